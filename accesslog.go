@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength ограничивает длину принятого от клиента идентификатора
+const maxRequestIDLength = 128
+
+type accessLogKey struct{}
+
+// accessLogEntry данные запроса, которые обработчики могут дополнить
+type accessLogEntry struct {
+	requestID string
+	deviceID  string
+}
+
+// validRequestID проверяет, что идентификатор клиента можно безопасно записать в журнал
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// requestID возвращает идентификатор текущего запроса
+func requestID(ctx context.Context) string {
+	if entry, ok := ctx.Value(accessLogKey{}).(*accessLogEntry); ok {
+		return entry.requestID
+	}
+	return ""
+}
+
+// setLogDeviceID добавляет device_id в запись журнала доступа, когда он
+// известен только после разбора тела запроса
+func setLogDeviceID(r *http.Request, deviceID string) {
+	if entry, ok := r.Context().Value(accessLogKey{}).(*accessLogEntry); ok {
+		entry.deviceID = deviceID
+	}
+}
+
+// accessLogMiddleware присваивает запросу X-Request-ID (или берет его из
+// запроса), возвращает его в ответе и пишет структурированную запись журнала.
+// При enabled=false идентификаторы присваиваются, но журнал не пишется.
+func accessLogMiddleware(enabled bool) mux.MiddlewareFunc {
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+
+			id := r.Header.Get(requestIDHeader)
+			if !validRequestID(id) {
+				id = newID()
+			}
+			entry := &accessLogEntry{requestID: id, deviceID: mux.Vars(r)["device_id"]}
+			if entry.deviceID == "" {
+				entry.deviceID = r.URL.Query().Get("device_id")
+			}
+			w.Header().Set(requestIDHeader, id)
+
+			recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), accessLogKey{}, entry)))
+
+			if !enabled {
+				return
+			}
+			attrs := []slog.Attr{
+				slog.String("request_id", id),
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.Int("status", recorder.status),
+				slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+				slog.Int64("request_bytes", r.ContentLength),
+				slog.Int("response_bytes", recorder.bytes),
+				slog.String("remote_addr", r.RemoteAddr),
+			}
+			if entry.deviceID != "" {
+				attrs = append(attrs, slog.String("device_id", entry.deviceID))
+			}
+			logger.LogAttrs(r.Context(), slog.LevelInfo, "http request", attrs...)
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/mux"
+)
+
+// DeviceBufferInfo описывает состояние буфера одного устройства
+type DeviceBufferInfo struct {
+	DeviceID    string                `json:"device_id"`
+	MemoryBytes int                   `json:"memory_bytes"`
+	Fields      map[string]FieldStats `json:"fields"`
+}
+
+// AdminBufferHandler возвращает состояние буфера по всем устройствам
+func (s *Service) AdminBufferHandler(w http.ResponseWriter, r *http.Request) {
+	devices := s.metricsBuffer.Devices()
+	sort.Strings(devices)
+	window, maxSize := s.metricsBuffer.Limits()
+	s.configMu.RLock()
+	memoryLimit := s.config.Buffer.MemoryLimitMB << 20
+	s.configMu.RUnlock()
+
+	infos := make([]DeviceBufferInfo, 0, len(devices))
+	totalBytes := 0
+	for _, deviceID := range devices {
+		stats, exists := s.metricsBuffer.DeviceStats(deviceID)
+		if !exists {
+			// Устройство сброшено между вызовами
+			continue
+		}
+		memory := s.metricsBuffer.MemoryUsage(deviceID)
+		totalBytes += memory
+		infos = append(infos, DeviceBufferInfo{
+			DeviceID:    deviceID,
+			MemoryBytes: memory,
+			Fields:      stats,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"window_size":        window,
+		"max_size":           maxSize,
+		"device_count":       len(infos),
+		"memory_bytes":       totalBytes,
+		"memory_limit_bytes": memoryLimit,
+		"devices":            infos,
+	})
+}
+
+// AdminResetBufferHandler сбрасывает окно устройства и состояние детекторов.
+// Значения окна перемещаются в корзину и могут быть восстановлены.
+func (s *Service) AdminResetBufferHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID := mux.Vars(r)["device_id"]
+	snapshot, exists := s.metricsBuffer.Take(deviceID)
+	if !exists {
+		http.Error(w, "device not found", http.StatusNotFound)
+		return
+	}
+	for _, detector := range s.activeDetectors() {
+		detector.Reset(deviceID)
+	}
+	s.shadow.Reset(deviceID)
+
+	entry := s.trash.Put(TrashKindBuffer, deviceID, func() {
+		s.metricsBuffer.Restore(deviceID, snapshot)
+	})
+	log.Printf("Buffer reset for device %s (trash id %s)", deviceID, entry.ID)
+
+	writeTrashResponse(w, "reset", entry)
+}
+
+// AdminDeleteDeviceHandler удаляет окно и историю аномалий устройства с возможностью отмены
+func (s *Service) AdminDeleteDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID := mux.Vars(r)["device_id"]
+	snapshot, exists := s.metricsBuffer.Take(deviceID)
+	anomalies := s.anomalies.RemoveDevice(deviceID)
+	if !exists && len(anomalies) == 0 {
+		http.Error(w, "device not found", http.StatusNotFound)
+		return
+	}
+	for _, detector := range s.activeDetectors() {
+		detector.Reset(deviceID)
+	}
+	s.shadow.Reset(deviceID)
+	s.sketches.Remove(deviceID)
+	s.calibration.Forget(deviceID)
+	s.slas.Forget(deviceID)
+	s.batches.Forget(deviceID)
+
+	entry := s.trash.Put(TrashKindDevice, deviceID, func() {
+		if snapshot != nil {
+			s.metricsBuffer.Restore(deviceID, snapshot)
+		}
+		s.anomalies.Restore(anomalies)
+	})
+	log.Printf("Data deleted for device %s (trash id %s)", deviceID, entry.ID)
+
+	writeTrashResponse(w, "deleted", entry)
+}
+
+// AdminTrashHandler возвращает список восстановимых удалений
+func (s *Service) AdminTrashHandler(w http.ResponseWriter, r *http.Request) {
+	entries := s.trash.List()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"count":   len(entries),
+		"entries": entries,
+	})
+}
+
+// AdminUndoHandler восстанавливает данные из корзины
+func (s *Service) AdminUndoHandler(w http.ResponseWriter, r *http.Request) {
+	entry, exists := s.trash.Restore(mux.Vars(r)["id"])
+	if !exists {
+		http.Error(w, "trash entry not found or expired", http.StatusNotFound)
+		return
+	}
+	log.Printf("Restored %s data for device %s (trash id %s)", entry.Kind, entry.DeviceID, entry.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "restored",
+		"entry":  entry,
+	})
+}
+
+func writeTrashResponse(w http.ResponseWriter, status string, entry TrashEntry) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":     status,
+		"device_id":  entry.DeviceID,
+		"trash_id":   entry.ID,
+		"expires_at": entry.ExpiresAt,
+		"undo":       "/api/admin/trash/" + entry.ID + "/undo",
+	})
+}
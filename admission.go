@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime/metrics"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Причины отказа в приеме
+const (
+	ShedReasonQueue  = "queue"
+	ShedReasonMemory = "memory"
+)
+
+// heapObjectsMetric объем занятых объектами страниц кучи
+const heapObjectsMetric = "/memory/classes/heap/objects:bytes"
+
+var (
+	shedRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "highload_shed_requests_total",
+			Help: "Total number of metrics rejected by admission control under overload by source and reason (queue, memory)",
+		},
+		[]string{"source", "reason"},
+	)
+
+	admissionShedding = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "highload_admission_shedding",
+		Help: "1 while admission control rejects metrics of non-critical devices, 0 otherwise",
+	})
+)
+
+// AdmissionStatus последний замер контроля приема
+type AdmissionStatus struct {
+	Shedding bool `json:"shedding"`
+	// Reason причина ограничения: queue или memory
+	Reason     string  `json:"reason,omitempty"`
+	Saturation float64 `json:"saturation"`
+	HeapMB     float64 `json:"heap_mb"`
+	SampledAt  int64   `json:"sampled_at"`
+}
+
+// AdmissionController отклоняет метрики некритичных устройств, пока
+// загрузка конвейера или куча выше порогов: лучше сразу ответить 503, чем
+// принять метрику и потерять ее или упасть по памяти позже. Замеры идут с
+// периодом lb_health.sample_interval, решение по запросу — без вычислений.
+type AdmissionController struct {
+	service *Service
+
+	mu       sync.Mutex
+	cfg      AdmissionConfig
+	critical map[string]bool
+	status   AdmissionStatus
+}
+
+func NewAdmissionController(service *Service, cfg AdmissionConfig) *AdmissionController {
+	ac := &AdmissionController{service: service}
+	ac.Configure(cfg)
+	return ac
+}
+
+// Configure применяет пороги и список критичных устройств
+func (ac *AdmissionController) Configure(cfg AdmissionConfig) {
+	critical := make(map[string]bool, len(cfg.CriticalDevices))
+	for _, deviceID := range cfg.CriticalDevices {
+		critical[deviceID] = true
+	}
+
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	ac.cfg = cfg
+	ac.critical = critical
+}
+
+// Run периодически замеряет загрузку и кучу
+func (ac *AdmissionController) Run() {
+	sample := []metrics.Sample{{Name: heapObjectsMetric}}
+	for {
+		metrics.Read(sample)
+		var heap uint64
+		if sample[0].Value.Kind() == metrics.KindUint64 {
+			heap = sample[0].Value.Uint64()
+		}
+		ac.sample(ac.service.lb.Status().Saturation, heap)
+		time.Sleep(ac.service.lb.config().SampleInterval)
+	}
+}
+
+// sample обновляет состояние по замеру
+func (ac *AdmissionController) sample(saturation float64, heap uint64) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	cfg := ac.cfg
+
+	status := AdmissionStatus{
+		Saturation: saturation,
+		HeapMB:     float64(heap) / (1 << 20),
+		SampledAt:  time.Now().Unix(),
+	}
+	switch {
+	case !cfg.Enabled:
+	case saturation >= cfg.QueueSaturation:
+		status.Reason = ShedReasonQueue
+	case cfg.MemoryLimitMB > 0 && heap >= uint64(cfg.MemoryLimitMB)<<20:
+		status.Reason = ShedReasonMemory
+	}
+	status.Shedding = status.Reason != ""
+	ac.status = status
+
+	shedding := 0.0
+	if status.Shedding {
+		shedding = 1
+	}
+	admissionShedding.Set(shedding)
+}
+
+// Admit сообщает, принимать ли метрику устройства; отказ учитывается в
+// highload_shed_requests_total
+func (ac *AdmissionController) Admit(source, deviceID string) bool {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if !ac.status.Shedding || ac.critical[deviceID] {
+		return true
+	}
+	shedRequests.WithLabelValues(source, ac.status.Reason).Inc()
+	return false
+}
+
+// RetryAfter возвращает значение заголовка Retry-After в секундах
+func (ac *AdmissionController) RetryAfter() string {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	return strconv.Itoa(int(ac.cfg.RetryAfter.Seconds()))
+}
+
+// Status возвращает последний замер
+func (ac *AdmissionController) Status() AdmissionStatus {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	return ac.status
+}
+
+// AdminAdmissionHandler возвращает пороги и состояние контроля приема
+func (s *Service) AdminAdmissionHandler(w http.ResponseWriter, r *http.Request) {
+	s.configMu.RLock()
+	cfg := s.config.Admission
+	s.configMu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled":          cfg.Enabled,
+		"queue_saturation": cfg.QueueSaturation,
+		"memory_limit_mb":  cfg.MemoryLimitMB,
+		"critical_devices": len(cfg.CriticalDevices),
+		"status":           s.admission.Status(),
+	})
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// maxAggregateBuckets ограничивает число интервалов ответа: неделя с шагом в минуту
+const maxAggregateBuckets = 7 * 24 * 60
+
+// maxRollupReads ограничивает число агрегатов Redis, читаемых одним запросом
+const maxRollupReads = 100000
+
+// Функции агрегации /api/aggregate
+const (
+	AggregateAvg   = "avg"
+	AggregateMin   = "min"
+	AggregateMax   = "max"
+	AggregateSum   = "sum"
+	AggregateCount = "count"
+)
+
+// Источники данных /api/aggregate
+const (
+	AggregateSourceRollups = "rollups"
+	AggregateSourceBuffer  = "buffer"
+)
+
+// aggregate count/sum/min/max значений интервала
+type aggregate struct {
+	count    int64
+	sum      float64
+	min, max float64
+}
+
+func (a *aggregate) add(value float64) {
+	a.merge(aggregate{count: 1, sum: value, min: value, max: value})
+}
+
+func (a *aggregate) merge(other aggregate) {
+	if other.count == 0 {
+		return
+	}
+	if a.count == 0 {
+		*a = other
+		return
+	}
+	a.count += other.count
+	a.sum += other.sum
+	a.min = math.Min(a.min, other.min)
+	a.max = math.Max(a.max, other.max)
+}
+
+func (a aggregate) value(fn string) float64 {
+	switch fn {
+	case AggregateMin:
+		return a.min
+	case AggregateMax:
+		return a.max
+	case AggregateSum:
+		return a.sum
+	case AggregateCount:
+		return float64(a.count)
+	default:
+		return a.sum / float64(a.count)
+	}
+}
+
+// AggregateBucket значение функции на интервале [Start, Start+step)
+type AggregateBucket struct {
+	Start int64   `json:"start"`
+	Value float64 `json:"value"`
+	Count int64   `json:"count"`
+}
+
+// Buckets читает агрегаты интервалов поля устройства, начинающихся в [from, to]
+func (ra *RollupAggregator) Buckets(ctx context.Context, deviceID, field string, from, to int64) (map[int64]aggregate, error) {
+	step := int64(ra.cfg.Resolution / time.Second)
+	pipe := ra.redis.Pipeline()
+	cmds := make(map[int64]*redis.StringStringMapCmd)
+	for start := ra.bucketStart(from); start <= to; start += step {
+		cmds[start] = pipe.HGetAll(ctx, ra.bucketKey(deviceID, field, start))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	buckets := make(map[int64]aggregate)
+	for start, cmd := range cmds {
+		values := cmd.Val()
+		count, _ := strconv.ParseInt(values["count"], 10, 64)
+		if count == 0 {
+			continue
+		}
+		a := aggregate{count: count}
+		a.sum, _ = strconv.ParseFloat(values["sum"], 64)
+		a.min, _ = strconv.ParseFloat(values["min"], 64)
+		a.max, _ = strconv.ParseFloat(values["max"], 64)
+		buckets[start] = a
+	}
+	return buckets, nil
+}
+
+// AggregateHandler возвращает значения функции fn по интервалам step для
+// поля устройства за [from, to]. Если агрегаты интервалов включены и step
+// кратен их разрешению, данные берутся из них, иначе — из буфера.
+func (s *Service) AggregateHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	deviceID := query.Get("device_id")
+	field := query.Get("field")
+	if deviceID == "" || field == "" {
+		http.Error(w, "device_id and field are required", http.StatusBadRequest)
+		return
+	}
+	if !validFieldName(field) {
+		http.Error(w, "invalid field name", http.StatusBadRequest)
+		return
+	}
+
+	fn := query.Get("fn")
+	switch fn {
+	case "":
+		fn = AggregateAvg
+	case AggregateAvg, AggregateMin, AggregateMax, AggregateSum, AggregateCount:
+	default:
+		http.Error(w, "fn must be avg, min, max, sum or count", http.StatusBadRequest)
+		return
+	}
+
+	step := time.Minute
+	if raw := query.Get("step"); raw != "" {
+		parsed, err := time.ParseDuration(raw)
+		if err != nil || parsed < time.Second || parsed%time.Second != 0 {
+			http.Error(w, "step must be a whole number of seconds, at least 1s", http.StatusBadRequest)
+			return
+		}
+		step = parsed
+	}
+	stepSec := int64(step / time.Second)
+
+	to := time.Now().Unix()
+	if raw := query.Get("to"); raw != "" {
+		parsed, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			http.Error(w, "to must be a unix timestamp", http.StatusBadRequest)
+			return
+		}
+		to = parsed
+	}
+	from := to - int64(time.Hour/time.Second)
+	if raw := query.Get("from"); raw != "" {
+		parsed, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			http.Error(w, "from must be a unix timestamp", http.StatusBadRequest)
+			return
+		}
+		from = parsed
+	}
+	if from > to {
+		http.Error(w, "from must not be after to", http.StatusBadRequest)
+		return
+	}
+
+	// Выравниваем начало по границе интервала
+	from -= from % stepSec
+	if (to-from)/stepSec+1 > maxAggregateBuckets {
+		http.Error(w, "too many buckets, increase step or narrow the range", http.StatusBadRequest)
+		return
+	}
+
+	merged := make(map[int64]*aggregate)
+	bucketOf := func(start int64) *aggregate {
+		start -= start % stepSec
+		a, ok := merged[start]
+		if !ok {
+			a = &aggregate{}
+			merged[start] = a
+		}
+		return a
+	}
+
+	source := AggregateSourceBuffer
+	rollups := s.rollups.cfg
+	if rollups.Enabled && step%rollups.Resolution == 0 {
+		source = AggregateSourceRollups
+		// Агрегаты старше retention уже удалены, их не читаем
+		readFrom := max(from, time.Now().Add(-rollups.Retention-rollups.Resolution).Unix())
+		if (to-readFrom)/int64(rollups.Resolution/time.Second) > maxRollupReads {
+			http.Error(w, "range is too wide for rollups, narrow it", http.StatusBadRequest)
+			return
+		}
+		buckets, err := s.rollups.Buckets(r.Context(), deviceID, field, readFrom, to)
+		if err != nil {
+			http.Error(w, "failed to read rollups: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		for start, a := range buckets {
+			bucketOf(start).merge(a)
+		}
+	} else {
+		for _, point := range s.metricsBuffer.Points(deviceID, field) {
+			if point.Timestamp >= from && point.Timestamp <= to {
+				bucketOf(point.Timestamp).add(point.Value)
+			}
+		}
+	}
+
+	buckets := make([]AggregateBucket, 0, len(merged))
+	for start := from; start <= to; start += stepSec {
+		if a, ok := merged[start]; ok {
+			buckets = append(buckets, AggregateBucket{Start: start, Value: a.value(fn), Count: a.count})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"device_id": deviceID,
+		"field":     field,
+		"fn":        fn,
+		"step":      step.String(),
+		"from":      from,
+		"to":        to,
+		"source":    source,
+		"buckets":   buckets,
+	})
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// alertGroupDevicesShown число устройств, перечисляемых в сводке группы
+const alertGroupDevicesShown = 10
+
+var alertGroupsSent = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "highload_alert_groups_total",
+		Help: "Total number of grouped anomaly notifications flushed by notifier and batching rule",
+	},
+	[]string{"notifier", "rule"},
+)
+
+// AlertGroup аномалии, накопленные правилом группировки для одного канала
+type AlertGroup struct {
+	Rule      string            `json:"rule"`
+	Since     int64             `json:"since"`
+	Until     int64             `json:"until"`
+	Severity  string            `json:"severity"`
+	Summary   string            `json:"summary"`
+	Devices   []string          `json:"devices"`
+	Anomalies []AnalyticsResult `json:"anomalies"`
+}
+
+// GroupNotifier уведомитель, умеющий отправить группу одним сообщением.
+// Остальным уведомителям группа передается пакетом через Notify.
+type GroupNotifier interface {
+	NotifyGroup(ctx context.Context, group AlertGroup) error
+}
+
+// pendingAlertGroup группа, ожидающая окончания окна
+type pendingAlertGroup struct {
+	notifier Notifier
+	rule     AlertBatchRule
+	opened   time.Time
+	results  []AnalyticsResult
+}
+
+// matches сообщает, относится ли аномалия канала notifier к правилу
+func (r AlertBatchRule) matches(notifier string, result AnalyticsResult) bool {
+	return (len(r.Notifiers) == 0 || containsString(r.Notifiers, notifier)) &&
+		(len(r.Types) == 0 || containsString(r.Types, result.Type)) &&
+		(len(r.Severities) == 0 || containsString(r.Severities, result.Severity))
+}
+
+// SetBatching заменяет правила группировки. Уже открытые группы отправляются
+// по правилам, с которыми были открыты.
+func (d *AlertDispatcher) SetBatching(rules []AlertBatchRule) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.batching = rules
+}
+
+// batchRule возвращает первое правило группировки, подходящее аномалии канала
+func (d *AlertDispatcher) batchRule(notifier string, result AnalyticsResult) (AlertBatchRule, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for _, rule := range d.batching {
+		if rule.matches(notifier, result) {
+			return rule, true
+		}
+	}
+	return AlertBatchRule{}, false
+}
+
+// hold добавляет аномалию в группу правила; группа, набравшая max_size,
+// отправляется сразу. Вызывается только из Run.
+func (d *AlertDispatcher) hold(notifier Notifier, rule AlertBatchRule, result AnalyticsResult) {
+	key := notifier.Name() + "/" + rule.Name
+	pending, ok := d.pending[key]
+	if !ok {
+		pending = &pendingAlertGroup{notifier: notifier, rule: rule, opened: time.Now()}
+		d.pending[key] = pending
+	}
+	pending.results = append(pending.results, result)
+	if rule.MaxSize > 0 && len(pending.results) >= rule.MaxSize {
+		delete(d.pending, key)
+		d.flushGroup(pending)
+	}
+}
+
+// flushDue отправляет группы, окно которых истекло
+func (d *AlertDispatcher) flushDue(now time.Time) {
+	for key, pending := range d.pending {
+		if now.Sub(pending.opened) >= pending.rule.Window {
+			delete(d.pending, key)
+			d.flushGroup(pending)
+		}
+	}
+}
+
+func (d *AlertDispatcher) flushGroup(pending *pendingAlertGroup) {
+	group := newAlertGroup(pending.rule.Name, pending.results)
+	notifier := pending.notifier
+	alertGroupsSent.WithLabelValues(notifier.Name(), group.Rule).Inc()
+	d.send(notifier, group.Anomalies, func(ctx context.Context) error {
+		if grouped, ok := notifier.(GroupNotifier); ok {
+			return grouped.NotifyGroup(ctx, group)
+		}
+		return notifier.Notify(ctx, group.Anomalies)
+	})
+}
+
+// newAlertGroup собирает группу и сводку: число аномалий и устройств, типы,
+// поля и число критичных
+func newAlertGroup(rule string, results []AnalyticsResult) AlertGroup {
+	group := AlertGroup{Rule: rule, Severity: SeverityWarning, Anomalies: results}
+	devices := make(map[string]bool)
+	types := make(map[string]int)
+	fields := make(map[string]bool)
+	critical := 0
+	for i, result := range results {
+		if i == 0 || result.Timestamp < group.Since {
+			group.Since = result.Timestamp
+		}
+		group.Until = max(group.Until, result.Timestamp)
+		if result.Severity == SeverityCritical {
+			critical++
+			group.Severity = SeverityCritical
+		}
+		if !devices[result.DeviceID] {
+			devices[result.DeviceID] = true
+			group.Devices = append(group.Devices, result.DeviceID)
+		}
+		types[result.Type]++
+		fields[result.Field] = true
+	}
+	sort.Strings(group.Devices)
+
+	typeNames := make([]string, 0, len(types))
+	for typ, count := range types {
+		typeNames = append(typeNames, fmt.Sprintf("%s×%d", typ, count))
+	}
+	sort.Strings(typeNames)
+	fieldNames := make([]string, 0, len(fields))
+	for field := range fields {
+		fieldNames = append(fieldNames, field)
+	}
+	sort.Strings(fieldNames)
+
+	shown := group.Devices
+	if len(shown) > alertGroupDevicesShown {
+		shown = shown[:alertGroupDevicesShown]
+	}
+	more := ""
+	if len(group.Devices) > len(shown) {
+		more = fmt.Sprintf(" and %d more", len(group.Devices)-len(shown))
+	}
+	group.Summary = fmt.Sprintf("%d anomalies (%d critical) on %d devices in %s: %s; fields %s; devices %s%s",
+		len(results), critical, len(group.Devices),
+		time.Duration(group.Until-group.Since)*time.Second,
+		strings.Join(typeNames, ", "), strings.Join(fieldNames, ", "), strings.Join(shown, ", "), more)
+	return group
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Уровни важности аномалий
+const (
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+)
+
+const (
+	alertBatchSize     = 100
+	alertFlushInterval = time.Second
+	alertMaxAttempts   = 3
+	// alertDeliveryLog число последних доставок, хранимых для пакетов инцидентов
+	alertDeliveryLog = 1000
+)
+
+var (
+	alertsSent = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "highload_alerts_sent_total",
+			Help: "Total number of anomaly alerts delivered by notifier and result",
+		},
+		[]string{"notifier", "result"},
+	)
+
+	alertsDropped = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "highload_alerts_dropped_total",
+			Help: "Total number of anomaly alerts dropped because the alert queue was full",
+		},
+	)
+)
+
+// Notifier доставляет обнаруженные аномалии во внешнюю систему
+type Notifier interface {
+	Name() string
+	Notify(ctx context.Context, anomalies []AnalyticsResult) error
+}
+
+// classifySeverity определяет важность аномалии по величине отклонения
+func classifySeverity(result AnalyticsResult, criticalZScore float64) string {
+	if result.Type == AnomalyTypeRule && result.Severity != "" {
+		// Важность задается правилом
+		return result.Severity
+	}
+	if result.Type == AnomalyTypeIQR && result.IQR != nil {
+		if iqrCritical(result) {
+			return SeverityCritical
+		}
+		return SeverityWarning
+	}
+	if result.Type == AnomalyTypeIsolation && result.Isolation != nil {
+		if isolationCritical(result) {
+			return SeverityCritical
+		}
+		return SeverityWarning
+	}
+	if math.Abs(result.ZScore) >= criticalZScore {
+		return SeverityCritical
+	}
+	return SeverityWarning
+}
+
+// AlertDelivery попытка доставки пакета аномалий одним уведомителем
+type AlertDelivery struct {
+	Notifier   string   `json:"notifier"`
+	At         int64    `json:"at"`
+	AnomalyIDs []string `json:"anomaly_ids"`
+	Attempts   int      `json:"attempts"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// AlertDispatcher асинхронно рассылает аномалии всем настроенным уведомителям,
+// группируя их в пакеты, чтобы медленный получатель не тормозил анализ.
+// Аномалии, подходящие правилу alerting.batching, копятся window и уходят в
+// канал одним сообщением со сводкой.
+type AlertDispatcher struct {
+	mu        sync.RWMutex
+	notifiers []Notifier
+	batching  []AlertBatchRule
+	queue     chan AnalyticsResult
+	timeout   time.Duration
+
+	// pending открытые группы по каналу и правилу; доступны только из Run
+	pending map[string]*pendingAlertGroup
+
+	logMu      sync.Mutex
+	deliveries []AlertDelivery // последние alertDeliveryLog доставок
+}
+
+func NewAlertDispatcher(notifiers []Notifier, batching []AlertBatchRule, queueSize int, timeout time.Duration) *AlertDispatcher {
+	return &AlertDispatcher{
+		notifiers: notifiers,
+		batching:  batching,
+		queue:     make(chan AnalyticsResult, queueSize),
+		timeout:   timeout,
+		pending:   make(map[string]*pendingAlertGroup),
+	}
+}
+
+// SetNotifiers заменяет набор уведомителей (при перезагрузке конфигурации).
+// Новые уведомители инцидентов перенимают открытые инциденты прежних.
+func (d *AlertDispatcher) SetNotifiers(notifiers []Notifier) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, notifier := range notifiers {
+		incidents, ok := notifier.(*IncidentNotifier)
+		if !ok {
+			continue
+		}
+		for _, previous := range d.notifiers {
+			if old, ok := previous.(*IncidentNotifier); ok && old.Name() == incidents.Name() {
+				incidents.Adopt(old)
+			}
+		}
+	}
+	d.notifiers = notifiers
+}
+
+func (d *AlertDispatcher) currentNotifiers() []Notifier {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.notifiers
+}
+
+// Enqueue ставит аномалию в очередь; при переполнении аномалия отбрасывается
+func (d *AlertDispatcher) Enqueue(result AnalyticsResult) {
+	select {
+	case d.queue <- result:
+	default:
+		alertsDropped.Inc()
+	}
+}
+
+// Run собирает пакеты из очереди и отправляет их
+func (d *AlertDispatcher) Run() {
+	ticker := time.NewTicker(alertFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]AnalyticsResult, 0, alertBatchSize)
+	for {
+		select {
+		case result := <-d.queue:
+			batch = append(batch, result)
+			if len(batch) < alertBatchSize {
+				continue
+			}
+		case now := <-ticker.C:
+			d.flushDue(now)
+			d.resolveIncidents(now)
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		d.deliver(batch)
+		batch = make([]AnalyticsResult, 0, alertBatchSize)
+	}
+}
+
+// deliver отправляет пакет каждому уведомителю; аномалии, подходящие правилам
+// группировки канала, откладываются в группы
+func (d *AlertDispatcher) deliver(batch []AnalyticsResult) {
+	defer recordConsumed("alerts", len(batch))
+	for _, notifier := range d.currentNotifiers() {
+		immediate := make([]AnalyticsResult, 0, len(batch))
+		for _, result := range batch {
+			if rule, ok := d.batchRule(notifier.Name(), result); ok {
+				d.hold(notifier, rule, result)
+				continue
+			}
+			immediate = append(immediate, result)
+		}
+		if len(immediate) == 0 {
+			continue
+		}
+		d.send(notifier, immediate, func(ctx context.Context) error {
+			return notifier.Notify(ctx, immediate)
+		})
+	}
+}
+
+// send доставляет аномалии уведомителю с повторами и записывает попытку в журнал
+func (d *AlertDispatcher) send(notifier Notifier, anomalies []AnalyticsResult, notify func(ctx context.Context) error) {
+	ids := make([]string, len(anomalies))
+	for i, result := range anomalies {
+		ids[i] = result.ID
+	}
+	var err error
+	attempt := 1
+	for ; attempt <= alertMaxAttempts; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+		err = notify(ctx)
+		cancel()
+		if err == nil {
+			break
+		}
+		time.Sleep(time.Duration(attempt) * 200 * time.Millisecond)
+	}
+	delivery := AlertDelivery{
+		Notifier:   notifier.Name(),
+		At:         time.Now().Unix(),
+		AnomalyIDs: ids,
+		Attempts:   min(attempt, alertMaxAttempts),
+	}
+	if err != nil {
+		delivery.Error = err.Error()
+	}
+	d.logDelivery(delivery)
+
+	if err != nil {
+		alertsSent.WithLabelValues(notifier.Name(), "failure").Add(float64(len(anomalies)))
+		log.Printf("Failed to deliver %d alerts via %s: %v", len(anomalies), notifier.Name(), err)
+		return
+	}
+	alertsSent.WithLabelValues(notifier.Name(), "success").Add(float64(len(anomalies)))
+}
+
+func (d *AlertDispatcher) logDelivery(delivery AlertDelivery) {
+	d.logMu.Lock()
+	defer d.logMu.Unlock()
+	d.deliveries = append(d.deliveries, delivery)
+	if len(d.deliveries) > alertDeliveryLog {
+		d.deliveries = append(d.deliveries[:0:0], d.deliveries[len(d.deliveries)-alertDeliveryLog:]...)
+	}
+}
+
+// Deliveries возвращает сохраненные доставки, в которые входила аномалия
+func (d *AlertDispatcher) Deliveries(anomalyID string) []AlertDelivery {
+	d.logMu.Lock()
+	defer d.logMu.Unlock()
+
+	result := make([]AlertDelivery, 0)
+	for _, delivery := range d.deliveries {
+		if containsString(delivery.AnomalyIDs, anomalyID) {
+			result = append(result, delivery)
+		}
+	}
+	return result
+}
+
+// buildNotifiers создает уведомители из конфигурации
+// notifierNames имена поддерживаемых уведомителей
+var notifierNames = []string{"alertmanager", "pagerduty", "opsgenie"}
+
+func buildNotifiers(cfg AlertingConfig) []Notifier {
+	notifiers := make([]Notifier, 0, 3)
+	if cfg.Alertmanager.URL != "" {
+		notifiers = append(notifiers, NewAlertmanagerNotifier(cfg.Alertmanager))
+	}
+	if cfg.PagerDuty.RoutingKey != "" || len(cfg.PagerDuty.Routes) > 0 {
+		notifiers = append(notifiers, NewPagerDutyNotifier(cfg.PagerDuty))
+	}
+	if cfg.Opsgenie.APIKey != "" || len(cfg.Opsgenie.Routes) > 0 {
+		notifiers = append(notifiers, NewOpsgenieNotifier(cfg.Opsgenie))
+	}
+	return notifiers
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// alertmanagerAlert формат алерта в Alertmanager API v2 (POST /api/v2/alerts)
+type alertmanagerAlert struct {
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	StartsAt     time.Time         `json:"startsAt"`
+	EndsAt       *time.Time        `json:"endsAt,omitempty"`
+	GeneratorURL string            `json:"generatorURL,omitempty"`
+}
+
+// AlertmanagerNotifier отправляет аномалии в Prometheus Alertmanager,
+// чтобы использовать существующую маршрутизацию, подавление и эскалацию
+type AlertmanagerNotifier struct {
+	endpoint     string
+	generatorURL string
+	client       *http.Client
+}
+
+func NewAlertmanagerNotifier(cfg AlertmanagerConfig) *AlertmanagerNotifier {
+	return &AlertmanagerNotifier{
+		endpoint:     strings.TrimRight(cfg.URL, "/") + "/api/v2/alerts",
+		generatorURL: cfg.GeneratorURL,
+		client:       &http.Client{},
+	}
+}
+
+func (n *AlertmanagerNotifier) Name() string { return "alertmanager" }
+
+func (n *AlertmanagerNotifier) Notify(ctx context.Context, anomalies []AnalyticsResult) error {
+	alerts := make([]alertmanagerAlert, 0, len(anomalies))
+	for _, anomaly := range anomalies {
+		alert := alertmanagerAlert{
+			Labels: map[string]string{
+				"alertname": "HighloadAnomaly",
+				"device_id": anomaly.DeviceID,
+				"field":     anomaly.Field,
+				"severity":  anomaly.Severity,
+				"type":      anomaly.Type,
+			},
+			Annotations: map[string]string{
+				"z_score":         strconv.FormatFloat(anomaly.ZScore, 'f', 2, 64),
+				"value":           strconv.FormatFloat(anomaly.Value, 'f', -1, 64),
+				"rolling_average": strconv.FormatFloat(anomaly.RollingAverage, 'f', 2, 64),
+				"anomaly_id":      anomaly.ID,
+				"probability":     strconv.FormatFloat(anomaly.Probability, 'f', 4, 64),
+				"summary": fmt.Sprintf("%s anomaly on %s: %s=%.2f",
+					anomaly.Type, anomaly.DeviceID, anomaly.Field, anomaly.Value),
+			},
+			StartsAt:     time.Unix(anomaly.Timestamp, 0).UTC(),
+			GeneratorURL: n.generatorURL,
+		}
+		if len(anomaly.Annotations) > 0 {
+			alert.Annotations["events"] = strings.Join(anomaly.Annotations, "; ")
+		}
+		alerts = append(alerts, alert)
+	}
+	return n.post(ctx, alerts)
+}
+
+// NotifyGroup отправляет группу одним алертом HighloadAnomalyGroup: сводка,
+// число аномалий и устройства — в аннотациях
+func (n *AlertmanagerNotifier) NotifyGroup(ctx context.Context, group AlertGroup) error {
+	ids := make([]string, len(group.Anomalies))
+	for i, anomaly := range group.Anomalies {
+		ids[i] = anomaly.ID
+	}
+	alert := alertmanagerAlert{
+		Labels: map[string]string{
+			"alertname": "HighloadAnomalyGroup",
+			"batch":     group.Rule,
+			"severity":  group.Severity,
+		},
+		Annotations: map[string]string{
+			"summary":     group.Summary,
+			"count":       strconv.Itoa(len(group.Anomalies)),
+			"devices":     strings.Join(group.Devices, ","),
+			"anomaly_ids": strings.Join(ids, ","),
+		},
+		StartsAt:     time.Unix(group.Since, 0).UTC(),
+		GeneratorURL: n.generatorURL,
+	}
+	return n.post(ctx, []alertmanagerAlert{alert})
+}
+
+// post отправляет алерты в Alertmanager API
+func (n *AlertmanagerNotifier) post(ctx context.Context, alerts []alertmanagerAlert) error {
+	body, err := json.Marshal(alerts)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("alertmanager returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Последние значения поля в ответе /api/analyze
+const (
+	defaultAnalyzePoints = 20
+	maxAnalyzePoints     = 1000
+)
+
+// analyzeRedisTimeout ограничивает чтение Redis в /api/analyze; по истечении
+// ответ строится по локальному буферу
+const analyzeRedisTimeout = 500 * time.Millisecond
+
+// cacheLatestScript запоминает метрику устройства, если она не старше уже
+// запомненной: метрики с опозданием не подменяют последние значения.
+// KEYS: hash последней метрики. ARGV: метка времени, метрика в JSON, TTL в
+// миллисекундах.
+var cacheLatestScript = redis.NewScript(`
+local ts = tonumber(redis.call("hget", KEYS[1], "ts") or "0")
+if tonumber(ARGV[1]) >= ts then
+	redis.call("hset", KEYS[1], "ts", ARGV[1], "metric", ARGV[2])
+end
+redis.call("pexpire", KEYS[1], ARGV[3])
+return 1`)
+
+// metricLatestKey ключ последней метрики устройства. Суффикс не число,
+// поэтому прогрев буфера ключ пропускает.
+func metricLatestKey(deviceID string) string {
+	return fmt.Sprintf("metric:%s:latest", deviceID)
+}
+
+// Analysis ответ /api/analyze: статистика окна поля, последние значения всех
+// полей устройства и последние значения поля
+type Analysis struct {
+	DeviceID       string  `json:"device_id"`
+	Field          string  `json:"field"`
+	RollingAverage float64 `json:"rolling_average"`
+	StdDev         float64 `json:"std_dev"`
+	Min            float64 `json:"min"`
+	Max            float64 `json:"max"`
+	Samples        int     `json:"samples"`
+	WindowSize     int     `json:"window_size"`
+	// ZScore отклонение последнего значения поля от среднего окна
+	ZScore        float64 `json:"z_score"`
+	LastTimestamp int64   `json:"last_timestamp"`
+	LastValue     float64 `json:"last_value"`
+	// Unit единицы поля из реестра полей
+	Unit string `json:"unit,omitempty"`
+	// LatestValues сырые значения последней метрики устройства, Units — их единицы
+	LatestValues    map[string]float64 `json:"latest_values"`
+	LatestTimestamp int64              `json:"latest_timestamp"`
+	Units           map[string]string  `json:"units,omitempty"`
+	// Points последние значения поля из буфера экземпляра, старые первыми
+	Points []Point `json:"points"`
+	// Source окно статистики: shared — общее окно реплик в Redis, local — буфер экземпляра
+	Source string `json:"source"`
+}
+
+// summarize заполняет статистику окна по значениям
+func (a *Analysis) summarize(values []float64) {
+	a.Samples = len(values)
+	a.RollingAverage, a.StdDev, a.Min, a.Max = 0, 0, 0, 0
+	if len(values) == 0 {
+		return
+	}
+	a.Min, a.Max = values[0], values[0]
+	var sum float64
+	for _, value := range values {
+		sum += value
+		a.Min = math.Min(a.Min, value)
+		a.Max = math.Max(a.Max, value)
+	}
+	a.RollingAverage = sum / float64(len(values))
+	var variance float64
+	for _, value := range values {
+		diff := value - a.RollingAverage
+		variance += diff * diff
+	}
+	a.StdDev = math.Sqrt(variance / float64(len(values)))
+}
+
+// analyze собирает ответ /api/analyze. Статистика считается по локальному
+// окну; общее окно реплик и последняя метрика устройства читаются из Redis
+// одним конвейером. При ошибке Redis остаются локальные значения.
+func (s *Service) analyze(ctx context.Context, deviceID, field string, limit int) Analysis {
+	window, _ := s.metricsBuffer.Limits()
+	analysis := Analysis{
+		DeviceID:     deviceID,
+		Field:        field,
+		WindowSize:   window,
+		LatestValues: make(map[string]float64),
+		Source:       "local",
+	}
+
+	points := s.metricsBuffer.Points(deviceID, field)
+	if len(points) > 0 {
+		last := points[len(points)-1]
+		analysis.LastTimestamp, analysis.LastValue = last.Timestamp, last.Value
+	}
+	analysis.summarize(s.metricsBuffer.WindowValues(deviceID, field))
+	if len(points) > limit {
+		points = points[len(points)-limit:]
+	}
+	analysis.Points = points
+
+	if stats, ok := s.metricsBuffer.DeviceStats(deviceID); ok {
+		for _, fieldStats := range stats {
+			if fieldStats.LastTimestamp > analysis.LatestTimestamp {
+				analysis.LatestTimestamp = fieldStats.LastTimestamp
+			}
+		}
+		// Последняя метрика могла содержать не все поля
+		for name, fieldStats := range stats {
+			if fieldStats.LastTimestamp == analysis.LatestTimestamp {
+				analysis.LatestValues[name] = fieldStats.LastValue
+			}
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, analyzeRedisTimeout)
+	defer cancel()
+	pipe := s.redis.Pipeline()
+	latest := pipe.HGet(ctx, metricLatestKey(deviceID), "metric")
+	var shared *redis.StringSliceCmd
+	if s.shared != nil {
+		shared = pipe.LRange(ctx, s.shared.keys(deviceID, field)[1], 0, -1)
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		log.Printf("Analyze of %s/%s uses local buffer: %v", deviceID, field, err)
+		analysis.zScore()
+		return analysis
+	}
+
+	var metric Metric
+	if data, err := latest.Result(); err == nil && json.Unmarshal([]byte(data), &metric) == nil &&
+		metric.Timestamp >= analysis.LatestTimestamp {
+		analysis.LatestTimestamp, analysis.LatestValues = metric.Timestamp, metric.Values
+		if value, ok := metric.Values[field]; ok && metric.Timestamp >= analysis.LastTimestamp {
+			analysis.LastTimestamp, analysis.LastValue = metric.Timestamp, value
+		}
+	}
+	if shared != nil {
+		if raw, err := shared.Result(); err == nil && len(raw) > 0 {
+			values := make([]float64, 0, len(raw))
+			for _, item := range raw {
+				if value, err := strconv.ParseFloat(item, 64); err == nil {
+					values = append(values, value)
+				}
+			}
+			analysis.summarize(values)
+			analysis.Source = "shared"
+		}
+	}
+	analysis.zScore()
+	return analysis
+}
+
+// zScore вычисляет отклонение последнего значения от среднего окна
+func (a *Analysis) zScore() {
+	a.ZScore = 0
+	if a.Samples > 0 && a.StdDev > 0 {
+		a.ZScore = (a.LastValue - a.RollingAverage) / a.StdDev
+	}
+}
+
+// writeAnalysis отвечает на /api/analyze без as_of
+func (s *Service) writeAnalysis(w http.ResponseWriter, r *http.Request, deviceID, field string) {
+	limit := defaultAnalyzePoints
+	if raw := r.URL.Query().Get("points"); raw != "" {
+		var err error
+		limit, err = strconv.Atoi(raw)
+		if err != nil || limit < 0 || limit > maxAnalyzePoints {
+			http.Error(w, "points must be between 0 and 1000", http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	analysis := s.analyze(r.Context(), deviceID, field, limit)
+	analysis.Unit = s.fields.Unit(deviceID, field)
+	analysis.Units = s.fields.Units(deviceID, analysis.LatestValues)
+	json.NewEncoder(w).Encode(analysis)
+}
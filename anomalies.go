@@ -0,0 +1,525 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	defaultHistoryLimit = 100
+	maxHistoryLimit     = 1000
+)
+
+// Статусы жизненного цикла аномалии
+const (
+	AnomalyStatusOpen         = "open"
+	AnomalyStatusAcknowledged = "acknowledged"
+	AnomalyStatusResolved     = "resolved"
+)
+
+var (
+	ErrAnomalyNotFound   = errors.New("anomaly not found")
+	ErrInvalidTransition = errors.New("invalid anomaly status transition")
+)
+
+var (
+	anomaliesEvicted = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "highload_anomalies_evicted_total",
+			Help: "Total number of anomalies evicted from history by retention policy",
+		},
+		[]string{"reason"},
+	)
+
+	anomaliesByStatus = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "highload_anomalies_by_status",
+			Help: "Current number of retained anomalies by lifecycle status (open means unacknowledged)",
+		},
+		[]string{"status"},
+	)
+)
+
+// AnomalyAction фиксирует, кто и когда подтвердил или закрыл аномалию
+type AnomalyAction struct {
+	User string `json:"user"`
+	Note string `json:"note,omitempty"`
+	At   int64  `json:"at"`
+}
+
+// AnomalyFilter условия выборки из истории; пустые значения не ограничивают выборку
+type AnomalyFilter struct {
+	DeviceID string
+	Field    string
+	Status   string
+	From     int64
+	To       int64
+}
+
+func (f AnomalyFilter) matches(item AnalyticsResult) bool {
+	if f.DeviceID != "" && item.DeviceID != f.DeviceID {
+		return false
+	}
+	if f.Field != "" && item.Field != f.Field {
+		return false
+	}
+	if f.Status != "" && item.Status != f.Status {
+		return false
+	}
+	if f.From != 0 && item.Timestamp < f.From {
+		return false
+	}
+	if f.To != 0 && item.Timestamp > f.To {
+		return false
+	}
+	return true
+}
+
+// AnomalyStore хранит историю обнаруженных аномалий в пределах окна хранения.
+// Дополнительно на каждое устройство хранится не более maxPerDevice последних аномалий.
+type AnomalyStore struct {
+	mu           sync.RWMutex
+	items        []AnalyticsResult
+	perDevice    map[string]int
+	retention    time.Duration
+	maxPerDevice int // 0 — без ограничения
+}
+
+func NewAnomalyStore(retention time.Duration, maxPerDevice int) *AnomalyStore {
+	return &AnomalyStore{
+		items:        make([]AnalyticsResult, 0),
+		perDevice:    make(map[string]int),
+		retention:    retention,
+		maxPerDevice: maxPerDevice,
+	}
+}
+
+// SetLimits меняет окно хранения и лимит на устройство и сразу применяет их
+func (as *AnomalyStore) SetLimits(retention time.Duration, maxPerDevice int) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	as.retention = retention
+	as.maxPerDevice = maxPerDevice
+	for deviceID := range as.perDevice {
+		as.enforceDeviceCap(deviceID)
+	}
+	as.prune(time.Now().Add(-as.retention).Unix())
+}
+
+// Add присваивает аномалии идентификатор и статус open, сохраняет ее
+// и удаляет записи старше окна хранения. Метку времени задает клиент, и
+// пакетные или опоздавшие аномалии приходят не по порядку, поэтому запись
+// вставляется на свое место: история всегда упорядочена по времени.
+// Аномалию, которую сразу удалили бы окно хранения или лимит устройства,
+// Add не сохраняет и идентификатор не присваивает; тогда второе значение false
+func (as *AnomalyStore) Add(result AnalyticsResult) (AnalyticsResult, bool) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	if result.Timestamp < time.Now().Add(-as.retention).Unix() {
+		anomaliesEvicted.WithLabelValues("age").Inc()
+		return result, false
+	}
+	i := sort.Search(len(as.items), func(i int) bool { return as.items[i].Timestamp > result.Timestamp })
+	if as.maxPerDevice > 0 && as.perDevice[result.DeviceID] >= as.maxPerDevice && !as.hasDeviceItem(result.DeviceID, i) {
+		// Опоздавшая аномалия старше всех сохраненных аномалий устройства
+		anomaliesEvicted.WithLabelValues("device_cap").Inc()
+		return result, false
+	}
+
+	if result.ID == "" {
+		result.ID = newID()
+	}
+	if result.Status == "" {
+		result.Status = AnomalyStatusOpen
+	}
+
+	as.items = append(as.items, AnalyticsResult{})
+	copy(as.items[i+1:], as.items[i:])
+	as.items[i] = result
+	as.remember(result)
+	as.enforceDeviceCap(result.DeviceID)
+	as.prune(time.Now().Add(-as.retention).Unix())
+	return result, true
+}
+
+// hasDeviceItem сообщает, есть ли у устройства аномалии среди первых n записей
+func (as *AnomalyStore) hasDeviceItem(deviceID string, n int) bool {
+	for _, item := range as.items[:n] {
+		if item.DeviceID == deviceID {
+			return true
+		}
+	}
+	return false
+}
+
+// prune удаляет аномалии старше cutoff — начало упорядоченной по времени истории
+func (as *AnomalyStore) prune(cutoff int64) {
+	drop := sort.Search(len(as.items), func(i int) bool { return as.items[i].Timestamp >= cutoff })
+	if drop == 0 {
+		return
+	}
+	for _, item := range as.items[:drop] {
+		as.forget(item)
+	}
+	anomaliesEvicted.WithLabelValues("age").Add(float64(drop))
+	kept := copy(as.items, as.items[drop:])
+	clear(as.items[kept:])
+	as.items = as.items[:kept]
+}
+
+// enforceDeviceCap удаляет самые старые аномалии устройства сверх лимита
+func (as *AnomalyStore) enforceDeviceCap(deviceID string) {
+	if as.maxPerDevice <= 0 {
+		return
+	}
+	excess := as.perDevice[deviceID] - as.maxPerDevice
+	if excess <= 0 {
+		return
+	}
+
+	kept := as.items[:0]
+	for _, item := range as.items {
+		if excess > 0 && item.DeviceID == deviceID {
+			excess--
+			as.forget(item)
+			anomaliesEvicted.WithLabelValues("device_cap").Inc()
+			continue
+		}
+		kept = append(kept, item)
+	}
+	as.items = kept
+}
+
+// remember и forget поддерживают счетчики по устройствам и статусам
+func (as *AnomalyStore) remember(item AnalyticsResult) {
+	as.perDevice[item.DeviceID]++
+	anomaliesByStatus.WithLabelValues(item.Status).Inc()
+}
+
+func (as *AnomalyStore) forget(item AnalyticsResult) {
+	as.perDevice[item.DeviceID]--
+	if as.perDevice[item.DeviceID] <= 0 {
+		delete(as.perDevice, item.DeviceID)
+	}
+	anomaliesByStatus.WithLabelValues(item.Status).Dec()
+}
+
+// Query возвращает аномалии, подходящие под фильтр, в порядке времени
+func (as *AnomalyStore) Query(filter AnomalyFilter) []AnalyticsResult {
+	as.mu.RLock()
+	defer as.mu.RUnlock()
+
+	result := make([]AnalyticsResult, 0)
+	for _, item := range as.items {
+		if filter.matches(item) {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// Scan передает fn аномалии, подходящие под фильтр, в порядке времени
+// порциями не больше chunk. Блокировка держится только на время копирования
+// порции, поэтому выгрузка большой истории не останавливает прием аномалий.
+// Аномалии, добавленные во время обхода, попадают в него, если их время не
+// раньше уже переданных.
+func (as *AnomalyStore) Scan(filter AnomalyFilter, chunk int, fn func([]AnalyticsResult) error) error {
+	started := false
+	var last int64
+	// seen переданные аномалии с меткой времени last: продолжение обхода
+	// начинается с этой метки и не должно повторять их
+	seen := make(map[string]bool)
+	for {
+		batch := as.scanChunk(filter, chunk, started, last, seen)
+		if len(batch) == 0 {
+			return nil
+		}
+		for _, item := range batch {
+			if !started || item.Timestamp != last {
+				started, last = true, item.Timestamp
+				clear(seen)
+			}
+			seen[item.ID] = true
+		}
+		if err := fn(batch); err != nil {
+			return err
+		}
+		if len(batch) < chunk {
+			return nil
+		}
+	}
+}
+
+func (as *AnomalyStore) scanChunk(filter AnomalyFilter, chunk int, started bool, last int64, seen map[string]bool) []AnalyticsResult {
+	as.mu.RLock()
+	defer as.mu.RUnlock()
+
+	// История упорядочена по времени (см. Add)
+	from := filter.From
+	if started {
+		from = last
+	}
+	start := sort.Search(len(as.items), func(i int) bool { return as.items[i].Timestamp >= from })
+
+	batch := make([]AnalyticsResult, 0, chunk)
+	for _, item := range as.items[start:] {
+		if filter.To != 0 && item.Timestamp > filter.To {
+			break
+		}
+		if started && item.Timestamp == last && seen[item.ID] {
+			continue
+		}
+		if filter.matches(item) {
+			batch = append(batch, item)
+			if len(batch) == chunk {
+				break
+			}
+		}
+	}
+	return batch
+}
+
+// Get возвращает аномалию по идентификатору
+func (as *AnomalyStore) Get(id string) (AnalyticsResult, bool) {
+	as.mu.RLock()
+	defer as.mu.RUnlock()
+
+	for _, item := range as.items {
+		if item.ID == id {
+			return item, true
+		}
+	}
+	return AnalyticsResult{}, false
+}
+
+// CountByDevice возвращает число хранимых аномалий по устройствам
+func (as *AnomalyStore) CountByDevice() map[string]int {
+	as.mu.RLock()
+	defer as.mu.RUnlock()
+
+	counts := make(map[string]int, len(as.perDevice))
+	for deviceID, n := range as.perDevice {
+		counts[deviceID] = n
+	}
+	return counts
+}
+
+// HasUnresolved сообщает, есть ли у устройства незакрытые аномалии
+func (as *AnomalyStore) HasUnresolved(deviceID string) bool {
+	as.mu.RLock()
+	defer as.mu.RUnlock()
+
+	for _, item := range as.items {
+		if item.DeviceID == deviceID && item.Status != AnomalyStatusResolved {
+			return true
+		}
+	}
+	return false
+}
+
+// Transition переводит аномалию в статус acknowledged или resolved.
+// Допустимы переходы open→acknowledged, open→resolved и acknowledged→resolved.
+func (as *AnomalyStore) Transition(id, status string, action AnomalyAction) (AnalyticsResult, error) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	for i := range as.items {
+		item := &as.items[i]
+		if item.ID != id {
+			continue
+		}
+
+		switch {
+		case status == AnomalyStatusAcknowledged && item.Status == AnomalyStatusOpen:
+			item.Acknowledged = &action
+		case status == AnomalyStatusResolved && item.Status != AnomalyStatusResolved:
+			item.Resolved = &action
+		default:
+			return *item, ErrInvalidTransition
+		}
+
+		anomaliesByStatus.WithLabelValues(item.Status).Dec()
+		item.Status = status
+		anomaliesByStatus.WithLabelValues(item.Status).Inc()
+		return *item, nil
+	}
+	return AnalyticsResult{}, ErrAnomalyNotFound
+}
+
+// SetFeedback сохраняет оценку аномалии и возвращает прежнюю метку
+// (пустую, если аномалию еще не оценивали)
+func (as *AnomalyStore) SetFeedback(id string, feedback AnomalyFeedback) (AnalyticsResult, string, error) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	for i := range as.items {
+		item := &as.items[i]
+		if item.ID != id {
+			continue
+		}
+		previous := ""
+		if item.Feedback != nil {
+			previous = item.Feedback.Label
+		}
+		item.Feedback = &feedback
+		return *item, previous, nil
+	}
+	return AnalyticsResult{}, "", ErrAnomalyNotFound
+}
+
+// RemoveDevice удаляет и возвращает все аномалии устройства
+func (as *AnomalyStore) RemoveDevice(deviceID string) []AnalyticsResult {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	removed := make([]AnalyticsResult, 0)
+	kept := as.items[:0]
+	for _, item := range as.items {
+		if item.DeviceID == deviceID {
+			removed = append(removed, item)
+			as.forget(item)
+			continue
+		}
+		kept = append(kept, item)
+	}
+	as.items = kept
+	return removed
+}
+
+// Restore возвращает ранее удаленные аномалии с сохранением порядка по времени
+func (as *AnomalyStore) Restore(items []AnalyticsResult) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	as.items = append(as.items, items...)
+	sort.SliceStable(as.items, func(i, j int) bool { return as.items[i].Timestamp < as.items[j].Timestamp })
+	for _, item := range items {
+		as.remember(item)
+	}
+	for _, item := range items {
+		as.enforceDeviceCap(item.DeviceID)
+	}
+	as.prune(time.Now().Add(-as.retention).Unix())
+}
+
+// AnomalyHistoryHandler возвращает сохраненные аномалии от новых к старым
+// с фильтрами device_id, field, status, from, to и limit
+func (s *Service) AnomalyHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter, err := parseAnomalyFilter(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultHistoryLimit
+	if raw := query.Get("limit"); raw != "" {
+		limit, err = strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > maxHistoryLimit {
+			http.Error(w, "limit must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+	}
+
+	items, total := s.anomalyHistory(filter, limit)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"total":     total,
+		"count":     len(items),
+		"anomalies": items,
+	})
+}
+
+// anomalyHistory возвращает до limit подходящих аномалий, новые первыми, и
+// общее число подходящих
+func (s *Service) anomalyHistory(filter AnomalyFilter, limit int) ([]AnalyticsResult, int) {
+	items := s.anomalies.Query(filter)
+	total := len(items)
+	for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+		items[i], items[j] = items[j], items[i]
+	}
+	if len(items) > limit {
+		items = items[:limit]
+	}
+	return items, total
+}
+
+// parseAnomalyFilter разбирает параметры device_id, field, status, from и to
+func parseAnomalyFilter(query url.Values) (AnomalyFilter, error) {
+	filter := AnomalyFilter{
+		DeviceID: query.Get("device_id"),
+		Field:    query.Get("field"),
+		Status:   query.Get("status"),
+	}
+	switch filter.Status {
+	case "", AnomalyStatusOpen, AnomalyStatusAcknowledged, AnomalyStatusResolved:
+	default:
+		return filter, fmt.Errorf("status must be open, acknowledged or resolved")
+	}
+
+	var err error
+	if raw := query.Get("from"); raw != "" {
+		if filter.From, err = strconv.ParseInt(raw, 10, 64); err != nil {
+			return filter, fmt.Errorf("from must be a unix timestamp")
+		}
+	}
+	if raw := query.Get("to"); raw != "" {
+		if filter.To, err = strconv.ParseInt(raw, 10, 64); err != nil {
+			return filter, fmt.Errorf("to must be a unix timestamp")
+		}
+	}
+	return filter, nil
+}
+
+// AnomalyAckHandler подтверждает аномалию: {"user": "...", "note": "..."}
+func (s *Service) AnomalyAckHandler(w http.ResponseWriter, r *http.Request) {
+	s.transitionAnomaly(w, r, AnomalyStatusAcknowledged)
+}
+
+// AnomalyResolveHandler закрывает аномалию: {"user": "...", "note": "..."}
+func (s *Service) AnomalyResolveHandler(w http.ResponseWriter, r *http.Request) {
+	s.transitionAnomaly(w, r, AnomalyStatusResolved)
+}
+
+func (s *Service) transitionAnomaly(w http.ResponseWriter, r *http.Request, status string) {
+	var action AnomalyAction
+	if err := json.NewDecoder(r.Body).Decode(&action); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if action.User == "" {
+		http.Error(w, "user is required", http.StatusBadRequest)
+		return
+	}
+	action.At = time.Now().Unix()
+
+	anomaly, err := s.anomalies.Transition(mux.Vars(r)["id"], status, action)
+	switch {
+	case errors.Is(err, ErrAnomalyNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, ErrInvalidTransition):
+		http.Error(w, "anomaly is already "+anomaly.Status, http.StatusConflict)
+		return
+	}
+	// Инцидент закрыт — возвращаем устройство в обычный режим сбора
+	if status == AnomalyStatusResolved && !s.anomalies.HasUnresolved(anomaly.DeviceID) {
+		s.sampling.Revert(anomaly.DeviceID)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(anomaly)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// anomaliesOutOfOrder добавляет аномалии так, как их шлют пакеты и опоздавшие
+// устройства: метки времени идут не по порядку поступления
+func anomaliesOutOfOrder(store *AnomalyStore) []int64 {
+	base := time.Now().Unix() - 600
+	offsets := []int64{50, 10, 40, 10, 0, 30, 20, 45, 5}
+	for i, offset := range offsets {
+		store.Add(AnalyticsResult{DeviceID: "dev", Field: "cpu", Timestamp: base + offset, Value: float64(i)})
+	}
+	timestamps := make([]int64, len(offsets))
+	for i, offset := range offsets {
+		timestamps[i] = base + offset
+	}
+	return timestamps
+}
+
+func TestAnomalyScanOutOfOrder(t *testing.T) {
+	store := NewAnomalyStore(time.Hour, 0)
+	timestamps := anomaliesOutOfOrder(store)
+
+	for _, chunk := range []int{1, 2, 4, 100} {
+		var got []AnalyticsResult
+		err := store.Scan(AnomalyFilter{}, chunk, func(batch []AnalyticsResult) error {
+			got = append(got, batch...)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(timestamps) {
+			t.Fatalf("chunk %d: scanned %d anomalies, want %d", chunk, len(got), len(timestamps))
+		}
+		seen := make(map[string]bool)
+		for i, item := range got {
+			if seen[item.ID] {
+				t.Fatalf("chunk %d: anomaly %s scanned twice", chunk, item.ID)
+			}
+			seen[item.ID] = true
+			if i > 0 && item.Timestamp < got[i-1].Timestamp {
+				t.Fatalf("chunk %d: timestamp %d after %d", chunk, item.Timestamp, got[i-1].Timestamp)
+			}
+		}
+	}
+
+	base := timestamps[4]
+	var ranged []AnalyticsResult
+	store.Scan(AnomalyFilter{From: base + 10, To: base + 40}, 2, func(batch []AnalyticsResult) error {
+		ranged = append(ranged, batch...)
+		return nil
+	})
+	// 10, 10, 20, 30, 40
+	if len(ranged) != 5 {
+		t.Fatalf("scanned %d anomalies in [from, to], want 5", len(ranged))
+	}
+}
+
+func TestAnomalyPruneOutOfOrder(t *testing.T) {
+	store := NewAnomalyStore(time.Hour, 0)
+	now := time.Now().Unix()
+	store.Add(AnalyticsResult{DeviceID: "dev", Timestamp: now})
+	store.Add(AnalyticsResult{DeviceID: "dev", Timestamp: now - 2*3600})
+	store.Add(AnalyticsResult{DeviceID: "dev", Timestamp: now - 60})
+
+	items := store.Query(AnomalyFilter{})
+	if len(items) != 2 || items[0].Timestamp != now-60 || items[1].Timestamp != now {
+		t.Fatalf("got %+v, want the two anomalies within retention in time order", items)
+	}
+	if got := store.CountByDevice()["dev"]; got != 2 {
+		t.Fatalf("device count %d, want 2", got)
+	}
+}
+
+func TestAnomalyExportOutOfOrder(t *testing.T) {
+	store := NewAnomalyStore(time.Hour, 0)
+	timestamps := anomaliesOutOfOrder(store)
+	s := &Service{anomalies: store}
+
+	base := timestamps[4]
+	target := fmt.Sprintf("/anomalies/export?format=csv&from=%d&to=%d", base+10, base+45)
+	rec := httptest.NewRecorder()
+	s.AnomalyExportHandler(rec, httptest.NewRequest("GET", target, nil))
+	records, err := csv.NewReader(rec.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 10, 10, 20, 30, 40, 45
+	if len(records) != 7 {
+		t.Fatalf("exported %d rows, want 6", len(records)-1)
+	}
+}
+
+func TestAnomalyAddEvictedOutOfOrder(t *testing.T) {
+	store := NewAnomalyStore(time.Hour, 2)
+	now := time.Now().Unix()
+	store.Add(AnalyticsResult{DeviceID: "dev", Timestamp: now - 60})
+	store.Add(AnalyticsResult{DeviceID: "dev", Timestamp: now})
+	store.Add(AnalyticsResult{DeviceID: "other", Timestamp: now - 600})
+
+	for _, late := range []AnalyticsResult{
+		{DeviceID: "dev", Timestamp: now - 120},
+		{DeviceID: "new", Timestamp: now - 2*3600},
+	} {
+		if result, ok := store.Add(late); ok || result.ID != "" {
+			t.Errorf("%+v: evicted anomaly stored as %q", late, result.ID)
+		}
+	}
+
+	result, ok := store.Add(AnalyticsResult{DeviceID: "dev", Timestamp: now - 30})
+	if !ok {
+		t.Fatal("anomaly within the cap was not stored")
+	}
+	if _, found := store.Get(result.ID); !found {
+		t.Fatalf("stored anomaly %s not found", result.ID)
+	}
+	if got := store.CountByDevice(); got["dev"] != 2 || got["other"] != 1 || len(got) != 2 {
+		t.Fatalf("device counts %v", got)
+	}
+}
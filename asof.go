@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// parseAsOf разбирает момент as_of: unix-время в секундах или RFC 3339
+func parseAsOf(raw string) (int64, error) {
+	if ts, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		if ts <= 0 {
+			return 0, fmt.Errorf("as_of must be a positive unix timestamp")
+		}
+		return ts, nil
+	}
+	t, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return 0, fmt.Errorf("as_of must be a unix timestamp or RFC 3339 time")
+	}
+	return t.Unix(), nil
+}
+
+// asOfParam возвращает as_of запроса; ok=false, если параметр не указан
+func asOfParam(r *http.Request) (int64, bool, error) {
+	raw := r.URL.Query().Get("as_of")
+	if raw == "" {
+		return 0, false, nil
+	}
+	asOf, err := parseAsOf(raw)
+	if err != nil {
+		return 0, false, err
+	}
+	if asOf > time.Now().Unix() {
+		return 0, false, fmt.Errorf("as_of must not be in the future")
+	}
+	return asOf, true, nil
+}
+
+// AsOfAnalysis то, что сервис знал о поле устройства в момент AsOf
+type AsOfAnalysis struct {
+	DeviceID       string  `json:"device_id"`
+	Field          string  `json:"field"`
+	AsOf           int64   `json:"as_of"`
+	RollingAverage float64 `json:"rolling_average"`
+	StdDev         float64 `json:"std_dev"`
+	Samples        int     `json:"samples"`
+	WindowSize     int     `json:"window_size"`
+	LastTimestamp  int64   `json:"last_timestamp"`
+	LastValue      float64 `json:"last_value"`
+	// Unit единицы поля из реестра полей
+	Unit string `json:"unit,omitempty"`
+	// HistoryFrom самая ранняя метка в буфере: более старой истории реконструкция не видит
+	HistoryFrom int64 `json:"history_from"`
+	// ConfigLoadedAt момент загрузки конфигурации, действовавшей в AsOf
+	ConfigLoadedAt int64 `json:"config_loaded_at"`
+	// Verdicts последний результат каждого детектора для значения не позже AsOf
+	Verdicts map[string]AnalyticsResult `json:"verdicts"`
+}
+
+// analyzeAsOf воспроизводит статистику окна и вердикты детекторов по данным,
+// поступившим не позже asOf, с конфигурацией, действовавшей в тот момент.
+// Детекторы прогреваются только историей буфера, поэтому для давних моментов
+// состояние с долгой памятью (CUSUM) может отличаться от исходного.
+func (s *Service) analyzeAsOf(deviceID, field string, asOf int64) (AsOfAnalysis, bool) {
+	snapshot := s.metricsBuffer.DeviceSnapshot(deviceID)
+	samples := samplesFromSnapshot(deviceID, snapshot, 0, asOf)
+
+	analysis := AsOfAnalysis{
+		DeviceID: deviceID,
+		Field:    field,
+		AsOf:     asOf,
+		Unit:     s.fields.Unit(deviceID, field),
+		Verdicts: make(map[string]AnalyticsResult),
+	}
+	for _, points := range snapshot {
+		if len(points) > 0 && (analysis.HistoryFrom == 0 || points[0].Timestamp < analysis.HistoryFrom) {
+			analysis.HistoryFrom = points[0].Timestamp
+		}
+	}
+
+	version, _ := s.configAt(asOf)
+	cfg := version.Config
+	analysis.ConfigLoadedAt = version.LoadedAt
+	analysis.WindowSize = cfg.Buffer.Window
+	critical := cfg.Alerting.CriticalZScore
+
+	buffer := replayDetectors(cfg.pipelineDetectors(), cfg.Buffer.Window, cfg.Buffer.MaxSize, samples,
+		func(detector Detector, result *AnalyticsResult) {
+			if result.Field != field {
+				return
+			}
+			if result.IsAnomaly {
+				result.Severity = classifySeverity(*result, critical)
+			}
+			analysis.Verdicts[detector.Name()] = *result
+		})
+
+	stats, ok := buffer.DeviceStats(deviceID)
+	fs, hasField := stats[field]
+	if !ok || !hasField {
+		return analysis, false
+	}
+	analysis.RollingAverage = fs.RollingAverage
+	analysis.StdDev = fs.StdDev
+	analysis.Samples = min(fs.Samples, cfg.Buffer.Window)
+	analysis.LastTimestamp = fs.LastTimestamp
+	analysis.LastValue = fs.LastValue
+	return analysis, true
+}
+
+// writeAsOfAnalysis отвечает на /api/analyze с параметром as_of
+func (s *Service) writeAsOfAnalysis(w http.ResponseWriter, deviceID, field string, asOf int64) {
+	analysis, ok := s.analyzeAsOf(deviceID, field, asOf)
+	if !ok {
+		http.Error(w, "no data for device field at as_of", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(analysis)
+}
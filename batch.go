@@ -0,0 +1,170 @@
+package main
+
+import (
+	"log"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	batchPending = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "highload_batch_pending_samples",
+		Help: "Number of samples from batch devices waiting for their batch to be evaluated",
+	})
+
+	batchEvaluations = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "highload_batch_evaluations_total",
+			Help: "Total number of device batches evaluated by trigger (settled, max_samples)",
+		},
+		[]string{"trigger"},
+	)
+)
+
+// stagedMetric метрика пакетного устройства, ожидающая оценки
+type stagedMetric struct {
+	metric Metric
+	fields map[string]float64
+}
+
+// pendingBatch накапливаемый пакет устройства
+type pendingBatch struct {
+	metrics    []stagedMetric
+	lastArrive time.Time
+}
+
+// BatchScheduler откладывает оценку устройств, которые выгружают метрики
+// пакетами (например, раз в час). Значения копятся, пока устройство не
+// замолчит на settle, после чего пакет оценивается целиком в порядке меток
+// времени: окна детекторов строятся по времени образцов, а не по моменту
+// поступления, и аномалии получают исходные метки времени.
+type BatchScheduler struct {
+	mu      sync.Mutex
+	cfg     BatchConfig
+	pending map[string]*pendingBatch // device_id -> пакет
+}
+
+func NewBatchScheduler(cfg BatchConfig) *BatchScheduler {
+	return &BatchScheduler{cfg: cfg, pending: make(map[string]*pendingBatch)}
+}
+
+// Configure применяет новый список пакетных устройств; уже накопленные
+// пакеты оцениваются по прежним правилам
+func (bs *BatchScheduler) Configure(cfg BatchConfig) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	bs.cfg = cfg
+}
+
+// matches сообщает, выгружает ли устройство метрики пакетами
+func (c BatchConfig) matches(deviceID string) bool {
+	if containsString(c.Devices, deviceID) {
+		return true
+	}
+	if c.DevicePattern != "" {
+		ok, _ := path.Match(c.DevicePattern, deviceID)
+		return ok
+	}
+	return false
+}
+
+// Stage откладывает метрику пакетного устройства и возвращает true; для
+// остальных устройств возвращает false
+func (bs *BatchScheduler) Stage(metric Metric, fields map[string]float64) bool {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if !bs.cfg.matches(metric.DeviceID) {
+		return false
+	}
+	batch, ok := bs.pending[metric.DeviceID]
+	if !ok {
+		batch = &pendingBatch{}
+		bs.pending[metric.DeviceID] = batch
+	}
+	batch.metrics = append(batch.metrics, stagedMetric{metric: metric, fields: fields})
+	batch.lastArrive = time.Now()
+	batchPending.Inc()
+	return true
+}
+
+// Forget отбрасывает накопленный пакет устройства
+func (bs *BatchScheduler) Forget(deviceID string) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if batch, ok := bs.pending[deviceID]; ok {
+		batchPending.Sub(float64(len(batch.metrics)))
+		delete(bs.pending, deviceID)
+	}
+}
+
+// Pending возвращает число отложенных значений всех пакетов
+func (bs *BatchScheduler) Pending() int {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	pending := 0
+	for _, batch := range bs.pending {
+		pending += len(batch.metrics)
+	}
+	return pending
+}
+
+// ready забирает пакеты, которые пора оценивать
+func (bs *BatchScheduler) ready(now time.Time) map[string][]stagedMetric {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	ready := make(map[string][]stagedMetric)
+	for deviceID, batch := range bs.pending {
+		switch {
+		case now.Sub(batch.lastArrive) >= bs.cfg.Settle:
+			batchEvaluations.WithLabelValues("settled").Inc()
+		case len(batch.metrics) >= bs.cfg.MaxSamples:
+			batchEvaluations.WithLabelValues("max_samples").Inc()
+		default:
+			continue
+		}
+		ready[deviceID] = batch.metrics
+		batchPending.Sub(float64(len(batch.metrics)))
+		delete(bs.pending, deviceID)
+	}
+	return ready
+}
+
+// Run периодически передает готовые пакеты в evaluate
+func (bs *BatchScheduler) Run(evaluate func(deviceID string, batch []stagedMetric)) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		for deviceID, batch := range bs.ready(now) {
+			evaluate(deviceID, batch)
+		}
+	}
+}
+
+// evaluateBatch последовательно учитывает и анализирует значения пакета в
+// порядке меток времени, чтобы каждое значение сравнивалось только с
+// предшествующими ему
+func (s *Service) evaluateBatch(deviceID string, batch []stagedMetric) {
+	sort.SliceStable(batch, func(i, j int) bool { return batch[i].metric.Timestamp < batch[j].metric.Timestamp })
+	start := time.Now()
+	for _, staged := range batch {
+		runRecovered("batch", func() {
+			if live := s.observeMetric(staged.metric, staged.fields); len(live) > 0 {
+				s.analyzeMetric(staged.metric, live)
+				s.ingestStatus.Record(staged.metric.IngestID, "analyzed", 1)
+			}
+		})
+	}
+	log.Printf("Evaluated batch of %d samples for device %s covering %s..%s in %s",
+		len(batch), deviceID,
+		time.Unix(batch[0].metric.Timestamp, 0).UTC().Format(time.RFC3339),
+		time.Unix(batch[len(batch)-1].metric.Timestamp, 0).UTC().Format(time.RFC3339),
+		time.Since(start).Round(time.Millisecond))
+}
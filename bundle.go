@@ -0,0 +1,236 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/yaml.v3"
+)
+
+// configHistorySize число последних версий конфигурации для пакетов инцидентов
+const configHistorySize = 20
+
+// configVersion конфигурация, действовавшая начиная с LoadedAt
+type configVersion struct {
+	LoadedAt int64
+	Config   *Config
+}
+
+// recordConfig делает cfg действующей конфигурацией и запоминает версию.
+// Вызывается под configMu.
+func (s *Service) recordConfig(cfg *Config) {
+	s.config = cfg
+	s.configHistory = append(s.configHistory, configVersion{LoadedAt: time.Now().Unix(), Config: cfg})
+	if len(s.configHistory) > configHistorySize {
+		s.configHistory = append(s.configHistory[:0:0], s.configHistory[len(s.configHistory)-configHistorySize:]...)
+	}
+}
+
+// configAt возвращает версию конфигурации, действовавшую в момент at, и все
+// перезагрузки после нее; если история короче, возвращается самая старая версия
+func (s *Service) configAt(at int64) (configVersion, []int64) {
+	s.configMu.RLock()
+	defer s.configMu.RUnlock()
+
+	version := s.configHistory[0]
+	var later []int64
+	for _, v := range s.configHistory {
+		if v.LoadedAt <= at {
+			version = v
+		} else {
+			later = append(later, v.LoadedAt)
+		}
+	}
+	return version, later
+}
+
+// TimelineEntry событие хронологии инцидента
+type TimelineEntry struct {
+	At      int64  `json:"at"`
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
+// BundleManifest описание содержимого пакета инцидента
+type BundleManifest struct {
+	AnomalyID      string   `json:"anomaly_id"`
+	DeviceID       string   `json:"device_id"`
+	GeneratedAt    int64    `json:"generated_at"`
+	ConfigLoadedAt int64    `json:"config_loaded_at"`
+	ConfigReloads  []int64  `json:"config_reloads_since,omitempty"`
+	Files          []string `json:"files"`
+	Missing        []string `json:"missing,omitempty"`
+}
+
+// bundleFile файл пакета
+type bundleFile struct {
+	name string
+	data []byte
+}
+
+// IncidentBundleHandler собирает архив tar.gz для разбора инцидента: аномалию,
+// сырые значения вокруг нее и текущее окно устройства, состояние детекторов,
+// действовавшую конфигурацию (без секретов), отправленные уведомления,
+// совпавшие внешние события и хронологию
+func (s *Service) IncidentBundleHandler(w http.ResponseWriter, r *http.Request) {
+	anomaly, ok := s.anomalies.Get(mux.Vars(r)["id"])
+	if !ok {
+		http.Error(w, ErrAnomalyNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	manifest := BundleManifest{
+		AnomalyID:   anomaly.ID,
+		DeviceID:    anomaly.DeviceID,
+		GeneratedAt: time.Now().Unix(),
+	}
+	var files []bundleFile
+	add := func(name string, v interface{}) {
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			manifest.Missing = append(manifest.Missing, name)
+			return
+		}
+		files = append(files, bundleFile{name: name, data: data})
+	}
+
+	add("anomaly.json", anomaly)
+
+	forensic, hasForensic := s.forensics.Get(r.Context(), anomaly.ID)
+	if hasForensic {
+		add("metrics/forensics.json", forensic)
+	} else {
+		manifest.Missing = append(manifest.Missing, "metrics/forensics.json")
+	}
+	add("metrics/buffer.json", s.metricsBuffer.DeviceSnapshot(anomaly.DeviceID))
+	if burst, ok := s.sampling.Burst(anomaly.DeviceID); ok {
+		add("metrics/highres.json", burst)
+	}
+
+	detectors := make(map[string]interface{})
+	for _, detector := range s.activeDetectors() {
+		if reporter, ok := detector.(StateReporter); ok {
+			detectors[detector.Name()] = reporter.State(anomaly.DeviceID)
+		}
+	}
+	add("detectors.json", detectors)
+
+	version, reloads := s.configAt(anomaly.Timestamp)
+	manifest.ConfigLoadedAt = version.LoadedAt
+	manifest.ConfigReloads = reloads
+	if view, err := configView(version.Config); err == nil {
+		if data, err := yaml.Marshal(view); err == nil {
+			files = append(files, bundleFile{name: "config.yaml", data: data})
+		}
+	}
+
+	deliveries := s.alerts.Deliveries(anomaly.ID)
+	add("notifications.json", deliveries)
+
+	events := s.events.ByIDs(anomaly.Events)
+	add("events.json", events)
+	add("timeline.json", incidentTimeline(anomaly, forensic, version, reloads, deliveries, events))
+
+	for _, f := range files {
+		manifest.Files = append(manifest.Files, f.name)
+	}
+	add("manifest.json", manifest)
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="incident-%s.tar.gz"`, anomaly.ID))
+	if err := writeBundle(w, "incident-"+anomaly.ID, files); err != nil {
+		log.Printf("Failed to write incident bundle %s: %v", anomaly.ID, err)
+	}
+}
+
+// incidentTimeline упорядочивает по времени все известные события инцидента
+func incidentTimeline(anomaly AnalyticsResult, forensic *ForensicSnapshot, version configVersion,
+	reloads []int64, deliveries []AlertDelivery, events []ExternalEvent) []TimelineEntry {
+	timeline := []TimelineEntry{{
+		At:      version.LoadedAt,
+		Kind:    "config",
+		Message: "configuration in effect loaded",
+	}}
+	for _, at := range reloads {
+		timeline = append(timeline, TimelineEntry{At: at, Kind: "config", Message: "configuration reloaded"})
+	}
+	for _, event := range events {
+		timeline = append(timeline, TimelineEntry{At: event.Start, Kind: "event", Message: fmt.Sprintf("%s started: %s", event.Type, event.Title)})
+		if event.End != 0 {
+			timeline = append(timeline, TimelineEntry{At: event.End, Kind: "event", Message: fmt.Sprintf("%s ended: %s", event.Type, event.Title)})
+		}
+	}
+	if anomaly.OnsetTimestamp != 0 {
+		timeline = append(timeline, TimelineEntry{At: anomaly.OnsetTimestamp, Kind: "anomaly", Message: "change onset"})
+	}
+	timeline = append(timeline, TimelineEntry{
+		At:      anomaly.Timestamp,
+		Kind:    "anomaly",
+		Message: fmt.Sprintf("%s %s anomaly on %s=%.2f", anomaly.Severity, anomaly.Type, anomaly.Field, anomaly.Value),
+	})
+	if forensic != nil {
+		timeline = append(timeline, TimelineEntry{At: forensic.CapturedAt, Kind: "forensics", Message: "forensic snapshot captured"})
+	}
+	for _, delivery := range deliveries {
+		message := fmt.Sprintf("notified via %s", delivery.Notifier)
+		if delivery.Error != "" {
+			message = fmt.Sprintf("notification via %s failed after %d attempts: %s", delivery.Notifier, delivery.Attempts, delivery.Error)
+		}
+		timeline = append(timeline, TimelineEntry{At: delivery.At, Kind: "notification", Message: message})
+	}
+	if a := anomaly.Acknowledged; a != nil {
+		timeline = append(timeline, TimelineEntry{At: a.At, Kind: "lifecycle", Message: actionMessage("acknowledged", a)})
+	}
+	if a := anomaly.Resolved; a != nil {
+		timeline = append(timeline, TimelineEntry{At: a.At, Kind: "lifecycle", Message: actionMessage("resolved", a)})
+	}
+	if f := anomaly.Feedback; f != nil {
+		message := fmt.Sprintf("labeled %s by %s", f.Label, f.User)
+		if f.Reason != "" {
+			message += ": " + f.Reason
+		}
+		timeline = append(timeline, TimelineEntry{At: f.At, Kind: "feedback", Message: message})
+	}
+
+	sort.SliceStable(timeline, func(i, j int) bool { return timeline[i].At < timeline[j].At })
+	return timeline
+}
+
+func actionMessage(verb string, action *AnomalyAction) string {
+	if action.Note != "" {
+		return fmt.Sprintf("%s by %s: %s", verb, action.User, action.Note)
+	}
+	return fmt.Sprintf("%s by %s", verb, action.User)
+}
+
+// writeBundle пишет файлы в архив tar.gz внутри каталога dir
+func writeBundle(w http.ResponseWriter, dir string, files []bundleFile) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+	for _, f := range files {
+		header := &tar.Header{
+			Name:    dir + "/" + f.name,
+			Mode:    0o644,
+			Size:    int64(len(f.data)),
+			ModTime: now,
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := tw.Write(f.data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
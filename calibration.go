@@ -0,0 +1,199 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	calibrationShards      = 16
+	calibrationCompression = 50
+)
+
+var calibrationSource = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "highload_calibration_results_total",
+		Help: "Total number of calibrated anomaly probabilities by distribution used (device, detector)",
+	},
+	[]string{"source"},
+)
+
+// Калибровка переводит сырую оценку детектора в вероятность аномальности
+// по квантилям: вероятность — доля прежних оценок того же детектора по тому
+// же полю устройства, не превышающих текущую. 0.95 означает, что оценка выше
+// 95% обычных для устройства, какой бы ни была шкала детектора. Пока у
+// устройства меньше min_samples оценок, используется распределение детектора
+// по всем устройствам. Распределения учитывают все результаты детекторов, а
+// не только аномалии, и обновляются: после max_samples оценок текущий скетч
+// становится предыдущим, а старый отбрасывается.
+
+// rawAnomalyScore сырая оценка результата: чем больше, тем аномальнее.
+// У правил оценки нет.
+func rawAnomalyScore(result AnalyticsResult) (float64, bool) {
+	switch {
+	case result.Type == AnomalyTypeRule:
+		return 0, false
+	case result.Type == AnomalyTypeIsolation && result.Isolation != nil:
+		return result.Isolation.Score, true
+	case result.Type == AnomalyTypeIQR && result.IQR != nil:
+		// Выход за ближнюю границу в долях межквартильного размаха; внутри границ — отрицательный
+		spread := result.IQR.Q3 - result.IQR.Q1
+		if spread <= 0 {
+			return 0, false
+		}
+		return math.Max(result.IQR.Lower-result.Value, result.Value-result.IQR.Upper) / spread, true
+	case result.Type == AnomalyTypeTrend && result.Trend != nil:
+		// Изменение за окно с весом линейности: шумный рост оценивается ниже
+		return math.Abs(result.Trend.Rise) * result.Trend.RSquared, true
+	case result.Type == AnomalyTypeML && result.ML != nil:
+		return result.ML.ModelProbability, true
+	}
+	return math.Abs(result.ZScore), true
+}
+
+// scoreDistribution скользящее распределение оценок из двух скетчей
+type scoreDistribution struct {
+	current, previous *TDigest
+}
+
+func newScoreDistribution() *scoreDistribution {
+	return &scoreDistribution{current: NewTDigest(calibrationCompression)}
+}
+
+func (d *scoreDistribution) count() float64 {
+	n := d.current.Count()
+	if d.previous != nil {
+		n += d.previous.Count()
+	}
+	return n
+}
+
+// rank доля оценок не больше score по обоим скетчам
+func (d *scoreDistribution) rank(score float64) float64 {
+	below := d.current.CDF(score) * d.current.Count()
+	if d.previous != nil {
+		below += d.previous.CDF(score) * d.previous.Count()
+	}
+	return below / d.count()
+}
+
+func (d *scoreDistribution) add(score float64, maxSamples int) {
+	d.current.Add(score)
+	if d.current.Count() >= float64(maxSamples) {
+		d.previous, d.current = d.current, NewTDigest(calibrationCompression)
+	}
+}
+
+type calibrationShard struct {
+	mu sync.Mutex
+	// devices device_id -> "тип/поле" -> распределение
+	devices map[string]map[string]*scoreDistribution
+}
+
+// Calibrator хранит распределения оценок детекторов по устройствам и по всему парку
+type Calibrator struct {
+	mu         sync.RWMutex
+	enabled    bool
+	minSamples int
+	maxSamples int
+
+	shards [calibrationShards]*calibrationShard
+
+	fleetMu sync.Mutex
+	fleet   map[string]*scoreDistribution // тип детектора -> распределение
+}
+
+func NewCalibrator(cfg CalibrationConfig) *Calibrator {
+	c := &Calibrator{fleet: make(map[string]*scoreDistribution)}
+	for i := range c.shards {
+		c.shards[i] = &calibrationShard{devices: make(map[string]map[string]*scoreDistribution)}
+	}
+	c.Configure(cfg)
+	return c
+}
+
+// Configure применяет параметры калибровки; накопленные распределения сохраняются
+func (c *Calibrator) Configure(cfg CalibrationConfig) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.enabled = cfg.Enabled
+	c.minSamples = cfg.MinSamples
+	c.maxSamples = cfg.MaxSamples
+}
+
+func (c *Calibrator) shard(deviceID string) *calibrationShard {
+	h := fnv.New32a()
+	h.Write([]byte(deviceID))
+	return c.shards[h.Sum32()%calibrationShards]
+}
+
+// Observe возвращает откалиброванную вероятность аномальности результата и
+// учитывает его оценку в распределениях. Вероятность рассчитывается по
+// оценкам до текущей и лежит в (0, 1); 0 — калибровка выключена, у
+// результата нет оценки или распределение детектора еще пусто.
+func (c *Calibrator) Observe(result AnalyticsResult) float64 {
+	c.mu.RLock()
+	enabled, minSamples, maxSamples := c.enabled, c.minSamples, c.maxSamples
+	c.mu.RUnlock()
+	if !enabled {
+		return 0
+	}
+	score, ok := rawAnomalyScore(result)
+	if !ok || math.IsNaN(score) || math.IsInf(score, 0) {
+		return 0
+	}
+
+	var probability float64
+	sh := c.shard(result.DeviceID)
+	sh.mu.Lock()
+	fields, ok := sh.devices[result.DeviceID]
+	if !ok {
+		fields = make(map[string]*scoreDistribution)
+		sh.devices[result.DeviceID] = fields
+	}
+	key := result.Type + "/" + result.Field
+	device, ok := fields[key]
+	if !ok {
+		device = newScoreDistribution()
+		fields[key] = device
+	}
+	if n := device.count(); n >= float64(minSamples) {
+		probability = calibratedProbability(device.rank(score), n)
+		calibrationSource.WithLabelValues("device").Inc()
+	}
+	device.add(score, maxSamples)
+	sh.mu.Unlock()
+
+	c.fleetMu.Lock()
+	defer c.fleetMu.Unlock()
+	fleet, ok := c.fleet[result.Type]
+	if !ok {
+		fleet = newScoreDistribution()
+		c.fleet[result.Type] = fleet
+	}
+	if n := fleet.count(); probability == 0 && n > 0 {
+		probability = calibratedProbability(fleet.rank(score), n)
+		calibrationSource.WithLabelValues("detector").Inc()
+	}
+	// Парк учитывает оценки с весом устройств пропорционально их потоку
+	fleet.add(score, maxSamples)
+	return probability
+}
+
+// calibratedProbability сдвигает долю к середине (n·rank + 0.5)/(n + 1), чтобы
+// вероятность не была ровно 0 или 1 на конечной выборке
+func calibratedProbability(rank, n float64) float64 {
+	return (n*rank + 0.5) / (n + 1)
+}
+
+// Forget удаляет распределения устройства
+func (c *Calibrator) Forget(deviceID string) {
+	sh := c.shard(deviceID)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	delete(sh.devices, deviceID)
+}
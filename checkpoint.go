@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var checkpointTimestamp = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "highload_aggregator_checkpoint_timestamp_seconds",
+		Help: "Time of the last ingestion stream entry processed by a background aggregator, from its checkpoint",
+	},
+	[]string{"aggregator"},
+)
+
+// Checkpoint прогресс фонового агрегатора в потоке ingest. Хранится в хеше
+// Redis (поля id, timestamp, updated_at) и обновляется атомарно вместе с
+// результатами агрегатора, поэтому после перезапуска чтение продолжается
+// ровно со следующей записи: интервалы не пересчитываются и не пропускаются.
+type Checkpoint struct {
+	Name string `json:"name"`
+	// StreamID последняя учтенная запись потока; пусто, если агрегатор еще не работал
+	StreamID string `json:"stream_id"`
+	// Timestamp метка времени метрики из этой записи
+	Timestamp int64 `json:"timestamp"`
+	// UpdatedAt момент сохранения, unix-время в миллисекундах
+	UpdatedAt int64 `json:"updated_at"`
+}
+
+// loadCheckpoint читает контрольную точку из хеша key
+func loadCheckpoint(ctx context.Context, rdb redis.UniversalClient, name, key string) (Checkpoint, error) {
+	values, err := rdb.HGetAll(ctx, key).Result()
+	if err != nil {
+		return Checkpoint{}, err
+	}
+	checkpoint := Checkpoint{Name: name, StreamID: values["id"]}
+	checkpoint.Timestamp, _ = strconv.ParseInt(values["timestamp"], 10, 64)
+	checkpoint.UpdatedAt, _ = strconv.ParseInt(values["updated_at"], 10, 64)
+	return checkpoint, nil
+}
+
+// streamIDTime возвращает время записи потока по ее идентификатору "<ms>-<seq>"
+func streamIDTime(id string) (int64, bool) {
+	ms, _, ok := strings.Cut(id, "-")
+	if !ok {
+		return 0, false
+	}
+	value, err := strconv.ParseInt(ms, 10, 64)
+	return value, err == nil
+}
+
+// parseStreamID разбирает идентификатор записи потока "<ms>-<seq>"
+func parseStreamID(id string) (int64, int64) {
+	ms, seq, _ := strings.Cut(id, "-")
+	m, _ := strconv.ParseInt(ms, 10, 64)
+	s, _ := strconv.ParseInt(seq, 10, 64)
+	return m, s
+}
+
+// compareStreamIDs сравнивает идентификаторы записей потока в порядке Redis
+func compareStreamIDs(a, b string) int {
+	am, as := parseStreamID(a)
+	bm, bs := parseStreamID(b)
+	switch {
+	case am < bm || am == bm && as < bs:
+		return -1
+	case am == bm && as == bs:
+		return 0
+	}
+	return 1
+}
+
+// nextStreamID возвращает наименьший идентификатор, следующий за id
+func nextStreamID(id string) string {
+	ms, seq := parseStreamID(id)
+	return fmt.Sprintf("%d-%d", ms, seq+1)
+}
+
+// CheckpointStatus контрольная точка вместе с отставанием от хвоста потока
+type CheckpointStatus struct {
+	Checkpoint
+	StreamLastID string `json:"stream_last_id,omitempty"`
+	// LagSeconds разница времени последней записи потока и контрольной точки
+	LagSeconds float64 `json:"lag_seconds"`
+}
+
+// AdminCheckpointsHandler возвращает контрольные точки фоновых агрегаторов
+func (s *Service) AdminCheckpointsHandler(w http.ResponseWriter, r *http.Request) {
+	statuses := make([]CheckpointStatus, 0, 1)
+	if s.rollups.cfg.Enabled {
+		status, err := s.checkpointStatus(r.Context(), rollupAggregatorName, s.rollups.cfg.CheckpointKey, s.rollups.stream)
+		if err != nil {
+			http.Error(w, "failed to read checkpoints: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		statuses = append(statuses, status)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"checkpoints": statuses})
+}
+
+func (s *Service) checkpointStatus(ctx context.Context, name, key, stream string) (CheckpointStatus, error) {
+	checkpoint, err := loadCheckpoint(ctx, s.redis, name, key)
+	if err != nil {
+		return CheckpointStatus{}, err
+	}
+	status := CheckpointStatus{Checkpoint: checkpoint}
+
+	last, err := s.redis.XRevRangeN(ctx, stream, "+", "-", 1).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return CheckpointStatus{}, err
+	}
+	if len(last) == 0 {
+		return status, nil
+	}
+	status.StreamLastID = last[0].ID
+	lastMs, _ := streamIDTime(last[0].ID)
+	doneMs, _ := streamIDTime(checkpoint.StreamID)
+	if checkpoint.StreamID == "" {
+		// Агрегатор еще не начинал: отставание считается от первой записи потока
+		if first, err := s.redis.XRangeN(ctx, stream, "-", "+", 1).Result(); err == nil && len(first) > 0 {
+			doneMs, _ = streamIDTime(first[0].ID)
+		}
+	}
+	if lastMs > doneMs {
+		status.LagSeconds = float64(lastMs-doneMs) / 1000
+	}
+	return status, nil
+}
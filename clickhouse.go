@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var clickhouseRows = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "highload_clickhouse_rows_total",
+		Help: "Total number of raw metric rows sent to ClickHouse by result (written, failed, dropped)",
+	},
+	[]string{"result"},
+)
+
+// clickhouseRow строка архивной таблицы: одно значение одного поля
+type clickhouseRow struct {
+	Timestamp int64   `json:"timestamp"`
+	DeviceID  string  `json:"device_id"`
+	Tenant    string  `json:"tenant"`
+	Field     string  `json:"field"`
+	Value     float64 `json:"value"`
+}
+
+// clickhouseTableDDL схема архивной таблицы; партиции по месяцам упрощают
+// сравнение месяц к месяцу и удаление старых данных
+const clickhouseTableDDL = `CREATE TABLE IF NOT EXISTS %s (
+	timestamp DateTime,
+	device_id LowCardinality(String),
+	tenant LowCardinality(String),
+	field LowCardinality(String),
+	value Float64
+) ENGINE = MergeTree
+PARTITION BY toYYYYMM(timestamp)
+ORDER BY (tenant, device_id, field, timestamp)`
+
+// ClickHouseSink пакетно архивирует сырые метрики в ClickHouse через HTTP
+// интерфейс (INSERT ... FORMAT JSONEachRow). Запись не блокирует прием:
+// при переполнении очереди строки отбрасываются.
+type ClickHouseSink struct {
+	cfg      ClickHouseConfig
+	endpoint string
+	client   *http.Client
+	queue    chan clickhouseRow
+	drains   chan chan struct{}
+	jobs     *JobScheduler
+}
+
+func NewClickHouseSink(cfg ClickHouseConfig, jobs *JobScheduler) *ClickHouseSink {
+	return &ClickHouseSink{
+		cfg:      cfg,
+		endpoint: strings.TrimRight(cfg.URL, "/") + "/",
+		client:   &http.Client{Timeout: cfg.Timeout},
+		queue:    make(chan clickhouseRow, cfg.QueueSize),
+		drains:   make(chan chan struct{}),
+		jobs:     jobs,
+	}
+}
+
+func (cs *ClickHouseSink) Name() string { return SinkTypeClickHouse }
+
+// Enabled сообщает, настроен ли архив
+func (cs *ClickHouseSink) Enabled() bool {
+	return cs.cfg.URL != ""
+}
+
+// Write ставит значения метрики в очередь на запись
+func (cs *ClickHouseSink) Write(metric Metric) {
+	if !cs.Enabled() {
+		return
+	}
+	for field, value := range metric.Values {
+		row := clickhouseRow{
+			Timestamp: metric.Timestamp,
+			DeviceID:  metric.DeviceID,
+			Tenant:    metric.Tenant,
+			Field:     field,
+			Value:     value,
+		}
+		select {
+		case cs.queue <- row:
+		default:
+			clickhouseRows.WithLabelValues("dropped").Inc()
+		}
+	}
+}
+
+// Run создает таблицу при необходимости и отправляет пакеты по размеру или интервалу
+func (cs *ClickHouseSink) Run() {
+	ctx, cancel := context.WithTimeout(context.Background(), cs.cfg.Timeout)
+	if err := cs.exec(ctx, fmt.Sprintf(clickhouseTableDDL, cs.table()), nil, ""); err != nil {
+		log.Printf("Failed to create ClickHouse table %s: %v", cs.table(), err)
+	}
+	cancel()
+
+	ticker := time.NewTicker(cs.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]clickhouseRow, 0, cs.cfg.BatchSize)
+	for {
+		select {
+		case row := <-cs.queue:
+			batch = append(batch, row)
+			if len(batch) < cs.cfg.BatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		case done := <-cs.drains:
+			cs.drainQueue(batch)
+			batch = make([]clickhouseRow, 0, cs.cfg.BatchSize)
+			close(done)
+			continue
+		}
+
+		// Отправка учитывается в бюджете задачи archiver; пока она отложена
+		// под нагрузкой ingest, строки копятся в очереди
+		pending := batch
+		cs.jobs.Run(context.Background(), JobArchiver, func(ctx context.Context) error {
+			return cs.flush(ctx, pending)
+		})
+		batch = make([]clickhouseRow, 0, cs.cfg.BatchSize)
+	}
+}
+
+// Drain отправляет все строки, уже поставленные в очередь, и ждет завершения записи
+func (cs *ClickHouseSink) Drain(ctx context.Context) error {
+	done := make(chan struct{})
+	select {
+	case cs.drains <- done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// drainQueue отправляет текущий пакет и остаток очереди пакетами по batch_size
+func (cs *ClickHouseSink) drainQueue(batch []clickhouseRow) {
+	for {
+		select {
+		case row := <-cs.queue:
+			batch = append(batch, row)
+			if len(batch) < cs.cfg.BatchSize {
+				continue
+			}
+		default:
+			if len(batch) > 0 {
+				cs.flush(context.Background(), batch)
+			}
+			return
+		}
+		cs.flush(context.Background(), batch)
+		batch = make([]clickhouseRow, 0, cs.cfg.BatchSize)
+	}
+}
+
+func (cs *ClickHouseSink) flush(ctx context.Context, batch []clickhouseRow) error {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, row := range batch {
+		encoder.Encode(row)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cs.cfg.Timeout)
+	defer cancel()
+	query := fmt.Sprintf("INSERT INTO %s FORMAT JSONEachRow", cs.table())
+	defer recordConsumed(SinkTypeClickHouse, len(batch))
+	data, encoding, err := compressPayload(SinkTypeClickHouse, cs.cfg.Compression, cs.cfg.CompressionLevel, body.Bytes())
+	if err == nil {
+		err = cs.exec(ctx, query, bytes.NewReader(data), encoding)
+	}
+	if err != nil {
+		clickhouseRows.WithLabelValues("failed").Add(float64(len(batch)))
+		log.Printf("Failed to write %d rows to ClickHouse: %v", len(batch), err)
+		return err
+	}
+	clickhouseRows.WithLabelValues("written").Add(float64(len(batch)))
+	return nil
+}
+
+func (cs *ClickHouseSink) table() string {
+	if cs.cfg.Database == "" {
+		return cs.cfg.Table
+	}
+	return cs.cfg.Database + "." + cs.cfg.Table
+}
+
+// exec выполняет запрос; данные для INSERT передаются телом запроса,
+// сжатым encoding (пусто — без сжатия)
+func (cs *ClickHouseSink) exec(ctx context.Context, query string, data io.Reader, encoding string) error {
+	params := url.Values{"query": {query}}
+	if data == nil {
+		data = http.NoBody
+	} else if cs.cfg.AsyncInsert {
+		params.Set("async_insert", "1")
+		params.Set("wait_for_async_insert", "0")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cs.endpoint+"?"+params.Encode(), data)
+	if err != nil {
+		return err
+	}
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	if cs.cfg.User != "" {
+		req.Header.Set("X-ClickHouse-User", cs.cfg.User)
+		req.Header.Set("X-ClickHouse-Key", cs.cfg.Password)
+	}
+
+	resp, err := cs.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("clickhouse returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// clientVersionHeader заголовок с версией клиента или прошивки устройства
+const clientVersionHeader = "X-Client-Version"
+
+// Служебные значения метки version
+const (
+	versionUnknown = "unknown"
+	versionInvalid = "invalid"
+	versionOther   = "other"
+)
+
+var versionPattern = regexp.MustCompile(`^[a-zA-Z0-9_.+-]{1,32}$`)
+
+var (
+	ingestByVersion = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "highload_ingest_requests_by_version_total",
+			Help: "Total number of ingestion requests by client version and status class",
+		},
+		[]string{"version", "class"},
+	)
+
+	versionErrorRate = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "highload_ingest_error_rate_by_version",
+			Help: "Share of ingestion responses with the given error class per client version over the SLI window",
+		},
+		[]string{"version", "class"},
+	)
+)
+
+// ClientVersionTracker учитывает запросы приема по версиям клиентов. Число
+// различных версий ограничено, чтобы мусорные заголовки не раздували метки.
+type ClientVersionTracker struct {
+	mu    sync.Mutex
+	known map[string]bool
+	max   int
+	sli   *SLITracker
+}
+
+func NewClientVersionTracker(maxVersions int, window time.Duration) *ClientVersionTracker {
+	return &ClientVersionTracker{
+		known: make(map[string]bool),
+		max:   maxVersions,
+		sli:   NewSLITracker(window, versionErrorRate),
+	}
+}
+
+// Run периодически обновляет доли ошибок по версиям
+func (t *ClientVersionTracker) Run() {
+	t.sli.Run()
+}
+
+// label нормализует значение заголовка в метку version
+func (t *ClientVersionTracker) label(raw string) string {
+	if raw == "" {
+		return versionUnknown
+	}
+	if !versionPattern.MatchString(raw) {
+		return versionInvalid
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.known[raw] {
+		return raw
+	}
+	if len(t.known) >= t.max {
+		return versionOther
+	}
+	t.known[raw] = true
+	return raw
+}
+
+// Middleware учитывает ответ на запрос приема под версией клиента
+func (t *ClientVersionTracker) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		version := t.label(r.Header.Get(clientVersionHeader))
+		ingestByVersion.WithLabelValues(version, statusClass(recorder.status)).Inc()
+		t.sli.Record(version, recorder.status)
+	})
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// forwardedHeader помечает запрос, пересланный владельцу устройства; такой
+// запрос обрабатывается на месте, даже если представления о кластере расходятся.
+// Пометка действительна только вместе с forwardSecretHeader.
+const (
+	forwardedHeader     = "X-Highload-Forwarded-By"
+	forwardSecretHeader = "X-Highload-Forward-Secret"
+)
+
+var (
+	clusterMembers = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "highload_cluster_members",
+		Help: "Number of live analyzer instances in the consistent hashing ring",
+	})
+
+	clusterForwarded = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "highload_cluster_forwarded_total",
+			Help: "Requests forwarded to the owning instance by kind (ingest, query) and result (ok, error)",
+		},
+		[]string{"kind", "result"},
+	)
+)
+
+// hashRing консистентное хеширование устройств по экземплярам с виртуальными узлами
+type hashRing struct {
+	hashes []uint32
+	owners map[uint32]string
+}
+
+func newHashRing(members []string, virtualNodes int) *hashRing {
+	ring := &hashRing{owners: make(map[uint32]string, len(members)*virtualNodes)}
+	for _, member := range members {
+		for i := 0; i < virtualNodes; i++ {
+			h := ringHash(member + "#" + strconv.Itoa(i))
+			ring.owners[h] = member
+			ring.hashes = append(ring.hashes, h)
+		}
+	}
+	sort.Slice(ring.hashes, func(i, j int) bool { return ring.hashes[i] < ring.hashes[j] })
+	return ring
+}
+
+// ringHash равномерно раскладывает и похожие ключи (адреса, номера виртуальных узлов)
+func ringHash(key string) uint32 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+// owner возвращает первый узел по часовой стрелке от хеша устройства
+func (hr *hashRing) owner(deviceID string) string {
+	if len(hr.hashes) == 0 {
+		return ""
+	}
+	h := ringHash(deviceID)
+	i := sort.Search(len(hr.hashes), func(i int) bool { return hr.hashes[i] >= h })
+	if i == len(hr.hashes) {
+		i = 0
+	}
+	return hr.owners[hr.hashes[i]]
+}
+
+// Cluster распределяет устройства по экземплярам анализатора. Живые экземпляры
+// отмечаются в sorted set Redis (адрес -> время heartbeat); окно устройства
+// хранится только на владельце, остальные пересылают ему запросы.
+type Cluster struct {
+	mu      sync.RWMutex
+	redis   redis.UniversalClient
+	cfg     ClusterConfig
+	self    string
+	members []string
+	ring    *hashRing
+	client  *http.Client
+	// scheme экземпляры обслуживают тот же порт, что и клиентов: с tls — по HTTPS
+	scheme string
+}
+
+func NewCluster(rdb redis.UniversalClient, cfg ClusterConfig, port string, serverTLS TLSConfig) *Cluster {
+	self := cfg.AdvertiseAddr
+	if self == "" {
+		host, _ := os.Hostname()
+		self = net.JoinHostPort(host, port)
+	}
+	c := &Cluster{
+		redis: rdb,
+		cfg:   cfg,
+		self:  self,
+		// До первого heartbeat все устройства обрабатываются локально
+		members: []string{self},
+		ring:    newHashRing([]string{self}, cfg.VirtualNodes),
+		client:  &http.Client{Timeout: cfg.ForwardTimeout},
+		scheme:  "http",
+	}
+	if serverTLS.Enabled {
+		c.scheme = "https"
+		tlsConfig, err := clusterTLSConfig(cfg, serverTLS)
+		if err != nil {
+			// Файл проверен при загрузке конфигурации; без него сертификаты
+			// экземпляров проверяются по системным корневым
+			log.Printf("Failed to load cluster.ca_file, using system roots: %v", err)
+			tlsConfig = &tls.Config{MinVersion: tlsVersions[serverTLS.MinVersion]}
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		c.client.Transport = transport
+	}
+	return c
+}
+
+// clusterTLSConfig параметры TLS для пересылки экземплярам: та же минимальная
+// версия, что у сервера, и корневые сертификаты из cluster.ca_file
+func clusterTLSConfig(cfg ClusterConfig, serverTLS TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tlsVersions[serverTLS.MinVersion]}
+	if cfg.CAFile == "" {
+		return tlsConfig, nil
+	}
+	pem, err := os.ReadFile(cfg.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.RootCAs = x509.NewCertPool()
+	if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in %s", cfg.CAFile)
+	}
+	return tlsConfig, nil
+}
+
+// Enabled сообщает, включено ли распределение устройств
+func (c *Cluster) Enabled() bool {
+	return c.cfg.Enabled
+}
+
+// Owner возвращает адрес владельца устройства и признак, что это текущий экземпляр
+func (c *Cluster) Owner(deviceID string) (string, bool) {
+	if !c.cfg.Enabled {
+		return c.self, true
+	}
+	c.mu.RLock()
+	owner := c.ring.owner(deviceID)
+	c.mu.RUnlock()
+	return owner, owner == c.self
+}
+
+// Members возвращает адреса живых экземпляров
+func (c *Cluster) Members() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return append([]string(nil), c.members...)
+}
+
+// Run отправляет heartbeat и обновляет кольцо до отмены контекста, затем
+// удаляет экземпляр из списка, чтобы его устройства сразу перешли к остальным
+func (c *Cluster) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.cfg.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := c.heartbeat(ctx); err != nil {
+			log.Printf("Cluster heartbeat failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			leaveCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+			c.redis.ZRem(leaveCtx, c.cfg.MembersKey, c.self)
+			cancel()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *Cluster) heartbeat(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, c.cfg.HeartbeatInterval)
+	defer cancel()
+
+	now := time.Now()
+	deadline := strconv.FormatInt(now.Add(-c.cfg.MemberTTL).UnixMilli(), 10)
+	pipe := c.redis.TxPipeline()
+	pipe.ZAdd(ctx, c.cfg.MembersKey, &redis.Z{Score: float64(now.UnixMilli()), Member: c.self})
+	pipe.ZRemRangeByScore(ctx, c.cfg.MembersKey, "-inf", "("+deadline)
+	live := pipe.ZRange(ctx, c.cfg.MembersKey, 0, -1)
+	if _, err := pipe.Exec(ctx); err != nil {
+		// Последнее известное кольцо остается в силе; пересылка на выбывший
+		// экземпляр завершится ошибкой, и запрос будет обработан локально
+		return err
+	}
+
+	members := live.Val()
+	sort.Strings(members)
+	clusterMembers.Set(float64(len(members)))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !equalStrings(members, c.members) {
+		log.Printf("Cluster membership changed: %v -> %v", c.members, members)
+		c.members = members
+		c.ring = newHashRing(members, c.cfg.VirtualNodes)
+	}
+	return nil
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// ForwardMetric пересылает несжатое тело метрики владельцу устройства и
+// возвращает его ответ; при пересылке тело сжимается кодеком cluster.forward_compression
+func (c *Cluster) ForwardMetric(ctx context.Context, owner string, body []byte, header http.Header) (*http.Response, error) {
+	data, encoding, err := compressPayload("cluster", c.cfg.ForwardCompression, c.cfg.ForwardCompressionLevel, body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.scheme+"://"+owner+"/api/metrics", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	c.prepare(req)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		clusterForwarded.WithLabelValues("ingest", "error").Inc()
+		return nil, err
+	}
+	clusterForwarded.WithLabelValues("ingest", "ok").Inc()
+	return resp, nil
+}
+
+// ForwardUDP пересылает метрику из UDP владельцу в виде JSON; false, если
+// владелец недоступен и метрику нужно обработать локально
+func (c *Cluster) ForwardUDP(ctx context.Context, owner string, metric Metric) bool {
+	body, err := json.Marshal(Metric{Timestamp: metric.Timestamp, DeviceID: metric.DeviceID, Values: metric.Values})
+	if err != nil {
+		return false
+	}
+	resp, err := c.ForwardMetric(ctx, owner, body, http.Header{"Content-Type": {"application/json"}})
+	if err != nil {
+		log.Printf("Failed to forward UDP metric for %s to %s: %v", metric.DeviceID, owner, err)
+		return false
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		log.Printf("Owner %s rejected UDP metric for %s: %s", owner, metric.DeviceID, resp.Status)
+	}
+	return true
+}
+
+// prepare помечает пересылаемый запрос и подставляет токен кластера
+func (c *Cluster) prepare(req *http.Request) {
+	req.Header.Set(forwardedHeader, c.self)
+	req.Header.Set(forwardSecretHeader, c.cfg.ForwardSecret)
+	if c.cfg.AuthToken != "" && req.Header.Get("Authorization") == "" {
+		req.Header.Set("Authorization", "Bearer "+c.cfg.AuthToken)
+	}
+}
+
+// Forwarded сообщает, что запрос переслан другим экземпляром: пометка без
+// верного секрета кластера не учитывается
+func (c *Cluster) Forwarded(r *http.Request) bool {
+	if r.Header.Get(forwardedHeader) == "" || c.cfg.ForwardSecret == "" {
+		return false
+	}
+	secret := r.Header.Get(forwardSecretHeader)
+	return subtle.ConstantTimeCompare([]byte(secret), []byte(c.cfg.ForwardSecret)) == 1
+}
+
+// Middleware пересылает запросы с device_id в пути или параметрах владельцу
+// устройства. Если владелец недоступен, запрос обрабатывается локально.
+func (c *Cluster) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// /api/cluster отвечает о кольце текущего экземпляра
+		if !c.cfg.Enabled || c.Forwarded(r) || r.URL.Path == "/api/cluster" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		deviceID := mux.Vars(r)["device_id"]
+		if deviceID == "" {
+			deviceID = r.URL.Query().Get("device_id")
+		}
+		if deviceID == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		owner, local := c.Owner(deviceID)
+		if local {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Прокси вычитывает тело; при недоступном владельце локальный
+		// обработчик получает его копию
+		var body []byte
+		if r.Body != nil && r.Body != http.NoBody {
+			var err error
+			body, err = io.ReadAll(r.Body)
+			r.Body.Close()
+			if err != nil {
+				writeBodyError(w, err)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+
+		proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: c.scheme, Host: owner})
+		proxy.Transport = c.client.Transport
+		director := proxy.Director
+		proxy.Director = func(req *http.Request) {
+			director(req)
+			c.prepare(req)
+		}
+		proxy.ModifyResponse = func(*http.Response) error {
+			clusterForwarded.WithLabelValues("query", "ok").Inc()
+			return nil
+		}
+		proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+			clusterForwarded.WithLabelValues("query", "error").Inc()
+			log.Printf("Failed to forward %s for %s to %s, serving locally: %v", r.URL.Path, deviceID, owner, err)
+			if body != nil {
+				r.Body = io.NopCloser(bytes.NewReader(body))
+			}
+			next.ServeHTTP(w, r)
+		}
+		proxy.ServeHTTP(w, r)
+	})
+}
+
+// ClusterHandler возвращает список экземпляров и, если указан device_id, его владельца
+func (s *Service) ClusterHandler(w http.ResponseWriter, r *http.Request) {
+	response := map[string]interface{}{
+		"enabled": s.cluster.Enabled(),
+		"self":    s.cluster.self,
+		"members": s.cluster.Members(),
+	}
+	if deviceID := r.URL.Query().Get("device_id"); deviceID != "" {
+		owner, local := s.cluster.Owner(deviceID)
+		response["device_id"] = deviceID
+		response["owner"] = owner
+		response["local"] = local
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// forwardIngest пересылает метрику владельцу с уже определенным арендатором
+// и транслирует его ответ клиенту; false, если метрику нужно обработать локально
+func (s *Service) forwardIngest(w http.ResponseWriter, r *http.Request, tenant, deviceID string, body []byte) bool {
+	if !s.cluster.Enabled() || s.cluster.Forwarded(r) {
+		return false
+	}
+	owner, local := s.cluster.Owner(deviceID)
+	if local {
+		return false
+	}
+
+	// Тело уже распаковано
+	header := r.Header.Clone()
+	header.Del("Content-Encoding")
+	header.Set(tenantHeader, tenant)
+	resp, err := s.cluster.ForwardMetric(r.Context(), owner, body, header)
+	if err != nil {
+		log.Printf("Failed to forward metric for %s to %s, ingesting locally: %v", deviceID, owner, err)
+		return false
+	}
+	defer resp.Body.Close()
+
+	for key, values := range resp.Header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		log.Printf("Failed to relay response from %s: %v", owner, err)
+	}
+	return true
+}
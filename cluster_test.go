@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testClusterConfig() ClusterConfig {
+	cfg := DefaultConfig().Cluster
+	cfg.Enabled = true
+	cfg.AdvertiseAddr = "node-a:8080"
+	cfg.ForwardSecret = "s3cret"
+	return cfg
+}
+
+func TestClusterForwardedRequiresSecret(t *testing.T) {
+	c := NewCluster(nil, testClusterConfig(), "8080", TLSConfig{})
+	for _, tc := range []struct {
+		name   string
+		header map[string]string
+		want   bool
+	}{
+		{"no marker", nil, false},
+		{"marker without secret", map[string]string{forwardedHeader: "node-b:8080"}, false},
+		{"wrong secret", map[string]string{forwardedHeader: "node-b:8080", forwardSecretHeader: "guess"}, false},
+		{"peer", map[string]string{forwardedHeader: "node-b:8080", forwardSecretHeader: "s3cret"}, true},
+	} {
+		r := httptest.NewRequest("GET", "/api/analyze?device_id=dev", nil)
+		for key, value := range tc.header {
+			r.Header.Set(key, value)
+		}
+		if got := c.Forwarded(r); got != tc.want {
+			t.Errorf("%s: Forwarded = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestClusterForwardsOverTLS(t *testing.T) {
+	var got *http.Request
+	owner := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer owner.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: owner.Certificate().Raw})
+	if err := os.WriteFile(caFile, ca, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := testClusterConfig()
+	cfg.CAFile = caFile
+	c := NewCluster(nil, cfg, "8080", TLSConfig{Enabled: true, MinVersion: "1.2"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := c.ForwardMetric(ctx, strings.TrimPrefix(owner.URL, "https://"), []byte(`{}`), http.Header{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted || got == nil || got.TLS == nil {
+		t.Fatalf("metric was not forwarded over TLS: status %d", resp.StatusCode)
+	}
+	if got.Header.Get(forwardSecretHeader) != cfg.ForwardSecret {
+		t.Error("forwarded request does not carry the cluster secret")
+	}
+}
+
+func TestClusterMiddlewareFallbackKeepsBody(t *testing.T) {
+	// Владелец вычитывает запрос и обрывает соединение без ответа
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			http.ReadRequest(bufio.NewReader(conn))
+			conn.Close()
+		}
+	}()
+
+	c := NewCluster(nil, testClusterConfig(), "8080", TLSConfig{})
+	c.members = []string{ln.Addr().String(), c.self}
+	c.ring = newHashRing(c.members, c.cfg.VirtualNodes)
+	deviceID := ""
+	for i := 0; deviceID == ""; i++ {
+		if _, local := c.Owner(fmt.Sprintf("dev-%d", i)); !local {
+			deviceID = fmt.Sprintf("dev-%d", i)
+		}
+	}
+
+	var got string
+	handler := c.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got = string(body)
+	}))
+	const update = `{"min":0,"max":100}`
+	target := "/api/devices/fields/cpu?device_id=" + deviceID
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PUT", target, strings.NewReader(update)))
+	if got != update {
+		t.Fatalf("local handler read body %q, want %q", got, update)
+	}
+}
@@ -0,0 +1,638 @@
+// fakefleet имитирует парк IoT устройств для демонстраций и end-to-end проверок
+// совместимости протоколов приема метрик.
+//
+// Режим имитации: N устройств с заданным поведением отправляют метрики по HTTP
+// (JSON или protobuf), UDP и InfluxDB line protocol, в конце печатается
+// сводка по протоколам.
+//
+//	go run ./cmd/fakefleet -devices 100 -interval 1s -behavior mixed -protocol mixed
+//
+// Протокол influx пишет в /api/influx/write строки
+// <influx-measurement>,host=<device_id> cpu=...,memory=...,rps=... с
+// precision=s; при unmapped_fields: prefix поля приходят в сервис как
+// fakefleet_cpu и т.д., соответствие fakefleet.cpu: cpu в influx.fields
+// сохраняет имена. В mixed и -check он участвует только с флагом -influx,
+// так как на сервисе прием выключен по умолчанию.
+//
+// С -batch N устройство копит N замеров и отправляет их одним запросом, как
+// шлюз с локальным буфером: метрикой с samples (JSON и protobuf), N строками
+// (influx) или одной датаграммой из N строк (UDP).
+//
+// Режим проверки (-check): по каждому протоколу отправляется серия значений
+// отдельного устройства, затем через /api/admin/buffer проверяется, что сервис
+// принял их все. Код возврата 1 означает несовместимость.
+//
+// При device_tokens.mode на сервисе каждому устройству нужен свой токен:
+// -issue-device-tokens выдает их через /api/admin/devices/{id}/token (нужен
+// -token с доступом к admin) и отправляет в X-Device-Token, -device-token
+// задает один токен для всех отправок (парк из одного устройства). По UDP
+// токен не передается, в режиме required такие метрики отклоняются.
+//
+// Протоколы соответствуют тем, что принимает сервис: MQTT и gRPC появятся
+// здесь вместе с их поддержкой в сервисе.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Протоколы приема, поддерживаемые сервисом
+const (
+	ProtocolJSON     = "json"
+	ProtocolProtobuf = "protobuf"
+	ProtocolUDP      = "udp"
+	ProtocolInflux   = "influx"
+	ProtocolMixed    = "mixed"
+)
+
+var allProtocols = []string{ProtocolJSON, ProtocolProtobuf, ProtocolUDP, ProtocolInflux}
+
+// Поведения устройств
+const (
+	BehaviorNormal   = "normal"   // шум вокруг базового уровня
+	BehaviorSpike    = "spike"    // редкие выбросы, ловятся z-score
+	BehaviorDrift    = "drift"    // сдвиг уровня, ловится CUSUM
+	BehaviorFlatline = "flatline" // постоянное значение
+	BehaviorMixed    = "mixed"
+)
+
+var allBehaviors = []string{BehaviorNormal, BehaviorSpike, BehaviorDrift, BehaviorFlatline}
+
+type options struct {
+	target     string
+	udpAddr    string
+	token      string
+	tenant     string
+	devToken   string
+	issueToken bool
+	influx     bool
+	measure    string
+	batch      int
+	devices    int
+	interval   time.Duration
+	duration   time.Duration
+	protocol   string
+	behavior   string
+	prefix     string
+	spikeProb  float64
+	seed       int64
+	check      bool
+	checkCount int
+}
+
+// sample значения одного замера устройства
+type sample struct {
+	deviceID  string
+	timestamp int64
+	values    map[string]float64
+}
+
+// device состояние имитируемого устройства
+type device struct {
+	id       string
+	protocol string
+	behavior string
+	rng      *rand.Rand
+	base     float64
+	step     int
+}
+
+// next возвращает очередной замер в соответствии с поведением устройства
+func (d *device) next(spikeProb float64) sample {
+	d.step++
+	cpu := d.base + d.rng.NormFloat64()*3
+	switch d.behavior {
+	case BehaviorSpike:
+		if d.rng.Float64() < spikeProb {
+			cpu = d.base + 40 + d.rng.Float64()*20
+		}
+	case BehaviorDrift:
+		// Через 30 замеров уровень плавно поднимается на 25
+		if d.step > 30 {
+			cpu += math.Min(25, float64(d.step-30))
+		}
+	case BehaviorFlatline:
+		cpu = d.base
+	}
+	return sample{
+		deviceID:  d.id,
+		timestamp: time.Now().Unix(),
+		values: map[string]float64{
+			"cpu":    math.Max(0, cpu),
+			"memory": 40 + d.rng.Float64()*10,
+			"rps":    math.Max(0, 200+d.rng.NormFloat64()*20),
+		},
+	}
+}
+
+// sender отправляет замеры по всем протоколам и ведет счетчики
+type sender struct {
+	opts   options
+	client *http.Client
+	udp    net.Conn
+	sent   map[string]*atomic.Int64
+	failed map[string]*atomic.Int64
+
+	tokensMu sync.RWMutex
+	tokens   map[string]string
+}
+
+func newSender(opts options) (*sender, error) {
+	s := &sender{
+		opts:   opts,
+		client: &http.Client{Timeout: 5 * time.Second},
+		sent:   make(map[string]*atomic.Int64),
+		failed: make(map[string]*atomic.Int64),
+		tokens: make(map[string]string),
+	}
+	for _, p := range allProtocols {
+		s.sent[p] = new(atomic.Int64)
+		s.failed[p] = new(atomic.Int64)
+	}
+	if opts.udpAddr != "" {
+		conn, err := net.Dial("udp", opts.udpAddr)
+		if err != nil {
+			return nil, fmt.Errorf("dial udp %s: %w", opts.udpAddr, err)
+		}
+		s.udp = conn
+	}
+	return s, nil
+}
+
+// send отправляет замеры одного устройства одним запросом; счетчики
+// ведутся в замерах
+func (s *sender) send(ctx context.Context, protocol string, batch []sample) error {
+	deviceID := batch[0].deviceID
+	var err error
+	switch protocol {
+	case ProtocolJSON:
+		err = s.post(ctx, "/api/metrics", "application/json", deviceID, http.StatusAccepted, encodeJSON(batch))
+	case ProtocolProtobuf:
+		err = s.post(ctx, "/api/metrics", "application/x-protobuf", deviceID, http.StatusAccepted, encodeProto(batch))
+	case ProtocolInflux:
+		err = s.post(ctx, "/api/influx/write?precision=s", "text/plain; charset=utf-8", deviceID, http.StatusNoContent,
+			encodeInflux(s.opts.measure, batch))
+	case ProtocolUDP:
+		if s.udp == nil {
+			err = fmt.Errorf("udp address is not set")
+			break
+		}
+		var packet bytes.Buffer
+		for _, smp := range batch {
+			fmt.Fprintf(&packet, "%s:%g|%g|%g|%d\n", smp.deviceID,
+				smp.values["cpu"], smp.values["memory"], smp.values["rps"], smp.timestamp)
+		}
+		_, err = s.udp.Write(packet.Bytes())
+	}
+	if err != nil {
+		s.failed[protocol].Add(int64(len(batch)))
+		return err
+	}
+	s.sent[protocol].Add(int64(len(batch)))
+	return nil
+}
+
+func (s *sender) post(ctx context.Context, path, contentType, deviceID string, status int, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.opts.target+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "fakefleet/1.0")
+	s.authorize(req)
+	if s.opts.tenant != "" {
+		req.Header.Set("X-Tenant-ID", s.opts.tenant)
+	}
+	if token := s.deviceToken(deviceID); token != "" {
+		req.Header.Set("X-Device-Token", token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != status {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func (s *sender) authorize(req *http.Request) {
+	if s.opts.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.opts.token)
+	}
+}
+
+// deviceToken возвращает токен устройства: выданный ему или общий -device-token
+func (s *sender) deviceToken(deviceID string) string {
+	s.tokensMu.RLock()
+	defer s.tokensMu.RUnlock()
+	if token, ok := s.tokens[deviceID]; ok {
+		return token
+	}
+	return s.opts.devToken
+}
+
+// issueTokens выдает токены устройствам через admin API сервиса, если
+// задан -issue-device-tokens; прежние токены устройств заменяются
+func (s *sender) issueTokens(ctx context.Context, deviceIDs []string) error {
+	if !s.opts.issueToken {
+		return nil
+	}
+	for _, deviceID := range deviceIDs {
+		endpoint := s.opts.target + "/api/admin/devices/" + url.PathEscape(deviceID) + "/token"
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, nil)
+		if err != nil {
+			return err
+		}
+		s.authorize(req)
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return fmt.Errorf("issue token for %s: %w", deviceID, err)
+		}
+		var issued struct {
+			Token string `json:"token"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&issued)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated {
+			return fmt.Errorf("issue token for %s: unexpected status %s", deviceID, resp.Status)
+		}
+		if err != nil {
+			return fmt.Errorf("issue token for %s: %w", deviceID, err)
+		}
+
+		s.tokensMu.Lock()
+		s.tokens[deviceID] = issued.Token
+		s.tokensMu.Unlock()
+	}
+	log.Printf("Issued device tokens for %d devices", len(deviceIDs))
+	return nil
+}
+
+// encodeJSON кодирует замеры телом POST /api/metrics: один замер — полями
+// timestamp и values, несколько — массивом samples
+func encodeJSON(batch []sample) []byte {
+	if len(batch) == 1 {
+		body, _ := json.Marshal(map[string]interface{}{
+			"timestamp": batch[0].timestamp,
+			"device_id": batch[0].deviceID,
+			"values":    batch[0].values,
+		})
+		return body
+	}
+	samples := make([]map[string]interface{}, len(batch))
+	for i, smp := range batch {
+		samples[i] = map[string]interface{}{"timestamp": smp.timestamp, "values": smp.values}
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"device_id": batch[0].deviceID,
+		"samples":   samples,
+	})
+	return body
+}
+
+// encodeProto кодирует замеры сообщением highload.v1.Metric
+// (proto/metric.proto); несколько замеров передаются в samples
+func encodeProto(batch []sample) []byte {
+	var b []byte
+	if len(batch) == 1 {
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(batch[0].timestamp))
+	}
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	b = protowire.AppendString(b, batch[0].deviceID)
+	if len(batch) == 1 {
+		return appendProtoValues(b, 3, batch[0].values)
+	}
+	for _, smp := range batch {
+		var entry []byte
+		entry = protowire.AppendTag(entry, 1, protowire.VarintType)
+		entry = protowire.AppendVarint(entry, uint64(smp.timestamp))
+		entry = appendProtoValues(entry, 2, smp.values)
+		b = protowire.AppendTag(b, 8, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	return b
+}
+
+// appendProtoValues добавляет поле map<string, double> с номером num
+func appendProtoValues(b []byte, num protowire.Number, values map[string]float64) []byte {
+	for field, value := range values {
+		var entry []byte
+		entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+		entry = protowire.AppendString(entry, field)
+		entry = protowire.AppendTag(entry, 2, protowire.Fixed64Type)
+		entry = protowire.AppendFixed64(entry, math.Float64bits(value))
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	return b
+}
+
+// influxEscaper экранирует значения тегов line protocol
+var influxEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+// encodeInflux кодирует замеры строками line protocol с точностью в секундах
+func encodeInflux(measurement string, batch []sample) []byte {
+	var b bytes.Buffer
+	for _, smp := range batch {
+		fmt.Fprintf(&b, "%s,host=%s cpu=%g,memory=%g,rps=%g %d\n", influxEscaper.Replace(measurement),
+			influxEscaper.Replace(smp.deviceID), smp.values["cpu"], smp.values["memory"], smp.values["rps"], smp.timestamp)
+	}
+	return b.Bytes()
+}
+
+// simulate запускает устройства до отмены контекста или истечения duration
+func simulate(ctx context.Context, opts options, s *sender) {
+	if opts.duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.duration)
+		defer cancel()
+	}
+
+	rng := rand.New(rand.NewSource(opts.seed))
+	devices := make([]*device, opts.devices)
+	ids := make([]string, opts.devices)
+	for i := range devices {
+		devices[i] = &device{
+			id:       fmt.Sprintf("%s-%04d", opts.prefix, i),
+			protocol: pick(rng, opts.protocol, ProtocolMixed, fleetProtocols(opts)),
+			behavior: pick(rng, opts.behavior, BehaviorMixed, allBehaviors),
+			rng:      rand.New(rand.NewSource(rng.Int63())),
+			base:     20 + rng.Float64()*40,
+		}
+		ids[i] = devices[i].id
+	}
+	if err := s.issueTokens(ctx, ids); err != nil {
+		log.Printf("Failed to issue device tokens: %v", err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, d := range devices {
+		// Разносим устройства по интервалу, чтобы не отправлять замеры залпом
+		offset := time.Duration(rng.Int63n(int64(opts.interval)))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			run(ctx, d, offset, opts, s)
+		}()
+	}
+
+	log.Printf("Simulating %d devices every %s (protocol %s, behavior %s)", opts.devices, opts.interval, opts.protocol, opts.behavior)
+	wg.Wait()
+}
+
+func run(ctx context.Context, d *device, offset time.Duration, opts options, s *sender) {
+	select {
+	case <-time.After(offset):
+	case <-ctx.Done():
+		return
+	}
+	ticker := time.NewTicker(opts.interval)
+	defer ticker.Stop()
+	batch := make([]sample, 0, opts.batch)
+	for {
+		if batch = append(batch, d.next(opts.spikeProb)); len(batch) == opts.batch {
+			if err := s.send(ctx, d.protocol, batch); err != nil && ctx.Err() == nil {
+				log.Printf("Device %s (%s): %v", d.id, d.protocol, err)
+			}
+			batch = batch[:0]
+		}
+		select {
+		case <-ctx.Done():
+			// Накопленные замеры отправляются при остановке, как шлюз при выключении
+			if len(batch) > 0 {
+				if err := s.send(context.WithoutCancel(ctx), d.protocol, batch); err != nil {
+					log.Printf("Device %s (%s): %v", d.id, d.protocol, err)
+				}
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// fleetProtocols протоколы, из которых выбирает mixed и которые проверяет -check
+func fleetProtocols(opts options) []string {
+	protocols := []string{ProtocolJSON, ProtocolProtobuf}
+	// В mixed адрес UDP обязателен, -check без него проверяет только HTTP
+	if opts.udpAddr != "" || !opts.check {
+		protocols = append(protocols, ProtocolUDP)
+	}
+	if opts.influx {
+		protocols = append(protocols, ProtocolInflux)
+	}
+	return protocols
+}
+
+func pick(rng *rand.Rand, value, mixed string, all []string) string {
+	if value == mixed {
+		return all[rng.Intn(len(all))]
+	}
+	return value
+}
+
+// check отправляет по каждому протоколу checkCount замеров отдельного
+// устройства и проверяет, что все они попали в буфер сервиса
+func check(ctx context.Context, opts options, s *sender) bool {
+	protocols := fleetProtocols(opts)
+
+	runID := time.Now().UnixNano()
+	devices := make(map[string]string, len(protocols))
+	ids := make([]string, 0, len(protocols))
+	for _, protocol := range protocols {
+		devices[protocol] = fmt.Sprintf("%s-check-%s-%d", opts.prefix, protocol, runID)
+		ids = append(ids, devices[protocol])
+	}
+	if err := s.issueTokens(ctx, ids); err != nil {
+		log.Printf("FAIL device tokens: %v", err)
+		return false
+	}
+
+	for _, protocol := range protocols {
+		d := &device{
+			id:       devices[protocol],
+			behavior: BehaviorNormal,
+			rng:      rand.New(rand.NewSource(opts.seed)),
+			base:     50,
+		}
+		for i := 0; i < opts.checkCount; i += opts.batch {
+			batch := make([]sample, 0, opts.batch)
+			for j := i; j < min(i+opts.batch, opts.checkCount); j++ {
+				smp := d.next(0)
+				// Разные метки времени, чтобы значения не сливались при дедупликации
+				smp.timestamp += int64(j)
+				batch = append(batch, smp)
+			}
+			if err := s.send(ctx, protocol, batch); err != nil {
+				log.Printf("FAIL %s: send: %v", protocol, err)
+				break
+			}
+		}
+	}
+
+	ok := true
+	deadline := time.Now().Add(10 * time.Second)
+	for _, protocol := range protocols {
+		var got int
+		for {
+			samples, err := s.bufferedSamples(ctx, devices[protocol])
+			if err != nil {
+				log.Printf("FAIL %s: read buffer: %v", protocol, err)
+				return false
+			}
+			got = samples
+			if got >= opts.checkCount || time.Now().After(deadline) {
+				break
+			}
+			time.Sleep(200 * time.Millisecond)
+		}
+		if got >= opts.checkCount {
+			log.Printf("PASS %s: %d/%d samples of %s buffered", protocol, got, opts.checkCount, devices[protocol])
+		} else {
+			log.Printf("FAIL %s: %d/%d samples of %s buffered", protocol, got, opts.checkCount, devices[protocol])
+			ok = false
+		}
+	}
+	return ok
+}
+
+// bufferedSamples возвращает число значений поля cpu устройства в буфере
+// сервиса; точки influx без соответствия в influx.fields попадают в поле
+// <measurement>_cpu
+func (s *sender) bufferedSamples(ctx context.Context, deviceID string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.opts.target+"/api/admin/buffer", nil)
+	if err != nil {
+		return 0, err
+	}
+	s.authorize(req)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var buffer struct {
+		Devices []struct {
+			DeviceID string `json:"device_id"`
+			Fields   map[string]struct {
+				Samples int `json:"samples"`
+			} `json:"fields"`
+		} `json:"devices"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&buffer); err != nil {
+		return 0, err
+	}
+	for _, d := range buffer.Devices {
+		if d.DeviceID == deviceID {
+			return max(d.Fields["cpu"].Samples, d.Fields[s.opts.measure+"_cpu"].Samples), nil
+		}
+	}
+	return 0, nil
+}
+
+func (s *sender) summary() {
+	names := make([]string, 0, len(s.sent))
+	for name := range s.sent {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if sent, failed := s.sent[name].Load(), s.failed[name].Load(); sent+failed > 0 {
+			log.Printf("%-8s sent=%d failed=%d", name, sent, failed)
+		}
+	}
+}
+
+func main() {
+	var opts options
+	flag.StringVar(&opts.target, "target", "http://localhost:8080", "base URL of the service")
+	flag.StringVar(&opts.udpAddr, "udp", "", "UDP ingest address host:port; empty disables UDP")
+	flag.StringVar(&opts.token, "token", "", "bearer token for listeners with auth_tokens")
+	flag.StringVar(&opts.tenant, "tenant", "", "tenant sent in X-Tenant-ID (honored only with tenants.trust_header)")
+	flag.StringVar(&opts.devToken, "device-token", "", "X-Device-Token sent for every device")
+	flag.BoolVar(&opts.issueToken, "issue-device-tokens", false, "issue a device token for every simulated device via the admin API (needs -token with admin access)")
+	flag.IntVar(&opts.devices, "devices", 10, "number of simulated devices")
+	flag.DurationVar(&opts.interval, "interval", time.Second, "interval between samples of one device")
+	flag.DurationVar(&opts.duration, "duration", 0, "stop after this duration; 0 runs until interrupted")
+	flag.StringVar(&opts.protocol, "protocol", ProtocolJSON, "json, protobuf, udp, influx or mixed")
+	flag.BoolVar(&opts.influx, "influx", false, "service accepts InfluxDB line protocol (influx.enabled); adds influx to mixed and -check")
+	flag.StringVar(&opts.measure, "influx-measurement", "fakefleet", "measurement of influx points")
+	flag.IntVar(&opts.batch, "batch", 1, "samples per request; more than 1 sends batches like a buffering gateway")
+	flag.StringVar(&opts.behavior, "behavior", BehaviorNormal, "normal, spike, drift, flatline or mixed")
+	flag.StringVar(&opts.prefix, "prefix", "fake", "device id prefix")
+	flag.Float64Var(&opts.spikeProb, "spike-prob", 0.02, "probability of a spike per sample for spike devices")
+	flag.Int64Var(&opts.seed, "seed", time.Now().UnixNano(), "random seed for reproducible fleets")
+	flag.BoolVar(&opts.check, "check", false, "run protocol compatibility check and exit")
+	flag.IntVar(&opts.checkCount, "check-count", 5, "samples per protocol in -check mode")
+	flag.Parse()
+
+	opts.target = strings.TrimRight(opts.target, "/")
+	if opts.protocol != ProtocolMixed && !contains(allProtocols, opts.protocol) {
+		log.Fatalf("Unknown protocol %q", opts.protocol)
+	}
+	if opts.behavior != BehaviorMixed && !contains(allBehaviors, opts.behavior) {
+		log.Fatalf("Unknown behavior %q", opts.behavior)
+	}
+	if opts.devices < 1 || opts.interval <= 0 || opts.batch < 1 {
+		log.Fatalf("devices, interval and batch must be positive")
+	}
+	if opts.udpAddr == "" && (opts.protocol == ProtocolUDP || opts.protocol == ProtocolMixed) && !opts.check {
+		log.Fatalf("-udp is required for protocol %s", opts.protocol)
+	}
+
+	s, err := newSender(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if opts.check {
+		ok := check(ctx, opts, s)
+		s.summary()
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
+
+	simulate(ctx, opts, s)
+	s.summary()
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+)
+
+const (
+	maxMetadataAttributes = 32
+	maxMetadataValueLen   = 128
+	// madScale приводит медианное абсолютное отклонение к σ нормального распределения
+	madScale = 1.4826
+)
+
+var ErrDeviceMetadataNotFound = errors.New("device metadata not found")
+
+// DeviceMetadataStore хранит описательные атрибуты устройств (прошивка,
+// модель, площадка) в хэше Redis, общем для всех экземпляров, и
+// периодически перечитывает их. По атрибутам устройства объединяются в
+// когорты для сравнения друг с другом.
+type DeviceMetadataStore struct {
+	redis redis.UniversalClient
+
+	mu       sync.RWMutex
+	cfg      CohortsConfig
+	metadata map[string]map[string]string
+}
+
+func NewDeviceMetadataStore(rdb redis.UniversalClient, cfg CohortsConfig) *DeviceMetadataStore {
+	return &DeviceMetadataStore{redis: rdb, cfg: cfg, metadata: make(map[string]map[string]string)}
+}
+
+// Configure применяет новые параметры; ключ Redis действует со следующего чтения
+func (ms *DeviceMetadataStore) Configure(cfg CohortsConfig) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.cfg = cfg
+}
+
+func (ms *DeviceMetadataStore) config() CohortsConfig {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	return ms.cfg
+}
+
+// Run перечитывает атрибуты устройств из Redis каждые cohorts.interval
+func (ms *DeviceMetadataStore) Run(ctx context.Context) {
+	for {
+		cfg := ms.config()
+		if err := ms.refresh(ctx); err != nil {
+			log.Printf("Failed to load device metadata, keeping previous: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(cfg.Interval):
+		}
+	}
+}
+
+func (ms *DeviceMetadataStore) refresh(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	raw, err := ms.redis.HGetAll(ctx, ms.config().MetadataKey).Result()
+	if err != nil {
+		return err
+	}
+
+	metadata := make(map[string]map[string]string, len(raw))
+	for deviceID, data := range raw {
+		var attributes map[string]string
+		if err := json.Unmarshal([]byte(data), &attributes); err != nil {
+			log.Printf("Skipping malformed metadata of device %s: %v", deviceID, err)
+			continue
+		}
+		metadata[deviceID] = attributes
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.metadata = metadata
+	return nil
+}
+
+// Set заменяет атрибуты устройства
+func (ms *DeviceMetadataStore) Set(ctx context.Context, deviceID string, attributes map[string]string) error {
+	data, err := json.Marshal(attributes)
+	if err != nil {
+		return err
+	}
+	if err := ms.redis.HSet(ctx, ms.config().MetadataKey, deviceID, data).Err(); err != nil {
+		return err
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.metadata[deviceID] = attributes
+	return nil
+}
+
+// Delete удаляет атрибуты устройства
+func (ms *DeviceMetadataStore) Delete(ctx context.Context, deviceID string) error {
+	removed, err := ms.redis.HDel(ctx, ms.config().MetadataKey, deviceID).Result()
+	if err != nil {
+		return err
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if _, exists := ms.metadata[deviceID]; !exists && removed == 0 {
+		return ErrDeviceMetadataNotFound
+	}
+	delete(ms.metadata, deviceID)
+	return nil
+}
+
+// Get возвращает атрибуты устройства; nil, если они не заданы
+func (ms *DeviceMetadataStore) Get(deviceID string) map[string]string {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	return ms.metadata[deviceID]
+}
+
+// validateDeviceMetadata проверяет имена и значения атрибутов
+func validateDeviceMetadata(attributes map[string]string) error {
+	if len(attributes) > maxMetadataAttributes {
+		return errors.New("at most 32 attributes are allowed")
+	}
+	for name, value := range attributes {
+		if !validFieldName(name) {
+			return errors.New("invalid attribute name " + strconv.Quote(name))
+		}
+		if value == "" || len(value) > maxMetadataValueLen {
+			return errors.New("attribute " + name + " must be 1 to 128 characters long")
+		}
+	}
+	return nil
+}
+
+// CohortMember устройство когорты, отклонившееся от ее базовой линии
+type CohortMember struct {
+	DeviceID       string  `json:"device_id"`
+	RollingAverage float64 `json:"rolling_average"`
+	// Deviation отклонение среднего устройства от медианы когорты в робастных σ
+	Deviation float64 `json:"deviation"`
+	// OwnZScore последнее значение относительно собственного окна устройства;
+	// небольшое значение означает, что устройство стабильно по своей истории
+	OwnZScore float64 `json:"own_z_score"`
+}
+
+// CohortReport базовая линия когорты и ее выбросы
+type CohortReport struct {
+	Value   string `json:"value"`
+	Devices int    `json:"devices"`
+	// Median и Spread медиана средних устройств когорты и их разброс (MAD в σ)
+	Median   float64        `json:"median"`
+	Spread   float64        `json:"spread"`
+	Outliers []CohortMember `json:"outliers"`
+	// Insufficient в когорте меньше cohorts.min_devices устройств, выбросы не ищутся
+	Insufficient bool `json:"insufficient,omitempty"`
+}
+
+// cohortOutliers группирует устройства буфера по значению атрибута key и в
+// каждой когорте ищет устройства, среднее поля которых отклонилось от
+// медианы когорты больше чем на threshold робастных σ. Так видны
+// устройства, которые стабильны относительно собственной истории, но ведут
+// себя не так, как остальные устройства с той же прошивкой или моделью.
+func (s *Service) cohortOutliers(key, value, field string, threshold float64, minDevices int) []CohortReport {
+	members := make(map[string][]CohortMember)
+	for _, deviceID := range s.metricsBuffer.Devices() {
+		cohort := s.metadata.Get(deviceID)[key]
+		if cohort == "" || (value != "" && cohort != value) {
+			continue
+		}
+		stats, exists := s.metricsBuffer.DeviceStats(deviceID)
+		fs, ok := stats[field]
+		if !exists || !ok || fs.Samples == 0 {
+			continue
+		}
+		member := CohortMember{DeviceID: deviceID, RollingAverage: fs.RollingAverage}
+		if fs.StdDev > 0 {
+			member.OwnZScore = (fs.LastValue - fs.RollingAverage) / fs.StdDev
+		}
+		members[cohort] = append(members[cohort], member)
+	}
+
+	reports := make([]CohortReport, 0, len(members))
+	for cohort, devices := range members {
+		report := CohortReport{Value: cohort, Devices: len(devices), Outliers: make([]CohortMember, 0)}
+		if len(devices) < minDevices {
+			report.Insufficient = true
+			reports = append(reports, report)
+			continue
+		}
+
+		averages := make([]float64, len(devices))
+		for i, member := range devices {
+			averages[i] = member.RollingAverage
+		}
+		sort.Float64s(averages)
+		report.Median = quantile(averages, 0.5)
+		deviations := make([]float64, len(averages))
+		for i, avg := range averages {
+			deviations[i] = math.Abs(avg - report.Median)
+		}
+		sort.Float64s(deviations)
+		report.Spread = madScale * quantile(deviations, 0.5)
+
+		// Если больше половины когорты совпадает, разброс нулевой и отклонения
+		// не измерить в σ
+		if report.Spread > 0 {
+			for _, member := range devices {
+				member.Deviation = (member.RollingAverage - report.Median) / report.Spread
+				if math.Abs(member.Deviation) > threshold {
+					report.Outliers = append(report.Outliers, member)
+				}
+			}
+		}
+		sort.Slice(report.Outliers, func(i, j int) bool {
+			return math.Abs(report.Outliers[i].Deviation) > math.Abs(report.Outliers[j].Deviation)
+		})
+		reports = append(reports, report)
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Value < reports[j].Value })
+	return reports
+}
+
+// CohortOutliersHandler сравнивает устройства с их когортами по атрибуту:
+// GET /api/cohorts/{key}/outliers?field=cpu&value=2.3.1&threshold=3
+func (s *Service) CohortOutliersHandler(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	if !validFieldName(key) {
+		http.Error(w, "invalid metadata key", http.StatusBadRequest)
+		return
+	}
+	query := r.URL.Query()
+	field := query.Get("field")
+	if field == "" {
+		field = "cpu"
+	}
+	if !validFieldName(field) {
+		http.Error(w, "invalid field name", http.StatusBadRequest)
+		return
+	}
+
+	cfg := s.metadata.config()
+	threshold := cfg.Threshold
+	if raw := query.Get("threshold"); raw != "" {
+		parsed, err := strconv.ParseFloat(raw, 64)
+		if err != nil || !(parsed > 0) || math.IsInf(parsed, 0) {
+			http.Error(w, "threshold must be a positive number", http.StatusBadRequest)
+			return
+		}
+		threshold = parsed
+	}
+
+	cohorts := s.cohortOutliers(key, query.Get("value"), field, threshold, cfg.MinDevices)
+	outliers := 0
+	for _, cohort := range cohorts {
+		outliers += len(cohort.Outliers)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"key":         key,
+		"field":       field,
+		"threshold":   threshold,
+		"min_devices": cfg.MinDevices,
+		"outliers":    outliers,
+		"cohorts":     cohorts,
+	})
+}
+
+// DeviceMetadataHandler возвращает атрибуты устройства
+func (s *Service) DeviceMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID := mux.Vars(r)["device_id"]
+	attributes := s.metadata.Get(deviceID)
+	if attributes == nil {
+		http.Error(w, ErrDeviceMetadataNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"device_id": deviceID,
+		"metadata":  attributes,
+	})
+}
+
+// AdminSetDeviceMetadataHandler заменяет атрибуты устройства:
+// {"firmware": "2.3.1", "model": "pump-x"}
+func (s *Service) AdminSetDeviceMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID := mux.Vars(r)["device_id"]
+	var attributes map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&attributes); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if len(attributes) == 0 {
+		http.Error(w, "at least one attribute is required", http.StatusBadRequest)
+		return
+	}
+	if err := validateDeviceMetadata(attributes); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.metadata.Set(r.Context(), deviceID, attributes); err != nil {
+		log.Printf("Failed to store metadata of device %s: %v", deviceID, err)
+		http.Error(w, "device metadata storage unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"device_id": deviceID,
+		"metadata":  attributes,
+	})
+}
+
+// AdminDeleteDeviceMetadataHandler удаляет атрибуты устройства
+func (s *Service) AdminDeleteDeviceMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID := mux.Vars(r)["device_id"]
+	err := s.metadata.Delete(r.Context(), deviceID)
+	if errors.Is(err, ErrDeviceMetadataNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to delete metadata of device %s: %v", deviceID, err)
+		http.Error(w, "device metadata storage unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	errUnsupportedEncoding = errors.New("unsupported content encoding")
+	errBodyTooLarge        = errors.New("decompressed body too large")
+)
+
+var (
+	compressedRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "highload_ingest_compressed_requests_total",
+			Help: "Total number of compressed ingest requests by encoding and result (ok, invalid, too_large)",
+		},
+		[]string{"encoding", "result"},
+	)
+
+	compressionBytes = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "highload_compression_bytes_total",
+			Help: "Total number of bytes passed through outgoing compression by target (clickhouse, cluster), codec and side (in, out)",
+		},
+		[]string{"target", "codec", "side"},
+	)
+
+	compressionDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "highload_compression_duration_seconds",
+			Help:    "Time spent compressing outgoing payloads by target and codec",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 4, 8),
+		},
+		[]string{"target", "codec"},
+	)
+)
+
+// Кодеки сжатия исходящих данных
+const (
+	CodecNone    = "none"
+	CodecGzip    = "gzip"
+	CodecDeflate = "deflate"
+	CodecZstd    = "zstd"
+	// CodecLZ4 кадровый формат LZ4, CodecSnappy — потоковый (framed) snappy
+	CodecLZ4    = "lz4"
+	CodecSnappy = "snappy"
+)
+
+// lz4Levels уровни LZ4 по шкале 1-9
+var lz4Levels = [...]lz4.CompressionLevel{
+	lz4.Fast, lz4.Level1, lz4.Level2, lz4.Level3, lz4.Level4,
+	lz4.Level5, lz4.Level6, lz4.Level7, lz4.Level8, lz4.Level9,
+}
+
+// compressionCodecs кодеки, доступные в сборке. Имя кодека совпадает с
+// Content-Encoding; уровень 1 — быстрее, 9 — плотнее, 0 — уровень кодека по
+// умолчанию. У snappy уровней нет.
+var compressionCodecs = map[string]func(w io.Writer, level int) (io.WriteCloser, error){
+	CodecGzip: func(w io.Writer, level int) (io.WriteCloser, error) {
+		if level == 0 {
+			level = flate.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	},
+	CodecDeflate: func(w io.Writer, level int) (io.WriteCloser, error) {
+		if level == 0 {
+			level = flate.DefaultCompression
+		}
+		return zlib.NewWriterLevel(w, level)
+	},
+	CodecZstd: func(w io.Writer, level int) (io.WriteCloser, error) {
+		encoderLevel := zstd.SpeedDefault
+		if level > 0 {
+			encoderLevel = zstd.EncoderLevelFromZstd(level)
+		}
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(encoderLevel), zstd.WithEncoderConcurrency(1))
+	},
+	CodecLZ4: func(w io.Writer, level int) (io.WriteCloser, error) {
+		writer := lz4.NewWriter(w)
+		if err := writer.Apply(lz4.CompressionLevelOption(lz4Levels[level])); err != nil {
+			return nil, err
+		}
+		return writer, nil
+	},
+	CodecSnappy: func(w io.Writer, level int) (io.WriteCloser, error) {
+		return snappy.NewBufferedWriter(w), nil
+	},
+}
+
+// supportedEncodings значение Accept-Encoding в ответе 415: кодировки,
+// которые принимает readBody
+func supportedEncodings() string {
+	encodings := make([]string, 0, len(compressionCodecs)+1)
+	for codec := range compressionCodecs {
+		encodings = append(encodings, codec)
+	}
+	sort.Strings(encodings)
+	return strings.Join(append(encodings, "identity"), ", ")
+}
+
+// validateCompression проверяет кодек и уровень сжатия секции path
+func validateCompression(path, codec string, level int) error {
+	if _, ok := compressionCodecs[codec]; !ok && codec != "" && codec != CodecNone {
+		return fmt.Errorf("%s: unknown codec %q, expected none, gzip, deflate, zstd, lz4 or snappy", path, codec)
+	}
+	if level < 0 || level > 9 {
+		return fmt.Errorf("%s_level: must be between 0 and 9, got %d", path, level)
+	}
+	return nil
+}
+
+// compressPayload сжимает исходящие данные для target и возвращает их и
+// значение Content-Encoding; без кодека данные возвращаются как есть
+func compressPayload(target, codec string, level int, data []byte) ([]byte, string, error) {
+	newWriter, ok := compressionCodecs[codec]
+	if !ok {
+		return data, "", nil
+	}
+
+	start := time.Now()
+	var compressed bytes.Buffer
+	writer, err := newWriter(&compressed, level)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := writer.Write(data); err != nil {
+		return nil, "", err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, "", err
+	}
+	compressionDuration.WithLabelValues(target, codec).Observe(time.Since(start).Seconds())
+	compressionBytes.WithLabelValues(target, codec, "in").Add(float64(len(data)))
+	compressionBytes.WithLabelValues(target, codec, "out").Add(float64(compressed.Len()))
+	return compressed.Bytes(), codec, nil
+}
+
+// readBody читает тело запроса, распаковывая gzip, deflate, zstd, lz4 и
+// snappy по Content-Encoding. Распакованный объем ограничен maxBytes, чтобы
+// сжатая «бомба» не исчерпала память.
+func readBody(r *http.Request, maxBytes int64) ([]byte, error) {
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+	if encoding == "" || encoding == "identity" {
+		return io.ReadAll(r.Body)
+	}
+
+	var reader io.Reader
+	var err error
+	switch encoding {
+	case "gzip", "x-gzip":
+		reader, err = gzip.NewReader(r.Body)
+	case CodecDeflate:
+		reader, err = newDeflateReader(r.Body)
+	case CodecZstd:
+		var decoder *zstd.Decoder
+		// Окно ограничено тем же пределом, что и распакованное тело
+		limit := uint64(max(maxBytes+1, zstd.MinWindowSize))
+		decoder, err = zstd.NewReader(r.Body, zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderMaxMemory(limit), zstd.WithDecoderMaxWindow(limit))
+		if err == nil {
+			defer decoder.Close()
+			reader = decoder
+		}
+	case CodecLZ4:
+		reader = lz4.NewReader(r.Body)
+	case CodecSnappy:
+		reader = snappy.NewReader(r.Body)
+	default:
+		return nil, fmt.Errorf("%w %q", errUnsupportedEncoding, encoding)
+	}
+	if err != nil {
+		compressedRequests.WithLabelValues(encoding, "invalid").Inc()
+		return nil, err
+	}
+
+	// Читаем на байт больше лимита, чтобы отличить превышение от точного совпадения
+	body, err := io.ReadAll(io.LimitReader(reader, maxBytes+1))
+	if errors.Is(err, zstd.ErrDecoderSizeExceeded) || errors.Is(err, zstd.ErrWindowSizeExceeded) {
+		compressedRequests.WithLabelValues(encoding, "too_large").Inc()
+		return nil, errBodyTooLarge
+	}
+	if err != nil {
+		compressedRequests.WithLabelValues(encoding, "invalid").Inc()
+		return nil, err
+	}
+	if int64(len(body)) > maxBytes {
+		compressedRequests.WithLabelValues(encoding, "too_large").Inc()
+		return nil, errBodyTooLarge
+	}
+	compressedRequests.WithLabelValues(encoding, "ok").Inc()
+	return body, nil
+}
+
+// newDeflateReader принимает deflate в обертке zlib (RFC 9110) и, как многие
+// клиенты отправляют на практике, «сырой» поток RFC 1951
+func newDeflateReader(body io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReader(body)
+	header, err := buffered.Peek(2)
+	if err != nil {
+		return nil, err
+	}
+	// Заголовок zlib: метод 8 в младших битах CMF и CMF*256+FLG кратно 31
+	if header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(buffered)
+	}
+	return flate.NewReader(buffered), nil
+}
+
+// writeBodyError отвечает на ошибку чтения тела подходящим статусом
+func writeBodyError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errUnsupportedEncoding):
+		// RFC 7694: клиент узнает, какими кодировками можно сжимать тело
+		w.Header().Set("Accept-Encoding", supportedEncodings())
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+	case errors.Is(err, errBodyTooLarge):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	case errors.As(err, new(*http.MaxBytesError)):
+		http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+	default:
+		http.Error(w, "Failed to read body", http.StatusBadRequest)
+	}
+}
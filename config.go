@@ -0,0 +1,2467 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config полная конфигурация сервиса. Значения читаются из YAML файла
+// (путь в CONFIG_FILE), затем переопределяются переменными окружения из тегов env.
+type Config struct {
+	Server        ServerConfig        `yaml:"server"`
+	TLS           TLSConfig           `yaml:"tls"`
+	Ingest        IngestConfig        `yaml:"ingest"`
+	Quotas        QuotasConfig        `yaml:"quotas"`
+	Dedup         DedupConfig         `yaml:"dedup"`
+	Deadlines     DeadlinesConfig     `yaml:"deadlines"`
+	Batch         BatchConfig         `yaml:"batch"`
+	Redis         RedisConfig         `yaml:"redis"`
+	Buffer        BufferConfig        `yaml:"buffer"`
+	Anomalies     AnomaliesConfig     `yaml:"anomalies"`
+	Memory        MemoryConfig        `yaml:"memory"`
+	Events        EventsConfig        `yaml:"events"`
+	Detectors     DetectorsConfig     `yaml:"detectors"`
+	Shadow        ShadowConfig        `yaml:"shadow"`
+	Tenants       TenantsConfig       `yaml:"tenants"`
+	UDP           UDPConfig           `yaml:"udp"`
+	GRPC          GRPCConfig          `yaml:"grpc"`
+	Admin         AdminConfig         `yaml:"admin"`
+	Reload        ReloadConfig        `yaml:"reload"`
+	Observability ObservabilityConfig `yaml:"observability"`
+	IDs           IDsConfig           `yaml:"ids"`
+	Debug         DebugConfig         `yaml:"debug"`
+	Alerting      AlertingConfig      `yaml:"alerting"`
+	Rules         RulesConfig         `yaml:"rules"`
+	Silences      SilencesConfig      `yaml:"silences"`
+	DeviceTokens  DeviceTokensConfig  `yaml:"device_tokens"`
+	Feedback      FeedbackConfig      `yaml:"feedback"`
+	Cohorts       CohortsConfig       `yaml:"cohorts"`
+	Fields        FieldsConfig        `yaml:"fields"`
+	Reports       ReportsConfig       `yaml:"reports"`
+	Influx        InfluxConfig        `yaml:"influx"`
+	NATS          NATSConfig          `yaml:"nats"`
+	Calibration   CalibrationConfig   `yaml:"calibration"`
+	Forensics     ForensicsConfig     `yaml:"forensics"`
+	Stream        StreamConfig        `yaml:"stream"`
+	Sampling      SamplingConfig      `yaml:"sampling"`
+	ClickHouse    ClickHouseConfig    `yaml:"clickhouse"`
+	HA            HAConfig            `yaml:"ha"`
+	Leader        LeaderConfig        `yaml:"leader"`
+	SharedStats   SharedStatsConfig   `yaml:"shared_stats"`
+	Cluster       ClusterConfig       `yaml:"cluster"`
+	Migrations    MigrationsConfig    `yaml:"migrations"`
+	Warmup        WarmupConfig        `yaml:"warmup"`
+	Synthetic     SyntheticConfig     `yaml:"synthetic"`
+	LBHealth      LBHealthConfig      `yaml:"lb_health"`
+	Admission     AdmissionConfig     `yaml:"admission"`
+	CORS          CORSConfig          `yaml:"cors"`
+	Health        HealthConfig        `yaml:"health"`
+	Jobs          JobsConfig          `yaml:"jobs"`
+	Rollups       RollupsConfig       `yaml:"rollups"`
+	// Listeners отдельные слушатели с собственными маршрутами и middleware;
+	// если список пуст, все маршруты обслуживаются на адресах секции server
+	Listeners []ListenerConfig `yaml:"listeners"`
+	Pipeline  PipelineConfig   `yaml:"pipeline"`
+	// SLAs ожидаемые диапазоны значений устройств
+	SLAs []SLAConfig `yaml:"slas"`
+	// Forwarders получатели копии принятых метрик и найденных аномалий
+	Forwarders []ForwarderConfig `yaml:"forwarders"`
+	Secrets    SecretsConfig     `yaml:"secrets"`
+
+	// secretRefs пути полей, значения которых получены по ссылкам vault: и file:
+	secretRefs []string
+}
+
+type ServerConfig struct {
+	// Port TCP-порт; пустое значение отключает TCP-слушатель
+	Port string `yaml:"port" env:"PORT"`
+	// UnixSocket путь к unix-сокету для локального reverse proxy
+	UnixSocket     string `yaml:"unix_socket" env:"UNIX_SOCKET"`
+	UnixSocketMode string `yaml:"unix_socket_mode" env:"UNIX_SOCKET_MODE"`
+	// SystemdActivation принимает сокеты, переданные systemd (LISTEN_FDS)
+	SystemdActivation bool `yaml:"systemd_activation" env:"SYSTEMD_ACTIVATION"`
+	// ReadHeaderTimeout и MaxHeaderBytes ограничивают чтение заголовков запроса
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout" env:"SERVER_READ_HEADER_TIMEOUT"`
+	MaxHeaderBytes    int           `yaml:"max_header_bytes" env:"SERVER_MAX_HEADER_BYTES"`
+	// ReadTimeout время чтения всего запроса вместе с телом
+	ReadTimeout time.Duration `yaml:"read_timeout" env:"SERVER_READ_TIMEOUT"`
+	// WriteTimeout время записи ответа; на потоковые ответы не действует
+	WriteTimeout time.Duration `yaml:"write_timeout" env:"SERVER_WRITE_TIMEOUT"`
+	// IdleTimeout время ожидания следующего запроса в keep-alive соединении
+	IdleTimeout time.Duration `yaml:"idle_timeout" env:"SERVER_IDLE_TIMEOUT"`
+	// MaxBodyBytes ограничивает тело запроса до распаковки
+	MaxBodyBytes int `yaml:"max_body_bytes" env:"SERVER_MAX_BODY_BYTES"`
+}
+
+// TLSConfig HTTPS на TCP-адресах сервиса
+type TLSConfig struct {
+	Enabled  bool   `yaml:"enabled" env:"TLS_ENABLED"`
+	CertFile string `yaml:"cert_file" env:"TLS_CERT_FILE"`
+	KeyFile  string `yaml:"key_file" env:"TLS_KEY_FILE"`
+	// ReloadInterval период проверки изменения файлов; 0 — только по SIGHUP
+	ReloadInterval time.Duration `yaml:"reload_interval" env:"TLS_RELOAD_INTERVAL"`
+	MinVersion     string        `yaml:"min_version" env:"TLS_MIN_VERSION"`
+	// RedirectPort HTTP-порт, перенаправляющий на HTTPS-порт server.port; пусто — отключено
+	RedirectPort string `yaml:"redirect_port" env:"TLS_REDIRECT_PORT"`
+}
+
+type IngestConfig struct {
+	// MaxFields ограничивает число полей в одной метрике
+	MaxFields int `yaml:"max_fields" env:"INGEST_MAX_FIELDS"`
+	// MaxSamples ограничивает число значений в метрике с samples
+	MaxSamples int `yaml:"max_samples" env:"INGEST_MAX_SAMPLES"`
+	// MaxClientVersions ограничивает число различных версий клиентов в метриках
+	MaxClientVersions int `yaml:"max_client_versions" env:"INGEST_MAX_CLIENT_VERSIONS"`
+	// MaxDecompressedBytes ограничивает тело запроса после распаковки gzip/deflate
+	MaxDecompressedBytes int `yaml:"max_decompressed_bytes" env:"INGEST_MAX_DECOMPRESSED_BYTES"`
+	// Tracking выдавать метрикам HTTP номера приема и вести их статус в Redis
+	Tracking bool `yaml:"tracking" env:"INGEST_TRACKING"`
+	// StatusTTL сколько хранится статус принятой метрики
+	StatusTTL       time.Duration `yaml:"status_ttl" env:"INGEST_STATUS_TTL"`
+	StatusKeyPrefix string        `yaml:"status_key_prefix" env:"INGEST_STATUS_KEY_PREFIX"`
+}
+
+// DedupConfig отбрасывание повторных отправок метрик. По умолчанию метрики
+// опознаются только по заголовку Idempotency-Key; сравнение по метке времени
+// и по содержимому включается явно
+type DedupConfig struct {
+	Enabled bool `yaml:"enabled" env:"DEDUP_ENABLED"`
+	// TTL сколько помнить принятую метрику; повторы позже принимаются
+	TTL       time.Duration `yaml:"ttl" env:"DEDUP_TTL"`
+	KeyPrefix string        `yaml:"key_prefix" env:"DEDUP_KEY_PREFIX"`
+	// ByTimestamp опознавать метрику без ключа по device_id и метке времени.
+	// Метка задается с точностью до секунды, поэтому несколько значений
+	// устройства за секунду считаются повторами — только для устройств,
+	// которые шлют не чаще раза в секунду
+	ByTimestamp bool `yaml:"by_timestamp" env:"DEDUP_BY_TIMESTAMP"`
+	// ContentWindow сколько помнить метрику без ключа и метки времени: она
+	// опознается по содержимому, и одинаковые значения устройства позже
+	// считаются новыми; 0 — такие метрики не проверяются
+	ContentWindow time.Duration `yaml:"content_window" env:"DEDUP_CONTENT_WINDOW"`
+}
+
+// DeadlinesConfig сроки обработки метрик по классам deadline_class: от приема
+// до окончания буферизации и запуска анализа
+type DeadlinesConfig struct {
+	Realtime time.Duration `yaml:"realtime" env:"DEADLINE_REALTIME"`
+	Standard time.Duration `yaml:"standard" env:"DEADLINE_STANDARD"`
+	Bulk     time.Duration `yaml:"bulk" env:"DEADLINE_BULK"`
+}
+
+// QuotasConfig лимиты приема метрик в минуту; 0 — без ограничения
+type QuotasConfig struct {
+	DevicePerMinute int `yaml:"device_per_minute" env:"QUOTA_DEVICE_PER_MINUTE"`
+	TenantPerMinute int `yaml:"tenant_per_minute" env:"QUOTA_TENANT_PER_MINUTE"`
+	// Devices и Tenants переопределяют лимиты отдельных устройств и арендаторов
+	Devices map[string]int `yaml:"devices"`
+	Tenants map[string]int `yaml:"tenants"`
+}
+
+// BatchConfig устройства, выгружающие метрики пакетами: их значения
+// оцениваются целым пакетом после паузы settle
+type BatchConfig struct {
+	Devices       []string `yaml:"devices" env:"BATCH_DEVICES"`
+	DevicePattern string   `yaml:"device_pattern" env:"BATCH_DEVICE_PATTERN"`
+	// Settle пауза после последнего значения, после которой пакет считается полным
+	Settle time.Duration `yaml:"settle" env:"BATCH_SETTLE"`
+	// MaxSamples оценивает пакет досрочно, если значений накопилось больше
+	MaxSamples int `yaml:"max_samples" env:"BATCH_MAX_SAMPLES"`
+}
+
+type RedisConfig struct {
+	// Mode standalone, sentinel или cluster
+	Mode string `yaml:"mode" env:"REDIS_MODE"`
+	// Addr адрес Redis в режиме standalone
+	Addr string `yaml:"addr" env:"REDIS_ADDR"`
+	// Addrs адреса Sentinel (sentinel) или начальные узлы кластера (cluster)
+	Addrs []string `yaml:"addrs" env:"REDIS_ADDRS"`
+	// MasterName имя мастера, под которым его отслеживают Sentinel
+	MasterName       string `yaml:"master_name" env:"REDIS_MASTER_NAME"`
+	SentinelPassword string `yaml:"sentinel_password" env:"REDIS_SENTINEL_PASSWORD" secret:"true"`
+	Password         string `yaml:"password" env:"REDIS_PASSWORD" secret:"true"`
+	// DB номер базы; в кластере доступна только 0
+	DB int `yaml:"db" env:"REDIS_DB"`
+	// MaxRetries повторов команды после сетевой ошибки или переключения мастера; -1 — без повторов
+	MaxRetries      int           `yaml:"max_retries" env:"REDIS_MAX_RETRIES"`
+	MinRetryBackoff time.Duration `yaml:"min_retry_backoff" env:"REDIS_MIN_RETRY_BACKOFF"`
+	MaxRetryBackoff time.Duration `yaml:"max_retry_backoff" env:"REDIS_MAX_RETRY_BACKOFF"`
+}
+
+type BufferConfig struct {
+	Window  int `yaml:"window" env:"BUFFER_WINDOW"`
+	MaxSize int `yaml:"max_size" env:"BUFFER_MAX_SIZE"`
+	// LatenessHorizon насколько значение может опоздать относительно самого
+	// нового значения поля, чтобы попасть в окно; 0 — без ограничения
+	LatenessHorizon time.Duration `yaml:"lateness_horizon" env:"BUFFER_LATENESS_HORIZON"`
+	// IdleTTL удаляет окно устройства без значений дольше этого срока; 0 — не удалять
+	IdleTTL time.Duration `yaml:"idle_ttl" env:"BUFFER_IDLE_TTL"`
+	// MemoryLimitMB оценка памяти буфера, выше которой вытесняются давно не
+	// обновлявшиеся устройства; 0 — без ограничения
+	MemoryLimitMB int `yaml:"memory_limit_mb" env:"BUFFER_MEMORY_LIMIT_MB"`
+	// ShrinkOnPressure при превышении memory_limit_mb сначала сокращать окна
+	// давно не обновлявшихся устройств до window значений, затем вытеснять
+	ShrinkOnPressure bool          `yaml:"shrink_on_pressure" env:"BUFFER_SHRINK_ON_PRESSURE"`
+	EvictionInterval time.Duration `yaml:"eviction_interval" env:"BUFFER_EVICTION_INTERVAL"`
+}
+
+// MemoryConfig память процесса и учет памяти буфера
+type MemoryConfig struct {
+	// BallastMB размер балласта кучи, выделяемого при старте; 0 — без балласта
+	BallastMB int `yaml:"ballast_mb" env:"MEMORY_BALLAST_MB"`
+	// SoftLimitMB мягкий предел памяти рантайма Go; 0 — GOMEMLIMIT или без предела
+	SoftLimitMB int `yaml:"soft_limit_mb" env:"MEMORY_SOFT_LIMIT_MB"`
+	// TopDevices число самых тяжелых устройств в highload_buffer_device_memory_bytes
+	TopDevices int `yaml:"top_devices" env:"MEMORY_TOP_DEVICES"`
+}
+
+type AnomaliesConfig struct {
+	Retention    time.Duration `yaml:"retention" env:"ANOMALY_RETENTION"`
+	MaxPerDevice int           `yaml:"max_per_device" env:"ANOMALY_MAX_PER_DEVICE"`
+}
+
+// EventsConfig хранение внешних событий и сопоставление с ними аномалий
+type EventsConfig struct {
+	Retention time.Duration `yaml:"retention" env:"EVENTS_RETENTION"`
+	// Window допуск до начала и после окончания события, в который аномалия считается совпавшей
+	Window    time.Duration `yaml:"window" env:"EVENTS_WINDOW"`
+	MaxEvents int           `yaml:"max_events" env:"EVENTS_MAX"`
+}
+
+type DetectorsConfig struct {
+	ZScore      ZScoreConfig          `yaml:"zscore"`
+	CUSUM       CUSUMConfig           `yaml:"cusum"`
+	IQR         IQRConfig             `yaml:"iqr"`
+	Correlation CorrelationConfig     `yaml:"correlation"`
+	Isolation   IsolationForestConfig `yaml:"isolation"`
+	Seasonal    SeasonalConfig        `yaml:"seasonal"`
+	Trend       TrendConfig           `yaml:"trend"`
+	ML          MLConfig              `yaml:"ml"`
+}
+
+// ShadowConfig детекторы в теневом режиме: они оценивают каждое значение
+// наравне с рабочими, но их срабатывания только считаются и не вызывают
+// алертов. Параметры задаются как в секции detectors (только в файле:
+// переменные окружения детекторов относятся к рабочим), по умолчанию все
+// выключены.
+type ShadowConfig struct {
+	Detectors DetectorsConfig `yaml:"detectors" env:"-"`
+	// HistorySize число последних теневых срабатываний в /api/anomalies/shadow
+	HistorySize int `yaml:"history_size" env:"SHADOW_HISTORY_SIZE"`
+}
+
+type ZScoreConfig struct {
+	Enabled   bool     `yaml:"enabled" env:"ZSCORE_ENABLED"`
+	Threshold float64  `yaml:"threshold" env:"ZSCORE_THRESHOLD"`
+	Fields    []string `yaml:"fields" env:"ZSCORE_FIELDS"`
+}
+
+type CUSUMConfig struct {
+	Enabled bool    `yaml:"enabled" env:"CUSUM_ENABLED"`
+	Warmup  int     `yaml:"warmup" env:"CUSUM_WARMUP"`
+	K       float64 `yaml:"k" env:"CUSUM_K"`
+	H       float64 `yaml:"h" env:"CUSUM_H"`
+	// MinRun значений подряд за пределами допуска, без которых сдвиг не
+	// фиксируется: вклад одного значения в сумму ограничен h/(min_run−1)
+	MinRun int      `yaml:"min_run" env:"CUSUM_MIN_RUN"`
+	Fields []string `yaml:"fields" env:"CUSUM_FIELDS"`
+}
+
+// CorrelationConfig детектор нарушения связи между полями устройства
+type CorrelationConfig struct {
+	Enabled bool `yaml:"enabled" env:"CORRELATION_ENABLED"`
+	// Pairs пары driver:dependent, например rps:cpu — cpu объясняется rps
+	Pairs []string `yaml:"pairs" env:"CORRELATION_PAIRS"`
+	// MinCorrelation минимальная |ρ| в окне, при которой связь считается установленной
+	MinCorrelation float64 `yaml:"min_correlation" env:"CORRELATION_MIN"`
+	// Threshold порог отклонения от ожидаемого значения в σ остатков
+	Threshold  float64 `yaml:"threshold" env:"CORRELATION_THRESHOLD"`
+	MinSamples int     `yaml:"min_samples" env:"CORRELATION_MIN_SAMPLES"`
+}
+
+// TrendConfig детектор устойчивого линейного роста (медленных утечек)
+type TrendConfig struct {
+	Enabled bool     `yaml:"enabled" env:"TREND_ENABLED"`
+	Fields  []string `yaml:"fields" env:"TREND_FIELDS"`
+	// Window число последних значений для регрессии; не больше buffer.max_size
+	Window     int `yaml:"window" env:"TREND_WINDOW"`
+	MinSamples int `yaml:"min_samples" env:"TREND_MIN_SAMPLES"`
+	// MinRSquared доля дисперсии, объясняемая прямой, с которой тренд считается устойчивым
+	MinRSquared float64 `yaml:"min_r_squared" env:"TREND_MIN_R_SQUARED"`
+	// MinRise изменение по прямой за окно относительно ее начального уровня
+	MinRise float64 `yaml:"min_rise" env:"TREND_MIN_RISE"`
+	// Direction up, down или both
+	Direction string `yaml:"direction" env:"TREND_DIRECTION"`
+}
+
+// MLConfig детектор на модели ONNX, обученной вне сервиса
+type MLConfig struct {
+	Enabled bool     `yaml:"enabled" env:"ML_ENABLED"`
+	Fields  []string `yaml:"fields" env:"ML_FIELDS"`
+	// ModelPath файл модели .onnx; вход модели — вектор из window значений и признаков времени
+	ModelPath string `yaml:"model_path" env:"ML_MODEL_PATH"`
+	// Window число последних значений поля во входе модели
+	Window int `yaml:"window" env:"ML_WINDOW"`
+	// Normalize подавать значения в отклонениях от среднего окна в долях σ
+	Normalize bool `yaml:"normalize" env:"ML_NORMALIZE"`
+	// TimeFeatures добавить sin/cos часа суток и дня недели в зоне Timezone
+	TimeFeatures bool   `yaml:"time_features" env:"ML_TIME_FEATURES"`
+	Timezone     string `yaml:"timezone" env:"ML_TIMEZONE"`
+	// OutputIndex элемент выхода модели с вероятностью аномалии; -1 — последний
+	OutputIndex int `yaml:"output_index" env:"ML_OUTPUT_INDEX"`
+	// Threshold вероятность, с которой значение считается аномалией
+	Threshold float64 `yaml:"threshold" env:"ML_THRESHOLD"`
+}
+
+// SeasonalConfig детектор отклонений от обычного для часа (и дня недели) уровня
+type SeasonalConfig struct {
+	Enabled bool     `yaml:"enabled" env:"SEASONAL_ENABLED"`
+	Fields  []string `yaml:"fields" env:"SEASONAL_FIELDS"`
+	// Buckets hour_of_week (168 интервалов) или hour_of_day (24)
+	Buckets string `yaml:"buckets" env:"SEASONAL_BUCKETS"`
+	// Timezone зона IANA, в которой считаются часы и дни недели
+	Timezone  string  `yaml:"timezone" env:"SEASONAL_TIMEZONE"`
+	Threshold float64 `yaml:"threshold" env:"SEASONAL_THRESHOLD"`
+	// MinSamples значений в интервале, после которых он участвует в проверке
+	MinSamples int `yaml:"min_samples" env:"SEASONAL_MIN_SAMPLES"`
+	// HalfLife время, за которое вес накопленных значений убывает вдвое
+	HalfLife  time.Duration `yaml:"half_life" env:"SEASONAL_HALF_LIFE"`
+	KeyPrefix string        `yaml:"key_prefix" env:"SEASONAL_KEY_PREFIX"`
+	// TTL срок хранения баз устройства, от которого нет новых значений
+	TTL     time.Duration `yaml:"ttl" env:"SEASONAL_TTL"`
+	Timeout time.Duration `yaml:"timeout" env:"SEASONAL_TIMEOUT"`
+}
+
+// IsolationForestConfig детектор необычных сочетаний значений полей устройства
+type IsolationForestConfig struct {
+	Enabled bool `yaml:"enabled" env:"ISOLATION_ENABLED"`
+	// Fields поля вектора; детектор запускается по первому из них
+	Fields     []string `yaml:"fields" env:"ISOLATION_FIELDS"`
+	Trees      int      `yaml:"trees" env:"ISOLATION_TREES"`
+	SampleSize int      `yaml:"sample_size" env:"ISOLATION_SAMPLE_SIZE"`
+	// Threshold порог аномальности от 0.5 до 1
+	Threshold  float64 `yaml:"threshold" env:"ISOLATION_THRESHOLD"`
+	MinSamples int     `yaml:"min_samples" env:"ISOLATION_MIN_SAMPLES"`
+	// RetrainEvery число векторов, после которого модель обучается заново на текущем окне
+	RetrainEvery int `yaml:"retrain_every" env:"ISOLATION_RETRAIN_EVERY"`
+}
+
+type IQRConfig struct {
+	Enabled    bool     `yaml:"enabled" env:"IQR_ENABLED"`
+	K          float64  `yaml:"k" env:"IQR_K"`
+	MinSamples int      `yaml:"min_samples" env:"IQR_MIN_SAMPLES"`
+	Fields     []string `yaml:"fields" env:"IQR_FIELDS"`
+}
+
+type TenantsConfig struct {
+	PoliciesFile string         `yaml:"policies_file" env:"TENANT_POLICIES_FILE"`
+	Policies     TenantPolicies `yaml:"policies"`
+	// APIKeys bearer-токены арендаторов: запрос с таким Authorization
+	// относится к арендатору ключа
+	APIKeys []TenantAPIKey `yaml:"api_keys"`
+	// TrustHeader принимать арендатора из X-Tenant-ID, если его не дали токен
+	// устройства и ключ API; только за шлюзом, который сам проверяет заголовок
+	TrustHeader bool `yaml:"trust_header" env:"TENANT_TRUST_HEADER"`
+}
+
+// TenantAPIKey ключ API арендатора
+type TenantAPIKey struct {
+	Tenant string `yaml:"tenant"`
+	Key    string `yaml:"key" secret:"true"`
+}
+
+type UDPConfig struct {
+	Addr       string `yaml:"addr" env:"UDP_ADDR"`
+	ReadBuffer int    `yaml:"read_buffer" env:"UDP_READ_BUFFER"`
+	Workers    int    `yaml:"workers" env:"UDP_WORKERS"`
+}
+
+// GRPCConfig gRPC API результатов анализа (proto/analytics.proto)
+type GRPCConfig struct {
+	// Addr адрес host:port; пустое значение отключает сервер
+	Addr string `yaml:"addr" env:"GRPC_ADDR"`
+	// AuthTokens bearer-токены в метаданных authorization; пустой список отключает проверку
+	AuthTokens []string `yaml:"auth_tokens" env:"GRPC_AUTH_TOKENS" secret:"true"`
+}
+
+type AdminConfig struct {
+	TrashRetention time.Duration `yaml:"trash_retention" env:"TRASH_RETENTION"`
+}
+
+type ReloadConfig struct {
+	// WatchInterval период проверки изменения файла конфигурации; 0 — только по SIGHUP
+	WatchInterval time.Duration `yaml:"watch_interval" env:"CONFIG_WATCH_INTERVAL"`
+}
+
+type ObservabilityConfig struct {
+	// SLIWindow окно, за которое считается доля ошибочных ответов
+	SLIWindow time.Duration `yaml:"sli_window" env:"SLI_WINDOW"`
+	// AccessLog включает структурированный журнал HTTP-запросов в stdout
+	AccessLog bool `yaml:"access_log" env:"ACCESS_LOG"`
+}
+
+// DebugConfig pprof и /debug/vars для диагностики роста горутин и памяти
+type DebugConfig struct {
+	Enabled bool `yaml:"enabled" env:"DEBUG_ENABLED"`
+	// Tokens bearer-токены доступа к /debug; обязательны при enabled
+	Tokens []string `yaml:"tokens" env:"DEBUG_TOKENS" secret:"true"`
+}
+
+// IDsConfig генерация идентификаторов аномалий, событий и запросов
+type IDsConfig struct {
+	// Generator ulid или sequence — детерминированная последовательность для тестов
+	Generator string `yaml:"generator" env:"IDS_GENERATOR"`
+}
+
+type AlertingConfig struct {
+	// CriticalZScore порог |z-score|, начиная с которого аномалия считается критичной
+	CriticalZScore float64            `yaml:"critical_z_score" env:"ALERT_CRITICAL_Z_SCORE"`
+	QueueSize      int                `yaml:"queue_size" env:"ALERT_QUEUE_SIZE"`
+	Timeout        time.Duration      `yaml:"timeout" env:"ALERT_TIMEOUT"`
+	Alertmanager   AlertmanagerConfig `yaml:"alertmanager"`
+	PagerDuty      PagerDutyConfig    `yaml:"pagerduty"`
+	Opsgenie       OpsgenieConfig     `yaml:"opsgenie"`
+	// Batching правила группировки уведомлений; аномалия попадает в первое
+	// подходящее правило, остальные отправляются сразу
+	Batching []AlertBatchRule `yaml:"batching"`
+}
+
+// AlertBatchRule копит подходящие аномалии window и отправляет их в канал
+// одним сообщением со сводкой. Пустой список фильтра — без ограничения.
+type AlertBatchRule struct {
+	Name       string        `yaml:"name"`
+	Notifiers  []string      `yaml:"notifiers"`
+	Types      []string      `yaml:"types"`
+	Severities []string      `yaml:"severities"`
+	Window     time.Duration `yaml:"window"`
+	// MaxSize отправляет группу досрочно, когда в ней столько аномалий; 0 — без ограничения
+	MaxSize int `yaml:"max_size"`
+}
+
+type AlertmanagerConfig struct {
+	URL          string `yaml:"url" env:"ALERTMANAGER_URL"`
+	GeneratorURL string `yaml:"generator_url" env:"ALERTMANAGER_GENERATOR_URL"`
+}
+
+// PagerDutyConfig инциденты PagerDuty через Events API v2. Уведомитель
+// включается, если задан routing_key или routes.
+type PagerDutyConfig struct {
+	URL string `yaml:"url" env:"PAGERDUTY_URL"`
+	// RoutingKey ключ для устройств, не подходящих ни одному маршруту
+	RoutingKey string          `yaml:"routing_key" env:"PAGERDUTY_ROUTING_KEY" secret:"true"`
+	Routes     []IncidentRoute `yaml:"routes"`
+	// Severities важности аномалий, по которым открываются инциденты
+	Severities []string `yaml:"severities" env:"PAGERDUTY_SEVERITIES"`
+	// ResolveAfter время без аномалий по устройству и полю, после которого инцидент закрывается
+	ResolveAfter time.Duration `yaml:"resolve_after" env:"PAGERDUTY_RESOLVE_AFTER"`
+}
+
+// OpsgenieConfig алерты Opsgenie через Alert API. Уведомитель включается,
+// если задан api_key или routes.
+type OpsgenieConfig struct {
+	// URL https://api.opsgenie.com или https://api.eu.opsgenie.com
+	URL string `yaml:"url" env:"OPSGENIE_URL"`
+	// APIKey ключ интеграции для устройств, не подходящих ни одному маршруту
+	APIKey       string          `yaml:"api_key" env:"OPSGENIE_API_KEY" secret:"true"`
+	Routes       []IncidentRoute `yaml:"routes"`
+	Severities   []string        `yaml:"severities" env:"OPSGENIE_SEVERITIES"`
+	ResolveAfter time.Duration   `yaml:"resolve_after" env:"OPSGENIE_RESOLVE_AFTER"`
+}
+
+// RulesConfig составные правила, управляемые через /api/rules
+type RulesConfig struct {
+	// Key хэш Redis, в котором правила хранятся для всех экземпляров
+	Key string `yaml:"key" env:"RULES_KEY"`
+	// Interval период перечитывания и вычисления правил
+	Interval time.Duration `yaml:"interval" env:"RULES_INTERVAL"`
+	MaxRules int           `yaml:"max_rules" env:"RULES_MAX_RULES"`
+}
+
+// SilencesConfig хранение окон обслуживания
+type SilencesConfig struct {
+	// Key хэш Redis, в котором окна хранятся для всех экземпляров
+	Key string `yaml:"key" env:"SILENCES_KEY"`
+	// Interval период перечитывания окон
+	Interval    time.Duration `yaml:"interval" env:"SILENCES_INTERVAL"`
+	MaxSilences int           `yaml:"max_silences" env:"SILENCES_MAX"`
+	// Retention время, которое закончившееся окно остается в списке
+	Retention time.Duration `yaml:"retention" env:"SILENCES_RETENTION"`
+}
+
+// InfluxConfig прием InfluxDB line protocol на POST /api/influx/write
+type InfluxConfig struct {
+	Enabled bool `yaml:"enabled" env:"INFLUX_ENABLED"`
+	// DeviceTag тег точки с идентификатором устройства (у Telegraf — host)
+	DeviceTag string `yaml:"device_tag" env:"INFLUX_DEVICE_TAG"`
+	// Fields соответствие measurement.field полю метрики, например cpu.usage_user: cpu
+	Fields map[string]string `yaml:"fields"`
+	// UnmappedFields поля без соответствия: drop или prefix (measurement_field)
+	UnmappedFields string `yaml:"unmapped_fields" env:"INFLUX_UNMAPPED_FIELDS"`
+	// MaxLines ограничивает число строк в одном запросе
+	MaxLines int `yaml:"max_lines" env:"INFLUX_MAX_LINES"`
+}
+
+// NATSConfig прием метрик из JetStream и публикация аномалий в JetStream
+type NATSConfig struct {
+	// URL серверов nats://host:port или tls://host:port через запятую;
+	// пустое значение отключает интеграцию
+	URL string `yaml:"url" env:"NATS_URL"`
+	// Аутентификация: одно из user/password, token, creds_file (JWT и
+	// seed, выданные nsc) или nkey_seed_file
+	User         string        `yaml:"user" env:"NATS_USER"`
+	Password     string        `yaml:"password" env:"NATS_PASSWORD" secret:"true"`
+	Token        string        `yaml:"token" env:"NATS_TOKEN" secret:"true"`
+	CredsFile    string        `yaml:"creds_file" env:"NATS_CREDS_FILE"`
+	NKeySeedFile string        `yaml:"nkey_seed_file" env:"NATS_NKEY_SEED_FILE"`
+	TLS          NATSTLSConfig `yaml:"tls"`
+	// Name имя клиента в мониторинге NATS
+	Name string `yaml:"name" env:"NATS_NAME"`
+	// Timeout подключения, запросов к JetStream API и подтверждения публикации
+	Timeout time.Duration `yaml:"timeout" env:"NATS_TIMEOUT"`
+	// ReconnectWait пауза между попытками переподключения
+	ReconnectWait time.Duration `yaml:"reconnect_wait" env:"NATS_RECONNECT_WAIT"`
+	// MaxReconnects попыток восстановить разорванное соединение, -1 — без ограничения
+	MaxReconnects int `yaml:"max_reconnects" env:"NATS_MAX_RECONNECTS"`
+	// Subject тема с метриками в формате POST /api/metrics; пустое значение отключает прием
+	Subject string `yaml:"subject" env:"NATS_SUBJECT"`
+	// Stream поток с темой subject; пустое значение — поток ищется по теме
+	Stream string `yaml:"stream" env:"NATS_STREAM"`
+	// Durable имя долговечного потребителя, общего для всех экземпляров
+	Durable string `yaml:"durable" env:"NATS_DURABLE"`
+	// Batch сообщений в одной выборке
+	Batch int `yaml:"batch" env:"NATS_BATCH"`
+	// AckWait время до повторной доставки неподтвержденного сообщения
+	AckWait time.Duration `yaml:"ack_wait" env:"NATS_ACK_WAIT"`
+	// MaxDeliver попыток доставки сообщения, -1 — без ограничения
+	MaxDeliver int `yaml:"max_deliver" env:"NATS_MAX_DELIVER"`
+	// RetryDelay задержка повторной доставки метрики, отклоненной из-за перегрузки или квоты
+	RetryDelay time.Duration `yaml:"retry_delay" env:"NATS_RETRY_DELAY"`
+	// AnomalySubject тема для аномалий; пустое значение отключает публикацию
+	AnomalySubject string `yaml:"anomaly_subject" env:"NATS_ANOMALY_SUBJECT"`
+	// QueueSize аномалий, ожидающих публикации
+	QueueSize int `yaml:"queue_size" env:"NATS_QUEUE_SIZE"`
+}
+
+// NATSTLSConfig TLS соединения с NATS. Без этих параметров TLS включается,
+// только если сервер его требует или url начинается с tls://, и сертификат
+// сервера проверяется по системным корневым.
+type NATSTLSConfig struct {
+	// CAFile корневые сертификаты для проверки сервера
+	CAFile string `yaml:"ca_file" env:"NATS_TLS_CA_FILE"`
+	// CertFile и KeyFile клиентский сертификат, если сервер проверяет клиентов
+	CertFile           string `yaml:"cert_file" env:"NATS_TLS_CERT_FILE"`
+	KeyFile            string `yaml:"key_file" env:"NATS_TLS_KEY_FILE"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify" env:"NATS_TLS_INSECURE_SKIP_VERIFY"`
+}
+
+// configured задан ли хотя бы один параметр TLS
+func (t NATSTLSConfig) configured() bool {
+	return t.CAFile != "" || t.CertFile != "" || t.KeyFile != "" || t.InsecureSkipVerify
+}
+
+// DeviceTokensConfig проверка токенов устройств при приеме метрик
+type DeviceTokensConfig struct {
+	// Mode off, optional (проверяются устройства с выданным токеном) или required
+	Mode string `yaml:"mode" env:"DEVICE_TOKENS_MODE"`
+	// Key хэш Redis, в котором хэши токенов хранятся для всех экземпляров
+	Key string `yaml:"key" env:"DEVICE_TOKENS_KEY"`
+	// Interval период перечитывания токенов
+	Interval time.Duration `yaml:"interval" env:"DEVICE_TOKENS_INTERVAL"`
+}
+
+// CohortsConfig атрибуты устройств и сравнение устройств с их когортами
+type CohortsConfig struct {
+	// MetadataKey хэш Redis с атрибутами устройств (прошивка, модель и т.п.)
+	MetadataKey string `yaml:"metadata_key" env:"COHORTS_METADATA_KEY"`
+	// Interval период перечитывания атрибутов
+	Interval time.Duration `yaml:"interval" env:"COHORTS_INTERVAL"`
+	// Threshold отклонение от медианы когорты в робастных σ, с которого устройство — выброс
+	Threshold float64 `yaml:"threshold" env:"COHORTS_THRESHOLD"`
+	// MinDevices минимальный размер когорты, при котором ищутся выбросы
+	MinDevices int `yaml:"min_devices" env:"COHORTS_MIN_DEVICES"`
+}
+
+// FieldsConfig реестр единиц, типов и диапазонов полей метрик
+type FieldsConfig struct {
+	// Key хэш Redis с объявлениями полей
+	Key string `yaml:"key" env:"FIELDS_KEY"`
+	// Interval период перечитывания объявлений
+	Interval time.Duration `yaml:"interval" env:"FIELDS_INTERVAL"`
+}
+
+// ReportsConfig сводные отчеты об аномалиях по расписанию
+type ReportsConfig struct {
+	Enabled bool `yaml:"enabled" env:"REPORTS_ENABLED"`
+	// Schedule выражение cron из пяти полей или @daily, @weekly и т.п.
+	Schedule string `yaml:"schedule" env:"REPORTS_SCHEDULE"`
+	// Timezone часовой пояс расписания
+	Timezone string `yaml:"timezone" env:"REPORTS_TIMEZONE"`
+	// Period за какой период до момента отчета считаются аномалии
+	Period time.Duration `yaml:"period" env:"REPORTS_PERIOD"`
+	// TopDevices сколько устройств с наибольшим числом аномалий попадает в отчет
+	TopDevices int `yaml:"top_devices" env:"REPORTS_TOP_DEVICES"`
+	// Key список Redis с последними отчетами, MaxReports — его длина
+	Key        string              `yaml:"key" env:"REPORTS_KEY"`
+	MaxReports int                 `yaml:"max_reports" env:"REPORTS_MAX_REPORTS"`
+	Timeout    time.Duration       `yaml:"timeout" env:"REPORTS_TIMEOUT"`
+	Webhook    ReportWebhookConfig `yaml:"webhook"`
+	Email      ReportEmailConfig   `yaml:"email"`
+}
+
+// ReportWebhookConfig получатель отчета в JSON; пустой url — без отправки
+type ReportWebhookConfig struct {
+	URL       string `yaml:"url" env:"REPORTS_WEBHOOK_URL"`
+	AuthToken string `yaml:"auth_token" env:"REPORTS_WEBHOOK_AUTH_TOKEN" secret:"true"`
+}
+
+// ReportEmailConfig рассылка отчета письмом; пустой smtp_addr — без отправки
+type ReportEmailConfig struct {
+	// SMTPAddr сервер host:port
+	SMTPAddr string   `yaml:"smtp_addr" env:"REPORTS_SMTP_ADDR"`
+	Username string   `yaml:"username" env:"REPORTS_SMTP_USERNAME"`
+	Password string   `yaml:"password" env:"REPORTS_SMTP_PASSWORD" secret:"true"`
+	From     string   `yaml:"from" env:"REPORTS_EMAIL_FROM"`
+	To       []string `yaml:"to" env:"REPORTS_EMAIL_TO"`
+}
+
+// FeedbackConfig оценки аномалий операторами и подстройка порога z-score по ним
+type FeedbackConfig struct {
+	// AutoTune поднимать порог устройствам с частыми ложными срабатываниями
+	AutoTune bool `yaml:"auto_tune" env:"FEEDBACK_AUTO_TUNE"`
+	// Key хэш Redis со счетчиками оценок по устройствам
+	Key string `yaml:"key" env:"FEEDBACK_KEY"`
+	// Interval период перечитывания счетчиков
+	Interval time.Duration `yaml:"interval" env:"FEEDBACK_INTERVAL"`
+	// MinLabels оценок устройства, после которых порог начинает подстраиваться
+	MinLabels int `yaml:"min_labels" env:"FEEDBACK_MIN_LABELS"`
+	// TargetFalsePositiveRate доля ложных срабатываний, выше которой порог растет
+	TargetFalsePositiveRate float64 `yaml:"target_false_positive_rate" env:"FEEDBACK_TARGET_FALSE_POSITIVE_RATE"`
+	// MaxThresholdFactor множитель порога, когда все оцененные срабатывания ложные
+	MaxThresholdFactor float64 `yaml:"max_threshold_factor" env:"FEEDBACK_MAX_THRESHOLD_FACTOR"`
+}
+
+// CalibrationConfig перевод оценок детекторов в вероятности по распределениям устройств
+type CalibrationConfig struct {
+	Enabled bool `yaml:"enabled" env:"CALIBRATION_ENABLED"`
+	// MinSamples оценок устройства, после которых используется его собственное распределение
+	MinSamples int `yaml:"min_samples" env:"CALIBRATION_MIN_SAMPLES"`
+	// MaxSamples оценок в текущем скетче до его замены новым
+	MaxSamples int `yaml:"max_samples" env:"CALIBRATION_MAX_SAMPLES"`
+}
+
+type ForensicsConfig struct {
+	Enabled bool `yaml:"enabled" env:"FORENSICS_ENABLED"`
+	// Samples число значений до и после аномалии в снимке
+	Samples        int           `yaml:"samples" env:"FORENSICS_SAMPLES"`
+	Retention      time.Duration `yaml:"retention" env:"FORENSICS_RETENTION"`
+	CaptureTimeout time.Duration `yaml:"capture_timeout" env:"FORENSICS_CAPTURE_TIMEOUT"`
+	MemoryLimit    int           `yaml:"memory_limit" env:"FORENSICS_MEMORY_LIMIT"`
+}
+
+// StreamConfig очередь приема метрик в Redis Stream
+type StreamConfig struct {
+	Enabled bool   `yaml:"enabled" env:"STREAM_ENABLED"`
+	Key     string `yaml:"key" env:"STREAM_KEY"`
+	Group   string `yaml:"group" env:"STREAM_GROUP"`
+	// Consumer имя потребителя в группе, по умолчанию имя хоста
+	Consumer  string        `yaml:"consumer" env:"STREAM_CONSUMER"`
+	Workers   int           `yaml:"workers" env:"STREAM_WORKERS"`
+	BatchSize int           `yaml:"batch_size" env:"STREAM_BATCH_SIZE"`
+	Block     time.Duration `yaml:"block" env:"STREAM_BLOCK"`
+	// ClaimIdle время, после которого неподтвержденная запись забирается другим потребителем
+	ClaimIdle time.Duration `yaml:"claim_idle" env:"STREAM_CLAIM_IDLE"`
+	// MaxLen и MaxAge ограничивают поток; 0 отключает ограничение. Записи,
+	// которые еще не обработали читатели, не удаляются.
+	MaxLen       int           `yaml:"max_len" env:"STREAM_MAX_LEN"`
+	MaxAge       time.Duration `yaml:"max_age" env:"STREAM_MAX_AGE"`
+	TrimInterval time.Duration `yaml:"trim_interval" env:"STREAM_TRIM_INTERVAL"`
+}
+
+// SamplingConfig режим высокого разрешения после аномалии
+type SamplingConfig struct {
+	Enabled bool `yaml:"enabled" env:"SAMPLING_ENABLED"`
+	// Interval интервал сбора, запрашиваемый у шлюза на время всплеска
+	Interval time.Duration `yaml:"interval" env:"SAMPLING_INTERVAL"`
+	// Duration срок режима после последней аномалии устройства
+	Duration   time.Duration `yaml:"duration" env:"SAMPLING_DURATION"`
+	MaxSamples int           `yaml:"max_samples" env:"SAMPLING_MAX_SAMPLES"`
+	Retention  time.Duration `yaml:"retention" env:"SAMPLING_RETENTION"`
+}
+
+// SyntheticConfig периодические тестовые доставки в уведомители и приемники
+type SyntheticConfig struct {
+	Enabled  bool          `yaml:"enabled" env:"SYNTHETIC_ENABLED"`
+	Interval time.Duration `yaml:"interval" env:"SYNTHETIC_INTERVAL"`
+	Timeout  time.Duration `yaml:"timeout" env:"SYNTHETIC_TIMEOUT"`
+	// FailureThreshold число неудач подряд, после которого интеграция считается нерабочей
+	FailureThreshold int `yaml:"failure_threshold" env:"SYNTHETIC_FAILURE_THRESHOLD"`
+}
+
+// ClickHouseConfig архив сырых метрик; пустой URL отключает архив
+type ClickHouseConfig struct {
+	URL           string        `yaml:"url" env:"CLICKHOUSE_URL"`
+	Database      string        `yaml:"database" env:"CLICKHOUSE_DATABASE"`
+	Table         string        `yaml:"table" env:"CLICKHOUSE_TABLE"`
+	User          string        `yaml:"user" env:"CLICKHOUSE_USER"`
+	Password      string        `yaml:"password" env:"CLICKHOUSE_PASSWORD" secret:"true"`
+	BatchSize     int           `yaml:"batch_size" env:"CLICKHOUSE_BATCH_SIZE"`
+	FlushInterval time.Duration `yaml:"flush_interval" env:"CLICKHOUSE_FLUSH_INTERVAL"`
+	QueueSize     int           `yaml:"queue_size" env:"CLICKHOUSE_QUEUE_SIZE"`
+	AsyncInsert   bool          `yaml:"async_insert" env:"CLICKHOUSE_ASYNC_INSERT"`
+	Timeout       time.Duration `yaml:"timeout" env:"CLICKHOUSE_TIMEOUT"`
+	// Compression кодек сжатия пакетов INSERT: none, gzip, deflate, zstd, lz4 или snappy
+	Compression      string `yaml:"compression" env:"CLICKHOUSE_COMPRESSION"`
+	CompressionLevel int    `yaml:"compression_level" env:"CLICKHOUSE_COMPRESSION_LEVEL"`
+}
+
+// HAConfig режим пары active/standby с общей блокировкой в Redis
+type HAConfig struct {
+	Enabled bool   `yaml:"enabled" env:"HA_ENABLED"`
+	LockKey string `yaml:"lock_key" env:"HA_LOCK_KEY"`
+	// InstanceID владелец блокировки, по умолчанию имя хоста и pid
+	InstanceID string `yaml:"instance_id" env:"HA_INSTANCE_ID"`
+	// LockTTL определяет время переключения на резервный экземпляр при отказе активного
+	LockTTL       time.Duration `yaml:"lock_ttl" env:"HA_LOCK_TTL"`
+	RenewInterval time.Duration `yaml:"renew_interval" env:"HA_RENEW_INTERVAL"`
+}
+
+// LeaderConfig выборы лидера среди реплик для фоновых задач
+type LeaderConfig struct {
+	Enabled  bool   `yaml:"enabled" env:"LEADER_ENABLED"`
+	LeaseKey string `yaml:"lease_key" env:"LEADER_LEASE_KEY"`
+	// InstanceID владелец аренды, по умолчанию имя хоста и pid
+	InstanceID string `yaml:"instance_id" env:"LEADER_INSTANCE_ID"`
+	// LeaseTTL через сколько после отказа лидера задачи переходят к другой реплике
+	LeaseTTL      time.Duration `yaml:"lease_ttl" env:"LEADER_LEASE_TTL"`
+	RenewInterval time.Duration `yaml:"renew_interval" env:"LEADER_RENEW_INTERVAL"`
+}
+
+// MigrationsConfig миграции схемы данных в Redis, применяемые при запуске
+type MigrationsConfig struct {
+	VersionKey string        `yaml:"version_key" env:"MIGRATIONS_VERSION_KEY"`
+	LockKey    string        `yaml:"lock_key" env:"MIGRATIONS_LOCK_KEY"`
+	LockTTL    time.Duration `yaml:"lock_ttl" env:"MIGRATIONS_LOCK_TTL"`
+	// WaitTimeout сколько ждать экземпляр, выполняющий миграции, прежде чем завершиться с ошибкой
+	WaitTimeout time.Duration `yaml:"wait_timeout" env:"MIGRATIONS_WAIT_TIMEOUT"`
+}
+
+// WarmupConfig прогрев буфера метриками из кэша Redis при запуске
+type WarmupConfig struct {
+	Enabled bool `yaml:"enabled" env:"WARMUP_ENABLED"`
+	// MaxAge возраст самых старых восстанавливаемых метрик; кэш хранит их 10 минут
+	MaxAge    time.Duration `yaml:"max_age" env:"WARMUP_MAX_AGE"`
+	Timeout   time.Duration `yaml:"timeout" env:"WARMUP_TIMEOUT"`
+	ScanCount int           `yaml:"scan_count" env:"WARMUP_SCAN_COUNT"`
+}
+
+// SharedStatsConfig общая для реплик статистика скользящего окна в Redis
+type SharedStatsConfig struct {
+	Enabled   bool   `yaml:"enabled" env:"SHARED_STATS_ENABLED"`
+	KeyPrefix string `yaml:"key_prefix" env:"SHARED_STATS_KEY_PREFIX"`
+	// TTL срок хранения статистики устройства, от которого нет новых значений
+	TTL time.Duration `yaml:"ttl" env:"SHARED_STATS_TTL"`
+	// Timeout ограничивает обращение к Redis; по истечении используется локальное окно
+	Timeout time.Duration `yaml:"timeout" env:"SHARED_STATS_TIMEOUT"`
+}
+
+// AdmissionConfig отказ в приеме метрик некритичных устройств при перегрузке
+type AdmissionConfig struct {
+	Enabled bool `yaml:"enabled" env:"ADMISSION_ENABLED"`
+	// QueueSaturation загрузка конвейера (как в /health/lb), с которой прием ограничивается
+	QueueSaturation float64 `yaml:"queue_saturation" env:"ADMISSION_QUEUE_SATURATION"`
+	// MemoryLimitMB объем кучи, с которого прием ограничивается; 0 — без ограничения
+	MemoryLimitMB int `yaml:"memory_limit_mb" env:"ADMISSION_MEMORY_LIMIT_MB"`
+	// CriticalDevices устройства, метрики которых принимаются и при перегрузке
+	CriticalDevices []string `yaml:"critical_devices" env:"ADMISSION_CRITICAL_DEVICES"`
+	// RetryAfter значение заголовка Retry-After в ответе 503
+	RetryAfter time.Duration `yaml:"retry_after" env:"ADMISSION_RETRY_AFTER"`
+}
+
+// CORSConfig доступ к API из браузера со страниц других источников
+type CORSConfig struct {
+	Enabled bool `yaml:"enabled" env:"CORS_ENABLED"`
+	// AllowedOrigins источники вида https://dash.example.com; * — любой
+	AllowedOrigins []string `yaml:"allowed_origins" env:"CORS_ALLOWED_ORIGINS"`
+	AllowedMethods []string `yaml:"allowed_methods" env:"CORS_ALLOWED_METHODS"`
+	AllowedHeaders []string `yaml:"allowed_headers" env:"CORS_ALLOWED_HEADERS"`
+	// AllowCredentials разрешает запросы с cookie и Authorization браузера
+	AllowCredentials bool `yaml:"allow_credentials" env:"CORS_ALLOW_CREDENTIALS"`
+	// MaxAge время, на которое браузер запоминает ответ на OPTIONS
+	MaxAge time.Duration `yaml:"max_age" env:"CORS_MAX_AGE"`
+}
+
+// HealthConfig проверки зависимостей /health
+type HealthConfig struct {
+	// CheckTimeout время ожидания одной проверки
+	CheckTimeout time.Duration `yaml:"check_timeout" env:"HEALTH_CHECK_TIMEOUT"`
+	// QueueSaturation заполненность очереди воркеров, с которой проверка worker_queues не проходит
+	QueueSaturation float64 `yaml:"queue_saturation" env:"HEALTH_QUEUE_SATURATION"`
+}
+
+// JobsConfig бюджеты фоновых задач: агрегатов интервалов, обрезки потока и архива
+type JobsConfig struct {
+	// DeferAt загрузка конвейера ingest, с которой проходы откладываются; 0 — не откладывать
+	DeferAt float64 `yaml:"defer_at" env:"JOBS_DEFER_AT"`
+	// MaxDeferral наибольшая задержка прохода, после которой он выполняется несмотря на загрузку
+	MaxDeferral time.Duration `yaml:"max_deferral" env:"JOBS_MAX_DEFERRAL"`
+	// MaxConcurrent проходов всех задач одновременно; 0 — без ограничения
+	MaxConcurrent int       `yaml:"max_concurrent" env:"JOBS_MAX_CONCURRENT"`
+	Rollups       JobBudget `yaml:"rollups"`
+	Retention     JobBudget `yaml:"retention"`
+	Archiver      JobBudget `yaml:"archiver"`
+}
+
+// JobBudget бюджет одной фоновой задачи
+type JobBudget struct {
+	// MaxRunTime ограничение одного прохода; 0 — без ограничения
+	MaxRunTime time.Duration `yaml:"max_run_time"`
+	// Utilization доля времени, которую задача может работать, от 0 до 1
+	Utilization float64 `yaml:"utilization"`
+}
+
+// budget возвращает бюджет задачи; у неизвестной задачи ограничений нет
+func (c JobsConfig) budget(job string) JobBudget {
+	switch job {
+	case JobRollups:
+		return c.Rollups
+	case JobRetention:
+		return c.Retention
+	case JobArchiver:
+		return c.Archiver
+	}
+	return JobBudget{Utilization: 1}
+}
+
+// LBHealthConfig пороги загрузки для проверки балансировщика /health/lb
+type LBHealthConfig struct {
+	// DegradeAt загрузка, с которой начинается сброс трафика
+	DegradeAt float64 `yaml:"degrade_at" env:"LB_DEGRADE_AT"`
+	// RecoverAt загрузка, ниже которой сброс прекращается
+	RecoverAt float64 `yaml:"recover_at" env:"LB_RECOVER_AT"`
+	// FailAt загрузка, при которой отказывают все проверки
+	FailAt         float64       `yaml:"fail_at" env:"LB_FAIL_AT"`
+	SampleInterval time.Duration `yaml:"sample_interval" env:"LB_SAMPLE_INTERVAL"`
+	// StreamLagLimit отставание группы потребителей, считающееся полной загрузкой
+	StreamLagLimit time.Duration `yaml:"stream_lag_limit" env:"LB_STREAM_LAG_LIMIT"`
+}
+
+// RollupsConfig агрегаты значений по интервалам, которые фоновый агрегатор
+// считает из потока ingest и хранит в Redis
+type RollupsConfig struct {
+	Enabled   bool   `yaml:"enabled" env:"ROLLUPS_ENABLED"`
+	KeyPrefix string `yaml:"key_prefix" env:"ROLLUPS_KEY_PREFIX"`
+	// Resolution длительность интервала, целое число секунд
+	Resolution time.Duration `yaml:"resolution" env:"ROLLUPS_RESOLUTION"`
+	Retention  time.Duration `yaml:"retention" env:"ROLLUPS_RETENTION"`
+	// CheckpointKey хеш Redis с последней учтенной записью потока
+	CheckpointKey string `yaml:"checkpoint_key" env:"ROLLUPS_CHECKPOINT_KEY"`
+}
+
+// ClusterConfig распределение устройств по экземплярам консистентным хешированием
+type ClusterConfig struct {
+	Enabled    bool   `yaml:"enabled" env:"CLUSTER_ENABLED"`
+	MembersKey string `yaml:"members_key" env:"CLUSTER_MEMBERS_KEY"`
+	// AdvertiseAddr host:port, по которому экземпляр доступен остальным; по умолчанию имя хоста и server.port
+	AdvertiseAddr     string        `yaml:"advertise_addr" env:"CLUSTER_ADVERTISE_ADDR"`
+	HeartbeatInterval time.Duration `yaml:"heartbeat_interval" env:"CLUSTER_HEARTBEAT_INTERVAL"`
+	// MemberTTL время без heartbeat, после которого экземпляр исключается из кольца
+	MemberTTL      time.Duration `yaml:"member_ttl" env:"CLUSTER_MEMBER_TTL"`
+	VirtualNodes   int           `yaml:"virtual_nodes" env:"CLUSTER_VIRTUAL_NODES"`
+	ForwardTimeout time.Duration `yaml:"forward_timeout" env:"CLUSTER_FORWARD_TIMEOUT"`
+	// AuthToken bearer-токен для пересылаемых запросов без собственного Authorization
+	AuthToken string `yaml:"auth_token" env:"CLUSTER_AUTH_TOKEN" secret:"true"`
+	// ForwardSecret общий секрет экземпляров: пометка пересланного запроса
+	// принимается только вместе с ним, иначе клиент мог бы обойти маршрутизацию
+	ForwardSecret string `yaml:"forward_secret" env:"CLUSTER_FORWARD_SECRET" secret:"true"`
+	// CAFile корневые сертификаты для проверки экземпляров при включенном tls;
+	// пусто — системные корневые
+	CAFile string `yaml:"ca_file" env:"CLUSTER_CA_FILE"`
+	// ForwardCompression кодек сжатия метрик, пересылаемых владельцу: none, gzip, deflate, zstd, lz4 или snappy
+	ForwardCompression      string `yaml:"forward_compression" env:"CLUSTER_FORWARD_COMPRESSION"`
+	ForwardCompressionLevel int    `yaml:"forward_compression_level" env:"CLUSTER_FORWARD_COMPRESSION_LEVEL"`
+}
+
+// SecretsConfig источники секретов для полей со ссылками vault:<путь>#<ключ> и file:<путь>
+type SecretsConfig struct {
+	// RefreshInterval период перечитывания секретов; 0 — только при загрузке конфигурации
+	RefreshInterval time.Duration `yaml:"refresh_interval" env:"SECRETS_REFRESH_INTERVAL"`
+	Vault           VaultConfig   `yaml:"vault"`
+}
+
+type VaultConfig struct {
+	Addr  string `yaml:"addr" env:"VAULT_ADDR"`
+	Token string `yaml:"token" env:"VAULT_TOKEN"`
+	// TokenFile файл с токеном, например sink Vault Agent; имеет приоритет над token
+	TokenFile string        `yaml:"token_file" env:"VAULT_TOKEN_FILE"`
+	Namespace string        `yaml:"namespace" env:"VAULT_NAMESPACE"`
+	Timeout   time.Duration `yaml:"timeout" env:"VAULT_TIMEOUT"`
+}
+
+// ListenerConfig слушатель с набором групп маршрутов (ingest, query, admin, metrics)
+type ListenerConfig struct {
+	Name string `yaml:"name"`
+	// Addr адрес host:port или unix:/path
+	Addr   string   `yaml:"addr"`
+	Routes []string `yaml:"routes"`
+	// AuthTokens bearer-токены; пустой список отключает проверку
+	AuthTokens []string        `yaml:"auth_tokens" secret:"true"`
+	RateLimit  RateLimitConfig `yaml:"rate_limit"`
+}
+
+// SLAConfig ожидаемый диапазон поля для устройств: доля значений в [min, max]
+// за окно должна быть не ниже target (например, cpu <= 80 в 99% времени)
+type SLAConfig struct {
+	Name    string   `yaml:"name"`
+	Devices []string `yaml:"devices"`
+	// DevicePattern шаблон идентификаторов устройств (path.Match, например sensor-*)
+	DevicePattern string        `yaml:"device_pattern"`
+	Field         string        `yaml:"field"`
+	Min           *float64      `yaml:"min"`
+	Max           *float64      `yaml:"max"`
+	Target        float64       `yaml:"target"`
+	Window        time.Duration `yaml:"window"`
+}
+
+// ForwarderConfig получатель копии данных: http — JSON-пакеты POST на url,
+// grpc — вызовы highload.v1.Forwarder/Forward (proto/forward.proto) на addr.
+// Нулевые значения параметров очереди заменяются значениями по умолчанию.
+type ForwarderConfig struct {
+	Name     string `yaml:"name"`
+	Protocol string `yaml:"protocol"`
+	URL      string `yaml:"url"`
+	Addr     string `yaml:"addr"`
+	// TLS шифрование соединения gRPC; для http определяется схемой url
+	TLS bool `yaml:"tls"`
+	// Data пересылаемые данные: metrics, anomalies или all
+	Data          string        `yaml:"data"`
+	BatchSize     int           `yaml:"batch_size"`
+	FlushInterval time.Duration `yaml:"flush_interval"`
+	QueueSize     int           `yaml:"queue_size"`
+	// MaxRetries повторов пакета после временной ошибки; -1 — без повторов
+	MaxRetries int `yaml:"max_retries"`
+	// RetryBackoff пауза перед первым повтором, далее удваивается
+	RetryBackoff time.Duration `yaml:"retry_backoff"`
+	Timeout      time.Duration `yaml:"timeout"`
+	// AuthToken bearer-токен получателя
+	AuthToken string `yaml:"auth_token" secret:"true"`
+}
+
+// RateLimitConfig ограничение частоты запросов с одного адреса; rps 0 — без ограничения
+type RateLimitConfig struct {
+	RPS   float64 `yaml:"rps"`
+	Burst int     `yaml:"burst"`
+}
+
+// PipelineConfig связывает источники, обработчики, детекторы и приемники.
+// Пустые списки заменяются значениями по умолчанию: источники http, udp
+// (если задан udp.addr), influx (если influx.enabled) и nats (если задан
+// nats.subject), все включенные детекторы, приемники redis_cache и clickhouse (если задан clickhouse.url).
+type PipelineConfig struct {
+	Sources    []PipelineStageConfig `yaml:"sources"`
+	Processors []ProcessorConfig     `yaml:"processors"`
+	// Detectors ключи секции detectors (zscore, cusum, iqr, correlation,
+	// isolation), получающие значения
+	Detectors []string              `yaml:"detectors"`
+	Sinks     []PipelineStageConfig `yaml:"sinks"`
+	// DrainTimeout время на отправку принятых данных отключаемым приемником
+	DrainTimeout time.Duration `yaml:"drain_timeout" env:"PIPELINE_DRAIN_TIMEOUT"`
+}
+
+// PipelineStageConfig именованный источник или приемник
+type PipelineStageConfig struct {
+	Name string `yaml:"name"`
+	Type string `yaml:"type"`
+}
+
+// ProcessorConfig обработчик полей метрики: drop_fields, keep_fields, rename, scale
+type ProcessorConfig struct {
+	Name   string   `yaml:"name"`
+	Type   string   `yaml:"type"`
+	Fields []string `yaml:"fields"`
+	From   string   `yaml:"from"`
+	To     string   `yaml:"to"`
+	// Factor и Offset для scale: value*factor + offset
+	Factor float64 `yaml:"factor"`
+	Offset float64 `yaml:"offset"`
+}
+
+// DefaultConfig возвращает конфигурацию, совпадающую с прежним поведением сервиса
+func DefaultConfig() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Port:              "8080",
+			UnixSocketMode:    "0660",
+			ReadHeaderTimeout: 5 * time.Second,
+			MaxHeaderBytes:    1 << 20,
+			ReadTimeout:       30 * time.Second,
+			WriteTimeout:      60 * time.Second,
+			IdleTimeout:       2 * time.Minute,
+			MaxBodyBytes:      4 << 20,
+		},
+		TLS: TLSConfig{ReloadInterval: 30 * time.Second, MinVersion: "1.2"},
+		IDs: IDsConfig{Generator: IDGeneratorULID},
+		Ingest: IngestConfig{
+			MaxFields:            32,
+			MaxSamples:           600,
+			MaxClientVersions:    100,
+			MaxDecompressedBytes: 10 << 20,
+			Tracking:             true,
+			StatusTTL:            time.Hour,
+			StatusKeyPrefix:      "highload:ingest",
+		},
+		Dedup:    DedupConfig{Enabled: true, TTL: 10 * time.Minute, KeyPrefix: "highload:dedup"},
+		Rules:    RulesConfig{Key: "highload:rules", Interval: 10 * time.Second, MaxRules: 100},
+		Silences: SilencesConfig{Key: "highload:silences", Interval: 10 * time.Second, MaxSilences: 1000, Retention: 24 * time.Hour},
+		Influx:   InfluxConfig{DeviceTag: "host", UnmappedFields: InfluxUnmappedPrefix, MaxLines: 5000},
+		NATS: NATSConfig{
+			Name:          "highload-service",
+			Timeout:       5 * time.Second,
+			ReconnectWait: 2 * time.Second,
+			MaxReconnects: 60,
+			Durable:       "highload-service",
+			Batch:         100,
+			AckWait:       30 * time.Second,
+			MaxDeliver:    5,
+			RetryDelay:    5 * time.Second,
+			QueueSize:     10000,
+		},
+		DeviceTokens: DeviceTokensConfig{Mode: DeviceTokensOff, Key: "highload:device_tokens", Interval: 10 * time.Second},
+		Feedback:     FeedbackConfig{Key: "highload:feedback", Interval: 30 * time.Second, MinLabels: 10, TargetFalsePositiveRate: 0.2, MaxThresholdFactor: 2},
+		Cohorts:      CohortsConfig{MetadataKey: "highload:device_metadata", Interval: 30 * time.Second, Threshold: 3.0, MinDevices: 5},
+		Fields:       FieldsConfig{Key: "highload:fields", Interval: 30 * time.Second},
+		Reports: ReportsConfig{
+			Schedule:   "0 8 * * *",
+			Timezone:   "UTC",
+			Period:     24 * time.Hour,
+			TopDevices: 20,
+			Key:        "highload:reports",
+			MaxReports: 30,
+			Timeout:    10 * time.Second,
+		},
+		Calibration: CalibrationConfig{Enabled: true, MinSamples: 100, MaxSamples: 10000},
+		Deadlines: DeadlinesConfig{
+			Realtime: time.Second,
+			Standard: 10 * time.Second,
+			Bulk:     5 * time.Minute,
+		},
+		Batch: BatchConfig{Settle: 2 * time.Minute, MaxSamples: 100000},
+		Redis: RedisConfig{
+			Mode:            RedisModeStandalone,
+			Addr:            "localhost:6379",
+			MaxRetries:      3,
+			MinRetryBackoff: 8 * time.Millisecond,
+			MaxRetryBackoff: 512 * time.Millisecond,
+		},
+		Buffer: BufferConfig{
+			Window:           50,
+			MaxSize:          1000,
+			LatenessHorizon:  5 * time.Minute,
+			IdleTTL:          24 * time.Hour,
+			MemoryLimitMB:    1024,
+			ShrinkOnPressure: true,
+			EvictionInterval: 30 * time.Second,
+		},
+		Memory: MemoryConfig{TopDevices: 20},
+		Anomalies: AnomaliesConfig{
+			Retention:    24 * time.Hour,
+			MaxPerDevice: 500,
+		},
+		Events: EventsConfig{
+			Retention: 7 * 24 * time.Hour,
+			Window:    15 * time.Minute,
+			MaxEvents: 10000,
+		},
+		Detectors:     defaultDetectorsConfig(),
+		Shadow:        ShadowConfig{Detectors: disabledDetectors(defaultDetectorsConfig()), HistorySize: 1000},
+		UDP:           UDPConfig{Workers: 4},
+		Admin:         AdminConfig{TrashRetention: 24 * time.Hour},
+		Observability: ObservabilityConfig{SLIWindow: 5 * time.Minute, AccessLog: true},
+		Alerting: AlertingConfig{
+			CriticalZScore: 4.0,
+			QueueSize:      1000,
+			Timeout:        5 * time.Second,
+			PagerDuty: PagerDutyConfig{
+				URL:          "https://events.pagerduty.com",
+				Severities:   []string{SeverityCritical},
+				ResolveAfter: 10 * time.Minute,
+			},
+			Opsgenie: OpsgenieConfig{
+				URL:          "https://api.opsgenie.com",
+				Severities:   []string{SeverityCritical},
+				ResolveAfter: 10 * time.Minute,
+			},
+		},
+		Forensics: ForensicsConfig{
+			Enabled:        true,
+			Samples:        20,
+			Retention:      30 * 24 * time.Hour,
+			CaptureTimeout: 10 * time.Minute,
+			MemoryLimit:    1000,
+		},
+		Stream: StreamConfig{
+			Enabled:      true,
+			Key:          "metrics:stream",
+			Group:        "analyzers",
+			Workers:      4,
+			BatchSize:    100,
+			Block:        2 * time.Second,
+			ClaimIdle:    time.Minute,
+			MaxLen:       1000000,
+			MaxAge:       24 * time.Hour,
+			TrimInterval: 30 * time.Second,
+		},
+		Sampling: SamplingConfig{
+			Enabled:    true,
+			Interval:   time.Second,
+			Duration:   10 * time.Minute,
+			MaxSamples: 10000,
+			Retention:  7 * 24 * time.Hour,
+		},
+		ClickHouse: ClickHouseConfig{
+			Database:      "default",
+			Table:         "raw_metrics",
+			BatchSize:     10000,
+			FlushInterval: 5 * time.Second,
+			QueueSize:     100000,
+			AsyncInsert:   true,
+			Timeout:       10 * time.Second,
+			Compression:   CodecNone,
+		},
+		HA: HAConfig{
+			LockKey:       "highload:active",
+			LockTTL:       5 * time.Second,
+			RenewInterval: time.Second,
+		},
+		Leader: LeaderConfig{
+			LeaseKey:      "highload:leader",
+			LeaseTTL:      15 * time.Second,
+			RenewInterval: 5 * time.Second,
+		},
+		SharedStats: SharedStatsConfig{
+			KeyPrefix: "stats",
+			TTL:       24 * time.Hour,
+			Timeout:   200 * time.Millisecond,
+		},
+		Pipeline: PipelineConfig{
+			DrainTimeout: 30 * time.Second,
+		},
+		Warmup: WarmupConfig{
+			Enabled:   true,
+			MaxAge:    10 * time.Minute,
+			Timeout:   30 * time.Second,
+			ScanCount: 1000,
+		},
+		Synthetic: SyntheticConfig{
+			Enabled:          true,
+			Interval:         5 * time.Minute,
+			Timeout:          10 * time.Second,
+			FailureThreshold: 2,
+		},
+		Admission: AdmissionConfig{
+			Enabled:         true,
+			QueueSaturation: 0.9,
+			RetryAfter:      5 * time.Second,
+		},
+		CORS: CORSConfig{
+			AllowedMethods: []string{"GET", "POST"},
+			AllowedHeaders: []string{"Authorization", "Content-Type", tenantHeader, requestIDHeader},
+			MaxAge:         10 * time.Minute,
+		},
+		Health: HealthConfig{CheckTimeout: 2 * time.Second, QueueSaturation: 0.9},
+		Jobs: JobsConfig{
+			DeferAt:       0.8,
+			MaxDeferral:   5 * time.Minute,
+			MaxConcurrent: 2,
+			Rollups:       JobBudget{MaxRunTime: 10 * time.Second, Utilization: 0.5},
+			Retention:     JobBudget{MaxRunTime: 30 * time.Second, Utilization: 0.25},
+			Archiver:      JobBudget{MaxRunTime: 30 * time.Second, Utilization: 0.5},
+		},
+		LBHealth: LBHealthConfig{
+			DegradeAt:      0.8,
+			RecoverAt:      0.6,
+			FailAt:         0.95,
+			SampleInterval: time.Second,
+			StreamLagLimit: 30 * time.Second,
+		},
+		Rollups: RollupsConfig{
+			KeyPrefix:     "highload:rollup",
+			Resolution:    time.Minute,
+			Retention:     7 * 24 * time.Hour,
+			CheckpointKey: "highload:checkpoints:rollups",
+		},
+		Migrations: MigrationsConfig{
+			VersionKey:  "highload:schema:version",
+			LockKey:     "highload:schema:lock",
+			LockTTL:     30 * time.Second,
+			WaitTimeout: 5 * time.Minute,
+		},
+		Secrets: SecretsConfig{
+			RefreshInterval: 5 * time.Minute,
+			Vault:           VaultConfig{Timeout: 5 * time.Second},
+		},
+		Cluster: ClusterConfig{
+			MembersKey:         "highload:members",
+			HeartbeatInterval:  2 * time.Second,
+			MemberTTL:          6 * time.Second,
+			VirtualNodes:       64,
+			ForwardTimeout:     2 * time.Second,
+			ForwardCompression: CodecNone,
+		},
+	}
+}
+
+// defaultDetectorsConfig параметры детекторов по умолчанию
+func defaultDetectorsConfig() DetectorsConfig {
+	return DetectorsConfig{
+		ZScore: ZScoreConfig{Enabled: true, Threshold: 2.0, Fields: []string{"cpu"}},
+		CUSUM:  CUSUMConfig{Enabled: true, Warmup: 30, K: 0.5, H: 5.0, MinRun: 3},
+		IQR:    IQRConfig{K: 1.5, MinSamples: 20},
+		Correlation: CorrelationConfig{
+			Pairs:          []string{"rps:cpu"},
+			MinCorrelation: 0.7,
+			Threshold:      3.0,
+			MinSamples:     20,
+		},
+		Isolation: IsolationForestConfig{
+			Fields:       []string{"cpu", "memory", "rps"},
+			Trees:        50,
+			SampleSize:   128,
+			Threshold:    0.6,
+			MinSamples:   30,
+			RetrainEvery: 50,
+		},
+		Seasonal: SeasonalConfig{
+			Fields:     []string{"cpu", "memory", "rps"},
+			Buckets:    SeasonalBucketsHourOfWeek,
+			Timezone:   "UTC",
+			Threshold:  3.0,
+			MinSamples: 10,
+			HalfLife:   28 * 24 * time.Hour,
+			KeyPrefix:  "highload:seasonal",
+			TTL:        30 * 24 * time.Hour,
+			Timeout:    200 * time.Millisecond,
+		},
+		Trend: TrendConfig{
+			Fields:      []string{"memory"},
+			Window:      300,
+			MinSamples:  30,
+			MinRSquared: 0.8,
+			MinRise:     0.2,
+			Direction:   TrendDirectionUp,
+		},
+		ML: MLConfig{
+			Fields:       []string{"cpu", "memory", "rps"},
+			Window:       30,
+			Normalize:    true,
+			TimeFeatures: true,
+			Timezone:     "UTC",
+			OutputIndex:  -1,
+			Threshold:    0.9,
+		},
+	}
+}
+
+// disabledDetectors выключает все детекторы, сохраняя их параметры
+func disabledDetectors(d DetectorsConfig) DetectorsConfig {
+	d.ZScore.Enabled = false
+	d.CUSUM.Enabled = false
+	d.IQR.Enabled = false
+	d.Correlation.Enabled = false
+	d.Isolation.Enabled = false
+	d.Seasonal.Enabled = false
+	d.Trend.Enabled = false
+	d.ML.Enabled = false
+	return d
+}
+
+// LoadConfig читает файл конфигурации (если путь задан), применяет переменные
+// окружения и проверяет результат
+func LoadConfig(path string) (*Config, error) {
+	cfg := DefaultConfig()
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read config: %w", err)
+		}
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(cfg); err != nil {
+			return nil, fmt.Errorf("parse config %s: %w", path, err)
+		}
+	}
+
+	if err := applyEnv(reflect.ValueOf(cfg).Elem(), ""); err != nil {
+		return nil, err
+	}
+
+	if cfg.Tenants.PoliciesFile != "" {
+		policies, err := LoadTenantPolicies(cfg.Tenants.PoliciesFile)
+		if err != nil {
+			return nil, fmt.Errorf("tenants.policies_file: %w", err)
+		}
+		if cfg.Tenants.Policies == nil {
+			cfg.Tenants.Policies = make(TenantPolicies)
+		}
+		for tenant, policy := range policies {
+			cfg.Tenants.Policies[tenant] = policy
+		}
+	}
+
+	if cfg.Secrets.Vault.Timeout <= 0 {
+		return nil, fmt.Errorf("secrets.vault.timeout: must be positive")
+	}
+	refs, err := resolveSecrets(cfg)
+	if err != nil {
+		return nil, err
+	}
+	cfg.secretRefs = refs
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// applyEnv рекурсивно переопределяет поля с тегом env значениями из окружения
+func applyEnv(v reflect.Value, prefix string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+
+		if field.Tag.Get("env") == "-" {
+			continue
+		}
+		if field.Type.Kind() == reflect.Struct {
+			if err := applyEnv(v.Field(i), name); err != nil {
+				return err
+			}
+			continue
+		}
+
+		key := field.Tag.Get("env")
+		if key == "" {
+			continue
+		}
+		raw, ok := os.LookupEnv(key)
+		if !ok || raw == "" {
+			continue
+		}
+		if err := setFromString(v.Field(i), raw); err != nil {
+			return fmt.Errorf("%s (from %s): %w", name, key, err)
+		}
+	}
+	return nil
+}
+
+func setFromString(v reflect.Value, raw string) error {
+	switch v.Interface().(type) {
+	case time.Duration:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+	case string:
+		v.SetString(raw)
+	case int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(n))
+	case float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case []string:
+		parts := strings.Split(raw, ",")
+		for i := range parts {
+			parts[i] = strings.TrimSpace(parts[i])
+		}
+		v.Set(reflect.ValueOf(parts))
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// Validate проверяет конфигурацию; ошибка содержит путь к неверному полю
+func (c *Config) Validate() error {
+	if c.Server.Port != "" {
+		if port, err := strconv.Atoi(c.Server.Port); err != nil || port < 1 || port > 65535 {
+			return fmt.Errorf("server.port: must be a port number, got %q", c.Server.Port)
+		}
+	}
+	if c.Server.Port == "" && c.Server.UnixSocket == "" && !c.Server.SystemdActivation {
+		return fmt.Errorf("server: at least one of port, unix_socket or systemd_activation is required")
+	}
+	if c.Server.ReadHeaderTimeout <= 0 || c.Server.ReadTimeout < c.Server.ReadHeaderTimeout {
+		return fmt.Errorf("server.read_header_timeout: must be positive and not exceed read_timeout")
+	}
+	if c.Server.WriteTimeout <= 0 || c.Server.IdleTimeout <= 0 {
+		return fmt.Errorf("server: write_timeout and idle_timeout must be positive")
+	}
+	if c.Server.MaxHeaderBytes < 4<<10 {
+		return fmt.Errorf("server.max_header_bytes: must be at least 4096, got %d", c.Server.MaxHeaderBytes)
+	}
+	if c.Server.MaxBodyBytes < 1 {
+		return fmt.Errorf("server.max_body_bytes: must be at least 1, got %d", c.Server.MaxBodyBytes)
+	}
+	if mode, err := strconv.ParseUint(c.Server.UnixSocketMode, 8, 32); err != nil || mode > 0777 {
+		return fmt.Errorf("server.unix_socket_mode: must be an octal file mode, got %q", c.Server.UnixSocketMode)
+	}
+	if c.TLS.Enabled {
+		if c.TLS.CertFile == "" || c.TLS.KeyFile == "" {
+			return fmt.Errorf("tls: cert_file and key_file are required")
+		}
+		if c.TLS.ReloadInterval < 0 {
+			return fmt.Errorf("tls.reload_interval: must not be negative")
+		}
+		if _, ok := tlsVersions[c.TLS.MinVersion]; !ok {
+			return fmt.Errorf("tls.min_version: must be 1.2 or 1.3, got %q", c.TLS.MinVersion)
+		}
+		if c.TLS.RedirectPort != "" {
+			if port, err := strconv.Atoi(c.TLS.RedirectPort); err != nil || port < 1 || port > 65535 {
+				return fmt.Errorf("tls.redirect_port: must be a port number, got %q", c.TLS.RedirectPort)
+			}
+			if c.Server.Port == "" || c.TLS.RedirectPort == c.Server.Port {
+				return fmt.Errorf("tls.redirect_port: requires server.port to redirect to and must differ from it")
+			}
+		}
+	}
+	if c.Debug.Enabled && len(c.Debug.Tokens) == 0 {
+		return fmt.Errorf("debug.tokens: at least one token is required when debug is enabled")
+	}
+	switch c.IDs.Generator {
+	case IDGeneratorULID, IDGeneratorSequence:
+	default:
+		return fmt.Errorf("ids.generator: must be ulid or sequence, got %q", c.IDs.Generator)
+	}
+	if c.Ingest.MaxFields < 1 {
+		return fmt.Errorf("ingest.max_fields: must be at least 1, got %d", c.Ingest.MaxFields)
+	}
+	if c.Ingest.MaxSamples < 1 {
+		return fmt.Errorf("ingest.max_samples: must be at least 1, got %d", c.Ingest.MaxSamples)
+	}
+	if c.Ingest.MaxClientVersions < 1 {
+		return fmt.Errorf("ingest.max_client_versions: must be at least 1, got %d", c.Ingest.MaxClientVersions)
+	}
+	if c.Ingest.MaxDecompressedBytes < 1 {
+		return fmt.Errorf("ingest.max_decompressed_bytes: must be at least 1, got %d", c.Ingest.MaxDecompressedBytes)
+	}
+	if c.Ingest.StatusTTL < time.Second {
+		return fmt.Errorf("ingest.status_ttl: must be at least 1s")
+	}
+	if c.Ingest.StatusKeyPrefix == "" {
+		return fmt.Errorf("ingest.status_key_prefix: must not be empty")
+	}
+	if err := c.Quotas.validate(); err != nil {
+		return err
+	}
+	if c.Batch.Settle < time.Second {
+		return fmt.Errorf("batch.settle: must be at least 1s")
+	}
+	if c.Batch.MaxSamples < 1 {
+		return fmt.Errorf("batch.max_samples: must be at least 1, got %d", c.Batch.MaxSamples)
+	}
+	if c.Batch.DevicePattern != "" {
+		if _, err := path.Match(c.Batch.DevicePattern, ""); err != nil {
+			return fmt.Errorf("batch.device_pattern: %v", err)
+		}
+	}
+	switch c.Redis.Mode {
+	case RedisModeStandalone:
+		if c.Redis.Addr == "" {
+			return fmt.Errorf("redis.addr: must not be empty")
+		}
+	case RedisModeSentinel:
+		if c.Redis.MasterName == "" {
+			return fmt.Errorf("redis.master_name: must not be empty in sentinel mode")
+		}
+		if len(c.Redis.Addrs) == 0 {
+			return fmt.Errorf("redis.addrs: must list sentinel addresses in sentinel mode")
+		}
+	case RedisModeCluster:
+		if len(c.Redis.Addrs) == 0 {
+			return fmt.Errorf("redis.addrs: must list cluster nodes in cluster mode")
+		}
+		if c.Redis.DB != 0 {
+			return fmt.Errorf("redis.db: must be 0 in cluster mode")
+		}
+		if c.Rollups.Enabled {
+			// Скрипт агрегатов обновляет ключи разных устройств и контрольную точку атомарно
+			return fmt.Errorf("rollups.enabled: not supported in redis cluster mode")
+		}
+	default:
+		return fmt.Errorf("redis.mode: must be standalone, sentinel or cluster, got %q", c.Redis.Mode)
+	}
+	if c.Redis.DB < 0 {
+		return fmt.Errorf("redis.db: must not be negative")
+	}
+	if c.Redis.MaxRetries < -1 {
+		return fmt.Errorf("redis.max_retries: must be -1 or more, got %d", c.Redis.MaxRetries)
+	}
+	if c.Redis.MinRetryBackoff < 0 || c.Redis.MaxRetryBackoff < c.Redis.MinRetryBackoff {
+		return fmt.Errorf("redis.max_retry_backoff: must be at least redis.min_retry_backoff, both non-negative")
+	}
+	if d := c.Deadlines; d.Realtime <= 0 || d.Standard < d.Realtime || d.Bulk < d.Standard {
+		return fmt.Errorf("deadlines: must satisfy 0 < realtime <= standard <= bulk")
+	}
+	if c.Dedup.Enabled {
+		if c.Dedup.TTL < time.Second {
+			return fmt.Errorf("dedup.ttl: must be at least 1s, got %s", c.Dedup.TTL)
+		}
+		if c.Dedup.KeyPrefix == "" {
+			return fmt.Errorf("dedup.key_prefix: must not be empty")
+		}
+		if c.Dedup.ContentWindow < 0 || c.Dedup.ContentWindow > c.Dedup.TTL {
+			return fmt.Errorf("dedup.content_window: must be between 0 and dedup.ttl, got %s", c.Dedup.ContentWindow)
+		}
+	}
+	if c.Buffer.Window < 2 {
+		return fmt.Errorf("buffer.window: must be at least 2, got %d", c.Buffer.Window)
+	}
+	if c.Buffer.MaxSize < c.Buffer.Window {
+		return fmt.Errorf("buffer.max_size: must be at least buffer.window (%d), got %d", c.Buffer.Window, c.Buffer.MaxSize)
+	}
+	if c.Buffer.LatenessHorizon < 0 || c.Buffer.LatenessHorizon%time.Second != 0 {
+		return fmt.Errorf("buffer.lateness_horizon: must be a non-negative whole number of seconds, got %s", c.Buffer.LatenessHorizon)
+	}
+	if c.Buffer.IdleTTL < 0 {
+		return fmt.Errorf("buffer.idle_ttl: must not be negative")
+	}
+	if c.Buffer.MemoryLimitMB < 0 {
+		return fmt.Errorf("buffer.memory_limit_mb: must not be negative, got %d", c.Buffer.MemoryLimitMB)
+	}
+	if c.Buffer.EvictionInterval < time.Second {
+		return fmt.Errorf("buffer.eviction_interval: must be at least 1s")
+	}
+	if c.Memory.BallastMB < 0 {
+		return fmt.Errorf("memory.ballast_mb: must not be negative, got %d", c.Memory.BallastMB)
+	}
+	if c.Memory.SoftLimitMB < 0 {
+		return fmt.Errorf("memory.soft_limit_mb: must not be negative, got %d", c.Memory.SoftLimitMB)
+	}
+	if c.Memory.TopDevices < 0 {
+		return fmt.Errorf("memory.top_devices: must not be negative, got %d", c.Memory.TopDevices)
+	}
+	if c.Anomalies.Retention <= 0 {
+		return fmt.Errorf("anomalies.retention: must be positive")
+	}
+	if c.Anomalies.MaxPerDevice < 0 {
+		return fmt.Errorf("anomalies.max_per_device: must not be negative")
+	}
+	if c.Events.Retention <= 0 {
+		return fmt.Errorf("events.retention: must be positive")
+	}
+	if c.Events.Window < 0 {
+		return fmt.Errorf("events.window: must not be negative")
+	}
+	if c.Events.MaxEvents < 0 {
+		return fmt.Errorf("events.max_events: must not be negative")
+	}
+	if err := c.Detectors.validate("detectors"); err != nil {
+		return err
+	}
+	if err := c.Shadow.Detectors.validate("shadow.detectors"); err != nil {
+		return err
+	}
+	// Сезонные базы в Redis общие с рабочим детектором
+	if c.Shadow.Detectors.Seasonal.Enabled {
+		return fmt.Errorf("shadow.detectors.seasonal: not supported in shadow mode")
+	}
+	if c.Shadow.HistorySize < 1 {
+		return fmt.Errorf("shadow.history_size: must be at least 1, got %d", c.Shadow.HistorySize)
+	}
+	for i, key := range c.Tenants.APIKeys {
+		if key.Tenant == "" || key.Key == "" {
+			return fmt.Errorf("tenants.api_keys[%d]: tenant and key must not be empty", i)
+		}
+	}
+	for tenant, policy := range c.Tenants.Policies {
+		if err := validateFields("tenants.policies."+tenant+".allow", policy.Allow); err != nil {
+			return err
+		}
+		if err := validateFields("tenants.policies."+tenant+".deny", policy.Deny); err != nil {
+			return err
+		}
+	}
+	if c.UDP.Addr != "" && c.UDP.Workers < 1 {
+		return fmt.Errorf("udp.workers: must be at least 1, got %d", c.UDP.Workers)
+	}
+	if c.UDP.ReadBuffer < 0 {
+		return fmt.Errorf("udp.read_buffer: must not be negative")
+	}
+	if c.Admin.TrashRetention <= 0 {
+		return fmt.Errorf("admin.trash_retention: must be positive")
+	}
+	if c.Reload.WatchInterval < 0 {
+		return fmt.Errorf("reload.watch_interval: must not be negative")
+	}
+	if c.Observability.SLIWindow < time.Minute {
+		return fmt.Errorf("observability.sli_window: must be at least 1m")
+	}
+	if c.Alerting.CriticalZScore <= 0 {
+		return fmt.Errorf("alerting.critical_z_score: must be positive")
+	}
+	if c.Alerting.QueueSize < 1 {
+		return fmt.Errorf("alerting.queue_size: must be at least 1, got %d", c.Alerting.QueueSize)
+	}
+	if c.Alerting.Timeout <= 0 {
+		return fmt.Errorf("alerting.timeout: must be positive")
+	}
+	if err := validateAlertBatching(c.Alerting.Batching); err != nil {
+		return err
+	}
+	if c.Rules.Key == "" {
+		return fmt.Errorf("rules.key: must not be empty")
+	}
+	if c.Rules.Interval < time.Second {
+		return fmt.Errorf("rules.interval: must be at least 1s")
+	}
+	if c.Calibration.MinSamples < 1 {
+		return fmt.Errorf("calibration.min_samples: must be at least 1, got %d", c.Calibration.MinSamples)
+	}
+	if c.Calibration.MaxSamples < c.Calibration.MinSamples {
+		return fmt.Errorf("calibration.max_samples: must be at least calibration.min_samples")
+	}
+	if c.Rules.MaxRules < 1 {
+		return fmt.Errorf("rules.max_rules: must be at least 1, got %d", c.Rules.MaxRules)
+	}
+	if c.Silences.Key == "" {
+		return fmt.Errorf("silences.key: must not be empty")
+	}
+	if c.Silences.Interval < time.Second {
+		return fmt.Errorf("silences.interval: must be at least 1s")
+	}
+	if c.Silences.MaxSilences < 1 {
+		return fmt.Errorf("silences.max_silences: must be at least 1, got %d", c.Silences.MaxSilences)
+	}
+	if c.Silences.Retention < 0 {
+		return fmt.Errorf("silences.retention: must not be negative")
+	}
+	if c.Influx.DeviceTag == "" {
+		return fmt.Errorf("influx.device_tag: must not be empty")
+	}
+	for point, field := range c.Influx.Fields {
+		if measurement, name, ok := strings.Cut(point, "."); !ok || measurement == "" || name == "" {
+			return fmt.Errorf("influx.fields: key must be measurement.field, got %q", point)
+		}
+		if !validFieldName(field) {
+			return fmt.Errorf("influx.fields[%s]: invalid metric field name %q", point, field)
+		}
+	}
+	if c.Influx.UnmappedFields != InfluxUnmappedDrop && c.Influx.UnmappedFields != InfluxUnmappedPrefix {
+		return fmt.Errorf("influx.unmapped_fields: must be drop or prefix, got %q", c.Influx.UnmappedFields)
+	}
+	if c.Influx.MaxLines < 1 {
+		return fmt.Errorf("influx.max_lines: must be at least 1, got %d", c.Influx.MaxLines)
+	}
+	if err := c.NATS.validate(); err != nil {
+		return err
+	}
+	switch c.DeviceTokens.Mode {
+	case DeviceTokensOff, DeviceTokensOptional, DeviceTokensRequired:
+	default:
+		return fmt.Errorf("device_tokens.mode: must be off, optional or required, got %q", c.DeviceTokens.Mode)
+	}
+	if c.DeviceTokens.Key == "" {
+		return fmt.Errorf("device_tokens.key: must not be empty")
+	}
+	if c.DeviceTokens.Interval < time.Second {
+		return fmt.Errorf("device_tokens.interval: must be at least 1s")
+	}
+	if c.Feedback.Key == "" {
+		return fmt.Errorf("feedback.key: must not be empty")
+	}
+	if c.Feedback.Interval < time.Second {
+		return fmt.Errorf("feedback.interval: must be at least 1s")
+	}
+	if c.Feedback.MinLabels < 1 {
+		return fmt.Errorf("feedback.min_labels: must be at least 1, got %d", c.Feedback.MinLabels)
+	}
+	if c.Feedback.TargetFalsePositiveRate < 0 || c.Feedback.TargetFalsePositiveRate >= 1 {
+		return fmt.Errorf("feedback.target_false_positive_rate: must be in [0, 1), got %v", c.Feedback.TargetFalsePositiveRate)
+	}
+	if c.Feedback.MaxThresholdFactor < 1 {
+		return fmt.Errorf("feedback.max_threshold_factor: must be at least 1, got %v", c.Feedback.MaxThresholdFactor)
+	}
+	if c.Cohorts.MetadataKey == "" {
+		return fmt.Errorf("cohorts.metadata_key: must not be empty")
+	}
+	if c.Cohorts.Interval < time.Second {
+		return fmt.Errorf("cohorts.interval: must be at least 1s")
+	}
+	if c.Cohorts.Threshold <= 0 {
+		return fmt.Errorf("cohorts.threshold: must be positive")
+	}
+	if c.Cohorts.MinDevices < 3 {
+		return fmt.Errorf("cohorts.min_devices: must be at least 3, got %d", c.Cohorts.MinDevices)
+	}
+	if c.Fields.Key == "" {
+		return fmt.Errorf("fields.key: must not be empty")
+	}
+	if c.Fields.Interval < time.Second {
+		return fmt.Errorf("fields.interval: must be at least 1s")
+	}
+	if _, err := parseCron(c.Reports.Schedule); err != nil {
+		return fmt.Errorf("reports.schedule: %v", err)
+	}
+	if _, err := time.LoadLocation(c.Reports.Timezone); err != nil {
+		return fmt.Errorf("reports.timezone: %v", err)
+	}
+	if c.Reports.Period <= 0 {
+		return fmt.Errorf("reports.period: must be positive")
+	}
+	// Отчет строится по истории аномалий, старые записи из нее уже удалены
+	if c.Reports.Period > c.Anomalies.Retention {
+		return fmt.Errorf("reports.period: must not exceed anomalies.retention (%s)", c.Anomalies.Retention)
+	}
+	if c.Reports.TopDevices < 1 {
+		return fmt.Errorf("reports.top_devices: must be at least 1, got %d", c.Reports.TopDevices)
+	}
+	if c.Reports.Key == "" {
+		return fmt.Errorf("reports.key: must not be empty")
+	}
+	if c.Reports.MaxReports < 1 {
+		return fmt.Errorf("reports.max_reports: must be at least 1, got %d", c.Reports.MaxReports)
+	}
+	if c.Reports.Timeout <= 0 {
+		return fmt.Errorf("reports.timeout: must be positive")
+	}
+	if c.Reports.Webhook.URL != "" {
+		if parsed, err := url.Parse(c.Reports.Webhook.URL); err != nil || parsed.Scheme == "" || parsed.Host == "" {
+			return fmt.Errorf("reports.webhook.url: must be an absolute URL, got %q", c.Reports.Webhook.URL)
+		}
+	}
+	if c.Reports.Email.SMTPAddr != "" {
+		if _, _, err := net.SplitHostPort(c.Reports.Email.SMTPAddr); err != nil {
+			return fmt.Errorf("reports.email.smtp_addr: %v", err)
+		}
+		if c.Reports.Email.From == "" || len(c.Reports.Email.To) == 0 {
+			return fmt.Errorf("reports.email: from and to are required with smtp_addr")
+		}
+	}
+	if c.Forensics.Samples < 1 {
+		return fmt.Errorf("forensics.samples: must be at least 1, got %d", c.Forensics.Samples)
+	}
+	if c.Forensics.Retention <= 0 {
+		return fmt.Errorf("forensics.retention: must be positive")
+	}
+	if c.Forensics.CaptureTimeout < time.Second {
+		return fmt.Errorf("forensics.capture_timeout: must be at least 1s")
+	}
+	if c.Forensics.MemoryLimit < 0 {
+		return fmt.Errorf("forensics.memory_limit: must not be negative")
+	}
+	if c.Stream.Enabled {
+		if c.Stream.Key == "" {
+			return fmt.Errorf("stream.key: must not be empty")
+		}
+		if c.Stream.Group == "" {
+			return fmt.Errorf("stream.group: must not be empty")
+		}
+		if c.Stream.Workers < 1 {
+			return fmt.Errorf("stream.workers: must be at least 1, got %d", c.Stream.Workers)
+		}
+		if c.Stream.BatchSize < 1 {
+			return fmt.Errorf("stream.batch_size: must be at least 1, got %d", c.Stream.BatchSize)
+		}
+		if c.Stream.Block <= 0 {
+			return fmt.Errorf("stream.block: must be positive")
+		}
+		if c.Stream.ClaimIdle < time.Second {
+			return fmt.Errorf("stream.claim_idle: must be at least 1s")
+		}
+		if c.Stream.MaxLen < 0 {
+			return fmt.Errorf("stream.max_len: must not be negative")
+		}
+		if c.Stream.MaxAge < 0 {
+			return fmt.Errorf("stream.max_age: must not be negative")
+		}
+		if c.Stream.TrimInterval < time.Second {
+			return fmt.Errorf("stream.trim_interval: must be at least 1s")
+		}
+	}
+	if c.Sampling.Interval <= 0 {
+		return fmt.Errorf("sampling.interval: must be positive")
+	}
+	if c.Sampling.Duration < time.Second {
+		return fmt.Errorf("sampling.duration: must be at least 1s")
+	}
+	if c.Sampling.MaxSamples < 1 {
+		return fmt.Errorf("sampling.max_samples: must be at least 1, got %d", c.Sampling.MaxSamples)
+	}
+	if c.Sampling.Retention <= 0 {
+		return fmt.Errorf("sampling.retention: must be positive")
+	}
+	if err := c.Pipeline.validate(c); err != nil {
+		return err
+	}
+	names := make(map[string]bool, len(c.Listeners))
+	for i, l := range c.Listeners {
+		path := fmt.Sprintf("listeners[%d]", i)
+		if l.Name == "" || names[l.Name] {
+			return fmt.Errorf("%s.name: must be unique and not empty", path)
+		}
+		names[l.Name] = true
+		if l.Addr == "" {
+			return fmt.Errorf("%s.addr: must not be empty", path)
+		}
+		if len(l.Routes) == 0 {
+			return fmt.Errorf("%s.routes: at least one route group is required", path)
+		}
+		for _, group := range l.Routes {
+			if !validRouteGroup(group) {
+				return fmt.Errorf("%s.routes: unknown route group %q (expected %s)", path, group, strings.Join(allRouteGroups, ", "))
+			}
+		}
+		if l.RateLimit.RPS < 0 {
+			return fmt.Errorf("%s.rate_limit.rps: must not be negative", path)
+		}
+		if l.RateLimit.RPS > 0 && l.RateLimit.Burst < 1 {
+			return fmt.Errorf("%s.rate_limit.burst: must be at least 1", path)
+		}
+	}
+	if err := validateSLAs(c.SLAs); err != nil {
+		return err
+	}
+	if err := validateForwarders(c.Forwarders); err != nil {
+		return err
+	}
+	if c.HA.Enabled {
+		if !c.Stream.Enabled {
+			return fmt.Errorf("ha.enabled: requires stream.enabled")
+		}
+		if c.HA.LockKey == "" {
+			return fmt.Errorf("ha.lock_key: must not be empty")
+		}
+		if c.HA.RenewInterval <= 0 {
+			return fmt.Errorf("ha.renew_interval: must be positive")
+		}
+		if c.HA.LockTTL < 2*c.HA.RenewInterval {
+			return fmt.Errorf("ha.lock_ttl: must be at least twice ha.renew_interval")
+		}
+	}
+	if c.Leader.Enabled {
+		if c.Leader.LeaseKey == "" {
+			return fmt.Errorf("leader.lease_key: must not be empty")
+		}
+		// Один ключ для пары и выборов лидера дал бы блокировку двум ролям сразу
+		if c.HA.Enabled && c.Leader.LeaseKey == c.HA.LockKey {
+			return fmt.Errorf("leader.lease_key: must differ from ha.lock_key")
+		}
+		if c.Leader.RenewInterval <= 0 {
+			return fmt.Errorf("leader.renew_interval: must be positive")
+		}
+		if c.Leader.LeaseTTL < 2*c.Leader.RenewInterval {
+			return fmt.Errorf("leader.lease_ttl: must be at least twice leader.renew_interval")
+		}
+	}
+	if c.Migrations.VersionKey == "" {
+		return fmt.Errorf("migrations.version_key: must not be empty")
+	}
+	if c.Migrations.LockKey == "" || c.Migrations.LockKey == c.Migrations.VersionKey {
+		return fmt.Errorf("migrations.lock_key: must be non-empty and differ from version_key")
+	}
+	if c.Migrations.LockTTL < 3*time.Second {
+		return fmt.Errorf("migrations.lock_ttl: must be at least 3s")
+	}
+	if c.Migrations.WaitTimeout <= 0 {
+		return fmt.Errorf("migrations.wait_timeout: must be positive")
+	}
+	if c.Warmup.Enabled {
+		if c.Warmup.MaxAge <= 0 {
+			return fmt.Errorf("warmup.max_age: must be positive")
+		}
+		if c.Warmup.Timeout <= 0 {
+			return fmt.Errorf("warmup.timeout: must be positive")
+		}
+		if c.Warmup.ScanCount < 1 {
+			return fmt.Errorf("warmup.scan_count: must be at least 1, got %d", c.Warmup.ScanCount)
+		}
+	}
+	if c.Synthetic.Interval < 10*time.Second {
+		return fmt.Errorf("synthetic.interval: must be at least 10s")
+	}
+	if c.Synthetic.Timeout <= 0 {
+		return fmt.Errorf("synthetic.timeout: must be positive")
+	}
+	if c.Synthetic.FailureThreshold < 1 {
+		return fmt.Errorf("synthetic.failure_threshold: must be at least 1, got %d", c.Synthetic.FailureThreshold)
+	}
+	if c.Secrets.RefreshInterval < 0 {
+		return fmt.Errorf("secrets.refresh_interval: must not be negative")
+	}
+	if lb := c.LBHealth; lb.RecoverAt < 0 || lb.RecoverAt >= lb.DegradeAt || lb.DegradeAt > lb.FailAt || lb.FailAt > 1 {
+		return fmt.Errorf("lb_health: thresholds must satisfy 0 <= recover_at < degrade_at <= fail_at <= 1")
+	}
+	if c.LBHealth.SampleInterval < 100*time.Millisecond {
+		return fmt.Errorf("lb_health.sample_interval: must be at least 100ms")
+	}
+	if c.LBHealth.StreamLagLimit <= 0 {
+		return fmt.Errorf("lb_health.stream_lag_limit: must be positive")
+	}
+	if c.Admission.QueueSaturation <= 0 || c.Admission.QueueSaturation > 1 {
+		return fmt.Errorf("admission.queue_saturation: must be in (0, 1], got %g", c.Admission.QueueSaturation)
+	}
+	if c.Admission.MemoryLimitMB < 0 {
+		return fmt.Errorf("admission.memory_limit_mb: must not be negative, got %d", c.Admission.MemoryLimitMB)
+	}
+	if c.Admission.RetryAfter < time.Second {
+		return fmt.Errorf("admission.retry_after: must be at least 1s")
+	}
+	if c.CORS.Enabled {
+		if len(c.CORS.AllowedOrigins) == 0 {
+			return fmt.Errorf("cors.allowed_origins: must not be empty when cors is enabled")
+		}
+		if c.CORS.AllowCredentials && containsString(c.CORS.AllowedOrigins, corsAnyOrigin) {
+			return fmt.Errorf("cors.allowed_origins: * is not allowed with allow_credentials")
+		}
+		if len(c.CORS.AllowedMethods) == 0 {
+			return fmt.Errorf("cors.allowed_methods: must not be empty when cors is enabled")
+		}
+	}
+	if c.CORS.MaxAge < 0 {
+		return fmt.Errorf("cors.max_age: must not be negative")
+	}
+	if c.Health.CheckTimeout <= 0 {
+		return fmt.Errorf("health.check_timeout: must be positive")
+	}
+	if c.Health.QueueSaturation <= 0 || c.Health.QueueSaturation > 1 {
+		return fmt.Errorf("health.queue_saturation: must be in (0, 1], got %g", c.Health.QueueSaturation)
+	}
+	if c.Jobs.DeferAt < 0 || c.Jobs.DeferAt > 1 {
+		return fmt.Errorf("jobs.defer_at: must be in [0, 1], got %g", c.Jobs.DeferAt)
+	}
+	if c.Jobs.DeferAt > 0 && c.Jobs.MaxDeferral <= 0 {
+		return fmt.Errorf("jobs.max_deferral: must be positive when defer_at is set")
+	}
+	if c.Jobs.MaxConcurrent < 0 {
+		return fmt.Errorf("jobs.max_concurrent: must not be negative")
+	}
+	for job, budget := range map[string]JobBudget{JobRollups: c.Jobs.Rollups, JobRetention: c.Jobs.Retention, JobArchiver: c.Jobs.Archiver} {
+		if budget.MaxRunTime < 0 {
+			return fmt.Errorf("jobs.%s.max_run_time: must not be negative", job)
+		}
+		if budget.Utilization <= 0 || budget.Utilization > 1 {
+			return fmt.Errorf("jobs.%s.utilization: must be in (0, 1], got %g", job, budget.Utilization)
+		}
+	}
+	if c.Rollups.Enabled {
+		if !c.Stream.Enabled {
+			return fmt.Errorf("rollups.enabled: requires stream.enabled, rollups are computed from the ingestion stream")
+		}
+		if c.Rollups.KeyPrefix == "" {
+			return fmt.Errorf("rollups.key_prefix: must not be empty")
+		}
+		if c.Rollups.CheckpointKey == "" {
+			return fmt.Errorf("rollups.checkpoint_key: must not be empty")
+		}
+		if c.Rollups.Resolution < time.Second || c.Rollups.Resolution%time.Second != 0 {
+			return fmt.Errorf("rollups.resolution: must be a whole number of seconds, got %s", c.Rollups.Resolution)
+		}
+		if c.Rollups.Retention < c.Rollups.Resolution {
+			return fmt.Errorf("rollups.retention: must be at least rollups.resolution")
+		}
+	}
+	if c.SharedStats.Enabled {
+		if c.SharedStats.KeyPrefix == "" {
+			return fmt.Errorf("shared_stats.key_prefix: must not be empty")
+		}
+		if c.SharedStats.TTL <= 0 {
+			return fmt.Errorf("shared_stats.ttl: must be positive")
+		}
+		if c.SharedStats.Timeout <= 0 {
+			return fmt.Errorf("shared_stats.timeout: must be positive")
+		}
+	}
+	if c.Cluster.Enabled {
+		if c.Stream.Enabled {
+			// Группа потребителей раздает записи любым экземплярам, а окно устройства
+			// должно собираться только на его владельце
+			return fmt.Errorf("cluster.enabled: requires stream.enabled=false")
+		}
+		if c.HA.Enabled {
+			return fmt.Errorf("cluster.enabled: cannot be combined with ha.enabled")
+		}
+		if c.Cluster.MembersKey == "" {
+			return fmt.Errorf("cluster.members_key: must not be empty")
+		}
+		if c.Cluster.AdvertiseAddr == "" && c.Server.Port == "" {
+			return fmt.Errorf("cluster.advertise_addr: required when server.port is empty")
+		}
+		if c.Cluster.AdvertiseAddr != "" {
+			if _, _, err := net.SplitHostPort(c.Cluster.AdvertiseAddr); err != nil {
+				return fmt.Errorf("cluster.advertise_addr: must be host:port, got %q", c.Cluster.AdvertiseAddr)
+			}
+		}
+		if c.Cluster.HeartbeatInterval <= 0 {
+			return fmt.Errorf("cluster.heartbeat_interval: must be positive")
+		}
+		if c.Cluster.MemberTTL < 2*c.Cluster.HeartbeatInterval {
+			return fmt.Errorf("cluster.member_ttl: must be at least twice cluster.heartbeat_interval")
+		}
+		if c.Cluster.VirtualNodes < 1 {
+			return fmt.Errorf("cluster.virtual_nodes: must be at least 1, got %d", c.Cluster.VirtualNodes)
+		}
+		if c.Cluster.ForwardTimeout <= 0 {
+			return fmt.Errorf("cluster.forward_timeout: must be positive")
+		}
+		if c.Cluster.ForwardSecret == "" {
+			return fmt.Errorf("cluster.forward_secret: must not be empty")
+		}
+		if c.TLS.Enabled {
+			if _, err := clusterTLSConfig(c.Cluster, c.TLS); err != nil {
+				return fmt.Errorf("cluster.ca_file: %w", err)
+			}
+		}
+	}
+	if err := validateCompression("cluster.forward_compression", c.Cluster.ForwardCompression, c.Cluster.ForwardCompressionLevel); err != nil {
+		return err
+	}
+	if err := validateCompression("clickhouse.compression", c.ClickHouse.Compression, c.ClickHouse.CompressionLevel); err != nil {
+		return err
+	}
+	if u := c.ClickHouse.URL; u != "" {
+		if parsed, err := url.Parse(u); err != nil || parsed.Scheme == "" || parsed.Host == "" {
+			return fmt.Errorf("clickhouse.url: must be an absolute URL, got %q", u)
+		}
+		if !clickhouseIdentPattern.MatchString(c.ClickHouse.Table) {
+			return fmt.Errorf("clickhouse.table: invalid table name %q", c.ClickHouse.Table)
+		}
+		if c.ClickHouse.Database != "" && !clickhouseIdentPattern.MatchString(c.ClickHouse.Database) {
+			return fmt.Errorf("clickhouse.database: invalid database name %q", c.ClickHouse.Database)
+		}
+		if c.ClickHouse.BatchSize < 1 {
+			return fmt.Errorf("clickhouse.batch_size: must be at least 1, got %d", c.ClickHouse.BatchSize)
+		}
+		if c.ClickHouse.FlushInterval <= 0 {
+			return fmt.Errorf("clickhouse.flush_interval: must be positive")
+		}
+		if c.ClickHouse.QueueSize < 1 {
+			return fmt.Errorf("clickhouse.queue_size: must be at least 1, got %d", c.ClickHouse.QueueSize)
+		}
+		if c.ClickHouse.Timeout <= 0 {
+			return fmt.Errorf("clickhouse.timeout: must be positive")
+		}
+	}
+	if u := c.Alerting.Alertmanager.URL; u != "" {
+		if parsed, err := url.Parse(u); err != nil || parsed.Scheme == "" || parsed.Host == "" {
+			return fmt.Errorf("alerting.alertmanager.url: must be an absolute URL, got %q", u)
+		}
+	}
+	pd := c.Alerting.PagerDuty
+	if err := validateIncidents("alerting.pagerduty", pd.URL, pd.Routes, pd.Severities, pd.ResolveAfter); err != nil {
+		return err
+	}
+	og := c.Alerting.Opsgenie
+	if err := validateIncidents("alerting.opsgenie", og.URL, og.Routes, og.Severities, og.ResolveAfter); err != nil {
+		return err
+	}
+	return nil
+}
+
+// validateIncidents проверяет параметры уведомителя инцидентов; section — префикс в сообщениях об ошибках
+func validateIncidents(section, u string, routes []IncidentRoute, severities []string, resolveAfter time.Duration) error {
+	if parsed, err := url.Parse(u); err != nil || parsed.Scheme == "" || parsed.Host == "" {
+		return fmt.Errorf("%s.url: must be an absolute URL, got %q", section, u)
+	}
+	for i, route := range routes {
+		if route.DevicePattern == "" {
+			return fmt.Errorf("%s.routes[%d].device_pattern: must not be empty", section, i)
+		}
+		if _, err := path.Match(route.DevicePattern, ""); err != nil {
+			return fmt.Errorf("%s.routes[%d].device_pattern: %v", section, i, err)
+		}
+		if route.Key == "" {
+			return fmt.Errorf("%s.routes[%d].key: must not be empty", section, i)
+		}
+	}
+	if len(severities) == 0 {
+		return fmt.Errorf("%s.severities: must not be empty", section)
+	}
+	for _, severity := range severities {
+		if severity != SeverityWarning && severity != SeverityCritical {
+			return fmt.Errorf("%s.severities: unknown severity %q, expected warning or critical", section, severity)
+		}
+	}
+	if resolveAfter < time.Second {
+		return fmt.Errorf("%s.resolve_after: must be at least 1s", section)
+	}
+	return nil
+}
+
+// validate проверяет параметры детекторов; path — префикс в сообщениях об ошибках
+func (d DetectorsConfig) validate(path string) error {
+	if d.ZScore.Threshold <= 0 {
+		return fmt.Errorf("%s.zscore.threshold: must be positive", path)
+	}
+	if err := validateFields(path+".zscore.fields", d.ZScore.Fields); err != nil {
+		return err
+	}
+	if d.CUSUM.Warmup < 2 {
+		return fmt.Errorf("%s.cusum.warmup: must be at least 2, got %d", path, d.CUSUM.Warmup)
+	}
+	if d.CUSUM.K < 0 {
+		return fmt.Errorf("%s.cusum.k: must not be negative", path)
+	}
+	if d.CUSUM.H <= 0 {
+		return fmt.Errorf("%s.cusum.h: must be positive", path)
+	}
+	if d.CUSUM.MinRun < 1 {
+		return fmt.Errorf("%s.cusum.min_run: must be at least 1, got %d", path, d.CUSUM.MinRun)
+	}
+	if err := validateFields(path+".cusum.fields", d.CUSUM.Fields); err != nil {
+		return err
+	}
+	if d.IQR.K <= 0 {
+		return fmt.Errorf("%s.iqr.k: must be positive", path)
+	}
+	if d.IQR.MinSamples < 4 {
+		return fmt.Errorf("%s.iqr.min_samples: must be at least 4, got %d", path, d.IQR.MinSamples)
+	}
+	if err := validateFields(path+".iqr.fields", d.IQR.Fields); err != nil {
+		return err
+	}
+	for i, raw := range d.Correlation.Pairs {
+		if _, err := parseCorrelationPair(raw); err != nil {
+			return fmt.Errorf("%s.correlation.pairs[%d]: %v", path, i, err)
+		}
+	}
+	if d.Correlation.MinCorrelation < 0 || d.Correlation.MinCorrelation > 1 {
+		return fmt.Errorf("%s.correlation.min_correlation: must be in [0, 1], got %g", path, d.Correlation.MinCorrelation)
+	}
+	if d.Correlation.Threshold <= 0 {
+		return fmt.Errorf("%s.correlation.threshold: must be positive", path)
+	}
+	if d.Correlation.MinSamples < 3 {
+		return fmt.Errorf("%s.correlation.min_samples: must be at least 3, got %d", path, d.Correlation.MinSamples)
+	}
+	if len(d.Isolation.Fields) < 2 {
+		return fmt.Errorf("%s.isolation.fields: at least 2 fields are required, got %d", path, len(d.Isolation.Fields))
+	}
+	if err := validateFields(path+".isolation.fields", d.Isolation.Fields); err != nil {
+		return err
+	}
+	if d.Isolation.Trees < 1 {
+		return fmt.Errorf("%s.isolation.trees: must be at least 1, got %d", path, d.Isolation.Trees)
+	}
+	if d.Isolation.SampleSize < 8 {
+		return fmt.Errorf("%s.isolation.sample_size: must be at least 8, got %d", path, d.Isolation.SampleSize)
+	}
+	if d.Isolation.Threshold <= 0.5 || d.Isolation.Threshold >= 1 {
+		return fmt.Errorf("%s.isolation.threshold: must be in (0.5, 1), got %g", path, d.Isolation.Threshold)
+	}
+	if d.Isolation.MinSamples < 8 {
+		return fmt.Errorf("%s.isolation.min_samples: must be at least 8, got %d", path, d.Isolation.MinSamples)
+	}
+	if d.Isolation.RetrainEvery < 1 {
+		return fmt.Errorf("%s.isolation.retrain_every: must be at least 1, got %d", path, d.Isolation.RetrainEvery)
+	}
+	if err := validateFields(path+".trend.fields", d.Trend.Fields); err != nil {
+		return err
+	}
+	if d.Trend.MinSamples < 3 {
+		return fmt.Errorf("%s.trend.min_samples: must be at least 3, got %d", path, d.Trend.MinSamples)
+	}
+	if d.Trend.Window < d.Trend.MinSamples {
+		return fmt.Errorf("%s.trend.window: must be at least min_samples, got %d", path, d.Trend.Window)
+	}
+	if d.Trend.MinRSquared <= 0 || d.Trend.MinRSquared > 1 {
+		return fmt.Errorf("%s.trend.min_r_squared: must be in (0, 1], got %g", path, d.Trend.MinRSquared)
+	}
+	if d.Trend.MinRise <= 0 {
+		return fmt.Errorf("%s.trend.min_rise: must be positive", path)
+	}
+	if d.Trend.Direction != TrendDirectionUp && d.Trend.Direction != TrendDirectionDown && d.Trend.Direction != TrendDirectionBoth {
+		return fmt.Errorf("%s.trend.direction: must be %s, %s or %s, got %q", path, TrendDirectionUp, TrendDirectionDown, TrendDirectionBoth, d.Trend.Direction)
+	}
+	if err := validateFields(path+".ml.fields", d.ML.Fields); err != nil {
+		return err
+	}
+	if d.ML.Window < 1 {
+		return fmt.Errorf("%s.ml.window: must be at least 1, got %d", path, d.ML.Window)
+	}
+	if _, err := time.LoadLocation(d.ML.Timezone); err != nil {
+		return fmt.Errorf("%s.ml.timezone: %v", path, err)
+	}
+	if d.ML.OutputIndex < -1 {
+		return fmt.Errorf("%s.ml.output_index: must be -1 or an index, got %d", path, d.ML.OutputIndex)
+	}
+	if d.ML.Threshold <= 0 || d.ML.Threshold > 1 {
+		return fmt.Errorf("%s.ml.threshold: must be in (0, 1], got %g", path, d.ML.Threshold)
+	}
+	if d.ML.Enabled {
+		model, err := LoadONNXModel(d.ML.ModelPath)
+		if err != nil {
+			return fmt.Errorf("%s.ml.model_path: %v", path, err)
+		}
+		if size := model.InputSize(); size > 0 && size != mlFeatureCount(d.ML) {
+			return fmt.Errorf("%s.ml.window: model expects %d features, window and time features give %d", path, size, mlFeatureCount(d.ML))
+		}
+	}
+	if err := validateFields(path+".seasonal.fields", d.Seasonal.Fields); err != nil {
+		return err
+	}
+	if d.Seasonal.Buckets != SeasonalBucketsHourOfWeek && d.Seasonal.Buckets != SeasonalBucketsHourOfDay {
+		return fmt.Errorf("%s.seasonal.buckets: must be %s or %s, got %q", path, SeasonalBucketsHourOfWeek, SeasonalBucketsHourOfDay, d.Seasonal.Buckets)
+	}
+	if _, err := time.LoadLocation(d.Seasonal.Timezone); err != nil {
+		return fmt.Errorf("%s.seasonal.timezone: %v", path, err)
+	}
+	if d.Seasonal.Threshold <= 0 {
+		return fmt.Errorf("%s.seasonal.threshold: must be positive", path)
+	}
+	if d.Seasonal.MinSamples < 2 {
+		return fmt.Errorf("%s.seasonal.min_samples: must be at least 2, got %d", path, d.Seasonal.MinSamples)
+	}
+	if d.Seasonal.HalfLife < 24*time.Hour {
+		return fmt.Errorf("%s.seasonal.half_life: must be at least 24h", path)
+	}
+	if d.Seasonal.Enabled {
+		if d.Seasonal.KeyPrefix == "" {
+			return fmt.Errorf("%s.seasonal.key_prefix: must not be empty", path)
+		}
+		if d.Seasonal.TTL < 7*24*time.Hour {
+			return fmt.Errorf("%s.seasonal.ttl: must be at least a week to keep weekly baselines", path)
+		}
+		if d.Seasonal.Timeout <= 0 {
+			return fmt.Errorf("%s.seasonal.timeout: must be positive", path)
+		}
+	}
+	return nil
+}
+
+// clickhouseIdentPattern допустимые имена базы и таблицы ClickHouse
+var clickhouseIdentPattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+func validateFields(path string, fields []string) error {
+	for _, field := range fields {
+		if !validFieldName(field) {
+			return fmt.Errorf("%s: invalid metric field name %q", path, field)
+		}
+	}
+	return nil
+}
+
+// validateSLAs проверяет список SLA
+func validateSLAs(slas []SLAConfig) error {
+	names := make(map[string]bool, len(slas))
+	for i, c := range slas {
+		p := fmt.Sprintf("slas[%d]", i)
+		if c.Name == "" || names[c.Name] {
+			return fmt.Errorf("%s.name: must be unique and not empty", p)
+		}
+		names[c.Name] = true
+		if len(c.Devices) == 0 && c.DevicePattern == "" {
+			return fmt.Errorf("%s: devices or device_pattern is required", p)
+		}
+		if c.DevicePattern != "" {
+			if _, err := path.Match(c.DevicePattern, ""); err != nil {
+				return fmt.Errorf("%s.device_pattern: %v", p, err)
+			}
+		}
+		if !validFieldName(c.Field) {
+			return fmt.Errorf("%s.field: invalid metric field name %q", p, c.Field)
+		}
+		if c.Min == nil && c.Max == nil {
+			return fmt.Errorf("%s: min or max is required", p)
+		}
+		if c.Min != nil && c.Max != nil && *c.Min > *c.Max {
+			return fmt.Errorf("%s.min: must not exceed max", p)
+		}
+		if c.Target <= 0 || c.Target > 1 {
+			return fmt.Errorf("%s.target: must be in (0, 1], got %g", p, c.Target)
+		}
+		if c.Window < slaBuckets*time.Second {
+			return fmt.Errorf("%s.window: must be at least %s", p, slaBuckets*time.Second)
+		}
+	}
+	return nil
+}
+
+// validateForwarders проверяет получателей пересылки
+func validateForwarders(forwarders []ForwarderConfig) error {
+	names := make(map[string]bool, len(forwarders))
+	for i, c := range forwarders {
+		p := fmt.Sprintf("forwarders[%d]", i)
+		if c.Name == "" || names[c.Name] {
+			return fmt.Errorf("%s.name: must be unique and not empty", p)
+		}
+		names[c.Name] = true
+		switch c.Protocol {
+		case ForwardProtocolHTTP:
+			if u, err := url.Parse(c.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("%s.url: must be an http or https URL", p)
+			}
+		case ForwardProtocolGRPC:
+			if _, _, err := net.SplitHostPort(c.Addr); err != nil {
+				return fmt.Errorf("%s.addr: must be host:port: %v", p, err)
+			}
+		default:
+			return fmt.Errorf("%s.protocol: must be http or grpc, got %q", p, c.Protocol)
+		}
+		switch c.Data {
+		case "", ForwardDataMetrics, ForwardDataAnomalies, ForwardDataAll:
+		default:
+			return fmt.Errorf("%s.data: must be metrics, anomalies or all, got %q", p, c.Data)
+		}
+		if c.BatchSize < 0 || c.QueueSize < 0 {
+			return fmt.Errorf("%s: batch_size and queue_size must not be negative", p)
+		}
+		if c.MaxRetries < -1 {
+			return fmt.Errorf("%s.max_retries: must be -1 or more, got %d", p, c.MaxRetries)
+		}
+		if c.FlushInterval < 0 || c.RetryBackoff < 0 || c.Timeout < 0 {
+			return fmt.Errorf("%s: flush_interval, retry_backoff and timeout must not be negative", p)
+		}
+	}
+	return nil
+}
+
+// validateAlertBatching проверяет правила группировки уведомлений
+func validateAlertBatching(rules []AlertBatchRule) error {
+	names := make(map[string]bool, len(rules))
+	for i, rule := range rules {
+		p := fmt.Sprintf("alerting.batching[%d]", i)
+		if rule.Name == "" || names[rule.Name] {
+			return fmt.Errorf("%s.name: must be unique and not empty", p)
+		}
+		names[rule.Name] = true
+		for _, notifier := range rule.Notifiers {
+			if !containsString(notifierNames, notifier) {
+				return fmt.Errorf("%s.notifiers: unknown notifier %q", p, notifier)
+			}
+		}
+		for _, severity := range rule.Severities {
+			if severity != SeverityWarning && severity != SeverityCritical {
+				return fmt.Errorf("%s.severities: invalid severity %q, expected warning or critical", p, severity)
+			}
+		}
+		if rule.Window < time.Second {
+			return fmt.Errorf("%s.window: must be at least 1s", p)
+		}
+		if rule.MaxSize < 0 {
+			return fmt.Errorf("%s.max_size: must not be negative", p)
+		}
+	}
+	return nil
+}
+
+// validate проверяет, что лимиты квот не отрицательны
+func (q QuotasConfig) validate() error {
+	if q.DevicePerMinute < 0 {
+		return fmt.Errorf("quotas.device_per_minute: must not be negative")
+	}
+	if q.TenantPerMinute < 0 {
+		return fmt.Errorf("quotas.tenant_per_minute: must not be negative")
+	}
+	for device, limit := range q.Devices {
+		if limit < 0 {
+			return fmt.Errorf("quotas.devices.%s: must not be negative", device)
+		}
+	}
+	for tenant, limit := range q.Tenants {
+		if limit < 0 {
+			return fmt.Errorf("quotas.tenants.%s: must not be negative", tenant)
+		}
+	}
+	return nil
+}
+
+func (n NATSConfig) validate() error {
+	if n.URL == "" {
+		if n.Subject != "" || n.AnomalySubject != "" {
+			return fmt.Errorf("nats.url: required when nats.subject or nats.anomaly_subject is set")
+		}
+		return nil
+	}
+	for _, server := range strings.Split(n.URL, ",") {
+		u, err := url.Parse(strings.TrimSpace(server))
+		if err != nil || (u.Scheme != "nats" && u.Scheme != "tls") || u.Hostname() == "" {
+			return fmt.Errorf("nats.url: must be nats://host[:port] or tls://host[:port], got %q", server)
+		}
+		if u.User != nil {
+			return fmt.Errorf("nats.url: credentials belong in nats.user and nats.password")
+		}
+	}
+	methods := 0
+	for _, set := range []bool{n.User != "", n.Token != "", n.CredsFile != "", n.NKeySeedFile != ""} {
+		if set {
+			methods++
+		}
+	}
+	if methods > 1 {
+		return fmt.Errorf("nats: only one of user, token, creds_file and nkey_seed_file may be set")
+	}
+	if n.Password != "" && n.User == "" {
+		return fmt.Errorf("nats.password: requires nats.user")
+	}
+	if (n.TLS.CertFile == "") != (n.TLS.KeyFile == "") {
+		return fmt.Errorf("nats.tls: cert_file and key_file must be set together")
+	}
+	if n.Timeout <= 0 {
+		return fmt.Errorf("nats.timeout: must be positive")
+	}
+	if n.ReconnectWait <= 0 {
+		return fmt.Errorf("nats.reconnect_wait: must be positive")
+	}
+	if n.MaxReconnects < -1 {
+		return fmt.Errorf("nats.max_reconnects: must be at least 0 or -1 for unlimited, got %d", n.MaxReconnects)
+	}
+	if n.QueueSize < 1 {
+		return fmt.Errorf("nats.queue_size: must be at least 1, got %d", n.QueueSize)
+	}
+	if strings.ContainsAny(n.AnomalySubject, " \t*>") {
+		return fmt.Errorf("nats.anomaly_subject: must not contain spaces or wildcards")
+	}
+	if n.Subject == "" {
+		return nil
+	}
+	if strings.ContainsAny(n.Subject, " \t") {
+		return fmt.Errorf("nats.subject: must not contain spaces")
+	}
+	if n.Durable == "" || strings.ContainsAny(n.Durable, " \t.*>") {
+		return fmt.Errorf("nats.durable: must be a name without spaces, dots or wildcards")
+	}
+	if strings.ContainsAny(n.Stream, " \t.*>") {
+		return fmt.Errorf("nats.stream: must be a name without spaces, dots or wildcards")
+	}
+	if n.Batch < 1 {
+		return fmt.Errorf("nats.batch: must be at least 1, got %d", n.Batch)
+	}
+	if n.AckWait < time.Second {
+		return fmt.Errorf("nats.ack_wait: must be at least 1s")
+	}
+	if n.MaxDeliver < 1 && n.MaxDeliver != -1 {
+		return fmt.Errorf("nats.max_deliver: must be at least 1 or -1 for unlimited, got %d", n.MaxDeliver)
+	}
+	if n.RetryDelay < 0 {
+		return fmt.Errorf("nats.retry_delay: must not be negative")
+	}
+	return nil
+}
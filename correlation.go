@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// CorrelationPair пара полей: значения Dependent объясняются значениями Driver
+// (например, cpu растет вместе с rps)
+type CorrelationPair struct {
+	Driver    string
+	Dependent string
+}
+
+// parseCorrelationPair разбирает пару вида "driver:dependent"
+func parseCorrelationPair(raw string) (CorrelationPair, error) {
+	driver, dependent, ok := strings.Cut(raw, ":")
+	if !ok || !validFieldName(driver) || !validFieldName(dependent) || driver == dependent {
+		return CorrelationPair{}, fmt.Errorf("pair must look like driver:dependent with two different fields, got %q", raw)
+	}
+	return CorrelationPair{Driver: driver, Dependent: dependent}, nil
+}
+
+// CorrelationInfo связь значения аномалии с ведущим полем
+type CorrelationInfo struct {
+	With        string  `json:"with"`
+	Coefficient float64 `json:"coefficient"`
+	Expected    float64 `json:"expected"`
+	Residual    float64 `json:"residual"`
+}
+
+// linearFit линейная зависимость y = Intercept + Slope·x по окну
+type linearFit struct {
+	Coefficient float64 `json:"coefficient"`
+	Slope       float64 `json:"slope"`
+	Intercept   float64 `json:"intercept"`
+	// ResidualStdDev σ остатков регрессии
+	ResidualStdDev float64 `json:"residual_std_dev"`
+	Samples        int     `json:"samples"`
+}
+
+// fitLinear считает коэффициент Пирсона и регрессию ys на xs
+func fitLinear(xs, ys []float64) linearFit {
+	n := float64(len(xs))
+	fit := linearFit{Samples: len(xs)}
+	if len(xs) < 2 {
+		return fit
+	}
+	var mx, my float64
+	for i := range xs {
+		mx += xs[i]
+		my += ys[i]
+	}
+	mx /= n
+	my /= n
+
+	var sxx, syy, sxy float64
+	for i := range xs {
+		dx, dy := xs[i]-mx, ys[i]-my
+		sxx += dx * dx
+		syy += dy * dy
+		sxy += dx * dy
+	}
+	if sxx > 0 {
+		fit.Slope = sxy / sxx
+	}
+	if sxx > 0 && syy > 0 {
+		fit.Coefficient = sxy / math.Sqrt(sxx*syy)
+	}
+	fit.Intercept = my - fit.Slope*mx
+
+	var sse float64
+	for i := range xs {
+		r := ys[i] - fit.Intercept - fit.Slope*xs[i]
+		sse += r * r
+	}
+	fit.ResidualStdDev = math.Sqrt(sse / n)
+	// Защита от нулевого разброса на идеально связанных данных
+	if minSigma := math.Max(math.Abs(my)*0.01, 1e-6); fit.ResidualStdDev < minSigma {
+		fit.ResidualStdDev = minSigma
+	}
+	return fit
+}
+
+// PairedWindow возвращает значения двух полей устройства с совпадающими метками
+// времени раньше before из текущего окна и значение x в момент before, если оно есть
+func (mb *MetricsBuffer) PairedWindow(deviceID, x, y string, before int64) ([]float64, []float64, float64, bool) {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+
+	var current float64
+	var hasCurrent bool
+	byTimestamp := make(map[int64]float64)
+	for _, point := range mb.data[deviceID][x] {
+		if point.Timestamp == before {
+			current, hasCurrent = point.Value, true
+		} else if point.Timestamp < before {
+			byTimestamp[point.Timestamp] = point.Value
+		}
+	}
+
+	var xs, ys []float64
+	points := mb.data[deviceID][y]
+	for i := len(points) - 1; i >= 0 && len(ys) < mb.window; i-- {
+		point := points[i]
+		if point.Timestamp >= before {
+			continue
+		}
+		if value, ok := byTimestamp[point.Timestamp]; ok {
+			xs = append(xs, value)
+			ys = append(ys, point.Value)
+		}
+	}
+	return xs, ys, current, hasCurrent
+}
+
+// CorrelationDetector изучает линейную связь между полями устройства и
+// помечает значения, выпадающие из нее: рост CPU при неизменном RPS обычно
+// означает зациклившийся процесс. Срабатывает только для пар, связь которых
+// в окне достаточно сильна (|ρ| ≥ MinCorrelation).
+type CorrelationDetector struct {
+	buffer *MetricsBuffer
+	pairs  []CorrelationPair
+
+	MinCorrelation float64
+	Threshold      float64 // порог остатка в σ
+	MinSamples     int
+}
+
+func NewCorrelationDetector(buffer *MetricsBuffer, cfg CorrelationConfig) *CorrelationDetector {
+	d := &CorrelationDetector{
+		buffer:         buffer,
+		MinCorrelation: cfg.MinCorrelation,
+		Threshold:      cfg.Threshold,
+		MinSamples:     cfg.MinSamples,
+	}
+	for _, raw := range cfg.Pairs {
+		if pair, err := parseCorrelationPair(raw); err == nil {
+			d.pairs = append(d.pairs, pair)
+		}
+	}
+	return d
+}
+
+func (d *CorrelationDetector) Name() string { return AnomalyTypeDecorrelation }
+
+func (d *CorrelationDetector) Applies(field string) bool {
+	for _, pair := range d.pairs {
+		if pair.Dependent == field {
+			return true
+		}
+	}
+	return false
+}
+
+// Detect сравнивает значение с ожидаемым по ведущему полю; из нескольких пар
+// выбирается наибольшее отклонение. nil — если ведущего значения в той же
+// метрике нет или истории недостаточно.
+func (d *CorrelationDetector) Detect(deviceID, field string, point Point) *AnalyticsResult {
+	var best *AnalyticsResult
+	for _, pair := range d.pairs {
+		if pair.Dependent != field {
+			continue
+		}
+		xs, ys, x, ok := d.buffer.PairedWindow(deviceID, pair.Driver, field, point.Timestamp)
+		if !ok || len(xs) < d.MinSamples {
+			continue
+		}
+
+		fit := fitLinear(xs, ys)
+		expected := fit.Intercept + fit.Slope*x
+		residual := point.Value - expected
+		z := residual / fit.ResidualStdDev
+		result := &AnalyticsResult{
+			DeviceID:       deviceID,
+			Field:          field,
+			Type:           AnomalyTypeDecorrelation,
+			RollingAverage: expected,
+			ZScore:         z,
+			IsAnomaly:      math.Abs(fit.Coefficient) >= d.MinCorrelation && math.Abs(z) > d.Threshold,
+			Timestamp:      point.Timestamp,
+			Value:          point.Value,
+			Correlation: &CorrelationInfo{
+				With:        pair.Driver,
+				Coefficient: fit.Coefficient,
+				Expected:    expected,
+				Residual:    residual,
+			},
+		}
+		if best == nil || math.Abs(result.ZScore) > math.Abs(best.ZScore) {
+			best = result
+		}
+	}
+	return best
+}
+
+// State возвращает изученные зависимости пар устройства
+func (d *CorrelationDetector) State(deviceID string) map[string]interface{} {
+	state := make(map[string]interface{}, len(d.pairs))
+	for _, pair := range d.pairs {
+		xs, ys, _, _ := d.buffer.PairedWindow(deviceID, pair.Driver, pair.Dependent, math.MaxInt64)
+		if len(xs) > 0 {
+			state[pair.Driver+":"+pair.Dependent] = fitLinear(xs, ys)
+		}
+	}
+	return state
+}
+
+// Reset ничего не делает: окно хранится в буфере и очищается вызывающим
+func (d *CorrelationDetector) Reset(deviceID string) {}
+
+// FieldCorrelation коэффициент корреляции пары полей устройства
+type FieldCorrelation struct {
+	Fields      [2]string `json:"fields"`
+	Coefficient float64   `json:"coefficient"`
+	Slope       float64   `json:"slope"`
+	Samples     int       `json:"samples"`
+}
+
+// CorrelationHandler возвращает коэффициенты Пирсона между всеми полями
+// устройства по текущему окну; fields ограничивает набор полей, as_of
+// строит окно из значений, поступивших не позже указанного момента
+func (s *Service) CorrelationHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.URL.Query().Get("device_id")
+	if deviceID == "" {
+		http.Error(w, "device_id is required", http.StatusBadRequest)
+		return
+	}
+	// С as_of учитываются только значения, поступившие не позже этого момента
+	before := int64(math.MaxInt64)
+	asOf, historical, err := asOfParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if historical {
+		before = asOf + 1
+	}
+
+	stats, exists := s.metricsBuffer.DeviceStats(deviceID)
+	if !exists {
+		http.Error(w, "device not found", http.StatusNotFound)
+		return
+	}
+
+	fields := make([]string, 0, len(stats))
+	if raw := r.URL.Query().Get("fields"); raw != "" {
+		for _, field := range strings.Split(raw, ",") {
+			if _, ok := stats[field]; ok {
+				fields = append(fields, field)
+			}
+		}
+	} else {
+		for field := range stats {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+
+	correlations := make([]FieldCorrelation, 0)
+	for i := range fields {
+		for j := i + 1; j < len(fields); j++ {
+			xs, ys, _, _ := s.metricsBuffer.PairedWindow(deviceID, fields[i], fields[j], before)
+			if len(xs) < 2 {
+				continue
+			}
+			fit := fitLinear(xs, ys)
+			correlations = append(correlations, FieldCorrelation{
+				Fields:      [2]string{fields[i], fields[j]},
+				Coefficient: fit.Coefficient,
+				Slope:       fit.Slope,
+				Samples:     fit.Samples,
+			})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response := map[string]interface{}{
+		"device_id":    deviceID,
+		"fields":       fields,
+		"correlations": correlations,
+	}
+	if historical {
+		response["as_of"] = asOf
+	}
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// corsAnyOrigin разрешает запросы со страниц любого источника
+const corsAnyOrigin = "*"
+
+// corsExposedHeaders заголовки ответа, которые скрипт страницы может прочитать
+var corsExposedHeaders = strings.Join([]string{
+	"Retry-After",
+	requestIDHeader,
+	samplingModeHeader,
+	samplingIntervalHeader,
+	samplingUntilHeader,
+}, ", ")
+
+// corsMiddleware разрешает запросы к API из браузера со страниц других
+// источников (дашборд на своем домене). Предварительные запросы OPTIONS
+// отвечаются до маршрутизатора: у них нет токена, и маршруты с методом GET
+// или POST ответили бы на них 405. Настройки читаются на каждый запрос,
+// поэтому изменения применяются перезагрузкой конфигурации.
+func (s *Service) corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		s.configMu.RLock()
+		cfg := s.config.CORS
+		s.configMu.RUnlock()
+		allowed := cfg.allowedOrigin(origin)
+		if !cfg.Enabled || allowed == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		header := w.Header()
+		header.Add("Vary", "Origin")
+		header.Set("Access-Control-Allow-Origin", allowed)
+		if cfg.AllowCredentials {
+			header.Set("Access-Control-Allow-Credentials", "true")
+		}
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			header.Set("Access-Control-Allow-Methods", strings.Join(cfg.AllowedMethods, ", "))
+			header.Set("Access-Control-Allow-Headers", strings.Join(cfg.AllowedHeaders, ", "))
+			if cfg.MaxAge > 0 {
+				header.Set("Access-Control-Max-Age", strconv.Itoa(int(cfg.MaxAge.Seconds())))
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		header.Set("Access-Control-Expose-Headers", corsExposedHeaders)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowedOrigin возвращает значение Access-Control-Allow-Origin для
+// источника или пустую строку, если источник не разрешен
+func (c CORSConfig) allowedOrigin(origin string) string {
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == corsAnyOrigin {
+			return corsAnyOrigin
+		}
+		if strings.EqualFold(allowed, origin) {
+			return origin
+		}
+	}
+	return ""
+}
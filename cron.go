@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronMacros сокращения расписаний
+var cronMacros = map[string]string{
+	"@yearly":  "0 0 1 1 *",
+	"@monthly": "0 0 1 * *",
+	"@weekly":  "0 0 * * 0",
+	"@daily":   "0 0 * * *",
+	"@hourly":  "0 * * * *",
+}
+
+// cronField допустимый диапазон поля расписания
+type cronField struct {
+	name     string
+	min, max int
+}
+
+var cronFields = [5]cronField{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// CronSchedule расписание в формате cron из пяти полей: минута, час, день
+// месяца, месяц и день недели (0 и 7 — воскресенье). Поле — *, число,
+// диапазон a-b, шаг */n или a-b/n либо их список через запятую. Как и в
+// cron, если заданы и день месяца, и день недели, достаточно совпадения
+// любого из них.
+type CronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// domAny и dowAny поле дня задано как *
+	domAny, dowAny bool
+}
+
+// parseCron разбирает выражение cron или сокращение @daily, @hourly и т.п.
+func parseCron(expr string) (*CronSchedule, error) {
+	expr = strings.TrimSpace(expr)
+	if macro, ok := cronMacros[expr]; ok {
+		expr = macro
+	}
+	parts := strings.Fields(expr)
+	if len(parts) != len(cronFields) {
+		return nil, fmt.Errorf("expected 5 fields (minute hour day-of-month month day-of-week), got %d", len(parts))
+	}
+
+	var bits [5]uint64
+	for i, part := range parts {
+		set, err := parseCronField(part, cronFields[i])
+		if err != nil {
+			return nil, err
+		}
+		bits[i] = set
+	}
+	// 7 — воскресенье, как и 0
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+	return &CronSchedule{
+		minute: bits[0],
+		hour:   bits[1],
+		dom:    bits[2],
+		month:  bits[3],
+		dow:    bits[4],
+		domAny: parts[2] == "*",
+		dowAny: parts[4] == "*",
+	}, nil
+}
+
+func parseCronField(raw string, field cronField) (uint64, error) {
+	var set uint64
+	for _, item := range strings.Split(raw, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(item, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepPart); err != nil || step < 1 {
+				return 0, fmt.Errorf("%s: invalid step %q", field.name, stepPart)
+			}
+		}
+
+		low, high := field.min, field.max
+		if rangePart != "*" {
+			from, to, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if low, err = strconv.Atoi(from); err != nil {
+				return 0, fmt.Errorf("%s: invalid value %q", field.name, from)
+			}
+			high = low
+			if isRange {
+				if high, err = strconv.Atoi(to); err != nil {
+					return 0, fmt.Errorf("%s: invalid value %q", field.name, to)
+				}
+			} else if hasStep {
+				// a/n — от a до конца диапазона
+				high = field.max
+			}
+		}
+		if low < field.min || high > field.max || low > high {
+			return 0, fmt.Errorf("%s: %q is outside %d-%d", field.name, item, field.min, field.max)
+		}
+		for v := low; v <= high; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+func (cs *CronSchedule) dayMatches(t time.Time) bool {
+	dom := cs.dom&(1<<t.Day()) != 0
+	dow := cs.dow&(1<<int(t.Weekday())) != 0
+	if cs.domAny || cs.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Next возвращает первый момент расписания строго после t в часовом поясе
+// t; нулевое время, если такого момента нет в ближайшие пять лет
+// (например, 30 февраля)
+func (cs *CronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	loc := t.Location()
+	for t.Before(limit) {
+		if cs.month&(1<<int(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !cs.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if cs.hour&(1<<t.Hour()) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			continue
+		}
+		if cs.minute&(1<<t.Minute()) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"math"
+	"sync"
+)
+
+// CUSUMDetector обнаруживает устойчивые сдвиги среднего (двусторонний табличный CUSUM).
+// Базовый уровень оценивается по первым Warmup значениям, после срабатывания
+// состояние сбрасывается и базовый уровень оценивается заново. Вклад одного
+// значения в сумму ограничен H/(MinRun−1) σ, поэтому одиночный выброс, который
+// уже отмечает z-score, не выдается за сдвиг уровня.
+type CUSUMDetector struct {
+	fieldSet
+	mu     sync.Mutex
+	states map[string]map[string]*cusumState // device_id -> field -> состояние
+
+	Warmup int     // число значений для оценки базового уровня
+	K      float64 // допуск в единицах σ
+	H      float64 // порог срабатывания в единицах σ
+	MinRun int     // минимум значений за пределами допуска для срабатывания
+}
+
+type cusumState struct {
+	count int
+	mean  float64
+	m2    float64
+
+	pos, neg           float64
+	posN, negN         int
+	posOnset, negOnset int64
+	// posDev, negDev суммы отклонений от базового уровня с начала накопления
+	posDev, negDev float64
+}
+
+func NewCUSUMDetector(warmup int, k, h float64, minRun int, fields ...string) *CUSUMDetector {
+	return &CUSUMDetector{
+		fieldSet: newFieldSet(fields...),
+		states:   make(map[string]map[string]*cusumState),
+		Warmup:   warmup,
+		K:        k,
+		H:        h,
+		MinRun:   minRun,
+	}
+}
+
+func (d *CUSUMDetector) Name() string { return AnomalyTypeChangePoint }
+
+func (d *CUSUMDetector) Detect(deviceID, field string, point Point) *AnalyticsResult {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	fields, exists := d.states[deviceID]
+	if !exists {
+		fields = make(map[string]*cusumState)
+		d.states[deviceID] = fields
+	}
+	state, exists := fields[field]
+	if !exists {
+		state = &cusumState{}
+		fields[field] = state
+	}
+
+	// Оцениваем базовый уровень (алгоритм Уэлфорда)
+	if state.count < d.Warmup {
+		state.count++
+		delta := point.Value - state.mean
+		state.mean += delta / float64(state.count)
+		state.m2 += delta * (point.Value - state.mean)
+		return nil
+	}
+
+	sigma := math.Sqrt(state.m2 / float64(state.count))
+	// Защита от нулевой дисперсии на константном сигнале
+	if minSigma := math.Max(math.Abs(state.mean)*0.01, 1e-6); sigma < minSigma {
+		sigma = minSigma
+	}
+	k := d.K * sigma
+	h := d.H * sigma
+	// За MinRun−1 значений сумма доходит самое большее до h, но не превышает его
+	step := math.Inf(1)
+	if d.MinRun > 1 {
+		step = h / float64(d.MinRun-1)
+	}
+
+	if state.pos == 0 {
+		state.posOnset = point.Timestamp
+		state.posN = 0
+		state.posDev = 0
+	}
+	if state.neg == 0 {
+		state.negOnset = point.Timestamp
+		state.negN = 0
+		state.negDev = 0
+	}
+	deviation := point.Value - state.mean
+	state.pos = math.Max(0, state.pos+math.Min(deviation-k, step))
+	state.neg = math.Max(0, state.neg+math.Min(-deviation-k, step))
+	if state.pos > 0 {
+		state.posN++
+		state.posDev += deviation
+	}
+	if state.neg > 0 {
+		state.negN++
+		state.negDev += deviation
+	}
+
+	var shift float64
+	var onset int64
+	switch {
+	case state.pos > h:
+		shift = state.posDev / float64(state.posN)
+		onset = state.posOnset
+	case state.neg > h:
+		shift = state.negDev / float64(state.negN)
+		onset = state.negOnset
+	default:
+		return nil
+	}
+
+	baseline := state.mean
+	// Сбрасываем состояние, чтобы заново оценить новый уровень
+	fields[field] = &cusumState{}
+
+	return &AnalyticsResult{
+		DeviceID:       deviceID,
+		Field:          field,
+		Type:           AnomalyTypeChangePoint,
+		RollingAverage: baseline,
+		ZScore:         shift / sigma,
+		IsAnomaly:      true,
+		Timestamp:      point.Timestamp,
+		Value:          point.Value,
+		Shift:          shift,
+		OnsetTimestamp: onset,
+	}
+}
+
+func (d *CUSUMDetector) Reset(deviceID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.states, deviceID)
+}
+
+// State возвращает базовый уровень и накопленные суммы по полям устройства
+func (d *CUSUMDetector) State(deviceID string) map[string]interface{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	state := make(map[string]interface{}, len(d.states[deviceID]))
+	for field, fs := range d.states[deviceID] {
+		state[field] = map[string]interface{}{
+			"samples":   fs.count,
+			"warmed_up": fs.count >= d.Warmup,
+			"baseline":  fs.mean,
+			"sigma":     math.Sqrt(fs.m2 / math.Max(float64(fs.count), 1)),
+			"pos":       fs.pos,
+			"neg":       fs.neg,
+		}
+	}
+	return state
+}
@@ -0,0 +1,69 @@
+package main
+
+import "testing"
+
+// cusumSteady значения около 42 с небольшим шумом
+func cusumSteady(i int) float64 {
+	return 42 + float64(i%3-1)*0.5
+}
+
+func TestCUSUMIgnoresSingleSpike(t *testing.T) {
+	d := NewCUSUMDetector(30, 0.5, 5.0, 3)
+	ts := int64(1700000000)
+	for i := 0; i < 30; i++ {
+		d.Detect("dev", "cpu", Point{Timestamp: ts, Value: cusumSteady(i)})
+		ts++
+	}
+
+	if result := d.Detect("dev", "cpu", Point{Timestamp: ts, Value: 99}); result != nil {
+		t.Fatalf("single spike reported as change point: shift %v", result.Shift)
+	}
+	for i := 0; i < 100; i++ {
+		ts++
+		if result := d.Detect("dev", "cpu", Point{Timestamp: ts, Value: cusumSteady(i)}); result != nil {
+			t.Fatalf("change point %d samples after a single spike: shift %v", i+1, result.Shift)
+		}
+	}
+}
+
+func TestCUSUMDetectsSustainedShift(t *testing.T) {
+	d := NewCUSUMDetector(30, 0.5, 5.0, 3)
+	ts := int64(1700000000)
+	for i := 0; i < 30; i++ {
+		d.Detect("dev", "cpu", Point{Timestamp: ts, Value: cusumSteady(i)})
+		ts++
+	}
+
+	onset := ts
+	for i := 0; i < 3; i++ {
+		result := d.Detect("dev", "cpu", Point{Timestamp: ts, Value: 99 + cusumSteady(i) - 42})
+		ts++
+		if i < 2 {
+			if result != nil {
+				t.Fatalf("change point after %d samples, want at least 3", i+1)
+			}
+			continue
+		}
+		if result == nil {
+			t.Fatal("sustained shift not detected after 3 samples")
+		}
+		if result.OnsetTimestamp != onset {
+			t.Errorf("onset = %d, want %d", result.OnsetTimestamp, onset)
+		}
+		if result.Shift < 55 || result.Shift > 59 {
+			t.Errorf("shift = %v, want about 57", result.Shift)
+		}
+	}
+}
+
+func TestCUSUMMinRunOneFiresOnSpike(t *testing.T) {
+	d := NewCUSUMDetector(30, 0.5, 5.0, 1)
+	ts := int64(1700000000)
+	for i := 0; i < 30; i++ {
+		d.Detect("dev", "cpu", Point{Timestamp: ts, Value: cusumSteady(i)})
+		ts++
+	}
+	if d.Detect("dev", "cpu", Point{Timestamp: ts, Value: 99}) == nil {
+		t.Fatal("min_run 1 must keep the unbounded CUSUM behaviour")
+	}
+}
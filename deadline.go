@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Классы сроков обработки метрик в порядке приоритета
+const (
+	DeadlineRealtime = "realtime"
+	DeadlineStandard = "standard"
+	DeadlineBulk     = "bulk"
+)
+
+// deadlineClasses классы по убыванию приоритета; индекс — приоритет
+var deadlineClasses = []string{DeadlineRealtime, DeadlineStandard, DeadlineBulk}
+
+var (
+	deadlineProcessed = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "highload_deadline_processed_total",
+			Help: "Total number of metrics processed by deadline class and result (met, missed)",
+		},
+		[]string{"class", "result"},
+	)
+
+	deadlineLatency = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "highload_deadline_latency_seconds",
+			Help:    "Time from receiving a metric to the end of its processing by deadline class",
+			Buckets: []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300, 900},
+		},
+		[]string{"class"},
+	)
+)
+
+// deadlineCounts число обработанных и опоздавших метрик по классам
+var deadlineCounts [3]struct{ processed, missed atomic.Int64 }
+
+// deadlinePriority возвращает приоритет класса: 0 — наивысший. Метрики без
+// класса обрабатываются как standard.
+func deadlinePriority(class string) int {
+	for i, c := range deadlineClasses {
+		if c == class {
+			return i
+		}
+	}
+	return 1
+}
+
+func validateDeadlineClass(class string) error {
+	if class == "" {
+		return nil
+	}
+	for _, c := range deadlineClasses {
+		if c == class {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid deadline_class %q, expected realtime, standard or bulk", class)
+}
+
+// budget срок обработки класса с приоритетом priority
+func (c DeadlinesConfig) budget(priority int) time.Duration {
+	switch priority {
+	case 0:
+		return c.Realtime
+	case 2:
+		return c.Bulk
+	}
+	return c.Standard
+}
+
+// recordDeadline учитывает, уложилась ли обработка метрики в срок ее класса
+func (s *Service) recordDeadline(metric Metric) {
+	if metric.ReceivedAt == 0 {
+		return
+	}
+	s.configMu.RLock()
+	deadlines := s.config.Deadlines
+	s.configMu.RUnlock()
+
+	priority := deadlinePriority(metric.DeadlineClass)
+	class := deadlineClasses[priority]
+	latency := time.Since(time.UnixMilli(metric.ReceivedAt))
+	deadlineLatency.WithLabelValues(class).Observe(latency.Seconds())
+
+	counts := &deadlineCounts[priority]
+	counts.processed.Add(1)
+	if latency > deadlines.budget(priority) {
+		counts.missed.Add(1)
+		deadlineProcessed.WithLabelValues(class, "missed").Inc()
+		return
+	}
+	deadlineProcessed.WithLabelValues(class, "met").Inc()
+}
+
+// byDeadline упорядочивает записи потока по приоритету класса, сохраняя
+// порядок внутри класса
+func byDeadline(messages []redis.XMessage) []redis.XMessage {
+	priorities := make([]int, len(messages))
+	for i, msg := range messages {
+		priorities[i] = deadlinePriority(streamRouting(msg).DeadlineClass)
+	}
+	index := make([]int, len(messages))
+	for i := range index {
+		index[i] = i
+	}
+	sort.SliceStable(index, func(a, b int) bool { return priorities[index[a]] < priorities[index[b]] })
+
+	sorted := make([]redis.XMessage, len(messages))
+	for i, j := range index {
+		sorted[i] = messages[j]
+	}
+	return sorted
+}
+
+// nextByDeadline возвращает следующую запись воркера: сначала realtime, затем
+// standard и bulk. Закрытые очереди заменяются на nil; false — закрыты все.
+func nextByDeadline(queues []chan redis.XMessage) (redis.XMessage, bool) {
+	for {
+		open := false
+		for i, queue := range queues {
+			if queue == nil {
+				continue
+			}
+			open = true
+			select {
+			case msg, ok := <-queue:
+				if ok {
+					return msg, true
+				}
+				queues[i] = nil
+			default:
+			}
+		}
+		if !open {
+			return redis.XMessage{}, false
+		}
+
+		// Все очереди пусты: ждем первую запись любого класса
+		select {
+		case msg, ok := <-queues[0]:
+			if ok {
+				return msg, true
+			}
+			queues[0] = nil
+		case msg, ok := <-queues[1]:
+			if ok {
+				return msg, true
+			}
+			queues[1] = nil
+		case msg, ok := <-queues[2]:
+			if ok {
+				return msg, true
+			}
+			queues[2] = nil
+		}
+	}
+}
+
+// DeadlineStats доля опозданий класса
+type DeadlineStats struct {
+	Class     string  `json:"class"`
+	Budget    string  `json:"budget"`
+	Processed int64   `json:"processed"`
+	Missed    int64   `json:"missed"`
+	MissRate  float64 `json:"miss_rate"`
+}
+
+// DeadlinesHandler возвращает число обработанных метрик и долю опозданий по
+// классам сроков с момента запуска
+func (s *Service) DeadlinesHandler(w http.ResponseWriter, r *http.Request) {
+	s.configMu.RLock()
+	deadlines := s.config.Deadlines
+	s.configMu.RUnlock()
+
+	stats := make([]DeadlineStats, len(deadlineClasses))
+	for priority, class := range deadlineClasses {
+		counts := &deadlineCounts[priority]
+		stats[priority] = DeadlineStats{
+			Class:     class,
+			Budget:    deadlines.budget(priority).String(),
+			Processed: counts.processed.Load(),
+			Missed:    counts.missed.Load(),
+		}
+		if stats[priority].Processed > 0 {
+			stats[priority].MissRate = float64(stats[priority].Missed) / float64(stats[priority].Processed)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"classes": stats})
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"expvar"
+	"net/http/pprof"
+	"runtime"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// debugVarsOnce публикует переменные сервиса в expvar один раз на процесс:
+// роутер собирается для каждого слушателя, а повторная публикация паникует
+var debugVarsOnce sync.Once
+
+// QueueDepth заполненность очереди
+type QueueDepth struct {
+	Depth    int `json:"depth"`
+	Capacity int `json:"capacity"`
+}
+
+func queueDepth[T any](ch chan T) QueueDepth {
+	return QueueDepth{Depth: len(ch), Capacity: cap(ch)}
+}
+
+// BufferTotals размер буфера по всем устройствам
+type BufferTotals struct {
+	Devices     int `json:"devices"`
+	Points      int `json:"points"`
+	MemoryBytes int `json:"memory_bytes"`
+}
+
+// Totals возвращает число устройств и значений буфера и оценку занимаемой памяти
+func (mb *MetricsBuffer) Totals() BufferTotals {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+
+	totals := BufferTotals{Devices: len(mb.data), MemoryBytes: mb.memory}
+	for _, fields := range mb.data {
+		for _, values := range fields {
+			totals.Points += len(values)
+		}
+	}
+	return totals
+}
+
+// workerQueues возвращает заполненность очередей перед фоновыми воркерами
+func (s *Service) workerQueues() map[string]QueueDepth {
+	queues := map[string]QueueDepth{
+		"alerts": queueDepth(s.alerts.queue),
+	}
+	if s.archive.Enabled() {
+		queues["clickhouse"] = queueDepth(s.archive.queue)
+	}
+	if s.udp != nil {
+		queues["udp"] = queueDepth(s.udp.packets)
+	}
+	if s.nats.Enabled() {
+		queues["nats_anomalies"] = queueDepth(s.nats.anomalies)
+	}
+	return queues
+}
+
+// debugVars состояние очередей и буферов для /debug/vars
+func (s *Service) debugVars() interface{} {
+	return map[string]interface{}{
+		"goroutines":      runtime.NumGoroutine(),
+		"anomaly_channel": queueDepth(s.anomalyChannel),
+		"queues":          s.workerQueues(),
+		"buffer":          s.metricsBuffer.Totals(),
+		"batch_pending":   s.batches.Pending(),
+		"feed_clients":    s.feed.Subscribers(),
+	}
+}
+
+// debugTokens возвращает токены доступа к /debug
+func (s *Service) debugTokens() []string {
+	s.configMu.RLock()
+	defer s.configMu.RUnlock()
+	return s.config.Debug.Tokens
+}
+
+// mountDebug подключает pprof и /debug/vars (expvar: memstats, cmdline и
+// переменная highload). Доступ только с токеном из debug.tokens на любом
+// слушателе, в том числе без собственной проверки токенов.
+func (s *Service) mountDebug(r *mux.Router) {
+	debugVarsOnce.Do(func() {
+		expvar.Publish("highload", expvar.Func(s.debugVars))
+	})
+
+	debug := r.PathPrefix("/debug").Subrouter()
+	debug.Use(authMiddleware("debug", s.debugTokens))
+	debug.Handle("/vars", expvar.Handler()).Methods("GET")
+	debug.HandleFunc("/pprof/cmdline", pprof.Cmdline)
+	debug.HandleFunc("/pprof/profile", pprof.Profile)
+	debug.HandleFunc("/pprof/symbol", pprof.Symbol)
+	debug.HandleFunc("/pprof/trace", pprof.Trace)
+	// Index отдает и именованные профили: heap, goroutine, allocs, block, mutex
+	debug.PathPrefix("/pprof/").HandlerFunc(pprof.Index)
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Разложение ряда по схеме STL (Cleveland et al., 1990): ряд представляется
+// суммой тренда, сезонной составляющей с периодом period и остатка. Тренд и
+// сглаживание подрядов одной фазы периода считаются локальной линейной
+// регрессией (LOESS) с весами tricube. Концы ряда не экстраполируются:
+// окна у краев сдвигаются внутрь ряда.
+
+const (
+	// decomposeSeasonalSpan точек в окне сглаживания подряда одной фазы
+	decomposeSeasonalSpan = 7
+	// decomposeInnerPasses проходов уточнения тренда и сезонности
+	decomposeInnerPasses = 2
+	// decomposeRobustPasses дополнительных проходов с весами выбросов при robust=true
+	decomposeRobustPasses = 5
+)
+
+// DecomposePoint составляющие ряда на интервале; Filled — значения в
+// интервале не было, оно интерполировано по соседним
+type DecomposePoint struct {
+	Timestamp int64   `json:"timestamp"`
+	Value     float64 `json:"value"`
+	Trend     float64 `json:"trend"`
+	Seasonal  float64 `json:"seasonal"`
+	Residual  float64 `json:"residual"`
+	Filled    bool    `json:"filled,omitempty"`
+}
+
+// loess сглаживает y локальной регрессией по span ближайшим точкам: линейной
+// или, при linear=false, взвешенным средним. weights — веса надежности точек
+// (nil — все равны 1); если в окне все они нулевые, окно сглаживается без них.
+func loess(y, weights []float64, span int, linear bool) []float64 {
+	n := len(y)
+	span = max(min(span, n), 1)
+	result := make([]float64, n)
+	for i := range y {
+		lo := min(max(i-span/2, 0), n-span)
+		hi := lo + span - 1
+		radius := float64(max(i-lo, hi-i)) + 1
+
+		var sw, swx, swy, swxx, swxy float64
+		accumulate := func(robust bool) {
+			sw, swx, swy, swxx, swxy = 0, 0, 0, 0, 0
+			for j := lo; j <= hi; j++ {
+				d := math.Abs(float64(j-i)) / radius
+				w := 1 - d*d*d
+				w = w * w * w
+				if robust {
+					w *= weights[j]
+				}
+				x := float64(j - i)
+				sw += w
+				swx += w * x
+				swy += w * y[j]
+				swxx += w * x * x
+				swxy += w * x * y[j]
+			}
+		}
+		accumulate(weights != nil)
+		if sw == 0 && weights != nil {
+			accumulate(false)
+		}
+		switch {
+		case linear && sw*swxx-swx*swx > 1e-9*sw*swxx:
+			// Значение прямой в x = 0, то есть в самой точке i
+			slope := (sw*swxy - swx*swy) / (sw*swxx - swx*swx)
+			result[i] = (swy - slope*swx) / sw
+		default:
+			result[i] = swy / sw
+		}
+	}
+	return result
+}
+
+// movingAverage центрированное скользящее среднее; у краев окно укорачивается
+func movingAverage(y []float64, window int) []float64 {
+	result := make([]float64, len(y))
+	for i := range y {
+		lo, hi := max(i-window/2, 0), min(i+(window-1)/2, len(y)-1)
+		var sum float64
+		for j := lo; j <= hi; j++ {
+			sum += y[j]
+		}
+		result[i] = sum / float64(hi-lo+1)
+	}
+	return result
+}
+
+// decomposeSeries раскладывает ряд на тренд и сезонную составляющую с
+// периодом period точек; остаток — y минус обе составляющие
+func decomposeSeries(y []float64, period int, robust bool) (trend, seasonal []float64) {
+	n := len(y)
+	// Окно тренда по рекомендации STL: наименьшее нечетное не меньше 1.5·period/(1-1.5/ns)
+	trendSpan := int(math.Ceil(1.5 * float64(period) / (1 - 1.5/decomposeSeasonalSpan)))
+	trendSpan += 1 - trendSpan%2
+
+	trend = make([]float64, n)
+	seasonal = make([]float64, n)
+	var weights []float64
+	passes := 1
+	if robust {
+		passes += decomposeRobustPasses
+	}
+	for pass := 0; pass < passes; pass++ {
+		for inner := 0; inner < decomposeInnerPasses; inner++ {
+			// Сглаживание подрядов одной фазы ряда без тренда
+			cycle := make([]float64, n)
+			for phase := 0; phase < period; phase++ {
+				var sub, subWeights []float64
+				for i := phase; i < n; i += period {
+					sub = append(sub, y[i]-trend[i])
+					if weights != nil {
+						subWeights = append(subWeights, weights[i])
+					}
+				}
+				// Подряд короткий (по точке на период), поэтому, как в STL по
+				// умолчанию, он сглаживается средним, а не прямой
+				smoothed := loess(sub, subWeights, decomposeSeasonalSpan, false)
+				for k, i := 0, phase; i < n; k, i = k+1, i+period {
+					cycle[i] = smoothed[k]
+				}
+			}
+			// Низкочастотную часть сглаженных подрядов относим к тренду
+			low := movingAverage(movingAverage(movingAverage(cycle, period), period), 3)
+			deseasonalized := make([]float64, n)
+			for i := range y {
+				seasonal[i] = cycle[i] - low[i]
+				deseasonalized[i] = y[i] - seasonal[i]
+			}
+			trend = loess(deseasonalized, weights, trendSpan, true)
+		}
+		if pass == passes-1 {
+			break
+		}
+
+		// Веса надежности: bisquare от остатка относительно 6 медиан модуля остатка
+		residuals := make([]float64, n)
+		for i := range y {
+			residuals[i] = math.Abs(y[i] - trend[i] - seasonal[i])
+		}
+		sorted := append([]float64(nil), residuals...)
+		sort.Float64s(sorted)
+		h := 6 * quantile(sorted, 0.5)
+		weights = make([]float64, n)
+		for i, r := range residuals {
+			if h == 0 {
+				weights[i] = 1
+				continue
+			}
+			if u := r / h; u < 1 {
+				weights[i] = (1 - u*u) * (1 - u*u)
+			}
+		}
+	}
+	return trend, seasonal
+}
+
+// DecomposeHandler раскладывает поле устройства на тренд, сезонность и остаток
+// по агрегатам интервалов: GET /api/devices/{device_id}/decompose?field=cpu.
+// Параметры: step — шаг ряда, кратный разрешению агрегатов (по умолчанию 1h
+// или разрешение, если оно больше); period — период сезонности, кратный step
+// (по умолчанию 24h); from и to — unix-время (по умолчанию последние 7
+// периодов); robust=true — устойчивое к выбросам разложение. Значения
+// интервала — среднее; пропуски интерполируются.
+func (s *Service) DecomposeHandler(w http.ResponseWriter, r *http.Request) {
+	rollups := s.rollups.cfg
+	if !rollups.Enabled {
+		http.Error(w, "decomposition requires rollups, enable rollups.enabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	deviceID := mux.Vars(r)["device_id"]
+	query := r.URL.Query()
+	field := query.Get("field")
+	if field == "" {
+		http.Error(w, "field is required", http.StatusBadRequest)
+		return
+	}
+	if !validFieldName(field) {
+		http.Error(w, "invalid field name", http.StatusBadRequest)
+		return
+	}
+
+	step := max(time.Hour, rollups.Resolution)
+	if raw := query.Get("step"); raw != "" {
+		parsed, err := time.ParseDuration(raw)
+		if err != nil || parsed <= 0 || parsed%rollups.Resolution != 0 {
+			http.Error(w, "step must be a multiple of the rollup resolution "+rollups.Resolution.String(), http.StatusBadRequest)
+			return
+		}
+		step = parsed
+	}
+	period := 24 * time.Hour
+	if raw := query.Get("period"); raw != "" {
+		parsed, err := time.ParseDuration(raw)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "period must be a positive duration", http.StatusBadRequest)
+			return
+		}
+		period = parsed
+	}
+	if period%step != 0 || period/step < 2 {
+		http.Error(w, "period must be a multiple of step, at least two steps", http.StatusBadRequest)
+		return
+	}
+	robust := query.Get("robust") == "true"
+
+	stepSec := int64(step / time.Second)
+	to := time.Now().Unix()
+	if raw := query.Get("to"); raw != "" {
+		parsed, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			http.Error(w, "to must be a unix timestamp", http.StatusBadRequest)
+			return
+		}
+		to = parsed
+	}
+	from := to - 7*int64(period/time.Second)
+	if raw := query.Get("from"); raw != "" {
+		parsed, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			http.Error(w, "from must be a unix timestamp", http.StatusBadRequest)
+			return
+		}
+		from = parsed
+	}
+	// Агрегаты старше retention уже удалены, их не читаем
+	from = max(from, time.Now().Add(-rollups.Retention-rollups.Resolution).Unix())
+	from -= from % stepSec
+	if from > to {
+		http.Error(w, "from must not be after to", http.StatusBadRequest)
+		return
+	}
+	if (to-from)/stepSec+1 > maxAggregateBuckets {
+		http.Error(w, "too many buckets, increase step or narrow the range", http.StatusBadRequest)
+		return
+	}
+	if (to-from)/int64(rollups.Resolution/time.Second) > maxRollupReads {
+		http.Error(w, "range is too wide for rollups, narrow it", http.StatusBadRequest)
+		return
+	}
+
+	buckets, err := s.rollups.Buckets(r.Context(), deviceID, field, from, to)
+	if err != nil {
+		http.Error(w, "failed to read rollups: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	merged := make(map[int64]*aggregate)
+	for start, a := range buckets {
+		start -= start % stepSec
+		if merged[start] == nil {
+			merged[start] = &aggregate{}
+		}
+		merged[start].merge(a)
+	}
+	if len(merged) == 0 {
+		http.Error(w, "no rollups for device field in range", http.StatusNotFound)
+		return
+	}
+
+	// Ряд от первого до последнего интервала с данными; пропуски внутри
+	// заполняются линейной интерполяцией между соседними значениями
+	first, last := to, from
+	for start := range merged {
+		first, last = min(first, start), max(last, start)
+	}
+	points := make([]DecomposePoint, 0, (last-first)/stepSec+1)
+	prev := -1
+	for start := first; start <= last; start += stepSec {
+		point := DecomposePoint{Timestamp: start}
+		if a, ok := merged[start]; ok {
+			point.Value = a.value(AggregateAvg)
+			for k := prev + 1; k < len(points); k++ {
+				frac := float64(k-prev) / float64(len(points)-prev)
+				points[k].Value = points[prev].Value + frac*(point.Value-points[prev].Value)
+			}
+			prev = len(points)
+		} else {
+			point.Filled = true
+		}
+		points = append(points, point)
+	}
+
+	periodLen := int(period / step)
+	if len(points) < 2*periodLen {
+		http.Error(w, "not enough data: decomposition needs at least two periods", http.StatusUnprocessableEntity)
+		return
+	}
+
+	values := make([]float64, len(points))
+	for i, point := range points {
+		values[i] = point.Value
+	}
+	trend, seasonal := decomposeSeries(values, periodLen, robust)
+
+	var residualVar, combinedVar float64
+	var residualMean, combinedMean float64
+	for i := range points {
+		points[i].Trend = trend[i]
+		points[i].Seasonal = seasonal[i]
+		points[i].Residual = values[i] - trend[i] - seasonal[i]
+		residualMean += points[i].Residual
+		combinedMean += points[i].Residual + seasonal[i]
+	}
+	n := float64(len(points))
+	residualMean /= n
+	combinedMean /= n
+	for i := range points {
+		r := points[i].Residual - residualMean
+		c := points[i].Residual + seasonal[i] - combinedMean
+		residualVar += r * r
+		combinedVar += c * c
+	}
+	// Сила сезонности по Hyndman: 1 - Var(R)/Var(S+R), от 0 до 1
+	strength := 0.0
+	if combinedVar > 0 {
+		strength = math.Max(0, 1-residualVar/combinedVar)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"device_id":         deviceID,
+		"field":             field,
+		"step":              step.String(),
+		"period":            period.String(),
+		"from":              first,
+		"to":                last,
+		"robust":            robust,
+		"trend_change":      trend[len(trend)-1] - trend[0],
+		"seasonal_strength": strength,
+		"points":            points,
+	})
+}
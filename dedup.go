@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// idempotencyKeyHeader ключ повторной отправки, задаваемый клиентом
+const (
+	idempotencyKeyHeader    = "Idempotency-Key"
+	maxIdempotencyKeyLength = 255
+)
+
+var duplicatesDropped = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "highload_duplicates_dropped_total",
+		Help: "Total number of metrics dropped as retries of already accepted ones by source",
+	},
+	[]string{"source"},
+)
+
+// Deduplicator отбрасывает повторные отправки метрик. Метрика опознается по
+// заголовку Idempotency-Key, а без него — по device_id и метке времени, если
+// ее задал клиент и включен by_timestamp. Принятые ключи хранятся в Redis ttl,
+// поэтому повтор отбрасывается на любой реплике. Метрика без ключа и метки
+// времени опознается по хэшу значений, если задан content_window, и помнится
+// только это время: повтор приходит сразу, а те же значения позже — это новое
+// измерение. При недоступности Redis метрики принимаются.
+type Deduplicator struct {
+	redis redis.UniversalClient
+
+	mu  sync.RWMutex
+	cfg DedupConfig
+}
+
+func NewDeduplicator(rdb redis.UniversalClient, cfg DedupConfig) *Deduplicator {
+	return &Deduplicator{redis: rdb, cfg: cfg}
+}
+
+// Configure применяет новые настройки к следующим метрикам
+func (d *Deduplicator) Configure(cfg DedupConfig) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.cfg = cfg
+}
+
+func (d *Deduplicator) config() DedupConfig {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.cfg
+}
+
+// dedupKey возвращает ключ метрики и срок его хранения; пустой ключ —
+// метрику нельзя опознать
+func dedupKey(cfg DedupConfig, tenant, idempotencyKey string, metric Metric) (string, time.Duration) {
+	if idempotencyKey != "" {
+		return fmt.Sprintf("%s:key:%s", tenant, idempotencyKey), cfg.TTL
+	}
+	if metric.Timestamp != 0 {
+		if !cfg.ByTimestamp {
+			return "", 0
+		}
+		return fmt.Sprintf("%s:sample:%s:%d", tenant, metric.DeviceID, metric.Timestamp), cfg.TTL
+	}
+	if cfg.ContentWindow > 0 {
+		return fmt.Sprintf("%s:content:%s:%s", tenant, metric.DeviceID, metricContentHash(metric)), cfg.ContentWindow
+	}
+	return "", 0
+}
+
+// metricContentHash хэш значений метрики, не зависящий от порядка полей
+func metricContentHash(metric Metric) string {
+	fields := make([]string, 0, len(metric.Values))
+	for field := range metric.Values {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	h := sha256.New()
+	for _, field := range fields {
+		fmt.Fprintf(h, "%s=%v\n", field, metric.Values[field])
+	}
+	fmt.Fprintf(h, "deadline_class=%s\n", metric.DeadlineClass)
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// Duplicate запоминает метрику и возвращает true, если она уже была принята.
+// Вызывается после проверки квот: метрика, отклоненная с 429, при повторе
+// не считается дубликатом.
+func (d *Deduplicator) Duplicate(ctx context.Context, source, tenant, idempotencyKey string, metric Metric) bool {
+	_, duplicate := d.duplicate(ctx, source, tenant, idempotencyKey, metric)
+	return duplicate
+}
+
+// duplicate запоминает метрику вместе с ее номером приема и для повтора
+// возвращает номер исходной отправки (пустой, если его не было)
+func (d *Deduplicator) duplicate(ctx context.Context, source, tenant, idempotencyKey string, metric Metric) (string, bool) {
+	cfg := d.config()
+	key, ttl := dedupKey(cfg, tenant, idempotencyKey, metric)
+	if !cfg.Enabled || key == "" {
+		return "", false
+	}
+
+	var value interface{} = 1
+	if metric.IngestID != "" {
+		value = metric.IngestID
+	}
+	fresh, err := d.redis.SetNX(ctx, cfg.KeyPrefix+":"+key, value, ttl).Result()
+	if err != nil {
+		log.Printf("Failed to check metric for duplicates, accepting it: %v", err)
+		return "", false
+	}
+	if fresh {
+		return "", false
+	}
+	duplicatesDropped.WithLabelValues(source).Inc()
+	original, err := d.redis.Get(ctx, cfg.KeyPrefix+":"+key).Result()
+	if err != nil || original == "1" {
+		return "", true
+	}
+	return original, true
+}
+
+// Deduplicate отбрасывает повторы метрики с samples и возвращает true, если
+// повторены все значения. Без Idempotency-Key и с by_timestamp значения
+// опознаются по одному (device_id и метка времени) одним конвейером SETNX: шлюз может повторить
+// отправку, часть которой уже принята. Метрика без samples проверяется как
+// в Duplicate; у ее повтора номер приема заменяется номером исходной отправки.
+func (d *Deduplicator) Deduplicate(ctx context.Context, source, tenant, idempotencyKey string, metric *Metric) bool {
+	if idempotencyKey != "" || len(metric.Samples) == 0 {
+		original, duplicate := d.duplicate(ctx, source, tenant, idempotencyKey, *metric)
+		if duplicate {
+			metric.IngestID = original
+		}
+		return duplicate
+	}
+	cfg := d.config()
+	if !cfg.Enabled || !cfg.ByTimestamp {
+		return false
+	}
+
+	pipe := d.redis.Pipeline()
+	cmds := make([]*redis.BoolCmd, len(metric.Samples))
+	for i, sample := range metric.Samples {
+		key, ttl := dedupKey(cfg, tenant, "", Metric{DeviceID: metric.DeviceID, Timestamp: sample.Timestamp})
+		cmds[i] = pipe.SetNX(ctx, cfg.KeyPrefix+":"+key, 1, ttl)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("Failed to check metric samples for duplicates, accepting them: %v", err)
+		return false
+	}
+
+	fresh := make([]MetricSample, 0, len(metric.Samples))
+	for i, sample := range metric.Samples {
+		if cmds[i].Val() {
+			fresh = append(fresh, sample)
+		}
+	}
+	if dropped := len(metric.Samples) - len(fresh); dropped > 0 {
+		duplicatesDropped.WithLabelValues(source).Add(float64(dropped))
+	}
+	metric.Samples = fresh
+	return len(fresh) == 0
+}
@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestDedupKeyDefaultsToIdempotencyKey(t *testing.T) {
+	cfg := DefaultConfig().Dedup
+	metric := Metric{DeviceID: "dev", Timestamp: 1700000000, Values: map[string]float64{"cpu": 1}}
+
+	if key, _ := dedupKey(cfg, "acme", "retry-1", metric); key == "" {
+		t.Error("metric with Idempotency-Key is not deduplicated")
+	}
+	if key, _ := dedupKey(cfg, "acme", "", metric); key != "" {
+		t.Errorf("metric with timestamp deduplicated by default as %q", key)
+	}
+	metric.Timestamp = 0
+	if key, _ := dedupKey(cfg, "acme", "", metric); key != "" {
+		t.Errorf("metric without timestamp deduplicated by default as %q", key)
+	}
+}
+
+func TestDedupKeyOptInModes(t *testing.T) {
+	cfg := DefaultConfig().Dedup
+	cfg.ByTimestamp = true
+	cfg.ContentWindow = cfg.TTL / 2
+	metric := Metric{DeviceID: "dev", Timestamp: 1700000000, Values: map[string]float64{"cpu": 1}}
+
+	key, ttl := dedupKey(cfg, "acme", "", metric)
+	if key != "acme:sample:dev:1700000000" || ttl != cfg.TTL {
+		t.Errorf("by_timestamp key %q ttl %s", key, ttl)
+	}
+	metric.Timestamp = 0
+	if _, ttl := dedupKey(cfg, "acme", "", metric); ttl != cfg.ContentWindow {
+		t.Errorf("content key ttl %s, want content_window %s", ttl, cfg.ContentWindow)
+	}
+}
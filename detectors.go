@@ -0,0 +1,191 @@
+package main
+
+import (
+	"math"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Типы аномалий, сообщаемые детекторами
+const (
+	AnomalyTypeZScore      = "zscore"
+	AnomalyTypeChangePoint = "change_point"
+	AnomalyTypeIQR         = "iqr"
+	// AnomalyTypeDecorrelation значение выпало из обычной связи с другим полем устройства
+	AnomalyTypeDecorrelation = "decorrelation"
+	// AnomalyTypeIsolation необычное сочетание значений полей устройства
+	AnomalyTypeIsolation = "isolation"
+	// AnomalyTypeRule выполнилось составное правило (сообщается движком правил, а не детектором)
+	AnomalyTypeRule = "rule"
+)
+
+// zScoreDistribution распределение z-score со знаком: сдвиг распределения
+// виден до срабатываний, а по квантилям подбирается порог. Имена полей
+// задает клиент, поэтому своя метка есть только у cpu, rps, memory, полей
+// из detectors.zscore.fields и объявленных в реестре полей; остальные
+// попадают в other.
+var zScoreDistribution = promauto.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "highload_zscore",
+		Help:    "Distribution of computed z-scores by field (values with fewer than 2 samples or zero deviation are not observed; undeclared fields are reported as other)",
+		Buckets: prometheus.LinearBuckets(-6, 0.5, 25),
+	},
+	[]string{"field"},
+)
+
+// Detector анализирует очередное значение поля устройства
+type Detector interface {
+	// Name возвращает тип аномалии, которую сообщает детектор
+	Name() string
+	// Applies сообщает, анализирует ли детектор указанное поле
+	Applies(field string) bool
+	// Detect оценивает новое значение; nil означает отсутствие результата
+	Detect(deviceID, field string, point Point) *AnalyticsResult
+	// Reset сбрасывает накопленное состояние детектора для устройства
+	Reset(deviceID string)
+}
+
+// StateReporter детектор, показывающий накопленное состояние устройства по полям
+// (для пакетов инцидентов)
+type StateReporter interface {
+	State(deviceID string) map[string]interface{}
+}
+
+// buildDetectors создает включенные в конфигурации детекторы. Сезонные базы
+// хранятся в rdb и обновляются, пока active возвращает true; при rdb == nil —
+// в памяти детектора. По реестру fields выбираются метки гистограммы z-score.
+func buildDetectors(cfg DetectorsConfig, stats RollingStats, buffer *MetricsBuffer, rdb redis.UniversalClient, active func() bool, tuning *FeedbackTuner, fields *FieldRegistry) []Detector {
+	detectors := make([]Detector, 0, 8)
+	if cfg.ZScore.Enabled {
+		zscore := NewZScoreDetector(stats, cfg.ZScore.Threshold, cfg.ZScore.Fields...)
+		zscore.tuning = tuning
+		zscore.active = active
+		zscore.fields = fields
+		detectors = append(detectors, zscore)
+	}
+	if cfg.CUSUM.Enabled {
+		detectors = append(detectors, NewCUSUMDetector(cfg.CUSUM.Warmup, cfg.CUSUM.K, cfg.CUSUM.H, cfg.CUSUM.MinRun, cfg.CUSUM.Fields...))
+	}
+	if cfg.IQR.Enabled {
+		detectors = append(detectors, NewIQRDetector(buffer, cfg.IQR.K, cfg.IQR.MinSamples, cfg.IQR.Fields...))
+	}
+	if cfg.Correlation.Enabled {
+		detectors = append(detectors, NewCorrelationDetector(buffer, cfg.Correlation))
+	}
+	if cfg.Isolation.Enabled {
+		detectors = append(detectors, NewIsolationForestDetector(buffer, cfg.Isolation))
+	}
+	if cfg.Seasonal.Enabled {
+		detectors = append(detectors, NewSeasonalDetector(rdb, cfg.Seasonal, active))
+	}
+	if cfg.Trend.Enabled {
+		detectors = append(detectors, NewTrendDetector(buffer, cfg.Trend))
+	}
+	if cfg.ML.Enabled {
+		detectors = append(detectors, NewMLDetector(buffer, cfg.ML))
+	}
+	return detectors
+}
+
+// fieldSet ограничивает набор полей детектора; пустой набор разрешает все поля
+type fieldSet map[string]bool
+
+func newFieldSet(fields ...string) fieldSet {
+	set := make(fieldSet, len(fields))
+	for _, field := range fields {
+		set[field] = true
+	}
+	return set
+}
+
+func (fs fieldSet) Applies(field string) bool {
+	return len(fs) == 0 || fs[field]
+}
+
+// ZScoreDetector помечает значения, отклоняющиеся от скользящего окна более чем на Threshold σ.
+// Порог устройства умножается на множитель, подобранный tuning по оценкам операторов.
+// Z-score попадают в гистограмму highload_zscore, пока active возвращает true;
+// у детекторов правил и теневых active не задан.
+type ZScoreDetector struct {
+	fieldSet
+	stats     RollingStats
+	tuning    *FeedbackTuner
+	active    func() bool
+	fields    *FieldRegistry
+	Threshold float64
+}
+
+func NewZScoreDetector(stats RollingStats, threshold float64, fields ...string) *ZScoreDetector {
+	return &ZScoreDetector{
+		fieldSet:  newFieldSet(fields...),
+		stats:     stats,
+		Threshold: threshold,
+	}
+}
+
+func (d *ZScoreDetector) Name() string { return AnomalyTypeZScore }
+
+// label метка поля в гистограмме highload_zscore
+func (d *ZScoreDetector) label(field string) string {
+	switch {
+	case field == "cpu" || field == "rps" || field == "memory":
+		return field
+	case d.fieldSet[field]:
+		return field
+	case d.fields != nil && d.fields.Declared(field):
+		return field
+	}
+	return "other"
+}
+
+func (d *ZScoreDetector) Detect(deviceID, field string, point Point) *AnalyticsResult {
+	mean, stdDev, count := d.stats.Observe(deviceID, field, point.Value)
+	var zScore float64
+	if count >= 2 && stdDev > 0 {
+		zScore = (point.Value - mean) / stdDev
+		if d.active != nil && d.active() {
+			zScoreDistribution.WithLabelValues(d.label(field)).Observe(zScore)
+		}
+	}
+
+	return &AnalyticsResult{
+		DeviceID:       deviceID,
+		Field:          field,
+		Type:           AnomalyTypeZScore,
+		RollingAverage: mean,
+		ZScore:         zScore,
+		IsAnomaly:      math.Abs(zScore) > d.Threshold*d.tuning.Factor(AnomalyTypeZScore, deviceID),
+		Timestamp:      point.Timestamp,
+		Value:          point.Value,
+	}
+}
+
+// Reset сбрасывает общую статистику в Redis; локальный буфер очищается вызывающим
+func (d *ZScoreDetector) Reset(deviceID string) {
+	if shared, ok := d.stats.(*SharedStats); ok {
+		shared.Reset(deviceID)
+	}
+}
+
+// State возвращает статистику окна, по которой считается z-score
+func (d *ZScoreDetector) State(deviceID string) map[string]interface{} {
+	state := make(map[string]interface{})
+	switch stats := d.stats.(type) {
+	case *SharedStats:
+		for field, fs := range stats.State(deviceID) {
+			if d.Applies(field) {
+				state[field] = fs
+			}
+		}
+	case *MetricsBuffer:
+		fields, _ := stats.DeviceStats(deviceID)
+		for field, fs := range fields {
+			if d.Applies(field) {
+				state[field] = map[string]interface{}{"mean": fs.RollingAverage, "std_dev": fs.StdDev, "samples": fs.Samples}
+			}
+		}
+	}
+	return state
+}
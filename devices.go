@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// DeviceSummary сведения об устройстве для GET /api/devices
+type DeviceSummary struct {
+	DeviceID string `json:"device_id"`
+	// Samples число замеров в буфере (по самому заполненному полю)
+	Samples         int                `json:"samples"`
+	LastSeen        int64              `json:"last_seen"`
+	LatestValues    map[string]float64 `json:"latest_values"`
+	RollingAverages map[string]float64 `json:"rolling_averages"`
+	Anomalies       int                `json:"anomalies"`
+	// Metadata атрибуты устройства, по которым оно входит в когорты
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Units единицы полей, объявленные в реестре полей
+	Units map[string]string `json:"units,omitempty"`
+}
+
+// deviceSorts порядок сортировки по умолчанию для каждого ключа: имена по
+// возрастанию, активность и аномалии — самые заметные устройства первыми
+var deviceSorts = map[string]string{
+	"device_id": "asc",
+	"last_seen": "desc",
+	"samples":   "desc",
+	"anomalies": "desc",
+}
+
+// DevicesHandler перечисляет устройства в буфере со статистикой активности,
+// с сортировкой (sort, order) и постраничным выводом (limit, offset)
+func (s *Service) DevicesHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	sortBy := query.Get("sort")
+	if sortBy == "" {
+		sortBy = "device_id"
+	}
+	order, ok := deviceSorts[sortBy]
+	if !ok {
+		http.Error(w, "sort must be device_id, last_seen, samples or anomalies", http.StatusBadRequest)
+		return
+	}
+	if raw := query.Get("order"); raw != "" {
+		if raw != "asc" && raw != "desc" {
+			http.Error(w, "order must be asc or desc", http.StatusBadRequest)
+			return
+		}
+		order = raw
+	}
+
+	limit := defaultHistoryLimit
+	if raw := query.Get("limit"); raw != "" {
+		var err error
+		limit, err = strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > maxHistoryLimit {
+			http.Error(w, "limit must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+	}
+	offset := 0
+	if raw := query.Get("offset"); raw != "" {
+		var err error
+		offset, err = strconv.Atoi(raw)
+		if err != nil || offset < 0 {
+			http.Error(w, "offset must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	anomalies := s.anomalies.CountByDevice()
+	devices := make([]DeviceSummary, 0)
+	for _, deviceID := range s.metricsBuffer.Devices() {
+		stats, exists := s.metricsBuffer.DeviceStats(deviceID)
+		if !exists {
+			// Устройство сброшено между вызовами
+			continue
+		}
+		summary := DeviceSummary{
+			DeviceID:        deviceID,
+			LatestValues:    make(map[string]float64, len(stats)),
+			RollingAverages: make(map[string]float64, len(stats)),
+			Anomalies:       anomalies[deviceID],
+			Metadata:        s.metadata.Get(deviceID),
+		}
+		summary.Units = s.fields.Units(deviceID, summary.LatestValues)
+		for field, fs := range stats {
+			summary.LatestValues[field] = fs.LastValue
+			summary.RollingAverages[field] = fs.RollingAverage
+			if fs.Samples > summary.Samples {
+				summary.Samples = fs.Samples
+			}
+			if fs.LastTimestamp > summary.LastSeen {
+				summary.LastSeen = fs.LastTimestamp
+			}
+		}
+		devices = append(devices, summary)
+	}
+
+	sort.Slice(devices, func(i, j int) bool {
+		a, b := devices[i], devices[j]
+		if order == "desc" {
+			a, b = b, a
+		}
+		switch sortBy {
+		case "device_id":
+			return a.DeviceID < b.DeviceID
+		case "last_seen":
+			if a.LastSeen != b.LastSeen {
+				return a.LastSeen < b.LastSeen
+			}
+		case "samples":
+			if a.Samples != b.Samples {
+				return a.Samples < b.Samples
+			}
+		case "anomalies":
+			if a.Anomalies != b.Anomalies {
+				return a.Anomalies < b.Anomalies
+			}
+		}
+		// Устойчивый порядок страниц при равных значениях
+		return devices[i].DeviceID < devices[j].DeviceID
+	})
+
+	total := len(devices)
+	page := devices[min(offset, total):min(offset+limit, total)]
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"total":   total,
+		"count":   len(page),
+		"limit":   limit,
+		"offset":  offset,
+		"sort":    sortBy,
+		"order":   order,
+		"devices": page,
+	})
+}
+
+// SeriesPoint значение поля и скользящее среднее по окну, заканчивающемуся на нем
+type SeriesPoint struct {
+	Timestamp      int64   `json:"timestamp"`
+	Value          float64 `json:"value"`
+	RollingAverage float64 `json:"rolling_average"`
+}
+
+// DeviceSeriesHandler возвращает значения поля из буфера вместе со скользящим
+// средним для графиков: GET /api/devices/{device_id}/series?field=cpu
+func (s *Service) DeviceSeriesHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID := mux.Vars(r)["device_id"]
+	field := r.URL.Query().Get("field")
+	if field == "" {
+		field = "cpu"
+	}
+
+	points := s.metricsBuffer.Points(deviceID, field)
+	if len(points) == 0 {
+		http.Error(w, "no data for device field", http.StatusNotFound)
+		return
+	}
+	window, _ := s.metricsBuffer.Limits()
+
+	series := make([]SeriesPoint, len(points))
+	var sum float64
+	for i, point := range points {
+		sum += point.Value
+		if i >= window {
+			sum -= points[i-window].Value
+		}
+		series[i] = SeriesPoint{
+			Timestamp:      point.Timestamp,
+			Value:          point.Value,
+			RollingAverage: sum / float64(min(i+1, window)),
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"device_id":   deviceID,
+		"field":       field,
+		"window_size": window,
+		"points":      series,
+	})
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// deviceTokenHeader заголовок, в котором устройство передает свой токен
+const deviceTokenHeader = "X-Device-Token"
+
+// Режимы проверки токенов устройств
+const (
+	// DeviceTokensOff токены не проверяются
+	DeviceTokensOff = "off"
+	// DeviceTokensOptional проверяются токены устройств, которым они выданы
+	DeviceTokensOptional = "optional"
+	// DeviceTokensRequired метрики устройств без токена отклоняются
+	DeviceTokensRequired = "required"
+)
+
+// deviceTokenBytes длина токена до шестнадцатеричной записи
+const deviceTokenBytes = 24
+
+var (
+	ErrDeviceTokenMissing  = errors.New("device token is required")
+	ErrDeviceTokenInvalid  = errors.New("device token does not match device_id")
+	ErrDeviceTokenNotFound = errors.New("device token not found")
+)
+
+var deviceTokenRejections = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "highload_device_token_rejections_total",
+		Help: "Total number of metrics rejected by device token check by source and reason (missing, invalid)",
+	},
+	[]string{"source", "reason"},
+)
+
+// DeviceToken выданный токен устройства; сам токен возвращается только при
+// выдаче, в Redis хранится его SHA-256. Tenant арендатор, к которому токен
+// относит метрики устройства (квоты и политики полей)
+type DeviceToken struct {
+	DeviceID  string `json:"device_id"`
+	Tenant    string `json:"tenant,omitempty"`
+	Hash      string `json:"hash,omitempty"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// DeviceTokenStore хранит токены устройств в Redis (общие для всех
+// экземпляров) и периодически перечитывает их. Токен подтверждает, что
+// метрику отправило само устройство из device_id: скомпрометированное
+// устройство не может отправлять метрики от имени остального парка.
+type DeviceTokenStore struct {
+	redis redis.UniversalClient
+
+	mu     sync.RWMutex
+	cfg    DeviceTokensConfig
+	tokens map[string]DeviceToken
+}
+
+func NewDeviceTokenStore(rdb redis.UniversalClient, cfg DeviceTokensConfig) *DeviceTokenStore {
+	return &DeviceTokenStore{redis: rdb, cfg: cfg, tokens: make(map[string]DeviceToken)}
+}
+
+// Configure применяет новые параметры; режим действует сразу
+func (ts *DeviceTokenStore) Configure(cfg DeviceTokensConfig) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.cfg = cfg
+}
+
+func (ts *DeviceTokenStore) config() DeviceTokensConfig {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	return ts.cfg
+}
+
+// Run перечитывает токены из Redis каждые device_tokens.interval
+func (ts *DeviceTokenStore) Run(ctx context.Context) {
+	for {
+		cfg := ts.config()
+		if err := ts.refresh(ctx); err != nil {
+			log.Printf("Failed to load device tokens, keeping %d known: %v", len(ts.List()), err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(cfg.Interval):
+		}
+	}
+}
+
+func (ts *DeviceTokenStore) refresh(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	raw, err := ts.redis.HGetAll(ctx, ts.config().Key).Result()
+	if err != nil {
+		return err
+	}
+
+	tokens := make(map[string]DeviceToken, len(raw))
+	for deviceID, data := range raw {
+		var token DeviceToken
+		if err := json.Unmarshal([]byte(data), &token); err != nil {
+			log.Printf("Skipping malformed token of device %s: %v", deviceID, err)
+			continue
+		}
+		tokens[deviceID] = token
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.tokens = tokens
+	return nil
+}
+
+// Issue выдает устройству новый токен арендатора tenant (пустой — без
+// арендатора), заменяя прежний, и возвращает его
+func (ts *DeviceTokenStore) Issue(ctx context.Context, deviceID, tenant string) (string, DeviceToken, error) {
+	secret := make([]byte, deviceTokenBytes)
+	if _, err := rand.Read(secret); err != nil {
+		return "", DeviceToken{}, err
+	}
+	value := hex.EncodeToString(secret)
+	token := DeviceToken{DeviceID: deviceID, Tenant: tenant, Hash: hashDeviceToken(value), CreatedAt: time.Now().Unix()}
+	data, err := json.Marshal(token)
+	if err != nil {
+		return "", token, err
+	}
+	if err := ts.redis.HSet(ctx, ts.config().Key, deviceID, data).Err(); err != nil {
+		return "", token, err
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.tokens[deviceID] = token
+	return value, token, nil
+}
+
+// Revoke отзывает токен устройства
+func (ts *DeviceTokenStore) Revoke(ctx context.Context, deviceID string) error {
+	removed, err := ts.redis.HDel(ctx, ts.config().Key, deviceID).Result()
+	if err != nil {
+		return err
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if _, exists := ts.tokens[deviceID]; !exists && removed == 0 {
+		return ErrDeviceTokenNotFound
+	}
+	delete(ts.tokens, deviceID)
+	return nil
+}
+
+// List возвращает устройства с выданными токенами без хэшей
+func (ts *DeviceTokenStore) List() []DeviceToken {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	tokens := make([]DeviceToken, 0, len(ts.tokens))
+	for _, token := range ts.tokens {
+		token.Hash = ""
+		tokens = append(tokens, token)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].DeviceID < tokens[j].DeviceID })
+	return tokens
+}
+
+// Verify проверяет токен метрики устройства; пустой token — источник без
+// токенов (udp), его метрики проходят только для устройств без токена в
+// режиме optional
+func (ts *DeviceTokenStore) Verify(source, deviceID, token string) error {
+	_, err := ts.Authenticate(source, deviceID, token)
+	return err
+}
+
+// Authenticate проверяет токен как Verify и возвращает арендатора из
+// подтвержденного токена; пустой арендатор — токен не проверялся (режим off,
+// устройство без токена) или выдан без арендатора
+func (ts *DeviceTokenStore) Authenticate(source, deviceID, token string) (string, error) {
+	ts.mu.RLock()
+	mode := ts.cfg.Mode
+	issued, ok := ts.tokens[deviceID]
+	ts.mu.RUnlock()
+
+	switch {
+	case mode == DeviceTokensOff:
+		return "", nil
+	case !ok && mode == DeviceTokensOptional:
+		return "", nil
+	case token == "":
+		deviceTokenRejections.WithLabelValues(source, "missing").Inc()
+		return "", ErrDeviceTokenMissing
+	case !ok || subtle.ConstantTimeCompare([]byte(issued.Hash), []byte(hashDeviceToken(token))) != 1:
+		deviceTokenRejections.WithLabelValues(source, "invalid").Inc()
+		return "", ErrDeviceTokenInvalid
+	}
+	return issued.Tenant, nil
+}
+
+func hashDeviceToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// writeDeviceTokenError отвечает на отказ проверки токена: 401 без токена,
+// 403 при чужом токене
+func writeDeviceTokenError(w http.ResponseWriter, err error) {
+	status := http.StatusForbidden
+	if errors.Is(err, ErrDeviceTokenMissing) {
+		status = http.StatusUnauthorized
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// AdminDeviceTokensHandler перечисляет устройства с выданными токенами
+func (s *Service) AdminDeviceTokensHandler(w http.ResponseWriter, r *http.Request) {
+	tokens := s.deviceTokens.List()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"mode":   s.deviceTokens.config().Mode,
+		"count":  len(tokens),
+		"tokens": tokens,
+	})
+}
+
+// AdminIssueDeviceTokenHandler выдает устройству токен (или заменяет
+// прежний); параметр tenant относит метрики устройства к арендатору. Токен
+// возвращается один раз, сервис хранит только его хэш.
+func (s *Service) AdminIssueDeviceTokenHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID := mux.Vars(r)["device_id"]
+	value, token, err := s.deviceTokens.Issue(r.Context(), deviceID, r.URL.Query().Get("tenant"))
+	if err != nil {
+		log.Printf("Failed to issue token for device %s: %v", deviceID, err)
+		http.Error(w, "device token storage unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	log.Printf("Token issued for device %s", deviceID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"device_id":  deviceID,
+		"tenant":     token.Tenant,
+		"token":      value,
+		"header":     deviceTokenHeader,
+		"created_at": token.CreatedAt,
+	})
+}
+
+// AdminRevokeDeviceTokenHandler отзывает токен устройства
+func (s *Service) AdminRevokeDeviceTokenHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID := mux.Vars(r)["device_id"]
+	err := s.deviceTokens.Revoke(r.Context(), deviceID)
+	if errors.Is(err, ErrDeviceTokenNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to revoke token of device %s: %v", deviceID, err)
+		http.Error(w, "device token storage unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	log.Printf("Token of device %s revoked", deviceID)
+	w.WriteHeader(http.StatusNoContent)
+}
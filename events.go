@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Типы внешних событий
+const (
+	EventTypeDeploy      = "deploy"
+	EventTypeWeather     = "weather"
+	EventTypeOutage      = "outage"
+	EventTypeMaintenance = "maintenance"
+	EventTypeOther       = "other"
+)
+
+var externalEventTypes = []string{EventTypeDeploy, EventTypeWeather, EventTypeOutage, EventTypeMaintenance, EventTypeOther}
+
+var eventCorrelations = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "highload_event_correlations_total",
+		Help: "Total number of anomalies annotated with a coinciding external event by event type",
+	},
+	[]string{"type"},
+)
+
+// ExternalEvent внешнее событие (выкатка прошивки, погодное предупреждение,
+// отказ внешнего сервиса), с которым сопоставляются аномалии
+type ExternalEvent struct {
+	ID    string `json:"id"`
+	Type  string `json:"type"`
+	Title string `json:"title"`
+	// Start и End — unix-время; End 0 означает точечное событие
+	Start int64 `json:"start"`
+	End   int64 `json:"end,omitempty"`
+	// Devices затронутые устройства; пустой список — весь парк
+	Devices   []string          `json:"devices,omitempty"`
+	Source    string            `json:"source,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	CreatedAt int64             `json:"created_at"`
+}
+
+// Validate проверяет тип, название и интервал события
+func (e ExternalEvent) Validate() error {
+	if !containsString(externalEventTypes, e.Type) {
+		return fmt.Errorf("type must be one of %v", externalEventTypes)
+	}
+	if e.Title == "" {
+		return fmt.Errorf("title is required")
+	}
+	if e.Start <= 0 {
+		return fmt.Errorf("start must be a unix timestamp")
+	}
+	if e.End != 0 && e.End < e.Start {
+		return fmt.Errorf("end must not be before start")
+	}
+	return nil
+}
+
+// covers сообщает, попадает ли аномалия устройства в интервал события с допуском window
+func (e ExternalEvent) covers(deviceID string, timestamp int64, window time.Duration) bool {
+	if len(e.Devices) > 0 && !containsString(e.Devices, deviceID) {
+		return false
+	}
+	end := e.End
+	if end == 0 {
+		end = e.Start
+	}
+	slack := int64(window / time.Second)
+	return timestamp >= e.Start-slack && timestamp <= end+slack
+}
+
+// annotation текст пометки для аномалии, совпавшей с событием
+func (e ExternalEvent) annotation() string {
+	return "coincides with " + e.Title
+}
+
+// EventStore хранит внешние события в пределах окна хранения
+type EventStore struct {
+	mu        sync.RWMutex
+	events    []ExternalEvent // по возрастанию Start
+	retention time.Duration
+	window    time.Duration
+	maxEvents int
+}
+
+func NewEventStore(cfg EventsConfig) *EventStore {
+	return &EventStore{retention: cfg.Retention, window: cfg.Window, maxEvents: cfg.MaxEvents}
+}
+
+// Configure применяет новые параметры хранения и сопоставления
+func (es *EventStore) Configure(cfg EventsConfig) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	es.retention = cfg.Retention
+	es.window = cfg.Window
+	es.maxEvents = cfg.MaxEvents
+	es.prune()
+}
+
+// Add сохраняет событие, присваивая ему идентификатор
+func (es *EventStore) Add(event ExternalEvent) ExternalEvent {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	event.ID = newID()
+	event.CreatedAt = time.Now().Unix()
+	i := sort.Search(len(es.events), func(i int) bool { return es.events[i].Start > event.Start })
+	es.events = append(es.events, ExternalEvent{})
+	copy(es.events[i+1:], es.events[i:])
+	es.events[i] = event
+	es.prune()
+	return event
+}
+
+// prune удаляет события, закончившиеся раньше окна хранения, и самые старые сверх лимита
+func (es *EventStore) prune() {
+	cutoff := time.Now().Add(-es.retention).Unix()
+	kept := es.events[:0]
+	for _, event := range es.events {
+		if event.End >= cutoff || event.Start >= cutoff {
+			kept = append(kept, event)
+		}
+	}
+	es.events = kept
+	if es.maxEvents > 0 && len(es.events) > es.maxEvents {
+		es.events = append(es.events[:0:0], es.events[len(es.events)-es.maxEvents:]...)
+	}
+}
+
+// Window возвращает допуск сопоставления аномалий с событиями
+func (es *EventStore) Window() time.Duration {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+	return es.window
+}
+
+// Matching возвращает события, с которыми совпадает аномалия устройства
+func (es *EventStore) Matching(deviceID string, timestamp int64) []ExternalEvent {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+
+	var matched []ExternalEvent
+	for _, event := range es.events {
+		if event.covers(deviceID, timestamp, es.window) {
+			matched = append(matched, event)
+		}
+	}
+	return matched
+}
+
+// ByIDs возвращает сохраненные события с указанными идентификаторами
+func (es *EventStore) ByIDs(ids []string) []ExternalEvent {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+
+	result := make([]ExternalEvent, 0, len(ids))
+	for _, event := range es.events {
+		if containsString(ids, event.ID) {
+			result = append(result, event)
+		}
+	}
+	return result
+}
+
+// Query возвращает события, пересекающие интервал [from, to]; нули не ограничивают выборку
+func (es *EventStore) Query(eventType string, from, to int64) []ExternalEvent {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+
+	result := make([]ExternalEvent, 0)
+	for _, event := range es.events {
+		end := event.End
+		if end == 0 {
+			end = event.Start
+		}
+		if eventType != "" && event.Type != eventType ||
+			from != 0 && end < from ||
+			to != 0 && event.Start > to {
+			continue
+		}
+		result = append(result, event)
+	}
+	return result
+}
+
+// annotate добавляет к результату пометки о совпавших событиях
+func annotate(result *AnalyticsResult, events []ExternalEvent) bool {
+	changed := false
+	for _, event := range events {
+		if containsString(result.Events, event.ID) {
+			continue
+		}
+		// Копируем срезы, чтобы не менять уже выданные копии результата
+		result.Events = append(result.Events[:len(result.Events):len(result.Events)], event.ID)
+		result.Annotations = append(result.Annotations[:len(result.Annotations):len(result.Annotations)], event.annotation())
+		eventCorrelations.WithLabelValues(event.Type).Inc()
+		changed = true
+	}
+	return changed
+}
+
+// Annotate помечает сохраненные аномалии, совпавшие с событием, и возвращает их число.
+// Нужно для событий, о которых сообщают после инцидента.
+func (as *AnomalyStore) Annotate(event ExternalEvent, window time.Duration) int {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	annotated := 0
+	for i := range as.items {
+		item := &as.items[i]
+		if event.covers(item.DeviceID, item.Timestamp, window) && annotate(item, []ExternalEvent{event}) {
+			annotated++
+		}
+	}
+	return annotated
+}
+
+// ExternalEventHandler регистрирует внешнее событие и помечает уже сохраненные аномалии:
+// {"type": "deploy", "title": "firmware rollout 2.3.1", "start": 1700000000, "devices": [...]}
+func (s *Service) ExternalEventHandler(w http.ResponseWriter, r *http.Request) {
+	var event ExternalEvent
+	if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if err := event.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	event = s.events.Add(event)
+	annotated := s.anomalies.Annotate(event, s.events.Window())
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"event":               event,
+		"annotated_anomalies": annotated,
+	})
+}
+
+// ExternalEventsHandler возвращает события с фильтрами type, from и to
+func (s *Service) ExternalEventsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	eventType := query.Get("type")
+	if eventType != "" && !containsString(externalEventTypes, eventType) {
+		http.Error(w, fmt.Sprintf("type must be one of %v", externalEventTypes), http.StatusBadRequest)
+		return
+	}
+
+	var from, to int64
+	var err error
+	if raw := query.Get("from"); raw != "" {
+		if from, err = strconv.ParseInt(raw, 10, 64); err != nil {
+			http.Error(w, "from must be a unix timestamp", http.StatusBadRequest)
+			return
+		}
+	}
+	if raw := query.Get("to"); raw != "" {
+		if to, err = strconv.ParseInt(raw, 10, 64); err != nil {
+			http.Error(w, "to must be a unix timestamp", http.StatusBadRequest)
+			return
+		}
+	}
+
+	events := s.events.Query(eventType, from, to)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"count":  len(events),
+		"events": events,
+	})
+}
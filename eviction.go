@@ -0,0 +1,229 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"time"
+	"unsafe"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	bufferEvictions = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "highload_buffer_evictions_total",
+			Help: "Total number of devices evicted from the metrics buffer by reason (idle, memory)",
+		},
+		[]string{"reason"},
+	)
+
+	bufferDevices = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "highload_buffer_devices",
+		Help: "Number of devices tracked in the metrics buffer",
+	})
+
+	bufferMemory = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "highload_buffer_memory_bytes",
+		Help: "Estimated memory held by the metrics buffer",
+	})
+
+	bufferMemoryLimit = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "highload_buffer_memory_limit_bytes",
+		Help: "Configured cap on the estimated metrics buffer memory (0 means unlimited)",
+	})
+
+	bufferDeviceMemory = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "highload_buffer_device_memory_bytes",
+			Help: "Estimated metrics buffer memory of the devices holding the most of it (memory.top_devices)",
+		},
+		[]string{"device_id"},
+	)
+
+	bufferShrinks = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "highload_buffer_shrinks_total",
+		Help: "Total number of device windows shrunk to buffer.window values under memory pressure",
+	})
+)
+
+// bufferEntry запись списка LRU: устройство и время последнего значения
+type bufferEntry struct {
+	deviceID string
+	lastSeen time.Time
+}
+
+// touch переносит устройство в начало списка LRU. Вызывается под mb.mu.
+func (mb *MetricsBuffer) touch(deviceID string) {
+	if element, exists := mb.recent[deviceID]; exists {
+		element.Value.(*bufferEntry).lastSeen = time.Now()
+		mb.lru.MoveToFront(element)
+		return
+	}
+	mb.recent[deviceID] = mb.lru.PushFront(&bufferEntry{deviceID: deviceID, lastSeen: time.Now()})
+}
+
+// remove удаляет устройство из буфера и списка LRU. Вызывается под mb.mu.
+func (mb *MetricsBuffer) remove(deviceID string) {
+	delete(mb.data, deviceID)
+	mb.account(deviceID)
+	if element, exists := mb.recent[deviceID]; exists {
+		mb.lru.Remove(element)
+		delete(mb.recent, deviceID)
+	}
+}
+
+// deviceMemory оценивает объем памяти данных устройства в байтах. Вызывается под mb.mu.
+func deviceMemory(deviceID string, fields map[string][]Point) int {
+	// Приблизительные накладные расходы на запись в map и заголовки слайсов
+	const entryOverhead = 48
+	usage := entryOverhead + len(deviceID)
+	for field, values := range fields {
+		usage += entryOverhead + len(field) + cap(values)*int(unsafe.Sizeof(Point{}))
+	}
+	return usage
+}
+
+// account пересчитывает оценку памяти устройства после изменения его
+// значений; для удаленного устройства оценка снимается. Вызывается под mb.mu.
+func (mb *MetricsBuffer) account(deviceID string) {
+	mb.memory -= mb.usage[deviceID]
+	fields, exists := mb.data[deviceID]
+	if !exists {
+		delete(mb.usage, deviceID)
+		return
+	}
+	usage := deviceMemory(deviceID, fields)
+	mb.usage[deviceID] = usage
+	mb.memory += usage
+}
+
+// shrink сокращает окна давно не обновлявшихся устройств до window
+// последних значений с точной емкостью, пока оценка памяти выше limit.
+// Устройство сохраняет состояние для анализа, теряется только история сверх
+// окна. Возвращает число сокращенных устройств. Вызывается под mb.mu.
+func (mb *MetricsBuffer) shrink(limit int) int {
+	shrunk := 0
+	for element := mb.lru.Back(); element != nil && element != mb.lru.Front() && mb.memory > limit; element = element.Prev() {
+		deviceID := element.Value.(*bufferEntry).deviceID
+		before := mb.usage[deviceID]
+		for field, values := range mb.data[deviceID] {
+			keep := min(len(values), mb.window)
+			if cap(values) > keep {
+				mb.data[deviceID][field] = append(make([]Point, 0, keep), values[len(values)-keep:]...)
+			}
+		}
+		mb.account(deviceID)
+		if mb.usage[deviceID] < before {
+			shrunk++
+		}
+	}
+	return shrunk
+}
+
+// Evict удаляет устройства без значений дольше idleTTL, а затем, пока оценка
+// памяти буфера выше memoryLimit байт, сокращает окна (при shrink) и
+// вытесняет давно не обновлявшиеся устройства. Нулевые ограничения
+// отключены. Возвращает удаленные устройства.
+func (mb *MetricsBuffer) Evict(now time.Time, idleTTL time.Duration, memoryLimit int, shrink bool) []string {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	var evicted []string
+	if idleTTL > 0 {
+		for element := mb.lru.Back(); element != nil; element = mb.lru.Back() {
+			entry := element.Value.(*bufferEntry)
+			if now.Sub(entry.lastSeen) < idleTTL {
+				break
+			}
+			mb.remove(entry.deviceID)
+			evicted = append(evicted, entry.deviceID)
+			bufferEvictions.WithLabelValues("idle").Inc()
+		}
+	}
+
+	if memoryLimit > 0 && mb.memory > memoryLimit && shrink {
+		bufferShrinks.Add(float64(mb.shrink(memoryLimit)))
+	}
+	if memoryLimit > 0 {
+		// Последнее обновленное устройство не вытесняется: оно принимает значения прямо сейчас
+		for mb.memory > memoryLimit && mb.lru.Len() > 1 {
+			entry := mb.lru.Back().Value.(*bufferEntry)
+			mb.remove(entry.deviceID)
+			evicted = append(evicted, entry.deviceID)
+			bufferEvictions.WithLabelValues("memory").Inc()
+		}
+	}
+
+	bufferDevices.Set(float64(len(mb.data)))
+	bufferMemory.Set(float64(mb.memory))
+	bufferMemoryLimit.Set(float64(memoryLimit))
+	return evicted
+}
+
+// DeviceMemory пара устройство — оценка памяти его окна
+type DeviceMemory struct {
+	DeviceID    string `json:"device_id"`
+	MemoryBytes int    `json:"memory_bytes"`
+}
+
+// TopMemory возвращает до n устройств, занимающих больше всего памяти
+func (mb *MetricsBuffer) TopMemory(n int) []DeviceMemory {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+
+	top := make([]DeviceMemory, 0, len(mb.usage))
+	for deviceID, usage := range mb.usage {
+		top = append(top, DeviceMemory{DeviceID: deviceID, MemoryBytes: usage})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].MemoryBytes != top[j].MemoryBytes {
+			return top[i].MemoryBytes > top[j].MemoryBytes
+		}
+		return top[i].DeviceID < top[j].DeviceID
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+// publishDeviceMemory выставляет gauge памяти для n самых тяжелых устройств;
+// остальные устройства в метрики не попадают, чтобы число серий не росло с парком
+func (mb *MetricsBuffer) publishDeviceMemory(n int) {
+	bufferDeviceMemory.Reset()
+	for _, device := range mb.TopMemory(n) {
+		bufferDeviceMemory.WithLabelValues(device.DeviceID).Set(float64(device.MemoryBytes))
+	}
+}
+
+// runBufferEviction периодически вытесняет из буфера неактивные устройства и
+// сбрасывает их состояние в детекторах. История аномалий не трогается: она
+// ограничена сроком хранения.
+func (s *Service) runBufferEviction() {
+	for {
+		s.configMu.RLock()
+		cfg := s.config.Buffer
+		topDevices := s.config.Memory.TopDevices
+		s.configMu.RUnlock()
+
+		evicted := s.metricsBuffer.Evict(time.Now(), cfg.IdleTTL, cfg.MemoryLimitMB<<20, cfg.ShrinkOnPressure)
+		s.metricsBuffer.publishDeviceMemory(topDevices)
+		if len(evicted) > 0 {
+			detectors := s.activeDetectors()
+			for _, deviceID := range evicted {
+				for _, detector := range detectors {
+					detector.Reset(deviceID)
+				}
+				s.shadow.Reset(deviceID)
+				s.sketches.Remove(deviceID)
+				s.calibration.Forget(deviceID)
+				s.slas.Forget(deviceID)
+				s.batches.Forget(deviceID)
+			}
+			log.Printf("Evicted %d inactive devices from the metrics buffer", len(evicted))
+		}
+		time.Sleep(cfg.EvictionInterval)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// anomalyExportChunk аномалий в одной порции выгрузки (и в группе строк Parquet)
+const anomalyExportChunk = 5000
+
+var anomalyExportRows = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "highload_anomaly_export_rows_total",
+		Help: "Total number of anomalies written to history exports by format",
+	},
+	[]string{"format"},
+)
+
+// anomalyExportColumn колонка CSV; value возвращает string, int64 или float64.
+// Колонки Parquet задает anomalyExportRow в том же порядке.
+type anomalyExportColumn struct {
+	name  string
+	value func(item AnalyticsResult) interface{}
+}
+
+var anomalyExportColumns = []anomalyExportColumn{
+	{"id", func(a AnalyticsResult) interface{} { return a.ID }},
+	{"device_id", func(a AnalyticsResult) interface{} { return a.DeviceID }},
+	{"field", func(a AnalyticsResult) interface{} { return a.Field }},
+	{"type", func(a AnalyticsResult) interface{} { return a.Type }},
+	{"severity", func(a AnalyticsResult) interface{} { return a.Severity }},
+	{"status", func(a AnalyticsResult) interface{} { return a.Status }},
+	{"timestamp", func(a AnalyticsResult) interface{} { return a.Timestamp }},
+	{"value", func(a AnalyticsResult) interface{} { return a.Value }},
+	{"rolling_average", func(a AnalyticsResult) interface{} { return a.RollingAverage }},
+	{"z_score", func(a AnalyticsResult) interface{} { return a.ZScore }},
+	{"probability", func(a AnalyticsResult) interface{} { return a.Probability }},
+	{"acknowledged_by", func(a AnalyticsResult) interface{} { return actionUser(a.Acknowledged) }},
+	{"acknowledged_at", func(a AnalyticsResult) interface{} { return actionTime(a.Acknowledged) }},
+	{"resolved_by", func(a AnalyticsResult) interface{} { return actionUser(a.Resolved) }},
+	{"resolved_at", func(a AnalyticsResult) interface{} { return actionTime(a.Resolved) }},
+	{"feedback", func(a AnalyticsResult) interface{} { return feedbackValue(a.Feedback).Label }},
+	{"feedback_reason", func(a AnalyticsResult) interface{} { return feedbackValue(a.Feedback).Reason }},
+	{"feedback_by", func(a AnalyticsResult) interface{} { return feedbackValue(a.Feedback).User }},
+	{"events", func(a AnalyticsResult) interface{} { return strings.Join(a.Events, "; ") }},
+	{"trace_id", func(a AnalyticsResult) interface{} { return a.TraceID }},
+}
+
+func actionUser(action *AnomalyAction) string {
+	if action == nil {
+		return ""
+	}
+	return action.User
+}
+
+func actionTime(action *AnomalyAction) int64 {
+	if action == nil {
+		return 0
+	}
+	return action.At
+}
+
+func feedbackValue(feedback *AnomalyFeedback) AnomalyFeedback {
+	if feedback == nil {
+		return AnomalyFeedback{}
+	}
+	return *feedback
+}
+
+// anomalyExporter пишет порции аномалий в файл выгрузки
+type anomalyExporter interface {
+	Write(batch []AnalyticsResult) error
+	Close() error
+}
+
+type csvAnomalyExporter struct {
+	w *csv.Writer
+}
+
+func newCSVAnomalyExporter(w http.ResponseWriter) (*csvAnomalyExporter, error) {
+	e := &csvAnomalyExporter{w: csv.NewWriter(w)}
+	header := make([]string, len(anomalyExportColumns))
+	for i, column := range anomalyExportColumns {
+		header[i] = column.name
+	}
+	return e, e.w.Write(header)
+}
+
+func (e *csvAnomalyExporter) Write(batch []AnalyticsResult) error {
+	record := make([]string, len(anomalyExportColumns))
+	for _, item := range batch {
+		for i, column := range anomalyExportColumns {
+			switch v := column.value(item).(type) {
+			case string:
+				record[i] = v
+			case int64:
+				record[i] = strconv.FormatInt(v, 10)
+			case float64:
+				record[i] = strconv.FormatFloat(v, 'g', -1, 64)
+			}
+		}
+		if err := e.w.Write(record); err != nil {
+			return err
+		}
+	}
+	e.w.Flush()
+	return e.w.Error()
+}
+
+func (e *csvAnomalyExporter) Close() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// anomalyExportRow строка выгрузки Parquet; колонки совпадают с anomalyExportColumns
+type anomalyExportRow struct {
+	ID             string  `parquet:"id"`
+	DeviceID       string  `parquet:"device_id"`
+	Field          string  `parquet:"field"`
+	Type           string  `parquet:"type"`
+	Severity       string  `parquet:"severity"`
+	Status         string  `parquet:"status"`
+	Timestamp      int64   `parquet:"timestamp"`
+	Value          float64 `parquet:"value"`
+	RollingAverage float64 `parquet:"rolling_average"`
+	ZScore         float64 `parquet:"z_score"`
+	Probability    float64 `parquet:"probability"`
+	AcknowledgedBy string  `parquet:"acknowledged_by"`
+	AcknowledgedAt int64   `parquet:"acknowledged_at"`
+	ResolvedBy     string  `parquet:"resolved_by"`
+	ResolvedAt     int64   `parquet:"resolved_at"`
+	Feedback       string  `parquet:"feedback"`
+	FeedbackReason string  `parquet:"feedback_reason"`
+	FeedbackBy     string  `parquet:"feedback_by"`
+	Events         string  `parquet:"events"`
+	TraceID        string  `parquet:"trace_id"`
+}
+
+func newAnomalyExportRow(a AnalyticsResult) anomalyExportRow {
+	feedback := feedbackValue(a.Feedback)
+	return anomalyExportRow{
+		ID:             a.ID,
+		DeviceID:       a.DeviceID,
+		Field:          a.Field,
+		Type:           a.Type,
+		Severity:       a.Severity,
+		Status:         a.Status,
+		Timestamp:      a.Timestamp,
+		Value:          a.Value,
+		RollingAverage: a.RollingAverage,
+		ZScore:         a.ZScore,
+		Probability:    a.Probability,
+		AcknowledgedBy: actionUser(a.Acknowledged),
+		AcknowledgedAt: actionTime(a.Acknowledged),
+		ResolvedBy:     actionUser(a.Resolved),
+		ResolvedAt:     actionTime(a.Resolved),
+		Feedback:       feedback.Label,
+		FeedbackReason: feedback.Reason,
+		FeedbackBy:     feedback.User,
+		Events:         strings.Join(a.Events, "; "),
+		TraceID:        a.TraceID,
+	}
+}
+
+// parquetAnomalyExporter пишет каждую порцию отдельной группой строк
+type parquetAnomalyExporter struct {
+	w    *parquet.GenericWriter[anomalyExportRow]
+	rows []anomalyExportRow
+}
+
+func newParquetAnomalyExporter(w http.ResponseWriter) (*parquetAnomalyExporter, error) {
+	return &parquetAnomalyExporter{w: parquet.NewGenericWriter[anomalyExportRow](w)}, nil
+}
+
+func (e *parquetAnomalyExporter) Write(batch []AnalyticsResult) error {
+	e.rows = e.rows[:0]
+	for _, item := range batch {
+		e.rows = append(e.rows, newAnomalyExportRow(item))
+	}
+	if _, err := e.w.Write(e.rows); err != nil {
+		return err
+	}
+	return e.w.Flush()
+}
+
+func (e *parquetAnomalyExporter) Close() error {
+	return e.w.Close()
+}
+
+// AnomalyExportHandler отдает историю аномалий файлом CSV или Parquet
+// (format=csv|parquet) с фильтрами from, to, device_id, field и status.
+// Файл пишется порциями по мере обхода истории, без сборки в памяти.
+func (s *Service) AnomalyExportHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter, err := parseAnomalyFilter(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	format := query.Get("format")
+	if format == "" {
+		format = "csv"
+	}
+
+	var exporter anomalyExporter
+	switch format {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	case "parquet":
+		w.Header().Set("Content-Type", "application/vnd.apache.parquet")
+	default:
+		http.Error(w, "format must be csv or parquet", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="anomalies-%s.%s"`,
+		time.Now().UTC().Format("20060102T150405Z"), format))
+
+	if format == "csv" {
+		exporter, err = newCSVAnomalyExporter(w)
+	} else {
+		exporter, err = newParquetAnomalyExporter(w)
+	}
+	// Выгрузка большой истории длится дольше server.write_timeout
+	disableWriteTimeout(w)
+	flusher, _ := w.(http.Flusher)
+	rows := 0
+	if err == nil {
+		err = s.anomalies.Scan(filter, anomalyExportChunk, func(batch []AnalyticsResult) error {
+			if err := exporter.Write(batch); err != nil {
+				return err
+			}
+			rows += len(batch)
+			if flusher != nil {
+				flusher.Flush()
+			}
+			return nil
+		})
+	}
+	if err == nil {
+		err = exporter.Close()
+	}
+	anomalyExportRows.WithLabelValues(format).Add(float64(rows))
+	if err != nil {
+		// Заголовок ответа уже отправлен: клиент получит обрезанный файл
+		log.Printf("Anomaly export (%s) failed after %d rows: %v", format, rows, err)
+	}
+}
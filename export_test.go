@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+func openParquet(t *testing.T, data []byte) *parquet.File {
+	t.Helper()
+	f, err := parquet.OpenFile(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	return f
+}
+
+func readParquet[T any](t *testing.T, f *parquet.File) []T {
+	t.Helper()
+	reader := parquet.NewGenericReader[T](f)
+	defer reader.Close()
+	rows := make([]T, f.NumRows())
+	n, err := reader.Read(rows)
+	if err != nil && err != io.EOF {
+		t.Fatalf("read: %v", err)
+	}
+	return rows[:n]
+}
+
+func TestParquetAnomalyExport(t *testing.T) {
+	rec := httptest.NewRecorder()
+	exporter, err := newParquetAnomalyExporter(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batches := [][]AnalyticsResult{
+		{{ID: "a1", DeviceID: "dev-1", Field: "cpu", Timestamp: 1700000000, Value: 97.5, ZScore: 4.2,
+			Acknowledged: &AnomalyAction{User: "ops", At: 1700000100}}},
+		{{ID: "a2", DeviceID: "dev-2", Field: "rps", Timestamp: 1700000050, Value: 3, Events: []string{"deploy", "restart"}}},
+	}
+	for _, batch := range batches {
+		if err := exporter.Write(batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := exporter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f := openParquet(t, rec.Body.Bytes())
+	if len(f.RowGroups()) != len(batches) {
+		t.Fatalf("got %d row groups, want one per batch", len(f.RowGroups()))
+	}
+	fields := f.Schema().Fields()
+	if len(fields) != len(anomalyExportColumns) {
+		t.Fatalf("schema has %d columns, want %d", len(fields), len(anomalyExportColumns))
+	}
+	for i, field := range fields {
+		if field.Name() != anomalyExportColumns[i].name {
+			t.Errorf("column %d is %s, CSV has %s", i, field.Name(), anomalyExportColumns[i].name)
+		}
+	}
+
+	type exportRow struct {
+		ID             string  `parquet:"id"`
+		DeviceID       string  `parquet:"device_id"`
+		Field          string  `parquet:"field"`
+		Timestamp      int64   `parquet:"timestamp"`
+		Value          float64 `parquet:"value"`
+		ZScore         float64 `parquet:"z_score"`
+		AcknowledgedBy string  `parquet:"acknowledged_by"`
+		AcknowledgedAt int64   `parquet:"acknowledged_at"`
+		Events         string  `parquet:"events"`
+	}
+	rows := readParquet[exportRow](t, f)
+	want := []exportRow{
+		{ID: "a1", DeviceID: "dev-1", Field: "cpu", Timestamp: 1700000000, Value: 97.5, ZScore: 4.2, AcknowledgedBy: "ops", AcknowledgedAt: 1700000100},
+		{ID: "a2", DeviceID: "dev-2", Field: "rps", Timestamp: 1700000050, Value: 3, Events: "deploy; restart"},
+	}
+	if len(rows) != len(want) {
+		t.Fatalf("read %d rows, want %d", len(rows), len(want))
+	}
+	for i := range want {
+		if rows[i] != want[i] {
+			t.Errorf("row %d: got %+v, want %+v", i, rows[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Роли экземпляра в паре active/standby
+const (
+	RoleActive  = "active"
+	RoleStandby = "standby"
+)
+
+// renewLockScript продлевает блокировку, только если она принадлежит этому экземпляру
+var renewLockScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("pexpire", KEYS[1], ARGV[2])
+end
+return 0`)
+
+// releaseLockScript удаляет блокировку, только если она принадлежит этому экземпляру
+var releaseLockScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0`)
+
+var haActive = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "highload_ha_active",
+	Help: "1 if this instance holds the active lock in active/standby mode, 0 otherwise",
+})
+
+// FailoverCoordinator выбирает активный экземпляр пары через блокировку в Redis.
+// Активный экземпляр продлевает блокировку каждые renew_interval; если он
+// перестает это делать, блокировка истекает через lock_ttl и ее забирает резервный.
+type FailoverCoordinator struct {
+	mu       sync.Mutex
+	redis    redis.UniversalClient
+	cfg      HAConfig
+	id       string
+	active   bool
+	since    time.Time
+	releases []context.CancelFunc // контексты, живущие пока экземпляр активен
+}
+
+func NewFailoverCoordinator(rdb redis.UniversalClient, cfg HAConfig) *FailoverCoordinator {
+	return &FailoverCoordinator{
+		redis: rdb,
+		cfg:   cfg,
+		id:    instanceID(cfg.InstanceID),
+		// Без режима пары экземпляр всегда активен
+		active: !cfg.Enabled,
+		since:  time.Now(),
+	}
+}
+
+// instanceID идентификатор экземпляра в блокировках: заданный или имя хоста и pid
+func instanceID(configured string) string {
+	if configured != "" {
+		return configured
+	}
+	host, _ := os.Hostname()
+	return host + "-" + strconv.Itoa(os.Getpid())
+}
+
+// Active сообщает, выполняет ли экземпляр работу с побочными эффектами
+// (алерты, архив, подтверждение записей потока)
+func (fc *FailoverCoordinator) Active() bool {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.active
+}
+
+// Role возвращает текущую роль и время ее получения
+func (fc *FailoverCoordinator) Role() (string, time.Time) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if fc.active {
+		return RoleActive, fc.since
+	}
+	return RoleStandby, fc.since
+}
+
+// ActiveContext возвращает контекст, который отменяется при потере блокировки
+func (fc *FailoverCoordinator) ActiveContext(parent context.Context) context.Context {
+	ctx, cancel := context.WithCancel(parent)
+
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if !fc.active {
+		cancel()
+		return ctx
+	}
+	fc.releases = append(fc.releases, cancel)
+	return ctx
+}
+
+// Run захватывает и продлевает блокировку до отмены контекста, после чего освобождает ее
+func (fc *FailoverCoordinator) Run(ctx context.Context) {
+	ticker := time.NewTicker(fc.cfg.RenewInterval)
+	defer ticker.Stop()
+
+	for {
+		fc.tick(ctx)
+		select {
+		case <-ctx.Done():
+			fc.release()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (fc *FailoverCoordinator) tick(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, fc.cfg.RenewInterval)
+	defer cancel()
+
+	if fc.Active() {
+		renewed, err := renewLockScript.Run(ctx, fc.redis, []string{fc.cfg.LockKey}, fc.id, fc.cfg.LockTTL.Milliseconds()).Int()
+		if err != nil || renewed == 0 {
+			// При ошибке Redis считаем блокировку потерянной: резервный может
+			// забрать ее по истечении TTL, и два активных экземпляра недопустимы
+			fc.setActive(false, err)
+		}
+		return
+	}
+
+	acquired, err := fc.redis.SetNX(ctx, fc.cfg.LockKey, fc.id, fc.cfg.LockTTL).Result()
+	if err == nil && acquired {
+		fc.setActive(true, nil)
+	}
+}
+
+func (fc *FailoverCoordinator) setActive(active bool, reason error) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	fc.active = active
+	fc.since = time.Now()
+	if active {
+		haActive.Set(1)
+		log.Printf("Acquired active lock %s as %s", fc.cfg.LockKey, fc.id)
+		return
+	}
+
+	haActive.Set(0)
+	for _, cancel := range fc.releases {
+		cancel()
+	}
+	fc.releases = nil
+	if reason != nil {
+		log.Printf("Lost active lock %s: %v; switching to standby", fc.cfg.LockKey, reason)
+	} else {
+		log.Printf("Lost active lock %s; switching to standby", fc.cfg.LockKey)
+	}
+}
+
+// release освобождает блокировку при остановке, чтобы резервный не ждал истечения TTL
+func (fc *FailoverCoordinator) release() {
+	if !fc.Active() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	releaseLockScript.Run(ctx, fc.redis, []string{fc.cfg.LockKey}, fc.id)
+	fc.setActive(false, nil)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// feedBufferSize аномалий в очереди одного подписчика; при переполнении новые отбрасываются
+	feedBufferSize = 64
+	// feedKeepAlive интервал комментариев SSE, чтобы прокси не закрывали простаивающее соединение
+	feedKeepAlive = 15 * time.Second
+)
+
+var (
+	feedSubscribers = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "highload_anomaly_feed_subscribers",
+		Help: "Number of clients connected to the anomaly SSE feed",
+	})
+
+	feedDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "highload_anomaly_feed_dropped_total",
+		Help: "Total number of anomalies not delivered to slow SSE feed subscribers",
+	})
+)
+
+// AnomalyFeed рассылает обнаруженные аномалии подключенным клиентам SSE.
+// Медленный клиент теряет аномалии, но не задерживает анализ.
+type AnomalyFeed struct {
+	mu          sync.RWMutex
+	subscribers map[chan AnalyticsResult]struct{}
+}
+
+func NewAnomalyFeed() *AnomalyFeed {
+	return &AnomalyFeed{subscribers: make(map[chan AnalyticsResult]struct{})}
+}
+
+// Subscribe регистрирует подписчика; возвращаемая функция отменяет подписку
+func (f *AnomalyFeed) Subscribe() (<-chan AnalyticsResult, func()) {
+	ch := make(chan AnalyticsResult, feedBufferSize)
+	f.mu.Lock()
+	f.subscribers[ch] = struct{}{}
+	f.mu.Unlock()
+	feedSubscribers.Inc()
+
+	return ch, func() {
+		f.mu.Lock()
+		delete(f.subscribers, ch)
+		f.mu.Unlock()
+		feedSubscribers.Dec()
+	}
+}
+
+// Subscribers возвращает число подключенных клиентов
+func (f *AnomalyFeed) Subscribers() int {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return len(f.subscribers)
+}
+
+// Publish отправляет аномалию всем подписчикам без ожидания
+
+func (f *AnomalyFeed) Publish(result AnalyticsResult) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	for ch := range f.subscribers {
+		select {
+		case ch <- result:
+		default:
+			feedDropped.Inc()
+		}
+	}
+}
+
+// AnomalyStreamHandler передает аномалии по мере обнаружения (Server-Sent Events,
+// событие anomaly). Параметр device_id ограничивает поток одним устройством.
+func (s *Service) AnomalyStreamHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	deviceID := r.URL.Query().Get("device_id")
+
+	feed, unsubscribe := s.feed.Subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Отключает буферизацию ответа в nginx
+	w.Header().Set("X-Accel-Buffering", "no")
+	disableWriteTimeout(w)
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(feedKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case result := <-feed:
+			if deviceID != "" && result.DeviceID != deviceID {
+				continue
+			}
+			data, err := json.Marshal(result)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "id: %s\nevent: anomaly\ndata: %s\n\n", result.ID, data)
+		}
+		flusher.Flush()
+	}
+}
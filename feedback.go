@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Оценки аномалии оператором
+const (
+	FeedbackTruePositive  = "true_positive"
+	FeedbackFalsePositive = "false_positive"
+)
+
+var anomalyFeedbackTotal = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "highload_anomaly_feedback_total",
+		Help: "Total number of operator feedback labels on anomalies by label (true_positive, false_positive)",
+	},
+	[]string{"label"},
+)
+
+// AnomalyFeedback оценка аномалии: настоящая она или ложное срабатывание
+type AnomalyFeedback struct {
+	Label  string `json:"label"`
+	Reason string `json:"reason,omitempty"`
+	User   string `json:"user"`
+	At     int64  `json:"at"`
+}
+
+// FeedbackCounts число оценок срабатываний детектора на устройстве
+type FeedbackCounts struct {
+	TruePositive  int `json:"true_positive"`
+	FalsePositive int `json:"false_positive"`
+}
+
+// falsePositiveRate доля ложных срабатываний среди оцененных
+func (c FeedbackCounts) falsePositiveRate() float64 {
+	total := c.TruePositive + c.FalsePositive
+	if total == 0 {
+		return 0
+	}
+	return float64(c.FalsePositive) / float64(total)
+}
+
+// DeviceFeedback оценки детектора на устройстве и подобранный по ним множитель порога
+type DeviceFeedback struct {
+	DeviceID string `json:"device_id"`
+	Detector string `json:"detector"`
+	FeedbackCounts
+	FalsePositiveRate float64 `json:"false_positive_rate"`
+	ThresholdFactor   float64 `json:"threshold_factor"`
+}
+
+type feedbackKey struct {
+	detector string
+	deviceID string
+}
+
+// FeedbackTuner копит оценки аномалий по устройствам и детекторам в Redis
+// (общие для всех экземпляров) и при auto_tune поднимает порог z-score
+// устройствам, у которых доля ложных срабатываний выше целевой. Множитель
+// растет линейно от 1 при целевой доле до max_threshold_factor, когда все
+// оцененные срабатывания ложные; пока оценок меньше min_labels, порог не
+// меняется. Остальные детекторы оценки копят, но порог не подстраивают.
+type FeedbackTuner struct {
+	redis redis.UniversalClient
+
+	mu     sync.RWMutex
+	cfg    FeedbackConfig
+	counts map[feedbackKey]FeedbackCounts
+}
+
+func NewFeedbackTuner(rdb redis.UniversalClient, cfg FeedbackConfig) *FeedbackTuner {
+	return &FeedbackTuner{redis: rdb, cfg: cfg, counts: make(map[feedbackKey]FeedbackCounts)}
+}
+
+// Configure применяет новые параметры подстройки; они действуют сразу
+func (ft *FeedbackTuner) Configure(cfg FeedbackConfig) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	ft.cfg = cfg
+}
+
+func (ft *FeedbackTuner) config() FeedbackConfig {
+	ft.mu.RLock()
+	defer ft.mu.RUnlock()
+	return ft.cfg
+}
+
+// Run перечитывает оценки из Redis каждые feedback.interval
+func (ft *FeedbackTuner) Run(ctx context.Context) {
+	for {
+		cfg := ft.config()
+		if err := ft.refresh(ctx); err != nil {
+			log.Printf("Failed to load anomaly feedback, keeping previous counts: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(cfg.Interval):
+		}
+	}
+}
+
+// feedbackField поле хэша с числом оценок label детектора на устройстве
+func feedbackField(key feedbackKey, label string) string {
+	return key.detector + ":" + key.deviceID + ":" + label
+}
+
+// parseFeedbackField разбирает поле хэша; имя детектора не содержит
+// двоеточий, а идентификатор устройства может
+func parseFeedbackField(field string) (feedbackKey, string, bool) {
+	first := strings.IndexByte(field, ':')
+	last := strings.LastIndexByte(field, ':')
+	if first < 0 || last <= first {
+		return feedbackKey{}, "", false
+	}
+	return feedbackKey{detector: field[:first], deviceID: field[first+1 : last]}, field[last+1:], true
+}
+
+func (ft *FeedbackTuner) refresh(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	raw, err := ft.redis.HGetAll(ctx, ft.config().Key).Result()
+	if err != nil {
+		return err
+	}
+
+	counts := make(map[feedbackKey]FeedbackCounts)
+	for field, value := range raw {
+		key, label, ok := parseFeedbackField(field)
+		n, err := strconv.Atoi(value)
+		if !ok || err != nil {
+			log.Printf("Skipping malformed feedback counter %s", field)
+			continue
+		}
+		c := counts[key]
+		switch label {
+		case FeedbackTruePositive:
+			c.TruePositive = max(n, 0)
+		case FeedbackFalsePositive:
+			c.FalsePositive = max(n, 0)
+		default:
+			continue
+		}
+		counts[key] = c
+	}
+
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	ft.counts = counts
+	return nil
+}
+
+// Record учитывает оценку срабатывания детектора; previous — прежняя оценка
+// той же аномалии, она перестает учитываться
+func (ft *FeedbackTuner) Record(ctx context.Context, detector, deviceID, previous, label string) error {
+	if previous == label {
+		return nil
+	}
+	key := feedbackKey{detector: detector, deviceID: deviceID}
+	hash := ft.config().Key
+	pipe := ft.redis.TxPipeline()
+	pipe.HIncrBy(ctx, hash, feedbackField(key, label), 1)
+	if previous != "" {
+		pipe.HIncrBy(ctx, hash, feedbackField(key, previous), -1)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	c := ft.counts[key]
+	adjustFeedbackCounts(&c, label, 1)
+	adjustFeedbackCounts(&c, previous, -1)
+	ft.counts[key] = c
+	return nil
+}
+
+func adjustFeedbackCounts(c *FeedbackCounts, label string, delta int) {
+	switch label {
+	case FeedbackTruePositive:
+		c.TruePositive = max(c.TruePositive+delta, 0)
+	case FeedbackFalsePositive:
+		c.FalsePositive = max(c.FalsePositive+delta, 0)
+	}
+}
+
+// thresholdFactor множитель порога по оценкам устройства
+func thresholdFactor(cfg FeedbackConfig, c FeedbackCounts) float64 {
+	if !cfg.AutoTune || c.TruePositive+c.FalsePositive < cfg.MinLabels {
+		return 1
+	}
+	rate := c.falsePositiveRate()
+	if rate <= cfg.TargetFalsePositiveRate {
+		return 1
+	}
+	excess := (rate - cfg.TargetFalsePositiveRate) / (1 - cfg.TargetFalsePositiveRate)
+	return 1 + excess*(cfg.MaxThresholdFactor-1)
+}
+
+// Factor возвращает множитель порога детектора для устройства; без
+// подстройки (и для nil) это 1
+func (ft *FeedbackTuner) Factor(detector, deviceID string) float64 {
+	if ft == nil {
+		return 1
+	}
+	ft.mu.RLock()
+	defer ft.mu.RUnlock()
+	return thresholdFactor(ft.cfg, ft.counts[feedbackKey{detector: detector, deviceID: deviceID}])
+}
+
+// Stats возвращает оценки по устройствам и детекторам, отфильтрованные по
+// deviceID, если он задан
+func (ft *FeedbackTuner) Stats(deviceID string) []DeviceFeedback {
+	ft.mu.RLock()
+	defer ft.mu.RUnlock()
+	stats := make([]DeviceFeedback, 0, len(ft.counts))
+	for key, c := range ft.counts {
+		if deviceID != "" && key.deviceID != deviceID {
+			continue
+		}
+		if c.TruePositive+c.FalsePositive == 0 {
+			continue
+		}
+		factor := 1.0
+		if key.detector == AnomalyTypeZScore {
+			factor = thresholdFactor(ft.cfg, c)
+		}
+		stats = append(stats, DeviceFeedback{
+			DeviceID:          key.deviceID,
+			Detector:          key.detector,
+			FeedbackCounts:    c,
+			FalsePositiveRate: c.falsePositiveRate(),
+			ThresholdFactor:   factor,
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].DeviceID != stats[j].DeviceID {
+			return stats[i].DeviceID < stats[j].DeviceID
+		}
+		return stats[i].Detector < stats[j].Detector
+	})
+	return stats
+}
+
+// AnomalyFeedbackHandler сохраняет оценку аномалии:
+// {"label": "true_positive|false_positive", "reason": "...", "user": "..."}.
+// Повторная оценка заменяет прежнюю.
+func (s *Service) AnomalyFeedbackHandler(w http.ResponseWriter, r *http.Request) {
+	var feedback AnomalyFeedback
+	if err := json.NewDecoder(r.Body).Decode(&feedback); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	switch feedback.Label {
+	case FeedbackTruePositive, FeedbackFalsePositive:
+	default:
+		http.Error(w, "label must be true_positive or false_positive", http.StatusBadRequest)
+		return
+	}
+	if feedback.User == "" {
+		http.Error(w, "user is required", http.StatusBadRequest)
+		return
+	}
+	feedback.At = time.Now().Unix()
+
+	anomaly, previous, err := s.anomalies.SetFeedback(mux.Vars(r)["id"], feedback)
+	if errors.Is(err, ErrAnomalyNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	anomalyFeedbackTotal.WithLabelValues(feedback.Label).Inc()
+	// Оценка уже сохранена в аномалии; без Redis не обновится только подстройка порога
+	if err := s.feedback.Record(r.Context(), anomaly.Type, anomaly.DeviceID, previous, feedback.Label); err != nil {
+		log.Printf("Failed to record feedback of anomaly %s for threshold tuning: %v", anomaly.ID, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(anomaly)
+}
+
+// AnomalyFeedbackStatsHandler возвращает накопленные оценки и множители
+// порога по устройствам, с фильтром device_id
+func (s *Service) AnomalyFeedbackStatsHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := s.feedback.config()
+	stats := s.feedback.Stats(r.URL.Query().Get("device_id"))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"auto_tune":                  cfg.AutoTune,
+		"min_labels":                 cfg.MinLabels,
+		"target_false_positive_rate": cfg.TargetFalsePositiveRate,
+		"count":                      len(stats),
+		"devices":                    stats,
+	})
+}
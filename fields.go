@@ -0,0 +1,410 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Типы значений поля
+const (
+	FieldTypeFloat   = "float"
+	FieldTypeInteger = "integer"
+	FieldTypeBoolean = "boolean"
+)
+
+const maxFieldUnitLen = 32
+
+var ErrFieldSpecNotFound = errors.New("field spec not found")
+
+var fieldViolations = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "highload_field_violations_total",
+		Help: "Total number of rejected metrics whose value did not match the declared field type or range by field",
+	},
+	[]string{"field"},
+)
+
+// FieldSpec объявленные единицы, тип и допустимый диапазон значений поля
+type FieldSpec struct {
+	// Unit единицы измерения: %, MB, bytes, count/s и т.п.
+	Unit string `json:"unit,omitempty"`
+	// Type float (по умолчанию), integer или boolean (0 или 1)
+	Type string   `json:"type,omitempty"`
+	Min  *float64 `json:"min,omitempty"`
+	Max  *float64 `json:"max,omitempty"`
+}
+
+// validate проверяет объявление поля
+func (fs FieldSpec) validate() error {
+	if len(fs.Unit) > maxFieldUnitLen {
+		return fmt.Errorf("unit must be at most %d characters long", maxFieldUnitLen)
+	}
+	switch fs.Type {
+	case "", FieldTypeFloat, FieldTypeInteger, FieldTypeBoolean:
+	default:
+		return fmt.Errorf("type must be one of %s, %s, %s", FieldTypeFloat, FieldTypeInteger, FieldTypeBoolean)
+	}
+	if fs.Min != nil && fs.Max != nil && *fs.Min > *fs.Max {
+		return errors.New("min must not exceed max")
+	}
+	return nil
+}
+
+// check проверяет значение поля на соответствие объявлению
+func (fs FieldSpec) check(value float64) error {
+	switch fs.Type {
+	case FieldTypeInteger:
+		if value != math.Trunc(value) {
+			return fmt.Errorf("must be an integer, got %g", value)
+		}
+	case FieldTypeBoolean:
+		if value != 0 && value != 1 {
+			return fmt.Errorf("must be 0 or 1, got %g", value)
+		}
+	}
+	if fs.Min != nil && value < *fs.Min {
+		return fmt.Errorf("%g is below declared min %g", value, *fs.Min)
+	}
+	if fs.Max != nil && value > *fs.Max {
+		return fmt.Errorf("%g is above declared max %g", value, *fs.Max)
+	}
+	return nil
+}
+
+// FieldRegistry хранит объявления полей в хэше Redis, общем для всех
+// экземпляров, и периодически перечитывает их. Поле объявляется для всех
+// устройств или для одного устройства; объявление устройства заменяет общее.
+// В хэше общее объявление лежит под именем поля, объявление устройства — под
+// field@device_id (в имени поля @ недопустим).
+type FieldRegistry struct {
+	redis redis.UniversalClient
+
+	mu      sync.RWMutex
+	cfg     FieldsConfig
+	global  map[string]FieldSpec
+	devices map[string]map[string]FieldSpec
+}
+
+func NewFieldRegistry(rdb redis.UniversalClient, cfg FieldsConfig) *FieldRegistry {
+	return &FieldRegistry{
+		redis:   rdb,
+		cfg:     cfg,
+		global:  make(map[string]FieldSpec),
+		devices: make(map[string]map[string]FieldSpec),
+	}
+}
+
+// Configure применяет новые параметры; ключ Redis действует со следующего чтения
+func (fr *FieldRegistry) Configure(cfg FieldsConfig) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	fr.cfg = cfg
+}
+
+func (fr *FieldRegistry) config() FieldsConfig {
+	fr.mu.RLock()
+	defer fr.mu.RUnlock()
+	return fr.cfg
+}
+
+func fieldSpecKey(deviceID, field string) string {
+	if deviceID == "" {
+		return field
+	}
+	return field + "@" + deviceID
+}
+
+// Run перечитывает объявления полей из Redis каждые fields.interval
+func (fr *FieldRegistry) Run(ctx context.Context) {
+	for {
+		cfg := fr.config()
+		if err := fr.refresh(ctx); err != nil {
+			log.Printf("Failed to load field specs, keeping previous: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(cfg.Interval):
+		}
+	}
+}
+
+func (fr *FieldRegistry) refresh(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	raw, err := fr.redis.HGetAll(ctx, fr.config().Key).Result()
+	if err != nil {
+		return err
+	}
+
+	global := make(map[string]FieldSpec)
+	devices := make(map[string]map[string]FieldSpec)
+	for key, data := range raw {
+		var spec FieldSpec
+		if err := json.Unmarshal([]byte(data), &spec); err != nil {
+			log.Printf("Skipping malformed spec of field %s: %v", key, err)
+			continue
+		}
+		field, deviceID, scoped := strings.Cut(key, "@")
+		if !scoped {
+			global[field] = spec
+			continue
+		}
+		if devices[deviceID] == nil {
+			devices[deviceID] = make(map[string]FieldSpec)
+		}
+		devices[deviceID][field] = spec
+	}
+
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	fr.global, fr.devices = global, devices
+	return nil
+}
+
+// Set объявляет поле для всех устройств (пустой deviceID) или для одного
+func (fr *FieldRegistry) Set(ctx context.Context, deviceID, field string, spec FieldSpec) error {
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return err
+	}
+	if err := fr.redis.HSet(ctx, fr.config().Key, fieldSpecKey(deviceID, field), data).Err(); err != nil {
+		return err
+	}
+
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	if deviceID == "" {
+		fr.global[field] = spec
+		return nil
+	}
+	if fr.devices[deviceID] == nil {
+		fr.devices[deviceID] = make(map[string]FieldSpec)
+	}
+	fr.devices[deviceID][field] = spec
+	return nil
+}
+
+// Delete удаляет объявление поля
+func (fr *FieldRegistry) Delete(ctx context.Context, deviceID, field string) error {
+	removed, err := fr.redis.HDel(ctx, fr.config().Key, fieldSpecKey(deviceID, field)).Result()
+	if err != nil {
+		return err
+	}
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	specs := fr.global
+	if deviceID != "" {
+		specs = fr.devices[deviceID]
+	}
+	if _, exists := specs[field]; !exists && removed == 0 {
+		return ErrFieldSpecNotFound
+	}
+	delete(specs, field)
+	return nil
+}
+
+// Lookup возвращает объявление поля для устройства: собственное или общее
+func (fr *FieldRegistry) Lookup(deviceID, field string) (FieldSpec, bool) {
+	fr.mu.RLock()
+	defer fr.mu.RUnlock()
+	if spec, ok := fr.devices[deviceID][field]; ok {
+		return spec, true
+	}
+	spec, ok := fr.global[field]
+	return spec, ok
+}
+
+// Declared сообщает, объявлено ли поле для всего парка
+func (fr *FieldRegistry) Declared(field string) bool {
+	fr.mu.RLock()
+	defer fr.mu.RUnlock()
+	_, ok := fr.global[field]
+	return ok
+}
+
+// Unit возвращает единицы поля для устройства; пустые, если не объявлены
+func (fr *FieldRegistry) Unit(deviceID, field string) string {
+	spec, _ := fr.Lookup(deviceID, field)
+	return spec.Unit
+}
+
+// Units возвращает единицы перечисленных полей, для которых они объявлены
+func (fr *FieldRegistry) Units(deviceID string, fields map[string]float64) map[string]string {
+	units := make(map[string]string)
+	for field := range fields {
+		if unit := fr.Unit(deviceID, field); unit != "" {
+			units[field] = unit
+		}
+	}
+	return units
+}
+
+// Check проверяет значения метрики, включая все samples, на соответствие
+// объявлениям полей; необъявленные поля не проверяются
+func (fr *FieldRegistry) Check(metric Metric) error {
+	check := func(values map[string]float64) error {
+		fields := make([]string, 0, len(values))
+		for field := range values {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		for _, field := range fields {
+			spec, ok := fr.Lookup(metric.DeviceID, field)
+			if !ok {
+				continue
+			}
+			if err := spec.check(values[field]); err != nil {
+				fieldViolations.WithLabelValues(field).Inc()
+				return fmt.Errorf("field %s: %v", field, err)
+			}
+		}
+		return nil
+	}
+
+	if err := check(metric.Values); err != nil {
+		return err
+	}
+	for i, sample := range metric.Samples {
+		if err := check(sample.Values); err != nil {
+			return fmt.Errorf("samples[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// List возвращает общие объявления и объявления устройств; при непустом
+// deviceID — только действующие для этого устройства
+func (fr *FieldRegistry) List(deviceID string) (map[string]FieldSpec, map[string]map[string]FieldSpec) {
+	fr.mu.RLock()
+	defer fr.mu.RUnlock()
+	if deviceID != "" {
+		effective := make(map[string]FieldSpec, len(fr.global))
+		for field, spec := range fr.global {
+			effective[field] = spec
+		}
+		for field, spec := range fr.devices[deviceID] {
+			effective[field] = spec
+		}
+		return effective, nil
+	}
+
+	global := make(map[string]FieldSpec, len(fr.global))
+	for field, spec := range fr.global {
+		global[field] = spec
+	}
+	devices := make(map[string]map[string]FieldSpec, len(fr.devices))
+	for id, specs := range fr.devices {
+		devices[id] = make(map[string]FieldSpec, len(specs))
+		for field, spec := range specs {
+			devices[id][field] = spec
+		}
+	}
+	return global, devices
+}
+
+// FieldsHandler перечисляет объявления полей: GET /api/fields — общие и
+// объявления устройств, GET /api/fields?device_id=... — действующие для устройства
+func (s *Service) FieldsHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.URL.Query().Get("device_id")
+	global, devices := s.fields.List(deviceID)
+	response := map[string]interface{}{"fields": global}
+	if deviceID != "" {
+		response["device_id"] = deviceID
+	} else {
+		response["devices"] = devices
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// setFieldSpec разбирает объявление из тела запроса и сохраняет его
+func (s *Service) setFieldSpec(w http.ResponseWriter, r *http.Request, deviceID, field string) {
+	if !validFieldName(field) {
+		http.Error(w, "invalid field name", http.StatusBadRequest)
+		return
+	}
+	var spec FieldSpec
+	if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if err := spec.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.fields.Set(r.Context(), deviceID, field, spec); err != nil {
+		log.Printf("Failed to store spec of field %s: %v", fieldSpecKey(deviceID, field), err)
+		http.Error(w, "field registry storage unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	response := map[string]interface{}{"field": field, "spec": spec}
+	if deviceID != "" {
+		response["device_id"] = deviceID
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *Service) deleteFieldSpec(w http.ResponseWriter, r *http.Request, deviceID, field string) {
+	err := s.fields.Delete(r.Context(), deviceID, field)
+	if errors.Is(err, ErrFieldSpecNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to delete spec of field %s: %v", fieldSpecKey(deviceID, field), err)
+		http.Error(w, "field registry storage unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AdminSetFieldHandler объявляет поле для всех устройств:
+// {"unit": "%", "type": "float", "min": 0, "max": 100}
+func (s *Service) AdminSetFieldHandler(w http.ResponseWriter, r *http.Request) {
+	s.setFieldSpec(w, r, "", mux.Vars(r)["field"])
+}
+
+// AdminDeleteFieldHandler удаляет общее объявление поля
+func (s *Service) AdminDeleteFieldHandler(w http.ResponseWriter, r *http.Request) {
+	s.deleteFieldSpec(w, r, "", mux.Vars(r)["field"])
+}
+
+// DeviceFieldHandler объявляет поле самим устройством; объявление заменяет
+// общее только для этого устройства. Токен устройства проверяется как при
+// приеме метрик.
+func (s *Service) DeviceFieldHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if err := s.deviceTokens.Verify(SourceTypeHTTP, vars["device_id"], r.Header.Get(deviceTokenHeader)); err != nil {
+		writeDeviceTokenError(w, err)
+		return
+	}
+	s.setFieldSpec(w, r, vars["device_id"], vars["field"])
+}
+
+// DeleteDeviceFieldHandler удаляет объявление поля устройства
+func (s *Service) DeleteDeviceFieldHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if err := s.deviceTokens.Verify(SourceTypeHTTP, vars["device_id"], r.Header.Get(deviceTokenHeader)); err != nil {
+		writeDeviceTokenError(w, err)
+		return
+	}
+	s.deleteFieldSpec(w, r, vars["device_id"], vars["field"])
+}
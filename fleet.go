@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	fleetShardCount   = 16
+	fleetCompression  = 100
+	fleetSketchPeriod = time.Minute
+)
+
+// fleetShard хранит скетчи для подмножества устройств. Скетчи ротируются
+// каждый период, поэтому запрос видит значения за последние один-два периода.
+type fleetShard struct {
+	mu        sync.Mutex
+	current   map[string]*TDigest // field -> скетч текущего периода
+	previous  map[string]*TDigest
+	lastSeen  map[string]time.Time // device_id -> время последнего значения
+	rotatedAt time.Time
+}
+
+// FleetSketch поддерживает квантили значений по всему парку устройств
+type FleetSketch struct {
+	shards [fleetShardCount]*fleetShard
+	period time.Duration
+}
+
+// FleetPercentiles результат запроса квантилей по парку
+type FleetPercentiles struct {
+	Field         string  `json:"field"`
+	Devices       int     `json:"devices"`
+	Samples       int64   `json:"samples"`
+	WindowSeconds int64   `json:"window_seconds"`
+	P50           float64 `json:"p50"`
+	P90           float64 `json:"p90"`
+	P99           float64 `json:"p99"`
+}
+
+func NewFleetSketch(period time.Duration) *FleetSketch {
+	fs := &FleetSketch{period: period}
+	now := time.Now()
+	for i := range fs.shards {
+		fs.shards[i] = &fleetShard{
+			current:   make(map[string]*TDigest),
+			previous:  make(map[string]*TDigest),
+			lastSeen:  make(map[string]time.Time),
+			rotatedAt: now,
+		}
+	}
+	return fs
+}
+
+func (fs *FleetSketch) shard(deviceID string) *fleetShard {
+	h := fnv.New32a()
+	h.Write([]byte(deviceID))
+	return fs.shards[h.Sum32()%fleetShardCount]
+}
+
+// rotate переключает период скетчей шарда; вызывается под блокировкой шарда
+func (sh *fleetShard) rotate(now time.Time, period time.Duration) {
+	if now.Sub(sh.rotatedAt) < period {
+		return
+	}
+	if now.Sub(sh.rotatedAt) >= 2*period {
+		// Шард простаивал больше двух периодов — старые данные неактуальны
+		sh.previous = make(map[string]*TDigest)
+	} else {
+		sh.previous = sh.current
+	}
+	sh.current = make(map[string]*TDigest)
+	sh.rotatedAt = now
+
+	for deviceID, seen := range sh.lastSeen {
+		if now.Sub(seen) >= 2*period {
+			delete(sh.lastSeen, deviceID)
+		}
+	}
+}
+
+// Add учитывает значение поля устройства в скетче его шарда
+func (fs *FleetSketch) Add(deviceID, field string, value float64) {
+	sh := fs.shard(deviceID)
+	now := time.Now()
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	sh.rotate(now, fs.period)
+	digest, exists := sh.current[field]
+	if !exists {
+		digest = NewTDigest(fleetCompression)
+		sh.current[field] = digest
+	}
+	digest.Add(value)
+	sh.lastSeen[deviceID] = now
+}
+
+// Percentiles объединяет скетчи всех шардов и вычисляет квантили поля
+func (fs *FleetSketch) Percentiles(field string) FleetPercentiles {
+	merged := NewTDigest(fleetCompression)
+	devices := 0
+	now := time.Now()
+
+	for _, sh := range fs.shards {
+		sh.mu.Lock()
+		sh.rotate(now, fs.period)
+		if digest, ok := sh.previous[field]; ok {
+			merged.Merge(digest)
+		}
+		if digest, ok := sh.current[field]; ok {
+			merged.Merge(digest)
+		}
+		devices += len(sh.lastSeen)
+		sh.mu.Unlock()
+	}
+
+	result := FleetPercentiles{
+		Field:         field,
+		Devices:       devices,
+		Samples:       int64(merged.Count()),
+		WindowSeconds: int64(2 * fs.period / time.Second),
+	}
+	if merged.Count() > 0 {
+		result.P50 = merged.Quantile(0.50)
+		result.P90 = merged.Quantile(0.90)
+		result.P99 = merged.Quantile(0.99)
+	}
+	return result
+}
+
+// FleetPercentilesHandler возвращает p50/p90/p99 поля по всем устройствам
+func (s *Service) FleetPercentilesHandler(w http.ResponseWriter, r *http.Request) {
+	field := r.URL.Query().Get("field")
+	if field == "" {
+		field = "cpu"
+	}
+	if !validFieldName(field) {
+		http.Error(w, "invalid field name", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.fleet.Percentiles(field))
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	forensicKeyPrefix     = "forensics:"
+	forensicSweepInterval = 15 * time.Second
+)
+
+var forensicSnapshots = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "highload_forensic_snapshots_total",
+		Help: "Total number of forensic snapshots by outcome (complete, partial, persist_error)",
+	},
+	[]string{"outcome"},
+)
+
+// ForensicSnapshot сырые значения всех полей устройства вокруг момента аномалии.
+// Before включает значение, на котором сработал детектор.
+type ForensicSnapshot struct {
+	AnomalyID  string             `json:"anomaly_id"`
+	DeviceID   string             `json:"device_id"`
+	Field      string             `json:"field"`
+	Timestamp  int64              `json:"timestamp"`
+	CapturedAt int64              `json:"captured_at"`
+	Complete   bool               `json:"complete"`
+	Before     map[string][]Point `json:"before"`
+	After      map[string][]Point `json:"after"`
+
+	afterCount int
+	deadline   time.Time
+}
+
+// ForensicStore снимает окно ±N значений вокруг аномалий и хранит его в Redis
+// с длительным сроком хранения, так как кэш метрик живет всего 10 минут.
+// Последние снимки дополнительно держатся в памяти на случай недоступности Redis.
+type ForensicStore struct {
+	mu        sync.Mutex
+	redis     redis.UniversalClient
+	enabled   bool
+	pending   map[string][]*ForensicSnapshot // device_id -> снимки, ждущие значений после аномалии
+	recent    map[string]*ForensicSnapshot
+	order     []string
+	samples   int
+	retention time.Duration
+	timeout   time.Duration
+	maxRecent int
+}
+
+func NewForensicStore(rdb redis.UniversalClient, cfg ForensicsConfig) *ForensicStore {
+	fs := &ForensicStore{
+		redis:   rdb,
+		pending: make(map[string][]*ForensicSnapshot),
+		recent:  make(map[string]*ForensicSnapshot),
+	}
+	fs.Configure(cfg)
+	return fs
+}
+
+// Configure применяет новые настройки; уже начатые снимки дособираются
+// со старым дедлайном
+func (fs *ForensicStore) Configure(cfg ForensicsConfig) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.enabled = cfg.Enabled
+	fs.samples = cfg.Samples
+	fs.retention = cfg.Retention
+	fs.timeout = cfg.CaptureTimeout
+	fs.maxRecent = cfg.MemoryLimit
+	fs.trimRecent()
+}
+
+func (fs *ForensicStore) trimRecent() {
+	for len(fs.order) > fs.maxRecent {
+		delete(fs.recent, fs.order[0])
+		fs.order = fs.order[1:]
+	}
+}
+
+// Capture начинает снимок для аномалии: значения до нее берутся из буфера сразу,
+// значения после — по мере поступления через Observe
+func (fs *ForensicStore) Capture(anomaly AnalyticsResult, buffer *MetricsBuffer) {
+	fs.mu.Lock()
+	enabled, samples, timeout := fs.enabled, fs.samples, fs.timeout
+	fs.mu.Unlock()
+	if !enabled {
+		return
+	}
+
+	snapshot := &ForensicSnapshot{
+		AnomalyID:  anomaly.ID,
+		DeviceID:   anomaly.DeviceID,
+		Field:      anomaly.Field,
+		Timestamp:  anomaly.Timestamp,
+		CapturedAt: time.Now().Unix(),
+		Before:     make(map[string][]Point),
+		After:      make(map[string][]Point),
+		deadline:   time.Now().Add(timeout),
+	}
+
+	// Значения после аномалии могли попасть в буфер раньше, чем закончился анализ
+	for field, points := range buffer.DeviceSnapshot(anomaly.DeviceID) {
+		split := len(points)
+		for split > 0 && points[split-1].Timestamp > anomaly.Timestamp {
+			split--
+		}
+		before := points[:split]
+		if len(before) > samples+1 {
+			before = before[len(before)-samples-1:]
+		}
+		after := points[split:]
+		if len(after) > samples {
+			after = after[:samples]
+		}
+		snapshot.Before[field] = before
+		snapshot.After[field] = after
+		if len(after) > snapshot.afterCount {
+			snapshot.afterCount = len(after)
+		}
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if snapshot.afterCount >= samples {
+		fs.finalize(snapshot, true)
+		return
+	}
+	fs.pending[anomaly.DeviceID] = append(fs.pending[anomaly.DeviceID], snapshot)
+}
+
+// Observe дополняет ожидающие снимки устройства новым значением
+func (fs *ForensicStore) Observe(metric Metric) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	snapshots := fs.pending[metric.DeviceID]
+	if !fs.enabled || len(snapshots) == 0 {
+		return
+	}
+
+	waiting := snapshots[:0]
+	for _, snapshot := range snapshots {
+		if metric.Timestamp > snapshot.Timestamp {
+			for field, value := range metric.Values {
+				snapshot.After[field] = append(snapshot.After[field], Point{Timestamp: metric.Timestamp, Value: value})
+			}
+			snapshot.afterCount++
+		}
+		if snapshot.afterCount >= fs.samples {
+			fs.finalize(snapshot, true)
+			continue
+		}
+		waiting = append(waiting, snapshot)
+	}
+	fs.setPending(metric.DeviceID, waiting)
+}
+
+func (fs *ForensicStore) setPending(deviceID string, snapshots []*ForensicSnapshot) {
+	if len(snapshots) == 0 {
+		delete(fs.pending, deviceID)
+		return
+	}
+	fs.pending[deviceID] = snapshots
+}
+
+// Run завершает снимки устройств, переставших присылать данные
+func (fs *ForensicStore) Run() {
+	ticker := time.NewTicker(forensicSweepInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		fs.mu.Lock()
+		for deviceID, snapshots := range fs.pending {
+			waiting := snapshots[:0]
+			for _, snapshot := range snapshots {
+				if now.After(snapshot.deadline) {
+					fs.finalize(snapshot, false)
+					continue
+				}
+				waiting = append(waiting, snapshot)
+			}
+			fs.setPending(deviceID, waiting)
+		}
+		fs.mu.Unlock()
+	}
+}
+
+// finalize сохраняет снимок; вызывается под блокировкой
+func (fs *ForensicStore) finalize(snapshot *ForensicSnapshot, complete bool) {
+	snapshot.Complete = complete
+	if complete {
+		forensicSnapshots.WithLabelValues("complete").Inc()
+	} else {
+		forensicSnapshots.WithLabelValues("partial").Inc()
+	}
+
+	fs.recent[snapshot.AnomalyID] = snapshot
+	fs.order = append(fs.order, snapshot.AnomalyID)
+	fs.trimRecent()
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return
+	}
+	retention := fs.retention
+	goSafe("forensics", func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := fs.redis.Set(ctx, forensicKeyPrefix+snapshot.AnomalyID, data, retention).Err(); err != nil {
+			forensicSnapshots.WithLabelValues("persist_error").Inc()
+			log.Printf("Failed to persist forensic snapshot %s: %v", snapshot.AnomalyID, err)
+		}
+	})
+}
+
+// Get возвращает снимок аномалии из памяти или из Redis; ожидающий снимок
+// возвращается в текущем (неполном) виде
+func (fs *ForensicStore) Get(ctx context.Context, anomalyID string) (*ForensicSnapshot, bool) {
+	fs.mu.Lock()
+	if snapshot, ok := fs.recent[anomalyID]; ok {
+		fs.mu.Unlock()
+		return snapshot, true
+	}
+	for _, snapshots := range fs.pending {
+		for _, snapshot := range snapshots {
+			if snapshot.AnomalyID == anomalyID {
+				copied := *snapshot
+				copied.After = make(map[string][]Point, len(snapshot.After))
+				for field, points := range snapshot.After {
+					copied.After[field] = append([]Point(nil), points...)
+				}
+				fs.mu.Unlock()
+				return &copied, true
+			}
+		}
+	}
+	fs.mu.Unlock()
+
+	data, err := fs.redis.Get(ctx, forensicKeyPrefix+anomalyID).Bytes()
+	if err != nil {
+		return nil, false
+	}
+	var snapshot ForensicSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, false
+	}
+	return &snapshot, true
+}
+
+// ForensicsHandler возвращает сырые значения вокруг аномалии
+func (s *Service) ForensicsHandler(w http.ResponseWriter, r *http.Request) {
+	snapshot, ok := s.forensics.Get(r.Context(), mux.Vars(r)["id"])
+	if !ok {
+		http.Error(w, "forensic snapshot not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshot)
+}
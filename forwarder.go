@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	highloadpb "github.com/seel2/highload-service/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Протоколы и данные пересылки
+const (
+	ForwardProtocolHTTP = "http"
+	ForwardProtocolGRPC = "grpc"
+
+	ForwardDataMetrics   = "metrics"
+	ForwardDataAnomalies = "anomalies"
+	ForwardDataAll       = "all"
+)
+
+// Значения по умолчанию для незаданных параметров получателя
+const (
+	defaultForwardBatchSize     = 500
+	defaultForwardFlushInterval = time.Second
+	defaultForwardQueueSize     = 10000
+	defaultForwardMaxRetries    = 3
+	defaultForwardRetryBackoff  = 500 * time.Millisecond
+	defaultForwardTimeout       = 5 * time.Second
+	// maxForwardRetryBackoff предел паузы между повторами
+	maxForwardRetryBackoff = 30 * time.Second
+)
+
+var (
+	forwardedItems = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "highload_forwarded_items_total",
+			Help: "Total number of metrics and anomalies relayed to downstream forwarders by kind (metric, anomaly) and result (sent, failed, dropped)",
+		},
+		[]string{"forwarder", "kind", "result"},
+	)
+
+	forwardRetries = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "highload_forward_retries_total",
+			Help: "Total number of repeated batch deliveries to downstream forwarders",
+		},
+		[]string{"forwarder"},
+	)
+
+	forwardDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "highload_forward_duration_seconds",
+			Help:    "Time to deliver one batch to a downstream forwarder, including retries",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"forwarder"},
+	)
+
+	forwardQueueLength = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "highload_forward_queue_length",
+			Help: "Number of items waiting to be relayed to a downstream forwarder",
+		},
+		[]string{"forwarder"},
+	)
+)
+
+// withDefaults подставляет значения по умолчанию вместо нулевых
+func (c ForwarderConfig) withDefaults() ForwarderConfig {
+	if c.Data == "" {
+		c.Data = ForwardDataMetrics
+	}
+	if c.BatchSize == 0 {
+		c.BatchSize = defaultForwardBatchSize
+	}
+	if c.FlushInterval == 0 {
+		c.FlushInterval = defaultForwardFlushInterval
+	}
+	if c.QueueSize == 0 {
+		c.QueueSize = defaultForwardQueueSize
+	}
+	if c.MaxRetries == 0 {
+		c.MaxRetries = defaultForwardMaxRetries
+	}
+	if c.RetryBackoff == 0 {
+		c.RetryBackoff = defaultForwardRetryBackoff
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defaultForwardTimeout
+	}
+	return c
+}
+
+// forwardBatch пакет пересылки; в HTTP уходит как JSON, в gRPC — как
+// ForwardRequest
+type forwardBatch struct {
+	Source    string            `json:"source"`
+	Metrics   []Metric          `json:"metrics,omitempty"`
+	Anomalies []AnalyticsResult `json:"anomalies,omitempty"`
+}
+
+func (b forwardBatch) size() int {
+	return len(b.Metrics) + len(b.Anomalies)
+}
+
+// proto сообщение ForwardRequest пакета
+func (b forwardBatch) proto() *highloadpb.ForwardRequest {
+	req := &highloadpb.ForwardRequest{
+		Source:    b.Source,
+		Metrics:   make([]*highloadpb.ForwardedMetric, len(b.Metrics)),
+		Anomalies: make([]*highloadpb.Anomaly, len(b.Anomalies)),
+	}
+	for i, metric := range b.Metrics {
+		req.Metrics[i] = &highloadpb.ForwardedMetric{Tenant: metric.Tenant, Metric: metricProto(metric)}
+	}
+	for i, anomaly := range b.Anomalies {
+		req.Anomalies[i] = anomalyProto(anomaly)
+	}
+	return req
+}
+
+// metricProto сообщение Metric из proto/metric.proto
+func metricProto(m Metric) *highloadpb.Metric {
+	msg := &highloadpb.Metric{
+		Timestamp:     m.Timestamp,
+		DeviceId:      m.DeviceID,
+		Values:        m.Values,
+		DeadlineClass: m.DeadlineClass,
+	}
+	for _, sample := range m.Samples {
+		msg.Samples = append(msg.Samples, &highloadpb.Sample{Timestamp: sample.Timestamp, Values: sample.Values})
+	}
+	return msg
+}
+
+// forwardItem элемент очереди: метрика или аномалия
+type forwardItem struct {
+	metric  *Metric
+	anomaly *AnalyticsResult
+}
+
+// forwarder доставляет пакеты одному получателю. Очередь не блокирует
+// прием: при переполнении элементы отбрасываются.
+type forwarder struct {
+	cfg    ForwarderConfig
+	source string
+	queue  chan forwardItem
+	client *http.Client
+	conn   *grpc.ClientConn
+	// grpc клиент highload.v1.Forwarder поверх conn (proto/forward.proto)
+	grpc   highloadpb.ForwarderClient
+	cancel context.CancelFunc
+}
+
+func newForwarder(cfg ForwarderConfig, source string) (*forwarder, error) {
+	f := &forwarder{
+		cfg:    cfg,
+		source: source,
+		queue:  make(chan forwardItem, cfg.QueueSize),
+	}
+	switch cfg.Protocol {
+	case ForwardProtocolGRPC:
+		creds := insecure.NewCredentials()
+		if cfg.TLS {
+			creds = credentials.NewTLS(nil)
+		}
+		conn, err := grpc.NewClient(cfg.Addr, grpc.WithTransportCredentials(creds))
+		if err != nil {
+			return nil, err
+		}
+		f.conn = conn
+		f.grpc = highloadpb.NewForwarderClient(conn)
+	default:
+		f.client = &http.Client{Timeout: cfg.Timeout}
+	}
+	return f, nil
+}
+
+func (f *forwarder) accepts(kind string) bool {
+	return f.cfg.Data == ForwardDataAll || f.cfg.Data == kind
+}
+
+func (f *forwarder) enqueue(item forwardItem, kind string) {
+	select {
+	case f.queue <- item:
+	default:
+		forwardedItems.WithLabelValues(f.cfg.Name, kind, "dropped").Inc()
+	}
+}
+
+// run отправляет пакеты по размеру или интервалу до отмены ctx; после отмены
+// остаток очереди отправляется одной попыткой
+func (f *forwarder) run(ctx context.Context) {
+	ticker := time.NewTicker(f.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	batch := forwardBatch{Source: f.source}
+	for {
+		select {
+		case item := <-f.queue:
+			batch.add(item)
+			if batch.size() < f.cfg.BatchSize {
+				continue
+			}
+		case <-ticker.C:
+			forwardQueueLength.WithLabelValues(f.cfg.Name).Set(float64(len(f.queue)))
+			if batch.size() == 0 {
+				continue
+			}
+		case <-ctx.Done():
+			f.drain(batch)
+			if f.conn != nil {
+				f.conn.Close()
+			}
+			return
+		}
+		f.deliver(ctx, batch)
+		batch = forwardBatch{Source: f.source}
+	}
+}
+
+func (b *forwardBatch) add(item forwardItem) {
+	if item.metric != nil {
+		b.Metrics = append(b.Metrics, *item.metric)
+	} else {
+		b.Anomalies = append(b.Anomalies, *item.anomaly)
+	}
+}
+
+// drain отправляет текущий пакет и остаток очереди без повторов
+func (f *forwarder) drain(batch forwardBatch) {
+	for {
+		select {
+		case item := <-f.queue:
+			batch.add(item)
+			if batch.size() < f.cfg.BatchSize {
+				continue
+			}
+		default:
+			if batch.size() > 0 {
+				f.record(batch, f.send(context.Background(), batch))
+			}
+			return
+		}
+		f.record(batch, f.send(context.Background(), batch))
+		batch = forwardBatch{Source: f.source}
+	}
+}
+
+// deliver отправляет пакет, повторяя временные ошибки с удвоением паузы
+func (f *forwarder) deliver(ctx context.Context, batch forwardBatch) {
+	start := time.Now()
+	backoff := f.cfg.RetryBackoff
+	err := f.send(ctx, batch)
+retry:
+	for attempt := 0; err != nil && retryableForward(err) && attempt < f.cfg.MaxRetries; attempt++ {
+		select {
+		case <-ctx.Done():
+			break retry
+		case <-time.After(backoff):
+		}
+		forwardRetries.WithLabelValues(f.cfg.Name).Inc()
+		backoff = min(backoff*2, maxForwardRetryBackoff)
+		err = f.send(ctx, batch)
+	}
+	forwardDuration.WithLabelValues(f.cfg.Name).Observe(time.Since(start).Seconds())
+	f.record(batch, err)
+}
+
+func (f *forwarder) record(batch forwardBatch, err error) {
+	result := "sent"
+	if err != nil {
+		result = "failed"
+		log.Printf("Failed to forward %d metrics and %d anomalies to %s: %v",
+			len(batch.Metrics), len(batch.Anomalies), f.cfg.Name, err)
+	}
+	forwardedItems.WithLabelValues(f.cfg.Name, "metric", result).Add(float64(len(batch.Metrics)))
+	forwardedItems.WithLabelValues(f.cfg.Name, "anomaly", result).Add(float64(len(batch.Anomalies)))
+}
+
+// send выполняет одну попытку доставки
+func (f *forwarder) send(ctx context.Context, batch forwardBatch) error {
+	ctx, cancel := context.WithTimeout(ctx, f.cfg.Timeout)
+	defer cancel()
+	if f.conn != nil {
+		if f.cfg.AuthToken != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+f.cfg.AuthToken)
+		}
+		_, err := f.grpc.Forward(ctx, batch.proto())
+		return err
+	}
+
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, f.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if f.cfg.AuthToken != "" {
+		req.Header.Set("Authorization", "Bearer "+f.cfg.AuthToken)
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return forwardStatusError(resp.StatusCode)
+	}
+	return nil
+}
+
+// forwardStatusError неуспешный HTTP-статус получателя
+type forwardStatusError int
+
+func (e forwardStatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d", int(e))
+}
+
+// retryableForward сообщает, имеет ли смысл повторить пакет: ошибки сети,
+// 429 и 5xx повторяются, отказы получателя в самом пакете — нет
+func retryableForward(err error) bool {
+	if code, ok := err.(forwardStatusError); ok {
+		return code == http.StatusTooManyRequests || code >= 500
+	}
+	if s, ok := status.FromError(err); ok {
+		switch s.Code() {
+		case codes.InvalidArgument, codes.Unauthenticated, codes.PermissionDenied, codes.Unimplemented:
+			return false
+		}
+	}
+	return true
+}
+
+// Forwarding пересылает копию принятых метрик и найденных аномалий
+// получателям из секции forwarders (например, в тестовый анализатор или
+// загрузчик хранилища данных). Каждый получатель — своя очередь и горутина,
+// медленный получатель теряет данные, но не задерживает прием и других.
+type Forwarding struct {
+	ctx    context.Context
+	source string
+
+	mu         sync.RWMutex
+	forwarders []*forwarder
+}
+
+func NewForwarding(ctx context.Context, cfgs []ForwarderConfig) *Forwarding {
+	source, _ := os.Hostname()
+	fw := &Forwarding{ctx: ctx, source: source}
+	fw.Configure(cfgs)
+	return fw
+}
+
+// Configure запускает новых и измененных получателей и останавливает
+// удаленных; неизмененные продолжают работу со своей очередью
+func (fw *Forwarding) Configure(cfgs []ForwarderConfig) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	current := make(map[string]*forwarder, len(fw.forwarders))
+	for _, f := range fw.forwarders {
+		current[f.cfg.Name] = f
+	}
+	forwarders := make([]*forwarder, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		cfg = cfg.withDefaults()
+		if f, ok := current[cfg.Name]; ok && reflect.DeepEqual(f.cfg, cfg) {
+			forwarders = append(forwarders, f)
+			delete(current, cfg.Name)
+			continue
+		}
+		f, err := newForwarder(cfg, fw.source)
+		if err != nil {
+			log.Printf("Forwarder %s disabled: %v", cfg.Name, err)
+			continue
+		}
+		ctx, cancel := context.WithCancel(fw.ctx)
+		f.cancel = cancel
+		goSupervised("forwarder "+cfg.Name, func() { f.run(ctx) })
+		forwarders = append(forwarders, f)
+	}
+	for _, f := range current {
+		f.cancel()
+	}
+	fw.forwarders = forwarders
+}
+
+// Metric ставит принятую метрику в очереди получателей метрик
+func (fw *Forwarding) Metric(metric Metric) {
+	fw.mu.RLock()
+	defer fw.mu.RUnlock()
+	for _, f := range fw.forwarders {
+		if f.accepts(ForwardDataMetrics) {
+			f.enqueue(forwardItem{metric: &metric}, "metric")
+		}
+	}
+}
+
+// Anomaly ставит найденную аномалию в очереди получателей аномалий
+func (fw *Forwarding) Anomaly(result AnalyticsResult) {
+	fw.mu.RLock()
+	defer fw.mu.RUnlock()
+	for _, f := range fw.forwarders {
+		if f.accepts(ForwardDataAnomalies) {
+			f.enqueue(forwardItem{anomaly: &result}, "anomaly")
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	highloadpb "github.com/seel2/highload-service/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	grpcRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "highload_grpc_requests_total",
+			Help: "Total number of gRPC calls by method and status code",
+		},
+		[]string{"method", "code"},
+	)
+
+	grpcWatchers = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "highload_grpc_watchers",
+		Help: "Number of open WatchAnomalies streams",
+	})
+)
+
+// gRPC API результатов анализа (proto/analytics.proto) для сервисов, которым
+// не подходит опрос HTTP. Сообщения и описание сервиса сгенерированы в пакете
+// highloadpb (make proto).
+
+// grpcAnalytics реализация API поверх компонентов сервиса
+type grpcAnalytics struct {
+	highloadpb.UnimplementedAnalyticsServer
+	service *Service
+}
+
+func (g *grpcAnalytics) GetRollingStats(ctx context.Context, req *highloadpb.RollingStatsRequest) (*highloadpb.RollingStatsResponse, error) {
+	if req.DeviceId == "" {
+		return nil, status.Error(codes.InvalidArgument, "device_id is required")
+	}
+	fields, ok := g.service.metricsBuffer.DeviceStats(req.DeviceId)
+	if !ok {
+		return nil, status.Error(codes.NotFound, "device not found")
+	}
+	if req.Field != "" {
+		stats, ok := fields[req.Field]
+		if !ok {
+			return nil, status.Error(codes.NotFound, "field not found")
+		}
+		fields = map[string]FieldStats{req.Field: stats}
+	}
+	window, _ := g.service.metricsBuffer.Limits()
+
+	resp := &highloadpb.RollingStatsResponse{DeviceId: req.DeviceId, WindowSize: int64(window)}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		stats := fields[name]
+		resp.Fields = append(resp.Fields, &highloadpb.FieldStats{
+			Field:          name,
+			Samples:        int64(stats.Samples),
+			RollingAverage: stats.RollingAverage,
+			StdDev:         stats.StdDev,
+			LastTimestamp:  stats.LastTimestamp,
+			LastValue:      stats.LastValue,
+		})
+	}
+	return resp, nil
+}
+
+func (g *grpcAnalytics) QueryAnomalies(ctx context.Context, req *highloadpb.QueryAnomaliesRequest) (*highloadpb.QueryAnomaliesResponse, error) {
+	filter := AnomalyFilter{DeviceID: req.DeviceId, Field: req.Field, Status: req.Status, From: req.From, To: req.To}
+	switch filter.Status {
+	case "", AnomalyStatusOpen, AnomalyStatusAcknowledged, AnomalyStatusResolved:
+	default:
+		return nil, status.Error(codes.InvalidArgument, "status must be open, acknowledged or resolved")
+	}
+	limit := int(req.Limit)
+	if limit == 0 {
+		limit = defaultHistoryLimit
+	}
+	if limit < 1 || limit > maxHistoryLimit {
+		return nil, status.Error(codes.InvalidArgument, "limit must be between 1 and 1000")
+	}
+	items, total := g.service.anomalyHistory(filter, limit)
+	resp := &highloadpb.QueryAnomaliesResponse{Total: int64(total), Anomalies: make([]*highloadpb.Anomaly, len(items))}
+	for i, item := range items {
+		resp.Anomalies[i] = anomalyProto(item)
+	}
+	return resp, nil
+}
+
+// WatchAnomalies передает аномалии по мере обнаружения. Как и в SSE-ленте,
+// медленный клиент теряет аномалии, но не задерживает анализ.
+func (g *grpcAnalytics) WatchAnomalies(req *highloadpb.WatchAnomaliesRequest, stream highloadpb.Analytics_WatchAnomaliesServer) error {
+	feed, unsubscribe := g.service.feed.Subscribe()
+	defer unsubscribe()
+	grpcWatchers.Inc()
+	defer grpcWatchers.Dec()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case result := <-feed:
+			if req.DeviceId != "" && result.DeviceID != req.DeviceId {
+				continue
+			}
+			if len(req.Severities) > 0 && !containsString(req.Severities, result.Severity) {
+				continue
+			}
+			if err := stream.Send(anomalyProto(result)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// anomalyProto сообщение Anomaly для результата анализа
+func anomalyProto(r AnalyticsResult) *highloadpb.Anomaly {
+	return &highloadpb.Anomaly{
+		Id:             r.ID,
+		DeviceId:       r.DeviceID,
+		Field:          r.Field,
+		Type:           r.Type,
+		Timestamp:      r.Timestamp,
+		Value:          r.Value,
+		RollingAverage: r.RollingAverage,
+		ZScore:         r.ZScore,
+		Severity:       r.Severity,
+		Probability:    r.Probability,
+		Status:         r.Status,
+		Annotations:    r.Annotations,
+		TraceId:        r.TraceID,
+	}
+}
+
+// authorize проверяет bearer-токен из метаданных authorization; пустой
+// список токенов отключает проверку
+func (g *grpcAnalytics) authorize(ctx context.Context) error {
+	tokens := g.service.grpcTokens()
+	if len(tokens) == 0 {
+		return nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get("authorization") {
+		if token, ok := strings.CutPrefix(value, "Bearer "); ok && validToken(tokens, token) {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "unauthorized")
+}
+
+// call выполняет вызов с проверкой доступа, учетом в метриках и ответом
+// Internal вместо падения процесса при панике обработчика
+func (g *grpcAnalytics) call(ctx context.Context, method string, fn func() error) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			logPanic("grpc "+method, v)
+			err = status.Error(codes.Internal, "internal error")
+		}
+		grpcRequests.WithLabelValues(method, status.Code(err).String()).Inc()
+	}()
+	if err := g.authorize(ctx); err != nil {
+		return err
+	}
+	return fn()
+}
+
+func (g *grpcAnalytics) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	err = g.call(ctx, info.FullMethod, func() error {
+		resp, err = handler(ctx, req)
+		return err
+	})
+	return resp, err
+}
+
+func (g *grpcAnalytics) streamInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return g.call(stream.Context(), info.FullMethod, func() error {
+		return handler(srv, stream)
+	})
+}
+
+// grpcTokens действующие токены gRPC API
+func (s *Service) grpcTokens() []string {
+	s.configMu.RLock()
+	defer s.configMu.RUnlock()
+	return s.config.GRPC.AuthTokens
+}
+
+// newGRPCServer открывает адрес grpc.addr и создает сервер API. При
+// включенном TLS используются сертификаты HTTP-серверов.
+func newGRPCServer(cfg *Config, service *Service, certs *CertReloader) (*grpc.Server, net.Listener, error) {
+	l, err := net.Listen("tcp", cfg.GRPC.Addr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("grpc: %w", err)
+	}
+	api := &grpcAnalytics{service: service}
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(api.unaryInterceptor),
+		grpc.StreamInterceptor(api.streamInterceptor),
+		// Пинги держат открытыми потоки WatchAnomalies через прокси без трафика
+		grpc.KeepaliveParams(keepalive.ServerParameters{Time: feedKeepAlive, Timeout: 10 * time.Second}),
+	}
+	if certs != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(serverTLSConfig(cfg.TLS, certs))))
+	}
+	server := grpc.NewServer(opts...)
+	highloadpb.RegisterAnalyticsServer(server, api)
+	log.Printf("gRPC API on %s", l.Addr())
+	return server, l, nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Состояния зависимости в /health
+const (
+	DependencyOK      = "ok"
+	DependencyFailed  = "failed"
+	DependencyTimeout = "timeout"
+)
+
+var dependencyUp = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "highload_dependency_up",
+		Help: "1 if the last health check of the dependency succeeded, 0 otherwise",
+	},
+	[]string{"dependency"},
+)
+
+// DependencyStatus результат проверки зависимости
+type DependencyStatus struct {
+	Name      string  `json:"name"`
+	Status    string  `json:"status"`
+	LatencyMs float64 `json:"latency_ms"`
+	// LastSuccess время последней успешной проверки; 0 — успешных еще не было
+	LastSuccess int64  `json:"last_success,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// healthCheck зарегистрированная проверка и ее состояние между вызовами
+type healthCheck struct {
+	name  string
+	check func(ctx context.Context) error
+
+	// running проверка еще выполняется после прошлого таймаута
+	running     bool
+	lastSuccess time.Time
+}
+
+// HealthRegistry набор проверок зависимостей для /health. Проверки
+// выполняются параллельно, каждая со своим таймаутом: ответ не ждет
+// зависшую зависимость дольше timeout. Проверка, не завершившаяся к
+// следующему вызову, повторно не запускается и снова отмечается как timeout.
+type HealthRegistry struct {
+	mu      sync.Mutex
+	timeout time.Duration
+	checks  map[string]*healthCheck
+}
+
+func NewHealthRegistry(timeout time.Duration) *HealthRegistry {
+	return &HealthRegistry{timeout: timeout, checks: make(map[string]*healthCheck)}
+}
+
+// SetTimeout задает таймаут одной проверки
+func (h *HealthRegistry) SetTimeout(timeout time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.timeout = timeout
+}
+
+// Register добавляет или заменяет проверку зависимости. Проверка должна
+// соблюдать отмену контекста; ошибка означает, что зависимость недоступна.
+func (h *HealthRegistry) Register(name string, check func(ctx context.Context) error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if existing, ok := h.checks[name]; ok {
+		existing.check = check
+		return
+	}
+	h.checks[name] = &healthCheck{name: name, check: check}
+}
+
+// Check выполняет все проверки и возвращает их результаты по именам
+func (h *HealthRegistry) Check(ctx context.Context) []DependencyStatus {
+	h.mu.Lock()
+	timeout := h.timeout
+	checks := make([]*healthCheck, 0, len(h.checks))
+	for _, check := range h.checks {
+		checks = append(checks, check)
+	}
+	h.mu.Unlock()
+	sort.Slice(checks, func(i, j int) bool { return checks[i].name < checks[j].name })
+
+	results := make([]DependencyStatus, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check *healthCheck) {
+			defer wg.Done()
+			results[i] = h.run(ctx, check, timeout)
+			up := 0.0
+			if results[i].Status == DependencyOK {
+				up = 1
+			}
+			dependencyUp.WithLabelValues(check.name).Set(up)
+		}(i, check)
+	}
+	wg.Wait()
+	return results
+}
+
+// run выполняет проверку, ожидая ее не дольше timeout
+func (h *HealthRegistry) run(ctx context.Context, check *healthCheck, timeout time.Duration) DependencyStatus {
+	status := DependencyStatus{Name: check.name}
+	h.mu.Lock()
+	running := check.running
+	if !running {
+		check.running = true
+	}
+	status.LastSuccess = unixOrZero(check.lastSuccess)
+	h.mu.Unlock()
+	if running {
+		status.Status = DependencyTimeout
+		status.Error = "previous check is still running"
+		return status
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	start := time.Now()
+	done := make(chan error, 1)
+	goSafe("health check", func() {
+		err := check.check(ctx)
+		h.mu.Lock()
+		check.running = false
+		if err == nil {
+			check.lastSuccess = time.Now()
+		}
+		h.mu.Unlock()
+		done <- err
+		cancel()
+	})
+
+	select {
+	case err := <-done:
+		status.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+		if err != nil {
+			status.Status = DependencyFailed
+			status.Error = err.Error()
+			return status
+		}
+		status.Status = DependencyOK
+		status.LastSuccess = time.Now().Unix()
+	case <-ctx.Done():
+		status.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+		status.Status = DependencyTimeout
+		status.Error = fmt.Sprintf("no response within %s", timeout)
+	}
+	return status
+}
+
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+// registerHealthChecks регистрирует проверки зависимостей сервиса
+func (s *Service) registerHealthChecks() {
+	s.health.Register("redis", func(ctx context.Context) error {
+		return s.redis.Ping(ctx).Err()
+	})
+	s.health.Register("worker_queues", func(ctx context.Context) error {
+		s.configMu.RLock()
+		limit := s.config.Health.QueueSaturation
+		s.configMu.RUnlock()
+
+		var saturated []string
+		for name, queue := range s.workerQueues() {
+			if queue.Capacity > 0 && float64(queue.Depth)/float64(queue.Capacity) >= limit {
+				saturated = append(saturated, fmt.Sprintf("%s %d/%d", name, queue.Depth, queue.Capacity))
+			}
+		}
+		if len(saturated) > 0 {
+			sort.Strings(saturated)
+			return fmt.Errorf("queues saturated: %s", strings.Join(saturated, ", "))
+		}
+		return nil
+	})
+	if s.nats.Enabled() {
+		s.health.Register("nats", s.nats.Healthy)
+	}
+	if s.queue.cfg.Enabled {
+		s.health.Register("stream_consumers", func(ctx context.Context) error {
+			if !s.ha.Active() {
+				// Резервный экземпляр поток не читает
+				return nil
+			}
+			limit := s.lb.config().StreamLagLimit
+			lag, err := s.queue.groupLag(ctx)
+			if err != nil {
+				return err
+			}
+			if lag > limit {
+				return fmt.Errorf("consumer group %s lags %s behind the stream, limit %s", s.queue.cfg.Group, lag, limit)
+			}
+			return nil
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// maxHeatmapBuckets ограничивает размер матрицы по времени
+const maxHeatmapBuckets = 1440
+
+// HeatmapResponse компактное представление матрицы устройство×время.
+// Строки Values и Anomalies соответствуют Devices, столбцы — Timestamps.
+type HeatmapResponse struct {
+	Field      string       `json:"field"`
+	Bucket     int64        `json:"bucket"`
+	From       int64        `json:"from"`
+	To         int64        `json:"to"`
+	Timestamps []int64      `json:"timestamps"`
+	Devices    []string     `json:"devices"`
+	Values     [][]*float64 `json:"values"`
+	Anomalies  [][]int      `json:"anomalies"`
+}
+
+// HeatmapHandler возвращает средние значения и число аномалий по устройствам и интервалам
+func (s *Service) HeatmapHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	field := query.Get("field")
+	if field == "" {
+		field = "cpu"
+	}
+	if !validFieldName(field) {
+		http.Error(w, "invalid field name", http.StatusBadRequest)
+		return
+	}
+
+	bucket := 5 * time.Minute
+	if raw := query.Get("bucket"); raw != "" {
+		parsed, err := time.ParseDuration(raw)
+		if err != nil || parsed < time.Second {
+			http.Error(w, "bucket must be a duration of at least 1s", http.StatusBadRequest)
+			return
+		}
+		bucket = parsed
+	}
+	bucketSec := int64(bucket / time.Second)
+
+	to := time.Now().Unix()
+	if raw := query.Get("to"); raw != "" {
+		parsed, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			http.Error(w, "to must be a unix timestamp", http.StatusBadRequest)
+			return
+		}
+		to = parsed
+	}
+	from := to - int64(time.Hour/time.Second)
+	if raw := query.Get("from"); raw != "" {
+		parsed, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			http.Error(w, "from must be a unix timestamp", http.StatusBadRequest)
+			return
+		}
+		from = parsed
+	}
+	if from < 0 || from > to {
+		http.Error(w, "from must not be negative or after to", http.StatusBadRequest)
+		return
+	}
+
+	// Выравниваем начало по границе интервала. Число интервалов проверяется
+	// до выделения матрицы: широкий диапазон или мелкий интервал иначе дают
+	// огромную аллокацию
+	from -= from % bucketSec
+	if (to-from)/bucketSec >= maxHeatmapBuckets {
+		http.Error(w, "too many buckets, increase bucket or narrow the range", http.StatusBadRequest)
+		return
+	}
+	buckets := int((to-from)/bucketSec) + 1
+
+	devices := s.metricsBuffer.Devices()
+	sort.Strings(devices)
+
+	response := HeatmapResponse{
+		Field:      field,
+		Bucket:     bucketSec,
+		From:       from,
+		To:         to,
+		Timestamps: make([]int64, buckets),
+		Devices:    devices,
+		Values:     make([][]*float64, len(devices)),
+		Anomalies:  make([][]int, len(devices)),
+	}
+	for i := range response.Timestamps {
+		response.Timestamps[i] = from + int64(i)*bucketSec
+	}
+
+	rows := make(map[string]int, len(devices))
+	for i, deviceID := range devices {
+		rows[deviceID] = i
+		sums := make([]float64, buckets)
+		counts := make([]int, buckets)
+		for _, point := range s.metricsBuffer.Points(deviceID, field) {
+			if point.Timestamp < from || point.Timestamp > to {
+				continue
+			}
+			idx := (point.Timestamp - from) / bucketSec
+			sums[idx] += point.Value
+			counts[idx]++
+		}
+
+		values := make([]*float64, buckets)
+		for j := range values {
+			if counts[j] > 0 {
+				avg := sums[j] / float64(counts[j])
+				values[j] = &avg
+			}
+		}
+		response.Values[i] = values
+		response.Anomalies[i] = make([]int, buckets)
+	}
+
+	for _, anomaly := range s.anomalies.Query(AnomalyFilter{Field: field, From: from, To: to}) {
+		row, ok := rows[anomaly.DeviceID]
+		// from = 0 фильтр не ограничивает, поэтому границы проверяются здесь
+		if !ok || anomaly.Timestamp < from || anomaly.Timestamp > to {
+			continue
+		}
+		response.Anomalies[row][(anomaly.Timestamp-from)/bucketSec]++
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
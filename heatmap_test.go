@@ -0,0 +1,23 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHeatmapRejectsOversizedRange(t *testing.T) {
+	s := &Service{}
+	for _, target := range []string{
+		"/api/heatmap?from=0&to=9223372036854775807",
+		"/api/heatmap?from=-9223372036854775808&to=9223372036854775807",
+		"/api/heatmap?from=1700000000&to=1700100000&bucket=1s",
+		"/api/heatmap?from=-5&to=-3",
+	} {
+		rec := httptest.NewRecorder()
+		s.HeatmapHandler(rec, httptest.NewRequest("GET", target, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", target, rec.Code)
+		}
+	}
+}
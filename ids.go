@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// Генераторы идентификаторов (ids.generator)
+const (
+	IDGeneratorULID     = "ulid"
+	IDGeneratorSequence = "sequence"
+)
+
+// IDGenerator выдает идентификаторы аномалий, событий, записей корзины и
+// запросов (X-Request-ID)
+type IDGenerator interface {
+	NewID() string
+}
+
+// ulidGenerator ULID: 26 символов, лексикографически упорядочены по времени
+// создания, монотонны в пределах одной миллисекунды
+type ulidGenerator struct{}
+
+func (ulidGenerator) NewID() string {
+	return ulid.Make().String()
+}
+
+// sequenceGenerator детерминированная последовательность в формате ULID с
+// нулевым временем: 00000000000000000000000001, ...02 и т. д. Для
+// интеграционных тестов и эталонных ответов API; в работе не использовать.
+type sequenceGenerator struct {
+	next atomic.Uint64
+}
+
+func (g *sequenceGenerator) NewID() string {
+	var id ulid.ULID
+	binary.BigEndian.PutUint64(id[8:], g.next.Add(1))
+	return id.String()
+}
+
+// NewIDGenerator возвращает генератор по имени из конфигурации
+func NewIDGenerator(name string) IDGenerator {
+	if name == IDGeneratorSequence {
+		return &sequenceGenerator{}
+	}
+	return ulidGenerator{}
+}
+
+// ids действующий генератор; задается при запуске до приема запросов
+var ids IDGenerator = ulidGenerator{}
+
+// newID возвращает новый идентификатор действующего генератора
+func newID() string {
+	return ids.NewID()
+}
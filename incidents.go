@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var incidentActions = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "highload_incident_actions_total",
+		Help: "Total number of incident actions sent to incident management systems by notifier and action (trigger, resolve, unrouted)",
+	},
+	[]string{"notifier", "action"},
+)
+
+// IncidentRoute направляет инциденты группы устройств по отдельному ключу
+// (routing key PagerDuty или API-ключ интеграции Opsgenie)
+type IncidentRoute struct {
+	// DevicePattern шаблон идентификаторов устройств (path.Match, например pump-*)
+	DevicePattern string `yaml:"device_pattern"`
+	Key           string `yaml:"key" secret:"true"`
+}
+
+// incidentBackend формат API системы управления инцидентами
+type incidentBackend interface {
+	trigger(ctx context.Context, key, dedupKey string, anomaly AnalyticsResult) error
+	resolve(ctx context.Context, key, dedupKey string) error
+}
+
+// openIncident инцидент, открытый по устройству и полю
+type openIncident struct {
+	// key ключ маршрута, по которому инцидент открыт; по нему же он закрывается
+	key      string
+	lastSeen time.Time
+}
+
+// IncidentNotifier открывает инциденты по аномалиям выбранной важности, по
+// одному на устройство и поле: повторные аномалии дополняют открытый
+// инцидент. Инцидент закрывается, когда по устройству и полю нет новых
+// аномалий resolveAfter.
+type IncidentNotifier struct {
+	name         string
+	backend      incidentBackend
+	defaultKey   string
+	routes       []IncidentRoute
+	severities   []string
+	resolveAfter time.Duration
+
+	mu   sync.Mutex
+	open map[string]*openIncident
+}
+
+func newIncidentNotifier(name string, backend incidentBackend, defaultKey string, routes []IncidentRoute,
+	severities []string, resolveAfter time.Duration) *IncidentNotifier {
+	return &IncidentNotifier{
+		name:         name,
+		backend:      backend,
+		defaultKey:   defaultKey,
+		routes:       routes,
+		severities:   severities,
+		resolveAfter: resolveAfter,
+		open:         make(map[string]*openIncident),
+	}
+}
+
+func (n *IncidentNotifier) Name() string { return n.name }
+
+// incidentDedupKey ключ дедупликации инцидента устройства и поля
+func incidentDedupKey(deviceID, field string) string {
+	return fmt.Sprintf("highload/%s/%s", deviceID, field)
+}
+
+// routeKey возвращает ключ первого подходящего маршрута или ключ по умолчанию
+func (n *IncidentNotifier) routeKey(deviceID string) string {
+	for _, route := range n.routes {
+		if ok, _ := path.Match(route.DevicePattern, deviceID); ok {
+			return route.Key
+		}
+	}
+	return n.defaultKey
+}
+
+// Notify открывает или дополняет инциденты. Аномалии другой важности и
+// устройства без маршрута пропускаются.
+func (n *IncidentNotifier) Notify(ctx context.Context, anomalies []AnalyticsResult) error {
+	var failed int
+	var lastErr error
+	for _, anomaly := range anomalies {
+		if !containsString(n.severities, anomaly.Severity) {
+			continue
+		}
+		dedupKey := incidentDedupKey(anomaly.DeviceID, anomaly.Field)
+
+		n.mu.Lock()
+		key := n.routeKey(anomaly.DeviceID)
+		if incident, exists := n.open[dedupKey]; exists {
+			key = incident.key
+		}
+		n.mu.Unlock()
+		if key == "" {
+			incidentActions.WithLabelValues(n.name, "unrouted").Inc()
+			continue
+		}
+
+		if err := n.backend.trigger(ctx, key, dedupKey, anomaly); err != nil {
+			failed++
+			lastErr = err
+			continue
+		}
+		incidentActions.WithLabelValues(n.name, "trigger").Inc()
+		n.mu.Lock()
+		n.open[dedupKey] = &openIncident{key: key, lastSeen: time.Now()}
+		n.mu.Unlock()
+	}
+	if lastErr != nil {
+		return fmt.Errorf("%d of %d incidents not triggered: %w", failed, len(anomalies), lastErr)
+	}
+	return nil
+}
+
+// ResolveCleared закрывает инциденты без новых аномалий дольше resolveAfter.
+// Не закрытые из-за ошибки останутся открытыми до следующего вызова.
+func (n *IncidentNotifier) ResolveCleared(ctx context.Context, now time.Time) error {
+	n.mu.Lock()
+	cleared := make(map[string]string)
+	for dedupKey, incident := range n.open {
+		if now.Sub(incident.lastSeen) >= n.resolveAfter {
+			cleared[dedupKey] = incident.key
+		}
+	}
+	n.mu.Unlock()
+
+	var lastErr error
+	for dedupKey, key := range cleared {
+		if err := n.backend.resolve(ctx, key, dedupKey); err != nil {
+			lastErr = err
+			continue
+		}
+		incidentActions.WithLabelValues(n.name, "resolve").Inc()
+		n.mu.Lock()
+		// Аномалия могла прийти во время закрытия: такой инцидент снова открыт
+		if incident, exists := n.open[dedupKey]; exists && now.Sub(incident.lastSeen) >= n.resolveAfter {
+			delete(n.open, dedupKey)
+		}
+		n.mu.Unlock()
+	}
+	return lastErr
+}
+
+// Adopt перенимает открытые инциденты уведомителя, замененного при
+// перезагрузке конфигурации, чтобы они закрылись по прежним ключам
+func (n *IncidentNotifier) Adopt(previous *IncidentNotifier) {
+	previous.mu.Lock()
+	defer previous.mu.Unlock()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for dedupKey, incident := range previous.open {
+		n.open[dedupKey] = incident
+	}
+}
+
+// resolveIncidents закрывает прекратившиеся инциденты всех уведомителей.
+// Вызывается только из Run.
+func (d *AlertDispatcher) resolveIncidents(now time.Time) {
+	for _, notifier := range d.currentNotifiers() {
+		incidents, ok := notifier.(*IncidentNotifier)
+		if !ok {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+		if err := incidents.ResolveCleared(ctx, now); err != nil {
+			log.Printf("Failed to resolve cleared incidents via %s: %v", incidents.Name(), err)
+		}
+		cancel()
+	}
+}
+
+// incidentDetails подробности аномалии для инцидента
+func incidentDetails(anomaly AnalyticsResult) map[string]string {
+	details := map[string]string{
+		"anomaly_id":      anomaly.ID,
+		"device_id":       anomaly.DeviceID,
+		"field":           anomaly.Field,
+		"type":            anomaly.Type,
+		"value":           strconv.FormatFloat(anomaly.Value, 'f', -1, 64),
+		"rolling_average": strconv.FormatFloat(anomaly.RollingAverage, 'f', 2, 64),
+		"z_score":         strconv.FormatFloat(anomaly.ZScore, 'f', 2, 64),
+		"probability":     strconv.FormatFloat(anomaly.Probability, 'f', 4, 64),
+	}
+	if len(anomaly.Annotations) > 0 {
+		details["events"] = strings.Join(anomaly.Annotations, "; ")
+	}
+	return details
+}
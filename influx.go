@@ -0,0 +1,367 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// SourceTypeInflux источник InfluxDB line protocol (POST /api/influx/write)
+const SourceTypeInflux = "influx"
+
+// Обработка полей точки без соответствия в influx.fields
+const (
+	InfluxUnmappedDrop   = "drop"
+	InfluxUnmappedPrefix = "prefix"
+)
+
+// influxPrecisions множители меток времени по параметру precision в наносекундах
+var influxPrecisions = map[string]int64{
+	"":   1,
+	"n":  1,
+	"ns": 1,
+	"u":  int64(time.Microsecond),
+	"us": int64(time.Microsecond),
+	"ms": int64(time.Millisecond),
+	"s":  int64(time.Second),
+	"m":  int64(time.Minute),
+	"h":  int64(time.Hour),
+}
+
+var (
+	influxLines = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "highload_influx_lines_total",
+			Help: "Total number of InfluxDB line protocol lines by parse result",
+		},
+		[]string{"result"},
+	)
+
+	influxFieldsDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "highload_influx_fields_dropped_total",
+		Help: "Total number of line protocol fields dropped as non-numeric, unmapped or with an invalid name",
+	})
+)
+
+// influxPoint разобранная строка line protocol; строковые поля пропускаются
+type influxPoint struct {
+	measurement string
+	tags        map[string]string
+	fields      map[string]float64
+	// timestamp в единицах precision; 0 — время приема
+	timestamp int64
+}
+
+// parseInfluxLine разбирает строку
+// measurement[,tag=value...] field=value[,field=value...] [timestamp]
+func parseInfluxLine(line string) (influxPoint, int, error) {
+	sections := splitInflux(line, ' ')
+	if len(sections) < 2 || len(sections) > 3 {
+		return influxPoint{}, 0, fmt.Errorf("expected measurement, fields and optional timestamp")
+	}
+
+	series := splitInflux(sections[0], ',')
+	point := influxPoint{
+		measurement: unescapeInflux(series[0]),
+		tags:        make(map[string]string, len(series)-1),
+		fields:      make(map[string]float64),
+	}
+	if point.measurement == "" {
+		return point, 0, fmt.Errorf("missing measurement")
+	}
+	for _, tag := range series[1:] {
+		kv := splitInflux(tag, '=')
+		if len(kv) != 2 || kv[0] == "" {
+			return point, 0, fmt.Errorf("invalid tag %q", tag)
+		}
+		point.tags[unescapeInflux(kv[0])] = unescapeInflux(kv[1])
+	}
+
+	skipped := 0
+	for _, field := range splitInflux(sections[1], ',') {
+		kv := splitInflux(field, '=')
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return point, 0, fmt.Errorf("invalid field %q", field)
+		}
+		value, numeric, err := parseInfluxValue(kv[1])
+		if err != nil {
+			return point, 0, fmt.Errorf("field %s: %v", kv[0], err)
+		}
+		if !numeric {
+			skipped++
+			continue
+		}
+		point.fields[unescapeInflux(kv[0])] = value
+	}
+
+	if len(sections) == 3 {
+		ts, err := strconv.ParseInt(sections[2], 10, 64)
+		if err != nil || ts < 0 {
+			return point, 0, fmt.Errorf("invalid timestamp %q", sections[2])
+		}
+		point.timestamp = ts
+	}
+	return point, skipped, nil
+}
+
+// parseInfluxValue разбирает значение поля: float, integer (1i, 1u) или
+// boolean как 1 и 0; false в numeric — строковое значение
+func parseInfluxValue(raw string) (float64, bool, error) {
+	if strings.HasPrefix(raw, `"`) {
+		if len(raw) < 2 || !strings.HasSuffix(raw, `"`) {
+			return 0, false, fmt.Errorf("unterminated string")
+		}
+		return 0, false, nil
+	}
+	switch raw {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, true, nil
+	}
+	if strings.HasSuffix(raw, "i") || strings.HasSuffix(raw, "u") {
+		v, err := strconv.ParseInt(raw[:len(raw)-1], 10, 64)
+		return float64(v), err == nil, err
+	}
+	v, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return 0, false, err
+	}
+	// В line protocol нет NaN и Inf; ParseFloat принимает их как слова
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, false, fmt.Errorf("invalid float %q", raw)
+	}
+	return v, true, nil
+}
+
+// splitInflux делит строку по разделителю, не экранированному обратной
+// косой чертой и не внутри строкового значения в кавычках
+func splitInflux(s string, sep byte) []string {
+	var parts []string
+	start, quoted := 0, false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\':
+			i++
+		case c == '"' && sep != '=':
+			quoted = !quoted
+		case c == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+			// Значение поля после первого = может содержать = в кавычках
+			if sep == '=' {
+				return append(parts, s[start:])
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// unescapeInflux убирает экранирование запятых, пробелов и знаков равенства
+func unescapeInflux(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	return strings.NewReplacer(`\,`, ",", `\ `, " ", `\=`, "=", `\\`, `\`).Replace(s)
+}
+
+// influxFieldName имя поля метрики для поля точки: по influx.fields
+// (measurement.field) или measurement_field при unmapped_fields: prefix
+func influxFieldName(cfg InfluxConfig, measurement, field string) (string, bool) {
+	if name, ok := cfg.Fields[measurement+"."+field]; ok {
+		return name, true
+	}
+	if cfg.UnmappedFields == InfluxUnmappedPrefix {
+		name := measurement + "_" + field
+		return name, validFieldName(name)
+	}
+	return "", false
+}
+
+// influxError ответ об ошибке в формате InfluxDB: Telegraf читает поле error
+func influxError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+// InfluxWriteHandler принимает точки InfluxDB line protocol, как /write
+// InfluxDB 1.x: Telegraf с urls = ["http://host:8080/api/influx"] пишет в
+// сервис без изменений на клиенте. Устройство берется из тега
+// influx.device_tag, поля точек одного устройства с одной меткой времени
+// собираются в одну метрику, которая проходит те же проверки, что и
+// POST /api/metrics. Корректные строки принимаются, даже если в запросе
+// есть ошибочные (partial write, как в InfluxDB).
+func (s *Service) InfluxWriteHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.pipeline.Accepts(SourceTypeInflux) {
+		http.Error(w, "influx source is not configured in pipeline", http.StatusNotFound)
+		return
+	}
+	precision, ok := influxPrecisions[r.URL.Query().Get("precision")]
+	if !ok {
+		influxError(w, http.StatusBadRequest, "precision must be one of n, ns, u, us, ms, s, m, h")
+		return
+	}
+
+	s.configMu.RLock()
+	cfg := s.config.Influx
+	s.configMu.RUnlock()
+
+	body, err := readBody(r, s.maxDecompressedBytes())
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	now := time.Now().Unix()
+	metrics := make(map[[2]string]*Metric)
+	var order [][2]string
+	var parseErrors []string
+	lines := 0
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if lines++; lines > cfg.MaxLines {
+			influxError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("too many lines, max %d", cfg.MaxLines))
+			return
+		}
+
+		point, skipped, err := parseInfluxLine(line)
+		deviceID := point.tags[cfg.DeviceTag]
+		if err == nil && deviceID == "" {
+			err = fmt.Errorf("missing tag %s", cfg.DeviceTag)
+		}
+		if err != nil {
+			influxLines.WithLabelValues("error").Inc()
+			parseErrors = append(parseErrors, fmt.Sprintf("unable to parse '%s': %v", line, err))
+			continue
+		}
+		influxLines.WithLabelValues("ok").Inc()
+
+		timestamp := now
+		if point.timestamp != 0 {
+			timestamp = point.timestamp * precision / int64(time.Second)
+		}
+		key := [2]string{deviceID, strconv.FormatInt(timestamp, 10)}
+		metric, ok := metrics[key]
+		if !ok {
+			metric = &Metric{DeviceID: deviceID, Timestamp: timestamp, Values: make(map[string]float64)}
+			metrics[key] = metric
+			order = append(order, key)
+		}
+		for field, value := range point.fields {
+			name, ok := influxFieldName(cfg, point.measurement, field)
+			if !ok {
+				skipped++
+				continue
+			}
+			metric.Values[name] = value
+		}
+		influxFieldsDropped.Add(float64(skipped))
+	}
+
+	// Отказ важнее частичной записи: Telegraf повторяет пакет при 429 и 5xx,
+	// уже принятые метрики при повторе отбрасываются как дубликаты
+	var rejected error
+	status := http.StatusNoContent
+	reject := func(code int, err error) {
+		if status == http.StatusNoContent || code > status {
+			status, rejected = code, err
+		}
+	}
+	for _, key := range order {
+		metric := *metrics[key]
+		if len(metric.Values) == 0 {
+			continue
+		}
+		if err := metric.Validate(s.maxFields(), s.maxSamples()); err != nil {
+			parseErrors = append(parseErrors, fmt.Sprintf("device %s at %d: %v", metric.DeviceID, metric.Timestamp, err))
+			continue
+		}
+		if err := s.fields.Check(metric); err != nil {
+			parseErrors = append(parseErrors, fmt.Sprintf("device %s at %d: %v", metric.DeviceID, metric.Timestamp, err))
+			continue
+		}
+		tokenTenant, err := s.deviceTokens.Authenticate(SourceTypeInflux, metric.DeviceID, r.Header.Get(deviceTokenHeader))
+		if err != nil {
+			code := http.StatusForbidden
+			if errors.Is(err, ErrDeviceTokenMissing) {
+				code = http.StatusUnauthorized
+			}
+			reject(code, err)
+			continue
+		}
+		tenant := s.resolveTenant(tokenTenant, r.Header.Get("Authorization"), r.Header.Get(tenantHeader), s.cluster.Forwarded(r))
+		if owner, local := s.cluster.Owner(metric.DeviceID); !local && s.forwardInfluxMetric(r, owner, tenant, metric) {
+			continue
+		}
+		if !s.admission.Admit(SourceTypeInflux, metric.DeviceID) {
+			w.Header().Set("Retry-After", s.admission.RetryAfter())
+			reject(http.StatusServiceUnavailable, errors.New("service overloaded, retry later"))
+			continue
+		}
+		decision := s.quotas.Allow(tenant, metric.DeviceID)
+		if !decision.Allowed {
+			reject(http.StatusTooManyRequests, errors.New(decision.Scope+" quota exceeded"))
+			continue
+		}
+		if s.dedup.Duplicate(r.Context(), SourceTypeInflux, tenant, "", metric) {
+			continue
+		}
+		metric.Tenant = tenant
+		s.submit(r.Context(), SourceTypeInflux, metric, restrictFields(s.tenantLabel(tenant), s.policyFor(tenant), metric.Fields()))
+	}
+
+	switch {
+	case rejected != nil:
+		influxError(w, status, rejected.Error())
+	case len(parseErrors) > 0:
+		message := "partial write: " + parseErrors[0]
+		if len(parseErrors) > 1 {
+			message += fmt.Sprintf(" (and %d more errors)", len(parseErrors)-1)
+		}
+		influxError(w, http.StatusBadRequest, message)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// forwardInfluxMetric пересылает метрику устройства владельцу в кластере в
+// виде JSON с арендатором и токеном устройства; false, если владелец
+// недоступен и метрику нужно обработать локально
+func (s *Service) forwardInfluxMetric(r *http.Request, owner, tenant string, metric Metric) bool {
+	body, err := json.Marshal(metric)
+	if err != nil {
+		return false
+	}
+	header := http.Header{"Content-Type": {"application/json"}, tenantHeader: {tenant}}
+	if token := r.Header.Get(deviceTokenHeader); token != "" {
+		header.Set(deviceTokenHeader, token)
+	}
+	resp, err := s.cluster.ForwardMetric(r.Context(), owner, body, header)
+	if err != nil {
+		log.Printf("Failed to forward influx metric for %s to %s: %v", metric.DeviceID, owner, err)
+		return false
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("Owner %s rejected influx metric for %s: %s", owner, metric.DeviceID, resp.Status)
+	}
+	return true
+}
+
+// InfluxPingHandler отвечает на проверку доступности клиентов InfluxDB
+func InfluxPingHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,19 @@
+package main
+
+import "testing"
+
+func TestParseInfluxLineRejectsNonFinite(t *testing.T) {
+	for _, value := range []string{"NaN", "nan", "Inf", "+Inf", "-inf", "Infinity", "1e400"} {
+		line := "cpu,device_id=dev value=" + value
+		if _, _, err := parseInfluxLine(line); err == nil {
+			t.Errorf("%q accepted", line)
+		}
+	}
+	point, _, err := parseInfluxLine("cpu,device_id=dev value=1.5,count=3i")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if point.fields["value"] != 1.5 || point.fields["count"] != 3 {
+		t.Fatalf("fields %v", point.fields)
+	}
+}
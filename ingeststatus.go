@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Состояния принятой метрики в GET /api/ingest/{id}/status
+const (
+	IngestStatusAccepted  = "accepted"
+	IngestStatusQueued    = "queued"
+	IngestStatusDropped   = "dropped"
+	IngestStatusBatched   = "batched"
+	IngestStatusLate      = "late"
+	IngestStatusProcessed = "processed"
+	IngestStatusAnalyzed  = "analyzed"
+)
+
+const (
+	ingestStatusQueueSize     = 10000
+	ingestStatusBatch         = 500
+	ingestStatusFlushInterval = 100 * time.Millisecond
+	// ingestAnomalyPrefix префикс полей хэша с найденными по метрике аномалиями
+	ingestAnomalyPrefix = "anomaly:"
+)
+
+var ingestStatusUpdates = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "highload_ingest_status_updates_total",
+		Help: "Total number of ingestion status updates by result (written, dropped, failed)",
+	},
+	[]string{"result"},
+)
+
+// IngestAnomaly аномалия, найденная по значению принятой метрики
+type IngestAnomaly struct {
+	ID    string `json:"id"`
+	Type  string `json:"type"`
+	Field string `json:"field"`
+}
+
+// IngestStatus что произошло с принятой метрикой
+type IngestStatus struct {
+	ID         string `json:"id"`
+	DeviceID   string `json:"device_id"`
+	Status     string `json:"status"`
+	ReceivedAt int64  `json:"received_at"`
+	// ProcessedAt время буферизации в миллисекундах; 0 — метрика еще в очереди
+	ProcessedAt int64 `json:"processed_at,omitempty"`
+	// Analyzed значения прошли через детекторы
+	Analyzed bool `json:"analyzed"`
+	// Cached метрика записана в кэш Redis
+	Cached    bool            `json:"cached"`
+	Anomaly   bool            `json:"anomaly"`
+	Anomalies []IngestAnomaly `json:"anomalies"`
+}
+
+type ingestUpdate struct {
+	id     string
+	values []interface{}
+}
+
+// IngestTracker отслеживает путь метрик, принятых через HTTP, по номерам
+// приема. Состояние хранится в хэшах Redis с TTL, поэтому статус доступен
+// на любой реплике, даже если метрику обработал другой потребитель потока.
+// Обновления копятся в очереди и пишутся пачками, чтобы не добавлять
+// обращение к Redis в путь приема; при переполнении очереди они
+// отбрасываются. Каждое обновление пишет свои поля хэша, так что порядок
+// записи не важен, а состояние выводится из набора полей.
+type IngestTracker struct {
+	redis   redis.UniversalClient
+	updates chan ingestUpdate
+
+	mu  sync.RWMutex
+	cfg IngestConfig
+}
+
+func NewIngestTracker(rdb redis.UniversalClient, cfg IngestConfig) *IngestTracker {
+	return &IngestTracker{redis: rdb, cfg: cfg, updates: make(chan ingestUpdate, ingestStatusQueueSize)}
+}
+
+// Configure применяет новые параметры к следующим метрикам
+func (it *IngestTracker) Configure(cfg IngestConfig) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	it.cfg = cfg
+}
+
+func (it *IngestTracker) config() IngestConfig {
+	it.mu.RLock()
+	defer it.mu.RUnlock()
+	return it.cfg
+}
+
+// NewID выдает номер приема; пустой, если отслеживание выключено
+func (it *IngestTracker) NewID() string {
+	if !it.config().Tracking {
+		return ""
+	}
+	return newID()
+}
+
+// Record ставит в очередь запись полей состояния метрики id
+func (it *IngestTracker) Record(id string, values ...interface{}) {
+	if id == "" {
+		return
+	}
+	select {
+	case it.updates <- ingestUpdate{id: id, values: values}:
+	default:
+		ingestStatusUpdates.WithLabelValues("dropped").Inc()
+	}
+}
+
+func (it *IngestTracker) key(id string) string {
+	return it.config().StatusKeyPrefix + ":" + id
+}
+
+// Run пишет накопленные обновления пачками
+func (it *IngestTracker) Run(ctx context.Context) {
+	pending := make([]ingestUpdate, 0, ingestStatusBatch)
+	ticker := time.NewTicker(ingestStatusFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case update := <-it.updates:
+			if pending = append(pending, update); len(pending) < ingestStatusBatch {
+				continue
+			}
+		case <-ticker.C:
+			if len(pending) == 0 {
+				continue
+			}
+		}
+		it.flush(ctx, pending)
+		pending = pending[:0]
+	}
+}
+
+func (it *IngestTracker) flush(ctx context.Context, updates []ingestUpdate) {
+	ttl := it.config().StatusTTL
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	pipe := it.redis.Pipeline()
+	for _, update := range updates {
+		key := it.key(update.id)
+		pipe.HSet(ctx, key, update.values...)
+		pipe.PExpire(ctx, key, ttl)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		ingestStatusUpdates.WithLabelValues("failed").Add(float64(len(updates)))
+		log.Printf("Failed to write %d ingestion status updates: %v", len(updates), err)
+		return
+	}
+	ingestStatusUpdates.WithLabelValues("written").Add(float64(len(updates)))
+}
+
+// Status читает состояние метрики; false, если номер неизвестен или истек
+func (it *IngestTracker) Status(ctx context.Context, id string) (IngestStatus, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	raw, err := it.redis.HGetAll(ctx, it.key(id)).Result()
+	if err != nil || len(raw) == 0 {
+		return IngestStatus{}, false, err
+	}
+
+	status := IngestStatus{ID: id, DeviceID: raw["device_id"], Anomalies: make([]IngestAnomaly, 0)}
+	status.ReceivedAt, _ = strconv.ParseInt(raw["received_at"], 10, 64)
+	status.ProcessedAt, _ = strconv.ParseInt(raw["processed_at"], 10, 64)
+	status.Analyzed = raw["analyzed"] == "1"
+	status.Cached = raw["cached"] == "1"
+	for field, value := range raw {
+		if anomalyID, ok := strings.CutPrefix(field, ingestAnomalyPrefix); ok {
+			anomalyType, anomalyField, _ := strings.Cut(value, ":")
+			status.Anomalies = append(status.Anomalies, IngestAnomaly{ID: anomalyID, Type: anomalyType, Field: anomalyField})
+		}
+	}
+	sort.Slice(status.Anomalies, func(i, j int) bool { return status.Anomalies[i].ID < status.Anomalies[j].ID })
+	status.Anomaly = len(status.Anomalies) > 0
+
+	switch {
+	case raw["dropped"] == "1":
+		status.Status = IngestStatusDropped
+	case status.Analyzed:
+		status.Status = IngestStatusAnalyzed
+	case raw["late"] == "1":
+		status.Status = IngestStatusLate
+	case raw["batched"] == "1":
+		status.Status = IngestStatusBatched
+	case status.ProcessedAt != 0:
+		status.Status = IngestStatusProcessed
+	case raw["queued"] == "1":
+		status.Status = IngestStatusQueued
+	default:
+		status.Status = IngestStatusAccepted
+	}
+	return status, true, nil
+}
+
+// ingestStatusPath адрес статуса метрики для заголовка Location
+func ingestStatusPath(id string) string {
+	return "/api/ingest/" + id + "/status"
+}
+
+// IngestStatusHandler сообщает, что произошло с метрикой, принятой с
+// номером id: accepted (принята), queued (в потоке), dropped (отброшена
+// процессорами конвейера), processed (в буфере), batched (ждет анализа
+// пакетом), late (опоздала, не анализировалась) или analyzed, а также
+// записана ли она в кэш и какие аномалии по ней найдены. Состояние
+// обновляется с задержкой до 100 мс и хранится ingest.status_ttl.
+func (s *Service) IngestStatusHandler(w http.ResponseWriter, r *http.Request) {
+	status, found, err := s.ingestStatus.Status(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		log.Printf("Failed to read ingestion status: %v", err)
+		http.Error(w, "ingestion status storage unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if !found {
+		http.Error(w, "ingestion not found or expired", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"sort"
+)
+
+// IQRBounds квартили окна и границы, за которыми значение считается выбросом
+type IQRBounds struct {
+	Q1    float64 `json:"q1"`
+	Q3    float64 `json:"q3"`
+	Lower float64 `json:"lower"`
+	Upper float64 `json:"upper"`
+}
+
+// IQRDetector помечает значения за пределами [Q1 − K·IQR, Q3 + K·IQR] по
+// скользящему окну. В отличие от z-score границы не зависят от хвостов
+// распределения, поэтому детектор устойчив на асимметричных данных (RPS).
+// Квартили считаются по локальному буферу: общей статистики в Redis для них нет.
+type IQRDetector struct {
+	fieldSet
+	buffer *MetricsBuffer
+
+	K          float64 // множитель межквартильного размаха
+	MinSamples int     // минимальное число значений в окне для оценки
+}
+
+func NewIQRDetector(buffer *MetricsBuffer, k float64, minSamples int, fields ...string) *IQRDetector {
+	return &IQRDetector{
+		fieldSet:   newFieldSet(fields...),
+		buffer:     buffer,
+		K:          k,
+		MinSamples: minSamples,
+	}
+}
+
+func (d *IQRDetector) Name() string { return AnomalyTypeIQR }
+
+func (d *IQRDetector) Detect(deviceID, field string, point Point) *AnalyticsResult {
+	values := d.buffer.WindowValues(deviceID, field)
+	result := &AnalyticsResult{
+		DeviceID:  deviceID,
+		Field:     field,
+		Type:      AnomalyTypeIQR,
+		Timestamp: point.Timestamp,
+		Value:     point.Value,
+	}
+	if len(values) < d.MinSamples {
+		return result
+	}
+
+	sort.Float64s(values)
+	q1 := quantile(values, 0.25)
+	q3 := quantile(values, 0.75)
+	iqr := q3 - q1
+	bounds := &IQRBounds{Q1: q1, Q3: q3, Lower: q1 - d.K*iqr, Upper: q3 + d.K*iqr}
+
+	result.RollingAverage = quantile(values, 0.5)
+	result.IQR = bounds
+	result.IsAnomaly = point.Value < bounds.Lower || point.Value > bounds.Upper
+	return result
+}
+
+// State возвращает квартили и границы текущего окна по полям устройства
+func (d *IQRDetector) State(deviceID string) map[string]interface{} {
+	fields, _ := d.buffer.DeviceStats(deviceID)
+	state := make(map[string]interface{}, len(fields))
+	for field := range fields {
+		if !d.Applies(field) {
+			continue
+		}
+		values := d.buffer.WindowValues(deviceID, field)
+		if len(values) < d.MinSamples {
+			state[field] = map[string]interface{}{"samples": len(values)}
+			continue
+		}
+		sort.Float64s(values)
+		q1, q3 := quantile(values, 0.25), quantile(values, 0.75)
+		state[field] = IQRBounds{Q1: q1, Q3: q3, Lower: q1 - d.K*(q3-q1), Upper: q3 + d.K*(q3-q1)}
+	}
+	return state
+}
+
+// Reset ничего не делает: окно хранится в буфере и очищается вызывающим
+func (d *IQRDetector) Reset(deviceID string) {}
+
+// quantile возвращает квантиль отсортированных значений с линейной интерполяцией
+func quantile(sorted []float64, q float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	pos := q * float64(len(sorted)-1)
+	i := int(pos)
+	if i+1 >= len(sorted) {
+		return sorted[len(sorted)-1]
+	}
+	return sorted[i] + (pos-float64(i))*(sorted[i+1]-sorted[i])
+}
+
+// iqrCritical сообщает, что значение вышло за удвоенную границу выброса
+func iqrCritical(result AnalyticsResult) bool {
+	b := result.IQR
+	return result.Value > b.Q3+2*(b.Upper-b.Q3) || result.Value < b.Q1-2*(b.Q1-b.Lower)
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+	"math/rand/v2"
+	"sync"
+)
+
+// eulerGamma постоянная Эйлера — Маскерони для средней длины пути в дереве
+const eulerGamma = 0.5772156649015329
+
+// IsolationInfo оценка вектора полей лесом изоляции
+type IsolationInfo struct {
+	// Score аномальность от 0 до 1: около 0.5 — обычный вектор, ближе к 1 — выброс
+	Score     float64            `json:"score"`
+	Threshold float64            `json:"threshold"`
+	Vector    map[string]float64 `json:"vector"`
+}
+
+// isolationNode узел дерева; у листа left < 0. Внутренний узел делит
+// пространство гиперплоскостью normal·x = offset.
+type isolationNode struct {
+	left, right int32
+	size        int32
+	normal      []float64
+	offset      float64
+}
+
+// isolationTree дерево в плоском массиве, корень — nodes[0]
+type isolationTree struct {
+	nodes []isolationNode
+}
+
+// isolationForest расширенный лес изоляции (Liu, Ting, Zhou, 2008; Hariri,
+// Kind, Brunner, 2018): выброс отделяется случайными разбиениями быстрее
+// обычных векторов, поэтому средняя длина пути до него меньше. Разбиения идут
+// по наклонным гиперплоскостям, а не по одному полю: так лес видит нарушение
+// связи между полями, а не только выход отдельного поля за диапазон. Поля
+// нормируются по обучающей выборке, чтобы наклон не зависел от единиц.
+type isolationForest struct {
+	trees      []isolationTree
+	sampleSize int
+	mean, std  []float64
+}
+
+// averagePathLength средняя длина пути неудачного поиска в двоичном дереве из n элементов
+func averagePathLength(n int) float64 {
+	switch {
+	case n <= 1:
+		return 0
+	case n == 2:
+		return 1
+	}
+	return 2*(math.Log(float64(n-1))+eulerGamma) - 2*float64(n-1)/float64(n)
+}
+
+// trainIsolationForest строит trees деревьев по подвыборкам из sampleSize строк
+func trainIsolationForest(rows [][]float64, trees, sampleSize int, rng *rand.Rand) *isolationForest {
+	dims := len(rows[0])
+	forest := &isolationForest{
+		trees:      make([]isolationTree, trees),
+		sampleSize: min(sampleSize, len(rows)),
+		mean:       make([]float64, dims),
+		std:        make([]float64, dims),
+	}
+	for i := 0; i < dims; i++ {
+		var sum, sumSq float64
+		for _, row := range rows {
+			sum += row[i]
+			sumSq += row[i] * row[i]
+		}
+		forest.mean[i] = sum / float64(len(rows))
+		forest.std[i] = math.Sqrt(math.Max(sumSq/float64(len(rows))-forest.mean[i]*forest.mean[i], 0))
+		if forest.std[i] == 0 {
+			forest.std[i] = 1
+		}
+	}
+	scaled := make([][]float64, len(rows))
+	for i, row := range rows {
+		scaled[i] = forest.scale(row)
+	}
+
+	limit := int(math.Ceil(math.Log2(float64(max(forest.sampleSize, 2)))))
+	for i := range forest.trees {
+		sample := make([][]float64, forest.sampleSize)
+		for j, k := range rng.Perm(len(scaled))[:forest.sampleSize] {
+			sample[j] = scaled[k]
+		}
+		forest.trees[i].grow(sample, 0, limit, rng)
+	}
+	return forest
+}
+
+// scale нормирует вектор по обучающей выборке
+func (f *isolationForest) scale(x []float64) []float64 {
+	scaled := make([]float64, len(x))
+	for i := range x {
+		scaled[i] = (x[i] - f.mean[i]) / f.std[i]
+	}
+	return scaled
+}
+
+// grow добавляет поддерево по строкам и возвращает индекс его корня
+func (t *isolationTree) grow(rows [][]float64, depth, limit int, rng *rand.Rand) int32 {
+	index := int32(len(t.nodes))
+	t.nodes = append(t.nodes, isolationNode{left: -1, right: -1, size: int32(len(rows))})
+	if depth >= limit || len(rows) <= 1 {
+		return index
+	}
+
+	// Гиперплоскость со случайной нормалью через случайную точку в границах узла
+	dims := len(rows[0])
+	normal := make([]float64, dims)
+	var offset float64
+	spread := false
+	for i := 0; i < dims; i++ {
+		lo, hi := rows[0][i], rows[0][i]
+		for _, row := range rows[1:] {
+			lo = math.Min(lo, row[i])
+			hi = math.Max(hi, row[i])
+		}
+		if hi == lo {
+			continue
+		}
+		spread = true
+		normal[i] = rng.NormFloat64()
+		offset += normal[i] * (lo + rng.Float64()*(hi-lo))
+	}
+	if !spread {
+		return index
+	}
+
+	var left, right [][]float64
+	for _, row := range rows {
+		if dot(normal, row) < offset {
+			left = append(left, row)
+		} else {
+			right = append(right, row)
+		}
+	}
+	leftIndex := t.grow(left, depth+1, limit, rng)
+	rightIndex := t.grow(right, depth+1, limit, rng)
+	t.nodes[index].normal = normal
+	t.nodes[index].offset = offset
+	t.nodes[index].left = leftIndex
+	t.nodes[index].right = rightIndex
+	return index
+}
+
+func dot(a, b []float64) float64 {
+	var sum float64
+	for i := range a {
+		sum += a[i] * b[i]
+	}
+	return sum
+}
+
+// pathLength длина пути нормированного вектора до листа с поправкой на
+// неразобранные строки листа
+func (t *isolationTree) pathLength(x []float64) float64 {
+	node, depth := t.nodes[0], 0
+	for node.left >= 0 {
+		if dot(node.normal, x) < node.offset {
+			node = t.nodes[node.left]
+		} else {
+			node = t.nodes[node.right]
+		}
+		depth++
+	}
+	return float64(depth) + averagePathLength(int(node.size))
+}
+
+// score возвращает аномальность вектора 2^(−E[h(x)]/c(ψ))
+func (f *isolationForest) score(x []float64) float64 {
+	norm := averagePathLength(f.sampleSize)
+	if norm == 0 {
+		return 0.5
+	}
+	scaled := f.scale(x)
+	var total float64
+	for i := range f.trees {
+		total += f.trees[i].pathLength(scaled)
+	}
+	return math.Pow(2, -total/float64(len(f.trees))/norm)
+}
+
+// AlignedWindow возвращает векторы значений полей с совпадающими метками
+// времени раньше before из текущего окна первого поля и вектор в момент
+// before, если в нем есть все поля
+func (mb *MetricsBuffer) AlignedWindow(deviceID string, fields []string, before int64) ([][]float64, []float64, bool) {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+
+	byTimestamp := make([]map[int64]float64, len(fields))
+	for i, field := range fields[1:] {
+		byTimestamp[i+1] = make(map[int64]float64)
+		for _, point := range mb.data[deviceID][field] {
+			if point.Timestamp <= before {
+				byTimestamp[i+1][point.Timestamp] = point.Value
+			}
+		}
+	}
+	vector := func(point Point) ([]float64, bool) {
+		row := make([]float64, len(fields))
+		row[0] = point.Value
+		for i := 1; i < len(fields); i++ {
+			value, ok := byTimestamp[i][point.Timestamp]
+			if !ok {
+				return nil, false
+			}
+			row[i] = value
+		}
+		return row, true
+	}
+
+	var rows [][]float64
+	var current []float64
+	points := mb.data[deviceID][fields[0]]
+	for i := len(points) - 1; i >= 0 && len(rows) < mb.window; i-- {
+		point := points[i]
+		if point.Timestamp > before {
+			continue
+		}
+		row, ok := vector(point)
+		if !ok {
+			continue
+		}
+		if point.Timestamp == before {
+			current = row
+		} else {
+			rows = append(rows, row)
+		}
+	}
+	return rows, current, current != nil
+}
+
+// isolationState модель устройства
+type isolationState struct {
+	forest *isolationForest
+	// observed число оценок с последнего обучения
+	observed  int
+	trainedOn int
+	lastScore float64
+}
+
+// IsolationForestDetector оценивает вектор полей устройства (по умолчанию
+// cpu, memory, rps) лесом изоляции, обученным на текущем окне. Ловит
+// аномалии, заметные только в сочетании полей: обычный CPU при необычном
+// соотношении memory и RPS. Модель переобучается каждые RetrainEvery
+// векторов. Запускается по первому полю набора, если в метрике есть все поля.
+type IsolationForestDetector struct {
+	buffer *MetricsBuffer
+	fields []string
+
+	mu     sync.Mutex
+	states map[string]*isolationState
+
+	Trees        int
+	SampleSize   int
+	Threshold    float64 // порог аномальности
+	MinSamples   int     // минимум векторов в окне для обучения
+	RetrainEvery int
+}
+
+func NewIsolationForestDetector(buffer *MetricsBuffer, cfg IsolationForestConfig) *IsolationForestDetector {
+	return &IsolationForestDetector{
+		buffer:       buffer,
+		fields:       cfg.Fields,
+		states:       make(map[string]*isolationState),
+		Trees:        cfg.Trees,
+		SampleSize:   cfg.SampleSize,
+		Threshold:    cfg.Threshold,
+		MinSamples:   cfg.MinSamples,
+		RetrainEvery: cfg.RetrainEvery,
+	}
+}
+
+func (d *IsolationForestDetector) Name() string { return AnomalyTypeIsolation }
+
+func (d *IsolationForestDetector) Applies(field string) bool {
+	return len(d.fields) > 0 && d.fields[0] == field
+}
+
+// Detect оценивает вектор полей в момент значения. В результате указывается
+// поле, сильнее всего отклонившееся от среднего окна; nil — если в метрике
+// нет всех полей или векторов в окне недостаточно.
+func (d *IsolationForestDetector) Detect(deviceID, field string, point Point) *AnalyticsResult {
+	rows, current, ok := d.buffer.AlignedWindow(deviceID, d.fields, point.Timestamp)
+	if !ok || len(rows) < d.MinSamples {
+		return nil
+	}
+
+	d.mu.Lock()
+	state, exists := d.states[deviceID]
+	if !exists {
+		state = &isolationState{}
+		d.states[deviceID] = state
+	}
+	if state.forest == nil || state.observed >= d.RetrainEvery {
+		// Сид из устройства и метки времени: прогон правил по истории воспроизводим
+		h := fnv.New64a()
+		h.Write([]byte(deviceID))
+		rng := rand.New(rand.NewPCG(h.Sum64(), uint64(point.Timestamp)))
+		state.forest = trainIsolationForest(rows, d.Trees, d.SampleSize, rng)
+		state.observed = 0
+		state.trainedOn = len(rows)
+	}
+	state.observed++
+	score := state.forest.score(current)
+	state.lastScore = score
+	d.mu.Unlock()
+
+	// Поле с наибольшим отклонением от среднего окна в σ
+	vector := make(map[string]float64, len(d.fields))
+	best, bestZ, bestMean := 0, 0.0, 0.0
+	for i, name := range d.fields {
+		vector[name] = current[i]
+		var sum, sumSq float64
+		for _, row := range rows {
+			sum += row[i]
+			sumSq += row[i] * row[i]
+		}
+		mean := sum / float64(len(rows))
+		var z float64
+		if variance := sumSq/float64(len(rows)) - mean*mean; variance > 0 {
+			z = (current[i] - mean) / math.Sqrt(variance)
+		}
+		if i == 0 || math.Abs(z) > math.Abs(bestZ) {
+			best, bestZ, bestMean = i, z, mean
+		}
+	}
+
+	return &AnalyticsResult{
+		DeviceID:       deviceID,
+		Field:          d.fields[best],
+		Type:           AnomalyTypeIsolation,
+		RollingAverage: bestMean,
+		ZScore:         bestZ,
+		IsAnomaly:      score > d.Threshold,
+		Timestamp:      point.Timestamp,
+		Value:          current[best],
+		Isolation:      &IsolationInfo{Score: score, Threshold: d.Threshold, Vector: vector},
+	}
+}
+
+// State возвращает размер обучающей выборки и последнюю оценку устройства
+func (d *IsolationForestDetector) State(deviceID string) map[string]interface{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	state, exists := d.states[deviceID]
+	if !exists || state.forest == nil {
+		return map[string]interface{}{}
+	}
+	return map[string]interface{}{
+		"fields":      d.fields,
+		"trained_on":  state.trainedOn,
+		"mean":        state.forest.mean,
+		"since_train": state.observed,
+		"last_score":  state.lastScore,
+	}
+}
+
+func (d *IsolationForestDetector) Reset(deviceID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.states, deviceID)
+}
+
+// isolationCritical аномальность в верхней половине между порогом и 1
+func isolationCritical(result AnalyticsResult) bool {
+	info := result.Isolation
+	return info.Score >= info.Threshold+(1-info.Threshold)/2
+}
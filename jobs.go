@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Фоновые задачи с бюджетами
+const (
+	JobRollups   = "rollups"
+	JobRetention = "retention"
+	JobArchiver  = "archiver"
+)
+
+// jobLoadPoll период проверки загрузки, пока проход отложен
+const jobLoadPoll = time.Second
+
+var (
+	jobRuns = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "highload_job_runs_total",
+			Help: "Total number of background job passes by job and result (ok, error, overrun)",
+		},
+		[]string{"job", "result"},
+	)
+
+	jobRunDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "highload_job_run_duration_seconds",
+			Help:    "Duration of background job passes",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+		},
+		[]string{"job"},
+	)
+
+	jobDeferrals = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "highload_job_deferrals_total",
+			Help: "Total number of background job passes deferred because the ingest path was under pressure",
+		},
+		[]string{"job"},
+	)
+
+	jobDeferredSeconds = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "highload_job_deferred_seconds_total",
+			Help: "Total time background job passes waited for ingest pressure to drop or for a concurrency slot",
+		},
+		[]string{"job", "reason"},
+	)
+
+	jobsRunning = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "highload_jobs_running",
+		Help: "Number of background job passes running right now",
+	})
+)
+
+// JobStatus состояние фоновой задачи для /api/admin/jobs
+type JobStatus struct {
+	Job     string `json:"job"`
+	Running bool   `json:"running"`
+	// Deferred проход ждет снижения загрузки ingest
+	Deferred     bool    `json:"deferred"`
+	LastRunAt    int64   `json:"last_run_at,omitempty"`
+	LastDuration float64 `json:"last_duration_ms"`
+	LastError    string  `json:"last_error,omitempty"`
+	Runs         int64   `json:"runs"`
+	Overruns     int64   `json:"overruns"`
+	Deferrals    int64   `json:"deferrals"`
+}
+
+// JobScheduler выполняет проходы фоновых задач в рамках бюджетов, чтобы
+// обслуживание не конкурировало с обработкой в реальном времени. Пока
+// загрузка конвейера ingest (та же, что в /health/lb) не ниже defer_at,
+// проходы откладываются, но не дольше max_deferral: иначе при постоянной
+// нагрузке поток и очереди архива росли бы без ограничения. Одновременно
+// выполняется не больше max_concurrent проходов всех задач. Проход
+// ограничен max_run_time задачи, а после прохода задача отдыхает так, чтобы
+// работать не больше доли utilization времени.
+type JobScheduler struct {
+	mu      sync.Mutex
+	cfg     JobsConfig
+	load    func() float64
+	running int
+	// wake закрывается при освобождении слота, будя ожидающие проходы
+	wake   chan struct{}
+	status map[string]*JobStatus
+}
+
+func NewJobScheduler(cfg JobsConfig) *JobScheduler {
+	return &JobScheduler{
+		cfg:    cfg,
+		load:   func() float64 { return 0 },
+		wake:   make(chan struct{}),
+		status: make(map[string]*JobStatus),
+	}
+}
+
+// Configure применяет бюджеты со следующего прохода
+func (js *JobScheduler) Configure(cfg JobsConfig) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	js.cfg = cfg
+	// Лимит мог вырасти: ожидающие проходы проверят его заново
+	close(js.wake)
+	js.wake = make(chan struct{})
+}
+
+// SetLoad задает источник загрузки конвейера ingest от 0 до 1
+func (js *JobScheduler) SetLoad(load func() float64) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	js.load = load
+}
+
+// jobStatus возвращает состояние задачи; вызывается под js.mu
+func (js *JobScheduler) jobStatus(job string) *JobStatus {
+	status, ok := js.status[job]
+	if !ok {
+		status = &JobStatus{Job: job}
+		js.status[job] = status
+	}
+	return status
+}
+
+// Run выполняет проход задачи job в рамках ее бюджета и возвращает ошибку
+// прохода или отмены контекста
+func (js *JobScheduler) Run(ctx context.Context, job string, pass func(ctx context.Context) error) error {
+	if err := js.deferUnderLoad(ctx, job); err != nil {
+		return err
+	}
+	if err := js.acquire(ctx, job); err != nil {
+		return err
+	}
+
+	js.mu.Lock()
+	budget := js.cfg.budget(job)
+	js.mu.Unlock()
+	passCtx, cancel := ctx, context.CancelFunc(func() {})
+	if budget.MaxRunTime > 0 {
+		passCtx, cancel = context.WithTimeout(ctx, budget.MaxRunTime)
+	}
+	start := time.Now()
+	err := pass(passCtx)
+	elapsed := time.Since(start)
+	cancel()
+	js.release(job, start, elapsed, err, budget)
+
+	// Отдых после прохода: за проход длительностью d задача ждет d·(1-u)/u
+	if budget.Utilization > 0 && budget.Utilization < 1 {
+		pause := time.Duration(float64(elapsed) * (1 - budget.Utilization) / budget.Utilization)
+		select {
+		case <-ctx.Done():
+		case <-time.After(pause):
+		}
+	}
+	return err
+}
+
+// deferUnderLoad ждет, пока загрузка ingest опустится ниже defer_at, но не дольше max_deferral
+func (js *JobScheduler) deferUnderLoad(ctx context.Context, job string) error {
+	start := time.Now()
+	deferred := false
+	defer func() {
+		if !deferred {
+			return
+		}
+		jobDeferredSeconds.WithLabelValues(job, "load").Add(time.Since(start).Seconds())
+		js.mu.Lock()
+		js.jobStatus(job).Deferred = false
+		js.mu.Unlock()
+	}()
+
+	for {
+		js.mu.Lock()
+		cfg, load := js.cfg, js.load
+		js.mu.Unlock()
+		if cfg.DeferAt <= 0 || load() < cfg.DeferAt {
+			return nil
+		}
+		if time.Since(start) >= cfg.MaxDeferral {
+			log.Printf("Running %s despite ingest pressure: deferred for %s", job, time.Since(start).Round(time.Second))
+			return nil
+		}
+		if !deferred {
+			deferred = true
+			jobDeferrals.WithLabelValues(job).Inc()
+			js.mu.Lock()
+			status := js.jobStatus(job)
+			status.Deferred = true
+			status.Deferrals++
+			js.mu.Unlock()
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(jobLoadPoll):
+		}
+	}
+}
+
+// acquire занимает слот из max_concurrent
+func (js *JobScheduler) acquire(ctx context.Context, job string) error {
+	start := time.Now()
+	for {
+		js.mu.Lock()
+		if js.cfg.MaxConcurrent <= 0 || js.running < js.cfg.MaxConcurrent {
+			js.running++
+			js.jobStatus(job).Running = true
+			js.mu.Unlock()
+			jobsRunning.Inc()
+			if waited := time.Since(start); waited > time.Millisecond {
+				jobDeferredSeconds.WithLabelValues(job, "concurrency").Add(waited.Seconds())
+			}
+			return nil
+		}
+		wake := js.wake
+		js.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-wake:
+		}
+	}
+}
+
+// release освобождает слот и учитывает итог прохода
+func (js *JobScheduler) release(job string, start time.Time, elapsed time.Duration, err error, budget JobBudget) {
+	result := "ok"
+	switch {
+	case budget.MaxRunTime > 0 && elapsed >= budget.MaxRunTime:
+		result = "overrun"
+	case err != nil:
+		result = "error"
+	}
+	jobRuns.WithLabelValues(job, result).Inc()
+	jobRunDuration.WithLabelValues(job).Observe(elapsed.Seconds())
+	jobsRunning.Dec()
+
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	js.running--
+	close(js.wake)
+	js.wake = make(chan struct{})
+
+	status := js.jobStatus(job)
+	status.Running = false
+	status.LastRunAt = start.Unix()
+	status.LastDuration = float64(elapsed.Microseconds()) / 1000
+	status.LastError = ""
+	if err != nil {
+		status.LastError = err.Error()
+	}
+	status.Runs++
+	if result == "overrun" {
+		status.Overruns++
+	}
+}
+
+// Status возвращает состояние задач, у которых уже были проходы
+func (js *JobScheduler) Status() []JobStatus {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	statuses := make([]JobStatus, 0, len(js.status))
+	for _, status := range js.status {
+		statuses = append(statuses, *status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Job < statuses[j].Job })
+	return statuses
+}
+
+// AdminJobsHandler возвращает бюджеты и состояние фоновых задач
+func (s *Service) AdminJobsHandler(w http.ResponseWriter, r *http.Request) {
+	s.configMu.RLock()
+	cfg := s.config.Jobs
+	s.configMu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ingest_saturation": s.lb.Status().Saturation,
+		"defer_at":          cfg.DeferAt,
+		"max_concurrent":    cfg.MaxConcurrent,
+		"jobs":              s.jobs.Status(),
+	})
+}
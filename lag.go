@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// lagSampleInterval период замера отставания потребителей
+	lagSampleInterval = 5 * time.Second
+	// lagRateSmoothing вес нового замера в экспоненциально сглаженной скорости
+	lagRateSmoothing = 0.3
+	// lagBacklogLimit предел подсчета непрочитанных записей потока за замер
+	lagBacklogLimit = 100000
+)
+
+// Виды асинхронных потребителей
+const (
+	ConsumerKindStream = "stream"
+	ConsumerKindQueue  = "queue"
+)
+
+var (
+	consumerProcessed = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "highload_consumer_processed_total",
+			Help: "Total number of items processed by each asynchronous consumer (stream group, rollups, worker queues)",
+		},
+		[]string{"consumer"},
+	)
+
+	consumerBacklog = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "highload_consumer_backlog",
+			Help: "Number of items waiting for each asynchronous consumer",
+		},
+		[]string{"consumer"},
+	)
+
+	consumerRate = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "highload_consumer_rate",
+			Help: "Smoothed processing rate of each asynchronous consumer in items per second",
+		},
+		[]string{"consumer"},
+	)
+
+	consumerCatchUp = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "highload_consumer_catch_up_seconds",
+			Help: "Estimated time for each asynchronous consumer to work off its backlog at the current rate (+Inf when it is stalled)",
+		},
+		[]string{"consumer"},
+	)
+)
+
+// consumerProgress число обработанных элементов по потребителям: name -> *atomic.Int64
+var consumerProgress sync.Map
+
+// recordConsumed учитывает n элементов, обработанных потребителем
+func recordConsumed(consumer string, n int) {
+	if n <= 0 {
+		return
+	}
+	counter, _ := consumerProgress.LoadOrStore(consumer, new(atomic.Int64))
+	counter.(*atomic.Int64).Add(int64(n))
+	consumerProcessed.WithLabelValues(consumer).Add(float64(n))
+}
+
+func consumedTotal(consumer string) int64 {
+	if counter, ok := consumerProgress.Load(consumer); ok {
+		return counter.(*atomic.Int64).Load()
+	}
+	return 0
+}
+
+// countEntriesScript считает записи потока начиная с ARGV[1], но не больше ARGV[2],
+// не передавая их клиенту
+var countEntriesScript = redis.NewScript(`
+return #redis.call("xrange", KEYS[1], ARGV[1], "+", "COUNT", ARGV[2])`)
+
+// ConsumerLag отставание асинхронного потребителя
+type ConsumerLag struct {
+	Consumer string `json:"consumer"`
+	Kind     string `json:"kind"`
+	// Backlog число ожидающих элементов; для потока не больше lagBacklogLimit
+	Backlog int64 `json:"backlog"`
+	// LagSeconds возраст самой новой записи потока относительно позиции
+	// читателя; у очередей в памяти не определен
+	LagSeconds *float64 `json:"lag_seconds,omitempty"`
+	// Rate сглаженная скорость обработки, элементов в секунду
+	Rate float64 `json:"rate"`
+	// CatchUpSeconds оценка времени разбора очереди; null — потребитель стоит
+	CatchUpSeconds *float64 `json:"catch_up_seconds"`
+}
+
+// PipelineLag ответ /api/pipeline/lag
+type PipelineLag struct {
+	SampledAt int64 `json:"sampled_at"`
+	// CatchUpSeconds наибольшая оценка среди потребителей; null — какой-то из них стоит
+	CatchUpSeconds *float64      `json:"catch_up_seconds"`
+	Consumers      []ConsumerLag `json:"consumers"`
+}
+
+// LagMonitor периодически замеряет очередь, скорость обработки и время
+// догоняния каждого асинхронного потребителя: группы потока, агрегатов
+// интервалов и очередей воркеров. Потоком занимается только активный
+// экземпляр, поэтому на резервном он не учитывается.
+type LagMonitor struct {
+	service *Service
+
+	mu      sync.Mutex
+	totals  map[string]int64
+	rates   map[string]float64
+	sampled time.Time
+	lag     PipelineLag
+}
+
+func NewLagMonitor(service *Service) *LagMonitor {
+	return &LagMonitor{
+		service: service,
+		totals:  make(map[string]int64),
+		rates:   make(map[string]float64),
+		lag:     PipelineLag{Consumers: []ConsumerLag{}},
+	}
+}
+
+// Run замеряет отставание каждые lagSampleInterval
+func (m *LagMonitor) Run() {
+	ticker := time.NewTicker(lagSampleInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(m.service.ctx, lagSampleInterval)
+		consumers, err := m.service.consumerBacklogs(ctx)
+		cancel()
+		if err != nil {
+			log.Printf("Failed to measure stream consumer lag: %v", err)
+		}
+		m.sample(time.Now(), consumers)
+	}
+}
+
+// sample дополняет замер очередей скоростью обработки и временем догоняния
+func (m *LagMonitor) sample(now time.Time, consumers []ConsumerLag) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	elapsed := now.Sub(m.sampled).Seconds()
+	lag := PipelineLag{SampledAt: now.Unix(), Consumers: consumers}
+	var worst float64
+	stalled := false
+	for i := range consumers {
+		c := &consumers[i]
+		total := consumedTotal(c.Consumer)
+		if previous, ok := m.totals[c.Consumer]; ok && !m.sampled.IsZero() && elapsed > 0 {
+			current := float64(total-previous) / elapsed
+			m.rates[c.Consumer] = lagRateSmoothing*current + (1-lagRateSmoothing)*m.rates[c.Consumer]
+		}
+		m.totals[c.Consumer] = total
+		c.Rate = m.rates[c.Consumer]
+
+		consumerBacklog.WithLabelValues(c.Consumer).Set(float64(c.Backlog))
+		consumerRate.WithLabelValues(c.Consumer).Set(c.Rate)
+		switch {
+		case c.Backlog == 0:
+			c.CatchUpSeconds = new(float64)
+		case c.Rate > 0:
+			eta := float64(c.Backlog) / c.Rate
+			c.CatchUpSeconds = &eta
+		default:
+			stalled = true
+			consumerCatchUp.WithLabelValues(c.Consumer).Set(math.Inf(1))
+			continue
+		}
+		consumerCatchUp.WithLabelValues(c.Consumer).Set(*c.CatchUpSeconds)
+		worst = math.Max(worst, *c.CatchUpSeconds)
+	}
+	if !stalled {
+		lag.CatchUpSeconds = &worst
+	}
+	m.sampled = now
+	m.lag = lag
+}
+
+// Lag возвращает последний замер
+func (m *LagMonitor) Lag() PipelineLag {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lag
+}
+
+// consumerBacklogs возвращает очереди потребителей без скорости обработки.
+// При ошибке Redis возвращаются очереди воркеров.
+func (s *Service) consumerBacklogs(ctx context.Context) ([]ConsumerLag, error) {
+	var consumers []ConsumerLag
+	for name, queue := range s.workerQueues() {
+		consumers = append(consumers, ConsumerLag{Consumer: name, Kind: ConsumerKindQueue, Backlog: int64(queue.Depth)})
+	}
+	sort.Slice(consumers, func(i, j int) bool { return consumers[i].Consumer < consumers[j].Consumer })
+
+	if !s.queue.cfg.Enabled || !s.ha.Active() {
+		return consumers, nil
+	}
+	readers, err := s.queue.readerLags(ctx)
+	return append(readers, consumers...), err
+}
+
+// readerLags возвращает очередь и отставание каждого читателя потока
+func (q *IngestQueue) readerLags(ctx context.Context) ([]ConsumerLag, error) {
+	last, err := q.redis.XRevRangeN(ctx, q.cfg.Key, "+", "-", 1).Result()
+	if err != nil {
+		return nil, err
+	}
+	readers, err := q.readers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	lags := make([]ConsumerLag, 0, len(readers))
+	for _, reader := range readers {
+		lag := ConsumerLag{Consumer: reader.name, Kind: ConsumerKindStream, LagSeconds: new(float64)}
+		if len(last) > 0 && compareStreamIDs(reader.next, last[0].ID) <= 0 {
+			backlog, err := countEntriesScript.Run(ctx, q.redis, []string{q.cfg.Key}, reader.next, lagBacklogLimit).Int64()
+			if err != nil {
+				return nil, err
+			}
+			lag.Backlog = backlog
+			lastMs, _ := streamIDTime(last[0].ID)
+			readerMs, _ := streamIDTime(reader.next)
+			*lag.LagSeconds = float64(max(lastMs-readerMs, 0)) / 1000
+		}
+		lags = append(lags, lag)
+	}
+	return lags, nil
+}
+
+// PipelineLagHandler отставание асинхронных потребителей конвейера
+func (s *Service) PipelineLagHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.lag.Lag())
+}
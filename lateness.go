@@ -0,0 +1,35 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var lateSamples = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "highload_late_samples_total",
+		Help: "Total number of field values received out of order by result (reordered: inserted before newer values, excluded: older than the lateness horizon and kept out of live statistics)",
+	},
+	[]string{"result"},
+)
+
+// SetLatenessHorizon задает, насколько значение может отставать от самого
+// нового значения поля, чтобы попасть в окно; 0 — без ограничения
+func (mb *MetricsBuffer) SetLatenessHorizon(horizon time.Duration) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.horizon = int64(horizon / time.Second)
+}
+
+// insertionIndex возвращает позицию, сохраняющую порядок значений по времени.
+// Значения приходят почти по порядку, поэтому поиск идет с конца; значение с
+// той же меткой встает после уже имеющихся.
+func insertionIndex(points []Point, timestamp int64) int {
+	i := len(points)
+	for i > 0 && points[i-1].Timestamp > timestamp {
+		i--
+	}
+	return i
+}
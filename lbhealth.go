@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Состояния проверки для балансировщика
+const (
+	LBStatusOK       = "ok"
+	LBStatusShedding = "shedding"
+)
+
+var (
+	lbSaturation = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "highload_lb_saturation",
+			Help: "Saturation of pipeline components reported to the load balancer health check (0..1)",
+		},
+		[]string{"component"},
+	)
+
+	lbHealthFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "highload_lb_health_failures_total",
+		Help: "Total number of load balancer health checks answered with 503 to shed load",
+	})
+)
+
+// LBHealthStatus ответ /health/lb
+type LBHealthStatus struct {
+	Status string `json:"status"`
+	// Saturation наибольшая загрузка среди компонентов
+	Saturation float64            `json:"saturation"`
+	Components map[string]float64 `json:"components"`
+	// FailProbability доля проверок, на которые отвечается 503
+	FailProbability float64 `json:"fail_probability"`
+	SampledAt       int64   `json:"sampled_at"`
+}
+
+// LBHealth оценивает загрузку конвейера для балансировщика. Пока загрузка
+// ниже degrade_at, проверки проходят; после ее превышения экземпляр
+// переходит в shedding и отвечает 503 на долю проверок, растущую от
+// recover_at до fail_at, где отказывают все проверки. Балансировщик
+// постепенно снимает трафик, а не выключает реплику целиком. Выход из
+// shedding — только когда загрузка опустится ниже recover_at, чтобы
+// экземпляр не переключался туда и обратно на границе.
+type LBHealth struct {
+	service *Service
+
+	mu     sync.Mutex
+	cfg    LBHealthConfig
+	status LBHealthStatus
+}
+
+func NewLBHealth(service *Service, cfg LBHealthConfig) *LBHealth {
+	return &LBHealth{
+		service: service,
+		cfg:     cfg,
+		status:  LBHealthStatus{Status: LBStatusOK, Components: map[string]float64{}},
+	}
+}
+
+// Configure применяет новые пороги со следующего замера
+func (h *LBHealth) Configure(cfg LBHealthConfig) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.cfg = cfg
+}
+
+func (h *LBHealth) config() LBHealthConfig {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.cfg
+}
+
+// Run периодически замеряет загрузку
+func (h *LBHealth) Run() {
+	for {
+		h.sample(h.service.saturation())
+		time.Sleep(h.config().SampleInterval)
+	}
+}
+
+// sample обновляет состояние по замеру загрузки компонентов
+func (h *LBHealth) sample(components map[string]float64) {
+	saturation := 0.0
+	for component, value := range components {
+		lbSaturation.WithLabelValues(component).Set(value)
+		saturation = math.Max(saturation, value)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	cfg := h.cfg
+	shedding := h.status.Status == LBStatusShedding
+	switch {
+	case !shedding && saturation >= cfg.DegradeAt:
+		shedding = true
+	case shedding && saturation < cfg.RecoverAt:
+		shedding = false
+	}
+
+	h.status = LBHealthStatus{
+		Status:     LBStatusOK,
+		Saturation: saturation,
+		Components: components,
+		SampledAt:  time.Now().Unix(),
+	}
+	if shedding {
+		h.status.Status = LBStatusShedding
+		p := (saturation - cfg.RecoverAt) / (cfg.FailAt - cfg.RecoverAt)
+		h.status.FailProbability = math.Min(math.Max(p, 0), 1)
+	}
+}
+
+// Status возвращает последний замер
+func (h *LBHealth) Status() LBHealthStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.status
+}
+
+// saturation возвращает загрузку компонентов конвейера от 0 до 1: очередей
+// воркеров и отставания группы потребителей потока от stream_lag_limit
+func (s *Service) saturation() map[string]float64 {
+	components := make(map[string]float64)
+	for name, queue := range s.workerQueues() {
+		if queue.Capacity > 0 {
+			components[name] = float64(queue.Depth) / float64(queue.Capacity)
+		}
+	}
+
+	if s.queue.cfg.Enabled && s.ha.Active() {
+		limit := s.lb.config().StreamLagLimit
+		ctx, cancel := context.WithTimeout(s.ctx, time.Second)
+		defer cancel()
+		if lag, err := s.queue.groupLag(ctx); err == nil {
+			components["stream"] = math.Min(lag.Seconds()/limit.Seconds(), 1)
+		}
+	}
+	return components
+}
+
+// groupLag возвращает отставание группы потребителей: разницу времени
+// последней записи потока и последней выданной группе
+func (q *IngestQueue) groupLag(ctx context.Context) (time.Duration, error) {
+	last, err := q.redis.XRevRangeN(ctx, q.cfg.Key, "+", "-", 1).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return 0, err
+	}
+	if len(last) == 0 {
+		return 0, nil
+	}
+	delivered, _, err := q.lastDelivered(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if compareStreamIDs(delivered, last[0].ID) >= 0 {
+		return 0, nil
+	}
+	lastMs, _ := streamIDTime(last[0].ID)
+	deliveredMs, _ := streamIDTime(delivered)
+	return time.Duration(max(lastMs-deliveredMs, 0)) * time.Millisecond, nil
+}
+
+// LBHealthHandler проверка для балансировщика: 200, пока экземпляр справляется
+// с нагрузкой, и 503 на долю запросов, пропорциональную перегрузке
+func (s *Service) LBHealthHandler(w http.ResponseWriter, r *http.Request) {
+	status := s.lb.Status()
+	code := http.StatusOK
+	if status.FailProbability > 0 && rand.Float64() < status.FailProbability {
+		code = http.StatusServiceUnavailable
+		lbHealthFailures.Inc()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(status)
+}
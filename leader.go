@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	leaderGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "highload_leader",
+		Help: "1 if this replica holds the background jobs leader lease, 0 otherwise",
+	})
+
+	leaderChanges = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "highload_leader_changes_total",
+			Help: "Total number of leadership changes by event (acquired, lost by this replica; observed when the lease moved between other replicas)",
+		},
+		[]string{"event"},
+	)
+)
+
+// LeaderElector выбирает среди реплик одного лидера для фоновых задач,
+// которые должны выполняться ровно один раз (агрегаты интервалов, обрезка
+// потока, отчеты). Лидер держит аренду в Redis и продлевает ее каждые
+// renew_interval; если он перестает это делать, аренда истекает через
+// lease_ttl и ее забирает другая реплика. В отличие от пары active/standby,
+// остальные реплики продолжают принимать и анализировать метрики.
+type LeaderElector struct {
+	redis redis.UniversalClient
+	cfg   LeaderConfig
+	id    string
+
+	mu     sync.Mutex
+	leader bool
+	since  time.Time
+	// holder текущий владелец аренды по последнему чтению из Redis
+	holder string
+	// observed holder уже прочитан хотя бы раз
+	observed bool
+}
+
+func NewLeaderElector(rdb redis.UniversalClient, cfg LeaderConfig) *LeaderElector {
+	le := &LeaderElector{
+		redis: rdb,
+		cfg:   cfg,
+		id:    instanceID(cfg.InstanceID),
+		// Без выборов единственная реплика выполняет все задачи
+		leader: !cfg.Enabled,
+		since:  time.Now(),
+	}
+	if le.leader {
+		le.holder = le.id
+		leaderGauge.Set(1)
+	}
+	return le
+}
+
+// Leader сообщает, выполняет ли реплика фоновые задачи
+func (le *LeaderElector) Leader() bool {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	return le.leader
+}
+
+// LeaderStatus состояние выборов для /api/admin/leader
+type LeaderStatus struct {
+	Enabled    bool   `json:"enabled"`
+	InstanceID string `json:"instance_id"`
+	Leader     bool   `json:"leader"`
+	// Holder текущий лидер; пустой, если аренда никому не принадлежит
+	Holder string `json:"holder"`
+	Since  int64  `json:"since"`
+}
+
+func (le *LeaderElector) Status() LeaderStatus {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	return LeaderStatus{
+		Enabled:    le.cfg.Enabled,
+		InstanceID: le.id,
+		Leader:     le.leader,
+		Holder:     le.holder,
+		Since:      le.since.Unix(),
+	}
+}
+
+// Run захватывает и продлевает аренду до отмены контекста, после чего освобождает ее
+func (le *LeaderElector) Run(ctx context.Context) {
+	ticker := time.NewTicker(le.cfg.RenewInterval)
+	defer ticker.Stop()
+
+	for {
+		le.tick(ctx)
+		select {
+		case <-ctx.Done():
+			le.release()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (le *LeaderElector) tick(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, le.cfg.RenewInterval)
+	defer cancel()
+
+	if le.Leader() {
+		renewed, err := renewLockScript.Run(ctx, le.redis, []string{le.cfg.LeaseKey}, le.id, le.cfg.LeaseTTL.Milliseconds()).Int()
+		if err != nil || renewed == 0 {
+			// Аренду, которую не удалось продлить, считаем потерянной: иначе
+			// после ее истечения задачи выполнят два лидера
+			le.setLeader(false, err)
+		}
+		return
+	}
+
+	acquired, err := le.redis.SetNX(ctx, le.cfg.LeaseKey, le.id, le.cfg.LeaseTTL).Result()
+	if err == nil && acquired {
+		le.setLeader(true, nil)
+		return
+	}
+	if holder, err := le.redis.Get(ctx, le.cfg.LeaseKey).Result(); err == nil || err == redis.Nil {
+		le.observe(holder)
+	}
+}
+
+// observe запоминает лидера, выбранного среди других реплик
+func (le *LeaderElector) observe(holder string) {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	if holder != "" && holder != le.holder && le.observed {
+		leaderChanges.WithLabelValues("observed").Inc()
+	}
+	le.holder = holder
+	le.observed = true
+}
+
+func (le *LeaderElector) setLeader(leader bool, reason error) {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+
+	le.leader = leader
+	le.since = time.Now()
+	if leader {
+		le.holder = le.id
+		leaderGauge.Set(1)
+		leaderChanges.WithLabelValues("acquired").Inc()
+		log.Printf("Acquired leader lease %s as %s", le.cfg.LeaseKey, le.id)
+		return
+	}
+
+	le.holder = ""
+	leaderGauge.Set(0)
+	leaderChanges.WithLabelValues("lost").Inc()
+	if reason != nil {
+		log.Printf("Lost leader lease %s: %v; background jobs stop on this replica", le.cfg.LeaseKey, reason)
+	} else {
+		log.Printf("Lost leader lease %s; background jobs stop on this replica", le.cfg.LeaseKey)
+	}
+}
+
+// release освобождает аренду при остановке, чтобы другая реплика не ждала истечения TTL
+func (le *LeaderElector) release() {
+	if !le.Leader() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	releaseLockScript.Run(ctx, le.redis, []string{le.cfg.LeaseKey}, le.id)
+	le.setLeader(false, nil)
+}
+
+// runsJobs сообщает, выполняет ли экземпляр фоновые задачи, общие для всех
+// реплик: он должен быть активным в паре и лидером среди реплик
+func (s *Service) runsJobs() bool {
+	return s.ha.Active() && s.leader.Leader()
+}
+
+// AdminLeaderHandler показывает состояние выборов лидера
+func (s *Service) AdminLeaderHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.leader.Status())
+}
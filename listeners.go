@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// systemdListenFDsStart первый дескриптор, передаваемый systemd (SD_LISTEN_FDS_START)
+const systemdListenFDsStart = 3
+
+// unixAddrPrefix префикс адреса слушателя на unix-сокете
+const unixAddrPrefix = "unix:"
+
+// listenerServer HTTP-сервер одного слушателя со своим набором маршрутов
+type listenerServer struct {
+	name      string
+	server    *http.Server
+	listeners []net.Listener
+}
+
+// openServers открывает слушатели из секции listeners. Если она пуста, все
+// маршруты обслуживаются одним сервером на адресах из секции server.
+func openServers(cfg *Config, deps routerDeps) ([]listenerServer, error) {
+	if len(cfg.Listeners) == 0 {
+		listeners, err := openListeners(cfg.Server)
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range listeners {
+			log.Printf("Starting server on %s %s...", l.Addr().Network(), l.Addr())
+		}
+		return []listenerServer{{
+			name:      "default",
+			server:    newHTTPServer(cfg.Server, deps.service.corsMiddleware(deps.newRouter(allRouteGroups))),
+			listeners: listeners,
+		}}, nil
+	}
+
+	servers := make([]listenerServer, 0, len(cfg.Listeners))
+	for _, lc := range cfg.Listeners {
+		l, err := listenAddr(lc.Addr, cfg.Server.UnixSocketMode)
+		if err != nil {
+			for _, srv := range servers {
+				for _, opened := range srv.listeners {
+					opened.Close()
+				}
+			}
+			return nil, fmt.Errorf("listener %s: %w", lc.Name, err)
+		}
+
+		middlewares := make([]mux.MiddlewareFunc, 0, 2)
+		if len(lc.AuthTokens) > 0 {
+			name := lc.Name
+			middlewares = append(middlewares, authMiddleware(name, func() []string {
+				return deps.service.listenerTokens(name)
+			}))
+		}
+		if lc.RateLimit.RPS > 0 {
+			middlewares = append(middlewares, rateLimitMiddleware(lc.Name, lc.RateLimit.RPS, lc.RateLimit.Burst))
+		}
+
+		servers = append(servers, listenerServer{
+			name:      lc.Name,
+			server:    newHTTPServer(cfg.Server, deps.service.corsMiddleware(deps.newRouter(lc.Routes, middlewares...))),
+			listeners: []net.Listener{l},
+		})
+		log.Printf("Starting %s listener on %s %s (routes: %s)", lc.Name, l.Addr().Network(), l.Addr(), strings.Join(lc.Routes, ", "))
+	}
+	return servers, nil
+}
+
+// newHTTPServer создает сервер с ограничениями секции server: медленный
+// клиент не держит соединение дольше таймаутов, а тело запроса больше
+// max_body_bytes не читается целиком
+func newHTTPServer(cfg ServerConfig, handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           limitBody(int64(cfg.MaxBodyBytes), handler),
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+	}
+}
+
+// limitBody отклоняет запрос с заявленной длиной тела больше maxBytes и
+// обрывает чтение тела без Content-Length на этой границе
+func limitBody(maxBytes int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > maxBytes {
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// disableWriteTimeout снимает server.write_timeout с потокового ответа,
+// который длится дольше обычного запроса
+func disableWriteTimeout(w http.ResponseWriter) {
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+}
+
+// listenAddr открывает слушатель по адресу host:port или unix:/path
+func listenAddr(addr, unixMode string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, unixAddrPrefix); ok {
+		return listenUnix(path, unixMode)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// openListeners открывает все настроенные слушатели: TCP-порт, unix-сокет
+// и сокеты, переданные systemd при активации
+func openListeners(cfg ServerConfig) ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0, 2)
+	closeAll := func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}
+
+	if cfg.SystemdActivation {
+		activated, err := systemdListeners()
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, activated...)
+	}
+
+	if cfg.Port != "" {
+		l, err := net.Listen("tcp", ":"+cfg.Port)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+
+	if cfg.UnixSocket != "" {
+		l, err := listenUnix(cfg.UnixSocket, cfg.UnixSocketMode)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+
+	if len(listeners) == 0 {
+		return nil, errors.New("no listeners configured")
+	}
+	return listeners, nil
+}
+
+// listenUnix создает unix-сокет, удаляя файл, оставшийся от прошлого запуска
+func listenUnix(path, mode string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	perm, _ := strconv.ParseUint(mode, 8, 32)
+	if err := os.Chmod(path, os.FileMode(perm)); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// systemdListeners возвращает сокеты, переданные systemd (LISTEN_PID/LISTEN_FDS).
+// Переменные окружения удаляются, чтобы дочерние процессы их не унаследовали.
+func systemdListeners() ([]net.Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, errors.New("systemd socket activation enabled but LISTEN_PID does not match this process")
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, errors.New("systemd socket activation enabled but LISTEN_FDS is empty")
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	listeners := make([]net.Listener, 0, count)
+	for i := 0; i < count; i++ {
+		name := "systemd"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		file := os.NewFile(uintptr(systemdListenFDsStart+i), name)
+		l, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			return nil, fmt.Errorf("systemd socket %s: %w", name, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// notifySystemd сообщает systemd о готовности (Type=notify); без NOTIFY_SOCKET ничего не делает
+func notifySystemd(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	if strings.HasPrefix(socket, "@") {
+		// Абстрактное пространство имен Linux
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		log.Printf("Failed to notify systemd: %v", err)
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte(state))
+}
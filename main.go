@@ -1,153 +1,541 @@
 package main
 
 import (
+	"container/list"
 	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"math"
+	"net"
 	"net/http"
 	"os"
+	"regexp"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/go-redis/redis/v8"
-	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-// Metric представляет входящую метрику от IoT устройства
+// Metric представляет входящую метрику от IoT устройства.
+// Значения передаются в произвольном наборе именованных полей Values;
+// поля cpu, rps и memory верхнего уровня поддерживаются для совместимости.
 type Metric struct {
-	Timestamp int64   `json:"timestamp"`
-	DeviceID  string  `json:"device_id"`
-	CPU       float64 `json:"cpu"`
-	RPS       float64 `json:"rps"`
-	Memory    float64 `json:"memory"`
+	Timestamp int64              `json:"timestamp"`
+	DeviceID  string             `json:"device_id"`
+	Tenant    string             `json:"tenant,omitempty"`
+	Values    map[string]float64 `json:"values"`
+	// TraceID трасса запроса, принявшего метрику; переносится через поток ingest
+	TraceID string `json:"trace_id,omitempty"`
+	// DeadlineClass класс срока обработки: realtime, standard (по умолчанию) или bulk
+	DeadlineClass string `json:"deadline_class,omitempty"`
+	// ReceivedAt время приема в миллисекундах, от него отсчитывается срок
+	ReceivedAt int64 `json:"received_at,omitempty"`
+	// Samples несколько значений устройства в одной отправке (шлюзы, копящие
+	// данные локально); взаимоисключающе с Values
+	Samples []MetricSample `json:"samples,omitempty"`
+	// IngestID номер приема, выданный HTTP; по нему отслеживается обработка
+	IngestID string `json:"ingest_id,omitempty"`
+}
+
+// MetricSample одно значение устройства в метрике с несколькими значениями
+type MetricSample struct {
+	Timestamp int64              `json:"timestamp"`
+	Values    map[string]float64 `json:"values"`
+}
+
+// fieldNamePattern допустимые имена полей
+var fieldNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,64}$`)
+
+func (m *Metric) UnmarshalJSON(data []byte) error {
+	type plain Metric
+	var aux struct {
+		plain
+		CPU    *float64 `json:"cpu"`
+		RPS    *float64 `json:"rps"`
+		Memory *float64 `json:"memory"`
+	}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+
+	*m = Metric(aux.plain)
+	if m.Values == nil {
+		m.Values = make(map[string]float64)
+	}
+	for field, value := range map[string]*float64{"cpu": aux.CPU, "rps": aux.RPS, "memory": aux.Memory} {
+		if _, exists := m.Values[field]; value != nil && !exists {
+			m.Values[field] = *value
+		}
+	}
+	return nil
 }
 
 // AnalyticsResult представляет результат анализа
 type AnalyticsResult struct {
 	DeviceID       string  `json:"device_id"`
+	Field          string  `json:"field"`
+	Type           string  `json:"type"`
 	RollingAverage float64 `json:"rolling_average"`
 	ZScore         float64 `json:"z_score"`
 	IsAnomaly      bool    `json:"is_anomaly"`
 	Timestamp      int64   `json:"timestamp"`
 	Value          float64 `json:"value"`
+	Severity       string  `json:"severity,omitempty"`
+	// Probability откалиброванная вероятность аномальности (calibration.go)
+	Probability    float64          `json:"probability,omitempty"`
+	Shift          float64          `json:"shift,omitempty"`
+	OnsetTimestamp int64            `json:"onset_timestamp,omitempty"`
+	IQR            *IQRBounds       `json:"iqr,omitempty"`
+	Correlation    *CorrelationInfo `json:"correlation,omitempty"`
+	Isolation      *IsolationInfo   `json:"isolation,omitempty"`
+	Seasonal       *SeasonalInfo    `json:"seasonal,omitempty"`
+	Trend          *TrendInfo       `json:"trend,omitempty"`
+	ML             *MLInfo          `json:"ml,omitempty"`
+	Rule           *RuleMatch       `json:"rule,omitempty"`
+	// Внешние события, с которыми совпала аномалия, и пометки о них
+	Events      []string `json:"events,omitempty"`
+	Annotations []string `json:"annotations,omitempty"`
+	// Silenced аномалия попала в окна обслуживания Silences, уведомления не отправлялись
+	Silenced bool     `json:"silenced,omitempty"`
+	Silences []string `json:"silences,omitempty"`
+	// TraceID трасса запроса, с метрикой которого обнаружена аномалия
+	TraceID string `json:"trace_id,omitempty"`
+	// IngestID номер приема метрики, по значению которой найден результат
+	IngestID string `json:"ingest_id,omitempty"`
+	// Shadow результат теневого детектора (shadow.go), алерты по нему не отправлялись
+	Shadow bool `json:"shadow,omitempty"`
+	// Unit единицы поля из реестра полей (fields.go)
+	Unit string `json:"unit,omitempty"`
+
+	// Жизненный цикл заполняется для сохраненных аномалий
+	ID           string         `json:"id,omitempty"`
+	Status       string         `json:"status,omitempty"`
+	Acknowledged *AnomalyAction `json:"acknowledged,omitempty"`
+	Resolved     *AnomalyAction `json:"resolved,omitempty"`
+	// Feedback оценка оператора: настоящая аномалия или ложное срабатывание
+	Feedback *AnomalyFeedback `json:"feedback,omitempty"`
+}
+
+// Fields возвращает числовые поля метрики по их именам
+func (m Metric) Fields() map[string]float64 {
+	return m.Values
+}
+
+// Expand возвращает значения метрики по одному в порядке меток времени;
+// метрика без samples возвращается как есть
+func (m Metric) Expand() []Metric {
+	if len(m.Samples) == 0 {
+		return []Metric{m}
+	}
+	metrics := make([]Metric, len(m.Samples))
+	for i, sample := range m.Samples {
+		metric := m
+		metric.Timestamp, metric.Values, metric.Samples = sample.Timestamp, sample.Values, nil
+		metrics[i] = metric
+	}
+	sort.SliceStable(metrics, func(i, j int) bool { return metrics[i].Timestamp < metrics[j].Timestamp })
+	return metrics
+}
+
+// Validate проверяет идентификатор устройства, число полей, их имена и
+// конечность значений, а для метрики с несколькими значениями — каждое значение
+func (m Metric) Validate(maxFields, maxSamples int) error {
+	if m.DeviceID == "" {
+		return fmt.Errorf("device_id is required")
+	}
+	if err := validateDeadlineClass(m.DeadlineClass); err != nil {
+		return err
+	}
+	if m.Timestamp < 0 {
+		return fmt.Errorf("timestamp must not be negative")
+	}
+	if len(m.Samples) == 0 {
+		return validateValues(m.Values, maxFields)
+	}
+	if len(m.Values) > 0 {
+		return fmt.Errorf("values and samples are mutually exclusive")
+	}
+	if len(m.Samples) > maxSamples {
+		return fmt.Errorf("too many samples: %d, max %d", len(m.Samples), maxSamples)
+	}
+	for i, sample := range m.Samples {
+		// Без метки все значения получили бы одно время приема
+		if sample.Timestamp == 0 {
+			return fmt.Errorf("samples[%d]: timestamp is required", i)
+		}
+		if sample.Timestamp < 0 {
+			return fmt.Errorf("samples[%d]: timestamp must not be negative", i)
+		}
+		if err := validateValues(sample.Values, maxFields); err != nil {
+			return fmt.Errorf("samples[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func validateValues(values map[string]float64, maxFields int) error {
+	if len(values) == 0 {
+		return fmt.Errorf("at least one value is required")
+	}
+	if len(values) > maxFields {
+		return fmt.Errorf("too many fields: %d, max %d", len(values), maxFields)
+	}
+	for field, value := range values {
+		if !validFieldName(field) {
+			return fmt.Errorf("invalid field name %q", field)
+		}
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return fmt.Errorf("field %q: value is not finite", field)
+		}
+	}
+	return nil
+}
+
+func validFieldName(name string) bool {
+	return fieldNamePattern.MatchString(name)
+}
+
+// Point представляет одно значение поля с временной меткой
+type Point struct {
+	Timestamp int64   `json:"timestamp"`
+	Value     float64 `json:"value"`
 }
 
 // MetricsBuffer хранит метрики для анализа
 type MetricsBuffer struct {
 	mu      sync.RWMutex
-	data    map[string][]float64
+	data    map[string]map[string][]Point // device_id -> field -> значения по времени
 	window  int
 	maxSize int
+	// horizon допустимое опоздание значения в секундах, 0 — без ограничения
+	horizon int64
+	// lru устройства от последнего обновленного к давно не обновлявшимся
+	lru    *list.List
+	recent map[string]*list.Element
+	// usage оценка памяти по устройствам и их сумма memory (eviction.go)
+	usage  map[string]int
+	memory int
 }
 
-func NewMetricsBuffer(window int) *MetricsBuffer {
+func NewMetricsBuffer(window, maxSize int) *MetricsBuffer {
 	return &MetricsBuffer{
-		data:    make(map[string][]float64),
+		data:    make(map[string]map[string][]Point),
 		window:  window,
-		maxSize: 1000,
+		maxSize: maxSize,
+		lru:     list.New(),
+		recent:  make(map[string]*list.Element),
+		usage:   make(map[string]int),
 	}
 }
 
-func (mb *MetricsBuffer) Add(deviceID string, value float64) {
+// Add вставляет значение поля в порядке меток времени. Значение, опоздавшее
+// больше чем на горизонт относительно самого нового значения поля, в окно не
+// попадает: Add возвращает false, и значение не должно учитываться в живой
+// статистике и анализе.
+func (mb *MetricsBuffer) Add(deviceID, field string, timestamp int64, value float64) bool {
 	mb.mu.Lock()
 	defer mb.mu.Unlock()
+	defer mb.account(deviceID)
 
-	if _, exists := mb.data[deviceID]; !exists {
-		mb.data[deviceID] = make([]float64, 0, mb.maxSize)
+	fields, exists := mb.data[deviceID]
+	if !exists {
+		fields = make(map[string][]Point)
+		mb.data[deviceID] = fields
+	}
+	mb.touch(deviceID)
+	if _, exists := fields[field]; !exists {
+		fields[field] = make([]Point, 0, mb.maxSize)
 	}
 
-	mb.data[deviceID] = append(mb.data[deviceID], value)
+	points := fields[field]
+	i := insertionIndex(points, timestamp)
+	if i < len(points) {
+		if newest := points[len(points)-1].Timestamp; mb.horizon > 0 && newest-timestamp > mb.horizon {
+			lateSamples.WithLabelValues("excluded").Inc()
+			return false
+		}
+		lateSamples.WithLabelValues("reordered").Inc()
+	}
+	points = append(points, Point{})
+	copy(points[i+1:], points[i:])
+	points[i] = Point{Timestamp: timestamp, Value: value}
 
 	// Ограничиваем размер буфера
-	if len(mb.data[deviceID]) > mb.maxSize {
-		mb.data[deviceID] = mb.data[deviceID][len(mb.data[deviceID])-mb.maxSize:]
+	if len(points) > mb.maxSize {
+		points = points[len(points)-mb.maxSize:]
 	}
+	fields[field] = points
+	return true
 }
 
-func (mb *MetricsBuffer) GetRollingAverage(deviceID string) float64 {
+// Limits возвращает размер окна и максимальный размер буфера
+func (mb *MetricsBuffer) Limits() (int, int) {
 	mb.mu.RLock()
 	defer mb.mu.RUnlock()
+	return mb.window, mb.maxSize
+}
 
-	values, exists := mb.data[deviceID]
-	if !exists || len(values) == 0 {
-		return 0
+// SetLimits меняет размер окна и буфера; лишние старые значения отбрасываются
+func (mb *MetricsBuffer) SetLimits(window, maxSize int) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	mb.window = window
+	mb.maxSize = maxSize
+	for deviceID, fields := range mb.data {
+		for field, values := range fields {
+			if len(values) > maxSize {
+				fields[field] = append([]Point(nil), values[len(values)-maxSize:]...)
+			}
+		}
+		mb.account(deviceID)
 	}
+}
 
-	// Вычисляем скользящее среднее по последним N значениям
-	start := 0
-	if len(values) > mb.window {
-		start = len(values) - mb.window
+// Devices возвращает идентификаторы всех устройств в буфере
+func (mb *MetricsBuffer) Devices() []string {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+
+	devices := make([]string, 0, len(mb.data))
+	for deviceID := range mb.data {
+		devices = append(devices, deviceID)
 	}
+	return devices
+}
 
-	sum := 0.0
-	count := 0
-	for i := start; i < len(values); i++ {
-		sum += values[i]
-		count++
+// DeviceSnapshot возвращает копию значений всех полей устройства
+func (mb *MetricsBuffer) DeviceSnapshot(deviceID string) map[string][]Point {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+
+	snapshot := make(map[string][]Point, len(mb.data[deviceID]))
+	for field, points := range mb.data[deviceID] {
+		snapshot[field] = append([]Point(nil), points...)
 	}
+	return snapshot
+}
 
-	if count == 0 {
-		return 0
+// Points возвращает копию сохраненных значений поля устройства
+func (mb *MetricsBuffer) Points(deviceID, field string) []Point {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+
+	points := mb.data[deviceID][field]
+	result := make([]Point, len(points))
+	copy(result, points)
+	return result
+}
+
+// WindowValues возвращает копию значений поля из текущего окна
+func (mb *MetricsBuffer) WindowValues(deviceID, field string) []float64 {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+
+	points := mb.data[deviceID][field]
+	if len(points) > mb.window {
+		points = points[len(points)-mb.window:]
+	}
+	values := make([]float64, len(points))
+	for i, point := range points {
+		values[i] = point.Value
 	}
+	return values
+}
 
-	return sum / float64(count)
+// FieldStats содержит статистику поля устройства по текущему окну
+type FieldStats struct {
+	Samples        int     `json:"samples"`
+	RollingAverage float64 `json:"rolling_average"`
+	StdDev         float64 `json:"std_dev"`
+	LastTimestamp  int64   `json:"last_timestamp"`
+	LastValue      float64 `json:"last_value"`
 }
 
-func (mb *MetricsBuffer) GetZScore(deviceID string, currentValue float64) float64 {
+// DeviceStats возвращает статистику по всем полям устройства
+func (mb *MetricsBuffer) DeviceStats(deviceID string) (map[string]FieldStats, bool) {
 	mb.mu.RLock()
 	defer mb.mu.RUnlock()
 
-	values, exists := mb.data[deviceID]
-	if !exists || len(values) < 2 {
-		return 0
+	fields, exists := mb.data[deviceID]
+	if !exists {
+		return nil, false
 	}
 
-	// Вычисляем среднее и стандартное отклонение
+	stats := make(map[string]FieldStats, len(fields))
+	for field, values := range fields {
+		mean, stdDev := mb.windowStats(values)
+		fieldStats := FieldStats{
+			Samples:        len(values),
+			RollingAverage: mean,
+			StdDev:         stdDev,
+		}
+		if len(values) > 0 {
+			fieldStats.LastTimestamp = values[len(values)-1].Timestamp
+			fieldStats.LastValue = values[len(values)-1].Value
+		}
+		stats[field] = fieldStats
+	}
+	return stats, true
+}
+
+// windowStats вычисляет среднее и стандартное отклонение по последним window значениям
+func (mb *MetricsBuffer) windowStats(values []Point) (float64, float64) {
 	start := 0
 	if len(values) > mb.window {
 		start = len(values) - mb.window
 	}
+	window := values[start:]
+	if len(window) == 0 {
+		return 0, 0
+	}
 
 	var sum float64
-	count := 0
-	for i := start; i < len(values); i++ {
-		sum += values[i]
-		count++
+	for _, point := range window {
+		sum += point.Value
 	}
+	mean := sum / float64(len(window))
 
-	if count == 0 {
+	var variance float64
+	for _, point := range window {
+		diff := point.Value - mean
+		variance += diff * diff
+	}
+	variance /= float64(len(window))
+
+	return mean, math.Sqrt(variance)
+}
+
+// MemoryUsage оценивает объем памяти, занимаемый данными устройства, в байтах
+func (mb *MetricsBuffer) MemoryUsage(deviceID string) int {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+
+	return mb.usage[deviceID]
+}
+
+// Take удаляет все значения устройства и возвращает их; false, если устройство неизвестно
+func (mb *MetricsBuffer) Take(deviceID string) (map[string][]Point, bool) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	fields, exists := mb.data[deviceID]
+	if !exists {
+		return nil, false
+	}
+	mb.remove(deviceID)
+	return fields, true
+}
+
+// Restore возвращает ранее изъятые значения устройства. Значения, поступившие
+// после изъятия, сохраняются и идут после восстановленных.
+func (mb *MetricsBuffer) Restore(deviceID string, snapshot map[string][]Point) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	fields, exists := mb.data[deviceID]
+	if !exists {
+		fields = make(map[string][]Point)
+		mb.data[deviceID] = fields
+	}
+	mb.touch(deviceID)
+	for field, points := range snapshot {
+		merged := append(points, fields[field]...)
+		if len(merged) > mb.maxSize {
+			merged = merged[len(merged)-mb.maxSize:]
+		}
+		fields[field] = merged
+	}
+	mb.account(deviceID)
+}
+
+func (mb *MetricsBuffer) GetRollingAverage(deviceID, field string) float64 {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+
+	values, exists := mb.data[deviceID][field]
+	if !exists || len(values) == 0 {
 		return 0
 	}
 
-	mean := sum / float64(count)
+	// Вычисляем скользящее среднее по последним N значениям
+	start := 0
+	if len(values) > mb.window {
+		start = len(values) - mb.window
+	}
 
-	// Стандартное отклонение
-	var variance float64
+	sum := 0.0
+	count := 0
 	for i := start; i < len(values); i++ {
-		diff := values[i] - mean
-		variance += diff * diff
+		sum += values[i].Value
+		count++
 	}
-	variance /= float64(count)
-	stdDev := math.Sqrt(variance)
 
-	if stdDev == 0 {
+	if count == 0 {
 		return 0
 	}
 
-	// Z-score
-	zScore := (currentValue - mean) / stdDev
-	return zScore
+	return sum / float64(count)
 }
 
 // Service представляет основной сервис
 type Service struct {
-	redis          *redis.Client
+	configMu       sync.RWMutex
+	config         *Config
+	configPath     string
+	reloadState    ReloadState
+	configHistory  []configVersion
+	redis          redis.UniversalClient
 	metricsBuffer  *MetricsBuffer
+	stats          RollingStats
+	shared         *SharedStats
+	anomalies      *AnomalyStore
+	fleet          *FleetSketch
+	sketches       *DeviceSketches
+	calibration    *Calibrator
+	health         *HealthRegistry
+	jobs           *JobScheduler
+	policies       TenantPolicies
+	trash          *Trash
+	alerts         *AlertDispatcher
+	forensics      *ForensicStore
+	queue          *IngestQueue
+	sampling       *SamplingController
+	archive        *ClickHouseSink
+	ha             *FailoverCoordinator
+	leader         *LeaderElector
+	cluster        *Cluster
+	pipeline       *Pipeline
+	migrator       *Migrator
+	events         *EventStore
+	feed           *AnomalyFeed
+	slas           *SLATracker
+	deviceTokens   *DeviceTokenStore
+	feedback       *FeedbackTuner
+	metadata       *DeviceMetadataStore
+	fields         *FieldRegistry
+	ingestStatus   *IngestTracker
+	reports        *ReportScheduler
+	forwarding     *Forwarding
+	quotas         *QuotaTracker
+	dedup          *Deduplicator
+	synthetic      *SyntheticMonitor
+	batches        *BatchScheduler
+	udp            *UDPListener
+	nats           *NATSBridge
+	lb             *LBHealth
+	admission      *AdmissionController
+	lag            *LagMonitor
+	rules          *RuleEngine
+	silences       *SilenceStore
+	rollups        *RollupAggregator
+	detectors      []Detector
+	shadow         *ShadowMode
 	ctx            context.Context
 	anomalyChannel chan AnalyticsResult
 }
@@ -159,7 +547,7 @@ var (
 			Name: "highload_requests_total",
 			Help: "Total number of requests",
 		},
-		[]string{"endpoint"},
+		[]string{"endpoint", "method", "status"},
 	)
 
 	requestDuration = promauto.NewHistogramVec(
@@ -168,7 +556,15 @@ var (
 			Help:    "Request duration in seconds",
 			Buckets: prometheus.DefBuckets,
 		},
-		[]string{"endpoint"},
+		[]string{"endpoint", "method", "status"},
+	)
+
+	requestsInFlight = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "highload_requests_in_flight",
+			Help: "Number of HTTP requests currently being served by route and method",
+		},
+		[]string{"endpoint", "method"},
 	)
 
 	anomaliesDetected = promauto.NewCounter(
@@ -193,12 +589,8 @@ var (
 	)
 )
 
-func NewService(redisAddr string) *Service {
-	rdb := redis.NewClient(&redis.Options{
-		Addr:     redisAddr,
-		Password: "",
-		DB:       0,
-	})
+func NewService(cfg *Config, configPath string) *Service {
+	rdb := newRedisClient(cfg.Redis)
 
 	ctx := context.Background()
 
@@ -207,81 +599,397 @@ func NewService(redisAddr string) *Service {
 	if err != nil {
 		log.Printf("Warning: Redis connection failed: %v. Continuing without Redis.", err)
 	} else {
-		log.Println("Successfully connected to Redis")
+		log.Printf("Successfully connected to Redis (%s mode)", cfg.Redis.Mode)
+	}
+
+	buffer := NewMetricsBuffer(cfg.Buffer.Window, cfg.Buffer.MaxSize)
+	buffer.SetLatenessHorizon(cfg.Buffer.LatenessHorizon)
+	ha := NewFailoverCoordinator(rdb, cfg.HA)
+	leader := NewLeaderElector(rdb, cfg.Leader)
+
+	// Общая статистика в Redis согласует z-score между репликами
+	var stats RollingStats = buffer
+	var shared *SharedStats
+	if cfg.SharedStats.Enabled {
+		shared = NewSharedStats(rdb, cfg.SharedStats, buffer, ha.Active)
+		stats = shared
 	}
 
-	return &Service{
+	jobs := NewJobScheduler(cfg.Jobs)
+	feedback := NewFeedbackTuner(rdb, cfg.Feedback)
+	fields := NewFieldRegistry(rdb, cfg.Fields)
+	s := &Service{
+		config:         cfg,
+		configPath:     configPath,
+		reloadState:    ReloadState{LoadedAt: time.Now().Unix()},
 		redis:          rdb,
-		metricsBuffer:  NewMetricsBuffer(50),
+		metricsBuffer:  buffer,
+		stats:          stats,
+		shared:         shared,
+		anomalies:      NewAnomalyStore(cfg.Anomalies.Retention, cfg.Anomalies.MaxPerDevice),
+		fleet:          NewFleetSketch(fleetSketchPeriod),
+		sketches:       NewDeviceSketches(),
+		calibration:    NewCalibrator(cfg.Calibration),
+		health:         NewHealthRegistry(cfg.Health.CheckTimeout),
+		jobs:           jobs,
+		policies:       cfg.Tenants.Policies,
+		trash:          NewTrash(cfg.Admin.TrashRetention),
+		alerts:         NewAlertDispatcher(buildNotifiers(cfg.Alerting), cfg.Alerting.Batching, cfg.Alerting.QueueSize, cfg.Alerting.Timeout),
+		forensics:      NewForensicStore(rdb, cfg.Forensics),
+		sampling:       NewSamplingController(rdb, cfg.Sampling),
+		archive:        NewClickHouseSink(cfg.ClickHouse, jobs),
+		ha:             ha,
+		leader:         leader,
+		cluster:        NewCluster(rdb, cfg.Cluster, cfg.Server.Port, cfg.TLS),
+		migrator:       NewMigrator(rdb, cfg.Migrations),
+		events:         NewEventStore(cfg.Events),
+		silences:       NewSilenceStore(rdb, cfg.Silences),
+		feed:           NewAnomalyFeed(),
+		slas:           NewSLATracker(cfg.SLAs),
+		deviceTokens:   NewDeviceTokenStore(rdb, cfg.DeviceTokens),
+		feedback:       feedback,
+		metadata:       NewDeviceMetadataStore(rdb, cfg.Cohorts),
+		fields:         fields,
+		ingestStatus:   NewIngestTracker(rdb, cfg.Ingest),
+		forwarding:     NewForwarding(ctx, cfg.Forwarders),
+		quotas:         NewQuotaTracker(cfg.Quotas),
+		dedup:          NewDeduplicator(rdb, cfg.Dedup),
+		batches:        NewBatchScheduler(cfg.Batch),
+		detectors:      buildDetectors(cfg.pipelineDetectors(), stats, buffer, rdb, ha.Active, feedback, fields),
+		shadow:         NewShadowMode(cfg.Shadow, buffer),
 		ctx:            ctx,
 		anomalyChannel: make(chan AnalyticsResult, 100),
 	}
+	s.recordConfig(cfg)
+	s.queue = NewIngestQueue(s, rdb, cfg.Stream)
+	s.pipeline = NewPipeline(cfg, s)
+	s.nats = NewNATSBridge(s, cfg.NATS, s.pipeline.sources[SourceTypeNATS] != nil)
+	s.synthetic = NewSyntheticMonitor(s, cfg.Synthetic)
+	s.lb = NewLBHealth(s, cfg.LBHealth)
+	s.admission = NewAdmissionController(s, cfg.Admission)
+	s.jobs.SetLoad(func() float64 { return s.lb.Status().Saturation })
+	s.lag = NewLagMonitor(s)
+	s.rules = NewRuleEngine(rdb, cfg.Rules, buffer, s.publishResult)
+	s.reports = NewReportScheduler(s, rdb, cfg.Reports)
+	s.rollups = NewRollupAggregator(rdb, cfg.Rollups, cfg.Stream, s.runsJobs, jobs)
+	s.registerHealthChecks()
+	return s
 }
 
 // MetricsHandler обрабатывает входящие метрики
 func (s *Service) MetricsHandler(w http.ResponseWriter, r *http.Request) {
-	timer := prometheus.NewTimer(requestDuration.WithLabelValues("/metrics"))
-	defer timer.ObserveDuration()
-	requestsTotal.WithLabelValues("/metrics").Inc()
+	if !s.pipeline.Accepts(SourceTypeHTTP) {
+		http.Error(w, "http source is not configured in pipeline", http.StatusNotFound)
+		return
+	}
+
+	body, err := readBody(r, s.maxDecompressedBytes())
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
 
 	var metric Metric
-	if err := json.NewDecoder(r.Body).Decode(&metric); err != nil {
+	var unknown []string
+	if isProtobuf(r.Header.Get("Content-Type")) {
+		if metric, unknown, err = decodeMetricProto(body); err != nil {
+			http.Error(w, "Invalid protobuf", http.StatusBadRequest)
+			return
+		}
+	} else if err := json.Unmarshal(body, &metric); err != nil {
 		http.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
 
 	// Валидация
-	if metric.DeviceID == "" {
-		http.Error(w, "device_id is required", http.StatusBadRequest)
+	if err := metric.Validate(s.maxFields(), s.maxSamples()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.fields.Check(metric); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	idempotencyKey := r.Header.Get(idempotencyKeyHeader)
+	if len(idempotencyKey) > maxIdempotencyKeyLength {
+		http.Error(w, fmt.Sprintf("%s header is too long, max %d bytes", idempotencyKeyHeader, maxIdempotencyKeyLength), http.StatusBadRequest)
 		return
 	}
 
-	// Добавляем метрику в буфер
-	s.metricsBuffer.Add(metric.DeviceID, metric.CPU)
+	setLogDeviceID(r, metric.DeviceID)
+	// Номер приема выдает только сервис, присланный клиентом не учитывается
+	metric.IngestID = s.ingestStatus.NewID()
+	tokenTenant, err := s.deviceTokens.Authenticate(SourceTypeHTTP, metric.DeviceID, r.Header.Get(deviceTokenHeader))
+	if err != nil {
+		writeDeviceTokenError(w, err)
+		return
+	}
+	tenant := s.resolveTenant(tokenTenant, r.Header.Get("Authorization"), r.Header.Get(tenantHeader), s.cluster.Forwarded(r))
+	policy := s.policyFor(tenant)
+	label := s.tenantLabel(tenant)
+	if policy.DenyUnknownFields && !isProtobuf(r.Header.Get("Content-Type")) {
+		if unknown, err = unknownMetricKeys(body); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+	}
+	if policy.DenyUnknownFields && len(unknown) > 0 {
+		http.Error(w, "unknown fields: "+strings.Join(unknown, ", "), http.StatusBadRequest)
+		return
+	}
+
+	// Окно устройства хранится на владельце, ему и пересылаем метрику
+	if s.forwardIngest(w, r, tenant, metric.DeviceID, body) {
+		return
+	}
+
+	// При перегрузке некритичная метрика отклоняется до учета в квотах
+	if !s.admission.Admit(SourceTypeHTTP, metric.DeviceID) {
+		w.Header().Set("Retry-After", s.admission.RetryAfter())
+		http.Error(w, "service overloaded, retry later", http.StatusServiceUnavailable)
+		return
+	}
+
+	decision := s.quotas.AllowN(tenant, metric.DeviceID, max(len(metric.Samples), 1))
+	writeQuotaHeaders(w, decision)
+	if !decision.Allowed {
+		http.Error(w, decision.Scope+" quota exceeded", http.StatusTooManyRequests)
+		return
+	}
+
+	if s.dedup.Deduplicate(r.Context(), SourceTypeHTTP, tenant, idempotencyKey, &metric) {
+		// Повтор с Idempotency-Key получает номер исходной отправки
+		response := map[string]string{
+			"status":  "duplicate",
+			"message": "Metric was already received",
+		}
+		if metric.IngestID != "" {
+			response["ingest_id"] = metric.IngestID
+			w.Header().Set("Location", ingestStatusPath(metric.IngestID))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	metric.Tenant = tenant
+	for i := range metric.Samples {
+		metric.Samples[i].Values = restrictFields(label, policy, metric.Samples[i].Values)
+	}
+	s.submit(r.Context(), SourceTypeHTTP, metric, restrictFields(label, policy, metric.Fields()))
+
+	writeSamplingHeaders(w, s.sampling.Directive(metric.DeviceID))
+	response := map[string]string{
+		"status":  "accepted",
+		"message": "Metric received and queued for processing",
+	}
+	if metric.IngestID != "" {
+		response["ingest_id"] = metric.IngestID
+		w.Header().Set("Location", ingestStatusPath(metric.IngestID))
+	}
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(response)
+}
+
+// ingest сохраняет разрешенные поля метрики и запускает ее анализ
+func (s *Service) ingest(metric Metric, fields map[string]float64) {
+	if len(metric.Samples) > 0 {
+		s.ingestSamples(metric)
+		return
+	}
+	if metric.Timestamp == 0 {
+		metric.Timestamp = time.Now().Unix()
+	}
+	metric.Values = fields
 
 	// Обновляем Prometheus метрики
 	metricsProcessed.Inc()
-	currentRPS.Set(metric.RPS)
+	if rps, ok := fields["rps"]; ok {
+		currentRPS.Set(rps)
+	}
 
-	// Кэшируем в Redis
-	go s.cacheMetric(metric)
+	// Резервный экземпляр только прогревает состояние, в приемники пишет активный
+	if s.ha.Active() {
+		s.pipeline.Emit(metric)
+		s.forwarding.Metric(metric)
+	}
+
+	// Пакетные устройства учитываются и анализируются целым пакетом по расписанию
+	if s.batches.Stage(metric, fields) {
+		s.ingestStatus.Record(metric.IngestID, "processed_at", time.Now().UnixMilli(), "batched", 1)
+		return
+	}
+	live := s.observeMetric(metric, fields)
+	if len(live) == 0 {
+		s.ingestStatus.Record(metric.IngestID, "processed_at", time.Now().UnixMilli(), "late", 1)
+		return
+	}
+	s.ingestStatus.Record(metric.IngestID, "processed_at", time.Now().UnixMilli())
 
 	// Анализируем в отдельной горутине
-	go s.analyzeMetric(metric)
+	goSafe("analyze", func() {
+		s.analyzeMetric(metric, live)
+		s.ingestStatus.Record(metric.IngestID, "analyzed", 1)
+	})
+}
 
-	w.WriteHeader(http.StatusAccepted)
-	json.NewEncoder(w).Encode(map[string]string{
-		"status":  "accepted",
-		"message": "Metric received and queued for processing",
+// ingestSamples обрабатывает метрику с несколькими значениями в порядке меток
+// времени. Значения учитываются и анализируются по одному в одной горутине:
+// анализ значения видит в окне только более ранние значения этой метрики.
+func (s *Service) ingestSamples(metric Metric) {
+	samples := metric.Expand()
+	metricsProcessed.Add(float64(len(samples)))
+	if rps, ok := samples[len(samples)-1].Values["rps"]; ok {
+		currentRPS.Set(rps)
+	}
+
+	if s.ha.Active() {
+		for _, sample := range samples {
+			s.pipeline.Emit(sample)
+			s.forwarding.Metric(sample)
+		}
+	}
+
+	live := samples[:0]
+	for _, sample := range samples {
+		if !s.batches.Stage(sample, sample.Values) {
+			live = append(live, sample)
+		}
+	}
+	if len(live) == 0 {
+		s.ingestStatus.Record(metric.IngestID, "processed_at", time.Now().UnixMilli(), "batched", 1)
+		return
+	}
+	s.ingestStatus.Record(metric.IngestID, "processed_at", time.Now().UnixMilli())
+	goSafe("analyze", func() {
+		analyzed := false
+		for _, sample := range live {
+			if fields := s.observeMetric(sample, sample.Values); len(fields) > 0 {
+				s.analyzeMetric(sample, fields)
+				analyzed = true
+			}
+		}
+		if analyzed {
+			s.ingestStatus.Record(metric.IngestID, "analyzed", 1)
+		} else {
+			s.ingestStatus.Record(metric.IngestID, "late", 1)
+		}
 	})
 }
 
+// observeMetric добавляет значения метрики в буфер, скетчи и учет SLA и
+// возвращает поля для анализа. Опоздавшие дальше buffer.lateness_horizon
+// значения только учитываются в highload_late_samples_total: в окно, скетчи,
+// SLA и детекторы они не попадают.
+func (s *Service) observeMetric(metric Metric, fields map[string]float64) map[string]float64 {
+	live := make(map[string]float64, len(fields))
+	for field, value := range fields {
+		if !s.metricsBuffer.Add(metric.DeviceID, field, metric.Timestamp, value) {
+			continue
+		}
+		live[field] = value
+		s.fleet.Add(metric.DeviceID, field, value)
+		s.sketches.Add(metric.DeviceID, field, metric.Timestamp, value)
+	}
+	if len(live) > 0 {
+		s.slas.Observe(metric.DeviceID, metric.Timestamp, live)
+	}
+	s.forensics.Observe(metric)
+	s.sampling.Record(metric)
+	return live
+}
+
 func (s *Service) cacheMetric(metric Metric) {
 	key := fmt.Sprintf("metric:%s:%d", metric.DeviceID, metric.Timestamp)
 	data, _ := json.Marshal(metric)
-	s.redis.Set(s.ctx, key, data, 10*time.Minute)
+	pipe := s.redis.Pipeline()
+	pipe.Set(s.ctx, key, data, 10*time.Minute)
+	// Eval, а не EvalSha: в конвейере нет повтора при NOSCRIPT
+	cacheLatestScript.Eval(s.ctx, pipe, []string{metricLatestKey(metric.DeviceID)},
+		metric.Timestamp, data, (10 * time.Minute).Milliseconds())
+	if _, err := pipe.Exec(s.ctx); err == nil {
+		s.ingestStatus.Record(metric.IngestID, "cached", 1)
+	}
 }
 
-func (s *Service) analyzeMetric(metric Metric) {
-	rollingAvg := s.metricsBuffer.GetRollingAverage(metric.DeviceID)
-	zScore := s.metricsBuffer.GetZScore(metric.DeviceID, metric.CPU)
-
-	// Порог для аномалий: |z-score| > 2
-	isAnomaly := math.Abs(zScore) > 2.0
-
-	if isAnomaly {
-		anomaliesDetected.Inc()
-		log.Printf("Anomaly detected! Device: %s, CPU: %.2f, Z-Score: %.2f",
-			metric.DeviceID, metric.CPU, zScore)
+func (s *Service) analyzeMetric(metric Metric, fields map[string]float64) {
+	for field, value := range fields {
+		point := Point{Timestamp: metric.Timestamp, Value: value}
+		flagged := false
+		for _, detector := range s.activeDetectors() {
+			if !detector.Applies(field) {
+				continue
+			}
+			result := detector.Detect(metric.DeviceID, field, point)
+			s.pipeline.RecordDetection(detector.Name(), result != nil && result.IsAnomaly)
+			if result != nil {
+				flagged = flagged || result.IsAnomaly
+				result.TraceID = metric.TraceID
+				result.IngestID = metric.IngestID
+				s.publishResult(*result)
+			}
+		}
+		s.shadow.Evaluate(metric, field, point, flagged, s.ha.Active())
 	}
+}
 
-	result := AnalyticsResult{
-		DeviceID:       metric.DeviceID,
-		RollingAverage: rollingAvg,
-		ZScore:         zScore,
-		IsAnomaly:      isAnomaly,
-		Timestamp:      metric.Timestamp,
-		Value:          metric.CPU,
+func (s *Service) publishResult(result AnalyticsResult) {
+	// Распределения оценок пополняются и на резервном экземпляре
+	result.Probability = s.calibration.Observe(result)
+	result.Unit = s.fields.Unit(result.DeviceID, result.Field)
+	if !s.ha.Active() {
+		// Резервный экземпляр обновляет состояние детекторов, но не публикует результаты
+		return
+	}
+	if result.IsAnomaly {
+		result.Severity = classifySeverity(result, s.criticalZScore())
+		incWithTrace(anomaliesDetected, result.TraceID)
+		if result.Type == AnomalyTypeChangePoint {
+			log.Printf("Change point detected! Device: %s, %s shifted by %.2f since %d",
+				result.DeviceID, result.Field, result.Shift, result.OnsetTimestamp)
+		} else if result.Type == AnomalyTypeDecorrelation {
+			log.Printf("Decorrelation detected! Device: %s, %s: %.2f, expected %.2f from %s (r=%.2f)",
+				result.DeviceID, result.Field, result.Value, result.Correlation.Expected,
+				result.Correlation.With, result.Correlation.Coefficient)
+		} else if result.Type == AnomalyTypeIsolation {
+			log.Printf("Unusual field combination detected! Device: %s, %v, score %.2f (most deviating: %s)",
+				result.DeviceID, result.Isolation.Vector, result.Isolation.Score, result.Field)
+		} else if result.Type == AnomalyTypeSeasonal {
+			log.Printf("Seasonal anomaly detected! Device: %s, %s: %.2f, usual for %s %.2f ± %.2f",
+				result.DeviceID, result.Field, result.Value, result.Seasonal.Bucket, result.RollingAverage, result.Seasonal.StdDev)
+		} else if result.Type == AnomalyTypeTrend {
+			log.Printf("Sustained trend detected! Device: %s, %s: %.2f per hour since %d (R²=%.2f)",
+				result.DeviceID, result.Field, result.Trend.Slope, result.OnsetTimestamp, result.Trend.RSquared)
+		} else if result.Type == AnomalyTypeML {
+			log.Printf("Model %s flagged anomaly! Device: %s, %s: %.2f, probability %.2f",
+				result.ML.Model, result.DeviceID, result.Field, result.Value, result.ML.ModelProbability)
+		} else if result.Type == AnomalyTypeRule {
+			log.Printf("Rule %s fired! Device: %s, %v", result.Rule.Name, result.DeviceID, result.Rule.Values)
+		} else if result.Type == AnomalyTypeIQR {
+			log.Printf("Outlier detected! Device: %s, %s: %.2f outside [%.2f, %.2f]",
+				result.DeviceID, result.Field, result.Value, result.IQR.Lower, result.IQR.Upper)
+		} else {
+			log.Printf("Anomaly detected! Device: %s, %s: %.2f, Z-Score: %.2f",
+				result.DeviceID, result.Field, result.Value, result.ZScore)
+		}
+		annotate(&result, s.events.Matching(result.DeviceID, result.Timestamp))
+		if silences := s.silences.Matching(result.DeviceID, result.Timestamp); len(silences) > 0 {
+			result.Silenced, result.Silences = true, silences
+		}
+		var stored bool
+		if result, stored = s.anomalies.Add(result); stored {
+			s.ingestStatus.Record(result.IngestID, ingestAnomalyPrefix+result.ID, result.Type+":"+result.Field)
+			s.forensics.Capture(result, s.metricsBuffer)
+		}
+		s.sampling.Trigger(result)
+		if result.Silenced {
+			silencedAnomalies.Inc()
+		} else {
+			s.alerts.Enqueue(result)
+		}
+		s.feed.Publish(result)
+		s.forwarding.Anomaly(result)
+		s.nats.Anomaly(result)
 	}
 
 	// Отправляем результат в канал
@@ -292,44 +1000,69 @@ func (s *Service) analyzeMetric(metric Metric) {
 	}
 }
 
-// AnalyzeHandler возвращает результаты анализа для устройства
+// AnalyzeHandler возвращает статистику окна поля, последние значения
+// устройства и поля (параметр points, по умолчанию 20); с as_of —
+// статистику и вердикты детекторов по данным, известным в указанный момент
 func (s *Service) AnalyzeHandler(w http.ResponseWriter, r *http.Request) {
-	timer := prometheus.NewTimer(requestDuration.WithLabelValues("/analyze"))
-	defer timer.ObserveDuration()
-	requestsTotal.WithLabelValues("/analyze").Inc()
-
 	deviceID := r.URL.Query().Get("device_id")
 	if deviceID == "" {
 		http.Error(w, "device_id parameter is required", http.StatusBadRequest)
 		return
 	}
 
-	rollingAvg := s.metricsBuffer.GetRollingAverage(deviceID)
+	field := r.URL.Query().Get("field")
+	if field == "" {
+		field = "cpu"
+	}
 
-	response := map[string]interface{}{
-		"device_id":       deviceID,
-		"rolling_average": rollingAvg,
-		"window_size":     50,
+	asOf, historical, err := asOfParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if historical {
+		s.writeAsOfAnalysis(w, deviceID, field, asOf)
+		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	s.writeAnalysis(w, r, deviceID, field)
 }
 
 // HealthHandler проверка здоровья сервиса
 func (s *Service) HealthHandler(w http.ResponseWriter, r *http.Request) {
+	role, since := s.ha.Role()
 	health := map[string]interface{}{
-		"status": "healthy",
-		"time":   time.Now().Unix(),
+		"status":     "healthy",
+		"time":       time.Now().Unix(),
+		"role":       role,
+		"role_since": since.Unix(),
+		"leader":     s.leader.Leader(),
 	}
 
-	// Проверяем Redis
-	_, err := s.redis.Ping(s.ctx).Result()
-	if err != nil {
-		health["redis"] = "disconnected"
-		health["status"] = "degraded"
-	} else {
-		health["redis"] = "connected"
+	// Зависимости проверяются параллельно, каждая со своим таймаутом
+	dependencies := s.health.Check(r.Context())
+	health["dependencies"] = dependencies
+	for _, dependency := range dependencies {
+		if dependency.Status != DependencyOK {
+			health["status"] = "degraded"
+		}
+		if dependency.Name == "redis" {
+			// Прежнее поле для существующих проверок
+			health["redis"] = "connected"
+			if dependency.Status != DependencyOK {
+				health["redis"] = "disconnected"
+			}
+		}
+	}
+
+	// Интеграции, не прошедшие синтетическую проверку, переводят сервис в degraded
+	if checks := s.synthetic.Results(); len(checks) > 0 {
+		health["integrations"] = checks
+		for _, check := range checks {
+			if !check.Healthy {
+				health["status"] = "degraded"
+			}
+		}
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -338,8 +1071,6 @@ func (s *Service) HealthHandler(w http.ResponseWriter, r *http.Request) {
 
 // AnomaliesHandler возвращает список обнаруженных аномалий
 func (s *Service) AnomaliesHandler(w http.ResponseWriter, r *http.Request) {
-	requestsTotal.WithLabelValues("/anomalies").Inc()
-
 	anomalies := make([]AnalyticsResult, 0)
 	timeout := time.After(100 * time.Millisecond)
 
@@ -364,38 +1095,141 @@ drainLoop:
 }
 
 func main() {
-	redisAddr := os.Getenv("REDIS_ADDR")
-	if redisAddr == "" {
-		redisAddr = "localhost:6379"
+	configPath := os.Getenv("CONFIG_FILE")
+	cfg, err := LoadConfig(configPath)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	applyMemoryConfig(cfg.Memory)
+	ids = NewIDGenerator(cfg.IDs.Generator)
+	if cfg.IDs.Generator == IDGeneratorSequence {
+		log.Printf("Warning: deterministic sequence IDs are enabled, use only in tests")
 	}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	service := NewService(cfg, configPath)
+	// Миграции выполняются до приема данных, чтобы новый код не видел старую схему
+	if err := service.migrator.Run(service.ctx); err != nil {
+		log.Fatalf("Schema migration failed: %v", err)
+	}
+	if cfg.Warmup.Enabled {
+		goSafe("warmup", service.warmupBuffer)
+	}
+	goSupervised("config watcher", service.watchConfig)
+	if len(cfg.secretRefs) > 0 && cfg.Secrets.RefreshInterval > 0 {
+		goSupervised("secrets", service.refreshSecrets)
+	}
+	goSupervised("alerts", service.alerts.Run)
+	goSupervised("forensics", service.forensics.Run)
+	goSupervised("sampling", service.sampling.Run)
+	goSupervised("sketches", service.sketches.Run)
+	goSupervised("synthetic", service.synthetic.Run)
+	goSupervised("lb health", service.lb.Run)
+	goSupervised("admission", service.admission.Run)
+	goSupervised("buffer eviction", service.runBufferEviction)
+	goSupervised("pipeline lag", service.lag.Run)
+	goSupervised("rules", func() { service.rules.Run(service.ctx) })
+	goSupervised("silences", func() { service.silences.Run(service.ctx) })
+	goSupervised("device tokens", func() { service.deviceTokens.Run(service.ctx) })
+	goSupervised("feedback", func() { service.feedback.Run(service.ctx) })
+	goSupervised("device metadata", func() { service.metadata.Run(service.ctx) })
+	goSupervised("field registry", func() { service.fields.Run(service.ctx) })
+	goSupervised("ingest status", func() { service.ingestStatus.Run(service.ctx) })
+	goSupervised("reports", func() { service.reports.Run(service.ctx) })
+	goSupervised("batches", func() { service.batches.Run(service.evaluateBatch) })
+	if service.archive.Enabled() {
+		goSupervised("clickhouse", service.archive.Run)
+	}
+	if cfg.HA.Enabled {
+		goSupervised("failover", func() { service.ha.Run(service.ctx) })
+	}
+	if cfg.Leader.Enabled {
+		goSupervised("leader election", func() { service.leader.Run(service.ctx) })
+	}
+	if cfg.Cluster.Enabled {
+		goSupervised("cluster", func() { service.cluster.Run(service.ctx) })
+	}
+	if cfg.Stream.Enabled {
+		goSupervised("stream", func() { service.queue.Run(service.ctx) })
+		goSupervised("stream trimmer", func() { service.queue.RunTrimmer(service.ctx) })
+	}
+	if cfg.Rollups.Enabled {
+		goSupervised("rollups", func() { service.rollups.Run(service.ctx) })
 	}
 
-	service := NewService(redisAddr)
+	if service.pipeline.sources[SourceTypeUDP] != nil {
+		udp, err := StartUDPListener(cfg.UDP.Addr, cfg.UDP.ReadBuffer, cfg.UDP.Workers, service)
+		if err != nil {
+			log.Fatalf("Failed to start UDP listener: %v", err)
+		}
+		service.udp = udp
+		log.Printf("UDP listener on %s with %d workers", cfg.UDP.Addr, cfg.UDP.Workers)
+	}
 
-	r := mux.NewRouter()
+	if service.nats.Enabled() {
+		goSupervised("nats", func() { service.nats.Run(service.ctx) })
+		goSupervised("nats publisher", func() { service.nats.RunPublisher(service.ctx) })
+	}
 
-	// API endpoints
-	r.HandleFunc("/api/metrics", service.MetricsHandler).Methods("POST")
-	r.HandleFunc("/api/analyze", service.AnalyzeHandler).Methods("GET")
-	r.HandleFunc("/api/anomalies", service.AnomaliesHandler).Methods("GET")
-	r.HandleFunc("/health", service.HealthHandler).Methods("GET")
+	sli := NewSLITracker(cfg.Observability.SLIWindow, errorRate)
+	goSupervised("sli", sli.Run)
+	instrument := metricsMiddleware(sli)
 
-	// Prometheus metrics endpoint
-	r.Handle("/metrics", promhttp.Handler())
+	versions := NewClientVersionTracker(cfg.Ingest.MaxClientVersions, cfg.Observability.SLIWindow)
+	goSupervised("client versions", versions.Run)
 
-	// Простая главная страница
-	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte("Highload Service with AI Analytics - Running"))
-	}).Methods("GET")
+	deps := routerDeps{
+		service:    service,
+		versions:   versions,
+		accessLog:  accessLogMiddleware(cfg.Observability.AccessLog),
+		instrument: instrument,
+		debug:      cfg.Debug.Enabled,
+	}
 
-	log.Printf("Starting server on port %s...", port)
-	log.Printf("Endpoints: /api/metrics (POST), /api/analyze (GET), /api/anomalies (GET), /health (GET), /metrics (Prometheus)")
+	var certs *CertReloader
+	if cfg.TLS.Enabled {
+		if certs, err = NewCertReloader(cfg.TLS); err != nil {
+			log.Fatalf("Failed to load TLS certificate: %v", err)
+		}
+		goSupervised("tls certificates", certs.Run)
+	}
 
-	if err := http.ListenAndServe(":"+port, r); err != nil {
-		log.Fatal(err)
+	servers, err := openServers(cfg, deps)
+	if err != nil {
+		log.Fatalf("Failed to listen: %v", err)
 	}
+	if certs != nil {
+		tlsConfig := serverTLSConfig(cfg.TLS, certs)
+		for _, srv := range servers {
+			srv.server.TLSConfig = tlsConfig
+		}
+		if cfg.TLS.RedirectPort != "" {
+			redirect, err := httpsRedirectServer(cfg.TLS, cfg.Server)
+			if err != nil {
+				log.Fatalf("Failed to listen: %v", err)
+			}
+			servers = append(servers, redirect)
+		}
+	}
+	log.Printf("Endpoints: /api/metrics (POST), /api/analyze (GET), /api/analyze/percentiles (GET), /api/anomalies (GET), /api/anomalies/history (GET), /api/heatmap (GET), /api/fleet/percentiles (GET), /ui (dashboard), /health (GET), /metrics (Prometheus)")
+
+	errs := make(chan error, len(servers)+1)
+	for _, srv := range servers {
+		for _, l := range srv.listeners {
+			go func(server *http.Server, l net.Listener) {
+				errs <- serve(server, l)
+			}(srv.server, l)
+		}
+	}
+	if cfg.GRPC.Addr != "" {
+		grpcServer, l, err := newGRPCServer(cfg, service, certs)
+		if err != nil {
+			log.Fatalf("Failed to listen: %v", err)
+		}
+		go func() {
+			errs <- grpcServer.Serve(l)
+		}()
+	}
+	notifySystemd("READY=1")
+
+	log.Fatal(<-errs)
 }
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestMetricRejectsNonFiniteValues(t *testing.T) {
+	for _, value := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+		values := map[string]float64{"cpu": 1, "memory": value}
+		for _, metric := range []Metric{
+			{DeviceID: "dev", Values: values},
+			{DeviceID: "dev", Samples: []MetricSample{{Timestamp: 1700000000, Values: values}}},
+		} {
+			if metric.Validate(10, 10) == nil {
+				t.Errorf("%+v: accepted value %v", metric, value)
+			}
+		}
+	}
+}
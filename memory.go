@@ -0,0 +1,38 @@
+package main
+
+import (
+	"log"
+	"runtime/debug"
+	"sync"
+)
+
+var (
+	// ballast выделенный при старте и никогда не записываемый массив: его
+	// страницы не попадают в RSS, но поднимают размер кучи, от которого
+	// считается следующая сборка мусора, и GC реже срабатывает на малой куче
+	ballastMu sync.Mutex
+	ballast   []byte
+
+	// runtimeMemoryLimit предел из GOMEMLIMIT (или его отсутствие) до настройки сервисом
+	runtimeMemoryLimit = debug.SetMemoryLimit(-1)
+)
+
+// applyMemoryConfig выделяет балласт и выставляет мягкий предел памяти
+// рантайма. Балласт выделяется только при старте, предел меняется на лету;
+// без soft_limit_mb действует GOMEMLIMIT.
+func applyMemoryConfig(cfg MemoryConfig) {
+	ballastMu.Lock()
+	if ballast == nil && cfg.BallastMB > 0 {
+		ballast = make([]byte, cfg.BallastMB<<20)
+		log.Printf("Allocated %d MB memory ballast", cfg.BallastMB)
+	}
+	ballastMu.Unlock()
+
+	limit := runtimeMemoryLimit
+	if cfg.SoftLimitMB > 0 {
+		limit = int64(cfg.SoftLimitMB) << 20
+	}
+	if debug.SetMemoryLimit(limit) != limit {
+		log.Printf("Runtime soft memory limit set to %d MB", limit>>20)
+	}
+}
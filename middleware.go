@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// unmatchedRoute метка для запросов, не попавших ни в один маршрут
+const unmatchedRoute = "unmatched"
+
+// rateLimitIdle время, после которого неактивный клиент забывается ограничителем
+const rateLimitIdle = time.Minute
+
+var listenerRejected = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "highload_listener_rejected_total",
+		Help: "Total number of requests rejected by listener middleware by reason (unauthorized, rate_limited)",
+	},
+	[]string{"listener", "reason"},
+)
+
+// statusRecorder запоминает код ответа и размер тела
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	sr.status = code
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	n, err := sr.ResponseWriter.Write(b)
+	sr.bytes += n
+	return n, err
+}
+
+// Unwrap открывает исходный writer для http.ResponseController
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// Flush пробрасывает сброс буфера для потоковых ответов
+func (sr *statusRecorder) Flush() {
+	if flusher, ok := sr.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// routeTemplate возвращает шаблон маршрута mux (например /api/anomalies/{id}/ack),
+// чтобы параметры пути не размножали метки
+func routeTemplate(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if tpl, err := route.GetPathTemplate(); err == nil {
+			return tpl
+		}
+	}
+	return unmatchedRoute
+}
+
+// metricsMiddleware учитывает число и длительность запросов по маршруту, методу
+// и коду ответа, число выполняющихся запросов, а также передает коды ответов
+// в расчет SLI. Длительность записывается с exemplar trace_id, если запрос
+// пришел с контекстом трассы.
+func metricsMiddleware(sli *SLITracker) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			r = withTraceContext(r)
+			recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			// Маршрут известен до вызова обработчика: mux находит его раньше middleware
+			endpoint := routeTemplate(r)
+			inFlight := requestsInFlight.WithLabelValues(endpoint, r.Method)
+			inFlight.Inc()
+			defer inFlight.Dec()
+
+			next.ServeHTTP(recorder, r)
+
+			status := strconv.Itoa(recorder.status)
+			requestsTotal.WithLabelValues(endpoint, r.Method, status).Inc()
+			observeWithTrace(requestDuration.WithLabelValues(endpoint, r.Method, status), time.Since(start).Seconds(), traceID(r.Context()))
+			recordResponse(sli, endpoint, recorder.status)
+		})
+	}
+}
+
+// authMiddleware пропускает только запросы с заголовком Authorization: Bearer <token>
+// из действующего списка токенов слушателя; tokens вызывается на каждый запрос,
+// чтобы ротация секретов применялась без перезапуска. /health и /health/lb
+// открыты для проб балансировщика и k8s.
+func authMiddleware(listener string, tokens func() []string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/health" || r.URL.Path == "/health/lb" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if ok && validToken(tokens(), token) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			listenerRejected.WithLabelValues(listener, "unauthorized").Inc()
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+		})
+	}
+}
+
+// validToken сравнивает токен со всеми разрешенными за постоянное время
+func validToken(tokens []string, token string) bool {
+	valid := 0
+	for _, allowed := range tokens {
+		valid |= subtle.ConstantTimeCompare([]byte(allowed), []byte(token))
+	}
+	return valid == 1
+}
+
+// tokenBucket состояние ограничителя одного клиента
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimitMiddleware ограничивает частоту запросов с одного адреса алгоритмом token bucket
+func rateLimitMiddleware(listener string, rps float64, burst int) mux.MiddlewareFunc {
+	var mu sync.Mutex
+	buckets := make(map[string]*tokenBucket)
+	lastSweep := time.Now()
+
+	allow := func(client string, now time.Time) bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if now.Sub(lastSweep) >= rateLimitIdle {
+			for key, bucket := range buckets {
+				if now.Sub(bucket.last) >= rateLimitIdle {
+					delete(buckets, key)
+				}
+			}
+			lastSweep = now
+		}
+
+		bucket, ok := buckets[client]
+		if !ok {
+			bucket = &tokenBucket{tokens: float64(burst), last: now}
+			buckets[client] = bucket
+		}
+		bucket.tokens += now.Sub(bucket.last).Seconds() * rps
+		if bucket.tokens > float64(burst) {
+			bucket.tokens = float64(burst)
+		}
+		bucket.last = now
+		if bucket.tokens < 1 {
+			return false
+		}
+		bucket.tokens--
+		return true
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			client, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				client = r.RemoteAddr
+			}
+			if !allow(client, time.Now()) {
+				listenerRejected.WithLabelValues(listener, "rate_limited").Inc()
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Migration изменение схемы данных в Redis. Во время раскатки экземпляры
+// предыдущей версии продолжают работать, поэтому миграция должна только
+// расширять схему (новые ключи и поля), а удаление старого формата выносится
+// в отдельную миграцию следующего релиза. Up может выполниться повторно после
+// падения экземпляра, поэтому должна быть идемпотентной.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(ctx context.Context, rdb redis.UniversalClient) error
+}
+
+// migrations список миграций по возрастанию версии; версии не переиспользуются
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "baseline",
+		// Фиксирует схему, существовавшую до появления миграций
+		Up: func(context.Context, redis.UniversalClient) error { return nil },
+	},
+}
+
+var schemaVersion = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "highload_schema_version",
+	Help: "Schema version of the data in Redis as seen after startup migrations",
+})
+
+// MigrationRecord примененная миграция
+type MigrationRecord struct {
+	Version   int    `json:"version"`
+	Name      string `json:"name"`
+	AppliedAt string `json:"applied_at,omitempty"`
+}
+
+// Migrator применяет недостающие миграции при запуске. Несколько экземпляров,
+// стартующих одновременно, сериализуются блокировкой в Redis: остальные ждут,
+// пока владелец блокировки доведет схему до нужной версии.
+type Migrator struct {
+	redis      redis.UniversalClient
+	cfg        MigrationsConfig
+	id         string
+	migrations []Migration
+}
+
+func NewMigrator(rdb redis.UniversalClient, cfg MigrationsConfig) *Migrator {
+	host, _ := os.Hostname()
+	return &Migrator{
+		redis:      rdb,
+		cfg:        cfg,
+		id:         host + "-" + strconv.Itoa(os.Getpid()),
+		migrations: migrations,
+	}
+}
+
+// Latest возвращает версию схемы, которую ожидает этот релиз
+func (m *Migrator) Latest() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+func (m *Migrator) historyKey() string {
+	return m.cfg.VersionKey + ":history"
+}
+
+// Version возвращает текущую версию схемы; 0, если миграции не применялись
+func (m *Migrator) Version(ctx context.Context) (int, error) {
+	version, err := m.redis.Get(ctx, m.cfg.VersionKey).Int()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return version, err
+}
+
+// Run доводит схему до последней версии. Без Redis миграции пропускаются,
+// как и остальная работа с Redis при старте.
+func (m *Migrator) Run(ctx context.Context) error {
+	if err := m.redis.Ping(ctx).Err(); err != nil {
+		log.Printf("Warning: Redis unavailable, skipping schema migrations: %v", err)
+		return nil
+	}
+
+	deadline := time.Now().Add(m.cfg.WaitTimeout)
+	logged := false
+	for {
+		current, err := m.Version(ctx)
+		if err != nil {
+			return fmt.Errorf("read schema version: %w", err)
+		}
+		if current >= m.Latest() {
+			if current > m.Latest() {
+				// Откат релиза: более новая схема обратно совместима по построению
+				log.Printf("Warning: schema version %d is newer than %d known to this release", current, m.Latest())
+			}
+			schemaVersion.Set(float64(current))
+			return nil
+		}
+
+		acquired, err := m.redis.SetNX(ctx, m.cfg.LockKey, m.id, m.cfg.LockTTL).Result()
+		if err != nil {
+			return fmt.Errorf("acquire migration lock: %w", err)
+		}
+		if acquired {
+			err := m.apply(ctx)
+			releaseCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+			releaseLockScript.Run(releaseCtx, m.redis, []string{m.cfg.LockKey}, m.id)
+			cancel()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %s waiting for migration lock %s", m.cfg.WaitTimeout, m.cfg.LockKey)
+		}
+		if !logged {
+			holder, _ := m.redis.Get(ctx, m.cfg.LockKey).Result()
+			log.Printf("Waiting for schema migrations run by %s", holder)
+			logged = true
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// apply выполняет миграции под блокировкой, продлевая ее; при потере
+// блокировки контекст миграции отменяется
+func (m *Migrator) apply(parent context.Context) error {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	go func() {
+		ticker := time.NewTicker(m.cfg.LockTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			renewed, err := renewLockScript.Run(ctx, m.redis, []string{m.cfg.LockKey}, m.id, m.cfg.LockTTL.Milliseconds()).Int()
+			if err != nil || renewed == 0 {
+				log.Printf("Lost migration lock %s: %v", m.cfg.LockKey, err)
+				cancel()
+				return
+			}
+		}
+	}()
+
+	// Версию перечитываем под блокировкой: ее мог обновить предыдущий владелец
+	current, err := m.Version(ctx)
+	if err != nil {
+		return fmt.Errorf("read schema version: %w", err)
+	}
+	for _, migration := range m.migrations {
+		if migration.Version <= current {
+			continue
+		}
+		log.Printf("Applying schema migration %d (%s)", migration.Version, migration.Name)
+		start := time.Now()
+		if err := migration.Up(ctx, m.redis); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", migration.Version, migration.Name, err)
+		}
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", migration.Version, migration.Name, err)
+		}
+
+		// Версия сохраняется после каждого шага, чтобы после сбоя продолжить со следующего
+		record, _ := json.Marshal(MigrationRecord{
+			Version:   migration.Version,
+			Name:      migration.Name,
+			AppliedAt: time.Now().UTC().Format(time.RFC3339),
+		})
+		pipe := m.redis.TxPipeline()
+		pipe.Set(ctx, m.cfg.VersionKey, migration.Version, 0)
+		pipe.HSet(ctx, m.historyKey(), strconv.Itoa(migration.Version), record)
+		if _, err := pipe.Exec(ctx); err != nil {
+			return fmt.Errorf("record migration %d: %w", migration.Version, err)
+		}
+		log.Printf("Schema migration %d (%s) applied in %s", migration.Version, migration.Name, time.Since(start).Round(time.Millisecond))
+	}
+	return nil
+}
+
+// History возвращает примененные миграции по возрастанию версии
+func (m *Migrator) History(ctx context.Context) ([]MigrationRecord, error) {
+	raw, err := m.redis.HGetAll(ctx, m.historyKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+	records := make([]MigrationRecord, 0, len(raw))
+	for _, data := range raw {
+		var record MigrationRecord
+		if err := json.Unmarshal([]byte(data), &record); err != nil {
+			continue
+		}
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Version < records[j].Version })
+	return records, nil
+}
+
+// AdminMigrationsHandler возвращает версию схемы, примененные и ожидающие миграции
+func (s *Service) AdminMigrationsHandler(w http.ResponseWriter, r *http.Request) {
+	version, err := s.migrator.Version(r.Context())
+	if err != nil {
+		http.Error(w, "Failed to read schema version", http.StatusServiceUnavailable)
+		return
+	}
+	applied, err := s.migrator.History(r.Context())
+	if err != nil {
+		http.Error(w, "Failed to read migration history", http.StatusServiceUnavailable)
+		return
+	}
+	pending := []MigrationRecord{}
+	for _, migration := range s.migrator.migrations {
+		if migration.Version > version {
+			pending = append(pending, MigrationRecord{Version: migration.Version, Name: migration.Name})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"version": version,
+		"latest":  s.migrator.Latest(),
+		"applied": applied,
+		"pending": pending,
+	})
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"log"
+	"math"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// AnomalyTypeML вероятность аномалии по модели, обученной вне сервиса
+const AnomalyTypeML = "ml"
+
+// mlTimeFeatures число признаков времени: sin и cos часа суток и дня недели
+const mlTimeFeatures = 4
+
+var mlInferences = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "highload_ml_inferences_total",
+		Help: "Total number of ONNX model evaluations by result (ok, error)",
+	},
+	[]string{"result"},
+)
+
+// MLInfo результат модели
+type MLInfo struct {
+	Model string `json:"model"`
+	// ModelProbability выход модели до калибровки
+	ModelProbability float64 `json:"model_probability"`
+}
+
+// mlFeatureCount размер вектора признаков по настройкам детектора
+func mlFeatureCount(cfg MLConfig) int {
+	if cfg.TimeFeatures {
+		return cfg.Window + mlTimeFeatures
+	}
+	return cfg.Window
+}
+
+// MLDetector оценивает значение моделью ONNX, обученной офлайн. Вход модели —
+// последние window значений поля, старые первыми (при normalize — в
+// отклонениях от среднего окна в долях σ), и при time_features —
+// sin/cos часа суток и дня недели метки значения. Вероятность аномалии —
+// элемент output_index выхода (по умолчанию последний: для выхода
+// [p_normal, p_anomaly] это p_anomaly). Результаты идут вместе с
+// результатами статистических детекторов: калибруются, сохраняются и
+// отправляются как любые другие.
+type MLDetector struct {
+	fieldSet
+	buffer   *MetricsBuffer
+	model    *ONNXModel
+	name     string
+	location *time.Location
+	cfg      MLConfig
+}
+
+// NewMLDetector загружает модель; если файл перестал читаться после
+// проверки конфигурации, детектор не сообщает результатов
+func NewMLDetector(buffer *MetricsBuffer, cfg MLConfig) *MLDetector {
+	model, err := LoadONNXModel(cfg.ModelPath)
+	if err != nil {
+		log.Printf("ML detector disabled: %v", err)
+	}
+	location, err := time.LoadLocation(cfg.Timezone)
+	if err != nil {
+		// Зона проверена при загрузке конфигурации
+		location = time.UTC
+	}
+	return &MLDetector{
+		fieldSet: newFieldSet(cfg.Fields...),
+		buffer:   buffer,
+		model:    model,
+		name:     filepath.Base(cfg.ModelPath),
+		location: location,
+		cfg:      cfg,
+	}
+}
+
+func (d *MLDetector) Name() string { return AnomalyTypeML }
+
+// features собирает вектор признаков и возвращает его вместе со средним окна
+func (d *MLDetector) features(points []Point, timestamp int64) ([]float64, float64) {
+	features := make([]float64, 0, mlFeatureCount(d.cfg))
+	var sum float64
+	for _, p := range points {
+		features = append(features, p.Value)
+		sum += p.Value
+	}
+	mean := sum / float64(len(points))
+	if d.cfg.Normalize {
+		var variance float64
+		for _, v := range features {
+			variance += (v - mean) * (v - mean)
+		}
+		stdDev := math.Sqrt(variance / float64(len(features)))
+		for i, v := range features {
+			features[i] = 0
+			if stdDev > 0 {
+				features[i] = (v - mean) / stdDev
+			}
+		}
+	}
+	if d.cfg.TimeFeatures {
+		t := time.Unix(timestamp, 0).In(d.location)
+		hour := 2 * math.Pi * (float64(t.Hour()) + float64(t.Minute())/60) / 24
+		day := 2 * math.Pi * float64(t.Weekday()) / 7
+		features = append(features, math.Sin(hour), math.Cos(hour), math.Sin(day), math.Cos(day))
+	}
+	return features, mean
+}
+
+func (d *MLDetector) Detect(deviceID, field string, point Point) *AnalyticsResult {
+	if d.model == nil {
+		return nil
+	}
+	points := d.buffer.Points(deviceID, field)
+	if len(points) < d.cfg.Window {
+		return nil
+	}
+	points = points[len(points)-d.cfg.Window:]
+	features, mean := d.features(points, point.Timestamp)
+
+	output, err := d.model.Run(features)
+	if err == nil && len(output) == 0 {
+		err = errInvalidONNX
+	}
+	if err != nil {
+		mlInferences.WithLabelValues("error").Inc()
+		log.Printf("ML model failed for %s/%s: %v", deviceID, field, err)
+		return nil
+	}
+	mlInferences.WithLabelValues("ok").Inc()
+
+	index := d.cfg.OutputIndex
+	if index < 0 || index >= len(output) {
+		index = len(output) - 1
+	}
+	probability := math.Max(0, math.Min(1, output[index]))
+	return &AnalyticsResult{
+		DeviceID:       deviceID,
+		Field:          field,
+		Type:           AnomalyTypeML,
+		RollingAverage: mean,
+		IsAnomaly:      probability >= d.cfg.Threshold,
+		Timestamp:      point.Timestamp,
+		Value:          point.Value,
+		ML:             &MLInfo{Model: d.name, ModelProbability: probability},
+	}
+}
+
+func (d *MLDetector) Reset(deviceID string) {}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// SourceTypeNATS метрики из потока JetStream
+const SourceTypeNATS = "nats"
+
+// natsFetchExpires время ожидания одной выборки сообщений из потребителя
+const natsFetchExpires = 5 * time.Second
+
+var (
+	natsConnected = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "highload_nats_connected",
+			Help: "Whether the NATS connection is established (1) or not (0)",
+		},
+	)
+
+	natsMessages = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "highload_nats_messages_total",
+			Help: "Total number of JetStream metric messages by result (processed, duplicate, forwarded, invalid, rejected, retried)",
+		},
+		[]string{"result"},
+	)
+
+	natsPublished = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "highload_nats_published_total",
+			Help: "Total number of anomalies published to NATS by result (published, duplicate, failed, dropped)",
+		},
+		[]string{"result"},
+	)
+)
+
+// Решение по сообщению JetStream после обработки
+const (
+	// natsAck метрика обработана или намеренно пропущена
+	natsAck = "ack"
+	// natsTerm метрика некорректна, повторная доставка не поможет
+	natsTerm = "term"
+	// natsNak метрику нужно доставить повторно через retry_delay
+	natsNak = "nak"
+)
+
+// NATSBridge связывает сервис с шиной NATS: читает метрики из потока
+// JetStream через долговечного pull-потребителя и публикует аномалии в
+// JetStream. Сообщение подтверждается только после того, как метрика
+// принята в обработку, поэтому при падении экземпляра JetStream доставит
+// его повторно (до max_deliver раз). В паре active/standby поток читает
+// только активный экземпляр.
+type NATSBridge struct {
+	service *Service
+	cfg     NATSConfig
+	// consume источник nats включен в конвейер
+	consume bool
+
+	mu   sync.Mutex
+	conn *nats.Conn
+	js   jetstream.JetStream
+
+	anomalies chan AnalyticsResult
+}
+
+func NewNATSBridge(service *Service, cfg NATSConfig, consume bool) *NATSBridge {
+	return &NATSBridge{service: service, cfg: cfg, consume: consume, anomalies: make(chan AnalyticsResult, cfg.QueueSize)}
+}
+
+// Enabled сообщает, задан ли сервер NATS
+func (b *NATSBridge) Enabled() bool {
+	return b.cfg.URL != ""
+}
+
+func (b *NATSBridge) current() (*nats.Conn, jetstream.JetStream) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.conn, b.js
+}
+
+func (b *NATSBridge) setConn(conn *nats.Conn, js jetstream.JetStream) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.conn, b.js = conn, js
+}
+
+// options параметры клиента: аутентификация, TLS и переподключение.
+// Разорванное соединение клиент восстанавливает сам до max_reconnects раз;
+// если сервер требует TLS (tls_required), клиент переходит на TLS и без
+// секции nats.tls, проверяя сертификат по системным корневым.
+func (b *NATSBridge) options(closed chan struct{}) ([]nats.Option, error) {
+	cfg := b.cfg
+	opts := []nats.Option{
+		nats.Name(cfg.Name),
+		nats.Timeout(cfg.Timeout),
+		nats.MaxReconnects(cfg.MaxReconnects),
+		nats.ReconnectWait(cfg.ReconnectWait),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			natsConnected.Set(0)
+			if err != nil {
+				log.Printf("Disconnected from NATS: %v", err)
+			}
+		}),
+		nats.ReconnectHandler(func(conn *nats.Conn) {
+			natsConnected.Set(1)
+			log.Printf("Reconnected to NATS at %s", natsHost(conn.ConnectedUrl()))
+		}),
+		nats.ClosedHandler(func(*nats.Conn) {
+			natsConnected.Set(0)
+			close(closed)
+		}),
+	}
+
+	switch {
+	case cfg.CredsFile != "":
+		opts = append(opts, nats.UserCredentials(cfg.CredsFile))
+	case cfg.NKeySeedFile != "":
+		opt, err := nats.NkeyOptionFromSeed(cfg.NKeySeedFile)
+		if err != nil {
+			return nil, fmt.Errorf("nkey seed: %w", err)
+		}
+		opts = append(opts, opt)
+	case cfg.Token != "":
+		opts = append(opts, nats.Token(cfg.Token))
+	case cfg.User != "":
+		opts = append(opts, nats.UserInfo(cfg.User, cfg.Password))
+	}
+
+	if cfg.TLS.configured() {
+		tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: cfg.TLS.InsecureSkipVerify}
+		if cfg.TLS.CAFile != "" {
+			pem, err := os.ReadFile(cfg.TLS.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("tls ca: %w", err)
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("tls ca: no certificates in %s", cfg.TLS.CAFile)
+			}
+		}
+		if cfg.TLS.CertFile != "" {
+			cert, err := tls.LoadX509KeyPair(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("tls client certificate: %w", err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		opts = append(opts, nats.Secure(tlsConfig))
+	}
+	return opts, nil
+}
+
+// Run держит соединение с NATS и, если источник nats включен в конвейер,
+// читает метрики из потока. Кратковременные обрывы клиент переживает сам;
+// если соединение закрыто окончательно (исчерпаны max_reconnects или сервер
+// недоступен при подключении), оно создается заново через reconnect_wait.
+func (b *NATSBridge) Run(ctx context.Context) {
+	for {
+		closed := make(chan struct{})
+		opts, err := b.options(closed)
+		var conn *nats.Conn
+		if err == nil {
+			conn, err = nats.Connect(b.cfg.URL, opts...)
+		}
+		if err == nil {
+			var js jetstream.JetStream
+			js, err = jetstream.New(conn)
+			if err == nil {
+				b.setConn(conn, js)
+				natsConnected.Set(1)
+				log.Printf("Connected to NATS at %s", natsHost(conn.ConnectedUrl()))
+
+				if b.consume {
+					err = b.consumeStream(ctx, js, closed)
+				} else {
+					select {
+					case <-closed:
+						err = conn.LastError()
+					case <-ctx.Done():
+					}
+				}
+				b.setConn(nil, nil)
+			}
+			conn.Close()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("NATS connection failed, retrying in %s: %v", b.cfg.ReconnectWait, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(b.cfg.ReconnectWait):
+		}
+	}
+}
+
+// ensureConsumer находит поток с темой subject (если stream не задан) и
+// создает или обновляет долговечного потребителя с явным подтверждением
+func (b *NATSBridge) ensureConsumer(ctx context.Context, js jetstream.JetStream) (jetstream.Consumer, error) {
+	ctx, cancel := context.WithTimeout(ctx, b.cfg.Timeout)
+	defer cancel()
+
+	stream := b.cfg.Stream
+	if stream == "" {
+		name, err := js.StreamNameBySubject(ctx, b.cfg.Subject)
+		if errors.Is(err, jetstream.ErrStreamNotFound) {
+			return nil, fmt.Errorf("no jetstream stream captures subject %s", b.cfg.Subject)
+		}
+		if err != nil {
+			return nil, err
+		}
+		stream = name
+	}
+
+	consumer, err := js.CreateOrUpdateConsumer(ctx, stream, jetstream.ConsumerConfig{
+		Durable:       b.cfg.Durable,
+		DeliverPolicy: jetstream.DeliverAllPolicy,
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		AckWait:       b.cfg.AckWait,
+		MaxDeliver:    b.cfg.MaxDeliver,
+		FilterSubject: b.cfg.Subject,
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Consuming NATS subject %s from stream %s as %s", b.cfg.Subject, stream, b.cfg.Durable)
+	return consumer, nil
+}
+
+// consumeStream выбирает сообщения порциями до batch и подтверждает каждое
+// после обработки. Ошибки выборки во время переподключения клиента не
+// закрывают соединение: потребитель создается заново через reconnect_wait.
+// Возвращается, когда соединение закрыто окончательно.
+func (b *NATSBridge) consumeStream(ctx context.Context, js jetstream.JetStream, closed chan struct{}) error {
+	var consumer jetstream.Consumer
+	for {
+		var err error
+		// Резервный экземпляр не забирает сообщения у активного
+		if b.service.ha.Active() {
+			if consumer == nil {
+				consumer, err = b.ensureConsumer(ctx, js)
+			}
+			if err == nil {
+				err = b.fetch(ctx, consumer)
+			}
+			if err == nil {
+				continue
+			}
+			consumer = nil
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		wait := time.Second
+		if err != nil {
+			wait = b.cfg.ReconnectWait
+			log.Printf("NATS consumer failed, retrying in %s: %v", wait, err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-closed:
+			return err
+		case <-time.After(wait):
+		}
+	}
+}
+
+// fetch обрабатывает сообщения одной выборки до ее завершения: batch
+// сообщений или истечения ожидания
+func (b *NATSBridge) fetch(ctx context.Context, consumer jetstream.Consumer) error {
+	batch, err := consumer.Fetch(b.cfg.Batch, jetstream.FetchMaxWait(natsFetchExpires))
+	if err != nil {
+		return err
+	}
+	for msg := range batch.Messages() {
+		recordConsumed(SourceTypeNATS, 1)
+		decision, result := b.handle(ctx, msg)
+		natsMessages.WithLabelValues(result).Inc()
+
+		switch decision {
+		case natsAck:
+			err = msg.Ack()
+		case natsNak:
+			err = msg.NakWithDelay(b.cfg.RetryDelay)
+		default:
+			err = msg.Term()
+		}
+		if err != nil {
+			// Без подтверждения сообщение придет повторно через ack_wait
+			log.Printf("Failed to acknowledge NATS message: %v", err)
+		}
+	}
+	return batch.Error()
+}
+
+// handle проводит метрику через те же проверки, что и POST /api/metrics, и
+// возвращает решение для JetStream и результат для метрики сервиса
+func (b *NATSBridge) handle(ctx context.Context, msg jetstream.Msg) (string, string) {
+	s := b.service
+	s.pipeline.Accepts(SourceTypeNATS)
+
+	header := msg.Headers()
+	// Nats-Msg-Id издателя годится как ключ идемпотентности
+	idempotencyKey := natsHeader(header, idempotencyKeyHeader)
+	if idempotencyKey == "" {
+		idempotencyKey = header.Get(nats.MsgIdHdr)
+	}
+
+	var metric Metric
+	if err := json.Unmarshal(msg.Data(), &metric); err != nil {
+		return natsTerm, "invalid"
+	}
+	if err := metric.Validate(s.maxFields(), s.maxSamples()); err != nil || len(idempotencyKey) > maxIdempotencyKeyLength {
+		return natsTerm, "invalid"
+	}
+	if s.fields.Check(metric) != nil {
+		return natsTerm, "invalid"
+	}
+	tokenTenant, err := s.deviceTokens.Authenticate(SourceTypeNATS, metric.DeviceID, natsHeader(header, deviceTokenHeader))
+	if err != nil {
+		return natsTerm, "rejected"
+	}
+	// Ключей API у сообщений NATS нет: арендатора дает токен устройства или
+	// X-Tenant-ID с tenants.trust_header
+	tenant := s.resolveTenant(tokenTenant, "", natsHeader(header, tenantHeader), false)
+	policy := s.policyFor(tenant)
+	label := s.tenantLabel(tenant)
+	if owner, local := s.cluster.Owner(metric.DeviceID); !local {
+		if decision, ok := b.forward(ctx, owner, tenant, idempotencyKey, msg); ok {
+			return decision, "forwarded"
+		}
+	}
+	// Перегрузка и квоты временные: метрика будет доставлена повторно
+	if !s.admission.Admit(SourceTypeNATS, metric.DeviceID) {
+		return natsNak, "retried"
+	}
+	if !s.quotas.AllowN(tenant, metric.DeviceID, max(len(metric.Samples), 1)).Allowed {
+		return natsNak, "retried"
+	}
+	if s.dedup.Deduplicate(ctx, SourceTypeNATS, tenant, idempotencyKey, &metric) {
+		return natsAck, "duplicate"
+	}
+
+	metric.Tenant = tenant
+	for i := range metric.Samples {
+		metric.Samples[i].Values = restrictFields(label, policy, metric.Samples[i].Values)
+	}
+	s.submit(ctx, SourceTypeNATS, metric, restrictFields(label, policy, metric.Fields()))
+	return natsAck, "processed"
+}
+
+// forward пересылает метрику владельцу устройства в кластере; решение по
+// сообщению следует ответу владельца. false, если владелец недоступен и
+// метрику нужно обработать локально.
+func (b *NATSBridge) forward(ctx context.Context, owner, tenant, idempotencyKey string, msg jetstream.Msg) (string, bool) {
+	header := http.Header{"Content-Type": {"application/json"}, tenantHeader: {tenant}}
+	if token := natsHeader(msg.Headers(), deviceTokenHeader); token != "" {
+		header.Set(deviceTokenHeader, token)
+	}
+	if idempotencyKey != "" {
+		header.Set(idempotencyKeyHeader, idempotencyKey)
+	}
+	resp, err := b.service.cluster.ForwardMetric(ctx, owner, msg.Data(), header)
+	if err != nil {
+		log.Printf("Failed to forward NATS metric to %s: %v", owner, err)
+		return "", false
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode < 300:
+		return natsAck, true
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return natsNak, true
+	default:
+		log.Printf("Owner %s rejected NATS metric: %s", owner, resp.Status)
+		return natsTerm, true
+	}
+}
+
+// Anomaly ставит аномалию в очередь публикации; при переполненной очереди
+// аномалия отбрасывается
+func (b *NATSBridge) Anomaly(result AnalyticsResult) {
+	if !b.Enabled() || b.cfg.AnomalySubject == "" {
+		return
+	}
+	select {
+	case b.anomalies <- result:
+	default:
+		natsPublished.WithLabelValues("dropped").Inc()
+	}
+}
+
+// RunPublisher публикует аномалии из очереди в JetStream и ждет
+// подтверждения записи; идентификатор аномалии передается в Nats-Msg-Id,
+// так что повторная публикация не создает дубликат в потоке
+func (b *NATSBridge) RunPublisher(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case result := <-b.anomalies:
+			natsPublished.WithLabelValues(b.publish(ctx, result)).Inc()
+		}
+	}
+}
+
+func (b *NATSBridge) publish(ctx context.Context, result AnalyticsResult) string {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return "failed"
+	}
+	_, js := b.current()
+	if js == nil {
+		return "failed"
+	}
+	msg := &nats.Msg{Subject: b.cfg.AnomalySubject, Header: nats.Header{"Content-Type": {"application/json"}}, Data: data}
+	var opts []jetstream.PublishOpt
+	if result.ID != "" {
+		opts = append(opts, jetstream.WithMsgID(result.ID))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, b.cfg.Timeout)
+	defer cancel()
+	ack, err := js.PublishMsg(ctx, msg, opts...)
+	if errors.Is(err, jetstream.ErrNoStreamResponse) {
+		err = fmt.Errorf("no jetstream stream captures subject %s", b.cfg.AnomalySubject)
+	}
+	if err != nil {
+		log.Printf("Failed to publish anomaly %s to NATS: %v", result.ID, err)
+		return "failed"
+	}
+	if ack.Duplicate {
+		return "duplicate"
+	}
+	return "published"
+}
+
+// Healthy сообщает об ошибке, пока соединение с NATS не установлено
+func (b *NATSBridge) Healthy(ctx context.Context) error {
+	if conn, _ := b.current(); conn == nil || !conn.IsConnected() {
+		return fmt.Errorf("not connected to %s", natsHost(b.cfg.URL))
+	}
+	return nil
+}
+
+// natsHeader значение заголовка сообщения. Заголовки NATS чувствительны к
+// регистру, а издатели пишут X-Tenant-ID по-разному, поэтому при отсутствии
+// точного совпадения ключ ищется без учета регистра.
+func natsHeader(header nats.Header, key string) string {
+	if value := header.Get(key); value != "" {
+		return value
+	}
+	for name, values := range header {
+		if strings.EqualFold(name, key) && len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// natsHost адрес сервера для журнала
+func natsHost(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "nats server"
+	}
+	return u.Host
+}
@@ -0,0 +1,929 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Модель ONNX разбирается и вычисляется без onnxruntime: поддерживаются
+// полносвязные сети и линейные модели из операторов стандартного домена
+// ai.onnx, как их выгружают PyTorch и Keras (tf2onnx) при обычных
+// настройках. Модели sklearn через skl2onnx строятся из операторов домена
+// ai.onnx.ml (TreeEnsembleRegressor, Scaler и др.) и не поддерживаются.
+// Граф с оператором вне onnxSupportedOps, оператором другого домена или
+// версией набора операторов ai.onnx вне [onnxMinOpset, onnxMaxOpset]
+// отклоняется при загрузке, а не при первом значении.
+
+// Номера полей сообщений из onnx.proto
+const (
+	onnxModelGraph       protowire.Number = 7
+	onnxModelOpsetImport protowire.Number = 8
+	onnxOpsetDomain      protowire.Number = 1
+	onnxOpsetVersion     protowire.Number = 2
+
+	onnxGraphNode        protowire.Number = 1
+	onnxGraphInitializer protowire.Number = 5
+	onnxGraphInput       protowire.Number = 11
+	onnxGraphOutput      protowire.Number = 12
+
+	onnxNodeInput     protowire.Number = 1
+	onnxNodeOutput    protowire.Number = 2
+	onnxNodeOpType    protowire.Number = 4
+	onnxNodeAttribute protowire.Number = 5
+	onnxNodeDomain    protowire.Number = 7
+
+	onnxAttrName   protowire.Number = 1
+	onnxAttrFloat  protowire.Number = 2
+	onnxAttrInt    protowire.Number = 3
+	onnxAttrTensor protowire.Number = 5
+	onnxAttrFloats protowire.Number = 7
+	onnxAttrInts   protowire.Number = 8
+
+	onnxTensorDims         protowire.Number = 1
+	onnxTensorDataType     protowire.Number = 2
+	onnxTensorFloatData    protowire.Number = 4
+	onnxTensorInt32Data    protowire.Number = 5
+	onnxTensorInt64Data    protowire.Number = 7
+	onnxTensorName         protowire.Number = 8
+	onnxTensorRawData      protowire.Number = 9
+	onnxTensorDoubleData   protowire.Number = 10
+	onnxTensorDataLocation protowire.Number = 14
+
+	onnxValueInfoName protowire.Number = 1
+	onnxValueInfoType protowire.Number = 2
+	onnxTypeTensor    protowire.Number = 1
+	onnxTensorShape   protowire.Number = 2
+	onnxShapeDim      protowire.Number = 1
+	onnxDimValue      protowire.Number = 1
+)
+
+// Типы элементов TensorProto.DataType
+const (
+	onnxFloat  = 1
+	onnxInt32  = 6
+	onnxInt64  = 7
+	onnxDouble = 11
+)
+
+// onnxSupportedOps операторы, которые умеет вычислять ONNXModel
+var onnxSupportedOps = []string{
+	"Gemm", "MatMul", "Add", "Sub", "Mul", "Div", "Relu", "LeakyRelu", "Sigmoid", "Tanh",
+	"Softmax", "Flatten", "Reshape", "Identity", "Dropout", "Clip", "Constant", "BatchNormalization",
+}
+
+// Версии набора операторов ai.onnx, в которых операторы onnxSupportedOps
+// вычисляются по их определению: с opset 9 BatchNormalization без spatial,
+// после 21 семантика не проверялась
+const (
+	onnxMinOpset = 9
+	onnxMaxOpset = 21
+)
+
+var errInvalidONNX = errors.New("invalid onnx model")
+
+// onnxTensor тензор с данными в float64 и формой по строкам
+type onnxTensor struct {
+	shape []int
+	data  []float64
+}
+
+func (t onnxTensor) size() int {
+	n := 1
+	for _, d := range t.shape {
+		n *= d
+	}
+	return n
+}
+
+// onnxNode оператор графа с атрибутами
+type onnxNode struct {
+	op      string
+	inputs  []string
+	outputs []string
+	ints    map[string][]int64
+	floats  map[string][]float64
+	tensors map[string]onnxTensor
+}
+
+func (n onnxNode) intAttr(name string, def int64) int64 {
+	if v, ok := n.ints[name]; ok && len(v) > 0 {
+		return v[0]
+	}
+	return def
+}
+
+func (n onnxNode) floatAttr(name string, def float64) float64 {
+	if v, ok := n.floats[name]; ok && len(v) > 0 {
+		return v[0]
+	}
+	return def
+}
+
+// ONNXModel разобранный граф модели с одним входом и одним выходом
+type ONNXModel struct {
+	nodes        []onnxNode
+	initializers map[string]onnxTensor
+	input        string
+	inputShape   []int // -1 — размер, задаваемый при вызове (batch)
+	output       string
+}
+
+// LoadONNXModel читает и проверяет модель из файла
+func LoadONNXModel(path string) (*ONNXModel, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	model, err := parseONNXModel(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return model, nil
+}
+
+// InputSize возвращает число признаков входа без размера batch; 0 — не задано в модели
+func (m *ONNXModel) InputSize() int {
+	if len(m.inputShape) == 0 {
+		return 0
+	}
+	n := 1
+	for _, d := range m.inputShape {
+		if d > 0 {
+			n *= d
+		}
+	}
+	return n
+}
+
+// Run вычисляет граф на одном векторе признаков и возвращает выход
+// модели построчно. Безопасен для параллельных вызовов.
+func (m *ONNXModel) Run(features []float64) ([]float64, error) {
+	shape := []int{1, len(features)}
+	if len(m.inputShape) > 0 {
+		shape = make([]int, len(m.inputShape))
+		for i, d := range m.inputShape {
+			shape[i] = max(d, 1)
+		}
+	}
+	input := onnxTensor{shape: shape, data: features}
+	if input.size() != len(features) {
+		return nil, fmt.Errorf("model expects %d features, got %d", input.size(), len(features))
+	}
+
+	values := make(map[string]onnxTensor, len(m.initializers)+len(m.nodes)+1)
+	for name, t := range m.initializers {
+		values[name] = t
+	}
+	values[m.input] = input
+	for _, node := range m.nodes {
+		args := make([]*onnxTensor, len(node.inputs))
+		for i, name := range node.inputs {
+			if name == "" {
+				continue // необязательный вход не передан
+			}
+			t, ok := values[name]
+			if !ok {
+				return nil, fmt.Errorf("%s: input %q is not computed", node.op, name)
+			}
+			args[i] = &t
+		}
+		out, err := evalONNXNode(node, args)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", node.op, err)
+		}
+		values[node.outputs[0]] = out
+	}
+	out, ok := values[m.output]
+	if !ok {
+		return nil, fmt.Errorf("output %q is not computed", m.output)
+	}
+	return out.data, nil
+}
+
+// parseONNXModel разбирает ModelProto
+func parseONNXModel(data []byte) (*ONNXModel, error) {
+	var graph []byte
+	opset := int64(-1)
+	err := walkProto(data, func(num protowire.Number, typ protowire.Type, v uint64, b []byte) error {
+		if typ != protowire.BytesType {
+			return nil
+		}
+		switch num {
+		case onnxModelGraph:
+			graph = b
+		case onnxModelOpsetImport:
+			domain, version, err := parseONNXOpset(b)
+			if err == nil && (domain == "" || domain == "ai.onnx") {
+				opset = version
+			}
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if graph == nil {
+		return nil, fmt.Errorf("%w: no graph", errInvalidONNX)
+	}
+	// Операторы других доменов (ai.onnx.ml) отклоняются в parseONNXNode
+	if opset < 0 {
+		return nil, fmt.Errorf("%w: model does not import the ai.onnx operator set", errInvalidONNX)
+	}
+	if opset < onnxMinOpset || opset > onnxMaxOpset {
+		return nil, fmt.Errorf("unsupported opset %d, supported: %d to %d", opset, onnxMinOpset, onnxMaxOpset)
+	}
+
+	model := &ONNXModel{initializers: make(map[string]onnxTensor)}
+	var inputs [][]byte
+	var outputs []string
+	err = walkProto(graph, func(num protowire.Number, typ protowire.Type, v uint64, b []byte) error {
+		if typ != protowire.BytesType {
+			return nil
+		}
+		switch num {
+		case onnxGraphNode:
+			node, err := parseONNXNode(b)
+			if err != nil {
+				return err
+			}
+			model.nodes = append(model.nodes, node)
+		case onnxGraphInitializer:
+			name, t, err := parseONNXTensor(b)
+			if err != nil {
+				return fmt.Errorf("initializer %s: %w", name, err)
+			}
+			model.initializers[name] = t
+		case onnxGraphInput:
+			inputs = append(inputs, b)
+		case onnxGraphOutput:
+			name, _, err := parseONNXValueInfo(b)
+			if err != nil {
+				return err
+			}
+			outputs = append(outputs, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// В старых версиях IR веса перечислены и среди входов графа
+	for _, raw := range inputs {
+		name, shape, err := parseONNXValueInfo(raw)
+		if err != nil {
+			return nil, err
+		}
+		if _, isWeight := model.initializers[name]; isWeight {
+			continue
+		}
+		if model.input != "" {
+			return nil, fmt.Errorf("%w: model must have a single input, got %s and %s", errInvalidONNX, model.input, name)
+		}
+		model.input, model.inputShape = name, shape
+	}
+	if model.input == "" || len(outputs) == 0 {
+		return nil, fmt.Errorf("%w: model must have an input and an output", errInvalidONNX)
+	}
+	// Используется первый выход, остальные выходы графа не вычисляются
+	model.output = outputs[0]
+	if len(model.nodes) == 0 {
+		return nil, fmt.Errorf("%w: graph has no nodes", errInvalidONNX)
+	}
+	for _, node := range model.nodes {
+		if !containsString(onnxSupportedOps, node.op) {
+			return nil, fmt.Errorf("unsupported operator %s, supported: %v", node.op, onnxSupportedOps)
+		}
+		if len(node.outputs) == 0 {
+			return nil, fmt.Errorf("%w: %s has no outputs", errInvalidONNX, node.op)
+		}
+		switch node.op {
+		case "Constant":
+			_, tensor := node.tensors["value"]
+			_, floats := node.floats["value_floats"]
+			_, scalar := node.floats["value_float"]
+			if !tensor && !floats && !scalar {
+				return nil, fmt.Errorf("unsupported Constant: only tensor and float values are supported")
+			}
+		case "Softmax":
+			// До opset 13 axis по умолчанию 1, и вход сводится к матрице: для
+			// последней оси это то же самое, что softmax по последней оси
+			if _, ok := node.ints["axis"]; !ok && opset < 13 {
+				node.ints["axis"] = []int64{1}
+			}
+		}
+	}
+	return model, nil
+}
+
+// parseONNXOpset разбирает OperatorSetIdProto
+func parseONNXOpset(data []byte) (string, int64, error) {
+	var domain string
+	var version int64
+	err := walkProto(data, func(num protowire.Number, typ protowire.Type, v uint64, b []byte) error {
+		switch {
+		case num == onnxOpsetDomain && typ == protowire.BytesType:
+			domain = string(b)
+		case num == onnxOpsetVersion && typ == protowire.VarintType:
+			version = int64(v)
+		}
+		return nil
+	})
+	return domain, version, err
+}
+
+func parseONNXNode(data []byte) (onnxNode, error) {
+	node := onnxNode{
+		ints:    make(map[string][]int64),
+		floats:  make(map[string][]float64),
+		tensors: make(map[string]onnxTensor),
+	}
+	domain := ""
+	err := walkProto(data, func(num protowire.Number, typ protowire.Type, v uint64, b []byte) error {
+		if typ != protowire.BytesType {
+			return nil
+		}
+		switch num {
+		case onnxNodeInput:
+			node.inputs = append(node.inputs, string(b))
+		case onnxNodeOutput:
+			node.outputs = append(node.outputs, string(b))
+		case onnxNodeOpType:
+			node.op = string(b)
+		case onnxNodeDomain:
+			domain = string(b)
+		case onnxNodeAttribute:
+			return parseONNXAttribute(b, &node)
+		}
+		return nil
+	})
+	if err == nil && domain != "" && domain != "ai.onnx" {
+		err = fmt.Errorf("unsupported operator %s from domain %s", node.op, domain)
+	}
+	return node, err
+}
+
+func parseONNXAttribute(data []byte, node *onnxNode) error {
+	var name string
+	var ints []int64
+	var floats []float64
+	var tensor *onnxTensor
+	err := walkProto(data, func(num protowire.Number, typ protowire.Type, v uint64, b []byte) error {
+		switch {
+		case num == onnxAttrName && typ == protowire.BytesType:
+			name = string(b)
+		case num == onnxAttrFloat && typ == protowire.Fixed32Type:
+			floats = append(floats, float64(math.Float32frombits(uint32(v))))
+		case num == onnxAttrInt && typ == protowire.VarintType:
+			ints = append(ints, int64(v))
+		case num == onnxAttrTensor && typ == protowire.BytesType:
+			_, t, err := parseONNXTensor(b)
+			if err != nil {
+				return err
+			}
+			tensor = &t
+		case num == onnxAttrFloats:
+			floats = appendProtoFloats(floats, typ, v, b)
+		case num == onnxAttrInts:
+			ints = appendProtoInts(ints, typ, v, b)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if ints != nil {
+		node.ints[name] = ints
+	}
+	if floats != nil {
+		node.floats[name] = floats
+	}
+	if tensor != nil {
+		node.tensors[name] = *tensor
+	}
+	return nil
+}
+
+// parseONNXTensor разбирает TensorProto с данными float, double, int32 или int64
+func parseONNXTensor(data []byte) (string, onnxTensor, error) {
+	var name string
+	var dims []int64
+	var dataType uint64
+	var raw []byte
+	var values []float64
+	var ints []int64
+	external := false
+	err := walkProto(data, func(num protowire.Number, typ protowire.Type, v uint64, b []byte) error {
+		switch num {
+		case onnxTensorName:
+			name = string(b)
+		case onnxTensorDims:
+			dims = appendProtoInts(dims, typ, v, b)
+		case onnxTensorDataType:
+			dataType = v
+		case onnxTensorRawData:
+			raw = b
+		case onnxTensorFloatData:
+			values = appendProtoFloats(values, typ, v, b)
+		case onnxTensorDoubleData:
+			values = appendProtoDoubles(values, typ, v, b)
+		case onnxTensorInt32Data, onnxTensorInt64Data:
+			ints = appendProtoInts(ints, typ, v, b)
+		case onnxTensorDataLocation:
+			external = v == 1
+		}
+		return nil
+	})
+	if err != nil {
+		return name, onnxTensor{}, err
+	}
+	if external {
+		return name, onnxTensor{}, fmt.Errorf("external tensor data is not supported")
+	}
+
+	t := onnxTensor{shape: make([]int, len(dims))}
+	for i, d := range dims {
+		t.shape[i] = int(d)
+	}
+	for _, i := range ints {
+		values = append(values, float64(i))
+	}
+	if raw != nil {
+		width := map[uint64]int{onnxFloat: 4, onnxDouble: 8, onnxInt32: 4, onnxInt64: 8}[dataType]
+		if width == 0 || len(raw)%width != 0 {
+			return name, onnxTensor{}, fmt.Errorf("unsupported raw data of type %d", dataType)
+		}
+		for i := 0; i < len(raw); i += width {
+			switch dataType {
+			case onnxFloat:
+				values = append(values, float64(math.Float32frombits(binary.LittleEndian.Uint32(raw[i:]))))
+			case onnxDouble:
+				values = append(values, math.Float64frombits(binary.LittleEndian.Uint64(raw[i:])))
+			case onnxInt32:
+				values = append(values, float64(int32(binary.LittleEndian.Uint32(raw[i:]))))
+			case onnxInt64:
+				values = append(values, float64(int64(binary.LittleEndian.Uint64(raw[i:]))))
+			}
+		}
+	}
+	t.data = values
+	if t.size() != len(t.data) {
+		return name, onnxTensor{}, fmt.Errorf("%w: tensor of shape %v has %d values", errInvalidONNX, t.shape, len(t.data))
+	}
+	return name, t, nil
+}
+
+// parseONNXValueInfo возвращает имя и форму значения; -1 — размер, не
+// заданный числом
+func parseONNXValueInfo(data []byte) (string, []int, error) {
+	var name string
+	var shape []int
+	err := walkProto(data, func(num protowire.Number, typ protowire.Type, v uint64, b []byte) error {
+		if typ != protowire.BytesType {
+			return nil
+		}
+		switch num {
+		case onnxValueInfoName:
+			name = string(b)
+		case onnxValueInfoType:
+			return walkProto(b, func(num protowire.Number, typ protowire.Type, v uint64, b []byte) error {
+				if num != onnxTypeTensor || typ != protowire.BytesType {
+					return nil
+				}
+				return walkProto(b, func(num protowire.Number, typ protowire.Type, v uint64, b []byte) error {
+					if num != onnxTensorShape || typ != protowire.BytesType {
+						return nil
+					}
+					shape = []int{}
+					return walkProto(b, func(num protowire.Number, typ protowire.Type, v uint64, b []byte) error {
+						if num != onnxShapeDim || typ != protowire.BytesType {
+							return nil
+						}
+						size := -1
+						err := walkProto(b, func(num protowire.Number, typ protowire.Type, v uint64, b []byte) error {
+							if num == onnxDimValue && typ == protowire.VarintType {
+								size = int(v)
+							}
+							return nil
+						})
+						shape = append(shape, size)
+						return err
+					})
+				})
+			})
+		}
+		return nil
+	})
+	return name, shape, err
+}
+
+// walkProto передает fn поля сообщения: значение varint и fixed-полей — в v,
+// содержимое length-delimited — в b
+func walkProto(data []byte, fn func(num protowire.Number, typ protowire.Type, v uint64, b []byte) error) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return errInvalidONNX
+		}
+		data = data[n:]
+
+		var v uint64
+		var b []byte
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(data)
+		case protowire.Fixed32Type:
+			var v32 uint32
+			v32, n = protowire.ConsumeFixed32(data)
+			v = uint64(v32)
+		case protowire.Fixed64Type:
+			v, n = protowire.ConsumeFixed64(data)
+		case protowire.BytesType:
+			b, n = protowire.ConsumeBytes(data)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, data)
+		}
+		if n < 0 {
+			return errInvalidONNX
+		}
+		data = data[n:]
+		if err := fn(num, typ, v, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendProtoFloats добавляет float из упакованного или одиночного поля
+func appendProtoFloats(dst []float64, typ protowire.Type, v uint64, b []byte) []float64 {
+	if typ == protowire.Fixed32Type {
+		return append(dst, float64(math.Float32frombits(uint32(v))))
+	}
+	for ; len(b) >= 4; b = b[4:] {
+		dst = append(dst, float64(math.Float32frombits(binary.LittleEndian.Uint32(b))))
+	}
+	return dst
+}
+
+// appendProtoDoubles добавляет double из упакованного или одиночного поля
+func appendProtoDoubles(dst []float64, typ protowire.Type, v uint64, b []byte) []float64 {
+	if typ == protowire.Fixed64Type {
+		return append(dst, math.Float64frombits(v))
+	}
+	for ; len(b) >= 8; b = b[8:] {
+		dst = append(dst, math.Float64frombits(binary.LittleEndian.Uint64(b)))
+	}
+	return dst
+}
+
+// appendProtoInts добавляет целые из упакованного или одиночного поля
+func appendProtoInts(dst []int64, typ protowire.Type, v uint64, b []byte) []int64 {
+	if typ == protowire.VarintType {
+		return append(dst, int64(v))
+	}
+	for len(b) > 0 {
+		x, n := protowire.ConsumeVarint(b)
+		if n < 0 {
+			break
+		}
+		dst = append(dst, int64(x))
+		b = b[n:]
+	}
+	return dst
+}
+
+// evalONNXNode вычисляет один оператор
+func evalONNXNode(node onnxNode, args []*onnxTensor) (onnxTensor, error) {
+	arg := func(i int) (onnxTensor, error) {
+		if i >= len(args) || args[i] == nil {
+			return onnxTensor{}, fmt.Errorf("input %d is required", i)
+		}
+		return *args[i], nil
+	}
+
+	switch node.op {
+	case "Constant":
+		if t, ok := node.tensors["value"]; ok {
+			return t, nil
+		}
+		if v, ok := node.floats["value_floats"]; ok {
+			return onnxTensor{shape: []int{len(v)}, data: v}, nil
+		}
+		if v, ok := node.floats["value_float"]; ok {
+			return onnxTensor{data: v}, nil
+		}
+		return onnxTensor{}, fmt.Errorf("only tensor and float values are supported")
+	case "Identity", "Dropout":
+		return arg(0)
+	case "Relu", "LeakyRelu", "Sigmoid", "Tanh":
+		x, err := arg(0)
+		if err != nil {
+			return x, err
+		}
+		alpha := node.floatAttr("alpha", 0.01)
+		return mapONNX(x, func(v float64) float64 {
+			switch node.op {
+			case "Relu":
+				return math.Max(v, 0)
+			case "LeakyRelu":
+				if v < 0 {
+					return alpha * v
+				}
+				return v
+			case "Sigmoid":
+				return 1 / (1 + math.Exp(-v))
+			default:
+				return math.Tanh(v)
+			}
+		}), nil
+	case "Clip":
+		x, err := arg(0)
+		if err != nil {
+			return x, err
+		}
+		low, high := node.floatAttr("min", math.Inf(-1)), node.floatAttr("max", math.Inf(1))
+		// С opset 11 границы передаются входами
+		if len(args) > 1 && args[1] != nil && len(args[1].data) > 0 {
+			low = args[1].data[0]
+		}
+		if len(args) > 2 && args[2] != nil && len(args[2].data) > 0 {
+			high = args[2].data[0]
+		}
+		return mapONNX(x, func(v float64) float64 { return math.Max(low, math.Min(high, v)) }), nil
+	case "Add", "Sub", "Mul", "Div":
+		a, err := arg(0)
+		if err != nil {
+			return a, err
+		}
+		b, err := arg(1)
+		if err != nil {
+			return b, err
+		}
+		return broadcastONNX(a, b, func(x, y float64) float64 {
+			switch node.op {
+			case "Add":
+				return x + y
+			case "Sub":
+				return x - y
+			case "Mul":
+				return x * y
+			default:
+				return x / y
+			}
+		})
+	case "Flatten":
+		x, err := arg(0)
+		if err != nil {
+			return x, err
+		}
+		axis := int(node.intAttr("axis", 1))
+		if axis < 0 {
+			axis += len(x.shape)
+		}
+		if axis < 0 || axis > len(x.shape) {
+			return x, fmt.Errorf("axis %d is out of range for shape %v", axis, x.shape)
+		}
+		outer := onnxTensor{shape: x.shape[:axis]}.size()
+		return onnxTensor{shape: []int{outer, x.size() / max(outer, 1)}, data: x.data}, nil
+	case "Reshape":
+		x, err := arg(0)
+		if err != nil {
+			return x, err
+		}
+		target, err := arg(1)
+		if err != nil {
+			return x, err
+		}
+		return reshapeONNX(x, target.data)
+	case "Softmax":
+		x, err := arg(0)
+		if err != nil {
+			return x, err
+		}
+		if axis := node.intAttr("axis", -1); axis != -1 && int(axis) != len(x.shape)-1 {
+			return x, fmt.Errorf("softmax is supported over the last axis only")
+		}
+		return softmaxONNX(x), nil
+	case "MatMul", "Gemm":
+		a, err := arg(0)
+		if err != nil {
+			return a, err
+		}
+		b, err := arg(1)
+		if err != nil {
+			return b, err
+		}
+		var c *onnxTensor
+		if node.op == "Gemm" && len(args) > 2 {
+			c = args[2]
+		}
+		return gemmONNX(a, b, c, node)
+	case "BatchNormalization":
+		x, err := arg(0)
+		if err != nil {
+			return x, err
+		}
+		params := make([]onnxTensor, 4) // scale, bias, mean, var
+		for i := range params {
+			if params[i], err = arg(i + 1); err != nil {
+				return x, err
+			}
+		}
+		return batchNormONNX(x, params, node.floatAttr("epsilon", 1e-5))
+	}
+	return onnxTensor{}, fmt.Errorf("operator is not supported")
+}
+
+func mapONNX(x onnxTensor, fn func(float64) float64) onnxTensor {
+	out := onnxTensor{shape: x.shape, data: make([]float64, len(x.data))}
+	for i, v := range x.data {
+		out.data[i] = fn(v)
+	}
+	return out
+}
+
+// broadcastONNX применяет fn поэлементно с расширением форм по правилам numpy
+func broadcastONNX(a, b onnxTensor, fn func(x, y float64) float64) (onnxTensor, error) {
+	rank := max(len(a.shape), len(b.shape))
+	pad := func(shape []int) []int {
+		padded := make([]int, rank)
+		for i := range padded {
+			padded[i] = 1
+		}
+		copy(padded[rank-len(shape):], shape)
+		return padded
+	}
+	as, bs := pad(a.shape), pad(b.shape)
+	shape := make([]int, rank)
+	for i := range shape {
+		switch {
+		case as[i] == bs[i], bs[i] == 1:
+			shape[i] = as[i]
+		case as[i] == 1:
+			shape[i] = bs[i]
+		default:
+			return onnxTensor{}, fmt.Errorf("shapes %v and %v are not broadcastable", a.shape, b.shape)
+		}
+	}
+
+	out := onnxTensor{shape: shape}
+	out.data = make([]float64, out.size())
+	index := make([]int, rank)
+	for i := range out.data {
+		ai, bi := 0, 0
+		for d := 0; d < rank; d++ {
+			ai = ai*as[d] + index[d]%as[d]
+			bi = bi*bs[d] + index[d]%bs[d]
+		}
+		out.data[i] = fn(a.data[ai], b.data[bi])
+		for d := rank - 1; d >= 0; d-- {
+			if index[d]++; index[d] < shape[d] {
+				break
+			}
+			index[d] = 0
+		}
+	}
+	return out, nil
+}
+
+// reshapeONNX меняет форму: 0 сохраняет размер оси, -1 выводится из остальных
+func reshapeONNX(x onnxTensor, target []float64) (onnxTensor, error) {
+	shape := make([]int, len(target))
+	infer, known := -1, 1
+	for i, d := range target {
+		switch {
+		case d == 0 && i < len(x.shape):
+			shape[i] = x.shape[i]
+		case d == -1 && infer < 0:
+			infer = i
+			continue
+		case d > 0:
+			shape[i] = int(d)
+		default:
+			return x, fmt.Errorf("invalid target shape %v", target)
+		}
+		known *= shape[i]
+	}
+	if infer >= 0 && known > 0 {
+		shape[infer] = x.size() / known
+	}
+	out := onnxTensor{shape: shape, data: x.data}
+	if out.size() != len(x.data) {
+		return x, fmt.Errorf("cannot reshape %v to %v", x.shape, target)
+	}
+	return out, nil
+}
+
+func softmaxONNX(x onnxTensor) onnxTensor {
+	out := onnxTensor{shape: x.shape, data: make([]float64, len(x.data))}
+	width := 1
+	if len(x.shape) > 0 {
+		width = max(x.shape[len(x.shape)-1], 1)
+	}
+	for row := 0; row+width <= len(x.data); row += width {
+		highest := math.Inf(-1)
+		for _, v := range x.data[row : row+width] {
+			highest = math.Max(highest, v)
+		}
+		var sum float64
+		for i, v := range x.data[row : row+width] {
+			out.data[row+i] = math.Exp(v - highest)
+			sum += out.data[row+i]
+		}
+		for i := range out.data[row : row+width] {
+			out.data[row+i] /= sum
+		}
+	}
+	return out
+}
+
+// matrixONNX представляет тензор ранга 1 или 2 матрицей rows×cols
+func matrixONNX(t onnxTensor, transpose bool) (rows, cols int, at func(i, j int) float64, err error) {
+	switch len(t.shape) {
+	case 1:
+		rows, cols = 1, t.shape[0]
+	case 2:
+		rows, cols = t.shape[0], t.shape[1]
+	default:
+		return 0, 0, nil, fmt.Errorf("rank %d is not supported", len(t.shape))
+	}
+	stride := cols
+	at = func(i, j int) float64 { return t.data[i*stride+j] }
+	if transpose {
+		rows, cols = cols, rows
+		at = func(i, j int) float64 { return t.data[j*stride+i] }
+	}
+	return rows, cols, at, nil
+}
+
+// gemmONNX вычисляет alpha·A·B + beta·C; для MatMul alpha = 1 и C нет
+func gemmONNX(a, b onnxTensor, c *onnxTensor, node onnxNode) (onnxTensor, error) {
+	m, k, atA, err := matrixONNX(a, node.intAttr("transA", 0) == 1)
+	if err != nil {
+		return a, err
+	}
+	k2, n, atB, err := matrixONNX(b, node.intAttr("transB", 0) == 1)
+	if err != nil {
+		return b, err
+	}
+	if len(b.shape) == 1 {
+		// Вектор справа — столбец
+		k2, n = b.shape[0], 1
+		atB = func(i, j int) float64 { return b.data[i] }
+	}
+	if k != k2 {
+		return a, fmt.Errorf("shapes %v and %v do not match", a.shape, b.shape)
+	}
+
+	alpha := node.floatAttr("alpha", 1)
+	out := onnxTensor{shape: []int{m, n}, data: make([]float64, m*n)}
+	for i := 0; i < m; i++ {
+		for j := 0; j < n; j++ {
+			var sum float64
+			for p := 0; p < k; p++ {
+				sum += atA(i, p) * atB(p, j)
+			}
+			out.data[i*n+j] = alpha * sum
+		}
+	}
+	if c != nil {
+		beta := node.floatAttr("beta", 1)
+		if out, err = broadcastONNX(out, *c, func(x, y float64) float64 { return x + beta*y }); err != nil {
+			return out, err
+		}
+	}
+	// MatMul с вектором сохраняет ранг вектора
+	if node.op == "MatMul" && len(a.shape) == 1 {
+		out.shape = []int{n}
+	} else if node.op == "MatMul" && len(b.shape) == 1 {
+		out.shape = []int{m}
+	}
+	return out, nil
+}
+
+// batchNormONNX нормирует по оси каналов (вторая ось)
+func batchNormONNX(x onnxTensor, params []onnxTensor, epsilon float64) (onnxTensor, error) {
+	if len(x.shape) < 2 {
+		return x, fmt.Errorf("input must have at least 2 dimensions")
+	}
+	channels := x.shape[1]
+	for _, p := range params {
+		if len(p.data) != channels {
+			return x, fmt.Errorf("parameters must have %d values", channels)
+		}
+	}
+	inner := onnxTensor{shape: x.shape[2:]}.size()
+	out := onnxTensor{shape: x.shape, data: make([]float64, len(x.data))}
+	for i, v := range x.data {
+		ch := (i / inner) % channels
+		scale, bias, mean, variance := params[0].data[ch], params[1].data[ch], params[2].data[ch], params[3].data[ch]
+		out.data[i] = scale*(v-mean)/math.Sqrt(variance+epsilon) + bias
+	}
+	return out, nil
+}
@@ -0,0 +1,532 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Модели для тестов собираются из protobuf вручную по onnx.proto, а
+// ожидаемые значения посчитаны по определениям операторов в спецификации ONNX
+
+func onnxField(b []byte, num protowire.Number, v []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+func onnxVarint(b []byte, num protowire.Number, v int64) []byte {
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(v))
+}
+
+// onnxTestTensor TensorProto float с упакованным float_data
+func onnxTestTensor(name string, dims []int, values ...float64) []byte {
+	var b []byte
+	for _, d := range dims {
+		b = onnxVarint(b, onnxTensorDims, int64(d))
+	}
+	b = onnxVarint(b, onnxTensorDataType, onnxFloat)
+	var packed []byte
+	for _, v := range values {
+		packed = binary.LittleEndian.AppendUint32(packed, math.Float32bits(float32(v)))
+	}
+	b = onnxField(b, onnxTensorFloatData, packed)
+	return onnxField(b, onnxTensorName, []byte(name))
+}
+
+// onnxTestRawTensor TensorProto с данными в raw_data, как их пишет PyTorch
+func onnxTestRawTensor(name string, dataType int64, dims []int, values ...float64) []byte {
+	var b []byte
+	for _, d := range dims {
+		b = onnxVarint(b, onnxTensorDims, int64(d))
+	}
+	b = onnxVarint(b, onnxTensorDataType, dataType)
+	var raw []byte
+	for _, v := range values {
+		switch dataType {
+		case onnxFloat:
+			raw = binary.LittleEndian.AppendUint32(raw, math.Float32bits(float32(v)))
+		case onnxDouble:
+			raw = binary.LittleEndian.AppendUint64(raw, math.Float64bits(v))
+		case onnxInt64:
+			raw = binary.LittleEndian.AppendUint64(raw, uint64(int64(v)))
+		}
+	}
+	b = onnxField(b, onnxTensorRawData, raw)
+	return onnxField(b, onnxTensorName, []byte(name))
+}
+
+// onnxTestInt64Tensor TensorProto int64 с упакованным int64_data
+func onnxTestInt64Tensor(name string, values ...int64) []byte {
+	b := onnxVarint(nil, onnxTensorDims, int64(len(values)))
+	b = onnxVarint(b, onnxTensorDataType, onnxInt64)
+	var packed []byte
+	for _, v := range values {
+		packed = protowire.AppendVarint(packed, uint64(v))
+	}
+	b = onnxField(b, onnxTensorInt64Data, packed)
+	return onnxField(b, onnxTensorName, []byte(name))
+}
+
+// onnxTestValueInfo ValueInfoProto; размер -1 записывается как dim_param
+func onnxTestValueInfo(name string, dims ...int) []byte {
+	var shape []byte
+	for _, d := range dims {
+		var dim []byte
+		if d < 0 {
+			dim = onnxField(nil, 2, []byte("N"))
+		} else {
+			dim = onnxVarint(nil, onnxDimValue, int64(d))
+		}
+		shape = onnxField(shape, onnxShapeDim, dim)
+	}
+	tensor := onnxVarint(nil, 1, onnxFloat)
+	tensor = onnxField(tensor, onnxTensorShape, shape)
+	typ := onnxField(nil, onnxTypeTensor, tensor)
+
+	b := onnxField(nil, onnxValueInfoName, []byte(name))
+	return onnxField(b, onnxValueInfoType, typ)
+}
+
+func onnxAttrF(name string, v float64) []byte {
+	b := onnxField(nil, onnxAttrName, []byte(name))
+	b = protowire.AppendTag(b, onnxAttrFloat, protowire.Fixed32Type)
+	return protowire.AppendFixed32(b, math.Float32bits(float32(v)))
+}
+
+func onnxAttrI(name string, v int64) []byte {
+	b := onnxField(nil, onnxAttrName, []byte(name))
+	return onnxVarint(b, onnxAttrInt, v)
+}
+
+func onnxAttrT(name string, tensor []byte) []byte {
+	b := onnxField(nil, onnxAttrName, []byte(name))
+	return onnxField(b, onnxAttrTensor, tensor)
+}
+
+// onnxTestNode NodeProto; входы и выходы перечисляются через пробел,
+// "_" — пропущенный необязательный вход
+func onnxTestNode(op, inputs, outputs string, attrs ...[]byte) []byte {
+	var b []byte
+	for _, in := range strings.Fields(inputs) {
+		if in == "_" {
+			in = ""
+		}
+		b = onnxField(b, onnxNodeInput, []byte(in))
+	}
+	for _, out := range strings.Fields(outputs) {
+		b = onnxField(b, onnxNodeOutput, []byte(out))
+	}
+	b = onnxField(b, onnxNodeOpType, []byte(op))
+	for _, attr := range attrs {
+		b = onnxField(b, onnxNodeAttribute, attr)
+	}
+	return b
+}
+
+// onnxTestOpset версия ai.onnx тестовых моделей, как у выгрузки PyTorch 2
+const onnxTestOpset = 17
+
+// onnxTestGraph ModelProto с графом из готовых частей
+func onnxTestGraph(inputs, outputs, nodes, initializers [][]byte) []byte {
+	return onnxTestGraphOpset(onnxTestOpset, inputs, outputs, nodes, initializers)
+}
+
+// onnxTestGraphOpset ModelProto с версией ai.onnx opset; 0 — без opset_import
+func onnxTestGraphOpset(opset int64, inputs, outputs, nodes, initializers [][]byte) []byte {
+	var graph []byte
+	for _, node := range nodes {
+		graph = onnxField(graph, onnxGraphNode, node)
+	}
+	for _, init := range initializers {
+		graph = onnxField(graph, onnxGraphInitializer, init)
+	}
+	for _, in := range inputs {
+		graph = onnxField(graph, onnxGraphInput, in)
+	}
+	for _, out := range outputs {
+		graph = onnxField(graph, onnxGraphOutput, out)
+	}
+	model := onnxVarint(nil, 1, 8) // ir_version
+	if opset > 0 {
+		model = onnxField(model, onnxModelOpsetImport, onnxVarint(nil, onnxOpsetVersion, opset))
+	}
+	return onnxField(model, onnxModelGraph, graph)
+}
+
+// onnxTestModel модель со входом x формы [N, features] и выходом y
+func onnxTestModel(features int, nodes [][]byte, initializers ...[]byte) []byte {
+	return onnxTestGraph(
+		[][]byte{onnxTestValueInfo("x", -1, features)},
+		[][]byte{onnxTestValueInfo("y")},
+		nodes, initializers,
+	)
+}
+
+func onnxNodes(nodes ...[]byte) [][]byte { return nodes }
+
+func TestONNXOperators(t *testing.T) {
+	cases := []struct {
+		name     string
+		ops      []string
+		model    []byte
+		features []float64
+		want     []float64
+	}{
+		{
+			name: "gemm",
+			ops:  []string{"Gemm"},
+			// 2·(x·Wᵀ) + 0.5·b
+			model: onnxTestModel(3,
+				onnxNodes(onnxTestNode("Gemm", "x W b", "y", onnxAttrI("transB", 1), onnxAttrF("alpha", 2), onnxAttrF("beta", 0.5))),
+				onnxTestTensor("W", []int{2, 3}, 1, 0, -1, 0.5, 0.5, 0.5),
+				onnxTestTensor("b", []int{2}, 0.5, -1),
+			),
+			features: []float64{1, 2, 3},
+			want:     []float64{-3.75, 5.5},
+		},
+		{
+			name: "matmul raw float",
+			ops:  []string{"MatMul"},
+			model: onnxTestModel(3,
+				onnxNodes(onnxTestNode("MatMul", "x W", "y")),
+				onnxTestRawTensor("W", onnxFloat, []int{3, 2}, 1, 2, 3, 4, 5, 6),
+			),
+			features: []float64{1, 2, 3},
+			want:     []float64{22, 28},
+		},
+		{
+			name: "add raw double",
+			ops:  []string{"Add"},
+			model: onnxTestModel(3,
+				onnxNodes(onnxTestNode("Add", "x c", "y")),
+				onnxTestRawTensor("c", onnxDouble, []int{3}, 2, 4, 8),
+			),
+			features: []float64{1, 2, 3},
+			want:     []float64{3, 6, 11},
+		},
+		{
+			name: "sub",
+			ops:  []string{"Sub"},
+			model: onnxTestModel(3,
+				onnxNodes(onnxTestNode("Sub", "x c", "y")),
+				onnxTestTensor("c", []int{3}, 2, 4, 8),
+			),
+			features: []float64{1, 2, 3},
+			want:     []float64{-1, -2, -5},
+		},
+		{
+			name: "mul broadcast scalar",
+			ops:  []string{"Mul"},
+			model: onnxTestModel(3,
+				onnxNodes(onnxTestNode("Mul", "x c", "y")),
+				onnxTestTensor("c", nil, 4),
+			),
+			features: []float64{1, 2, 3},
+			want:     []float64{4, 8, 12},
+		},
+		{
+			name: "div broadcast column",
+			ops:  []string{"Div"},
+			model: onnxTestModel(3,
+				onnxNodes(onnxTestNode("Div", "c x", "y")),
+				onnxTestTensor("c", []int{1, 1}, 6),
+			),
+			features: []float64{1, 2, 3},
+			want:     []float64{6, 3, 2},
+		},
+		{
+			name:     "relu",
+			ops:      []string{"Relu"},
+			model:    onnxTestModel(3, onnxNodes(onnxTestNode("Relu", "x", "y"))),
+			features: []float64{-1, 0, 2},
+			want:     []float64{0, 0, 2},
+		},
+		{
+			name:     "leaky relu",
+			ops:      []string{"LeakyRelu"},
+			model:    onnxTestModel(3, onnxNodes(onnxTestNode("LeakyRelu", "x", "y", onnxAttrF("alpha", 0.25)))),
+			features: []float64{-2, 0, 2},
+			want:     []float64{-0.5, 0, 2},
+		},
+		{
+			name:     "sigmoid",
+			ops:      []string{"Sigmoid"},
+			model:    onnxTestModel(3, onnxNodes(onnxTestNode("Sigmoid", "x", "y"))),
+			features: []float64{0, 2, -2},
+			want:     []float64{0.5, 0.8807970779778823, 0.11920292202211755},
+		},
+		{
+			name:     "tanh",
+			ops:      []string{"Tanh"},
+			model:    onnxTestModel(2, onnxNodes(onnxTestNode("Tanh", "x", "y"))),
+			features: []float64{0.5, -1},
+			want:     []float64{0.46211715726000974, -0.7615941559557649},
+		},
+		{
+			name:     "softmax",
+			ops:      []string{"Softmax"},
+			model:    onnxTestModel(3, onnxNodes(onnxTestNode("Softmax", "x", "y", onnxAttrI("axis", 1)))),
+			features: []float64{1, 2, 3},
+			want:     []float64{0.09003057317038046, 0.24472847105479767, 0.6652409557748219},
+		},
+		{
+			// Форма после Flatten и Reshape проверяется следующим MatMul,
+			// который не примет тензор другого ранга или размера
+			name: "flatten",
+			ops:  []string{"Flatten"},
+			model: onnxTestGraph(
+				[][]byte{onnxTestValueInfo("x", 1, 2, 2)},
+				[][]byte{onnxTestValueInfo("y")},
+				onnxNodes(
+					onnxTestNode("Flatten", "x", "flat", onnxAttrI("axis", 1)),
+					onnxTestNode("MatMul", "flat W", "y"),
+				),
+				[][]byte{onnxTestTensor("W", []int{4, 1}, 1, 10, 100, 1000)},
+			),
+			features: []float64{1, 2, 3, 4},
+			want:     []float64{4321},
+		},
+		{
+			name: "reshape",
+			ops:  []string{"Reshape"},
+			model: onnxTestModel(4,
+				onnxNodes(
+					onnxTestNode("Reshape", "x shape", "rows"),
+					onnxTestNode("MatMul", "rows W", "y"),
+				),
+				onnxTestInt64Tensor("shape", 2, -1),
+				onnxTestTensor("W", []int{2, 1}, 1, 1),
+			),
+			features: []float64{1, 2, 3, 4},
+			want:     []float64{3, 7},
+		},
+		{
+			name: "identity and dropout",
+			ops:  []string{"Identity", "Dropout"},
+			model: onnxTestModel(2, onnxNodes(
+				onnxTestNode("Dropout", "x", "d mask"),
+				onnxTestNode("Identity", "d", "y"),
+			)),
+			features: []float64{1.5, -2},
+			want:     []float64{1.5, -2},
+		},
+		{
+			name:     "clip attributes",
+			ops:      []string{"Clip"},
+			model:    onnxTestModel(3, onnxNodes(onnxTestNode("Clip", "x", "y", onnxAttrF("min", 0), onnxAttrF("max", 1)))),
+			features: []float64{-1, 0.5, 2},
+			want:     []float64{0, 0.5, 1},
+		},
+		{
+			name: "clip inputs",
+			ops:  []string{"Clip"},
+			model: onnxTestModel(3,
+				onnxNodes(onnxTestNode("Clip", "x _ high", "y")),
+				onnxTestTensor("high", nil, 1),
+			),
+			features: []float64{-1, 0.5, 2},
+			want:     []float64{-1, 0.5, 1},
+		},
+		{
+			name: "constant",
+			ops:  []string{"Constant"},
+			model: onnxTestModel(3, onnxNodes(
+				onnxTestNode("Constant", "", "c", onnxAttrT("value", onnxTestTensor("", []int{3}, 1, 1, 1))),
+				onnxTestNode("Add", "x c", "y"),
+			)),
+			features: []float64{1, 2, 3},
+			want:     []float64{2, 3, 4},
+		},
+		{
+			// scale·(x − mean)/√(var + ε) + bias по каналам
+			name: "batch normalization",
+			ops:  []string{"BatchNormalization"},
+			model: onnxTestModel(2,
+				onnxNodes(onnxTestNode("BatchNormalization", "x scale bias mean var", "y", onnxAttrF("epsilon", 0))),
+				onnxTestTensor("scale", []int{2}, 2, 3),
+				onnxTestTensor("bias", []int{2}, 0.5, -0.5),
+				onnxTestTensor("mean", []int{2}, 0, 1),
+				onnxTestTensor("var", []int{2}, 4, 0.25),
+			),
+			features: []float64{1, 2},
+			want:     []float64{1.5, 5.5},
+		},
+		{
+			// Типичная выгрузка MLP из PyTorch: Gemm → Relu → Gemm → Sigmoid
+			name: "mlp",
+			ops:  []string{"Gemm", "Relu", "Sigmoid"},
+			model: onnxTestModel(2,
+				onnxNodes(
+					onnxTestNode("Gemm", "x W1 b1", "h", onnxAttrI("transB", 1)),
+					onnxTestNode("Relu", "h", "a"),
+					onnxTestNode("Gemm", "a W2 b2", "z", onnxAttrI("transB", 1)),
+					onnxTestNode("Sigmoid", "z", "y"),
+				),
+				onnxTestTensor("W1", []int{2, 2}, 1, -1, -1, 1),
+				onnxTestTensor("b1", []int{2}, 0, 0),
+				onnxTestTensor("W2", []int{1, 2}, 1, 1),
+				onnxTestTensor("b2", []int{1}, -1),
+			),
+			features: []float64{3, 1},
+			// h = [2, -2], a = [2, 0], z = 1
+			want: []float64{0.7310585786300049},
+		},
+	}
+
+	covered := make(map[string]bool)
+	for _, tc := range cases {
+		for _, op := range tc.ops {
+			covered[op] = true
+		}
+		t.Run(tc.name, func(t *testing.T) {
+			model, err := parseONNXModel(tc.model)
+			if err != nil {
+				t.Fatalf("parse: %v", err)
+			}
+			got, err := model.Run(tc.features)
+			if err != nil {
+				t.Fatalf("run: %v", err)
+			}
+			if len(got) != len(tc.want) {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+			for i := range got {
+				if math.Abs(got[i]-tc.want[i]) > 1e-6 {
+					t.Fatalf("got %v, want %v", got, tc.want)
+				}
+			}
+		})
+	}
+	for _, op := range onnxSupportedOps {
+		if !covered[op] {
+			t.Errorf("supported operator %s has no golden test", op)
+		}
+	}
+}
+
+func TestONNXInputShape(t *testing.T) {
+	model, err := parseONNXModel(onnxTestModel(3, onnxNodes(onnxTestNode("Relu", "x", "y"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := model.InputSize(); got != 3 {
+		t.Fatalf("input size %d, want 3", got)
+	}
+	if _, err := model.Run([]float64{1, 2}); err == nil {
+		t.Fatal("run accepted 2 features for a model with 3 inputs")
+	}
+}
+
+func TestONNXSoftmaxBeforeOpset13(t *testing.T) {
+	// До opset 13 axis по умолчанию 1, для матрицы это последняя ось
+	model, err := parseONNXModel(onnxTestGraphOpset(11,
+		[][]byte{onnxTestValueInfo("x", 1, 2)}, [][]byte{onnxTestValueInfo("y")},
+		onnxNodes(onnxTestNode("Softmax", "x", "y")), nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := model.Run([]float64{0, math.Log(3)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(out[0]-0.25) > 1e-9 || math.Abs(out[1]-0.75) > 1e-9 {
+		t.Fatalf("softmax %v, want [0.25 0.75]", out)
+	}
+}
+
+func TestONNXWeightsListedAsInputs(t *testing.T) {
+	// До IR 4 инициализаторы дублируются среди входов графа
+	data := onnxTestGraph(
+		[][]byte{onnxTestValueInfo("x", 1, 2), onnxTestValueInfo("c", 2)},
+		[][]byte{onnxTestValueInfo("y")},
+		onnxNodes(onnxTestNode("Add", "x c", "y")),
+		[][]byte{onnxTestTensor("c", []int{2}, 1, 2)},
+	)
+	model, err := parseONNXModel(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if model.input != "x" {
+		t.Fatalf("input %q, want x", model.input)
+	}
+	got, err := model.Run([]float64{10, 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got[0] != 11 || got[1] != 22 {
+		t.Fatalf("got %v, want [11 22]", got)
+	}
+}
+
+func TestONNXRejectsUnsupportedGraphs(t *testing.T) {
+	mlNode := onnxField(onnxTestNode("TreeEnsembleRegressor", "x", "y"), onnxNodeDomain, []byte("ai.onnx.ml"))
+	cases := []struct {
+		name  string
+		model []byte
+		want  string
+	}{
+		{
+			name:  "unknown operator",
+			model: onnxTestModel(3, onnxNodes(onnxTestNode("Conv", "x", "y"))),
+			want:  "unsupported operator Conv",
+		},
+		{
+			// Так выгружаются модели sklearn через skl2onnx
+			name:  "ai.onnx.ml domain",
+			model: onnxTestModel(3, onnxNodes(mlNode)),
+			want:  "domain ai.onnx.ml",
+		},
+		{
+			name: "two inputs",
+			model: onnxTestGraph(
+				[][]byte{onnxTestValueInfo("x", 1, 2), onnxTestValueInfo("z", 1, 2)},
+				[][]byte{onnxTestValueInfo("y")},
+				onnxNodes(onnxTestNode("Add", "x z", "y")),
+				nil,
+			),
+			want: "single input",
+		},
+		{
+			name:  "no nodes",
+			model: onnxTestModel(3, nil),
+			want:  "no nodes",
+		},
+		{
+			name:  "opset too old",
+			model: onnxTestGraphOpset(onnxMinOpset-1, [][]byte{onnxTestValueInfo("x", 1, 3)}, [][]byte{onnxTestValueInfo("y")}, onnxNodes(onnxTestNode("Relu", "x", "y")), nil),
+			want:  "unsupported opset 8",
+		},
+		{
+			name:  "opset too new",
+			model: onnxTestGraphOpset(onnxMaxOpset+1, [][]byte{onnxTestValueInfo("x", 1, 3)}, [][]byte{onnxTestValueInfo("y")}, onnxNodes(onnxTestNode("Relu", "x", "y")), nil),
+			want:  "unsupported opset 22",
+		},
+		{
+			name:  "no opset",
+			model: onnxTestGraphOpset(0, [][]byte{onnxTestValueInfo("x", 1, 3)}, [][]byte{onnxTestValueInfo("y")}, onnxNodes(onnxTestNode("Relu", "x", "y")), nil),
+			want:  "ai.onnx operator set",
+		},
+		{
+			name:  "constant without value",
+			model: onnxTestModel(3, onnxNodes(onnxTestNode("Constant", "", "c"), onnxTestNode("Add", "x c", "y"))),
+			want:  "unsupported Constant",
+		},
+		{
+			name:  "truncated",
+			model: onnxTestModel(3, onnxNodes(onnxTestNode("Relu", "x", "y")))[:10],
+			want:  "invalid onnx model",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parseONNXModel(tc.model)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("error %v, want %q", err, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// opsgenieAlert алерт Opsgenie Alert API (POST /v2/alerts)
+type opsgenieAlert struct {
+	Message     string            `json:"message"`
+	Alias       string            `json:"alias"`
+	Description string            `json:"description"`
+	Entity      string            `json:"entity"`
+	Source      string            `json:"source"`
+	Priority    string            `json:"priority"`
+	Tags        []string          `json:"tags"`
+	Details     map[string]string `json:"details"`
+}
+
+// opsgenieBackend создает и закрывает алерты Opsgenie; alias алерта —
+// ключ дедупликации, поэтому повторные аномалии увеличивают счетчик
+// открытого алерта
+type opsgenieBackend struct {
+	base   string
+	client *http.Client
+}
+
+// NewOpsgenieNotifier создает уведомитель Opsgenie; ключи — API-ключи
+// интеграций, через которые алерты попадают к нужной команде
+func NewOpsgenieNotifier(cfg OpsgenieConfig) *IncidentNotifier {
+	backend := &opsgenieBackend{
+		base:   strings.TrimRight(cfg.URL, "/") + "/v2/alerts",
+		client: &http.Client{},
+	}
+	return newIncidentNotifier("opsgenie", backend, cfg.APIKey, cfg.Routes, cfg.Severities, cfg.ResolveAfter)
+}
+
+func (b *opsgenieBackend) trigger(ctx context.Context, key, dedupKey string, anomaly AnalyticsResult) error {
+	priority := "P3"
+	if anomaly.Severity == SeverityCritical {
+		priority = "P1"
+	}
+	return b.post(ctx, key, b.base, opsgenieAlert{
+		Message: fmt.Sprintf("%s anomaly on %s: %s=%.2f",
+			anomaly.Type, anomaly.DeviceID, anomaly.Field, anomaly.Value),
+		Alias: dedupKey,
+		Description: fmt.Sprintf("Value %s of %s deviates from the rolling average %.2f (z-score %.2f)",
+			strconv.FormatFloat(anomaly.Value, 'f', -1, 64), anomaly.Field, anomaly.RollingAverage, anomaly.ZScore),
+		Entity:   anomaly.DeviceID,
+		Source:   "highload-service",
+		Priority: priority,
+		Tags:     []string{"highload", anomaly.Type, anomaly.Severity},
+		Details:  incidentDetails(anomaly),
+	})
+}
+
+func (b *opsgenieBackend) resolve(ctx context.Context, key, dedupKey string) error {
+	endpoint := b.base + "/" + url.PathEscape(dedupKey) + "/close?identifierType=alias"
+	return b.post(ctx, key, endpoint, map[string]string{
+		"source": "highload-service",
+		"note":   "Anomaly condition cleared",
+	})
+}
+
+func (b *opsgenieBackend) post(ctx context.Context, key, endpoint string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "GenieKey "+key)
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("opsgenie returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// pagerDutyEvent событие PagerDuty Events API v2 (POST /v2/enqueue)
+type pagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"`
+	DedupKey    string            `json:"dedup_key"`
+	Client      string            `json:"client,omitempty"`
+	Payload     *pagerDutyPayload `json:"payload,omitempty"`
+}
+
+type pagerDutyPayload struct {
+	Summary       string            `json:"summary"`
+	Source        string            `json:"source"`
+	Severity      string            `json:"severity"`
+	Timestamp     string            `json:"timestamp"`
+	Component     string            `json:"component"`
+	Class         string            `json:"class"`
+	CustomDetails map[string]string `json:"custom_details"`
+}
+
+// pagerDutyBackend отправляет события в PagerDuty Events API v2
+type pagerDutyBackend struct {
+	endpoint string
+	client   *http.Client
+}
+
+// NewPagerDutyNotifier создает уведомитель PagerDuty; ключи — routing key
+// интеграций Events API v2
+func NewPagerDutyNotifier(cfg PagerDutyConfig) *IncidentNotifier {
+	backend := &pagerDutyBackend{
+		endpoint: strings.TrimRight(cfg.URL, "/") + "/v2/enqueue",
+		client:   &http.Client{},
+	}
+	return newIncidentNotifier("pagerduty", backend, cfg.RoutingKey, cfg.Routes, cfg.Severities, cfg.ResolveAfter)
+}
+
+func (b *pagerDutyBackend) trigger(ctx context.Context, key, dedupKey string, anomaly AnalyticsResult) error {
+	severity := "warning"
+	if anomaly.Severity == SeverityCritical {
+		severity = "critical"
+	}
+	return b.post(ctx, pagerDutyEvent{
+		RoutingKey:  key,
+		EventAction: "trigger",
+		DedupKey:    dedupKey,
+		Client:      "highload-service",
+		Payload: &pagerDutyPayload{
+			Summary: fmt.Sprintf("%s anomaly on %s: %s=%.2f",
+				anomaly.Type, anomaly.DeviceID, anomaly.Field, anomaly.Value),
+			Source:        anomaly.DeviceID,
+			Severity:      severity,
+			Timestamp:     time.Unix(anomaly.Timestamp, 0).UTC().Format(time.RFC3339),
+			Component:     anomaly.Field,
+			Class:         anomaly.Type,
+			CustomDetails: incidentDetails(anomaly),
+		},
+	})
+}
+
+func (b *pagerDutyBackend) resolve(ctx context.Context, key, dedupKey string) error {
+	return b.post(ctx, pagerDutyEvent{RoutingKey: key, EventAction: "resolve", DedupKey: dedupKey})
+}
+
+func (b *pagerDutyBackend) post(ctx context.Context, event pagerDutyEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("pagerduty returned %s", resp.Status)
+	}
+	return nil
+}
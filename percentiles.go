@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	deviceSketchShards      = 16
+	deviceSketchCompression = 50
+	deviceSketchBucket      = time.Minute
+	// deviceSketchBuckets ограничивает максимальное окно запроса (60 минут)
+	deviceSketchBuckets = 60
+	defaultSketchWindow = 5 * time.Minute
+)
+
+// sketchRing кольцо поминутных скетчей одного поля устройства.
+// Память ограничена числом интервалов и сжатием t-digest и не зависит от потока значений.
+type sketchRing struct {
+	digests [deviceSketchBuckets]*TDigest
+	starts  [deviceSketchBuckets]int64 // номер интервала, которому принадлежит слот
+	latest  int64
+}
+
+type deviceSketchShard struct {
+	mu     sync.Mutex
+	series map[string]map[string]*sketchRing // device_id -> field -> кольцо
+}
+
+// DeviceSketches поддерживает квантили значений каждого устройства за последний час
+type DeviceSketches struct {
+	shards [deviceSketchShards]*deviceSketchShard
+}
+
+// DevicePercentiles результат запроса квантилей устройства
+type DevicePercentiles struct {
+	DeviceID      string  `json:"device_id"`
+	Field         string  `json:"field"`
+	WindowSeconds int64   `json:"window_seconds"`
+	Samples       int64   `json:"samples"`
+	P50           float64 `json:"p50"`
+	P90           float64 `json:"p90"`
+	P95           float64 `json:"p95"`
+	P99           float64 `json:"p99"`
+}
+
+func NewDeviceSketches() *DeviceSketches {
+	ds := &DeviceSketches{}
+	for i := range ds.shards {
+		ds.shards[i] = &deviceSketchShard{series: make(map[string]map[string]*sketchRing)}
+	}
+	return ds
+}
+
+func (ds *DeviceSketches) shard(deviceID string) *deviceSketchShard {
+	h := fnv.New32a()
+	h.Write([]byte(deviceID))
+	return ds.shards[h.Sum32()%deviceSketchShards]
+}
+
+func sketchBucket(ts int64) int64 {
+	return ts / int64(deviceSketchBucket/time.Second)
+}
+
+// Add учитывает значение поля в интервале, соответствующем метке времени
+func (ds *DeviceSketches) Add(deviceID, field string, ts int64, value float64) {
+	bucket := sketchBucket(ts)
+	sh := ds.shard(deviceID)
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	fields, ok := sh.series[deviceID]
+	if !ok {
+		fields = make(map[string]*sketchRing)
+		sh.series[deviceID] = fields
+	}
+	ring, ok := fields[field]
+	if !ok {
+		ring = &sketchRing{}
+		fields[field] = ring
+	}
+
+	// Остаток от деления отрицательного интервала отрицателен
+	slot := (bucket%deviceSketchBuckets + deviceSketchBuckets) % deviceSketchBuckets
+	if ring.digests[slot] == nil || ring.starts[slot] != bucket {
+		if ring.digests[slot] != nil && ring.starts[slot] > bucket {
+			// Значение старше часа относительно уже занятого слота
+			return
+		}
+		ring.digests[slot] = NewTDigest(deviceSketchCompression)
+		ring.starts[slot] = bucket
+	}
+	ring.digests[slot].Add(value)
+	if bucket > ring.latest {
+		ring.latest = bucket
+	}
+}
+
+// Percentiles объединяет интервалы окна и вычисляет квантили поля устройства.
+// asOf ограничивает окно минутами, завершившимися к этому моменту; 0 — текущее окно.
+func (ds *DeviceSketches) Percentiles(deviceID, field string, window time.Duration, asOf int64) (DevicePercentiles, bool) {
+	sh := ds.shard(deviceID)
+	merged := NewTDigest(deviceSketchCompression)
+	from := sketchBucket(time.Now().Add(-window).Unix())
+	until := int64(math.MaxInt64)
+	if asOf != 0 {
+		until = sketchBucket(asOf + 1)
+		from = until - int64(window/deviceSketchBucket)
+	}
+
+	sh.mu.Lock()
+	ring, ok := sh.series[deviceID][field]
+	if ok {
+		for slot, digest := range ring.digests {
+			if digest != nil && ring.starts[slot] >= from && ring.starts[slot] < until {
+				merged.Merge(digest)
+			}
+		}
+	}
+	sh.mu.Unlock()
+	if !ok {
+		return DevicePercentiles{}, false
+	}
+
+	result := DevicePercentiles{
+		DeviceID:      deviceID,
+		Field:         field,
+		WindowSeconds: int64(window / time.Second),
+		Samples:       int64(merged.Count()),
+	}
+	if merged.Count() > 0 {
+		result.P50 = merged.Quantile(0.50)
+		result.P90 = merged.Quantile(0.90)
+		result.P95 = merged.Quantile(0.95)
+		result.P99 = merged.Quantile(0.99)
+	}
+	return result, true
+}
+
+// Remove удаляет скетчи устройства
+func (ds *DeviceSketches) Remove(deviceID string) {
+	sh := ds.shard(deviceID)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	delete(sh.series, deviceID)
+}
+
+// Run удаляет скетчи полей, не получавших значений дольше максимального окна
+func (ds *DeviceSketches) Run() {
+	ticker := time.NewTicker(deviceSketchBucket)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		cutoff := sketchBucket(now.Unix()) - deviceSketchBuckets
+		for _, sh := range ds.shards {
+			sh.mu.Lock()
+			for deviceID, fields := range sh.series {
+				for field, ring := range fields {
+					if ring.latest < cutoff {
+						delete(fields, field)
+					}
+				}
+				if len(fields) == 0 {
+					delete(sh.series, deviceID)
+				}
+			}
+			sh.mu.Unlock()
+		}
+	}
+}
+
+// PercentilesHandler возвращает p50/p90/p95/p99 поля устройства за окно (по умолчанию 5m, не более 1h).
+// С as_of окно заканчивается последней завершенной к этому моменту минутой.
+func (s *Service) PercentilesHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	deviceID := query.Get("device_id")
+	if deviceID == "" {
+		http.Error(w, "device_id is required", http.StatusBadRequest)
+		return
+	}
+	field := query.Get("field")
+	if field == "" {
+		field = "cpu"
+	}
+	if !validFieldName(field) {
+		http.Error(w, "invalid field name", http.StatusBadRequest)
+		return
+	}
+
+	window := defaultSketchWindow
+	if raw := query.Get("window"); raw != "" {
+		parsed, err := time.ParseDuration(raw)
+		if err != nil {
+			// Допускаем окно в секундах
+			seconds, convErr := strconv.Atoi(raw)
+			if convErr != nil {
+				http.Error(w, "window must be a duration", http.StatusBadRequest)
+				return
+			}
+			parsed = time.Duration(seconds) * time.Second
+		}
+		if parsed < deviceSketchBucket || parsed > deviceSketchBuckets*deviceSketchBucket {
+			http.Error(w, "window must be between 1m and 1h", http.StatusBadRequest)
+			return
+		}
+		window = parsed
+	}
+
+	asOf, _, err := asOfParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Скетчи хранят последний час: более раннее окно восстановить нельзя
+	if asOf != 0 && time.Since(time.Unix(asOf, 0))+window > deviceSketchBuckets*deviceSketchBucket {
+		http.Error(w, "as_of window is older than the retained hour", http.StatusBadRequest)
+		return
+	}
+
+	result, ok := s.sketches.Percentiles(deviceID, field, window, asOf)
+	if !ok {
+		http.Error(w, "no data for device field", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeviceSketchesNegativeAndZeroTimestamps(t *testing.T) {
+	ds := NewDeviceSketches()
+	for _, ts := range []int64{-5, -65, -3600, 0} {
+		ds.Add("dev", "cpu", ts, 1)
+	}
+	// -3600 старше часа относительно занятого слота и отбрасывается
+	got, ok := ds.Percentiles("dev", "cpu", time.Hour, 59)
+	if !ok || got.Samples != 3 {
+		t.Fatalf("got %+v, %v; want 3 values within the hour ending at 59", got, ok)
+	}
+}
+
+func TestMetricRejectsNegativeTimestamp(t *testing.T) {
+	values := map[string]float64{"cpu": 1}
+	for _, metric := range []Metric{
+		{DeviceID: "dev", Timestamp: -5, Values: values},
+		{DeviceID: "dev", Samples: []MetricSample{{Timestamp: -5, Values: values}}},
+	} {
+		if metric.Validate(10, 10) == nil {
+			t.Errorf("%+v: accepted a negative timestamp", metric)
+		}
+	}
+	if (Metric{DeviceID: "dev", Values: values}).Validate(10, 10) != nil {
+		t.Error("rejected a metric without timestamp")
+	}
+	if _, err := parseUDPLine("dev:1|1|1|-5"); err == nil {
+		t.Error("udp line with a negative timestamp accepted")
+	}
+	if _, _, err := parseInfluxLine("cpu,device_id=dev value=1 -5"); err == nil {
+		t.Error("influx line with a negative timestamp accepted")
+	}
+}
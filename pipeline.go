@@ -0,0 +1,706 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Типы источников
+const (
+	SourceTypeHTTP = "http"
+	SourceTypeUDP  = "udp"
+)
+
+// Типы обработчиков
+const (
+	ProcessorDropFields = "drop_fields"
+	ProcessorKeepFields = "keep_fields"
+	ProcessorRename     = "rename"
+	ProcessorScale      = "scale"
+)
+
+// Типы приемников сырых метрик
+const (
+	SinkTypeRedisCache = "redis_cache"
+	SinkTypeClickHouse = "clickhouse"
+)
+
+// Детекторы, на которые может ссылаться конвейер (ключи секции detectors)
+const (
+	PipelineDetectorZScore      = "zscore"
+	PipelineDetectorCUSUM       = "cusum"
+	PipelineDetectorIQR         = "iqr"
+	PipelineDetectorCorrelation = "correlation"
+	PipelineDetectorIsolation   = "isolation"
+	PipelineDetectorSeasonal    = "seasonal"
+	PipelineDetectorTrend       = "trend"
+	PipelineDetectorML          = "ml"
+)
+
+var pipelineEvents = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "highload_pipeline_events_total",
+		Help: "Total number of metrics passing pipeline stages by stage, name and outcome",
+	},
+	[]string{"stage", "name", "outcome"},
+)
+
+var (
+	ErrPipelineStageNotFound = errors.New("pipeline stage not found")
+	ErrPipelineStageExists   = errors.New("pipeline stage already exists")
+)
+
+// Sink принимает сырые метрики после буферизации
+type Sink interface {
+	Name() string
+	Write(metric Metric)
+}
+
+// drainer реализуют приемники с отложенной записью: Drain дожидается отправки
+// уже принятых метрик перед отключением приемника
+type drainer interface {
+	Drain(ctx context.Context) error
+}
+
+// redisCacheSink кэширует метрику в Redis на 10 минут
+type redisCacheSink struct {
+	service  *Service
+	inFlight sync.WaitGroup
+}
+
+func (rs *redisCacheSink) Name() string { return SinkTypeRedisCache }
+
+func (rs *redisCacheSink) Write(metric Metric) {
+	rs.inFlight.Add(1)
+	goSafe("cache", func() {
+		defer rs.inFlight.Done()
+		rs.service.cacheMetric(metric)
+	})
+}
+
+// Drain ждет завершения начатых записей в кэш
+func (rs *redisCacheSink) Drain(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		rs.inFlight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// StageStatus состояние одного звена конвейера для /api/pipeline/status
+type StageStatus struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	In      int64  `json:"in"`
+	Out     int64  `json:"out"`
+	Dropped int64  `json:"dropped,omitempty"`
+}
+
+// stage счетчики звена конвейера
+type stage struct {
+	kind    string
+	name    string
+	typ     string
+	in      atomic.Int64
+	out     atomic.Int64
+	dropped atomic.Int64
+}
+
+func newStage(kind, name, typ string) *stage {
+	return &stage{kind: kind, name: name, typ: typ}
+}
+
+func (st *stage) record(outcome string) {
+	switch outcome {
+	case "in":
+		st.in.Add(1)
+	case "out":
+		st.out.Add(1)
+	case "dropped":
+		st.dropped.Add(1)
+	}
+	pipelineEvents.WithLabelValues(st.kind, st.name, outcome).Inc()
+}
+
+func (st *stage) status() StageStatus {
+	return StageStatus{Name: st.name, Type: st.typ, In: st.in.Load(), Out: st.out.Load(), Dropped: st.dropped.Load()}
+}
+
+type pipelineProcessor struct {
+	*stage
+	cfg ProcessorConfig
+}
+
+// apply изменяет значения метрики; false означает, что полей не осталось
+func (p *pipelineProcessor) apply(fields map[string]float64) bool {
+	switch p.cfg.Type {
+	case ProcessorDropFields:
+		for _, field := range p.cfg.Fields {
+			delete(fields, field)
+		}
+	case ProcessorKeepFields:
+		for field := range fields {
+			if !containsString(p.cfg.Fields, field) {
+				delete(fields, field)
+			}
+		}
+	case ProcessorRename:
+		if value, ok := fields[p.cfg.From]; ok {
+			delete(fields, p.cfg.From)
+			fields[p.cfg.To] = value
+		}
+	case ProcessorScale:
+		for _, field := range p.cfg.Fields {
+			if value, ok := fields[field]; ok {
+				fields[field] = value*p.cfg.Factor + p.cfg.Offset
+			}
+		}
+	}
+	return len(fields) > 0
+}
+
+type pipelineSink struct {
+	*stage
+	sink Sink
+}
+
+// Pipeline связывает источники, обработчики, детекторы и приемники,
+// описанные в секции pipeline конфигурации. Детекторы и приемники можно
+// заменять на лету; источники и обработчики меняются только перезапуском.
+type Pipeline struct {
+	service    *Service
+	sources    map[string]*stage // тип источника -> счетчики
+	order      []*stage
+	processors []*pipelineProcessor
+
+	mu            sync.RWMutex
+	detectors     map[string]*stage // Detector.Name() -> счетчики
+	detectorNames []string
+	sinks         []*pipelineSink
+}
+
+// effectivePipeline возвращает конфигурацию конвейера с заполненными
+// значениями по умолчанию, повторяющими поведение без секции pipeline
+func (c *Config) effectivePipeline() PipelineConfig {
+	p := c.Pipeline
+	if len(p.Sources) == 0 {
+		p.Sources = []PipelineStageConfig{{Name: SourceTypeHTTP, Type: SourceTypeHTTP}}
+		if c.UDP.Addr != "" {
+			p.Sources = append(p.Sources, PipelineStageConfig{Name: SourceTypeUDP, Type: SourceTypeUDP})
+		}
+		if c.Influx.Enabled {
+			p.Sources = append(p.Sources, PipelineStageConfig{Name: SourceTypeInflux, Type: SourceTypeInflux})
+		}
+		if c.NATS.Subject != "" {
+			p.Sources = append(p.Sources, PipelineStageConfig{Name: SourceTypeNATS, Type: SourceTypeNATS})
+		}
+	}
+	if p.Detectors == nil {
+		p.Detectors = []string{PipelineDetectorZScore, PipelineDetectorCUSUM, PipelineDetectorIQR, PipelineDetectorCorrelation,
+			PipelineDetectorIsolation, PipelineDetectorSeasonal, PipelineDetectorTrend, PipelineDetectorML}
+	}
+	if p.Sinks == nil {
+		p.Sinks = []PipelineStageConfig{{Name: SinkTypeRedisCache, Type: SinkTypeRedisCache}}
+		if c.ClickHouse.URL != "" {
+			p.Sinks = append(p.Sinks, PipelineStageConfig{Name: SinkTypeClickHouse, Type: SinkTypeClickHouse})
+		}
+	}
+	return p
+}
+
+// pipelineDetectors оставляет включенными только детекторы, подключенные к конвейеру
+func (c *Config) pipelineDetectors() DetectorsConfig {
+	detectors := c.Detectors
+	wired := c.effectivePipeline().Detectors
+	detectors.ZScore.Enabled = detectors.ZScore.Enabled && containsString(wired, PipelineDetectorZScore)
+	detectors.CUSUM.Enabled = detectors.CUSUM.Enabled && containsString(wired, PipelineDetectorCUSUM)
+	detectors.IQR.Enabled = detectors.IQR.Enabled && containsString(wired, PipelineDetectorIQR)
+	detectors.Correlation.Enabled = detectors.Correlation.Enabled && containsString(wired, PipelineDetectorCorrelation)
+	detectors.Isolation.Enabled = detectors.Isolation.Enabled && containsString(wired, PipelineDetectorIsolation)
+	detectors.Seasonal.Enabled = detectors.Seasonal.Enabled && containsString(wired, PipelineDetectorSeasonal)
+	detectors.Trend.Enabled = detectors.Trend.Enabled && containsString(wired, PipelineDetectorTrend)
+	detectors.ML.Enabled = detectors.ML.Enabled && containsString(wired, PipelineDetectorML)
+	return detectors
+}
+
+// NewPipeline собирает конвейер из проверенной конфигурации
+func NewPipeline(cfg *Config, s *Service) *Pipeline {
+	pc := cfg.effectivePipeline()
+	p := &Pipeline{
+		service: s,
+		sources: make(map[string]*stage, len(pc.Sources)),
+	}
+	for _, src := range pc.Sources {
+		st := newStage("source", src.Name, src.Type)
+		p.sources[src.Type] = st
+		p.order = append(p.order, st)
+	}
+	for _, proc := range pc.Processors {
+		p.processors = append(p.processors, &pipelineProcessor{stage: newStage("processor", proc.Name, proc.Type), cfg: proc})
+	}
+	p.SetDetectors(cfg.pipelineDetectors())
+	p.SetSinks(pc.Sinks)
+	return p
+}
+
+// SetDetectors подключает включенные детекторы, сохраняя счетчики оставшихся
+func (p *Pipeline) SetDetectors(cfg DetectorsConfig) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	previous := p.detectors
+	p.detectors = make(map[string]*stage)
+	p.detectorNames = nil
+	wire := func(enabled bool, name, typ string) {
+		if !enabled {
+			return
+		}
+		st, ok := previous[typ]
+		if !ok {
+			st = newStage("detector", name, typ)
+		}
+		p.detectors[typ] = st
+		p.detectorNames = append(p.detectorNames, typ)
+	}
+	wire(cfg.ZScore.Enabled, PipelineDetectorZScore, AnomalyTypeZScore)
+	wire(cfg.CUSUM.Enabled, PipelineDetectorCUSUM, AnomalyTypeChangePoint)
+	wire(cfg.IQR.Enabled, PipelineDetectorIQR, AnomalyTypeIQR)
+	wire(cfg.Correlation.Enabled, PipelineDetectorCorrelation, AnomalyTypeDecorrelation)
+	wire(cfg.Isolation.Enabled, PipelineDetectorIsolation, AnomalyTypeIsolation)
+	wire(cfg.Seasonal.Enabled, PipelineDetectorSeasonal, AnomalyTypeSeasonal)
+	wire(cfg.Trend.Enabled, PipelineDetectorTrend, AnomalyTypeTrend)
+	wire(cfg.ML.Enabled, PipelineDetectorML, AnomalyTypeML)
+}
+
+// SetSinks заменяет набор приемников. Приемники с прежними именем и типом
+// продолжают работу; отключенные возвращаются для дренирования. После возврата
+// Emit уже не пишет в отключенные приемники.
+func (p *Pipeline) SetSinks(configs []PipelineStageConfig) []*pipelineSink {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	previous := make(map[string]*pipelineSink, len(p.sinks))
+	for _, ps := range p.sinks {
+		previous[ps.name] = ps
+	}
+
+	sinks := make([]*pipelineSink, 0, len(configs))
+	for _, sc := range configs {
+		if ps, ok := previous[sc.Name]; ok && ps.typ == sc.Type {
+			sinks = append(sinks, ps)
+			delete(previous, sc.Name)
+			continue
+		}
+		var sink Sink
+		switch sc.Type {
+		case SinkTypeRedisCache:
+			sink = &redisCacheSink{service: p.service}
+		case SinkTypeClickHouse:
+			sink = p.service.archive
+		}
+		sinks = append(sinks, &pipelineSink{stage: newStage("sink", sc.Name, sc.Type), sink: sink})
+	}
+	p.sinks = sinks
+
+	removed := make([]*pipelineSink, 0, len(previous))
+	for _, ps := range previous {
+		removed = append(removed, ps)
+	}
+	return removed
+}
+
+// Drain дожидается отправки данных, принятых отключенными приемниками
+func (p *Pipeline) Drain(removed []*pipelineSink, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var errs []error
+	for _, ps := range removed {
+		if d, ok := ps.sink.(drainer); ok {
+			if err := d.Drain(ctx); err != nil {
+				errs = append(errs, fmt.Errorf("sink %s: %w", ps.name, err))
+				continue
+			}
+		}
+		log.Printf("Pipeline sink %s (%s) drained and removed", ps.name, ps.typ)
+	}
+	return errors.Join(errs...)
+}
+
+// Sinks возвращает действующие приемники
+func (p *Pipeline) Sinks() []Sink {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	sinks := make([]Sink, len(p.sinks))
+	for i, ps := range p.sinks {
+		sinks[i] = ps.sink
+	}
+	return sinks
+}
+
+// Accepts сообщает, подключен ли источник данного типа, и учитывает метрику
+func (p *Pipeline) Accepts(sourceType string) bool {
+	st, ok := p.sources[sourceType]
+	if ok {
+		st.record("in")
+	}
+	return ok
+}
+
+// Process учитывает прошедшую проверку метрику источника и применяет
+// обработчики к ее полям по порядку. Возвращает false, если полей не осталось.
+func (p *Pipeline) Process(sourceType string, fields map[string]float64) bool {
+	if st, ok := p.sources[sourceType]; ok {
+		st.record("out")
+	}
+	for _, proc := range p.processors {
+		proc.record("in")
+		if !proc.apply(fields) {
+			proc.record("dropped")
+			return false
+		}
+		proc.record("out")
+	}
+	return true
+}
+
+// RecordDetection учитывает проверку значения детектором и срабатывание
+func (p *Pipeline) RecordDetection(detector string, fired bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if st, ok := p.detectors[detector]; ok {
+		st.record("in")
+		if fired {
+			st.record("out")
+		}
+	}
+}
+
+// Emit передает метрику во все приемники
+func (p *Pipeline) Emit(metric Metric) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, ps := range p.sinks {
+		ps.record("in")
+		ps.sink.Write(metric)
+		ps.record("out")
+	}
+}
+
+// PipelineStatus текущее устройство конвейера и счетчики звеньев
+type PipelineStatus struct {
+	Sources    []StageStatus `json:"sources"`
+	Processors []StageStatus `json:"processors"`
+	Queue      string        `json:"queue"`
+	Detectors  []StageStatus `json:"detectors"`
+	Sinks      []StageStatus `json:"sinks"`
+}
+
+func (p *Pipeline) Status(queue string) PipelineStatus {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	status := PipelineStatus{
+		Sources:    make([]StageStatus, 0, len(p.order)),
+		Processors: make([]StageStatus, 0, len(p.processors)),
+		Queue:      queue,
+		Detectors:  make([]StageStatus, 0, len(p.detectorNames)),
+		Sinks:      make([]StageStatus, 0, len(p.sinks)),
+	}
+	for _, st := range p.order {
+		status.Sources = append(status.Sources, st.status())
+	}
+	for _, proc := range p.processors {
+		status.Processors = append(status.Processors, proc.status())
+	}
+	for _, name := range p.detectorNames {
+		status.Detectors = append(status.Detectors, p.detectors[name].status())
+	}
+	for _, ps := range p.sinks {
+		status.Sinks = append(status.Sinks, ps.status())
+	}
+	return status
+}
+
+// validate проверяет секцию pipeline с учетом остальных секций конфигурации
+func (pc PipelineConfig) validate(c *Config) error {
+	if pc.DrainTimeout <= 0 {
+		return fmt.Errorf("pipeline.drain_timeout: must be positive")
+	}
+	names := make(map[string]bool)
+	unique := func(path, name string) error {
+		if name == "" || names[name] {
+			return fmt.Errorf("%s.name: must be unique and not empty", path)
+		}
+		names[name] = true
+		return nil
+	}
+
+	types := make(map[string]bool)
+	for i, src := range pc.Sources {
+		path := fmt.Sprintf("pipeline.sources[%d]", i)
+		if err := unique(path, src.Name); err != nil {
+			return err
+		}
+		switch src.Type {
+		case SourceTypeHTTP:
+		case SourceTypeUDP:
+			if c.UDP.Addr == "" {
+				return fmt.Errorf("%s.type: udp source requires udp.addr", path)
+			}
+		case SourceTypeInflux:
+			if !c.Influx.Enabled {
+				return fmt.Errorf("%s.type: influx source requires influx.enabled", path)
+			}
+		case SourceTypeNATS:
+			if c.NATS.Subject == "" {
+				return fmt.Errorf("%s.type: nats source requires nats.subject", path)
+			}
+		default:
+			return fmt.Errorf("%s.type: unknown source type %q", path, src.Type)
+		}
+		if types[src.Type] {
+			return fmt.Errorf("%s.type: only one %s source is allowed", path, src.Type)
+		}
+		types[src.Type] = true
+	}
+
+	for i, proc := range pc.Processors {
+		path := fmt.Sprintf("pipeline.processors[%d]", i)
+		if err := unique(path, proc.Name); err != nil {
+			return err
+		}
+		switch proc.Type {
+		case ProcessorDropFields, ProcessorKeepFields, ProcessorScale:
+			if len(proc.Fields) == 0 {
+				return fmt.Errorf("%s.fields: at least one field is required", path)
+			}
+			if err := validateFields(path+".fields", proc.Fields); err != nil {
+				return err
+			}
+			if proc.Type == ProcessorScale && proc.Factor == 0 {
+				return fmt.Errorf("%s.factor: must not be zero", path)
+			}
+		case ProcessorRename:
+			if !validFieldName(proc.From) || !validFieldName(proc.To) {
+				return fmt.Errorf("%s: from and to must be valid field names", path)
+			}
+		default:
+			return fmt.Errorf("%s.type: unknown processor type %q", path, proc.Type)
+		}
+	}
+
+	for i, name := range pc.Detectors {
+		if name != PipelineDetectorZScore && name != PipelineDetectorCUSUM && name != PipelineDetectorIQR &&
+			name != PipelineDetectorCorrelation && name != PipelineDetectorIsolation && name != PipelineDetectorSeasonal &&
+			name != PipelineDetectorTrend && name != PipelineDetectorML {
+			return fmt.Errorf("pipeline.detectors[%d]: unknown detector %q", i, name)
+		}
+	}
+
+	types = make(map[string]bool)
+	for i, sink := range pc.Sinks {
+		path := fmt.Sprintf("pipeline.sinks[%d]", i)
+		if err := unique(path, sink.Name); err != nil {
+			return err
+		}
+		switch sink.Type {
+		case SinkTypeRedisCache:
+		case SinkTypeClickHouse:
+			if c.ClickHouse.URL == "" {
+				return fmt.Errorf("%s.type: clickhouse sink requires clickhouse.url", path)
+			}
+		default:
+			return fmt.Errorf("%s.type: unknown sink type %q", path, sink.Type)
+		}
+		if types[sink.Type] {
+			return fmt.Errorf("%s.type: only one %s sink is allowed", path, sink.Type)
+		}
+		types[sink.Type] = true
+	}
+	return nil
+}
+
+// PipelineStatusHandler показывает звенья конвейера и число прошедших через них метрик
+func (s *Service) PipelineStatusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.pipeline.Status(s.queueName()))
+}
+
+// queueName описывает очередь между источниками и детекторами
+func (s *Service) queueName() string {
+	if s.queue.cfg.Enabled {
+		return "stream:" + s.queue.cfg.Key
+	}
+	return "direct"
+}
+
+// applyPipeline переключает детекторы и приемники на новую конфигурацию и
+// возвращает отключенные приемники для дренирования. Вызывается под configMu.
+func (s *Service) applyPipeline(old, updated *Config) []*pipelineSink {
+	s.detectors = s.reconcileDetectors(old.pipelineDetectors(), updated.pipelineDetectors())
+	s.pipeline.SetDetectors(updated.pipelineDetectors())
+	return s.pipeline.SetSinks(updated.effectivePipeline().Sinks)
+}
+
+// updatePipeline применяет изменение детекторов и приемников к действующей
+// конфигурации. Изменения живут до следующей перезагрузки файла конфигурации.
+func (s *Service) updatePipeline(change func(pc *PipelineConfig) error) ([]*pipelineSink, time.Duration, error) {
+	s.configMu.Lock()
+	defer s.configMu.Unlock()
+
+	// Явные списки вместо значений по умолчанию, чтобы изменение не зависело от них
+	pc := s.config.effectivePipeline()
+	pc.Detectors = append([]string(nil), pc.Detectors...)
+	pc.Sinks = append([]PipelineStageConfig(nil), pc.Sinks...)
+	if err := change(&pc); err != nil {
+		return nil, 0, err
+	}
+
+	updated := *s.config
+	updated.Pipeline.Detectors = pc.Detectors
+	updated.Pipeline.Sinks = pc.Sinks
+	if err := updated.Validate(); err != nil {
+		return nil, 0, err
+	}
+
+	removed := s.applyPipeline(s.config, &updated)
+	s.recordConfig(&updated)
+	return removed, updated.Pipeline.DrainTimeout, nil
+}
+
+// writePipelineChange отвечает на изменение конвейера, дождавшись дренирования
+// отключенных приемников
+func (s *Service) writePipelineChange(w http.ResponseWriter, status string, removed []*pipelineSink, timeout time.Duration, err error) {
+	switch {
+	case errors.Is(err, ErrPipelineStageNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, ErrPipelineStageExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	response := map[string]interface{}{"status": status}
+	if len(removed) > 0 {
+		response["drained"] = true
+		if err := s.pipeline.Drain(removed, timeout); err != nil {
+			log.Printf("Pipeline drain incomplete: %v", err)
+			response["drained"] = false
+			response["drain_error"] = err.Error()
+		}
+	}
+	response["pipeline"] = s.pipeline.Status(s.queueName())
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// AdminPipelineAddSinkHandler подключает приемник без перезапуска
+func (s *Service) AdminPipelineAddSinkHandler(w http.ResponseWriter, r *http.Request) {
+	var sink PipelineStageConfig
+	if err := json.NewDecoder(r.Body).Decode(&sink); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	removed, timeout, err := s.updatePipeline(func(pc *PipelineConfig) error {
+		for _, existing := range pc.Sinks {
+			if existing.Name == sink.Name {
+				return fmt.Errorf("sink %q: %w", sink.Name, ErrPipelineStageExists)
+			}
+		}
+		pc.Sinks = append(pc.Sinks, sink)
+		return nil
+	})
+	if err == nil {
+		log.Printf("Pipeline sink %s (%s) added", sink.Name, sink.Type)
+	}
+	s.writePipelineChange(w, "added", removed, timeout, err)
+}
+
+// AdminPipelineRemoveSinkHandler отключает приемник и ждет отправки принятых им данных
+func (s *Service) AdminPipelineRemoveSinkHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	removed, timeout, err := s.updatePipeline(func(pc *PipelineConfig) error {
+		for i, existing := range pc.Sinks {
+			if existing.Name == name {
+				pc.Sinks = append(pc.Sinks[:i], pc.Sinks[i+1:]...)
+				return nil
+			}
+		}
+		return fmt.Errorf("sink %q: %w", name, ErrPipelineStageNotFound)
+	})
+	s.writePipelineChange(w, "removed", removed, timeout, err)
+}
+
+// AdminPipelineAddDetectorHandler подключает детектор из секции detectors
+func (s *Service) AdminPipelineAddDetectorHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	removed, timeout, err := s.updatePipeline(func(pc *PipelineConfig) error {
+		if containsString(pc.Detectors, req.Name) {
+			return fmt.Errorf("detector %q: %w", req.Name, ErrPipelineStageExists)
+		}
+		// Замыкание выполняется под configMu
+		detectors := s.config.Detectors
+		if req.Name == PipelineDetectorZScore && !detectors.ZScore.Enabled ||
+			req.Name == PipelineDetectorCUSUM && !detectors.CUSUM.Enabled ||
+			req.Name == PipelineDetectorIQR && !detectors.IQR.Enabled ||
+			req.Name == PipelineDetectorCorrelation && !detectors.Correlation.Enabled ||
+			req.Name == PipelineDetectorIsolation && !detectors.Isolation.Enabled ||
+			req.Name == PipelineDetectorSeasonal && !detectors.Seasonal.Enabled ||
+			req.Name == PipelineDetectorTrend && !detectors.Trend.Enabled ||
+			req.Name == PipelineDetectorML && !detectors.ML.Enabled {
+			return fmt.Errorf("detector %q is disabled in detectors section", req.Name)
+		}
+		pc.Detectors = append(pc.Detectors, req.Name)
+		return nil
+	})
+	if err == nil {
+		log.Printf("Pipeline detector %s added", req.Name)
+	}
+	s.writePipelineChange(w, "added", removed, timeout, err)
+}
+
+// AdminPipelineRemoveDetectorHandler отключает детектор; начатые проверки завершаются
+func (s *Service) AdminPipelineRemoveDetectorHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	removed, timeout, err := s.updatePipeline(func(pc *PipelineConfig) error {
+		for i, existing := range pc.Detectors {
+			if existing == name {
+				pc.Detectors = append(pc.Detectors[:i], pc.Detectors[i+1:]...)
+				return nil
+			}
+		}
+		return fmt.Errorf("detector %q: %w", name, ErrPipelineStageNotFound)
+	})
+	if err == nil {
+		log.Printf("Pipeline detector %s removed", name)
+	}
+	s.writePipelineChange(w, "removed", removed, timeout, err)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"mime"
+	"sort"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Номера полей сообщения Metric из proto/metric.proto
+const (
+	protoMetricTimestamp protowire.Number = 1
+	protoMetricDeviceID  protowire.Number = 2
+	protoMetricValues    protowire.Number = 3
+	protoMetricCPU       protowire.Number = 4
+	protoMetricMemory    protowire.Number = 5
+	protoMetricRPS       protowire.Number = 6
+	protoMetricDeadline  protowire.Number = 7
+	protoMetricSamples   protowire.Number = 8
+
+	protoSampleTimestamp protowire.Number = 1
+	protoSampleValues    protowire.Number = 2
+
+	protoMapKey   protowire.Number = 1
+	protoMapValue protowire.Number = 2
+)
+
+var errInvalidProtobuf = errors.New("invalid protobuf")
+
+// isProtobuf сообщает, передано ли тело в формате protobuf
+func isProtobuf(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/x-protobuf" || mediaType == "application/protobuf"
+}
+
+// decodeMetricProto разбирает сообщение Metric и возвращает номера
+// неизвестных полей для политики deny_unknown_fields
+func decodeMetricProto(data []byte) (Metric, []string, error) {
+	metric := Metric{Values: make(map[string]float64)}
+	legacy := make(map[string]float64, 3)
+	unknown := make([]string, 0)
+
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return Metric{}, nil, errInvalidProtobuf
+		}
+		data = data[n:]
+
+		switch {
+		case num == protoMetricTimestamp && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(data)
+			if n < 0 {
+				return Metric{}, nil, errInvalidProtobuf
+			}
+			metric.Timestamp = int64(v)
+			data = data[n:]
+		case num == protoMetricDeviceID && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return Metric{}, nil, errInvalidProtobuf
+			}
+			metric.DeviceID = string(v)
+			data = data[n:]
+		case num == protoMetricDeadline && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return Metric{}, nil, errInvalidProtobuf
+			}
+			metric.DeadlineClass = string(v)
+			data = data[n:]
+		case num == protoMetricValues && typ == protowire.BytesType:
+			entry, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return Metric{}, nil, errInvalidProtobuf
+			}
+			key, value, err := decodeProtoMapEntry(entry)
+			if err != nil {
+				return Metric{}, nil, err
+			}
+			metric.Values[key] = value
+			data = data[n:]
+		case num == protoMetricSamples && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return Metric{}, nil, errInvalidProtobuf
+			}
+			sample, err := decodeMetricSampleProto(v)
+			if err != nil {
+				return Metric{}, nil, err
+			}
+			metric.Samples = append(metric.Samples, sample)
+			data = data[n:]
+		case (num == protoMetricCPU || num == protoMetricMemory || num == protoMetricRPS) && typ == protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(data)
+			if n < 0 {
+				return Metric{}, nil, errInvalidProtobuf
+			}
+			legacy[protoLegacyField(num)] = math.Float64frombits(v)
+			data = data[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return Metric{}, nil, errInvalidProtobuf
+			}
+			unknown = append(unknown, fmt.Sprintf("field %d", num))
+			data = data[n:]
+		}
+	}
+
+	for field, value := range legacy {
+		if _, exists := metric.Values[field]; !exists {
+			metric.Values[field] = value
+		}
+	}
+	sort.Strings(unknown)
+	return metric, unknown, nil
+}
+
+func protoLegacyField(num protowire.Number) string {
+	switch num {
+	case protoMetricCPU:
+		return "cpu"
+	case protoMetricMemory:
+		return "memory"
+	default:
+		return "rps"
+	}
+}
+
+// decodeMetricSampleProto разбирает сообщение Sample
+func decodeMetricSampleProto(data []byte) (MetricSample, error) {
+	sample := MetricSample{Values: make(map[string]float64)}
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return MetricSample{}, errInvalidProtobuf
+		}
+		data = data[n:]
+
+		switch {
+		case num == protoSampleTimestamp && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(data)
+			if n < 0 {
+				return MetricSample{}, errInvalidProtobuf
+			}
+			sample.Timestamp = int64(v)
+			data = data[n:]
+		case num == protoSampleValues && typ == protowire.BytesType:
+			entry, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return MetricSample{}, errInvalidProtobuf
+			}
+			key, value, err := decodeProtoMapEntry(entry)
+			if err != nil {
+				return MetricSample{}, err
+			}
+			sample.Values[key] = value
+			data = data[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return MetricSample{}, errInvalidProtobuf
+			}
+			data = data[n:]
+		}
+	}
+	return sample, nil
+}
+
+// decodeProtoMapEntry разбирает элемент map<string, double>
+func decodeProtoMapEntry(data []byte) (string, float64, error) {
+	var key string
+	var value float64
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return "", 0, errInvalidProtobuf
+		}
+		data = data[n:]
+
+		switch {
+		case num == protoMapKey && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return "", 0, errInvalidProtobuf
+			}
+			key = string(v)
+			data = data[n:]
+		case num == protoMapValue && typ == protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(data)
+			if n < 0 {
+				return "", 0, errInvalidProtobuf
+			}
+			value = math.Float64frombits(v)
+			data = data[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return "", 0, errInvalidProtobuf
+			}
+			data = data[n:]
+		}
+	}
+	return key, value, nil
+}
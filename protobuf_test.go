@@ -0,0 +1,45 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func protoTestMapEntry(key string, bits uint64) []byte {
+	var entry []byte
+	entry = protowire.AppendTag(entry, protoMapKey, protowire.BytesType)
+	entry = protowire.AppendString(entry, key)
+	entry = protowire.AppendTag(entry, protoMapValue, protowire.Fixed64Type)
+	return protowire.AppendFixed64(entry, bits)
+}
+
+func TestMetricProtoRejectsNaN(t *testing.T) {
+	nan := math.Float64bits(math.NaN())
+	device := protowire.AppendString(protowire.AppendTag(nil, protoMetricDeviceID, protowire.BytesType), "dev")
+
+	values := protowire.AppendTag(append([]byte{}, device...), protoMetricValues, protowire.BytesType)
+	values = protowire.AppendBytes(values, protoTestMapEntry("cpu", nan))
+
+	legacy := protowire.AppendTag(append([]byte{}, device...), protoMetricCPU, protowire.Fixed64Type)
+	legacy = protowire.AppendFixed64(legacy, math.Float64bits(math.Inf(1)))
+
+	var sample []byte
+	sample = protowire.AppendTag(sample, protoSampleTimestamp, protowire.VarintType)
+	sample = protowire.AppendVarint(sample, 1700000000)
+	sample = protowire.AppendTag(sample, protoSampleValues, protowire.BytesType)
+	sample = protowire.AppendBytes(sample, protoTestMapEntry("cpu", nan))
+	samples := protowire.AppendTag(append([]byte{}, device...), protoMetricSamples, protowire.BytesType)
+	samples = protowire.AppendBytes(samples, sample)
+
+	for name, data := range map[string][]byte{"values": values, "legacy": legacy, "samples": samples} {
+		metric, _, err := decodeMetricProto(data)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if metric.Validate(10, 10) == nil {
+			t.Errorf("%s: non-finite value accepted", name)
+		}
+	}
+}
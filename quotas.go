@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Области действия квот
+const (
+	QuotaScopeDevice = "device"
+	QuotaScopeTenant = "tenant"
+)
+
+// quotaWindow длительность окна квоты
+const quotaWindow = time.Minute
+
+var quotaRejected = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "highload_quota_rejected_total",
+		Help: "Total number of metrics rejected by ingestion quotas by scope (device, tenant) and tenant (tenants without a configured quota are reported as other)",
+	},
+	[]string{"scope", "tenant"},
+)
+
+// quotaUsage потребление одного устройства или арендатора в текущем окне
+type quotaUsage struct {
+	used     int
+	rejected int
+}
+
+// QuotaUsage потребление квоты, возвращаемое API
+type QuotaUsage struct {
+	Scope     string `json:"scope"`
+	Key       string `json:"key"`
+	Used      int    `json:"used"`
+	Limit     int    `json:"limit"`
+	Remaining int    `json:"remaining"`
+	Rejected  int    `json:"rejected"`
+}
+
+// QuotaDecision результат проверки метрики по квотам
+type QuotaDecision struct {
+	Allowed bool
+	// Scope квота, по которой метрика отклонена
+	Scope  string
+	Device QuotaUsage
+	Tenant QuotaUsage
+	// Reset момент начала следующего окна
+	Reset time.Time
+}
+
+// QuotaTracker считает принятые метрики устройств и арендаторов в окне
+// в одну минуту. Счетчики локальны для экземпляра: в кластере квота устройства
+// точна, так как метрики устройства принимает его владелец, а квота арендатора
+// действует на каждом экземпляре отдельно. Арендатора метрики определяет
+// resolveTenant по токену устройства или ключу API, а не заголовок клиента.
+type QuotaTracker struct {
+	mu          sync.Mutex
+	cfg         QuotasConfig
+	windowStart time.Time
+	devices     map[string]*quotaUsage
+	tenants     map[string]*quotaUsage
+}
+
+func NewQuotaTracker(cfg QuotasConfig) *QuotaTracker {
+	return &QuotaTracker{
+		cfg:     cfg,
+		devices: make(map[string]*quotaUsage),
+		tenants: make(map[string]*quotaUsage),
+	}
+}
+
+// Configure применяет новые лимиты; потребление текущего окна сохраняется
+func (qt *QuotaTracker) Configure(cfg QuotasConfig) {
+	qt.mu.Lock()
+	defer qt.mu.Unlock()
+	qt.cfg = cfg
+}
+
+// quotaLimit возвращает лимит ключа: переопределение или значение по умолчанию
+func quotaLimit(overrides map[string]int, key string, fallback int) int {
+	if l, ok := overrides[key]; ok {
+		return l
+	}
+	return fallback
+}
+
+// tenantLabel метка арендатора для highload_quota_rejected_total: арендатор
+// со своим лимитом в quotas.tenants или default, остальные — other. Вызывается под mu.
+func (qt *QuotaTracker) tenantLabel(tenant string) string {
+	if _, ok := qt.cfg.Tenants[tenant]; ok || tenant == defaultTenant {
+		return tenant
+	}
+	return otherTenant
+}
+
+// roll начинает новое окно, если текущее закончилось. Вызывается под mu.
+func (qt *QuotaTracker) roll(now time.Time) {
+	start := now.Truncate(quotaWindow)
+	if start.Equal(qt.windowStart) {
+		return
+	}
+	qt.windowStart = start
+	qt.devices = make(map[string]*quotaUsage)
+	qt.tenants = make(map[string]*quotaUsage)
+}
+
+// Allow проверяет метрику устройства по квотам устройства и арендатора и
+// учитывает ее, если она принята
+func (qt *QuotaTracker) Allow(tenant, deviceID string) QuotaDecision {
+	return qt.AllowN(tenant, deviceID, 1)
+}
+
+// AllowN проверяет n значений устройства из одной метрики: они принимаются
+// или отклоняются вместе
+func (qt *QuotaTracker) AllowN(tenant, deviceID string, n int) QuotaDecision {
+	qt.mu.Lock()
+	defer qt.mu.Unlock()
+
+	qt.roll(time.Now())
+	decision := QuotaDecision{Allowed: true, Reset: qt.windowStart.Add(quotaWindow)}
+
+	device := qt.usage(qt.devices, deviceID)
+	deviceLimit := quotaLimit(qt.cfg.Devices, deviceID, qt.cfg.DevicePerMinute)
+	tenantUsage := qt.usage(qt.tenants, tenant)
+	tenantLimit := quotaLimit(qt.cfg.Tenants, tenant, qt.cfg.TenantPerMinute)
+
+	switch {
+	case deviceLimit > 0 && device.used+n > deviceLimit:
+		decision.Allowed = false
+		decision.Scope = QuotaScopeDevice
+		device.rejected += n
+	case tenantLimit > 0 && tenantUsage.used+n > tenantLimit:
+		decision.Allowed = false
+		decision.Scope = QuotaScopeTenant
+		tenantUsage.rejected += n
+	default:
+		device.used += n
+		tenantUsage.used += n
+	}
+	if !decision.Allowed {
+		quotaRejected.WithLabelValues(decision.Scope, qt.tenantLabel(tenant)).Add(float64(n))
+	}
+
+	decision.Device = quotaReport(QuotaScopeDevice, deviceID, device, deviceLimit)
+	decision.Tenant = quotaReport(QuotaScopeTenant, tenant, tenantUsage, tenantLimit)
+	return decision
+}
+
+// usage возвращает счетчики ключа, создавая их при первом обращении. Вызывается под mu.
+func (qt *QuotaTracker) usage(m map[string]*quotaUsage, key string) *quotaUsage {
+	u, ok := m[key]
+	if !ok {
+		u = &quotaUsage{}
+		m[key] = u
+	}
+	return u
+}
+
+func quotaReport(scope, key string, u *quotaUsage, limit int) QuotaUsage {
+	report := QuotaUsage{Scope: scope, Key: key, Used: u.used, Limit: limit, Rejected: u.rejected}
+	if limit > 0 {
+		report.Remaining = max(limit-u.used, 0)
+	}
+	return report
+}
+
+// Usage возвращает потребление текущего окна по убыванию: сначала арендаторы,
+// затем не более limit устройств (0 — все)
+func (qt *QuotaTracker) Usage(tenant string, limit int) ([]QuotaUsage, []QuotaUsage, time.Time) {
+	qt.mu.Lock()
+	defer qt.mu.Unlock()
+
+	qt.roll(time.Now())
+	collect := func(scope string, m map[string]*quotaUsage, overrides map[string]int, fallback int) []QuotaUsage {
+		result := make([]QuotaUsage, 0, len(m))
+		for key, u := range m {
+			result = append(result, quotaReport(scope, key, u, quotaLimit(overrides, key, fallback)))
+		}
+		sort.Slice(result, func(i, j int) bool {
+			if result[i].Used != result[j].Used {
+				return result[i].Used > result[j].Used
+			}
+			return result[i].Key < result[j].Key
+		})
+		return result
+	}
+
+	tenants := collect(QuotaScopeTenant, qt.tenants, qt.cfg.Tenants, qt.cfg.TenantPerMinute)
+	if tenant != "" {
+		filtered := make([]QuotaUsage, 0, 1)
+		for _, u := range tenants {
+			if u.Key == tenant {
+				filtered = append(filtered, u)
+			}
+		}
+		tenants = filtered
+	}
+	devices := collect(QuotaScopeDevice, qt.devices, qt.cfg.Devices, qt.cfg.DevicePerMinute)
+	if limit > 0 && len(devices) > limit {
+		devices = devices[:limit]
+	}
+	return tenants, devices, qt.windowStart.Add(quotaWindow)
+}
+
+// writeQuotaHeaders сообщает клиенту лимиты и остаток квот текущего окна
+func writeQuotaHeaders(w http.ResponseWriter, decision QuotaDecision) {
+	h := w.Header()
+	if decision.Device.Limit > 0 {
+		h.Set("X-Quota-Device-Limit", strconv.Itoa(decision.Device.Limit))
+		h.Set("X-Quota-Device-Remaining", strconv.Itoa(decision.Device.Remaining))
+	}
+	if decision.Tenant.Limit > 0 {
+		h.Set("X-Quota-Tenant-Limit", strconv.Itoa(decision.Tenant.Limit))
+		h.Set("X-Quota-Tenant-Remaining", strconv.Itoa(decision.Tenant.Remaining))
+	}
+	if decision.Device.Limit > 0 || decision.Tenant.Limit > 0 {
+		h.Set("X-Quota-Reset", strconv.FormatInt(decision.Reset.Unix(), 10))
+	}
+	if !decision.Allowed {
+		h.Set("Retry-After", strconv.Itoa(max(int(time.Until(decision.Reset).Seconds()+0.5), 1)))
+	}
+}
+
+// QuotaUsageHandler возвращает потребление квот в текущем окне; tenant
+// ограничивает выборку арендаторов, limit — число устройств (по умолчанию 100)
+func (s *Service) QuotaUsageHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit := 100
+	if raw := query.Get("limit"); raw != "" {
+		l, err := strconv.Atoi(raw)
+		if err != nil || l < 0 {
+			http.Error(w, "limit must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		limit = l
+	}
+
+	tenants, devices, reset := s.quotas.Usage(query.Get("tenant"), limit)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"window":  quotaWindow.String(),
+		"reset":   reset.Unix(),
+		"tenants": tenants,
+		"devices": devices,
+	})
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// supervisorRestartDelay пауза перед перезапуском фонового цикла после паники
+const supervisorRestartDelay = time.Second
+
+var panicsTotal = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "highload_panics_total",
+		Help: "Total number of recovered panics by component",
+	},
+	[]string{"component"},
+)
+
+// recoverPanic перехватывает панику, пишет стек в журнал и учитывает ее в метрике.
+// Должна вызываться только через defer.
+func recoverPanic(component string) {
+	if v := recover(); v != nil {
+		logPanic(component, v)
+	}
+}
+
+func logPanic(component string, v interface{}) {
+	panicsTotal.WithLabelValues(component).Inc()
+	log.Printf("Recovered panic in %s: %v\n%s", component, v, debug.Stack())
+}
+
+// goSafe запускает разовую задачу в горутине; паника не останавливает процесс
+func goSafe(component string, fn func()) {
+	go func() {
+		defer recoverPanic(component)
+		fn()
+	}()
+}
+
+// goSupervised запускает фоновый цикл и перезапускает его после паники.
+// Штатный выход из fn завершает горутину.
+func goSupervised(component string, fn func()) {
+	go func() {
+		for runRecovered(component, fn) {
+			time.Sleep(supervisorRestartDelay)
+			log.Printf("Restarting %s after panic", component)
+		}
+	}()
+}
+
+// runRecovered выполняет fn и сообщает, завершилась ли она паникой
+func runRecovered(component string, fn func()) (panicked bool) {
+	defer func() {
+		if v := recover(); v != nil {
+			logPanic(component, v)
+			panicked = true
+		}
+	}()
+	fn()
+	return false
+}
+
+// recoverMiddleware отвечает 500 вместо обрыва соединения, если обработчик паникует
+func recoverMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if v := recover(); v != nil {
+				if v == http.ErrAbortHandler {
+					// Штатное прерывание ответа, net/http обработает его сам
+					panic(v)
+				}
+				logPanic("http "+routeTemplate(r), v)
+				http.Error(w, "internal server error", http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
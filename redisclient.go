@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Режимы подключения к Redis
+const (
+	RedisModeStandalone = "standalone"
+	RedisModeSentinel   = "sentinel"
+	RedisModeCluster    = "cluster"
+)
+
+// newRedisClient создает клиент выбранного режима. В режиме sentinel клиент
+// узнает адрес мастера у Sentinel и переподключается к новому мастеру после
+// переключения; в режиме cluster — следует перенаправлениям MOVED/ASK.
+// Команды, прерванные сетевой ошибкой или переключением, повторяются до
+// max_retries раз с паузой от min_retry_backoff до max_retry_backoff.
+func newRedisClient(cfg RedisConfig) redis.UniversalClient {
+	switch cfg.Mode {
+	case RedisModeSentinel:
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       cfg.MasterName,
+			SentinelAddrs:    cfg.Addrs,
+			SentinelPassword: cfg.SentinelPassword,
+			Password:         cfg.Password,
+			DB:               cfg.DB,
+			MaxRetries:       cfg.MaxRetries,
+			MinRetryBackoff:  cfg.MinRetryBackoff,
+			MaxRetryBackoff:  cfg.MaxRetryBackoff,
+		})
+	case RedisModeCluster:
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:           cfg.Addrs,
+			Password:        cfg.Password,
+			MaxRetries:      cfg.MaxRetries,
+			MinRetryBackoff: cfg.MinRetryBackoff,
+			MaxRetryBackoff: cfg.MaxRetryBackoff,
+		})
+	}
+	return redis.NewClient(&redis.Options{
+		Addr:            cfg.Addr,
+		Password:        cfg.Password,
+		DB:              cfg.DB,
+		MaxRetries:      cfg.MaxRetries,
+		MinRetryBackoff: cfg.MinRetryBackoff,
+		MaxRetryBackoff: cfg.MaxRetryBackoff,
+	})
+}
+
+// scanKeys передает fn ключи, подходящие под pattern, порциями SCAN. В
+// кластере SCAN обходит только один узел, поэтому обходятся все мастеры.
+func scanKeys(ctx context.Context, rdb redis.UniversalClient, pattern string, count int64, fn func(keys []string) error) error {
+	scan := func(ctx context.Context, node redis.UniversalClient) error {
+		var cursor uint64
+		for {
+			keys, next, err := node.Scan(ctx, cursor, pattern, count).Result()
+			if err != nil {
+				return err
+			}
+			if err := fn(keys); err != nil {
+				return err
+			}
+			if cursor = next; cursor == 0 {
+				return nil
+			}
+		}
+	}
+	cluster, ok := rdb.(*redis.ClusterClient)
+	if !ok {
+		return scan(ctx, rdb)
+	}
+	// ForEachMaster вызывает функцию из горутин узлов, а fn не обязана быть
+	// потокобезопасной: сначала собираем мастеры, затем обходим по очереди
+	var mu sync.Mutex
+	var masters []*redis.Client
+	err := cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+		mu.Lock()
+		defer mu.Unlock()
+		masters = append(masters, node)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, node := range masters {
+		if err := scan(ctx, node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ReloadState сведения о последней загрузке конфигурации
+type ReloadState struct {
+	LoadedAt       int64  `json:"loaded_at"`
+	LastReloadAt   int64  `json:"last_reload_at,omitempty"`
+	LastReloadErr  string `json:"last_reload_error,omitempty"`
+	SuccessReloads int    `json:"successful_reloads"`
+	FailedReloads  int    `json:"failed_reloads"`
+}
+
+// activeDetectors возвращает текущий набор детекторов
+func (s *Service) activeDetectors() []Detector {
+	s.configMu.RLock()
+	defer s.configMu.RUnlock()
+	return s.detectors
+}
+
+// policyFor возвращает текущую политику полей арендатора
+func (s *Service) policyFor(tenant string) FieldPolicy {
+	s.configMu.RLock()
+	defer s.configMu.RUnlock()
+	return s.policies.For(tenant)
+}
+
+// tenantLabel возвращает метку арендатора для метрик Prometheus
+func (s *Service) tenantLabel(tenant string) string {
+	s.configMu.RLock()
+	defer s.configMu.RUnlock()
+	return s.policies.Label(tenant)
+}
+
+// maxFields возвращает допустимое число полей в одной метрике
+func (s *Service) maxFields() int {
+	s.configMu.RLock()
+	defer s.configMu.RUnlock()
+	return s.config.Ingest.MaxFields
+}
+
+// maxSamples возвращает допустимое число значений в метрике с samples
+func (s *Service) maxSamples() int {
+	s.configMu.RLock()
+	defer s.configMu.RUnlock()
+	return s.config.Ingest.MaxSamples
+}
+
+// maxDecompressedBytes возвращает предел размера распакованного тела запроса
+func (s *Service) maxDecompressedBytes() int64 {
+	s.configMu.RLock()
+	defer s.configMu.RUnlock()
+	return int64(s.config.Ingest.MaxDecompressedBytes)
+}
+
+// criticalZScore возвращает порог |z-score| для критичных аномалий
+func (s *Service) criticalZScore() float64 {
+	s.configMu.RLock()
+	defer s.configMu.RUnlock()
+	return s.config.Alerting.CriticalZScore
+}
+
+// Reload перечитывает файл конфигурации и применяет изменяемые на лету параметры.
+// Невалидная конфигурация отклоняется целиком, действующая остается без изменений.
+func (s *Service) Reload() error {
+	cfg, err := LoadConfig(s.configPath)
+
+	s.configMu.Lock()
+	defer s.configMu.Unlock()
+
+	s.reloadState.LastReloadAt = time.Now().Unix()
+	if err != nil {
+		s.reloadState.FailedReloads++
+		s.reloadState.LastReloadErr = err.Error()
+		return err
+	}
+
+	old := s.config
+	s.warnRestartRequired(old, cfg)
+
+	s.metricsBuffer.SetLimits(cfg.Buffer.Window, cfg.Buffer.MaxSize)
+	s.metricsBuffer.SetLatenessHorizon(cfg.Buffer.LatenessHorizon)
+	applyMemoryConfig(cfg.Memory)
+	s.anomalies.SetLimits(cfg.Anomalies.Retention, cfg.Anomalies.MaxPerDevice)
+	s.events.Configure(cfg.Events)
+	s.silences.Configure(cfg.Silences)
+	s.deviceTokens.Configure(cfg.DeviceTokens)
+	s.metadata.Configure(cfg.Cohorts)
+	s.feedback.Configure(cfg.Feedback)
+	s.slas.Configure(cfg.SLAs)
+	s.forwarding.Configure(cfg.Forwarders)
+	s.quotas.Configure(cfg.Quotas)
+	s.dedup.Configure(cfg.Dedup)
+	s.ingestStatus.Configure(cfg.Ingest)
+	s.rules.Configure(cfg.Rules)
+	s.calibration.Configure(cfg.Calibration)
+	s.health.SetTimeout(cfg.Health.CheckTimeout)
+	s.synthetic.Configure(cfg.Synthetic)
+	s.lb.Configure(cfg.LBHealth)
+	s.admission.Configure(cfg.Admission)
+	s.jobs.Configure(cfg.Jobs)
+	s.batches.Configure(cfg.Batch)
+	s.trash.SetRetention(cfg.Admin.TrashRetention)
+	s.policies = cfg.Tenants.Policies
+	s.forensics.Configure(cfg.Forensics)
+	s.sampling.Configure(cfg.Sampling)
+	s.shadow.Configure(cfg.Shadow)
+	s.reports.Configure(cfg.Reports)
+	s.fields.Configure(cfg.Fields)
+	if removed := s.applyPipeline(old, cfg); len(removed) > 0 {
+		goSafe("pipeline drain", func() {
+			if err := s.pipeline.Drain(removed, cfg.Pipeline.DrainTimeout); err != nil {
+				log.Printf("Pipeline drain incomplete: %v", err)
+			}
+		})
+	}
+	if !reflect.DeepEqual(old.Alerting, cfg.Alerting) {
+		s.alerts.SetNotifiers(buildNotifiers(cfg.Alerting))
+		s.alerts.SetBatching(cfg.Alerting.Batching)
+	}
+
+	s.recordConfig(cfg)
+	s.reloadState.LoadedAt = s.reloadState.LastReloadAt
+	s.reloadState.LastReloadErr = ""
+	s.reloadState.SuccessReloads++
+	return nil
+}
+
+// reconcileDetectors пересоздает только детекторы с измененной конфигурацией,
+// чтобы не терять накопленное состояние остальных
+func (s *Service) reconcileDetectors(old, updated DetectorsConfig) []Detector {
+	unchanged := map[string]bool{
+		AnomalyTypeZScore:        reflect.DeepEqual(old.ZScore, updated.ZScore),
+		AnomalyTypeChangePoint:   reflect.DeepEqual(old.CUSUM, updated.CUSUM),
+		AnomalyTypeIQR:           reflect.DeepEqual(old.IQR, updated.IQR),
+		AnomalyTypeDecorrelation: reflect.DeepEqual(old.Correlation, updated.Correlation),
+		AnomalyTypeIsolation:     reflect.DeepEqual(old.Isolation, updated.Isolation),
+		AnomalyTypeSeasonal:      reflect.DeepEqual(old.Seasonal, updated.Seasonal),
+		AnomalyTypeTrend:         reflect.DeepEqual(old.Trend, updated.Trend),
+		AnomalyTypeML:            reflect.DeepEqual(old.ML, updated.ML),
+	}
+
+	previous := make(map[string]Detector, len(s.detectors))
+	for _, detector := range s.detectors {
+		previous[detector.Name()] = detector
+	}
+
+	detectors := buildDetectors(updated, s.stats, s.metricsBuffer, s.redis, s.ha.Active, s.feedback, s.fields)
+	for i, detector := range detectors {
+		if prev, ok := previous[detector.Name()]; ok && unchanged[detector.Name()] {
+			detectors[i] = prev
+		}
+	}
+	return detectors
+}
+
+func (s *Service) warnRestartRequired(old, updated *Config) {
+	if old.Server != updated.Server {
+		log.Printf("Warning: server settings changed, restart required to apply")
+	}
+	// Содержимое сертификата перечитывается отдельно, остальное — перезапуском
+	if old.TLS != updated.TLS {
+		log.Printf("Warning: tls settings changed, restart required to apply")
+	}
+	// Токены debug применяются на лету, включение — перезапуском
+	if old.Debug.Enabled != updated.Debug.Enabled {
+		log.Printf("Warning: debug settings changed, restart required to apply")
+	}
+	if old.IDs != updated.IDs {
+		log.Printf("Warning: ids settings changed, restart required to apply")
+	}
+	if !reflect.DeepEqual(old.Redis, updated.Redis) {
+		log.Printf("Warning: redis settings changed, restart required to apply")
+	}
+	if old.UDP != updated.UDP {
+		log.Printf("Warning: udp settings changed, restart required to apply")
+	}
+	if old.Memory.BallastMB != updated.Memory.BallastMB {
+		log.Printf("Warning: memory.ballast_mb changed, restart required to apply")
+	}
+	if old.Stream != updated.Stream {
+		log.Printf("Warning: stream settings changed, restart required to apply")
+	}
+	if old.NATS != updated.NATS {
+		log.Printf("Warning: nats settings changed, restart required to apply")
+	}
+	// Детекторы и приемники конвейера переключаются на лету
+	if !reflect.DeepEqual(old.Pipeline.Sources, updated.Pipeline.Sources) ||
+		!reflect.DeepEqual(old.Pipeline.Processors, updated.Pipeline.Processors) {
+		log.Printf("Warning: pipeline sources or processors changed, restart required to apply")
+	}
+	// Токены слушателей применяются на лету, остальные параметры — перезапуском
+	if !reflect.DeepEqual(listenerLayout(old.Listeners), listenerLayout(updated.Listeners)) {
+		log.Printf("Warning: listeners settings changed, restart required to apply")
+	}
+	if old.GRPC.Addr != updated.GRPC.Addr {
+		log.Printf("Warning: grpc address changed, restart required to apply")
+	}
+	if old.HA != updated.HA {
+		log.Printf("Warning: ha settings changed, restart required to apply")
+	}
+	if old.Leader != updated.Leader {
+		log.Printf("Warning: leader settings changed, restart required to apply")
+	}
+	if old.SharedStats != updated.SharedStats {
+		log.Printf("Warning: shared_stats settings changed, restart required to apply")
+	}
+	if old.Rollups != updated.Rollups {
+		log.Printf("Warning: rollups settings changed, restart required to apply")
+	}
+	if old.Cluster != updated.Cluster {
+		log.Printf("Warning: cluster settings changed, restart required to apply")
+	}
+	if old.Warmup != updated.Warmup {
+		log.Printf("Warning: warmup settings changed, restart required to apply")
+	}
+	if old.Migrations != updated.Migrations {
+		log.Printf("Warning: migrations settings changed, restart required to apply")
+	}
+	if old.ClickHouse != updated.ClickHouse {
+		log.Printf("Warning: clickhouse settings changed, restart required to apply")
+	}
+}
+
+// listenerLayout возвращает слушатели без значений токенов, но с признаком
+// включенной проверки: включить или отключить ее можно только перезапуском
+func listenerLayout(listeners []ListenerConfig) []ListenerConfig {
+	layout := make([]ListenerConfig, len(listeners))
+	for i, l := range listeners {
+		layout[i] = l
+		layout[i].AuthTokens = nil
+		if len(l.AuthTokens) > 0 {
+			layout[i].AuthTokens = []string{"***"}
+		}
+	}
+	return layout
+}
+
+// listenerTokens возвращает действующие токены слушателя
+func (s *Service) listenerTokens(name string) []string {
+	s.configMu.RLock()
+	defer s.configMu.RUnlock()
+	for _, l := range s.config.Listeners {
+		if l.Name == name {
+			return l.AuthTokens
+		}
+	}
+	return nil
+}
+
+// watchConfig перезагружает конфигурацию по SIGHUP и, если задан интервал,
+// при изменении времени модификации файла
+func (s *Service) watchConfig() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	var lastMod time.Time
+	s.configMu.RLock()
+	interval := s.config.Reload.WatchInterval
+	s.configMu.RUnlock()
+	if interval > 0 && s.configPath != "" {
+		if info, err := os.Stat(s.configPath); err == nil {
+			lastMod = info.ModTime()
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-hup:
+			log.Println("SIGHUP received, reloading configuration")
+		case <-tick:
+			info, err := os.Stat(s.configPath)
+			if err != nil || !info.ModTime().After(lastMod) {
+				continue
+			}
+			lastMod = info.ModTime()
+			log.Println("Configuration file changed, reloading")
+		}
+
+		if err := s.Reload(); err != nil {
+			log.Printf("Configuration reload failed, keeping previous config: %v", err)
+			continue
+		}
+		log.Println("Configuration reloaded")
+	}
+}
+
+// AdminConfigHandler возвращает действующую конфигурацию и сведения о перезагрузках
+func (s *Service) AdminConfigHandler(w http.ResponseWriter, r *http.Request) {
+	s.configMu.RLock()
+	cfg := s.config
+	state := s.reloadState
+	s.configMu.RUnlock()
+
+	view, err := configView(cfg)
+	if err != nil {
+		http.Error(w, "Failed to render config", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"source": s.configPath,
+		"config": view,
+		"reload": state,
+	})
+}
+
+// configView возвращает конфигурацию со скрытыми секретами в виде дерева с
+// именами полей как в файле конфигурации
+func configView(config *Config) (map[string]interface{}, error) {
+	cfg := *config
+	if cfg.Redis.Password != "" {
+		cfg.Redis.Password = "***"
+	}
+	if cfg.ClickHouse.Password != "" {
+		cfg.ClickHouse.Password = "***"
+	}
+	if cfg.Cluster.AuthToken != "" {
+		cfg.Cluster.AuthToken = "***"
+	}
+	if cfg.Cluster.ForwardSecret != "" {
+		cfg.Cluster.ForwardSecret = "***"
+	}
+	if cfg.NATS.Password != "" {
+		cfg.NATS.Password = "***"
+	}
+	if cfg.NATS.Token != "" {
+		cfg.NATS.Token = "***"
+	}
+	if cfg.Secrets.Vault.Token != "" {
+		cfg.Secrets.Vault.Token = "***"
+	}
+	cfg.Listeners = append([]ListenerConfig(nil), cfg.Listeners...)
+	for i := range cfg.Listeners {
+		tokens := make([]string, len(cfg.Listeners[i].AuthTokens))
+		for j := range tokens {
+			tokens[j] = "***"
+		}
+		cfg.Listeners[i].AuthTokens = tokens
+	}
+	cfg.Tenants.APIKeys = append([]TenantAPIKey(nil), cfg.Tenants.APIKeys...)
+	for i := range cfg.Tenants.APIKeys {
+		cfg.Tenants.APIKeys[i].Key = "***"
+	}
+	cfg.Forwarders = append([]ForwarderConfig(nil), cfg.Forwarders...)
+	for i := range cfg.Forwarders {
+		if cfg.Forwarders[i].AuthToken != "" {
+			cfg.Forwarders[i].AuthToken = "***"
+		}
+	}
+	if cfg.Reports.Webhook.AuthToken != "" {
+		cfg.Reports.Webhook.AuthToken = "***"
+	}
+	if cfg.Reports.Email.Password != "" {
+		cfg.Reports.Email.Password = "***"
+	}
+
+	// Кодируем через YAML, чтобы имена полей совпадали с файлом конфигурации
+	var view map[string]interface{}
+	data, err := yaml.Marshal(&cfg)
+	if err == nil {
+		err = yaml.Unmarshal(data, &view)
+	}
+	return view, err
+}
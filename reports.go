@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// JobReports фоновая задача сводных отчетов
+const JobReports = "reports"
+
+var ErrReportNotFound = errors.New("report not found")
+
+var reportDeliveries = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "highload_report_deliveries_total",
+		Help: "Total number of anomaly summary report deliveries by channel (webhook, email) and result (ok, error)",
+	},
+	[]string{"channel", "result"},
+)
+
+// DeviceReport аномалии устройства за период отчета
+type DeviceReport struct {
+	DeviceID   string         `json:"device_id"`
+	Total      int            `json:"total"`
+	BySeverity map[string]int `json:"by_severity"`
+	Fields     []string       `json:"fields"`
+}
+
+// AnomalyReport сводка аномалий за период
+type AnomalyReport struct {
+	ID          string         `json:"id"`
+	GeneratedAt int64          `json:"generated_at"`
+	From        int64          `json:"from"`
+	To          int64          `json:"to"`
+	Total       int            `json:"total"`
+	Silenced    int            `json:"silenced"`
+	BySeverity  map[string]int `json:"by_severity"`
+	ByType      map[string]int `json:"by_type"`
+	DeviceCount int            `json:"device_count"`
+	// Devices устройства с наибольшим числом аномалий, не больше reports.top_devices
+	Devices []DeviceReport `json:"devices"`
+	// Delivery результат доставки по каналам: ok или текст ошибки
+	Delivery map[string]string `json:"delivery,omitempty"`
+}
+
+// ReportScheduler по расписанию cron собирает сводку аномалий за период,
+// рассылает ее через webhook и email и сохраняет последние отчеты в Redis
+// для GET /api/reports. Отчеты строит только лидер среди реплик, активный в
+// паре, чтобы рассылка не дублировалась; сводка строится по его истории аномалий.
+type ReportScheduler struct {
+	service *Service
+	redis   redis.UniversalClient
+	client  *http.Client
+	// changed будит планировщик после изменения расписания
+	changed chan struct{}
+
+	mu  sync.RWMutex
+	cfg ReportsConfig
+}
+
+func NewReportScheduler(s *Service, rdb redis.UniversalClient, cfg ReportsConfig) *ReportScheduler {
+	return &ReportScheduler{
+		service: s,
+		redis:   rdb,
+		client:  &http.Client{},
+		changed: make(chan struct{}, 1),
+		cfg:     cfg,
+	}
+}
+
+// Configure применяет новые параметры; новое расписание действует сразу
+func (rs *ReportScheduler) Configure(cfg ReportsConfig) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.cfg.Enabled == cfg.Enabled && rs.cfg.Schedule == cfg.Schedule && rs.cfg.Timezone == cfg.Timezone {
+		rs.cfg = cfg
+		return
+	}
+	rs.cfg = cfg
+	select {
+	case rs.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (rs *ReportScheduler) config() ReportsConfig {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	return rs.cfg
+}
+
+// nextRun момент следующего отчета по расписанию; нулевой, если отчеты выключены
+func (cfg ReportsConfig) nextRun(now time.Time) time.Time {
+	if !cfg.Enabled {
+		return time.Time{}
+	}
+	schedule, err := parseCron(cfg.Schedule)
+	if err != nil {
+		return time.Time{}
+	}
+	loc, err := time.LoadLocation(cfg.Timezone)
+	if err != nil {
+		return time.Time{}
+	}
+	return schedule.Next(now.In(loc))
+}
+
+// Run ждет очередного момента расписания и строит отчет
+func (rs *ReportScheduler) Run(ctx context.Context) {
+	for {
+		cfg := rs.config()
+		// Без расписания таймер не срабатывает, планировщик ждет изменения конфигурации
+		timer := time.NewTimer(time.Hour)
+		timer.Stop()
+		next := cfg.nextRun(time.Now())
+		if !next.IsZero() {
+			timer.Reset(time.Until(next))
+		}
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-rs.changed:
+			timer.Stop()
+			continue
+		case <-timer.C:
+		}
+
+		if !rs.service.runsJobs() {
+			continue
+		}
+		err := rs.service.jobs.Run(ctx, JobReports, func(ctx context.Context) error {
+			_, err := rs.Generate(ctx, next)
+			return err
+		})
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Failed to generate anomaly report: %v", err)
+		}
+	}
+}
+
+// Generate строит отчет за reports.period до момента to, рассылает и
+// сохраняет его. Ошибка доставки не мешает сохранению: она записывается в
+// delivery отчета.
+func (rs *ReportScheduler) Generate(ctx context.Context, to time.Time) (AnomalyReport, error) {
+	cfg := rs.config()
+	from := to.Add(-cfg.Period)
+	anomalies := rs.service.anomalies.Query(AnomalyFilter{From: from.Unix(), To: to.Unix()})
+	report := summarizeAnomalies(anomalies, cfg.TopDevices)
+	report.ID = newID()
+	report.GeneratedAt = time.Now().Unix()
+	report.From, report.To = from.Unix(), to.Unix()
+
+	report.Delivery = make(map[string]string)
+	if cfg.Webhook.URL != "" {
+		report.Delivery["webhook"] = deliveryResult("webhook", rs.postWebhook(ctx, cfg, report))
+	}
+	if cfg.Email.SMTPAddr != "" && len(cfg.Email.To) > 0 {
+		report.Delivery["email"] = deliveryResult("email", rs.sendEmail(cfg, report))
+	}
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		return report, err
+	}
+	pipe := rs.redis.TxPipeline()
+	pipe.LPush(ctx, cfg.Key, data)
+	pipe.LTrim(ctx, cfg.Key, 0, int64(cfg.MaxReports-1))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return report, fmt.Errorf("store report: %w", err)
+	}
+	log.Printf("Anomaly report %s generated: %d anomalies on %d devices from %s to %s",
+		report.ID, report.Total, report.DeviceCount, from.UTC().Format(time.RFC3339), to.UTC().Format(time.RFC3339))
+	return report, nil
+}
+
+// summarizeAnomalies считает аномалии по важности, типам и устройствам
+func summarizeAnomalies(anomalies []AnalyticsResult, topDevices int) AnomalyReport {
+	report := AnomalyReport{
+		BySeverity: make(map[string]int),
+		ByType:     make(map[string]int),
+		Devices:    make([]DeviceReport, 0),
+	}
+	devices := make(map[string]*DeviceReport)
+	fields := make(map[string]map[string]bool)
+	for _, anomaly := range anomalies {
+		report.Total++
+		if anomaly.Silenced {
+			report.Silenced++
+		}
+		report.BySeverity[anomaly.Severity]++
+		report.ByType[anomaly.Type]++
+
+		device, ok := devices[anomaly.DeviceID]
+		if !ok {
+			device = &DeviceReport{DeviceID: anomaly.DeviceID, BySeverity: make(map[string]int)}
+			devices[anomaly.DeviceID] = device
+			fields[anomaly.DeviceID] = make(map[string]bool)
+		}
+		device.Total++
+		device.BySeverity[anomaly.Severity]++
+		if !fields[anomaly.DeviceID][anomaly.Field] {
+			fields[anomaly.DeviceID][anomaly.Field] = true
+			device.Fields = append(device.Fields, anomaly.Field)
+		}
+	}
+
+	report.DeviceCount = len(devices)
+	for _, device := range devices {
+		sort.Strings(device.Fields)
+		report.Devices = append(report.Devices, *device)
+	}
+	sort.Slice(report.Devices, func(i, j int) bool {
+		if report.Devices[i].Total != report.Devices[j].Total {
+			return report.Devices[i].Total > report.Devices[j].Total
+		}
+		return report.Devices[i].DeviceID < report.Devices[j].DeviceID
+	})
+	if len(report.Devices) > topDevices {
+		report.Devices = report.Devices[:topDevices]
+	}
+	return report
+}
+
+func deliveryResult(channel string, err error) string {
+	if err != nil {
+		reportDeliveries.WithLabelValues(channel, "error").Inc()
+		log.Printf("Failed to deliver anomaly report via %s: %v", channel, err)
+		return err.Error()
+	}
+	reportDeliveries.WithLabelValues(channel, "ok").Inc()
+	return "ok"
+}
+
+func (rs *ReportScheduler) postWebhook(ctx context.Context, cfg ReportsConfig, report AnomalyReport) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.Webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if cfg.Webhook.AuthToken != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.Webhook.AuthToken)
+	}
+	resp, err := rs.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// sendEmail отправляет отчет текстовым письмом, переходя на STARTTLS, если
+// сервер его поддерживает. Весь обмен ограничен reports.timeout.
+func (rs *ReportScheduler) sendEmail(cfg ReportsConfig, report AnomalyReport) error {
+	from := time.Unix(report.From, 0).UTC().Format("2006-01-02 15:04")
+	to := time.Unix(report.To, 0).UTC().Format("2006-01-02 15:04")
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", cfg.Email.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(cfg.Email.To, ", "))
+	fmt.Fprintf(&msg, "Subject: Anomaly report %s - %s UTC: %d anomalies\r\n", from, to, report.Total)
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(formatReport(report))
+
+	conn, err := net.DialTimeout("tcp", cfg.Email.SMTPAddr, cfg.Timeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(cfg.Timeout))
+	host, _, _ := net.SplitHostPort(cfg.Email.SMTPAddr)
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if cfg.Email.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", cfg.Email.Username, cfg.Email.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(cfg.Email.From); err != nil {
+		return err
+	}
+	for _, rcpt := range cfg.Email.To {
+		if err := client.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte(msg.String())); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// formatReport текст отчета для письма
+func formatReport(report AnomalyReport) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Period: %s - %s UTC\r\n",
+		time.Unix(report.From, 0).UTC().Format(time.RFC3339), time.Unix(report.To, 0).UTC().Format(time.RFC3339))
+	fmt.Fprintf(&b, "Anomalies: %d on %d devices (%d silenced)\r\n", report.Total, report.DeviceCount, report.Silenced)
+	fmt.Fprintf(&b, "By severity: %s\r\n", formatCounts(report.BySeverity))
+	fmt.Fprintf(&b, "By type: %s\r\n", formatCounts(report.ByType))
+	if len(report.Devices) > 0 {
+		b.WriteString("\r\nTop devices:\r\n")
+		for _, device := range report.Devices {
+			fmt.Fprintf(&b, "  %s: %d (%s) fields %s\r\n",
+				device.DeviceID, device.Total, formatCounts(device.BySeverity), strings.Join(device.Fields, ", "))
+		}
+	}
+	return b.String()
+}
+
+func formatCounts(counts map[string]int) string {
+	if len(counts) == 0 {
+		return "none"
+	}
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, key := range keys {
+		parts[i] = key + "=" + strconv.Itoa(counts[key])
+	}
+	return strings.Join(parts, ", ")
+}
+
+// List возвращает последние limit отчетов, новые первыми
+func (rs *ReportScheduler) List(ctx context.Context, limit int) ([]AnomalyReport, error) {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	raw, err := rs.redis.LRange(ctx, rs.config().Key, 0, int64(limit-1)).Result()
+	if err != nil {
+		return nil, err
+	}
+	reports := make([]AnomalyReport, 0, len(raw))
+	for _, data := range raw {
+		var report AnomalyReport
+		if err := json.Unmarshal([]byte(data), &report); err != nil {
+			log.Printf("Skipping malformed stored report: %v", err)
+			continue
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// Get возвращает сохраненный отчет по идентификатору
+func (rs *ReportScheduler) Get(ctx context.Context, id string) (AnomalyReport, error) {
+	reports, err := rs.List(ctx, rs.config().MaxReports)
+	if err != nil {
+		return AnomalyReport{}, err
+	}
+	for _, report := range reports {
+		if report.ID == id {
+			return report, nil
+		}
+	}
+	return AnomalyReport{}, ErrReportNotFound
+}
+
+// ReportsHandler возвращает сохраненные отчеты, новые первыми (limit, по
+// умолчанию 10), и время следующего отчета по расписанию
+func (s *Service) ReportsHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := s.reports.config()
+	limit := 10
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		var err error
+		limit, err = strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > cfg.MaxReports {
+			http.Error(w, "limit must be between 1 and reports.max_reports", http.StatusBadRequest)
+			return
+		}
+	}
+	reports, err := s.reports.List(r.Context(), limit)
+	if err != nil {
+		log.Printf("Failed to read reports: %v", err)
+		http.Error(w, "report storage unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	response := map[string]interface{}{
+		"enabled":  cfg.Enabled,
+		"schedule": cfg.Schedule,
+		"count":    len(reports),
+		"reports":  reports,
+	}
+	if next := cfg.nextRun(time.Now()); !next.IsZero() {
+		response["next_run"] = next.Unix()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// ReportHandler возвращает сохраненный отчет по идентификатору
+func (s *Service) ReportHandler(w http.ResponseWriter, r *http.Request) {
+	report, err := s.reports.Get(r.Context(), mux.Vars(r)["id"])
+	if errors.Is(err, ErrReportNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to read reports: %v", err)
+		http.Error(w, "report storage unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// AdminRunReportHandler строит и рассылает отчет за период до текущего момента
+// вне расписания
+func (s *Service) AdminRunReportHandler(w http.ResponseWriter, r *http.Request) {
+	report, err := s.reports.Generate(r.Context(), time.Now())
+	if err != nil {
+		log.Printf("Failed to generate anomaly report: %v", err)
+		http.Error(w, "report storage unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(report)
+}
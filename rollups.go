@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// rollupAggregatorName имя агрегатора интервалов в контрольных точках и метриках
+const rollupAggregatorName = "rollups"
+
+// applyRollupScript учитывает пачку значений в агрегатах интервалов и сдвигает
+// контрольную точку в одной транзакции. Записи не новее сохраненной точки
+// пропускаются: повторное чтение после сбоя или параллельный агрегатор другой
+// реплики не учитывают значение дважды.
+// KEYS: хеш контрольной точки, хеши интервалов.
+// ARGV: время сохранения в мс, затем группы по 5: id записи, индекс ключа
+// интервала в KEYS, значение, срок хранения интервала (unix мс), метка метрики.
+var applyRollupScript = redis.NewScript(`
+local function newer(a, b)
+	if not b then return true end
+	local ams, aseq = string.match(a, "^(%d+)-(%d+)$")
+	local bms, bseq = string.match(b, "^(%d+)-(%d+)$")
+	ams, bms = tonumber(ams), tonumber(bms)
+	if ams ~= bms then return ams > bms end
+	return tonumber(aseq) > tonumber(bseq)
+end
+local checkpoint = redis.call("hget", KEYS[1], "id")
+local lastID, lastTs = false, false
+local applied, skipped = 0, 0
+for i = 2, #ARGV, 5 do
+	local id = ARGV[i]
+	if newer(id, checkpoint) then
+		local key = KEYS[tonumber(ARGV[i + 1])]
+		local value = tonumber(ARGV[i + 2])
+		redis.call("hincrby", key, "count", 1)
+		redis.call("hincrbyfloat", key, "sum", ARGV[i + 2])
+		local low = redis.call("hget", key, "min")
+		if not low or value < tonumber(low) then redis.call("hset", key, "min", ARGV[i + 2]) end
+		local high = redis.call("hget", key, "max")
+		if not high or value > tonumber(high) then redis.call("hset", key, "max", ARGV[i + 2]) end
+		redis.call("pexpireat", key, ARGV[i + 3])
+		lastID, lastTs = id, ARGV[i + 4]
+		applied = applied + 1
+	else
+		skipped = skipped + 1
+	end
+end
+if lastID then
+	redis.call("hset", KEYS[1], "id", lastID, "timestamp", lastTs, "updated_at", ARGV[1])
+end
+return {applied, skipped}`)
+
+var rollupSamples = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "highload_rollup_samples_total",
+		Help: "Total number of field values aggregated into rollups by result (applied, skipped)",
+	},
+	[]string{"result"},
+)
+
+// RollupAggregator считает count/sum/min/max значений полей по интервалам
+// resolution из потока ingest и хранит их в Redis retention. Поток читается
+// без группы потребителей, независимо от анализа; прогресс сохраняется в
+// контрольной точке вместе с агрегатами, поэтому перезапуск продолжает с
+// первой неучтенной записи. Работает только лидер среди реплик, активный в паре.
+type RollupAggregator struct {
+	redis  redis.UniversalClient
+	cfg    RollupsConfig
+	stream string
+	batch  int
+	block  time.Duration
+	active func() bool
+	jobs   *JobScheduler
+}
+
+func NewRollupAggregator(rdb redis.UniversalClient, cfg RollupsConfig, stream StreamConfig, active func() bool, jobs *JobScheduler) *RollupAggregator {
+	return &RollupAggregator{
+		redis:  rdb,
+		cfg:    cfg,
+		stream: stream.Key,
+		batch:  stream.BatchSize,
+		block:  stream.Block,
+		active: active,
+		jobs:   jobs,
+	}
+}
+
+// bucketKey ключ агрегата интервала, начинающегося в start
+func (ra *RollupAggregator) bucketKey(deviceID, field string, start int64) string {
+	// Хеш-тег устройства держит все ключи устройства в одном слоте Redis Cluster
+	return fmt.Sprintf("%s:{%s}:%s:%d", ra.cfg.KeyPrefix, deviceID, field, start)
+}
+
+// bucketStart начало интервала, в который попадает метка ts
+func (ra *RollupAggregator) bucketStart(ts int64) int64 {
+	step := int64(ra.cfg.Resolution / time.Second)
+	return ts - ts%step
+}
+
+// Run читает поток с контрольной точки до отмены контекста
+func (ra *RollupAggregator) Run(ctx context.Context) {
+	for ctx.Err() == nil {
+		if !ra.active() {
+			time.Sleep(time.Second)
+			continue
+		}
+		lastID, err := ra.resume(ctx)
+		if err == nil {
+			err = ra.tail(ctx, lastID)
+		}
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Rollup aggregation interrupted: %v", err)
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+// resume возвращает запись, после которой нужно продолжить чтение
+func (ra *RollupAggregator) resume(ctx context.Context) (string, error) {
+	checkpoint, err := loadCheckpoint(ctx, ra.redis, rollupAggregatorName, ra.cfg.CheckpointKey)
+	if err != nil {
+		return "", err
+	}
+	if checkpoint.StreamID == "" {
+		log.Printf("Rollups have no checkpoint, aggregating stream %s from the beginning", ra.stream)
+		return "0", nil
+	}
+
+	// Записи между контрольной точкой и началом потока уже удалены: этот
+	// промежуток в агрегатах восстановить нельзя, о нем нужно знать
+	first, err := ra.redis.XRangeN(ctx, ra.stream, "-", "+", 1).Result()
+	if err != nil {
+		return "", err
+	}
+	if len(first) > 0 {
+		doneMs, _ := streamIDTime(checkpoint.StreamID)
+		firstMs, _ := streamIDTime(first[0].ID)
+		if firstMs > doneMs+1 {
+			log.Printf("Warning: stream %s was trimmed past the rollup checkpoint %s, rollups miss %s of data",
+				ra.stream, checkpoint.StreamID, time.Duration(firstMs-doneMs)*time.Millisecond)
+		}
+	}
+	log.Printf("Resuming rollups from stream %s entry %s", ra.stream, checkpoint.StreamID)
+	return checkpoint.StreamID, nil
+}
+
+// tail учитывает новые записи, пока экземпляр активен
+func (ra *RollupAggregator) tail(ctx context.Context, lastID string) error {
+	for ctx.Err() == nil && ra.active() {
+		streams, err := ra.redis.XRead(ctx, &redis.XReadArgs{
+			Streams: []string{ra.stream, lastID},
+			Count:   int64(ra.batch),
+			Block:   ra.block,
+		}).Result()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, stream := range streams {
+			if len(stream.Messages) == 0 {
+				continue
+			}
+			// Пачка учитывается в бюджете задачи rollups: под нагрузкой ingest
+			// агрегатор отстает, а не отнимает ресурсы у анализа
+			err := ra.jobs.Run(ctx, JobRollups, func(ctx context.Context) error {
+				return ra.apply(ctx, stream.Messages)
+			})
+			if err != nil {
+				return err
+			}
+			lastID = stream.Messages[len(stream.Messages)-1].ID
+		}
+	}
+	return nil
+}
+
+// apply учитывает пачку записей и сдвигает контрольную точку на последнюю
+func (ra *RollupAggregator) apply(ctx context.Context, messages []redis.XMessage) error {
+	keys := []string{ra.cfg.CheckpointKey}
+	index := make(map[string]int)
+	args := []interface{}{time.Now().UnixMilli()}
+	for _, msg := range messages {
+		decoded, ok := decodeStreamMessage(msg)
+		if !ok {
+			continue
+		}
+		for _, metric := range decoded.Expand() {
+			start := ra.bucketStart(metric.Timestamp)
+			expireAt := time.Unix(start, 0).Add(ra.cfg.Resolution + ra.cfg.Retention).UnixMilli()
+			for field, value := range metric.Fields() {
+				key := ra.bucketKey(metric.DeviceID, field, start)
+				i, ok := index[key]
+				if !ok {
+					keys = append(keys, key)
+					i = len(keys)
+					index[key] = i
+				}
+				args = append(args, msg.ID, i, strconv.FormatFloat(value, 'g', -1, 64), expireAt, metric.Timestamp)
+			}
+		}
+	}
+	if len(args) == 1 {
+		return nil
+	}
+
+	res, err := applyRollupScript.Run(ctx, ra.redis, keys, args...).Slice()
+	if err != nil {
+		return err
+	}
+	recordConsumed(rollupAggregatorName, len(messages))
+	if len(res) == 2 {
+		applied, _ := res[0].(int64)
+		skipped, _ := res[1].(int64)
+		rollupSamples.WithLabelValues("applied").Add(float64(applied))
+		rollupSamples.WithLabelValues("skipped").Add(float64(skipped))
+	}
+	if ms, ok := streamIDTime(messages[len(messages)-1].ID); ok {
+		checkpointTimestamp.WithLabelValues(rollupAggregatorName).Set(float64(ms) / 1000)
+	}
+	return nil
+}
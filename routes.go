@@ -0,0 +1,168 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Группы маршрутов, которые распределяются по слушателям.
+// /health, /health/lb и главная страница доступны на любом слушателе.
+const (
+	RouteGroupIngest  = "ingest"
+	RouteGroupQuery   = "query"
+	RouteGroupAdmin   = "admin"
+	RouteGroupMetrics = "metrics"
+	// RouteGroupDebug pprof и /debug/vars; подключается при debug.enabled
+	RouteGroupDebug = "debug"
+)
+
+var allRouteGroups = []string{RouteGroupIngest, RouteGroupQuery, RouteGroupAdmin, RouteGroupMetrics, RouteGroupDebug}
+
+func validRouteGroup(group string) bool {
+	return containsString(allRouteGroups, group)
+}
+
+// routerDeps общие для всех слушателей компоненты HTTP-слоя
+type routerDeps struct {
+	service    *Service
+	versions   *ClientVersionTracker
+	accessLog  mux.MiddlewareFunc
+	instrument mux.MiddlewareFunc
+	// debug подключает группу debug; меняется только перезапуском
+	debug bool
+}
+
+// newRouter собирает роутер с указанными группами маршрутов. Журнал доступа
+// и метрики подключаются первыми, чтобы учитывать и отклоненные запросы,
+// а также ответы 500 после паники обработчика.
+func (d routerDeps) newRouter(groups []string, middlewares ...mux.MiddlewareFunc) *mux.Router {
+	s := d.service
+	wrap := func(h http.Handler) http.Handler {
+		h = d.instrument(h)
+		return d.accessLog(h)
+	}
+
+	r := mux.NewRouter()
+	r.Use(d.accessLog, d.instrument, recoverMiddleware)
+	r.Use(middlewares...)
+	// Пересылка владельцу устройства после проверки доступа и лимитов слушателя
+	r.Use(s.cluster.Middleware)
+	r.NotFoundHandler = wrap(http.NotFoundHandler())
+	r.MethodNotAllowedHandler = wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}))
+
+	if containsString(groups, RouteGroupIngest) {
+		r.Handle("/api/metrics", d.versions.Middleware(http.HandlerFunc(s.MetricsHandler))).Methods("POST")
+		r.HandleFunc("/api/ingest/{id}/status", s.IngestStatusHandler).Methods("GET")
+		r.HandleFunc("/api/devices/{device_id}/fields/{field}", s.DeviceFieldHandler).Methods("PUT")
+		r.HandleFunc("/api/devices/{device_id}/fields/{field}", s.DeleteDeviceFieldHandler).Methods("DELETE")
+		r.HandleFunc("/api/events/external", s.ExternalEventHandler).Methods("POST")
+		r.HandleFunc("/api/influx/write", s.InfluxWriteHandler).Methods("POST")
+		r.HandleFunc("/api/influx/ping", InfluxPingHandler).Methods("GET", "HEAD")
+	}
+
+	if containsString(groups, RouteGroupQuery) {
+		r.HandleFunc("/api/analyze", s.AnalyzeHandler).Methods("GET")
+		r.HandleFunc("/api/analyze/percentiles", s.PercentilesHandler).Methods("GET")
+		r.HandleFunc("/api/analyze/correlation", s.CorrelationHandler).Methods("GET")
+		r.HandleFunc("/api/analyze/trend", s.TrendHandler).Methods("GET")
+		r.HandleFunc("/api/analyze/simulate", s.SimulateHandler).Methods("GET")
+		r.HandleFunc("/api/aggregate", s.AggregateHandler).Methods("GET")
+		r.HandleFunc("/api/anomalies", s.AnomaliesHandler).Methods("GET")
+		r.HandleFunc("/api/anomalies/history", s.AnomalyHistoryHandler).Methods("GET")
+		r.HandleFunc("/api/anomalies/export", s.AnomalyExportHandler).Methods("GET")
+		r.HandleFunc("/api/anomalies/stream", s.AnomalyStreamHandler).Methods("GET")
+		r.HandleFunc("/api/anomalies/feedback", s.AnomalyFeedbackStatsHandler).Methods("GET")
+		r.HandleFunc("/api/anomalies/shadow", s.ShadowAnomaliesHandler).Methods("GET")
+		r.HandleFunc("/api/anomalies/{id}/forensics", s.ForensicsHandler).Methods("GET")
+		r.HandleFunc("/api/anomalies/{id}/bundle", s.IncidentBundleHandler).Methods("GET")
+		r.HandleFunc("/api/events/external", s.ExternalEventsHandler).Methods("GET")
+		r.HandleFunc("/api/silences", s.SilencesHandler).Methods("GET")
+		r.HandleFunc("/api/devices", s.DevicesHandler).Methods("GET")
+		r.HandleFunc("/api/devices/top", s.TopDevicesHandler).Methods("GET")
+		r.HandleFunc("/api/devices/{device_id}/series", s.DeviceSeriesHandler).Methods("GET")
+		r.HandleFunc("/api/devices/{device_id}/sla", s.DeviceSLAHandler).Methods("GET")
+		r.HandleFunc("/api/devices/{device_id}/metadata", s.DeviceMetadataHandler).Methods("GET")
+		r.HandleFunc("/api/cohorts/{key}/outliers", s.CohortOutliersHandler).Methods("GET")
+		r.HandleFunc("/api/reports", s.ReportsHandler).Methods("GET")
+		r.HandleFunc("/api/fields", s.FieldsHandler).Methods("GET")
+		r.HandleFunc("/api/reports/{id}", s.ReportHandler).Methods("GET")
+		r.HandleFunc("/api/devices/{device_id}/decompose", s.DecomposeHandler).Methods("GET")
+		r.HandleFunc("/api/sla", s.SLAReportHandler).Methods("GET")
+		r.HandleFunc("/api/quotas", s.QuotaUsageHandler).Methods("GET")
+		r.HandleFunc("/api/devices/{device_id}/sampling", s.SamplingHandler).Methods("GET")
+		r.HandleFunc("/api/devices/{device_id}/highres", s.HighResHandler).Methods("GET")
+		r.HandleFunc("/api/heatmap", s.HeatmapHandler).Methods("GET")
+		r.HandleFunc("/api/fleet/percentiles", s.FleetPercentilesHandler).Methods("GET")
+		r.HandleFunc("/api/rules/test", s.RuleTestHandler).Methods("POST")
+		r.HandleFunc("/api/rules", s.RulesHandler).Methods("GET")
+		r.HandleFunc("/api/rules/{name}", s.RuleHandler).Methods("GET")
+		r.HandleFunc("/api/pipeline/status", s.PipelineStatusHandler).Methods("GET")
+		r.HandleFunc("/api/pipeline/lag", s.PipelineLagHandler).Methods("GET")
+		r.HandleFunc("/api/pipeline/deadlines", s.DeadlinesHandler).Methods("GET")
+		r.HandleFunc("/api/cluster", s.ClusterHandler).Methods("GET")
+		r.HandleFunc("/ui", UIHandler).Methods("GET")
+		r.HandleFunc("/ui/", UIHandler).Methods("GET")
+	}
+
+	// Административные endpoints и изменение состояния, общего для всех
+	// пользователей: правила, заглушения, статус аномалий
+	if containsString(groups, RouteGroupAdmin) {
+		r.HandleFunc("/api/anomalies/{id}/ack", s.AnomalyAckHandler).Methods("POST")
+		r.HandleFunc("/api/anomalies/{id}/resolve", s.AnomalyResolveHandler).Methods("POST")
+		r.HandleFunc("/api/anomalies/{id}/feedback", s.AnomalyFeedbackHandler).Methods("POST")
+		r.HandleFunc("/api/rules", s.CreateRuleHandler).Methods("POST")
+		r.HandleFunc("/api/rules/{name}", s.UpdateRuleHandler).Methods("PUT")
+		r.HandleFunc("/api/rules/{name}", s.DeleteRuleHandler).Methods("DELETE")
+		r.HandleFunc("/api/silences", s.CreateSilenceHandler).Methods("POST")
+		r.HandleFunc("/api/silences/{id}", s.DeleteSilenceHandler).Methods("DELETE")
+		r.HandleFunc("/api/admin/buffer", s.AdminBufferHandler).Methods("GET")
+		r.HandleFunc("/api/admin/buffer/{device_id}", s.AdminResetBufferHandler).Methods("DELETE")
+		r.HandleFunc("/api/admin/devices/tokens", s.AdminDeviceTokensHandler).Methods("GET")
+		r.HandleFunc("/api/admin/devices/{device_id}", s.AdminDeleteDeviceHandler).Methods("DELETE")
+		r.HandleFunc("/api/admin/devices/{device_id}/token", s.AdminIssueDeviceTokenHandler).Methods("POST")
+		r.HandleFunc("/api/admin/devices/{device_id}/token", s.AdminRevokeDeviceTokenHandler).Methods("DELETE")
+		r.HandleFunc("/api/admin/devices/{device_id}/metadata", s.AdminSetDeviceMetadataHandler).Methods("PUT")
+		r.HandleFunc("/api/admin/devices/{device_id}/metadata", s.AdminDeleteDeviceMetadataHandler).Methods("DELETE")
+		r.HandleFunc("/api/admin/fields/{field}", s.AdminSetFieldHandler).Methods("PUT")
+		r.HandleFunc("/api/admin/fields/{field}", s.AdminDeleteFieldHandler).Methods("DELETE")
+		r.HandleFunc("/api/admin/trash", s.AdminTrashHandler).Methods("GET")
+		r.HandleFunc("/api/admin/trash/{id}/undo", s.AdminUndoHandler).Methods("POST")
+		r.HandleFunc("/api/admin/config", s.AdminConfigHandler).Methods("GET")
+		r.HandleFunc("/api/admin/migrations", s.AdminMigrationsHandler).Methods("GET")
+		r.HandleFunc("/api/admin/checkpoints", s.AdminCheckpointsHandler).Methods("GET")
+		r.HandleFunc("/api/admin/jobs", s.AdminJobsHandler).Methods("GET")
+		r.HandleFunc("/api/admin/leader", s.AdminLeaderHandler).Methods("GET")
+		r.HandleFunc("/api/admin/reports/run", s.AdminRunReportHandler).Methods("POST")
+		r.HandleFunc("/api/admin/admission", s.AdminAdmissionHandler).Methods("GET")
+		r.HandleFunc("/api/admin/pipeline/sinks", s.AdminPipelineAddSinkHandler).Methods("POST")
+		r.HandleFunc("/api/admin/pipeline/sinks/{name}", s.AdminPipelineRemoveSinkHandler).Methods("DELETE")
+		r.HandleFunc("/api/admin/pipeline/detectors", s.AdminPipelineAddDetectorHandler).Methods("POST")
+		r.HandleFunc("/api/admin/pipeline/detectors/{name}", s.AdminPipelineRemoveDetectorHandler).Methods("DELETE")
+	}
+
+	// Prometheus metrics endpoint
+	if containsString(groups, RouteGroupMetrics) {
+		// OpenMetrics нужен для выдачи exemplar с trace_id
+		r.Handle("/metrics", promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+			promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true})))
+	}
+
+	if containsString(groups, RouteGroupDebug) && d.debug {
+		s.mountDebug(r)
+	}
+
+	r.HandleFunc("/health", s.HealthHandler).Methods("GET")
+	r.HandleFunc("/health/lb", s.LBHealthHandler).Methods("GET")
+
+	// Простая главная страница
+	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Highload Service with AI Analytics - Running"))
+	}).Methods("GET")
+
+	return r
+}
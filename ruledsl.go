@@ -0,0 +1,498 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Ограничения выражения правила
+const (
+	maxRuleExpressionLength = 1024
+	maxRuleConditions       = 16
+)
+
+// Выражение правила — условия над полями устройства, соединенные AND, OR и
+// NOT со скобками:
+//
+//	cpu p95 > 90 for 5m AND memory rising
+//	(rps avg < 10 OR errors max >= 1) AND NOT disk last == 0
+//
+// Условие: <поле> [статистика] <оператор> <число> [for <длительность>] или
+// <поле> rising|falling [for <длительность>]. Статистики: last (по умолчанию),
+// avg, min, max, sum, count, stddev, slope (наклон в единицах в секунду) и
+// pNN — процентиль. for задает окно по меткам времени до последнего значения
+// устройства; без него используется текущее окно буфера. rising и falling
+// означают положительный и отрицательный наклон значений окна.
+
+// ruleTruth значение условия: без данных в окне условие неизвестно, и
+// неизвестность не превращается в срабатывание ни через NOT, ни через OR/AND
+type ruleTruth int
+
+const (
+	ruleFalse ruleTruth = iota
+	ruleTrue
+	ruleUnknown
+)
+
+// ruleSeries источник значений полей устройства для вычисления условий
+type ruleSeries struct {
+	points map[string][]Point
+	// now последняя метка времени устройства; от нее отсчитываются окна for
+	now int64
+	// window размер окна буфера для условий без for
+	window int
+	// values наблюдавшиеся значения условий для результата
+	values map[string]float64
+}
+
+type ruleExpr interface {
+	eval(series *ruleSeries) ruleTruth
+	// conditions возвращает условия выражения слева направо
+	conditions() []*ruleCondition
+}
+
+type ruleAnd struct{ left, right ruleExpr }
+
+func (e ruleAnd) eval(series *ruleSeries) ruleTruth {
+	left, right := e.left.eval(series), e.right.eval(series)
+	switch {
+	case left == ruleFalse || right == ruleFalse:
+		return ruleFalse
+	case left == ruleUnknown || right == ruleUnknown:
+		return ruleUnknown
+	}
+	return ruleTrue
+}
+
+func (e ruleAnd) conditions() []*ruleCondition {
+	return append(e.left.conditions(), e.right.conditions()...)
+}
+
+type ruleOr struct{ left, right ruleExpr }
+
+func (e ruleOr) eval(series *ruleSeries) ruleTruth {
+	left, right := e.left.eval(series), e.right.eval(series)
+	switch {
+	case left == ruleTrue || right == ruleTrue:
+		return ruleTrue
+	case left == ruleUnknown || right == ruleUnknown:
+		return ruleUnknown
+	}
+	return ruleFalse
+}
+
+func (e ruleOr) conditions() []*ruleCondition {
+	return append(e.left.conditions(), e.right.conditions()...)
+}
+
+type ruleNot struct{ expr ruleExpr }
+
+func (e ruleNot) eval(series *ruleSeries) ruleTruth {
+	switch e.expr.eval(series) {
+	case ruleTrue:
+		return ruleFalse
+	case ruleFalse:
+		return ruleTrue
+	}
+	return ruleUnknown
+}
+
+func (e ruleNot) conditions() []*ruleCondition { return e.expr.conditions() }
+
+// ruleCondition сравнение статистики поля за окно с порогом
+type ruleCondition struct {
+	field string
+	stat  string
+	// percentile для статистики pNN, от 0 до 1
+	percentile float64
+	op         string
+	threshold  float64
+	window     time.Duration
+	// windowText окно так, как оно записано в выражении
+	windowText string
+}
+
+func (c *ruleCondition) conditions() []*ruleCondition { return []*ruleCondition{c} }
+
+// key подпись наблюдаемой величины условия: «cpu p95 for 5m»
+func (c *ruleCondition) key() string {
+	key := c.field + " " + c.stat
+	if c.window > 0 {
+		key += " for " + c.windowText
+	}
+	return key
+}
+
+func (c *ruleCondition) eval(series *ruleSeries) ruleTruth {
+	points := series.points[c.field]
+	if c.window > 0 {
+		cutoff := series.now - int64(c.window/time.Second)
+		start := sort.Search(len(points), func(i int) bool { return points[i].Timestamp > cutoff })
+		points = points[start:]
+	} else if len(points) > series.window {
+		points = points[len(points)-series.window:]
+	}
+
+	value, ok := ruleStatistic(c.stat, c.percentile, points)
+	if !ok {
+		return ruleUnknown
+	}
+	series.values[c.key()] = value
+
+	var holds bool
+	switch c.op {
+	case ">":
+		holds = value > c.threshold
+	case ">=":
+		holds = value >= c.threshold
+	case "<":
+		holds = value < c.threshold
+	case "<=":
+		holds = value <= c.threshold
+	case "==":
+		holds = value == c.threshold
+	case "!=":
+		holds = value != c.threshold
+	}
+	if holds {
+		return ruleTrue
+	}
+	return ruleFalse
+}
+
+// ruleStatistic вычисляет статистику значений окна; false — значений недостаточно
+func ruleStatistic(stat string, percentile float64, points []Point) (float64, bool) {
+	if stat == "count" {
+		return float64(len(points)), true
+	}
+	if len(points) == 0 {
+		return 0, false
+	}
+
+	switch stat {
+	case "last":
+		return points[len(points)-1].Value, true
+	case "min", "max":
+		result := points[0].Value
+		for _, point := range points[1:] {
+			if stat == "min" {
+				result = math.Min(result, point.Value)
+			} else {
+				result = math.Max(result, point.Value)
+			}
+		}
+		return result, true
+	case "sum", "avg", "stddev":
+		var sum, sumSq float64
+		for _, point := range points {
+			sum += point.Value
+			sumSq += point.Value * point.Value
+		}
+		n := float64(len(points))
+		switch stat {
+		case "sum":
+			return sum, true
+		case "avg":
+			return sum / n, true
+		}
+		mean := sum / n
+		return math.Sqrt(math.Max(sumSq/n-mean*mean, 0)), true
+	case "slope":
+		// Наклон прямой наименьших квадратов по меткам времени
+		if len(points) < 2 {
+			return 0, false
+		}
+		origin := points[0].Timestamp
+		var sumT, sumV, sumTT, sumTV float64
+		for _, point := range points {
+			t := float64(point.Timestamp - origin)
+			sumT += t
+			sumV += point.Value
+			sumTT += t * t
+			sumTV += t * point.Value
+		}
+		n := float64(len(points))
+		denominator := n*sumTT - sumT*sumT
+		if denominator == 0 {
+			return 0, false
+		}
+		return (n*sumTV - sumT*sumV) / denominator, true
+	}
+
+	// pNN
+	values := make([]float64, len(points))
+	for i, point := range points {
+		values[i] = point.Value
+	}
+	sort.Float64s(values)
+	return quantile(values, percentile), true
+}
+
+// CompiledRule разобранное выражение правила
+type CompiledRule struct {
+	expr ruleExpr
+	// fields поля, на которые ссылается выражение
+	fields []string
+}
+
+// compileRuleExpression разбирает выражение правила
+func compileRuleExpression(src string) (*CompiledRule, error) {
+	if strings.TrimSpace(src) == "" {
+		return nil, fmt.Errorf("expression is required")
+	}
+	if len(src) > maxRuleExpressionLength {
+		return nil, fmt.Errorf("expression is too long: %d bytes, max %d", len(src), maxRuleExpressionLength)
+	}
+	tokens, err := tokenizeRule(src)
+	if err != nil {
+		return nil, err
+	}
+	parser := &ruleParser{tokens: tokens}
+	expr, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if token, ok := parser.peek(); ok {
+		return nil, fmt.Errorf("unexpected %q at position %d", token.text, token.pos+1)
+	}
+
+	conditions := expr.conditions()
+	if len(conditions) > maxRuleConditions {
+		return nil, fmt.Errorf("too many conditions: %d, max %d", len(conditions), maxRuleConditions)
+	}
+	rule := &CompiledRule{expr: expr}
+	seen := make(map[string]bool)
+	for _, condition := range conditions {
+		if !seen[condition.field] {
+			seen[condition.field] = true
+			rule.fields = append(rule.fields, condition.field)
+		}
+	}
+	return rule, nil
+}
+
+type ruleToken struct {
+	text string
+	pos  int
+}
+
+func isRuleWordByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '.' || c == '-' || c == '+'
+}
+
+// tokenizeRule делит выражение на слова, скобки и операторы сравнения
+func tokenizeRule(src string) ([]ruleToken, error) {
+	var tokens []ruleToken
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, ruleToken{text: src[i : i+1], pos: i})
+			i++
+		case c == '<' || c == '>' || c == '=' || c == '!':
+			end := i + 1
+			if end < len(src) && src[end] == '=' {
+				end++
+			}
+			op := src[i:end]
+			if op == "=" || op == "!" {
+				return nil, fmt.Errorf("unexpected %q at position %d, expected a comparison operator", op, i+1)
+			}
+			tokens = append(tokens, ruleToken{text: op, pos: i})
+			i = end
+		case isRuleWordByte(c):
+			end := i
+			for end < len(src) && isRuleWordByte(src[end]) {
+				end++
+			}
+			tokens = append(tokens, ruleToken{text: src[i:end], pos: i})
+			i = end
+		default:
+			return nil, fmt.Errorf("unexpected character %q at position %d", c, i+1)
+		}
+	}
+	return tokens, nil
+}
+
+// ruleParser разбор рекурсивным спуском; AND связывает сильнее OR
+type ruleParser struct {
+	tokens []ruleToken
+	pos    int
+}
+
+func (p *ruleParser) peek() (ruleToken, bool) {
+	if p.pos >= len(p.tokens) {
+		return ruleToken{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+func (p *ruleParser) next(expected string) (ruleToken, error) {
+	token, ok := p.peek()
+	if !ok {
+		return token, fmt.Errorf("unexpected end of expression, expected %s", expected)
+	}
+	p.pos++
+	return token, nil
+}
+
+// keyword сдвигается на слово word (без учета регистра), если оно следующее
+func (p *ruleParser) keyword(word string) bool {
+	if token, ok := p.peek(); ok && strings.EqualFold(token.text, word) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *ruleParser) parseOr() (ruleExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("or") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = ruleOr{left, right}
+	}
+	return left, nil
+}
+
+func (p *ruleParser) parseAnd() (ruleExpr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("and") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = ruleAnd{left, right}
+	}
+	return left, nil
+}
+
+func (p *ruleParser) parseUnary() (ruleExpr, error) {
+	if p.keyword("not") {
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return ruleNot{expr}, nil
+	}
+	if p.keyword("(") {
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		token, err := p.next(`")"`)
+		if err != nil {
+			return nil, err
+		}
+		if token.text != ")" {
+			return nil, fmt.Errorf("unexpected %q at position %d, expected \")\"", token.text, token.pos+1)
+		}
+		return expr, nil
+	}
+	return p.parseCondition()
+}
+
+func isRuleOperator(text string) bool {
+	switch text {
+	case ">", ">=", "<", "<=", "==", "!=":
+		return true
+	}
+	return false
+}
+
+func (p *ruleParser) parseCondition() (ruleExpr, error) {
+	token, err := p.next("a field name")
+	if err != nil {
+		return nil, err
+	}
+	if !validFieldName(token.text) {
+		return nil, fmt.Errorf("unexpected %q at position %d, expected a field name", token.text, token.pos+1)
+	}
+	condition := &ruleCondition{field: token.text, stat: "last"}
+
+	token, err = p.next("a statistic, rising, falling or a comparison")
+	if err != nil {
+		return nil, err
+	}
+	word := strings.ToLower(token.text)
+	switch {
+	case word == "rising" || word == "falling":
+		condition.stat, condition.op = "slope", ">"
+		if word == "falling" {
+			condition.op = "<"
+		}
+		return condition, p.parseWindow(condition)
+	case isRuleOperator(token.text):
+		p.pos--
+	default:
+		if err := condition.setStat(word); err != nil {
+			return nil, fmt.Errorf("%v at position %d", err, token.pos+1)
+		}
+	}
+
+	token, err = p.next("a comparison operator")
+	if err != nil {
+		return nil, err
+	}
+	if !isRuleOperator(token.text) {
+		return nil, fmt.Errorf("unexpected %q at position %d, expected a comparison operator", token.text, token.pos+1)
+	}
+	condition.op = token.text
+
+	token, err = p.next("a number")
+	if err != nil {
+		return nil, err
+	}
+	condition.threshold, err = strconv.ParseFloat(token.text, 64)
+	if err != nil || math.IsNaN(condition.threshold) || math.IsInf(condition.threshold, 0) {
+		return nil, fmt.Errorf("unexpected %q at position %d, expected a number", token.text, token.pos+1)
+	}
+	return condition, p.parseWindow(condition)
+}
+
+// setStat задает статистику условия по имени
+func (c *ruleCondition) setStat(name string) error {
+	switch name {
+	case "last", "avg", "min", "max", "sum", "count", "stddev", "slope":
+		c.stat = name
+		return nil
+	}
+	if strings.HasPrefix(name, "p") {
+		if n, err := strconv.ParseFloat(name[1:], 64); err == nil && n > 0 && n < 100 {
+			c.stat, c.percentile = name, n/100
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown statistic %q, expected last, avg, min, max, sum, count, stddev, slope or pNN", name)
+}
+
+// parseWindow разбирает необязательное окно «for 5m»
+func (p *ruleParser) parseWindow(condition *ruleCondition) error {
+	if !p.keyword("for") {
+		return nil
+	}
+	token, err := p.next("a duration")
+	if err != nil {
+		return err
+	}
+	window, err := time.ParseDuration(token.text)
+	if err != nil || window < time.Second || window%time.Second != 0 {
+		return fmt.Errorf("unexpected %q at position %d, expected a duration of whole seconds such as 5m", token.text, token.pos+1)
+	}
+	condition.window, condition.windowText = window, token.text
+	return nil
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	ErrRuleNotFound = errors.New("rule not found")
+	ErrRuleExists   = errors.New("rule already exists")
+	ErrTooManyRules = errors.New("too many rules")
+)
+
+var (
+	ruleEvaluations = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "highload_rule_evaluations_total",
+			Help: "Total number of rule evaluations per device by result (true, false, unknown)",
+		},
+		[]string{"result"},
+	)
+
+	ruleFirings = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "highload_rule_firings_total",
+			Help: "Total number of anomalies emitted by composite rules",
+		},
+		[]string{"rule"},
+	)
+)
+
+// AlertRule составное условие над полями устройства (см. ruledsl.go)
+type AlertRule struct {
+	Name       string `json:"name"`
+	Expression string `json:"expression"`
+	// Severity warning (по умолчанию) или critical
+	Severity string `json:"severity,omitempty"`
+	// DevicePattern шаблон устройств (path.Match); пусто — все устройства
+	DevicePattern string `json:"device_pattern,omitempty"`
+	CreatedAt     int64  `json:"created_at"`
+	UpdatedAt     int64  `json:"updated_at"`
+}
+
+// RuleMatch срабатывание правила в результате анализа
+type RuleMatch struct {
+	Name       string `json:"name"`
+	Expression string `json:"expression"`
+	// Values наблюдавшиеся статистики условий: «cpu p95 for 5m» → 93.1
+	Values map[string]float64 `json:"values"`
+}
+
+// Validate проверяет правило и разбирает выражение
+func (r AlertRule) Validate() (*CompiledRule, error) {
+	if !validFieldName(r.Name) {
+		return nil, fmt.Errorf("name must match %s", fieldNamePattern)
+	}
+	switch r.Severity {
+	case "", SeverityWarning, SeverityCritical:
+	default:
+		return nil, fmt.Errorf("severity must be warning or critical")
+	}
+	if r.DevicePattern != "" {
+		if _, err := path.Match(r.DevicePattern, ""); err != nil {
+			return nil, fmt.Errorf("device_pattern: %v", err)
+		}
+	}
+	compiled, err := compileRuleExpression(r.Expression)
+	if err != nil {
+		return nil, fmt.Errorf("expression: %v", err)
+	}
+	return compiled, nil
+}
+
+// compiledAlertRule правило с разобранным выражением и устройствами, на
+// которых оно сейчас выполняется
+type compiledAlertRule struct {
+	AlertRule
+	compiled *CompiledRule
+	firing   map[string]bool
+}
+
+// RuleEngine хранит составные правила в Redis (общие для всех экземпляров) и
+// периодически вычисляет их по буферу. Аномалия с именем правила выпускается,
+// когда условие на устройстве становится истинным; повторно — только после
+// того, как оно побывает ложным.
+type RuleEngine struct {
+	redis   redis.UniversalClient
+	buffer  *MetricsBuffer
+	publish func(AnalyticsResult)
+
+	mu    sync.Mutex
+	cfg   RulesConfig
+	rules map[string]*compiledAlertRule
+}
+
+func NewRuleEngine(rdb redis.UniversalClient, cfg RulesConfig, buffer *MetricsBuffer, publish func(AnalyticsResult)) *RuleEngine {
+	return &RuleEngine{
+		redis:   rdb,
+		buffer:  buffer,
+		publish: publish,
+		cfg:     cfg,
+		rules:   make(map[string]*compiledAlertRule),
+	}
+}
+
+// Configure применяет новые параметры со следующего вычисления
+func (e *RuleEngine) Configure(cfg RulesConfig) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.cfg = cfg
+}
+
+func (e *RuleEngine) config() RulesConfig {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.cfg
+}
+
+// Run перечитывает правила из Redis и вычисляет их каждые rules.interval
+func (e *RuleEngine) Run(ctx context.Context) {
+	for {
+		cfg := e.config()
+		if err := e.refresh(ctx); err != nil {
+			log.Printf("Failed to load rules, keeping %d known: %v", e.count(), err)
+		}
+		e.evaluate()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(cfg.Interval):
+		}
+	}
+}
+
+func (e *RuleEngine) count() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.rules)
+}
+
+// refresh загружает правила из Redis, сохраняя состояние неизмененных
+func (e *RuleEngine) refresh(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	raw, err := e.redis.HGetAll(ctx, e.config().Key).Result()
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	rules := make(map[string]*compiledAlertRule, len(raw))
+	for name, data := range raw {
+		var rule AlertRule
+		if err := json.Unmarshal([]byte(data), &rule); err != nil {
+			log.Printf("Skipping malformed rule %s: %v", name, err)
+			continue
+		}
+		if known, ok := e.rules[name]; ok && known.AlertRule == rule {
+			rules[name] = known
+			continue
+		}
+		compiled, err := rule.Validate()
+		if err != nil {
+			log.Printf("Skipping invalid rule %s: %v", name, err)
+			continue
+		}
+		rules[name] = &compiledAlertRule{AlertRule: rule, compiled: compiled, firing: make(map[string]bool)}
+	}
+	e.rules = rules
+	return nil
+}
+
+// evaluate вычисляет все правила на всех устройствах буфера
+func (e *RuleEngine) evaluate() {
+	e.mu.Lock()
+	rules := make([]*compiledAlertRule, 0, len(e.rules))
+	for _, rule := range e.rules {
+		rules = append(rules, rule)
+	}
+	e.mu.Unlock()
+	if len(rules) == 0 {
+		return
+	}
+
+	window, _ := e.buffer.Limits()
+	devices := e.buffer.Devices()
+	present := make(map[string]bool, len(devices))
+	for _, deviceID := range devices {
+		present[deviceID] = true
+		points := make(map[string][]Point)
+		for _, rule := range rules {
+			if rule.DevicePattern != "" {
+				if ok, _ := path.Match(rule.DevicePattern, deviceID); !ok {
+					continue
+				}
+			}
+			series := &ruleSeries{points: make(map[string][]Point), window: window, values: make(map[string]float64)}
+			for _, field := range rule.compiled.fields {
+				if _, ok := points[field]; !ok {
+					points[field] = e.buffer.Points(deviceID, field)
+				}
+				series.points[field] = points[field]
+				if n := len(points[field]); n > 0 {
+					series.now = max(series.now, points[field][n-1].Timestamp)
+				}
+			}
+			e.apply(rule, deviceID, series)
+		}
+	}
+
+	// Состояние устройств, удаленных из буфера, больше не нужно
+	e.mu.Lock()
+	for _, rule := range rules {
+		for deviceID := range rule.firing {
+			if !present[deviceID] {
+				delete(rule.firing, deviceID)
+			}
+		}
+	}
+	e.mu.Unlock()
+}
+
+// apply вычисляет правило на устройстве и выпускает аномалию при переходе в истину
+func (e *RuleEngine) apply(rule *compiledAlertRule, deviceID string, series *ruleSeries) {
+	truth := rule.compiled.expr.eval(series)
+	switch truth {
+	case ruleTrue:
+		ruleEvaluations.WithLabelValues("true").Inc()
+	case ruleFalse:
+		ruleEvaluations.WithLabelValues("false").Inc()
+	default:
+		ruleEvaluations.WithLabelValues("unknown").Inc()
+	}
+
+	e.mu.Lock()
+	wasFiring := rule.firing[deviceID]
+	switch truth {
+	case ruleTrue:
+		rule.firing[deviceID] = true
+	case ruleFalse:
+		delete(rule.firing, deviceID)
+	}
+	e.mu.Unlock()
+	if truth != ruleTrue || wasFiring {
+		return
+	}
+
+	// Поле и значение результата — первого условия выражения
+	first := rule.compiled.expr.conditions()[0]
+	severity := rule.Severity
+	if severity == "" {
+		severity = SeverityWarning
+	}
+	ruleFirings.WithLabelValues(rule.Name).Inc()
+	e.publish(AnalyticsResult{
+		DeviceID:  deviceID,
+		Field:     first.field,
+		Type:      AnomalyTypeRule,
+		IsAnomaly: true,
+		Timestamp: series.now,
+		Value:     series.values[first.key()],
+		Severity:  severity,
+		Rule: &RuleMatch{
+			Name:       rule.Name,
+			Expression: rule.Expression,
+			Values:     series.values,
+		},
+	})
+}
+
+// RuleStatus правило и устройства, на которых оно выполняется
+type RuleStatus struct {
+	AlertRule
+	Firing []string `json:"firing"`
+}
+
+func (e *RuleEngine) status(rule *compiledAlertRule) RuleStatus {
+	status := RuleStatus{AlertRule: rule.AlertRule, Firing: make([]string, 0, len(rule.firing))}
+	for deviceID := range rule.firing {
+		status.Firing = append(status.Firing, deviceID)
+	}
+	sort.Strings(status.Firing)
+	return status
+}
+
+// List возвращает правила по имени
+func (e *RuleEngine) List() []RuleStatus {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	statuses := make([]RuleStatus, 0, len(e.rules))
+	for _, rule := range e.rules {
+		statuses = append(statuses, e.status(rule))
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// Get возвращает правило по имени
+func (e *RuleEngine) Get(name string) (RuleStatus, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	rule, ok := e.rules[name]
+	if !ok {
+		return RuleStatus{}, false
+	}
+	return e.status(rule), true
+}
+
+// Put сохраняет правило в Redis и применяет его на этом экземпляре; create
+// запрещает перезапись, иначе правило должно существовать
+func (e *RuleEngine) Put(ctx context.Context, rule AlertRule, create bool) (AlertRule, error) {
+	compiled, err := rule.Validate()
+	if err != nil {
+		return rule, err
+	}
+
+	cfg := e.config()
+	e.mu.Lock()
+	known, exists := e.rules[rule.Name]
+	total := len(e.rules)
+	e.mu.Unlock()
+	switch {
+	case create && exists:
+		return rule, ErrRuleExists
+	case !create && !exists:
+		return rule, ErrRuleNotFound
+	case create && total >= cfg.MaxRules:
+		return rule, ErrTooManyRules
+	}
+
+	now := time.Now().Unix()
+	rule.CreatedAt, rule.UpdatedAt = now, now
+	if exists {
+		rule.CreatedAt = known.CreatedAt
+	}
+	data, err := json.Marshal(rule)
+	if err != nil {
+		return rule, err
+	}
+	if err := e.redis.HSet(ctx, cfg.Key, rule.Name, data).Err(); err != nil {
+		return rule, err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	entry := &compiledAlertRule{AlertRule: rule, compiled: compiled, firing: make(map[string]bool)}
+	if exists && known.Expression == rule.Expression && known.DevicePattern == rule.DevicePattern {
+		// Условие не менялось: уже сработавшие устройства не выпускают аномалию повторно
+		entry.firing = known.firing
+	}
+	e.rules[rule.Name] = entry
+	return rule, nil
+}
+
+// Delete удаляет правило из Redis и с этого экземпляра
+func (e *RuleEngine) Delete(ctx context.Context, name string) error {
+	removed, err := e.redis.HDel(ctx, e.config().Key, name).Result()
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, exists := e.rules[name]; !exists && removed == 0 {
+		return ErrRuleNotFound
+	}
+	delete(e.rules, name)
+	return nil
+}
+
+// RulesHandler возвращает правила и устройства, на которых они выполняются
+func (s *Service) RulesHandler(w http.ResponseWriter, r *http.Request) {
+	rules := s.rules.List()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"count": len(rules),
+		"rules": rules,
+	})
+}
+
+// RuleHandler возвращает правило по имени
+func (s *Service) RuleHandler(w http.ResponseWriter, r *http.Request) {
+	rule, ok := s.rules.Get(mux.Vars(r)["name"])
+	if !ok {
+		http.Error(w, ErrRuleNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rule)
+}
+
+// CreateRuleHandler создает правило: {"name", "expression", "severity", "device_pattern"}
+func (s *Service) CreateRuleHandler(w http.ResponseWriter, r *http.Request) {
+	var rule AlertRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	s.putRule(w, r, rule, true)
+}
+
+// UpdateRuleHandler заменяет выражение и параметры правила
+func (s *Service) UpdateRuleHandler(w http.ResponseWriter, r *http.Request) {
+	var rule AlertRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	name := mux.Vars(r)["name"]
+	if rule.Name != "" && rule.Name != name {
+		http.Error(w, "name in body does not match the URL", http.StatusBadRequest)
+		return
+	}
+	rule.Name = name
+	s.putRule(w, r, rule, false)
+}
+
+func (s *Service) putRule(w http.ResponseWriter, r *http.Request, rule AlertRule, create bool) {
+	if _, err := rule.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rule, err := s.rules.Put(r.Context(), rule, create)
+	switch {
+	case errors.Is(err, ErrRuleExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, ErrRuleNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, ErrTooManyRules):
+		http.Error(w, fmt.Sprintf("%v, max %d", err, s.rules.config().MaxRules), http.StatusConflict)
+		return
+	case err != nil:
+		log.Printf("Failed to save rule %s: %v", rule.Name, err)
+		http.Error(w, "rule storage unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	log.Printf("Rule %s saved: %s", rule.Name, rule.Expression)
+	w.Header().Set("Content-Type", "application/json")
+	if create {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(rule)
+}
+
+// DeleteRuleHandler удаляет правило
+func (s *Service) DeleteRuleHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	err := s.rules.Delete(r.Context(), name)
+	if errors.Is(err, ErrRuleNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to delete rule %s: %v", name, err)
+		http.Error(w, "rule storage unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	log.Printf("Rule %s deleted", name)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// maxRuleTestSamples ограничивает объем данных одного прогона песочницы
+const maxRuleTestSamples = 10000
+
+// RuleTestSource ссылка на значения устройства в текущем буфере
+type RuleTestSource struct {
+	DeviceID string `json:"device_id"`
+	From     int64  `json:"from"`
+	To       int64  `json:"to"`
+}
+
+// RuleTestRequest кандидат в правило и данные для прогона.
+// Rule имеет тот же формат, что и секция detectors файла конфигурации;
+// не указанные параметры берутся из текущей конфигурации, но детекторы
+// включаются только явно (enabled: true).
+type RuleTestRequest struct {
+	Rule    json.RawMessage `json:"rule"`
+	Samples []Metric        `json:"samples"`
+	Source  *RuleTestSource `json:"source"`
+	// Window размер скользящего окна для z-score, по умолчанию из конфигурации
+	Window int `json:"window"`
+}
+
+// RuleTestResponse показывает, сработало бы правило на данных и когда
+type RuleTestResponse struct {
+	Evaluated    int               `json:"evaluated"`
+	Fired        bool              `json:"fired"`
+	FiredCount   int               `json:"fired_count"`
+	FirstFiredAt int64             `json:"first_fired_at,omitempty"`
+	ByDetector   map[string]int    `json:"by_detector"`
+	Firings      []AnalyticsResult `json:"firings"`
+}
+
+// parseRule разбирает кандидат в правило поверх текущих параметров детекторов
+func parseRule(raw json.RawMessage, base DetectorsConfig) (DetectorsConfig, error) {
+	rule := base
+	rule.ZScore.Enabled = false
+	rule.CUSUM.Enabled = false
+	rule.IQR.Enabled = false
+	rule.Correlation.Enabled = false
+	rule.Isolation.Enabled = false
+	rule.Seasonal.Enabled = false
+	rule.Trend.Enabled = false
+	rule.ML.Enabled = false
+	if len(raw) == 0 {
+		return rule, fmt.Errorf("rule is required")
+	}
+
+	// JSON является подмножеством YAML, поэтому используем теги конфигурации
+	decoder := yaml.NewDecoder(bytes.NewReader(raw))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&rule); err != nil {
+		return rule, fmt.Errorf("rule: %w", err)
+	}
+	if !rule.ZScore.Enabled && !rule.CUSUM.Enabled && !rule.IQR.Enabled && !rule.Correlation.Enabled &&
+		!rule.Isolation.Enabled && !rule.Seasonal.Enabled && !rule.Trend.Enabled && !rule.ML.Enabled {
+		return rule, fmt.Errorf("rule: no detector enabled")
+	}
+	// Модель читается с диска сервиса, поэтому правило использует настроенную
+	if rule.ML.ModelPath != base.ML.ModelPath {
+		return rule, fmt.Errorf("rule.ml.model_path: must not differ from detectors.ml.model_path")
+	}
+	return rule, rule.validate("rule")
+}
+
+// ruleTestSamples возвращает значения для прогона в порядке времени
+func (s *Service) ruleTestSamples(req RuleTestRequest) ([]Metric, error) {
+	if req.Source == nil {
+		for i := range req.Samples {
+			if req.Samples[i].DeviceID == "" {
+				req.Samples[i].DeviceID = "sandbox"
+			}
+			if err := req.Samples[i].Validate(s.maxFields(), s.maxSamples()); err != nil {
+				return nil, fmt.Errorf("samples[%d]: %w", i, err)
+			}
+		}
+		samples := make([]Metric, 0, len(req.Samples))
+		for _, sample := range req.Samples {
+			samples = append(samples, sample.Expand()...)
+		}
+		return samples, nil
+	}
+	if len(req.Samples) > 0 {
+		return nil, fmt.Errorf("samples and source are mutually exclusive")
+	}
+	if req.Source.DeviceID == "" {
+		return nil, fmt.Errorf("source.device_id is required")
+	}
+
+	return samplesFromSnapshot(req.Source.DeviceID, s.metricsBuffer.DeviceSnapshot(req.Source.DeviceID),
+		req.Source.From, req.Source.To), nil
+}
+
+// samplesFromSnapshot собирает значения полей буфера с одинаковой меткой времени
+// в метрики из интервала [from, to]; нули не ограничивают интервал
+func samplesFromSnapshot(deviceID string, snapshot map[string][]Point, from, to int64) []Metric {
+	byTimestamp := make(map[int64]map[string]float64)
+	for field, points := range snapshot {
+		for _, point := range points {
+			if from != 0 && point.Timestamp < from {
+				continue
+			}
+			if to != 0 && point.Timestamp > to {
+				continue
+			}
+			if byTimestamp[point.Timestamp] == nil {
+				byTimestamp[point.Timestamp] = make(map[string]float64)
+			}
+			byTimestamp[point.Timestamp][field] = point.Value
+		}
+	}
+
+	samples := make([]Metric, 0, len(byTimestamp))
+	for ts, values := range byTimestamp {
+		samples = append(samples, Metric{Timestamp: ts, DeviceID: deviceID, Values: values})
+	}
+	return samples
+}
+
+// replayDetectors прогоняет значения в порядке времени через изолированные
+// буфер и детекторы, передает в visit каждый результат детектора и возвращает буфер
+func replayDetectors(rule DetectorsConfig, window, maxSize int, samples []Metric, visit func(detector Detector, result *AnalyticsResult)) *MetricsBuffer {
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].Timestamp < samples[j].Timestamp })
+
+	buffer := NewMetricsBuffer(window, maxSize)
+	detectors := buildDetectors(rule, buffer, buffer, nil, nil, nil, nil)
+	for _, sample := range samples {
+		deviceID := sample.DeviceID
+		// Порядок как в ingest: сначала значение попадает в окно, затем анализируется
+		for field, value := range sample.Fields() {
+			buffer.Add(deviceID, field, sample.Timestamp, value)
+		}
+		for field, value := range sample.Fields() {
+			point := Point{Timestamp: sample.Timestamp, Value: value}
+			for _, detector := range detectors {
+				if !detector.Applies(field) {
+					continue
+				}
+				if result := detector.Detect(deviceID, field, point); result != nil {
+					visit(detector, result)
+				}
+			}
+		}
+	}
+	return buffer
+}
+
+// RuleTestHandler прогоняет кандидат в правило на образце данных в изолированных
+// буфере и детекторах и возвращает срабатывания; состояние сервиса не меняется
+func (s *Service) RuleTestHandler(w http.ResponseWriter, r *http.Request) {
+	var req RuleTestRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	s.configMu.RLock()
+	base := s.config.Detectors
+	window, maxSize := s.config.Buffer.Window, s.config.Buffer.MaxSize
+	s.configMu.RUnlock()
+
+	rule, err := parseRule(req.Rule, base)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Window != 0 {
+		if req.Window < 2 || req.Window > maxSize {
+			http.Error(w, fmt.Sprintf("window must be between 2 and %d", maxSize), http.StatusBadRequest)
+			return
+		}
+		window = req.Window
+	}
+
+	samples, err := s.ruleTestSamples(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(samples) == 0 {
+		http.Error(w, "no samples to evaluate", http.StatusBadRequest)
+		return
+	}
+	if len(samples) > maxRuleTestSamples {
+		http.Error(w, fmt.Sprintf("too many samples, at most %d allowed", maxRuleTestSamples), http.StatusBadRequest)
+		return
+	}
+
+	// Значения без метки времени сохраняют порядок запроса
+	for i := range samples {
+		if samples[i].Timestamp == 0 {
+			samples[i].Timestamp = int64(i + 1)
+		}
+	}
+	critical := s.criticalZScore()
+	response := RuleTestResponse{
+		Evaluated:  len(samples),
+		ByDetector: make(map[string]int),
+		Firings:    make([]AnalyticsResult, 0),
+	}
+	replayDetectors(rule, window, maxSize, samples, func(detector Detector, result *AnalyticsResult) {
+		if !result.IsAnomaly {
+			return
+		}
+		result.Severity = classifySeverity(*result, critical)
+		response.Firings = append(response.Firings, *result)
+		response.ByDetector[detector.Name()]++
+	})
+
+	response.FiredCount = len(response.Firings)
+	response.Fired = response.FiredCount > 0
+	if response.Fired {
+		response.FirstFiredAt = response.Firings[0].Timestamp
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Режимы сбора данных устройством
+const (
+	SamplingModeNormal         = "normal"
+	SamplingModeHighResolution = "high_resolution"
+)
+
+// Заголовки ответа на прием метрик, через которые шлюз узнает о режиме сбора
+const (
+	samplingModeHeader     = "X-Sampling-Mode"
+	samplingIntervalHeader = "X-Sampling-Interval"
+	samplingUntilHeader    = "X-Sampling-Until"
+)
+
+const (
+	highResKeyPrefix      = "highres:"
+	samplingSweepInterval = 5 * time.Second
+)
+
+var (
+	highResDevices = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "highload_highres_devices",
+		Help: "Current number of devices in high-resolution sampling mode",
+	})
+
+	highResSamples = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "highload_highres_samples_total",
+		Help: "Total number of samples stored at full resolution during high-resolution bursts",
+	})
+)
+
+// SamplingDirective режим сбора, который должен применить шлюз устройства
+type SamplingDirective struct {
+	DeviceID  string `json:"device_id"`
+	Mode      string `json:"mode"`
+	Interval  string `json:"interval,omitempty"`
+	Until     int64  `json:"until,omitempty"`
+	AnomalyID string `json:"anomaly_id,omitempty"`
+}
+
+// HighResBurst значения, собранные с полным разрешением за время инцидента
+type HighResBurst struct {
+	DeviceID  string             `json:"device_id"`
+	AnomalyID string             `json:"anomaly_id"`
+	Since     int64              `json:"since"`
+	Until     int64              `json:"until"`
+	Active    bool               `json:"active"`
+	Truncated bool               `json:"truncated"`
+	Samples   map[string][]Point `json:"samples"`
+
+	count int
+}
+
+// SamplingController переводит устройства в режим высокого разрешения при
+// аномалии и возвращает их в обычный режим по истечении срока или при закрытии
+// всех аномалий устройства. Значения за время всплеска хранятся отдельно от
+// скользящего окна, чтобы не зависеть от его размера.
+type SamplingController struct {
+	mu       sync.Mutex
+	redis    redis.UniversalClient
+	cfg      SamplingConfig
+	active   map[string]*HighResBurst
+	finished map[string]*HighResBurst // последний завершенный всплеск устройства
+}
+
+func NewSamplingController(rdb redis.UniversalClient, cfg SamplingConfig) *SamplingController {
+	return &SamplingController{
+		redis:    rdb,
+		cfg:      cfg,
+		active:   make(map[string]*HighResBurst),
+		finished: make(map[string]*HighResBurst),
+	}
+}
+
+// Configure применяет новые настройки к следующим всплескам
+func (sc *SamplingController) Configure(cfg SamplingConfig) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.cfg = cfg
+}
+
+// Trigger включает режим высокого разрешения для устройства аномалии
+// или продлевает уже действующий
+func (sc *SamplingController) Trigger(anomaly AnalyticsResult) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if !sc.cfg.Enabled {
+		return
+	}
+
+	until := time.Now().Add(sc.cfg.Duration).Unix()
+	if burst, ok := sc.active[anomaly.DeviceID]; ok {
+		burst.Until = until
+		return
+	}
+
+	sc.active[anomaly.DeviceID] = &HighResBurst{
+		DeviceID:  anomaly.DeviceID,
+		AnomalyID: anomaly.ID,
+		Since:     time.Now().Unix(),
+		Until:     until,
+		Active:    true,
+		Samples:   make(map[string][]Point),
+	}
+	highResDevices.Set(float64(len(sc.active)))
+	log.Printf("High-resolution sampling enabled for device %s until %d", anomaly.DeviceID, until)
+}
+
+// Directive возвращает текущий режим сбора устройства
+func (sc *SamplingController) Directive(deviceID string) SamplingDirective {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	burst, ok := sc.active[deviceID]
+	if !ok {
+		return SamplingDirective{DeviceID: deviceID, Mode: SamplingModeNormal}
+	}
+	return SamplingDirective{
+		DeviceID:  deviceID,
+		Mode:      SamplingModeHighResolution,
+		Interval:  sc.cfg.Interval.String(),
+		Until:     burst.Until,
+		AnomalyID: burst.AnomalyID,
+	}
+}
+
+// Record сохраняет значения метрики, если устройство в режиме высокого разрешения
+func (sc *SamplingController) Record(metric Metric) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	burst, ok := sc.active[metric.DeviceID]
+	if !ok {
+		return
+	}
+	if burst.count >= sc.cfg.MaxSamples {
+		burst.Truncated = true
+		return
+	}
+	for field, value := range metric.Values {
+		burst.Samples[field] = append(burst.Samples[field], Point{Timestamp: metric.Timestamp, Value: value})
+	}
+	burst.count++
+	highResSamples.Inc()
+}
+
+// Revert досрочно возвращает устройство в обычный режим
+func (sc *SamplingController) Revert(deviceID string) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if burst, ok := sc.active[deviceID]; ok {
+		burst.Until = time.Now().Unix()
+		sc.finish(burst)
+	}
+}
+
+// Run завершает всплески с истекшим сроком
+func (sc *SamplingController) Run() {
+	ticker := time.NewTicker(samplingSweepInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		sc.mu.Lock()
+		for _, burst := range sc.active {
+			if now.Unix() >= burst.Until {
+				sc.finish(burst)
+			}
+		}
+		sc.mu.Unlock()
+	}
+}
+
+// finish переводит всплеск в завершенные и сохраняет его в Redis; вызывается под блокировкой
+func (sc *SamplingController) finish(burst *HighResBurst) {
+	burst.Active = false
+	delete(sc.active, burst.DeviceID)
+	sc.finished[burst.DeviceID] = burst
+	highResDevices.Set(float64(len(sc.active)))
+	log.Printf("High-resolution sampling reverted for device %s (%d samples)", burst.DeviceID, burst.count)
+
+	data, err := json.Marshal(burst)
+	if err != nil {
+		return
+	}
+	key := highResKeyPrefix + burst.DeviceID + ":" + strconv.FormatInt(burst.Since, 10)
+	retention := sc.cfg.Retention
+	goSafe("sampling", func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := sc.redis.Set(ctx, key, data, retention).Err(); err != nil {
+			log.Printf("Failed to persist high-resolution burst %s: %v", key, err)
+		}
+	})
+}
+
+// Burst возвращает текущий или последний завершенный всплеск устройства
+func (sc *SamplingController) Burst(deviceID string) (HighResBurst, bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	burst, ok := sc.active[deviceID]
+	if !ok {
+		burst, ok = sc.finished[deviceID]
+	}
+	if !ok {
+		return HighResBurst{}, false
+	}
+
+	copied := *burst
+	copied.Samples = make(map[string][]Point, len(burst.Samples))
+	for field, points := range burst.Samples {
+		copied.Samples[field] = append([]Point(nil), points...)
+	}
+	return copied, true
+}
+
+// writeSamplingHeaders сообщает шлюзу режим сбора в ответе на прием метрики
+func writeSamplingHeaders(w http.ResponseWriter, directive SamplingDirective) {
+	w.Header().Set(samplingModeHeader, directive.Mode)
+	if directive.Mode == SamplingModeHighResolution {
+		w.Header().Set(samplingIntervalHeader, directive.Interval)
+		w.Header().Set(samplingUntilHeader, strconv.FormatInt(directive.Until, 10))
+	}
+}
+
+// SamplingHandler возвращает режим сбора устройства для шлюзов, опрашивающих сервис
+func (s *Service) SamplingHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.sampling.Directive(mux.Vars(r)["device_id"]))
+}
+
+// HighResHandler возвращает значения текущего или последнего всплеска устройства
+func (s *Service) HighResHandler(w http.ResponseWriter, r *http.Request) {
+	burst, ok := s.sampling.Burst(mux.Vars(r)["device_id"])
+	if !ok {
+		http.Error(w, "no high-resolution data for device", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(burst)
+}
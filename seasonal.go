@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	// База часовых поясов в бинарнике: в образе alpine ее нет
+	_ "time/tzdata"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// AnomalyTypeSeasonal значение выпало из обычного для этого часа (и дня недели) диапазона
+const AnomalyTypeSeasonal = "seasonal"
+
+// Разбиение времени на интервалы сезонной базы
+const (
+	SeasonalBucketsHourOfWeek = "hour_of_week"
+	SeasonalBucketsHourOfDay  = "hour_of_day"
+)
+
+var seasonalOps = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "highload_seasonal_baseline_ops_total",
+		Help: "Operations on seasonal baselines in Redis by op (update, read) and result (ok, error)",
+	},
+	[]string{"op", "result"},
+)
+
+// SeasonalInfo интервал сезонной базы, с которым сравнивалось значение
+type SeasonalInfo struct {
+	// Bucket интервал, например mon 09:00 или 09:00
+	Bucket string  `json:"bucket"`
+	StdDev float64 `json:"std_dev"`
+	// Samples вес значений базы с учетом забывания
+	Samples int `json:"samples"`
+}
+
+// seasonalBaseline статистика интервала: взвешенное число значений, среднее,
+// дисперсия и время первого значения
+type seasonalBaseline struct {
+	count    float64
+	mean     float64
+	variance float64
+	first    int64
+}
+
+// observeSeasonalScript возвращает статистику интервала до учета значения и
+// обновляет ее. Вес накопленных значений убывает вдвое за half_life, поэтому
+// каждое прошлое повторение интервала (прошлый понедельник 9:00) весит
+// одинаково независимо от частоты значений, а старые недели забываются. После
+// min_samples значение перед учетом ограничивается mean ± threshold·σ, чтобы
+// один выброс не расширял базу.
+// KEYS: hash устройства. ARGV: поле интервала, значение, метка времени,
+// half_life в секундах, min_samples, threshold, TTL в миллисекундах,
+// 1 — только чтение.
+var observeSeasonalScript = redis.NewScript(`
+local field = ARGV[1]
+local value = tonumber(ARGV[2])
+local ts = tonumber(ARGV[3])
+local halfLife = tonumber(ARGV[4])
+local minSamples = tonumber(ARGV[5])
+local threshold = tonumber(ARGV[6])
+local stats = redis.call("hmget", KEYS[1], field .. ":n", field .. ":mean", field .. ":var", field .. ":first", field .. ":at")
+local n = tonumber(stats[1] or "0")
+local mean = tonumber(stats[2] or "0")
+local var = tonumber(stats[3] or "0")
+local first = tonumber(stats[4] or ARGV[3])
+local at = tonumber(stats[5] or ARGV[3])
+if ts > at then
+	n = n * math.pow(0.5, (ts - at) / halfLife)
+	at = ts
+end
+local reply = {string.format("%.17g", n), string.format("%.17g", mean), string.format("%.17g", var), first}
+if ARGV[8] == "1" then
+	return reply
+end
+if n >= minSamples and var > 0 then
+	local limit = threshold * math.sqrt(var)
+	value = math.max(mean - limit, math.min(mean + limit, value))
+end
+local alpha = 1 / (n + 1)
+local delta = value - mean
+mean = mean + alpha * delta
+var = (1 - alpha) * (var + alpha * delta * delta)
+redis.call("hset", KEYS[1], field .. ":n", string.format("%.17g", n + 1), field .. ":mean", string.format("%.17g", mean),
+	field .. ":var", string.format("%.17g", var), field .. ":first", first, field .. ":at", at)
+redis.call("pexpire", KEYS[1], ARGV[7])
+return reply`)
+
+// seasonalStore хранилище сезонных баз
+type seasonalStore interface {
+	// Observe возвращает базу интервала до учета значения и учитывает его
+	Observe(deviceID, key string, timestamp int64, value float64) (seasonalBaseline, error)
+	Reset(deviceID string)
+}
+
+// redisSeasonalStore базы в Redis, общие для реплик и переживающие
+// перезапуск: на накопление недели наблюдений уходит неделя. Резервный
+// экземпляр пары active/standby базы только читает.
+type redisSeasonalStore struct {
+	redis  redis.UniversalClient
+	cfg    SeasonalConfig
+	active func() bool
+}
+
+func (rs *redisSeasonalStore) key(deviceID string) string {
+	// Хеш-тег устройства держит все ключи устройства в одном слоте Redis Cluster
+	return fmt.Sprintf("%s:{%s}", rs.cfg.KeyPrefix, deviceID)
+}
+
+func (rs *redisSeasonalStore) Observe(deviceID, key string, timestamp int64, value float64) (seasonalBaseline, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), rs.cfg.Timeout)
+	defer cancel()
+
+	op, readOnly := "update", "0"
+	if !rs.active() {
+		op, readOnly = "read", "1"
+	}
+	res, err := observeSeasonalScript.Run(ctx, rs.redis, []string{rs.key(deviceID)},
+		key, strconv.FormatFloat(value, 'g', -1, 64), timestamp, int64(rs.cfg.HalfLife/time.Second), rs.cfg.MinSamples,
+		strconv.FormatFloat(rs.cfg.Threshold, 'g', -1, 64), rs.cfg.TTL.Milliseconds(), readOnly).Slice()
+	if err == nil && len(res) != 4 {
+		err = fmt.Errorf("unexpected script reply %v", res)
+	}
+	if err != nil {
+		seasonalOps.WithLabelValues(op, "error").Inc()
+		return seasonalBaseline{}, err
+	}
+	seasonalOps.WithLabelValues(op, "ok").Inc()
+
+	var baseline seasonalBaseline
+	baseline.first, _ = res[3].(int64)
+	for i, target := range []*float64{&baseline.count, &baseline.mean, &baseline.variance} {
+		if *target, err = strconv.ParseFloat(fmt.Sprint(res[i]), 64); err != nil {
+			return seasonalBaseline{}, fmt.Errorf("parse baseline: %w", err)
+		}
+	}
+	return baseline, nil
+}
+
+func (rs *redisSeasonalStore) Reset(deviceID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), rs.cfg.Timeout)
+	defer cancel()
+	if err := rs.redis.Del(ctx, rs.key(deviceID)).Err(); err != nil {
+		log.Printf("Failed to reset seasonal baseline for %s: %v", deviceID, err)
+	}
+}
+
+// memorySeasonalStore базы в памяти для проверки правил на выборке
+type memorySeasonalStore struct {
+	cfg SeasonalConfig
+
+	mu        sync.Mutex
+	baselines map[string]map[string]*memoryBaseline
+}
+
+type memoryBaseline struct {
+	seasonalBaseline
+	at int64
+}
+
+func (ms *memorySeasonalStore) Observe(deviceID, key string, timestamp int64, value float64) (seasonalBaseline, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.baselines[deviceID] == nil {
+		ms.baselines[deviceID] = make(map[string]*memoryBaseline)
+	}
+	b, ok := ms.baselines[deviceID][key]
+	if !ok {
+		b = &memoryBaseline{seasonalBaseline: seasonalBaseline{first: timestamp}, at: timestamp}
+		ms.baselines[deviceID][key] = b
+	}
+
+	// То же обновление, что в observeSeasonalScript
+	if timestamp > b.at {
+		b.count *= math.Pow(0.5, float64(timestamp-b.at)/ms.cfg.HalfLife.Seconds())
+		b.at = timestamp
+	}
+	previous := b.seasonalBaseline
+	if b.count >= float64(ms.cfg.MinSamples) && b.variance > 0 {
+		limit := ms.cfg.Threshold * math.Sqrt(b.variance)
+		value = math.Max(b.mean-limit, math.Min(b.mean+limit, value))
+	}
+	alpha := 1 / (b.count + 1)
+	delta := value - b.mean
+	b.mean += alpha * delta
+	b.variance = (1 - alpha) * (b.variance + alpha*delta*delta)
+	b.count++
+	return previous, nil
+}
+
+func (ms *memorySeasonalStore) Reset(deviceID string) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.baselines, deviceID)
+}
+
+// SeasonalDetector сравнивает значение со средним и σ того же часа (и дня
+// недели) у устройства, а не со скользящим окном: ежедневный рост нагрузки
+// в рабочие часы не считается аномалией, если он обычен для этого часа.
+// Интервал участвует в проверке, когда в нем есть значения прошлого
+// повторения (неделю или сутки назад) и их вес не меньше min_samples.
+type SeasonalDetector struct {
+	fieldSet
+	store    seasonalStore
+	location *time.Location
+	cfg      SeasonalConfig
+}
+
+// NewSeasonalDetector создает детектор с базами в Redis; при rdb == nil базы
+// хранятся в памяти
+func NewSeasonalDetector(rdb redis.UniversalClient, cfg SeasonalConfig, active func() bool) *SeasonalDetector {
+	location, err := time.LoadLocation(cfg.Timezone)
+	if err != nil {
+		// Зона проверена при загрузке конфигурации
+		location = time.UTC
+	}
+	var store seasonalStore = &memorySeasonalStore{cfg: cfg, baselines: make(map[string]map[string]*memoryBaseline)}
+	if rdb != nil {
+		store = &redisSeasonalStore{redis: rdb, cfg: cfg, active: active}
+	}
+	return &SeasonalDetector{
+		fieldSet: newFieldSet(cfg.Fields...),
+		store:    store,
+		location: location,
+		cfg:      cfg,
+	}
+}
+
+func (d *SeasonalDetector) Name() string { return AnomalyTypeSeasonal }
+
+// bucket возвращает ключ и подпись интервала, в который попадает метка, и
+// период повторения интервала. Ключи разбиений различаются, поэтому смена
+// buckets начинает базы заново.
+func (d *SeasonalDetector) bucket(timestamp int64) (string, string, time.Duration) {
+	t := time.Unix(timestamp, 0).In(d.location)
+	if d.cfg.Buckets == SeasonalBucketsHourOfDay {
+		return fmt.Sprintf("d%d", t.Hour()), fmt.Sprintf("%02d:00", t.Hour()), 24 * time.Hour
+	}
+	weekday := strings.ToLower(t.Weekday().String()[:3])
+	return fmt.Sprintf("w%d", int(t.Weekday())*24+t.Hour()), fmt.Sprintf("%s %02d:00", weekday, t.Hour()), 7 * 24 * time.Hour
+}
+
+func (d *SeasonalDetector) Detect(deviceID, field string, point Point) *AnalyticsResult {
+	key, label, cycle := d.bucket(point.Timestamp)
+	baseline, err := d.store.Observe(deviceID, field+":"+key, point.Timestamp, point.Value)
+	if err != nil {
+		log.Printf("Seasonal baseline unavailable for %s/%s: %v", deviceID, field, err)
+		return nil
+	}
+	// Значения только текущего повторения интервала еще не база: без прошлого
+	// повторения детектор сравнивал бы значение с последними минутами
+	seen := time.Duration(point.Timestamp-baseline.first) * time.Second
+	if baseline.count < float64(d.cfg.MinSamples) || seen < cycle-time.Hour {
+		return nil
+	}
+
+	stdDev := math.Sqrt(baseline.variance)
+	var zScore float64
+	if stdDev > 0 {
+		zScore = (point.Value - baseline.mean) / stdDev
+	}
+	return &AnalyticsResult{
+		DeviceID:       deviceID,
+		Field:          field,
+		Type:           AnomalyTypeSeasonal,
+		RollingAverage: baseline.mean,
+		ZScore:         zScore,
+		IsAnomaly:      math.Abs(zScore) > d.cfg.Threshold,
+		Timestamp:      point.Timestamp,
+		Value:          point.Value,
+		Seasonal:       &SeasonalInfo{Bucket: label, StdDev: stdDev, Samples: int(math.Round(baseline.count))},
+	}
+}
+
+func (d *SeasonalDetector) Reset(deviceID string) {
+	d.store.Reset(deviceID)
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Ссылки на секреты в значениях полей с тегом secret:"true":
+// vault:<путь API без /v1>#<ключ> (KV v1 и v2) и file:<путь> для смонтированных секретов
+const (
+	secretVaultPrefix = "vault:"
+	secretFilePrefix  = "file:"
+)
+
+var secretResolutions = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "highload_secret_resolutions_total",
+		Help: "Total number of secret reference resolutions by source (vault, file) and result (ok, error)",
+	},
+	[]string{"source", "result"},
+)
+
+// secretResolver подставляет значения секретов; данные одного пути Vault
+// читаются один раз за загрузку конфигурации
+type secretResolver struct {
+	cfg    VaultConfig
+	client *http.Client
+	cache  map[string]map[string]interface{}
+}
+
+func newSecretResolver(cfg VaultConfig) *secretResolver {
+	return &secretResolver{
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+		cache:  make(map[string]map[string]interface{}),
+	}
+}
+
+// resolveSecrets заменяет ссылки в полях-секретах их значениями и возвращает
+// пути замененных полей
+func resolveSecrets(cfg *Config) ([]string, error) {
+	resolver := newSecretResolver(cfg.Secrets.Vault)
+	var resolved []string
+	err := walkSecrets(reflect.ValueOf(cfg).Elem(), "", func(path string, value *string) error {
+		secret, ok, err := resolver.resolve(*value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if ok {
+			*value = secret
+			resolved = append(resolved, path)
+		}
+		return nil
+	})
+	return resolved, err
+}
+
+// walkSecrets вызывает fn для каждой строки в полях с тегом secret:"true"
+func walkSecrets(v reflect.Value, prefix string, fn func(path string, value *string) error) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+		fv := v.Field(i)
+
+		switch {
+		case field.Type.Kind() == reflect.Struct:
+			if err := walkSecrets(fv, name, fn); err != nil {
+				return err
+			}
+		case field.Type.Kind() == reflect.Slice && field.Type.Elem().Kind() == reflect.Struct:
+			for j := 0; j < fv.Len(); j++ {
+				if err := walkSecrets(fv.Index(j), fmt.Sprintf("%s[%d]", name, j), fn); err != nil {
+					return err
+				}
+			}
+		case field.Tag.Get("secret") != "true":
+		case field.Type.Kind() == reflect.String:
+			if err := fn(name, fv.Addr().Interface().(*string)); err != nil {
+				return err
+			}
+		case field.Type.Kind() == reflect.Slice && field.Type.Elem().Kind() == reflect.String:
+			for j := 0; j < fv.Len(); j++ {
+				if err := fn(fmt.Sprintf("%s[%d]", name, j), fv.Index(j).Addr().Interface().(*string)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// secretValues возвращает значения всех полей-секретов по путям
+func secretValues(cfg *Config) map[string]string {
+	values := make(map[string]string)
+	walkSecrets(reflect.ValueOf(cfg).Elem(), "", func(path string, value *string) error {
+		values[path] = *value
+		return nil
+	})
+	return values
+}
+
+// resolve возвращает значение секрета; false, если строка не является ссылкой
+func (sr *secretResolver) resolve(ref string) (string, bool, error) {
+	switch {
+	case strings.HasPrefix(ref, secretFilePrefix):
+		data, err := os.ReadFile(strings.TrimPrefix(ref, secretFilePrefix))
+		if err != nil {
+			secretResolutions.WithLabelValues("file", "error").Inc()
+			return "", false, err
+		}
+		secretResolutions.WithLabelValues("file", "ok").Inc()
+		return strings.TrimSpace(string(data)), true, nil
+	case strings.HasPrefix(ref, secretVaultPrefix):
+		value, err := sr.vaultSecret(strings.TrimPrefix(ref, secretVaultPrefix))
+		if err != nil {
+			secretResolutions.WithLabelValues("vault", "error").Inc()
+			return "", false, err
+		}
+		secretResolutions.WithLabelValues("vault", "ok").Inc()
+		return value, true, nil
+	}
+	return ref, false, nil
+}
+
+func (sr *secretResolver) vaultSecret(ref string) (string, error) {
+	path, key, ok := strings.Cut(ref, "#")
+	if !ok || path == "" || key == "" {
+		return "", fmt.Errorf("vault reference must be vault:<path>#<key>, got %q", ref)
+	}
+	if sr.cfg.Addr == "" {
+		return "", fmt.Errorf("vault reference requires secrets.vault.addr")
+	}
+
+	data, cached := sr.cache[path]
+	if !cached {
+		var err error
+		if data, err = sr.readVault(path); err != nil {
+			return "", fmt.Errorf("vault %s: %w", path, err)
+		}
+		sr.cache[path] = data
+	}
+	value, ok := data[key].(string)
+	if !ok {
+		return "", fmt.Errorf("vault %s: key %q not found or not a string", path, key)
+	}
+	return value, nil
+}
+
+// readVault читает секрет; для KV v2 данные вложены в data.data
+func (sr *secretResolver) readVault(path string) (map[string]interface{}, error) {
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := sr.vaultRequest(context.Background(), http.MethodGet, path, &body); err != nil {
+		return nil, err
+	}
+	if inner, ok := body.Data["data"].(map[string]interface{}); ok {
+		if _, versioned := body.Data["metadata"]; versioned {
+			return inner, nil
+		}
+	}
+	return body.Data, nil
+}
+
+func (sr *secretResolver) vaultRequest(ctx context.Context, method, path string, out interface{}) error {
+	token, err := sr.cfg.token()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, sr.cfg.Timeout)
+	defer cancel()
+
+	url := strings.TrimRight(sr.cfg.Addr, "/") + "/v1/" + strings.TrimLeft(path, "/")
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if sr.cfg.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", sr.cfg.Namespace)
+	}
+
+	resp, err := sr.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("vault returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// token возвращает токен Vault; файл перечитывается при каждом обращении,
+// чтобы подхватывать токены, обновляемые Vault Agent
+func (vc VaultConfig) token() (string, error) {
+	if vc.TokenFile != "" {
+		data, err := os.ReadFile(vc.TokenFile)
+		if err != nil {
+			return "", fmt.Errorf("read vault token: %w", err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	if vc.Token == "" {
+		return "", fmt.Errorf("vault token is not set (secrets.vault.token or token_file)")
+	}
+	return vc.Token, nil
+}
+
+// refreshSecrets периодически продлевает токен Vault и перечитывает секреты;
+// при изменении значений конфигурация перезагружается
+func (s *Service) refreshSecrets() {
+	s.configMu.RLock()
+	interval := s.config.Secrets.RefreshInterval
+	s.configMu.RUnlock()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.configMu.RLock()
+		current := s.config
+		s.configMu.RUnlock()
+
+		vault := current.Secrets.Vault
+		if vault.Addr != "" && vault.Token != "" && vault.TokenFile == "" {
+			// Статический токен продлеваем сами; токен из файла обновляет Vault Agent
+			if err := newSecretResolver(vault).vaultRequest(context.Background(), http.MethodPost, "auth/token/renew-self", nil); err != nil {
+				log.Printf("Failed to renew vault token: %v", err)
+			}
+		}
+
+		cfg, err := LoadConfig(s.configPath)
+		if err != nil {
+			log.Printf("Failed to refresh secrets: %v", err)
+			continue
+		}
+		if changed := changedSecrets(current, cfg); len(changed) > 0 {
+			log.Printf("Secrets changed: %s; reloading configuration", strings.Join(changed, ", "))
+			if err := s.Reload(); err != nil {
+				log.Printf("Config reload after secret refresh failed: %v", err)
+			}
+		}
+	}
+}
+
+// changedSecrets возвращает пути полей-секретов с изменившимися значениями
+func changedSecrets(old, updated *Config) []string {
+	before := secretValues(old)
+	var changed []string
+	for path, value := range secretValues(updated) {
+		if before[path] != value {
+			changed = append(changed, path)
+		}
+	}
+	return changed
+}
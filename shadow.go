@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Исходы сравнения теневого детектора с рабочими
+const (
+	ShadowAgreed   = "agreed"
+	ShadowOnly     = "shadow_only"
+	ShadowLiveOnly = "live_only"
+)
+
+var (
+	shadowAnomaliesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "highload_shadow_anomalies_total",
+			Help: "Total number of anomalies shadow detectors would have flagged by type (no alerts are sent)",
+		},
+		[]string{"type"},
+	)
+
+	shadowComparisonsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "highload_shadow_comparisons_total",
+			Help: "Total number of values where a shadow detector or live detectors flagged an anomaly by shadow type and outcome (agreed, shadow_only, live_only)",
+		},
+		[]string{"type", "outcome"},
+	)
+)
+
+// ShadowSummary исходы сравнения теневого детектора с рабочими с момента запуска
+type ShadowSummary struct {
+	Agreed     int `json:"agreed"`
+	ShadowOnly int `json:"shadow_only"`
+	LiveOnly   int `json:"live_only"`
+}
+
+// ShadowMode прогоняет каждое значение через теневые детекторы и запоминает,
+// что они пометили бы как аномалию. Результаты не уходят в историю, алерты,
+// ленту и пересылку: они видны только в счетчиках и в /api/anomalies/shadow
+// с пометкой shadow. Теневые детекторы держат собственное состояние (z-score
+// считается по локальному окну, без общей статистики и подстройки по оценкам),
+// поэтому не влияют на рабочие.
+type ShadowMode struct {
+	buffer *MetricsBuffer
+
+	mu        sync.RWMutex
+	cfg       ShadowConfig
+	detectors []Detector
+	history   []AnalyticsResult
+	summary   map[string]*ShadowSummary
+}
+
+func NewShadowMode(cfg ShadowConfig, buffer *MetricsBuffer) *ShadowMode {
+	return &ShadowMode{
+		buffer:    buffer,
+		cfg:       cfg,
+		detectors: buildDetectors(cfg.Detectors, buffer, buffer, nil, nil, nil, nil),
+		summary:   make(map[string]*ShadowSummary),
+	}
+}
+
+// Configure пересоздает теневые детекторы, если изменились их параметры
+func (sm *ShadowMode) Configure(cfg ShadowConfig) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if !reflect.DeepEqual(sm.cfg.Detectors, cfg.Detectors) {
+		sm.detectors = buildDetectors(cfg.Detectors, sm.buffer, sm.buffer, nil, nil, nil, nil)
+	}
+	sm.cfg = cfg
+	if excess := len(sm.history) - cfg.HistorySize; excess > 0 {
+		sm.history = append(sm.history[:0:0], sm.history[excess:]...)
+	}
+}
+
+func (sm *ShadowMode) active() []Detector {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return sm.detectors
+}
+
+// Evaluate прогоняет значение через теневые детекторы; live — пометил ли его
+// хотя бы один рабочий детектор. Состояние детекторов обновляется всегда, а
+// результаты учитываются только при record (на активном экземпляре).
+func (sm *ShadowMode) Evaluate(metric Metric, field string, point Point, live, record bool) {
+	for _, detector := range sm.active() {
+		if !detector.Applies(field) {
+			continue
+		}
+		result := detector.Detect(metric.DeviceID, field, point)
+		flagged := result != nil && result.IsAnomaly
+		if !record || (!flagged && !live) {
+			continue
+		}
+
+		outcome := ShadowLiveOnly
+		if flagged && live {
+			outcome = ShadowAgreed
+		} else if flagged {
+			outcome = ShadowOnly
+		}
+		shadowComparisonsTotal.WithLabelValues(detector.Name(), outcome).Inc()
+		if flagged {
+			shadowAnomaliesTotal.WithLabelValues(detector.Name()).Inc()
+			result.Shadow = true
+			result.TraceID = metric.TraceID
+		}
+		sm.record(detector.Name(), outcome, result, flagged)
+	}
+}
+
+func (sm *ShadowMode) record(detector, outcome string, result *AnalyticsResult, flagged bool) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	summary, ok := sm.summary[detector]
+	if !ok {
+		summary = &ShadowSummary{}
+		sm.summary[detector] = summary
+	}
+	switch outcome {
+	case ShadowAgreed:
+		summary.Agreed++
+	case ShadowOnly:
+		summary.ShadowOnly++
+	case ShadowLiveOnly:
+		summary.LiveOnly++
+	}
+
+	if !flagged {
+		return
+	}
+	sm.history = append(sm.history, *result)
+	if excess := len(sm.history) - sm.cfg.HistorySize; excess > 0 {
+		sm.history = append(sm.history[:0:0], sm.history[excess:]...)
+	}
+}
+
+// Reset сбрасывает состояние теневых детекторов для устройства
+func (sm *ShadowMode) Reset(deviceID string) {
+	for _, detector := range sm.active() {
+		detector.Reset(deviceID)
+	}
+}
+
+// Query возвращает до limit теневых срабатываний, подходящих под фильтр и
+// тип детектора, новые первыми, и общее число подходящих
+func (sm *ShadowMode) Query(filter AnomalyFilter, detector string, limit int) ([]AnalyticsResult, int) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	matched := make([]AnalyticsResult, 0)
+	for i := len(sm.history) - 1; i >= 0; i-- {
+		item := sm.history[i]
+		if filter.matches(item) && (detector == "" || item.Type == detector) {
+			matched = append(matched, item)
+		}
+	}
+	total := len(matched)
+	if len(matched) > limit {
+		matched = matched[:limit]
+	}
+	return matched, total
+}
+
+// Summary возвращает исходы сравнения по типам теневых детекторов
+func (sm *ShadowMode) Summary() map[string]ShadowSummary {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	summary := make(map[string]ShadowSummary, len(sm.summary))
+	for detector, s := range sm.summary {
+		summary[detector] = *s
+	}
+	return summary
+}
+
+// Detectors возвращает типы включенных теневых детекторов
+func (sm *ShadowMode) Detectors() []string {
+	names := make([]string, 0)
+	for _, detector := range sm.active() {
+		names = append(names, detector.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ShadowAnomaliesHandler показывает, что пометили бы теневые детекторы:
+// GET /api/anomalies/shadow от новых к старым с фильтрами device_id, field,
+// from, to, type и limit, а также сводку совпадений с рабочими детекторами
+func (s *Service) ShadowAnomaliesHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter, err := parseAnomalyFilter(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := defaultHistoryLimit
+	if raw := query.Get("limit"); raw != "" {
+		limit, err = strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > maxHistoryLimit {
+			http.Error(w, "limit must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+	}
+
+	anomalies, total := s.shadow.Query(filter, query.Get("type"), limit)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"detectors": s.shadow.Detectors(),
+		"summary":   s.shadow.Summary(),
+		"total":     total,
+		"count":     len(anomalies),
+		"anomalies": anomalies,
+	})
+}
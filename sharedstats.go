@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// RollingStats источник статистики скользящего окна для z-score
+type RollingStats interface {
+	// Observe учитывает значение поля и возвращает среднее, σ и число значений в окне
+	Observe(deviceID, field string, value float64) (mean, stdDev float64, count int)
+}
+
+// Observe возвращает статистику окна локального буфера. Значение уже добавлено
+// в буфер при приеме метрики, поэтому повторно не учитывается.
+func (mb *MetricsBuffer) Observe(deviceID, field string, value float64) (float64, float64, int) {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+
+	values := mb.data[deviceID][field]
+	count := len(values)
+	if count > mb.window {
+		count = mb.window
+	}
+	mean, stdDev := mb.windowStats(values)
+	return mean, stdDev, count
+}
+
+// observeSharedScript добавляет значение в окно поля и атомарно обновляет count,
+// sum и sumsq. Вытесненные значения вычитаются; каждые window вытеснений суммы
+// пересчитываются по списку, чтобы не накапливать ошибку округления.
+// KEYS: hash статистики, список значений окна, множество полей устройства.
+// ARGV: значение, размер окна, TTL в миллисекундах, имя поля.
+var observeSharedScript = redis.NewScript(`
+local value = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+redis.call("rpush", KEYS[2], ARGV[1])
+local count = redis.call("hincrby", KEYS[1], "count", 1)
+local sum = tonumber(redis.call("hincrbyfloat", KEYS[1], "sum", ARGV[1]))
+local sumsq = tonumber(redis.call("hincrbyfloat", KEYS[1], "sumsq", string.format("%.17g", value * value)))
+local evicted = 0
+while count > window do
+	local old = tonumber(redis.call("lpop", KEYS[2]))
+	count = count - 1
+	sum = sum - old
+	sumsq = sumsq - old * old
+	evicted = evicted + 1
+end
+if evicted > 0 then
+	local total = redis.call("hincrby", KEYS[1], "evictions", evicted)
+	if total >= window then
+		sum, sumsq = 0, 0
+		for _, v in ipairs(redis.call("lrange", KEYS[2], 0, -1)) do
+			local x = tonumber(v)
+			sum = sum + x
+			sumsq = sumsq + x * x
+		end
+		redis.call("hset", KEYS[1], "evictions", 0)
+	end
+	redis.call("hset", KEYS[1], "count", count, "sum", string.format("%.17g", sum), "sumsq", string.format("%.17g", sumsq))
+end
+redis.call("sadd", KEYS[3], ARGV[4])
+redis.call("pexpire", KEYS[1], ARGV[3])
+redis.call("pexpire", KEYS[2], ARGV[3])
+redis.call("pexpire", KEYS[3], ARGV[3])
+return {count, string.format("%.17g", sum), string.format("%.17g", sumsq)}`)
+
+var sharedStatsOps = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "highload_shared_stats_ops_total",
+		Help: "Operations on rolling statistics shared between replicas in Redis by op (update, read) and result (ok, error)",
+	},
+	[]string{"op", "result"},
+)
+
+// SharedStats хранит скользящие count/sum/sumsq в Redis, чтобы реплики за
+// балансировщиком считали z-score по общему окну. Резервный экземпляр пары
+// active/standby только читает статистику, чтобы не учитывать значения дважды.
+// При недоступности Redis используется локальный буфер.
+type SharedStats struct {
+	redis  redis.UniversalClient
+	cfg    SharedStatsConfig
+	local  *MetricsBuffer
+	active func() bool
+}
+
+func NewSharedStats(rdb redis.UniversalClient, cfg SharedStatsConfig, local *MetricsBuffer, active func() bool) *SharedStats {
+	return &SharedStats{redis: rdb, cfg: cfg, local: local, active: active}
+}
+
+func (ss *SharedStats) keys(deviceID, field string) []string {
+	// Хеш-тег устройства держит все ключи устройства в одном слоте Redis Cluster
+	base := fmt.Sprintf("%s:{%s}", ss.cfg.KeyPrefix, deviceID)
+	return []string{base + ":stats:" + field, base + ":window:" + field, base + ":fields"}
+}
+
+// Observe учитывает значение в общем окне и возвращает его статистику
+func (ss *SharedStats) Observe(deviceID, field string, value float64) (float64, float64, int) {
+	ctx, cancel := context.WithTimeout(context.Background(), ss.cfg.Timeout)
+	defer cancel()
+
+	op := "update"
+	var count int64
+	var sum, sumsq float64
+	var err error
+	if ss.active() {
+		window, _ := ss.local.Limits()
+		count, sum, sumsq, err = ss.update(ctx, deviceID, field, value, window)
+	} else {
+		op = "read"
+		count, sum, sumsq, err = ss.read(ctx, deviceID, field)
+	}
+	if err != nil {
+		sharedStatsOps.WithLabelValues(op, "error").Inc()
+		log.Printf("Shared stats %s failed for %s/%s, using local window: %v", op, deviceID, field, err)
+		return ss.local.Observe(deviceID, field, value)
+	}
+	sharedStatsOps.WithLabelValues(op, "ok").Inc()
+
+	if count == 0 {
+		return 0, 0, 0
+	}
+	mean := sum / float64(count)
+	variance := sumsq/float64(count) - mean*mean
+	if variance < 0 {
+		variance = 0
+	}
+	return mean, math.Sqrt(variance), int(count)
+}
+
+func (ss *SharedStats) update(ctx context.Context, deviceID, field string, value float64, window int) (int64, float64, float64, error) {
+	res, err := observeSharedScript.Run(ctx, ss.redis, ss.keys(deviceID, field),
+		strconv.FormatFloat(value, 'g', -1, 64), window, ss.cfg.TTL.Milliseconds(), field).Slice()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if len(res) != 3 {
+		return 0, 0, 0, fmt.Errorf("unexpected script reply %v", res)
+	}
+	count, _ := res[0].(int64)
+	return parseSharedSums(count, res[1], res[2])
+}
+
+func (ss *SharedStats) read(ctx context.Context, deviceID, field string) (int64, float64, float64, error) {
+	res, err := ss.redis.HMGet(ctx, ss.keys(deviceID, field)[0], "count", "sum", "sumsq").Result()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if res[0] == nil {
+		return 0, 0, 0, nil
+	}
+	count, err := strconv.ParseInt(fmt.Sprint(res[0]), 10, 64)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return parseSharedSums(count, res[1], res[2])
+}
+
+func parseSharedSums(count int64, rawSum, rawSumsq interface{}) (int64, float64, float64, error) {
+	sum, err := strconv.ParseFloat(fmt.Sprint(rawSum), 64)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("parse sum: %w", err)
+	}
+	sumsq, err := strconv.ParseFloat(fmt.Sprint(rawSumsq), 64)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("parse sumsq: %w", err)
+	}
+	return count, sum, sumsq, nil
+}
+
+// Reset удаляет общую статистику всех полей устройства
+func (ss *SharedStats) Reset(deviceID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), ss.cfg.Timeout)
+	defer cancel()
+
+	fieldsKey := ss.keys(deviceID, "")[2]
+	fields, err := ss.redis.SMembers(ctx, fieldsKey).Result()
+	if err != nil {
+		log.Printf("Failed to reset shared stats for %s: %v", deviceID, err)
+		return
+	}
+	keys := []string{fieldsKey}
+	for _, field := range fields {
+		keys = append(keys, ss.keys(deviceID, field)[:2]...)
+	}
+	if err := ss.redis.Del(ctx, keys...).Err(); err != nil {
+		log.Printf("Failed to reset shared stats for %s: %v", deviceID, err)
+	}
+}
+
+// State возвращает среднее, σ и число значений общего окна по всем полям устройства
+func (ss *SharedStats) State(deviceID string) map[string]interface{} {
+	ctx, cancel := context.WithTimeout(context.Background(), ss.cfg.Timeout)
+	defer cancel()
+
+	state := make(map[string]interface{})
+	fields, err := ss.redis.SMembers(ctx, ss.keys(deviceID, "")[2]).Result()
+	if err != nil {
+		return state
+	}
+	for _, field := range fields {
+		count, sum, sumsq, err := ss.read(ctx, deviceID, field)
+		if err != nil || count == 0 {
+			continue
+		}
+		mean := sum / float64(count)
+		state[field] = map[string]interface{}{
+			"mean":    mean,
+			"std_dev": math.Sqrt(math.Max(sumsq/float64(count)-mean*mean, 0)),
+			"samples": count,
+			"shared":  true,
+		}
+	}
+	return state
+}
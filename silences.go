@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	ErrSilenceNotFound = errors.New("silence not found")
+	ErrTooManySilences = errors.New("too many silences")
+)
+
+var silencedAnomalies = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "highload_silenced_anomalies_total",
+	Help: "Total number of anomalies recorded without alerts because of a matching silence",
+})
+
+// Silence окно обслуживания: аномалии устройств в интервале [Start, End]
+// сохраняются с пометкой silenced, но уведомления о них не отправляются
+type Silence struct {
+	ID string `json:"id"`
+	// Devices устройства окна; DevicePattern — шаблон группы устройств (path.Match)
+	Devices       []string `json:"devices,omitempty"`
+	DevicePattern string   `json:"device_pattern,omitempty"`
+	// Start и End — unix-время; Start 0 при создании означает «сейчас»
+	Start     int64  `json:"start"`
+	End       int64  `json:"end"`
+	Comment   string `json:"comment,omitempty"`
+	CreatedBy string `json:"created_by,omitempty"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// Validate проверяет устройства и интервал окна
+func (s Silence) Validate() error {
+	if len(s.Devices) == 0 && s.DevicePattern == "" {
+		return fmt.Errorf("devices or device_pattern is required")
+	}
+	if s.DevicePattern != "" {
+		if _, err := path.Match(s.DevicePattern, ""); err != nil {
+			return fmt.Errorf("device_pattern: %v", err)
+		}
+	}
+	if s.Start < 0 {
+		return fmt.Errorf("start must be a unix timestamp")
+	}
+	if s.End <= s.Start {
+		return fmt.Errorf("end must be after start")
+	}
+	return nil
+}
+
+// covers сообщает, попадает ли аномалия устройства в окно
+func (s Silence) covers(deviceID string, timestamp int64) bool {
+	if timestamp < s.Start || timestamp > s.End {
+		return false
+	}
+	if containsString(s.Devices, deviceID) {
+		return true
+	}
+	matched, _ := path.Match(s.DevicePattern, deviceID)
+	return s.DevicePattern != "" && matched
+}
+
+// SilenceStore хранит окна обслуживания в Redis (общие для всех экземпляров)
+// и периодически перечитывает их. Окна, закончившиеся раньше retention,
+// удаляются из Redis при перечитывании.
+type SilenceStore struct {
+	redis redis.UniversalClient
+
+	mu       sync.RWMutex
+	cfg      SilencesConfig
+	silences map[string]Silence
+}
+
+func NewSilenceStore(rdb redis.UniversalClient, cfg SilencesConfig) *SilenceStore {
+	return &SilenceStore{redis: rdb, cfg: cfg, silences: make(map[string]Silence)}
+}
+
+// Configure применяет новые параметры со следующего перечитывания
+func (ss *SilenceStore) Configure(cfg SilencesConfig) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.cfg = cfg
+}
+
+func (ss *SilenceStore) config() SilencesConfig {
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+	return ss.cfg
+}
+
+// Run перечитывает окна из Redis каждые silences.interval
+func (ss *SilenceStore) Run(ctx context.Context) {
+	for {
+		cfg := ss.config()
+		if err := ss.refresh(ctx); err != nil {
+			log.Printf("Failed to load silences, keeping %d known: %v", len(ss.List(false)), err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(cfg.Interval):
+		}
+	}
+}
+
+// refresh загружает окна из Redis и удаляет устаревшие
+func (ss *SilenceStore) refresh(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	cfg := ss.config()
+	raw, err := ss.redis.HGetAll(ctx, cfg.Key).Result()
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-cfg.Retention).Unix()
+	silences := make(map[string]Silence, len(raw))
+	var expired []string
+	for id, data := range raw {
+		var silence Silence
+		if err := json.Unmarshal([]byte(data), &silence); err != nil {
+			log.Printf("Skipping malformed silence %s: %v", id, err)
+			continue
+		}
+		if silence.End < cutoff {
+			expired = append(expired, id)
+			continue
+		}
+		silences[id] = silence
+	}
+	if len(expired) > 0 {
+		if err := ss.redis.HDel(ctx, cfg.Key, expired...).Err(); err != nil {
+			log.Printf("Failed to remove %d expired silences: %v", len(expired), err)
+		}
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.silences = silences
+	return nil
+}
+
+// Add сохраняет окно в Redis и применяет его на этом экземпляре
+func (ss *SilenceStore) Add(ctx context.Context, silence Silence) (Silence, error) {
+	if err := silence.Validate(); err != nil {
+		return silence, err
+	}
+
+	cfg := ss.config()
+	ss.mu.RLock()
+	total := len(ss.silences)
+	ss.mu.RUnlock()
+	if total >= cfg.MaxSilences {
+		return silence, ErrTooManySilences
+	}
+
+	silence.ID = newID()
+	silence.CreatedAt = time.Now().Unix()
+	data, err := json.Marshal(silence)
+	if err != nil {
+		return silence, err
+	}
+	if err := ss.redis.HSet(ctx, cfg.Key, silence.ID, data).Err(); err != nil {
+		return silence, err
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.silences[silence.ID] = silence
+	return silence, nil
+}
+
+// Delete удаляет окно из Redis и с этого экземпляра
+func (ss *SilenceStore) Delete(ctx context.Context, id string) error {
+	removed, err := ss.redis.HDel(ctx, ss.config().Key, id).Result()
+	if err != nil {
+		return err
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if _, exists := ss.silences[id]; !exists && removed == 0 {
+		return ErrSilenceNotFound
+	}
+	delete(ss.silences, id)
+	return nil
+}
+
+// List возвращает окна по времени начала; active оставляет только
+// действующие сейчас и запланированные
+func (ss *SilenceStore) List(active bool) []Silence {
+	now := time.Now().Unix()
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+	silences := make([]Silence, 0, len(ss.silences))
+	for _, silence := range ss.silences {
+		if active && silence.End < now {
+			continue
+		}
+		silences = append(silences, silence)
+	}
+	sort.Slice(silences, func(i, j int) bool {
+		if silences[i].Start != silences[j].Start {
+			return silences[i].Start < silences[j].Start
+		}
+		return silences[i].ID < silences[j].ID
+	})
+	return silences
+}
+
+// Matching возвращает идентификаторы окон, в которые попадает аномалия устройства
+func (ss *SilenceStore) Matching(deviceID string, timestamp int64) []string {
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+	var matched []string
+	for id, silence := range ss.silences {
+		if silence.covers(deviceID, timestamp) {
+			matched = append(matched, id)
+		}
+	}
+	sort.Strings(matched)
+	return matched
+}
+
+// SilencesHandler возвращает окна обслуживания; active=true оставляет
+// действующие и запланированные
+func (s *Service) SilencesHandler(w http.ResponseWriter, r *http.Request) {
+	silences := s.silences.List(r.URL.Query().Get("active") == "true")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"count":    len(silences),
+		"silences": silences,
+	})
+}
+
+// CreateSilenceHandler планирует окно обслуживания:
+// {"devices": [...], "device_pattern": "pump-*", "start": 1700000000, "end": 1700003600, "comment": "firmware 2.3.1"}
+func (s *Service) CreateSilenceHandler(w http.ResponseWriter, r *http.Request) {
+	var silence Silence
+	if err := json.NewDecoder(r.Body).Decode(&silence); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if silence.Start == 0 {
+		silence.Start = time.Now().Unix()
+	}
+	if err := silence.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	silence, err := s.silences.Add(r.Context(), silence)
+	switch {
+	case errors.Is(err, ErrTooManySilences):
+		http.Error(w, fmt.Sprintf("%v, max %d", err, s.silences.config().MaxSilences), http.StatusConflict)
+		return
+	case err != nil:
+		log.Printf("Failed to save silence: %v", err)
+		http.Error(w, "silence storage unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	log.Printf("Silence %s scheduled from %d to %d: %s", silence.ID, silence.Start, silence.End, silence.Comment)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(silence)
+}
+
+// DeleteSilenceHandler удаляет окно обслуживания, в том числе досрочно
+func (s *Service) DeleteSilenceHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	err := s.silences.Delete(r.Context(), id)
+	if errors.Is(err, ErrSilenceNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to delete silence %s: %v", id, err)
+		http.Error(w, "silence storage unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	log.Printf("Silence %s deleted", id)
+	w.WriteHeader(http.StatusNoContent)
+}
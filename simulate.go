@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// maxSimulatedPoints число сработавших значений поля в ответе /api/analyze/simulate
+const maxSimulatedPoints = 100
+
+// SimulatedPoint значение, на котором сработал бы детектор
+type SimulatedPoint struct {
+	Timestamp int64   `json:"timestamp"`
+	Value     float64 `json:"value"`
+	ZScore    float64 `json:"z_score"`
+}
+
+// FieldSimulation результат прогона поля с пробными и текущими параметрами
+type FieldSimulation struct {
+	Field   string `json:"field"`
+	Samples int    `json:"samples"`
+	// Anomalies срабатывания с пробными параметрами, CurrentAnomalies — с текущими
+	Anomalies        int              `json:"anomalies"`
+	CurrentAnomalies int              `json:"current_anomalies"`
+	Fired            []SimulatedPoint `json:"fired"`
+	// Truncated в fired попали только последние срабатывания
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// replayZScore прогоняет значения через z-score так же, как при приеме:
+// значение сравнивается со статистикой последних window значений, включая
+// его самого
+func replayZScore(points []Point, threshold float64, window int, visit func(p Point, zScore float64)) int {
+	fired := 0
+	for i, p := range points {
+		values := points[max(0, i+1-window) : i+1]
+		if len(values) < 2 {
+			continue
+		}
+		var sum float64
+		for _, v := range values {
+			sum += v.Value
+		}
+		mean := sum / float64(len(values))
+		var variance float64
+		for _, v := range values {
+			variance += (v.Value - mean) * (v.Value - mean)
+		}
+		stdDev := math.Sqrt(variance / float64(len(values)))
+		if stdDev == 0 {
+			continue
+		}
+		zScore := (p.Value - mean) / stdDev
+		if math.Abs(zScore) > threshold {
+			fired++
+			if visit != nil {
+				visit(p, zScore)
+			}
+		}
+	}
+	return fired
+}
+
+// SimulateHandler показывает, сколько аномалий z-score сработало бы на
+// сохраненных в буфере значениях устройства с пробными порогом и окном:
+// GET /api/analyze/simulate?device_id=&field=&threshold=&window=. Для
+// сравнения те же значения прогоняются с текущими параметрами, так что
+// порог можно подобрать без перезапуска и ожидания новых данных.
+func (s *Service) SimulateHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	deviceID := query.Get("device_id")
+	if deviceID == "" {
+		http.Error(w, "device_id is required", http.StatusBadRequest)
+		return
+	}
+
+	s.configMu.RLock()
+	current := s.config.Detectors.ZScore
+	currentThreshold := current.Threshold
+	currentWindow := s.config.Buffer.Window
+	maxSize := s.config.Buffer.MaxSize
+	s.configMu.RUnlock()
+
+	threshold := currentThreshold
+	if raw := query.Get("threshold"); raw != "" {
+		parsed, err := strconv.ParseFloat(raw, 64)
+		if err != nil || !(parsed > 0) || math.IsInf(parsed, 0) {
+			http.Error(w, "threshold must be a positive number", http.StatusBadRequest)
+			return
+		}
+		threshold = parsed
+	}
+	window := currentWindow
+	if raw := query.Get("window"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed < 2 || parsed > maxSize {
+			http.Error(w, "window must be between 2 and buffer.max_size", http.StatusBadRequest)
+			return
+		}
+		window = parsed
+	}
+
+	snapshot := s.metricsBuffer.DeviceSnapshot(deviceID)
+	if len(snapshot) == 0 {
+		http.Error(w, "device not found", http.StatusNotFound)
+		return
+	}
+	field := query.Get("field")
+	if _, ok := snapshot[field]; field != "" && !ok {
+		http.Error(w, "field not found", http.StatusNotFound)
+		return
+	}
+
+	// Текущие срабатывания считаются только там, где детектор работает сейчас,
+	// и с порогом, подстроенным по оценкам устройства
+	covered := newFieldSet(current.Fields...)
+	factor := s.feedback.Factor(AnomalyTypeZScore, deviceID)
+	fields := make([]FieldSimulation, 0, len(snapshot))
+	var total, currentTotal int
+	for name, points := range snapshot {
+		if field != "" && name != field {
+			continue
+		}
+		sim := FieldSimulation{Field: name, Samples: len(points), Fired: make([]SimulatedPoint, 0)}
+		sim.Anomalies = replayZScore(points, threshold, window, func(p Point, zScore float64) {
+			sim.Fired = append(sim.Fired, SimulatedPoint{Timestamp: p.Timestamp, Value: p.Value, ZScore: zScore})
+		})
+		if current.Enabled && covered.Applies(name) {
+			sim.CurrentAnomalies = replayZScore(points, currentThreshold*factor, currentWindow, nil)
+		}
+		if len(sim.Fired) > maxSimulatedPoints {
+			sim.Fired, sim.Truncated = sim.Fired[len(sim.Fired)-maxSimulatedPoints:], true
+		}
+		total += sim.Anomalies
+		currentTotal += sim.CurrentAnomalies
+		fields = append(fields, sim)
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i].Field < fields[j].Field })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"device_id": deviceID,
+		"detector":  AnomalyTypeZScore,
+		"threshold": threshold,
+		"window":    window,
+		"current": map[string]interface{}{
+			"threshold":        currentThreshold,
+			"threshold_factor": factor,
+			"window":           currentWindow,
+			"anomalies":        currentTotal,
+		},
+		"anomalies": total,
+		"fields":    fields,
+	})
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// slaBuckets число интервалов, на которые делится окно SLA
+const slaBuckets = 60
+
+// Состояния соответствия SLA
+const (
+	SLAStatusMet      = "met"
+	SLAStatusBreached = "breached"
+	SLAStatusNoData   = "no_data"
+)
+
+var slaSamples = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "highload_sla_samples_total",
+		Help: "Total number of values checked against device SLAs by SLA and result (within, outside)",
+	},
+	[]string{"sla", "result"},
+)
+
+// matches сообщает, распространяется ли SLA на устройство
+func (c SLAConfig) matches(deviceID string) bool {
+	if containsString(c.Devices, deviceID) {
+		return true
+	}
+	if c.DevicePattern != "" {
+		ok, _ := path.Match(c.DevicePattern, deviceID)
+		return ok
+	}
+	return false
+}
+
+// within сообщает, попадает ли значение в ожидаемый диапазон
+func (c SLAConfig) within(value float64) bool {
+	return (c.Min == nil || value >= *c.Min) && (c.Max == nil || value <= *c.Max)
+}
+
+// slaBucket число значений и значений в диапазоне за один интервал окна
+type slaBucket struct {
+	start  int64
+	total  int
+	within int
+}
+
+// slaSeries кольцо интервалов окна SLA одного устройства
+type slaSeries struct {
+	buckets [slaBuckets]slaBucket
+}
+
+func (ss *slaSeries) add(timestamp, width int64, within bool) {
+	start := timestamp - timestamp%width
+	b := &ss.buckets[(start/width)%slaBuckets]
+	if b.start != start {
+		if b.start > start {
+			// Значение старше окна
+			return
+		}
+		*b = slaBucket{start: start}
+	}
+	b.total++
+	if within {
+		b.within++
+	}
+}
+
+func (ss *slaSeries) totals(since int64) (int, int) {
+	var total, within int
+	for _, b := range ss.buckets {
+		if b.total > 0 && b.start >= since {
+			total += b.total
+			within += b.within
+		}
+	}
+	return total, within
+}
+
+// slaContract SLA и накопленные ряды устройств
+type slaContract struct {
+	cfg    SLAConfig
+	series map[string]*slaSeries // device_id -> ряд
+}
+
+// bucketWidth ширина интервала в секундах
+func (c *slaContract) bucketWidth() int64 {
+	return max(int64(c.cfg.Window/time.Second)/slaBuckets, 1)
+}
+
+// SLAReport соответствие устройства одному SLA за окно
+type SLAReport struct {
+	SLA        string   `json:"sla"`
+	DeviceID   string   `json:"device_id"`
+	Field      string   `json:"field"`
+	Min        *float64 `json:"min,omitempty"`
+	Max        *float64 `json:"max,omitempty"`
+	Target     float64  `json:"target"`
+	Window     string   `json:"window"`
+	Samples    int      `json:"samples"`
+	Within     int      `json:"within"`
+	Compliance float64  `json:"compliance"`
+	Status     string   `json:"status"`
+}
+
+// SLATracker непрерывно считает долю значений в ожидаемом диапазоне для
+// устройств с SLA. В отличие от детекторов проверяет заданный договором
+// диапазон, а не отклонение от собственной истории устройства.
+type SLATracker struct {
+	mu        sync.RWMutex
+	contracts []*slaContract
+}
+
+func NewSLATracker(configs []SLAConfig) *SLATracker {
+	st := &SLATracker{}
+	st.Configure(configs)
+	return st
+}
+
+// Configure применяет новый набор SLA; ряды SLA с неизменными параметрами сохраняются
+func (st *SLATracker) Configure(configs []SLAConfig) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	previous := make(map[string]*slaContract, len(st.contracts))
+	for _, c := range st.contracts {
+		previous[c.cfg.Name] = c
+	}
+	st.contracts = make([]*slaContract, 0, len(configs))
+	for _, cfg := range configs {
+		if c, ok := previous[cfg.Name]; ok && reflect.DeepEqual(c.cfg, cfg) {
+			st.contracts = append(st.contracts, c)
+			continue
+		}
+		st.contracts = append(st.contracts, &slaContract{cfg: cfg, series: make(map[string]*slaSeries)})
+	}
+}
+
+// Observe учитывает значения метрики во всех SLA устройства
+func (st *SLATracker) Observe(deviceID string, timestamp int64, fields map[string]float64) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	for _, c := range st.contracts {
+		value, ok := fields[c.cfg.Field]
+		if !ok || !c.cfg.matches(deviceID) {
+			continue
+		}
+		series, exists := c.series[deviceID]
+		if !exists {
+			series = &slaSeries{}
+			c.series[deviceID] = series
+		}
+		within := c.cfg.within(value)
+		series.add(timestamp, c.bucketWidth(), within)
+		if within {
+			slaSamples.WithLabelValues(c.cfg.Name, "within").Inc()
+		} else {
+			slaSamples.WithLabelValues(c.cfg.Name, "outside").Inc()
+		}
+	}
+}
+
+// Reports возвращает отчеты по SLA; пустой deviceID — по всем устройствам
+func (st *SLATracker) Reports(deviceID string) []SLAReport {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	now := time.Now().Unix()
+	reports := make([]SLAReport, 0)
+	for _, c := range st.contracts {
+		since := now - int64(c.cfg.Window/time.Second)
+		report := func(id string, series *slaSeries) {
+			r := SLAReport{
+				SLA:      c.cfg.Name,
+				DeviceID: id,
+				Field:    c.cfg.Field,
+				Min:      c.cfg.Min,
+				Max:      c.cfg.Max,
+				Target:   c.cfg.Target,
+				Window:   c.cfg.Window.String(),
+				Status:   SLAStatusNoData,
+			}
+			if series != nil {
+				r.Samples, r.Within = series.totals(since)
+			}
+			if r.Samples > 0 {
+				r.Compliance = float64(r.Within) / float64(r.Samples)
+				r.Status = SLAStatusMet
+				if r.Compliance < c.cfg.Target {
+					r.Status = SLAStatusBreached
+				}
+			}
+			reports = append(reports, r)
+		}
+
+		if deviceID != "" {
+			if c.cfg.matches(deviceID) {
+				report(deviceID, c.series[deviceID])
+			}
+			continue
+		}
+		ids := make([]string, 0, len(c.series))
+		for id := range c.series {
+			ids = append(ids, id)
+		}
+		// Устройства из явного списка попадают в отчет и без данных
+		for _, id := range c.cfg.Devices {
+			if c.series[id] == nil {
+				ids = append(ids, id)
+			}
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			report(id, c.series[id])
+		}
+	}
+	return reports
+}
+
+// Forget удаляет ряды устройства
+func (st *SLATracker) Forget(deviceID string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for _, c := range st.contracts {
+		delete(c.series, deviceID)
+	}
+}
+
+// SLAReportHandler возвращает соответствие SLA всех устройств; status
+// ограничивает выборку (met, breached, no_data)
+func (s *Service) SLAReportHandler(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "", SLAStatusMet, SLAStatusBreached, SLAStatusNoData:
+	default:
+		http.Error(w, "status must be met, breached or no_data", http.StatusBadRequest)
+		return
+	}
+
+	reports := make([]SLAReport, 0)
+	for _, report := range s.slas.Reports("") {
+		if status == "" || report.Status == status {
+			reports = append(reports, report)
+		}
+	}
+	writeSLAReports(w, reports)
+}
+
+// DeviceSLAHandler возвращает соответствие устройства его SLA
+func (s *Service) DeviceSLAHandler(w http.ResponseWriter, r *http.Request) {
+	reports := s.slas.Reports(mux.Vars(r)["device_id"])
+	if len(reports) == 0 {
+		http.Error(w, "no SLA applies to device", http.StatusNotFound)
+		return
+	}
+	writeSLAReports(w, reports)
+}
+
+func writeSLAReports(w http.ResponseWriter, reports []SLAReport) {
+	breached := 0
+	for _, report := range reports {
+		if report.Status == SLAStatusBreached {
+			breached++
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"count":    len(reports),
+		"breached": breached,
+		"reports":  reports,
+	})
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// sliBuckets число интервалов скользящего окна SLI
+const sliBuckets = 30
+
+var (
+	responsesByClass = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "highload_responses_total",
+			Help: "Total number of responses by endpoint and status class (2xx/3xx/4xx/5xx)",
+		},
+		[]string{"endpoint", "class"},
+	)
+
+	errorRate = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "highload_error_rate",
+			Help: "Share of responses with the given error class over the SLI window",
+		},
+		[]string{"endpoint", "class"},
+	)
+)
+
+// recordResponse учитывает ответ маршрута в счетчиках классов и в расчете SLI
+func recordResponse(sli *SLITracker, endpoint string, status int) {
+	responsesByClass.WithLabelValues(endpoint, statusClass(status)).Inc()
+	sli.Record(endpoint, status)
+}
+
+// sliCounts счетчики ответов за один интервал окна
+type sliCounts struct {
+	total, clientErrors, serverErrors int
+}
+
+// SLITracker считает долю ошибочных ответов по ключу (маршруту, версии клиента)
+// в скользящем окне и публикует ее в gauge с метками (ключ, класс)
+type SLITracker struct {
+	mu        sync.Mutex
+	interval  time.Duration
+	endpoints map[string]*[sliBuckets]sliCounts
+	current   int64 // номер текущего интервала с начала эпохи
+	gauge     *prometheus.GaugeVec
+}
+
+func NewSLITracker(window time.Duration, gauge *prometheus.GaugeVec) *SLITracker {
+	interval := window / sliBuckets
+	if interval < time.Second {
+		interval = time.Second
+	}
+	return &SLITracker{
+		interval:  interval,
+		endpoints: make(map[string]*[sliBuckets]sliCounts),
+		gauge:     gauge,
+	}
+}
+
+// statusClass возвращает класс кода ответа вида 2xx
+func statusClass(status int) string {
+	return string(rune('0'+status/100)) + "xx"
+}
+
+// Record учитывает ответ с указанным кодом
+func (t *SLITracker) Record(endpoint string, status int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.advance(time.Now())
+	buckets, exists := t.endpoints[endpoint]
+	if !exists {
+		buckets = &[sliBuckets]sliCounts{}
+		t.endpoints[endpoint] = buckets
+	}
+	bucket := &buckets[t.current%sliBuckets]
+	bucket.total++
+	switch {
+	case status >= 500:
+		bucket.serverErrors++
+	case status >= 400:
+		bucket.clientErrors++
+	}
+}
+
+// advance обнуляет интервалы, вышедшие из окна; вызывается под блокировкой
+func (t *SLITracker) advance(now time.Time) {
+	slot := now.UnixNano() / int64(t.interval)
+	if slot == t.current {
+		return
+	}
+	steps := slot - t.current
+	if steps > sliBuckets {
+		steps = sliBuckets
+	}
+	for i := int64(1); i <= steps; i++ {
+		idx := (t.current + i) % sliBuckets
+		for _, buckets := range t.endpoints {
+			buckets[idx] = sliCounts{}
+		}
+	}
+	t.current = slot
+}
+
+// Update пересчитывает gauge доли ошибок для всех маршрутов
+func (t *SLITracker) Update() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.advance(time.Now())
+	for endpoint, buckets := range t.endpoints {
+		var sum sliCounts
+		for _, bucket := range buckets {
+			sum.total += bucket.total
+			sum.clientErrors += bucket.clientErrors
+			sum.serverErrors += bucket.serverErrors
+		}
+
+		var clientRate, serverRate float64
+		if sum.total > 0 {
+			clientRate = float64(sum.clientErrors) / float64(sum.total)
+			serverRate = float64(sum.serverErrors) / float64(sum.total)
+		}
+		t.gauge.WithLabelValues(endpoint, "4xx").Set(clientRate)
+		t.gauge.WithLabelValues(endpoint, "5xx").Set(serverRate)
+	}
+}
+
+// Run периодически обновляет gauge, чтобы доля ошибок снижалась и без нового трафика
+func (t *SLITracker) Run() {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		t.Update()
+	}
+}
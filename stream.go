@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// streamPayloadField имя поля записи потока с JSON метрики
+const streamPayloadField = "metric"
+
+var streamMessages = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "highload_stream_messages_total",
+		Help: "Total number of ingestion stream messages by result (published, fallback, processed, invalid, claimed, warmed)",
+	},
+	[]string{"result"},
+)
+
+// IngestQueue развязывает прием метрик и их анализ через Redis Stream.
+// Обработчики только добавляют запись в поток (XADD), а воркеры группы
+// потребителей выполняют буферизацию и анализ. Неподтвержденные записи
+// переживают перезапуск и забираются другими репликами через XCLAIM.
+type IngestQueue struct {
+	service  *Service
+	redis    redis.UniversalClient
+	cfg      StreamConfig
+	consumer string
+}
+
+func NewIngestQueue(service *Service, rdb redis.UniversalClient, cfg StreamConfig) *IngestQueue {
+	consumer := cfg.Consumer
+	if consumer == "" {
+		consumer, _ = os.Hostname()
+		if consumer == "" {
+			consumer = "analyzer-" + strconv.Itoa(os.Getpid())
+		}
+	}
+	return &IngestQueue{service: service, redis: rdb, cfg: cfg, consumer: consumer}
+}
+
+// submit ставит метрику в очередь. Если поток выключен или Redis недоступен,
+// метрика обрабатывается сразу, чтобы прием не останавливался.
+func (s *Service) submit(ctx context.Context, source string, metric Metric, fields map[string]float64) {
+	if metric.Timestamp == 0 {
+		metric.Timestamp = time.Now().Unix()
+	}
+	if source != SourceTypeHTTP {
+		// Номера приема выдаются только метрикам, принятым через HTTP
+		metric.IngestID = ""
+	}
+	s.ingestStatus.Record(metric.IngestID, "device_id", metric.DeviceID, "received_at", time.Now().UnixMilli())
+	if len(metric.Samples) > 0 {
+		// Процессоры применяются к каждому значению; отброшенные дальше не идут
+		kept := metric.Samples[:0]
+		for _, sample := range metric.Samples {
+			if s.pipeline.Process(source, sample.Values) {
+				kept = append(kept, sample)
+			}
+		}
+		if len(kept) == 0 {
+			s.ingestStatus.Record(metric.IngestID, "dropped", 1)
+			return
+		}
+		metric.Samples = kept
+	} else if !s.pipeline.Process(source, fields) {
+		s.ingestStatus.Record(metric.IngestID, "dropped", 1)
+		return
+	} else {
+		metric.Values = fields
+	}
+	if id := traceID(ctx); id != "" {
+		metric.TraceID = id
+	}
+
+	metric.ReceivedAt = time.Now().UnixMilli()
+
+	if !s.queue.cfg.Enabled {
+		s.ingest(metric, fields)
+		s.recordDeadline(metric)
+		return
+	}
+	if err := s.queue.Publish(ctx, metric); err != nil {
+		streamMessages.WithLabelValues("fallback").Inc()
+		s.ingest(metric, fields)
+		s.recordDeadline(metric)
+		return
+	}
+	streamMessages.WithLabelValues("published").Inc()
+	s.ingestStatus.Record(metric.IngestID, "queued", 1)
+}
+
+// Publish добавляет метрику в поток
+func (q *IngestQueue) Publish(ctx context.Context, metric Metric) error {
+	payload, err := json.Marshal(metric)
+	if err != nil {
+		return err
+	}
+	return q.redis.XAdd(ctx, &redis.XAddArgs{
+		Stream: q.cfg.Key,
+		Values: map[string]interface{}{streamPayloadField: payload},
+	}).Err()
+}
+
+// Run создает группу потребителей и обрабатывает поток до отмены контекста.
+// В режиме пары active/standby группу читает только активный экземпляр,
+// а резервный следит за хвостом потока и прогревает буфер и детекторы.
+func (q *IngestQueue) Run(ctx context.Context) {
+	if !q.ensureGroup(ctx) {
+		return
+	}
+
+	ha := q.service.ha
+	lastID := "$"
+	for ctx.Err() == nil {
+		if ha.Active() {
+			q.consume(ha.ActiveContext(ctx))
+			lastID = "$"
+			continue
+		}
+		lastID = q.warm(ctx, lastID)
+	}
+}
+
+func (q *IngestQueue) ensureGroup(ctx context.Context) bool {
+	for {
+		err := q.redis.XGroupCreateMkStream(ctx, q.cfg.Key, q.cfg.Group, "0").Err()
+		if err == nil || strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return true
+		}
+		log.Printf("Failed to create stream consumer group %s: %v", q.cfg.Group, err)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// consume читает группу потребителей до отмены контекста.
+// Записи распределяются по воркерам по device_id, чтобы сохранить порядок
+// значений одного устройства. У каждого воркера своя очередь на класс срока:
+// воркер берет realtime раньше standard, а standard раньше bulk, и в
+// прочитанной пачке записи также отправляются по приоритету.
+func (q *IngestQueue) consume(ctx context.Context) {
+	log.Printf("Consuming stream %s as %s/%s with %d workers", q.cfg.Key, q.cfg.Group, q.consumer, q.cfg.Workers)
+
+	shards := make([][]chan redis.XMessage, q.cfg.Workers)
+	var wg sync.WaitGroup
+	for i := range shards {
+		shards[i] = make([]chan redis.XMessage, len(deadlineClasses))
+		for class := range shards[i] {
+			shards[i][class] = make(chan redis.XMessage, q.cfg.BatchSize)
+		}
+		wg.Add(1)
+		go func(queues []chan redis.XMessage) {
+			defer wg.Done()
+			for {
+				msg, ok := nextByDeadline(queues)
+				if !ok {
+					return
+				}
+				q.process(msg)
+			}
+		}(append([]chan redis.XMessage(nil), shards[i]...))
+	}
+	dispatch := func(messages []redis.XMessage) {
+		for _, msg := range byDeadline(messages) {
+			route := streamRouting(msg)
+			shards[q.shard(route.DeviceID, len(shards))][deadlinePriority(route.DeadlineClass)] <- msg
+		}
+	}
+
+	// Сначала дочитываем записи, полученные до перезапуска, но не подтвержденные
+	q.read(ctx, "0", dispatch)
+	claimed := make(chan struct{})
+	go func() {
+		defer close(claimed)
+		q.claimStale(ctx, dispatch)
+	}()
+	q.read(ctx, ">", dispatch)
+
+	<-claimed
+	for _, queues := range shards {
+		for _, queue := range queues {
+			close(queue)
+		}
+	}
+	wg.Wait()
+}
+
+// warm читает новые записи потока без группы, пока экземпляр резервный.
+// Значения попадают в буфер и детекторы, но алерты и архив не формируются.
+func (q *IngestQueue) warm(ctx context.Context, lastID string) string {
+	for ctx.Err() == nil && !q.service.ha.Active() {
+		streams, err := q.redis.XRead(ctx, &redis.XReadArgs{
+			Streams: []string{q.cfg.Key, lastID},
+			Count:   int64(q.cfg.BatchSize),
+			Block:   q.cfg.Block,
+		}).Result()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Failed to tail stream %s: %v", q.cfg.Key, err)
+				time.Sleep(time.Second)
+			}
+			continue
+		}
+
+		for _, stream := range streams {
+			for _, msg := range stream.Messages {
+				if metric, ok := decodeStreamMessage(msg); ok && q.ingest(metric) {
+					streamMessages.WithLabelValues("warmed").Inc()
+				}
+				lastID = msg.ID
+			}
+		}
+	}
+	return lastID
+}
+
+// read читает записи группы начиная с start. Для "0" чтение заканчивается,
+// когда очередь неподтвержденных записей потребителя пуста.
+func (q *IngestQueue) read(ctx context.Context, start string, dispatch func([]redis.XMessage)) {
+	for ctx.Err() == nil {
+		streams, err := q.redis.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    q.cfg.Group,
+			Consumer: q.consumer,
+			Streams:  []string{q.cfg.Key, start},
+			Count:    int64(q.cfg.BatchSize),
+			Block:    q.cfg.Block,
+		}).Result()
+		if errors.Is(err, redis.Nil) {
+			if start != ">" {
+				return
+			}
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Failed to read stream %s: %v", q.cfg.Key, err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		for _, stream := range streams {
+			if start != ">" && len(stream.Messages) == 0 {
+				return
+			}
+			dispatch(stream.Messages)
+			if start != ">" {
+				start = stream.Messages[len(stream.Messages)-1].ID
+			}
+		}
+	}
+}
+
+// claimStale забирает записи, зависшие у остановившихся потребителей
+func (q *IngestQueue) claimStale(ctx context.Context, dispatch func([]redis.XMessage)) {
+	ticker := time.NewTicker(q.cfg.ClaimIdle)
+	defer ticker.Stop()
+
+	// Первый проход сразу: после переключения на резервный экземпляр записи
+	// упавшего активного не должны ждать целый интервал
+	for {
+		q.claimPass(ctx, dispatch)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// claimPass забирает записи группы, простаивающие дольше claim_idle.
+// XAUTOCLAIM не используется: клиент go-redis v8 не разбирает ответ Redis 7.
+// Вместо него список ожидающих записей просматривается страницами с последней
+// увиденной: начало списка может принадлежать живым потребителям, и зависшие
+// записи за ним иначе не забирались бы никогда.
+func (q *IngestQueue) claimPass(ctx context.Context, dispatch func([]redis.XMessage)) {
+	start := "-"
+	for {
+		pending, err := q.redis.XPendingExt(ctx, &redis.XPendingExtArgs{
+			Stream: q.cfg.Key,
+			Group:  q.cfg.Group,
+			Idle:   q.cfg.ClaimIdle,
+			Start:  start,
+			End:    "+",
+			Count:  int64(q.cfg.BatchSize),
+		}).Result()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Failed to list pending stream entries: %v", err)
+			}
+			return
+		}
+
+		ids := make([]string, 0, len(pending))
+		for _, entry := range pending {
+			if entry.Consumer != q.consumer {
+				ids = append(ids, entry.ID)
+			}
+		}
+		if len(ids) > 0 && !q.claim(ctx, ids, dispatch) {
+			return
+		}
+		if len(pending) < q.cfg.BatchSize {
+			return
+		}
+		// Следующая страница начинается после последней записи (Redis 6.2+)
+		start = "(" + pending[len(pending)-1].ID
+	}
+}
+
+// claim забирает записи ids и передает их на обработку; false — ошибка Redis
+func (q *IngestQueue) claim(ctx context.Context, ids []string, dispatch func([]redis.XMessage)) bool {
+	messages, err := q.redis.XClaim(ctx, &redis.XClaimArgs{
+		Stream:   q.cfg.Key,
+		Group:    q.cfg.Group,
+		Consumer: q.consumer,
+		MinIdle:  q.cfg.ClaimIdle,
+		Messages: ids,
+	}).Result()
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("Failed to claim stale stream entries: %v", err)
+		}
+		return false
+	}
+	streamMessages.WithLabelValues("claimed").Add(float64(len(messages)))
+	dispatch(messages)
+	return true
+}
+
+// streamRoute поля записи, по которым она распределяется между воркерами
+type streamRoute struct {
+	DeviceID      string `json:"device_id"`
+	DeadlineClass string `json:"deadline_class"`
+}
+
+func streamRouting(msg redis.XMessage) streamRoute {
+	var route streamRoute
+	payload, _ := msg.Values[streamPayloadField].(string)
+	json.Unmarshal([]byte(payload), &route)
+	return route
+}
+
+func (q *IngestQueue) shard(deviceID string, shards int) int {
+	h := fnv.New32a()
+	h.Write([]byte(deviceID))
+	return int(h.Sum32() % uint32(shards))
+}
+
+// process выполняет буферизацию и анализ записи и подтверждает ее.
+// Записи, которые невозможно разобрать, подтверждаются, чтобы не блокировать поток.
+func (q *IngestQueue) process(msg redis.XMessage) {
+	if metric, ok := decodeStreamMessage(msg); !ok {
+		streamMessages.WithLabelValues("invalid").Inc()
+	} else if q.ingest(metric) {
+		streamMessages.WithLabelValues("processed").Inc()
+		q.service.recordDeadline(metric)
+	} else {
+		// Запись, вызвавшая панику, подтверждается, чтобы не обрабатывать ее повторно
+		streamMessages.WithLabelValues("invalid").Inc()
+	}
+	recordConsumed(q.groupReaderName(), 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := q.redis.XAck(ctx, q.cfg.Key, q.cfg.Group, msg.ID).Err(); err != nil {
+		log.Printf("Failed to ack stream entry %s: %v", msg.ID, err)
+	}
+}
+
+// ingest обрабатывает метрику записи и возвращает false, если обработка завершилась паникой
+func (q *IngestQueue) ingest(metric Metric) bool {
+	return !runRecovered("stream", func() {
+		q.service.ingest(metric, metric.Fields())
+	})
+}
+
+func decodeStreamMessage(msg redis.XMessage) (Metric, bool) {
+	payload, _ := msg.Values[streamPayloadField].(string)
+
+	var metric Metric
+	if err := json.Unmarshal([]byte(payload), &metric); err != nil || metric.DeviceID == "" {
+		return Metric{}, false
+	}
+	return metric, true
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// streamTrimBatch ограничивает число записей, удаляемых по max_len за один проход
+const streamTrimBatch = 10000
+
+var (
+	streamLength = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "highload_stream_length",
+		Help: "Number of entries in the ingestion stream",
+	})
+
+	streamPending = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "highload_stream_pending_entries",
+		Help: "Number of ingestion stream entries delivered to the consumer group but not yet acknowledged",
+	})
+
+	streamLag = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "highload_stream_lag_seconds",
+			Help: "Age of the newest ingestion stream entry relative to the position of each reader (consumer group, rollups)",
+		},
+		[]string{"reader"},
+	)
+
+	streamTrimmed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "highload_stream_trimmed_entries_total",
+		Help: "Total number of ingestion stream entries removed by retention trimming",
+	})
+
+	streamTrimBlocked = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "highload_stream_trim_blocked_total",
+			Help: "Total number of trim passes where the retention policy (max_len, max_age) was held back because readers had not processed the entries",
+		},
+		[]string{"policy"},
+	)
+)
+
+// streamReader позиция читателя потока: первая запись, которая ему еще нужна
+type streamReader struct {
+	name string
+	next string
+}
+
+// RunTrimmer периодически обрезает поток по max_len и max_age. Записи, которые
+// еще не прочитала группа потребителей, не подтверждены или не учтены в
+// агрегатах интервалов, не удаляются: при отставании читателей поток растет
+// сверх политики, что видно по highload_stream_trim_blocked_total.
+// Обрезает только лидер среди реплик, если он активен в паре.
+func (q *IngestQueue) RunTrimmer(ctx context.Context) {
+	ticker := time.NewTicker(q.cfg.TrimInterval)
+	defer ticker.Stop()
+
+	for {
+		if q.service.runsJobs() {
+			if err := q.service.jobs.Run(ctx, JobRetention, q.trim); err != nil && ctx.Err() == nil {
+				log.Printf("Failed to trim stream %s: %v", q.cfg.Key, err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// trim выполняет один проход обрезки и обновляет метрики отставания
+func (q *IngestQueue) trim(ctx context.Context) error {
+	length, err := q.redis.XLen(ctx, q.cfg.Key).Result()
+	if err != nil {
+		return err
+	}
+	streamLength.Set(float64(length))
+	if length == 0 {
+		return nil
+	}
+
+	last, err := q.redis.XRevRangeN(ctx, q.cfg.Key, "+", "-", 1).Result()
+	if err != nil || len(last) == 0 {
+		return err
+	}
+	lastMs, _ := streamIDTime(last[0].ID)
+
+	readers, err := q.readers(ctx)
+	if err != nil {
+		return err
+	}
+	// safe первая запись, которая еще нужна хотя бы одному читателю
+	safe := nextStreamID(last[0].ID)
+	for _, reader := range readers {
+		if compareStreamIDs(reader.next, last[0].ID) > 0 {
+			streamLag.WithLabelValues(reader.name).Set(0)
+		} else {
+			readerMs, _ := streamIDTime(reader.next)
+			streamLag.WithLabelValues(reader.name).Set(float64(max(lastMs-readerMs, 0)) / 1000)
+		}
+		if compareStreamIDs(reader.next, safe) < 0 {
+			safe = reader.next
+		}
+	}
+
+	policy, target, err := q.trimTarget(ctx, length)
+	if err != nil || target == "" {
+		return err
+	}
+	if compareStreamIDs(target, safe) > 0 {
+		// Политика упирается в читателя, только если до target есть непрочитанные записи
+		unread, err := q.redis.XRangeN(ctx, q.cfg.Key, safe, "+", 1).Result()
+		if err != nil {
+			return err
+		}
+		if len(unread) > 0 && compareStreamIDs(unread[0].ID, target) < 0 {
+			streamTrimBlocked.WithLabelValues(policy).Inc()
+			log.Printf("Warning: stream %s exceeds its %s policy, but readers lag behind; keeping entries from %s", q.cfg.Key, policy, unread[0].ID)
+		}
+		target = safe
+	}
+
+	trimmed, err := q.redis.XTrimMinID(ctx, q.cfg.Key, target).Result()
+	if err != nil {
+		return err
+	}
+	streamTrimmed.Add(float64(trimmed))
+	streamLength.Set(float64(length - trimmed))
+	return nil
+}
+
+// readers возвращает позиции всех читателей потока. Группе нужны самая
+// старая неподтвержденная запись и все, что еще не выдано.
+func (q *IngestQueue) readers(ctx context.Context) ([]streamReader, error) {
+	delivered, exists, err := q.lastDelivered(ctx)
+	if err != nil {
+		return nil, err
+	}
+	group := streamReader{name: q.groupReaderName(), next: nextStreamID(delivered)}
+	if !exists {
+		// Группа еще не создана: ей понадобится весь поток
+		return []streamReader{group}, nil
+	}
+
+	pending, err := q.redis.XPending(ctx, q.cfg.Key, q.cfg.Group).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+	count := int64(0)
+	if pending != nil {
+		count = pending.Count
+	}
+	streamPending.Set(float64(count))
+	if count > 0 && compareStreamIDs(pending.Lower, group.next) < 0 {
+		group.next = pending.Lower
+	}
+	readers := []streamReader{group}
+
+	if rollups := q.service.rollups; rollups.cfg.Enabled && rollups.stream == q.cfg.Key {
+		checkpoint, err := loadCheckpoint(ctx, q.redis, rollupAggregatorName, rollups.cfg.CheckpointKey)
+		if err != nil {
+			return nil, err
+		}
+		readers = append(readers, streamReader{name: rollupAggregatorName, next: nextStreamID(checkpoint.StreamID)})
+	}
+	return readers, nil
+}
+
+// groupReaderName имя группы потребителей в метриках читателей потока
+func (q *IngestQueue) groupReaderName() string {
+	return "group:" + q.cfg.Group
+}
+
+// lastDelivered возвращает последнюю запись, выданную группе потребителей, и
+// признак существования группы. XINFO GROUPS читается как массив: клиент
+// go-redis v8 не разбирает ответ Redis 7.
+func (q *IngestQueue) lastDelivered(ctx context.Context) (string, bool, error) {
+	groups, err := q.redis.Do(ctx, "XINFO", "GROUPS", q.cfg.Key).Slice()
+	if err != nil {
+		return "", false, err
+	}
+	for _, raw := range groups {
+		fields, _ := raw.([]interface{})
+		info := make(map[string]interface{}, len(fields)/2)
+		for i := 0; i+1 < len(fields); i += 2 {
+			if key, ok := fields[i].(string); ok {
+				info[key] = fields[i+1]
+			}
+		}
+		if info["name"] == q.cfg.Group {
+			id, _ := info["last-delivered-id"].(string)
+			return id, true, nil
+		}
+	}
+	return "0-0", false, nil
+}
+
+// trimTarget возвращает политику и идентификатор первой записи, которую она
+// оставляет; пустой идентификатор — обрезать нечего
+func (q *IngestQueue) trimTarget(ctx context.Context, length int64) (string, string, error) {
+	var policy, target string
+	if q.cfg.MaxAge > 0 {
+		policy = "max_age"
+		target = fmt.Sprintf("%d-0", time.Now().Add(-q.cfg.MaxAge).UnixMilli())
+	}
+	if maxLen := int64(q.cfg.MaxLen); maxLen > 0 && length > maxLen {
+		// Первая запись, которая остается после удаления лишних; большой излишек
+		// удаляется за несколько проходов
+		excess := min(length-maxLen, streamTrimBatch)
+		entries, err := q.redis.XRangeN(ctx, q.cfg.Key, "-", "+", excess+1).Result()
+		if err != nil {
+			return "", "", err
+		}
+		if len(entries) > 0 {
+			if keep := entries[len(entries)-1].ID; target == "" || compareStreamIDs(keep, target) > 0 {
+				policy, target = "max_len", keep
+			}
+		}
+	}
+	return policy, target, nil
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// syntheticKey ключ Redis, которым проверяется приемник redis_cache
+const syntheticKey = "highload:synthetic:probe"
+
+var (
+	syntheticUp = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "highload_synthetic_check_up",
+			Help: "Whether the last synthetic check of a downstream integration succeeded (1) or failed (0)",
+		},
+		[]string{"target"},
+	)
+
+	syntheticDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "highload_synthetic_check_duration_seconds",
+			Help:    "Duration of synthetic checks of downstream integrations",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"target"},
+	)
+
+	syntheticFailures = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "highload_synthetic_check_failures_total",
+			Help: "Total number of failed synthetic checks of downstream integrations",
+		},
+		[]string{"target"},
+	)
+)
+
+// prober реализуют уведомители и приемники, которые умеют проверить доставку
+// без реальных данных
+type prober interface {
+	Probe(ctx context.Context) error
+}
+
+// SyntheticResult итог последних проверок одной интеграции
+type SyntheticResult struct {
+	Target              string `json:"target"`
+	Healthy             bool   `json:"healthy"`
+	LastCheck           int64  `json:"last_check"`
+	LastSuccess         int64  `json:"last_success,omitempty"`
+	ConsecutiveFailures int    `json:"consecutive_failures,omitempty"`
+	Error               string `json:"error,omitempty"`
+}
+
+// SyntheticMonitor периодически проверяет каждый настроенный уведомитель и
+// приемник конвейера тестовой доставкой, чтобы о сломанной интеграции стало
+// известно до инцидента, которому она понадобится
+type SyntheticMonitor struct {
+	service *Service
+
+	mu      sync.Mutex
+	cfg     SyntheticConfig
+	results map[string]*SyntheticResult
+}
+
+func NewSyntheticMonitor(service *Service, cfg SyntheticConfig) *SyntheticMonitor {
+	return &SyntheticMonitor{service: service, cfg: cfg, results: make(map[string]*SyntheticResult)}
+}
+
+// Configure применяет новые параметры; интервал учитывается со следующей проверки
+func (sm *SyntheticMonitor) Configure(cfg SyntheticConfig) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.cfg = cfg
+}
+
+func (sm *SyntheticMonitor) config() SyntheticConfig {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.cfg
+}
+
+// targets возвращает проверяемые интеграции: уведомители и приемники конвейера
+func (sm *SyntheticMonitor) targets() map[string]prober {
+	targets := make(map[string]prober)
+	for _, notifier := range sm.service.alerts.currentNotifiers() {
+		if p, ok := notifier.(prober); ok {
+			targets["notifier:"+notifier.Name()] = p
+		}
+	}
+	for _, sink := range sm.service.pipeline.Sinks() {
+		if p, ok := sink.(prober); ok {
+			targets["sink:"+sink.Name()] = p
+		}
+	}
+	return targets
+}
+
+// Run выполняет проверки с интервалом из конфигурации
+func (sm *SyntheticMonitor) Run() {
+	for {
+		cfg := sm.config()
+		if cfg.Enabled {
+			sm.CheckAll()
+		}
+		time.Sleep(cfg.Interval)
+	}
+}
+
+// CheckAll проверяет все интеграции и забывает те, что убраны из конфигурации
+func (sm *SyntheticMonitor) CheckAll() {
+	cfg := sm.config()
+	targets := sm.targets()
+
+	var wg sync.WaitGroup
+	for name, p := range targets {
+		wg.Add(1)
+		go func(name string, p prober) {
+			defer wg.Done()
+			sm.check(name, p, cfg)
+		}(name, p)
+	}
+	wg.Wait()
+
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	for name := range sm.results {
+		if _, ok := targets[name]; !ok {
+			delete(sm.results, name)
+			syntheticUp.DeleteLabelValues(name)
+		}
+	}
+}
+
+func (sm *SyntheticMonitor) check(name string, p prober, cfg SyntheticConfig) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := runProbe(ctx, p)
+	syntheticDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	result, ok := sm.results[name]
+	if !ok {
+		result = &SyntheticResult{Target: name, Healthy: true}
+		sm.results[name] = result
+	}
+	result.LastCheck = start.Unix()
+	if err != nil {
+		syntheticFailures.WithLabelValues(name).Inc()
+		syntheticUp.WithLabelValues(name).Set(0)
+		result.ConsecutiveFailures++
+		result.Error = err.Error()
+		// Единичный сбой не переводит интеграцию в нерабочие, чтобы не шуметь в /health
+		if result.ConsecutiveFailures >= cfg.FailureThreshold {
+			if result.Healthy {
+				log.Printf("Synthetic check of %s failing: %v", name, err)
+			}
+			result.Healthy = false
+		}
+		return
+	}
+	syntheticUp.WithLabelValues(name).Set(1)
+	if !result.Healthy {
+		log.Printf("Synthetic check of %s recovered", name)
+	}
+	result.Healthy = true
+	result.LastSuccess = start.Unix()
+	result.ConsecutiveFailures = 0
+	result.Error = ""
+}
+
+// runProbe выполняет проверку, превращая панику в ошибку
+func runProbe(ctx context.Context, p prober) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("probe panicked: %v", r)
+		}
+	}()
+	return p.Probe(ctx)
+}
+
+// Results возвращает итоги проверок по имени интеграции
+func (sm *SyntheticMonitor) Results() []SyntheticResult {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	results := make([]SyntheticResult, 0, len(sm.results))
+	for _, result := range sm.results {
+		results = append(results, *result)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Target < results[j].Target })
+	return results
+}
+
+// Probe проверяет запись и чтение тестового ключа с коротким сроком жизни
+func (rs *redisCacheSink) Probe(ctx context.Context) error {
+	value := time.Now().Format(time.RFC3339Nano)
+	if err := rs.service.redis.Set(ctx, syntheticKey, value, time.Minute).Err(); err != nil {
+		return err
+	}
+	got, err := rs.service.redis.Get(ctx, syntheticKey).Result()
+	if err != nil {
+		return err
+	}
+	if got != value {
+		return fmt.Errorf("read back %q, want %q", got, value)
+	}
+	return nil
+}
+
+// Probe проверяет доступность ClickHouse, учетные данные и наличие таблицы архива
+func (cs *ClickHouseSink) Probe(ctx context.Context) error {
+	return cs.exec(ctx, "SELECT 1 FROM "+cs.table()+" LIMIT 0", nil, "")
+}
+
+// Probe отправляет в Alertmanager уже завершенный тестовый алерт: он проходит
+// API и маршрутизацию, но не приводит к уведомлению дежурного
+func (n *AlertmanagerNotifier) Probe(ctx context.Context) error {
+	now := time.Now().UTC()
+	return n.post(ctx, []alertmanagerAlert{{
+		Labels: map[string]string{
+			"alertname": "HighloadSyntheticCheck",
+			"severity":  "none",
+			"synthetic": "true",
+		},
+		Annotations: map[string]string{
+			"summary": "synthetic delivery check from highload-service",
+		},
+		StartsAt:     now.Add(-time.Second),
+		EndsAt:       &now,
+		GeneratorURL: n.generatorURL,
+	}})
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// centroid представляет группу близких значений в t-digest
+type centroid struct {
+	mean   float64
+	weight float64
+}
+
+// TDigest потоковый скетч квантилей (merging t-digest) с ограниченным объемом памяти.
+// Не потокобезопасен: синхронизация остается на стороне владельца.
+type TDigest struct {
+	compression float64
+	centroids   []centroid
+	buffer      []centroid
+	count       float64
+	min, max    float64
+}
+
+func NewTDigest(compression float64) *TDigest {
+	return &TDigest{
+		compression: compression,
+		min:         math.Inf(1),
+		max:         math.Inf(-1),
+	}
+}
+
+// Add добавляет значение в скетч
+func (t *TDigest) Add(value float64) {
+	t.addCentroid(centroid{mean: value, weight: 1})
+}
+
+func (t *TDigest) addCentroid(c centroid) {
+	t.buffer = append(t.buffer, c)
+	t.count += c.weight
+	t.min = math.Min(t.min, c.mean)
+	t.max = math.Max(t.max, c.mean)
+
+	// Буфер несжатых значений держим в пределах нескольких δ
+	if len(t.buffer) >= int(t.compression)*4 {
+		t.compress()
+	}
+}
+
+// Merge добавляет в скетч все центроиды другого скетча
+func (t *TDigest) Merge(other *TDigest) {
+	for _, c := range other.centroids {
+		t.addCentroid(c)
+	}
+	for _, c := range other.buffer {
+		t.addCentroid(c)
+	}
+	// Средние центроидов лежат внутри диапазона, крайние значения берем из скетча
+	t.min = math.Min(t.min, other.min)
+	t.max = math.Max(t.max, other.max)
+}
+
+// Count возвращает число добавленных значений
+func (t *TDigest) Count() float64 {
+	return t.count
+}
+
+// scale функция масштаба k1: k(q) = δ/(2π)·asin(2q−1)
+func (t *TDigest) scale(q float64) float64 {
+	return t.compression / (2 * math.Pi) * math.Asin(2*q-1)
+}
+
+func (t *TDigest) scaleInverse(k float64) float64 {
+	return (math.Sin(k*2*math.Pi/t.compression) + 1) / 2
+}
+
+func (t *TDigest) compress() {
+	if len(t.buffer) == 0 {
+		return
+	}
+
+	all := append(t.centroids, t.buffer...)
+	sort.Slice(all, func(i, j int) bool { return all[i].mean < all[j].mean })
+
+	merged := make([]centroid, 0, len(t.centroids)+1)
+	current := all[0]
+	weightSoFar := 0.0
+	limit := t.scaleInverse(t.scale(0) + 1)
+	for _, next := range all[1:] {
+		q := (weightSoFar + current.weight + next.weight) / t.count
+		if q <= limit {
+			current.mean += (next.mean - current.mean) * next.weight / (current.weight + next.weight)
+			current.weight += next.weight
+			continue
+		}
+		merged = append(merged, current)
+		weightSoFar += current.weight
+		limit = t.scaleInverse(t.scale(weightSoFar/t.count) + 1)
+		current = next
+	}
+	merged = append(merged, current)
+
+	t.centroids = merged
+	t.buffer = t.buffer[:0]
+}
+
+// Quantile возвращает оценку квантиля q ∈ [0, 1]; для пустого скетча — NaN
+func (t *TDigest) Quantile(q float64) float64 {
+	if t.count == 0 {
+		return math.NaN()
+	}
+	t.compress()
+
+	if q <= 0 {
+		return t.min
+	}
+	if q >= 1 {
+		return t.max
+	}
+	if len(t.centroids) == 1 {
+		return t.centroids[0].mean
+	}
+
+	target := q * t.count
+	first := t.centroids[0]
+	if target < first.weight/2 {
+		return t.min + (first.mean-t.min)*target/(first.weight/2)
+	}
+
+	cumulative := 0.0
+	for i := 0; i < len(t.centroids)-1; i++ {
+		left, right := t.centroids[i], t.centroids[i+1]
+		leftCenter := cumulative + left.weight/2
+		rightCenter := cumulative + left.weight + right.weight/2
+		if target <= rightCenter {
+			ratio := (target - leftCenter) / (rightCenter - leftCenter)
+			return left.mean + (right.mean-left.mean)*ratio
+		}
+		cumulative += left.weight
+	}
+
+	last := t.centroids[len(t.centroids)-1]
+	lastCenter := t.count - last.weight/2
+	return last.mean + (t.max-last.mean)*(target-lastCenter)/(last.weight/2)
+}
+
+// CDF возвращает оценку доли значений не больше x — обратную к Quantile;
+// для пустого скетча — NaN
+func (t *TDigest) CDF(x float64) float64 {
+	if t.count == 0 {
+		return math.NaN()
+	}
+	t.compress()
+
+	if x < t.min {
+		return 0
+	}
+	if x >= t.max {
+		return 1
+	}
+	if len(t.centroids) == 1 {
+		return (x - t.min) / (t.max - t.min)
+	}
+
+	first := t.centroids[0]
+	if x < first.mean {
+		return (x - t.min) / (first.mean - t.min) * first.weight / 2 / t.count
+	}
+
+	cumulative := 0.0
+	for i := 0; i < len(t.centroids)-1; i++ {
+		left, right := t.centroids[i], t.centroids[i+1]
+		leftCenter := cumulative + left.weight/2
+		rightCenter := cumulative + left.weight + right.weight/2
+		if x < right.mean {
+			ratio := (x - left.mean) / (right.mean - left.mean)
+			return (leftCenter + (rightCenter-leftCenter)*ratio) / t.count
+		}
+		cumulative += left.weight
+	}
+
+	last := t.centroids[len(t.centroids)-1]
+	lastCenter := t.count - last.weight/2
+	return (lastCenter + last.weight/2*(x-last.mean)/(t.max-last.mean)) / t.count
+}
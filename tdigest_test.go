@@ -0,0 +1,20 @@
+package main
+
+import "testing"
+
+func TestTDigestMergeKeepsExtremes(t *testing.T) {
+	// При малом сжатии крайние значения попадают в центроиды с весом больше 1
+	part := NewTDigest(5)
+	for i := 0; i < 1000; i++ {
+		part.Add(float64(i))
+	}
+	merged := NewTDigest(deviceSketchCompression)
+	merged.Merge(part)
+	merged.Merge(NewTDigest(deviceSketchCompression))
+	if got := merged.Quantile(0); got != 0 {
+		t.Errorf("p0 = %v, want 0", got)
+	}
+	if got := merged.Quantile(1); got != 999 {
+		t.Errorf("p100 = %v, want 999", got)
+	}
+}
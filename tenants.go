@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// tenantHeader заголовок, которым клиент указывает арендатора; учитывается
+	// только от экземпляров кластера и с tenants.trust_header (см. resolveTenant)
+	tenantHeader  = "X-Tenant-ID"
+	defaultTenant = "default"
+	// otherTenant метка метрик Prometheus для арендаторов без собственной
+	// настройки: заголовок задает клиент, и без этого число рядов не ограничено
+	otherTenant = "other"
+)
+
+// knownMetricKeys ключи JSON, которые понимает модель Metric
+var knownMetricKeys = map[string]bool{
+	"timestamp": true,
+	"device_id": true,
+	"tenant":    true,
+	"values":    true,
+	"cpu":       true,
+	"rps":       true,
+	"memory":    true,
+
+	"trace_id":       true,
+	"deadline_class": true,
+	"received_at":    true,
+	"samples":        true,
+	"ingest_id":      true,
+}
+
+var fieldsDropped = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "highload_fields_dropped_total",
+		Help: "Total number of metric fields dropped by tenant field policies (tenants without a policy are reported as other)",
+	},
+	[]string{"tenant"},
+)
+
+// FieldPolicy ограничивает набор полей, принимаемых от арендатора.
+// Пустой Allow разрешает все поля, Deny применяется после Allow.
+type FieldPolicy struct {
+	Allow             []string `json:"allow" yaml:"allow"`
+	Deny              []string `json:"deny" yaml:"deny"`
+	DenyUnknownFields bool     `json:"deny_unknown_fields" yaml:"deny_unknown_fields"`
+}
+
+// Permits сообщает, принимается ли поле политикой
+func (p FieldPolicy) Permits(field string) bool {
+	if len(p.Allow) > 0 && !containsString(p.Allow, field) {
+		return false
+	}
+	return !containsString(p.Deny, field)
+}
+
+// TenantPolicies политики полей по арендаторам
+type TenantPolicies map[string]FieldPolicy
+
+// LoadTenantPolicies читает политики из JSON файла вида {"tenant": {"allow": [...]}}
+func LoadTenantPolicies(path string) (TenantPolicies, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var policies TenantPolicies
+	if err := json.Unmarshal(data, &policies); err != nil {
+		return nil, fmt.Errorf("parse tenant policies: %w", err)
+	}
+	return policies, nil
+}
+
+// For возвращает политику арендатора, при ее отсутствии — политику по умолчанию
+func (tp TenantPolicies) For(tenant string) FieldPolicy {
+	if policy, ok := tp[tenant]; ok {
+		return policy
+	}
+	return tp[defaultTenant]
+}
+
+// Label возвращает метку арендатора для метрик Prometheus: арендатор с
+// собственной политикой или default, остальные — other
+func (tp TenantPolicies) Label(tenant string) string {
+	if _, ok := tp[tenant]; ok || tenant == defaultTenant {
+		return tenant
+	}
+	return otherTenant
+}
+
+// resolveTenant определяет арендатора метрики по подтвержденной личности
+// отправителя, а не по заголовку, который задает сам клиент: иначе клиент
+// обходит квоту арендатора, указав чужого или несуществующего. Порядок:
+// арендатор токена устройства, ключ API из Authorization, X-Tenant-ID с
+// tenants.trust_header, иначе default. forwarded — запрос переслан экземпляром
+// кластера, который уже определил арендатора и передал его в X-Tenant-ID.
+func (s *Service) resolveTenant(tokenTenant, authorization, claimed string, forwarded bool) string {
+	if forwarded && claimed != "" {
+		return claimed
+	}
+	if tokenTenant != "" {
+		return tokenTenant
+	}
+
+	s.configMu.RLock()
+	cfg := s.config.Tenants
+	s.configMu.RUnlock()
+	if bearer, ok := strings.CutPrefix(authorization, "Bearer "); ok {
+		tenant := ""
+		for _, key := range cfg.APIKeys {
+			// Все ключи сравниваются за постоянное время, как в validToken
+			if subtle.ConstantTimeCompare([]byte(key.Key), []byte(bearer)) == 1 {
+				tenant = key.Tenant
+			}
+		}
+		if tenant != "" {
+			return tenant
+		}
+	}
+	if cfg.TrustHeader && claimed != "" {
+		return claimed
+	}
+	return defaultTenant
+}
+
+// unknownMetricKeys возвращает отсортированные ключи JSON, не входящие в модель Metric
+func unknownMetricKeys(body []byte) ([]string, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, err
+	}
+
+	unknown := make([]string, 0)
+	for key := range raw {
+		if !knownMetricKeys[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown, nil
+}
+
+// restrictFields применяет политику арендатора к полям метрики; label —
+// метка арендатора из TenantPolicies.Label
+func restrictFields(label string, policy FieldPolicy, fields map[string]float64) map[string]float64 {
+	allowed := make(map[string]float64, len(fields))
+	for field, value := range fields {
+		if !policy.Permits(field) {
+			fieldsDropped.WithLabelValues(label).Inc()
+			continue
+		}
+		allowed[field] = value
+	}
+	return allowed
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
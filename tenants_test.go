@@ -0,0 +1,53 @@
+package main
+
+import "testing"
+
+func TestResolveTenantIgnoresUntrustedHeader(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Tenants.APIKeys = []TenantAPIKey{{Tenant: "acme", Key: "acme-key"}}
+	s := &Service{config: cfg}
+
+	for _, tc := range []struct {
+		name          string
+		tokenTenant   string
+		authorization string
+		claimed       string
+		forwarded     bool
+		want          string
+	}{
+		{"header only", "", "", "globex", false, defaultTenant},
+		{"device token", "acme", "", "globex", false, "acme"},
+		{"api key", "", "Bearer acme-key", "globex", false, "acme"},
+		{"unknown api key", "", "Bearer guess", "globex", false, defaultTenant},
+		{"cluster peer", "", "", "acme", true, "acme"},
+	} {
+		if got := s.resolveTenant(tc.tokenTenant, tc.authorization, tc.claimed, tc.forwarded); got != tc.want {
+			t.Errorf("%s: tenant %q, want %q", tc.name, got, tc.want)
+		}
+	}
+
+	cfg.Tenants.TrustHeader = true
+	if got := s.resolveTenant("", "", "globex", false); got != "globex" {
+		t.Errorf("trust_header: tenant %q, want globex", got)
+	}
+}
+
+func TestDeviceTokenAuthenticateTenant(t *testing.T) {
+	ts := NewDeviceTokenStore(nil, DeviceTokensConfig{Mode: DeviceTokensOptional})
+	ts.tokens["dev"] = DeviceToken{DeviceID: "dev", Tenant: "acme", Hash: hashDeviceToken("secret")}
+
+	if tenant, err := ts.Authenticate(SourceTypeHTTP, "dev", "secret"); err != nil || tenant != "acme" {
+		t.Errorf("valid token: tenant %q, err %v", tenant, err)
+	}
+	if tenant, err := ts.Authenticate(SourceTypeHTTP, "dev", "guess"); err == nil || tenant != "" {
+		t.Errorf("invalid token: tenant %q, err %v", tenant, err)
+	}
+	if tenant, err := ts.Authenticate(SourceTypeHTTP, "other", ""); err != nil || tenant != "" {
+		t.Errorf("device without token: tenant %q, err %v", tenant, err)
+	}
+
+	ts.Configure(DeviceTokensConfig{Mode: DeviceTokensOff})
+	if tenant, _ := ts.Authenticate(SourceTypeHTTP, "dev", "secret"); tenant != "" {
+		t.Errorf("tenant %q taken from an unchecked token", tenant)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	tlsCertificateExpiry = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "highload_tls_certificate_expiry_timestamp_seconds",
+		Help: "Expiry time of the TLS certificate currently served",
+	})
+
+	tlsCertificateReloads = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "highload_tls_certificate_reloads_total",
+			Help: "Total number of TLS certificate reloads by result (success, error)",
+		},
+		[]string{"result"},
+	)
+)
+
+// tlsVersions допустимые значения tls.min_version
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// CertReloader отдает сертификат сервера и перечитывает пару файлов при их
+// изменении и по SIGHUP, не прерывая установленные соединения. Если новая
+// пара не загружается, продолжает отдаваться прежний сертификат.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	interval time.Duration
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// NewCertReloader загружает сертификат; ошибка означает, что HTTPS поднять нельзя
+func NewCertReloader(cfg TLSConfig) (*CertReloader, error) {
+	cr := &CertReloader{certFile: cfg.CertFile, keyFile: cfg.KeyFile, interval: cfg.ReloadInterval}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// GetCertificate реализует tls.Config.GetCertificate
+func (cr *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, nil
+}
+
+// filesModTime возвращает время последнего изменения сертификата или ключа
+func (cr *CertReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{cr.certFile, cr.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (cr *CertReloader) reload() error {
+	modTime, err := cr.filesModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	cert.Leaf = leaf
+
+	cr.mu.Lock()
+	cr.cert = &cert
+	cr.modTime = modTime
+	cr.mu.Unlock()
+
+	tlsCertificateExpiry.Set(float64(leaf.NotAfter.Unix()))
+	log.Printf("Loaded TLS certificate for %v, valid until %s", leaf.DNSNames, leaf.NotAfter.UTC().Format(time.RFC3339))
+	return nil
+}
+
+// Run перечитывает сертификат по SIGHUP и, если задан интервал, при изменении файлов
+func (cr *CertReloader) Run() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if cr.interval > 0 {
+		ticker := time.NewTicker(cr.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-hup:
+		case <-tick:
+			modTime, err := cr.filesModTime()
+			cr.mu.RLock()
+			unchanged := err == nil && !modTime.After(cr.modTime)
+			cr.mu.RUnlock()
+			if unchanged {
+				continue
+			}
+		}
+
+		// Файлы обычно заменяются по одному: при ошибке повторим на следующей проверке
+		if err := cr.reload(); err != nil {
+			tlsCertificateReloads.WithLabelValues("error").Inc()
+			log.Printf("TLS certificate reload failed, keeping previous certificate: %v", err)
+			continue
+		}
+		tlsCertificateReloads.WithLabelValues("success").Inc()
+	}
+}
+
+// serverTLSConfig параметры TLS для HTTP-серверов
+func serverTLSConfig(cfg TLSConfig, certs *CertReloader) *tls.Config {
+	return &tls.Config{
+		MinVersion:     tlsVersions[cfg.MinVersion],
+		GetCertificate: certs.GetCertificate,
+	}
+}
+
+// serve обслуживает слушатель; TCP-слушатели серверов с TLS обслуживаются по
+// HTTPS, unix-сокеты остаются открытыми для локального reverse proxy
+func serve(server *http.Server, l net.Listener) error {
+	if server.TLSConfig != nil && l.Addr().Network() == "tcp" {
+		return server.ServeTLS(l, "", "")
+	}
+	return server.Serve(l)
+}
+
+// httpsRedirectServer отвечает на HTTP-запросы перенаправлением на HTTPS-порт
+func httpsRedirectServer(cfg TLSConfig, server ServerConfig) (listenerServer, error) {
+	httpsPort := server.Port
+	l, err := net.Listen("tcp", ":"+cfg.RedirectPort)
+	if err != nil {
+		return listenerServer{}, fmt.Errorf("https redirect: %w", err)
+	}
+	log.Printf("Redirecting HTTP on %s to HTTPS port %s", l.Addr(), httpsPort)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := strings.Trim(r.Host, "[]")
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+		target := "https://" + host + r.URL.RequestURI()
+		// 308 сохраняет метод и тело: POST метрик не превращается в GET
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	})
+	return listenerServer{
+		name:      "https-redirect",
+		server:    newHTTPServer(server, handler),
+		listeners: []net.Listener{l},
+	}, nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Размер ответа /api/devices/top
+const (
+	defaultTopDevices = 20
+	maxTopDevices     = 1000
+)
+
+// TopByAnomalies ранжирование по числу аномалий; иначе by — имя поля
+const TopByAnomalies = "anomalies"
+
+// TopDevice устройство в ответе /api/devices/top
+type TopDevice struct {
+	DeviceID string `json:"device_id"`
+	// Value число аномалий или среднее значение поля за окно
+	Value float64 `json:"value"`
+	// Samples число значений поля за окно; для аномалий не заполняется
+	Samples int64 `json:"samples,omitempty"`
+}
+
+// Totals читает агрегаты интервалов поля устройств, начинающихся в
+// [from, to], одним конвейером и сводит их по устройствам
+func (ra *RollupAggregator) Totals(ctx context.Context, devices []string, field string, from, to int64) (map[string]aggregate, error) {
+	step := int64(ra.cfg.Resolution / time.Second)
+	pipe := ra.redis.Pipeline()
+	cmds := make(map[string][]*redis.StringStringMapCmd, len(devices))
+	for _, deviceID := range devices {
+		for start := ra.bucketStart(from); start <= to; start += step {
+			cmds[deviceID] = append(cmds[deviceID], pipe.HGetAll(ctx, ra.bucketKey(deviceID, field, start)))
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	totals := make(map[string]aggregate, len(devices))
+	for deviceID, deviceCmds := range cmds {
+		var total aggregate
+		for _, cmd := range deviceCmds {
+			values := cmd.Val()
+			count, _ := strconv.ParseInt(values["count"], 10, 64)
+			if count == 0 {
+				continue
+			}
+			a := aggregate{count: count}
+			a.sum, _ = strconv.ParseFloat(values["sum"], 64)
+			a.min, _ = strconv.ParseFloat(values["min"], 64)
+			a.max, _ = strconv.ParseFloat(values["max"], 64)
+			total.merge(a)
+		}
+		if total.count > 0 {
+			totals[deviceID] = total
+		}
+	}
+	return totals, nil
+}
+
+// TopDevicesHandler возвращает n устройств с наибольшим числом аномалий или
+// наибольшим средним значением поля за последние window:
+// GET /api/devices/top?by=anomalies|cpu|rps&window=1h&n=20. Аномалии берутся
+// из истории, средние — из агрегатов интервалов, если они включены, иначе из
+// буфера. Кандидаты — устройства в буфере и устройства с аномалиями за окно.
+func (s *Service) TopDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	by := query.Get("by")
+	if by == "" {
+		by = TopByAnomalies
+	}
+	if by != TopByAnomalies && !validFieldName(by) {
+		http.Error(w, "by must be anomalies or a field name", http.StatusBadRequest)
+		return
+	}
+
+	window := time.Hour
+	if raw := query.Get("window"); raw != "" {
+		parsed, err := time.ParseDuration(raw)
+		if err != nil || parsed < time.Second {
+			http.Error(w, "window must be a duration of at least 1s", http.StatusBadRequest)
+			return
+		}
+		window = parsed
+	}
+
+	n := defaultTopDevices
+	if raw := query.Get("n"); raw != "" {
+		var err error
+		n, err = strconv.Atoi(raw)
+		if err != nil || n < 1 || n > maxTopDevices {
+			http.Error(w, "n must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+	}
+
+	to := time.Now().Unix()
+	from := to - int64(window/time.Second)
+	anomalies := make(map[string]int)
+	for _, anomaly := range s.anomalies.Query(AnomalyFilter{From: from, To: to}) {
+		anomalies[anomaly.DeviceID]++
+	}
+
+	source := AggregateSourceBuffer
+	top := make([]TopDevice, 0)
+	if by == TopByAnomalies {
+		source = TopByAnomalies
+		for deviceID, count := range anomalies {
+			top = append(top, TopDevice{DeviceID: deviceID, Value: float64(count)})
+		}
+	} else {
+		devices := s.metricsBuffer.Devices()
+		buffered := make(map[string]bool, len(devices))
+		for _, deviceID := range devices {
+			buffered[deviceID] = true
+		}
+		for deviceID := range anomalies {
+			if !buffered[deviceID] {
+				devices = append(devices, deviceID)
+			}
+		}
+
+		totals := make(map[string]aggregate, len(devices))
+		rollups := s.rollups.cfg
+		if rollups.Enabled {
+			source = AggregateSourceRollups
+			// Агрегаты старше retention уже удалены, их не читаем
+			readFrom := max(from, time.Now().Add(-rollups.Retention-rollups.Resolution).Unix())
+			if int64(len(devices))*((to-readFrom)/int64(rollups.Resolution/time.Second)+1) > maxRollupReads {
+				http.Error(w, "window is too wide for rollups, narrow it", http.StatusBadRequest)
+				return
+			}
+			var err error
+			if totals, err = s.rollups.Totals(r.Context(), devices, by, readFrom, to); err != nil {
+				http.Error(w, "failed to read rollups: "+err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		} else {
+			for _, deviceID := range devices {
+				var total aggregate
+				for _, point := range s.metricsBuffer.Points(deviceID, by) {
+					if point.Timestamp >= from && point.Timestamp <= to {
+						total.add(point.Value)
+					}
+				}
+				if total.count > 0 {
+					totals[deviceID] = total
+				}
+			}
+		}
+		for deviceID, total := range totals {
+			top = append(top, TopDevice{DeviceID: deviceID, Value: total.value(AggregateAvg), Samples: total.count})
+		}
+	}
+
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Value != top[j].Value {
+			return top[i].Value > top[j].Value
+		}
+		return top[i].DeviceID < top[j].DeviceID
+	})
+	total := len(top)
+	top = top[:min(n, total)]
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"by":      by,
+		"window":  window.String(),
+		"from":    from,
+		"to":      to,
+		"source":  source,
+		"total":   total,
+		"devices": top,
+	})
+}
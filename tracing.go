@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// traceExemplarLabel имя метки exemplar с идентификатором трассы
+const traceExemplarLabel = "trace_id"
+
+// traceContext формат W3C Trace Context (заголовок traceparent)
+var traceContext = propagation.TraceContext{}
+
+// withTraceContext переносит контекст трассы из заголовков запроса в его контекст.
+// Если span уже создан инструментированием выше по цепочке, контекст не меняется.
+func withTraceContext(r *http.Request) *http.Request {
+	if trace.SpanContextFromContext(r.Context()).IsValid() {
+		return r
+	}
+	ctx := traceContext.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	if ctx == r.Context() {
+		return r
+	}
+	return r.WithContext(ctx)
+}
+
+// traceID возвращает идентификатор трассы из контекста OpenTelemetry или пустую строку
+func traceID(ctx context.Context) string {
+	if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+		return sc.TraceID().String()
+	}
+	return ""
+}
+
+// traceExemplar возвращает метки exemplar для трассы; nil, если трассы нет
+func traceExemplar(traceID string) prometheus.Labels {
+	if traceID == "" {
+		return nil
+	}
+	return prometheus.Labels{traceExemplarLabel: traceID}
+}
+
+// observeWithTrace записывает значение в гистограмму с exemplar трассы, если она известна
+func observeWithTrace(observer prometheus.Observer, value float64, traceID string) {
+	if eo, ok := observer.(prometheus.ExemplarObserver); ok && traceID != "" {
+		eo.ObserveWithExemplar(value, traceExemplar(traceID))
+		return
+	}
+	observer.Observe(value)
+}
+
+// incWithTrace увеличивает счетчик с exemplar трассы, если она известна
+func incWithTrace(counter prometheus.Counter, traceID string) {
+	if ea, ok := counter.(prometheus.ExemplarAdder); ok && traceID != "" {
+		ea.AddWithExemplar(1, traceExemplar(traceID))
+		return
+	}
+	counter.Inc()
+}
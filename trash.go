@@ -0,0 +1,105 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Виды удаленных данных в корзине
+const (
+	TrashKindBuffer = "buffer"
+	TrashKindDevice = "device"
+)
+
+// TrashEntry описывает удаленные данные, которые можно восстановить до ExpiresAt
+type TrashEntry struct {
+	ID        string `json:"id"`
+	Kind      string `json:"kind"`
+	DeviceID  string `json:"device_id"`
+	DeletedAt int64  `json:"deleted_at"`
+	ExpiresAt int64  `json:"expires_at"`
+
+	restore func()
+}
+
+// Trash хранит результаты деструктивных административных операций в течение окна хранения
+type Trash struct {
+	mu        sync.Mutex
+	entries   map[string]*TrashEntry
+	retention time.Duration
+}
+
+func NewTrash(retention time.Duration) *Trash {
+	return &Trash{
+		entries:   make(map[string]*TrashEntry),
+		retention: retention,
+	}
+}
+
+// SetRetention меняет срок хранения для новых записей
+func (t *Trash) SetRetention(retention time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.retention = retention
+}
+
+// Put помещает удаленные данные в корзину; restore возвращает их на место
+func (t *Trash) Put(kind, deviceID string, restore func()) TrashEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	t.prune(now)
+
+	entry := &TrashEntry{
+		ID:        newID(),
+		Kind:      kind,
+		DeviceID:  deviceID,
+		DeletedAt: now.Unix(),
+		ExpiresAt: now.Add(t.retention).Unix(),
+		restore:   restore,
+	}
+	t.entries[entry.ID] = entry
+	return *entry
+}
+
+// Restore восстанавливает данные записи и удаляет ее из корзины
+func (t *Trash) Restore(id string) (TrashEntry, bool) {
+	t.mu.Lock()
+	t.prune(time.Now())
+	entry, exists := t.entries[id]
+	if exists {
+		delete(t.entries, id)
+	}
+	t.mu.Unlock()
+
+	if !exists {
+		return TrashEntry{}, false
+	}
+	entry.restore()
+	return *entry, true
+}
+
+// List возвращает записи корзины от новых к старым
+func (t *Trash) List() []TrashEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.prune(time.Now())
+	entries := make([]TrashEntry, 0, len(t.entries))
+	for _, entry := range t.entries {
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].DeletedAt > entries[j].DeletedAt })
+	return entries
+}
+
+// prune окончательно удаляет просроченные записи; вызывается под блокировкой
+func (t *Trash) prune(now time.Time) {
+	for id, entry := range t.entries {
+		if entry.ExpiresAt <= now.Unix() {
+			delete(t.entries, id)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// AnomalyTypeTrend устойчивый линейный рост или спад значения (утечка)
+const AnomalyTypeTrend = "trend"
+
+// Направления тренда
+const (
+	TrendDirectionUp   = "up"
+	TrendDirectionDown = "down"
+	TrendDirectionBoth = "both"
+)
+
+// TrendInfo линейная регрессия значений поля по времени
+type TrendInfo struct {
+	// Slope изменение значения в час по линии тренда
+	Slope     float64 `json:"slope_per_hour"`
+	RSquared  float64 `json:"r_squared"`
+	Samples   int     `json:"samples"`
+	SpanHours float64 `json:"span_hours"`
+	// Start и End значения линии тренда в начале и конце окна
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+	// Rise изменение по линии тренда за окно относительно начального уровня
+	Rise float64 `json:"rise"`
+}
+
+// fitTrend строит линию тренда по значениям; время — в часах от первого значения
+func fitTrend(points []Point) TrendInfo {
+	info := TrendInfo{Samples: len(points)}
+	if len(points) < 2 {
+		return info
+	}
+	first := points[0].Timestamp
+	xs := make([]float64, len(points))
+	ys := make([]float64, len(points))
+	for i, point := range points {
+		xs[i] = float64(point.Timestamp-first) / 3600
+		ys[i] = point.Value
+	}
+	fit := fitLinear(xs, ys)
+	info.Slope = fit.Slope
+	info.RSquared = fit.Coefficient * fit.Coefficient
+	info.SpanHours = xs[len(xs)-1]
+	info.Start = fit.Intercept
+	info.End = fit.Intercept + fit.Slope*info.SpanHours
+	// Защита от деления на нулевой начальный уровень
+	info.Rise = (info.End - info.Start) / math.Max(math.Abs(info.Start), 1e-9)
+	return info
+}
+
+// sustained сообщает, что тренд достаточно длинный, линейный и крутой
+func (t TrendInfo) sustained(cfg TrendConfig) bool {
+	if t.Samples < cfg.MinSamples || t.RSquared < cfg.MinRSquared {
+		return false
+	}
+	switch cfg.Direction {
+	case TrendDirectionDown:
+		return t.Rise <= -cfg.MinRise
+	case TrendDirectionBoth:
+		return math.Abs(t.Rise) >= cfg.MinRise
+	default:
+		return t.Rise >= cfg.MinRise
+	}
+}
+
+// TrendDetector ищет медленные утечки, которые не превышают мгновенных
+// порогов: по последним window значениям поля строится линейная регрессия, и
+// рост считается аномалией, когда прямая объясняет не меньше min_r_squared
+// дисперсии, а подъем по ней за окно не меньше min_rise от начального уровня.
+// Тренд сообщается один раз при появлении; следующий — после того, как
+// условие перестанет выполняться.
+type TrendDetector struct {
+	fieldSet
+	buffer *MetricsBuffer
+	cfg    TrendConfig
+
+	mu     sync.Mutex
+	active map[string]map[string]bool // device_id -> field -> тренд уже сообщен
+}
+
+func NewTrendDetector(buffer *MetricsBuffer, cfg TrendConfig) *TrendDetector {
+	return &TrendDetector{
+		fieldSet: newFieldSet(cfg.Fields...),
+		buffer:   buffer,
+		cfg:      cfg,
+		active:   make(map[string]map[string]bool),
+	}
+}
+
+func (d *TrendDetector) Name() string { return AnomalyTypeTrend }
+
+// window возвращает последние значения поля для регрессии
+func (d *TrendDetector) window(deviceID, field string) []Point {
+	points := d.buffer.Points(deviceID, field)
+	if len(points) > d.cfg.Window {
+		points = points[len(points)-d.cfg.Window:]
+	}
+	return points
+}
+
+func (d *TrendDetector) Detect(deviceID, field string, point Point) *AnalyticsResult {
+	points := d.window(deviceID, field)
+	if len(points) < d.cfg.MinSamples {
+		return nil
+	}
+	trend := fitTrend(points)
+	sustained := trend.sustained(d.cfg)
+
+	d.mu.Lock()
+	fields, ok := d.active[deviceID]
+	if !ok {
+		fields = make(map[string]bool)
+		d.active[deviceID] = fields
+	}
+	onset := sustained && !fields[field]
+	fields[field] = sustained
+	d.mu.Unlock()
+
+	var sum float64
+	for _, p := range points {
+		sum += p.Value
+	}
+	return &AnalyticsResult{
+		DeviceID:       deviceID,
+		Field:          field,
+		Type:           AnomalyTypeTrend,
+		RollingAverage: sum / float64(len(points)),
+		IsAnomaly:      onset,
+		Timestamp:      point.Timestamp,
+		Value:          point.Value,
+		OnsetTimestamp: points[0].Timestamp,
+		Trend:          &trend,
+	}
+}
+
+// State возвращает тренды полей устройства по текущему окну
+func (d *TrendDetector) State(deviceID string) map[string]interface{} {
+	fields, _ := d.buffer.DeviceStats(deviceID)
+	state := make(map[string]interface{}, len(fields))
+	for field := range fields {
+		if d.Applies(field) {
+			state[field] = fitTrend(d.window(deviceID, field))
+		}
+	}
+	return state
+}
+
+func (d *TrendDetector) Reset(deviceID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.active, deviceID)
+}
+
+// FieldTrend тренд поля в ответе /api/analyze/trend
+type FieldTrend struct {
+	Field string `json:"field"`
+	TrendInfo
+	// Sustained тренд удовлетворяет порогам детектора trend
+	Sustained bool `json:"sustained"`
+}
+
+// TrendHandler возвращает линейные тренды полей устройства по последним
+// window значениям (по умолчанию detectors.trend.window); field ограничивает
+// ответ одним полем
+func (s *Service) TrendHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	deviceID := query.Get("device_id")
+	if deviceID == "" {
+		http.Error(w, "device_id is required", http.StatusBadRequest)
+		return
+	}
+
+	s.configMu.RLock()
+	cfg := s.config.Detectors.Trend
+	maxSize := s.config.Buffer.MaxSize
+	s.configMu.RUnlock()
+	if raw := query.Get("window"); raw != "" {
+		window, err := strconv.Atoi(raw)
+		if err != nil || window < 2 || window > maxSize {
+			http.Error(w, "window must be between 2 and buffer.max_size", http.StatusBadRequest)
+			return
+		}
+		cfg.Window = window
+	}
+
+	snapshot := s.metricsBuffer.DeviceSnapshot(deviceID)
+	if len(snapshot) == 0 {
+		http.Error(w, "device not found", http.StatusNotFound)
+		return
+	}
+	field := query.Get("field")
+	if _, ok := snapshot[field]; field != "" && !ok {
+		http.Error(w, "field not found", http.StatusNotFound)
+		return
+	}
+
+	trends := make([]FieldTrend, 0, len(snapshot))
+	for name, points := range snapshot {
+		if field != "" && name != field {
+			continue
+		}
+		if len(points) > cfg.Window {
+			points = points[len(points)-cfg.Window:]
+		}
+		trend := fitTrend(points)
+		trends = append(trends, FieldTrend{Field: name, TrendInfo: trend, Sustained: trend.sustained(cfg)})
+	}
+	sort.Slice(trends, func(i, j int) bool { return trends[i].Field < trends[j].Field })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"device_id": deviceID,
+		"window":    cfg.Window,
+		"trends":    trends,
+	})
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// maxUDPPacketSize максимальный размер датаграммы, которую читает слушатель
+const maxUDPPacketSize = 65535
+
+var (
+	udpPacketsReceived = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "highload_udp_packets_received_total",
+			Help: "Total number of UDP packets received",
+		},
+	)
+
+	udpPacketsDropped = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "highload_udp_packets_dropped_total",
+			Help: "Total number of UDP packets dropped because the worker queue was full",
+		},
+	)
+
+	udpLinesParsed = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "highload_udp_lines_total",
+			Help: "Total number of UDP protocol lines by parse result",
+		},
+		[]string{"result"},
+	)
+)
+
+// UDPListener принимает метрики в компактном строковом формате
+// device_id:cpu|mem|rps[|ts], по одной метрике на строку
+type UDPListener struct {
+	conn    *net.UDPConn
+	service *Service
+	packets chan []byte
+}
+
+// StartUDPListener открывает UDP сокет и запускает чтение и workers разбора
+func StartUDPListener(addr string, readBuffer, workers int, service *Service) (*UDPListener, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	if readBuffer > 0 {
+		if err := conn.SetReadBuffer(readBuffer); err != nil {
+			log.Printf("Warning: failed to set UDP read buffer to %d: %v", readBuffer, err)
+		}
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	l := &UDPListener{
+		conn:    conn,
+		service: service,
+		packets: make(chan []byte, workers*256),
+	}
+	for i := 0; i < workers; i++ {
+		goSupervised("udp worker", l.worker)
+	}
+	goSupervised("udp reader", l.readLoop)
+
+	return l, nil
+}
+
+func (l *UDPListener) readLoop() {
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		n, _, err := l.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("UDP read error: %v", err)
+			continue
+		}
+		udpPacketsReceived.Inc()
+
+		packet := make([]byte, n)
+		copy(packet, buf[:n])
+		select {
+		case l.packets <- packet:
+		default:
+			// Очередь заполнена — при всплеске отбрасываем пакет, а не блокируем чтение
+			udpPacketsDropped.Inc()
+		}
+	}
+}
+
+func (l *UDPListener) worker() {
+	for packet := range l.packets {
+		recordConsumed("udp", 1)
+		policy := l.service.policyFor(defaultTenant)
+		for _, line := range strings.Split(string(packet), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+			l.service.pipeline.Accepts(SourceTypeUDP)
+			metric, err := parseUDPLine(line)
+			if err == nil {
+				err = metric.Validate(l.service.maxFields(), l.service.maxSamples())
+			}
+			if err != nil {
+				udpLinesParsed.WithLabelValues("error").Inc()
+				continue
+			}
+			udpLinesParsed.WithLabelValues("ok").Inc()
+			// Значение вне объявленного диапазона учитывается в highload_field_violations_total
+			if l.service.fields.Check(metric) != nil {
+				continue
+			}
+			// В строке udp нет токена; отказ учитывается в highload_device_token_rejections_total
+			if l.service.deviceTokens.Verify(SourceTypeUDP, metric.DeviceID, "") != nil {
+				continue
+			}
+
+			if owner, local := l.service.cluster.Owner(metric.DeviceID); !local &&
+				l.service.cluster.ForwardUDP(l.service.ctx, owner, metric) {
+				continue
+			}
+
+			// При перегрузке строка отбрасывается; учитывается в highload_shed_requests_total
+			if !l.service.admission.Admit(SourceTypeUDP, metric.DeviceID) {
+				continue
+			}
+			// Сверх квоты строка отбрасывается; учитывается в highload_quota_rejected_total
+			if !l.service.quotas.Allow(defaultTenant, metric.DeviceID).Allowed {
+				continue
+			}
+			if l.service.dedup.Duplicate(l.service.ctx, SourceTypeUDP, defaultTenant, "", metric) {
+				continue
+			}
+			metric.Tenant = defaultTenant
+			l.service.submit(l.service.ctx, SourceTypeUDP, metric, restrictFields(defaultTenant, policy, metric.Fields()))
+		}
+	}
+}
+
+// Close останавливает прием пакетов
+func (l *UDPListener) Close() error {
+	return l.conn.Close()
+}
+
+// parseUDPLine разбирает строку вида device_id:cpu|mem|rps[|ts]
+func parseUDPLine(line string) (Metric, error) {
+	sep := strings.LastIndexByte(line, ':')
+	if sep <= 0 {
+		return Metric{}, fmt.Errorf("missing device_id in %q", line)
+	}
+
+	parts := strings.Split(line[sep+1:], "|")
+	if len(parts) != 3 && len(parts) != 4 {
+		return Metric{}, fmt.Errorf("expected 3 or 4 values, got %d", len(parts))
+	}
+
+	values := make([]float64, 3)
+	for i := range values {
+		value, err := strconv.ParseFloat(parts[i], 64)
+		if err != nil {
+			return Metric{}, fmt.Errorf("invalid value %q: %w", parts[i], err)
+		}
+		// NaN и Inf делают статистику окна NaN, а ответы JSON — невалидными
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return Metric{}, fmt.Errorf("invalid value %q: not finite", parts[i])
+		}
+		values[i] = value
+	}
+
+	metric := Metric{
+		DeviceID: line[:sep],
+		Values: map[string]float64{
+			"cpu":    values[0],
+			"memory": values[1],
+			"rps":    values[2],
+		},
+	}
+	if len(parts) == 4 {
+		ts, err := strconv.ParseInt(parts[3], 10, 64)
+		if err != nil {
+			return Metric{}, fmt.Errorf("invalid timestamp %q: %w", parts[3], err)
+		}
+		if ts < 0 {
+			return Metric{}, fmt.Errorf("negative timestamp %d", ts)
+		}
+		metric.Timestamp = ts
+	}
+	return metric, nil
+}
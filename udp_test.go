@@ -0,0 +1,14 @@
+package main
+
+import "testing"
+
+func TestParseUDPLineRejectsNonFinite(t *testing.T) {
+	for _, line := range []string{"dev:NaN|1|1", "dev:1|Inf|1", "dev:1|1|-Inf|1700000000"} {
+		if _, err := parseUDPLine(line); err == nil {
+			t.Errorf("%q accepted", line)
+		}
+	}
+	if _, err := parseUDPLine("dev:1|2.5|3|1700000000"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"embed"
+	"net/http"
+)
+
+// uiFiles встроенная страница панели /ui; данные она берет из /api/devices,
+// /api/devices/{device_id}/series и потока /api/anomalies/stream
+//
+//go:embed ui/index.html
+var uiFiles embed.FS
+
+// UIHandler отдает встроенную панель мониторинга
+func UIHandler(w http.ResponseWriter, r *http.Request) {
+	page, err := uiFiles.ReadFile("ui/index.html")
+	if err != nil {
+		http.Error(w, "dashboard is not available", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(page)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// metricCacheKeyPattern ключи метрик, кэшируемых приемником redis_cache
+const metricCacheKeyPattern = "metric:*"
+
+var (
+	warmupDuration = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "highload_warmup_duration_seconds",
+		Help: "Duration of the startup warmup of the metrics buffer from the Redis cache",
+	})
+
+	warmupSamples = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "highload_warmup_samples_restored_total",
+		Help: "Total number of field values restored into the metrics buffer by startup warmup",
+	})
+)
+
+// Backfill добавляет в буфер значения, полученные не в порядке поступления
+// (прогрев из кэша идет параллельно с приемом новых метрик). Значения
+// упорядочиваются по времени, при совпадении метки остается уже имеющееся.
+// Возвращает число добавленных значений.
+func (mb *MetricsBuffer) Backfill(deviceID, field string, points []Point) int {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	defer mb.account(deviceID)
+
+	fields, exists := mb.data[deviceID]
+	if !exists {
+		fields = make(map[string][]Point)
+		mb.data[deviceID] = fields
+	}
+	mb.touch(deviceID)
+	existing := fields[field]
+	had := make(map[int64]bool, len(existing))
+	for _, point := range existing {
+		had[point.Timestamp] = true
+	}
+
+	merged := append(make([]Point, 0, len(existing)+len(points)), existing...)
+	for _, point := range points {
+		if had[point.Timestamp] {
+			continue
+		}
+		had[point.Timestamp] = true
+		merged = append(merged, point)
+	}
+	if len(merged) == len(existing) {
+		return 0
+	}
+	sort.SliceStable(merged, func(i, j int) bool { return merged[i].Timestamp < merged[j].Timestamp })
+	if len(merged) > mb.maxSize {
+		merged = merged[len(merged)-mb.maxSize:]
+	}
+	added := len(merged)
+	for _, point := range existing {
+		if merged[0].Timestamp <= point.Timestamp {
+			added--
+		}
+	}
+	fields[field] = merged
+	return added
+}
+
+// warmupBuffer заполняет буфер метриками из кэша Redis, чтобы сразу после
+// перезапуска детекторам хватало истории. Выполняется в фоне: прием метрик
+// не ждет окончания прогрева.
+func (s *Service) warmupBuffer() {
+	s.configMu.RLock()
+	cfg := s.config.Warmup
+	s.configMu.RUnlock()
+
+	ctx, cancel := context.WithTimeout(s.ctx, cfg.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	if s.cluster.Enabled() {
+		// Без актуального кольца все устройства считались бы своими
+		if err := s.cluster.heartbeat(ctx); err != nil {
+			log.Printf("Warmup skipped: cluster membership unknown: %v", err)
+			return
+		}
+	}
+
+	cutoff := time.Now().Add(-cfg.MaxAge).Unix()
+	points := make(map[string]map[string][]Point) // device_id -> field -> значения
+	err := scanKeys(ctx, s.redis, metricCacheKeyPattern, int64(cfg.ScanCount), func(keys []string) error {
+		return s.loadCachedMetrics(ctx, warmupKeys(keys, cutoff), points)
+	})
+	if err != nil {
+		log.Printf("Warmup aborted: %v", err)
+	}
+
+	restored, devices := 0, 0
+	for deviceID, fields := range points {
+		if _, local := s.cluster.Owner(deviceID); !local {
+			continue
+		}
+		devices++
+		for field, values := range fields {
+			restored += s.metricsBuffer.Backfill(deviceID, field, values)
+		}
+	}
+
+	elapsed := time.Since(start)
+	warmupDuration.Set(elapsed.Seconds())
+	warmupSamples.Add(float64(restored))
+	log.Printf("Warmup restored %d values for %d devices in %s", restored, devices, elapsed.Round(time.Millisecond))
+}
+
+// warmupKeys оставляет ключи metric:<device_id>:<timestamp> не старше cutoff
+func warmupKeys(keys []string, cutoff int64) []string {
+	recent := keys[:0]
+	for _, key := range keys {
+		i := strings.LastIndexByte(key, ':')
+		ts, err := strconv.ParseInt(key[i+1:], 10, 64)
+		if err != nil || ts < cutoff {
+			continue
+		}
+		recent = append(recent, key)
+	}
+	return recent
+}
+
+// loadCachedMetrics читает метрики по ключам и раскладывает значения по устройствам и полям
+func (s *Service) loadCachedMetrics(ctx context.Context, keys []string, points map[string]map[string][]Point) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	// Конвейер GET вместо MGET: в Redis Cluster ключи разных устройств лежат в разных слотах
+	pipe := s.redis.Pipeline()
+	cmds := make([]*redis.StringCmd, len(keys))
+	for i, key := range keys {
+		cmds[i] = pipe.Get(ctx, key)
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return err
+	}
+	for _, cmd := range cmds {
+		data, err := cmd.Result()
+		if err != nil {
+			// Ключ истек между SCAN и GET
+			continue
+		}
+		var metric Metric
+		if err := json.Unmarshal([]byte(data), &metric); err != nil || metric.DeviceID == "" {
+			continue
+		}
+		fields, exists := points[metric.DeviceID]
+		if !exists {
+			fields = make(map[string][]Point)
+			points[metric.DeviceID] = fields
+		}
+		for field, value := range metric.Values {
+			fields[field] = append(fields[field], Point{Timestamp: metric.Timestamp, Value: value})
+		}
+	}
+	return nil
+}